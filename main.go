@@ -1,22 +1,163 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/contactless/wb-rules/wbrules"
 	"github.com/contactless/wbgo"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const DRIVER_CLIENT_ID = "rules"
 
+// runTestScenario runs the test scenario against
+// the scripts and returns the exit code
+func runTestScenario(path string, roots []string) int {
+	steps, err := wbrules.ReadTestScenario(path)
+	if err != nil {
+		wbgo.Error.Fatal(err)
+	}
+	h, err := wbrules.NewRuleTestHarness()
+	if err != nil {
+		wbgo.Error.Fatal(err)
+	}
+	defer h.Close()
+	for _, root := range roots {
+		if err := h.LoadScripts(root); err != nil {
+			wbgo.Error.Fatalf("error loading scripts: %s", err)
+		}
+	}
+	h.Start()
+	failures := h.Run(steps)
+	for _, failure := range failures {
+		fmt.Printf("%s: %s\n", path, failure)
+	}
+	if len(failures) > 0 {
+		fmt.Println("FAIL")
+		return 1
+	}
+	fmt.Println("PASS")
+	return 0
+}
+
 func main() {
 	brokerAddress := flag.String("broker", "tcp://localhost:1883", "MQTT broker url")
+	instanceID := flag.String("instance", "", "Instance id for running several engines against the same broker")
 	editDir := flag.String("editdir", "", "Editable script directory")
 	debug := flag.Bool("debug", false, "Enable debugging")
 	useSyslog := flag.Bool("syslog", false, "Use syslog for logging")
 	mqttDebug := flag.Bool("mqttdebug", false, "Enable MQTT debugging")
+	coalesceWrites := flag.Bool("coalesce-writes", false, "Publish only the final value of cells written several times during a rule pass")
+	scriptSwitches := flag.Bool("script-switches", false, "Add switches for enabling and disabling the scripts under -editdir to the wbrules device")
+	scriptLogLevels := flag.Bool("script-log-levels", false, "Add cells setting the log levels of the scripts under -editdir to the wbrules_log_levels device")
+	logSuppressedWrites := flag.Bool("log-suppressed-writes", false, "Log cell writes suppressed due to write coalescing")
+	deferWrites := flag.Bool("defer-writes", false, "Apply cell writes made by rules after all the rules of a rule pass are checked")
+	persistentDB := flag.String("persistent-db", "/var/lib/wb-rules/persistent.json", "Persistent storage file (empty = don't persist values)")
+	persistentBackend := flag.String("persistent-backend", wbrules.STORAGE_BACKEND_JSON, "Persistent storage backend (json, bolt or sqlite; bolt and sqlite require the corresponding build tags)")
+	persistentFlushInterval := flag.Duration("persistent-flush-interval", 30*time.Second, "Interval between persistent storage writes (0 = write immediately)")
+	restrictedDirs := flag.String("restricted-dirs", "", "Comma-separated list of directories with untrusted scripts")
+	restrictedTimeLimit := flag.Duration("restricted-time-limit", wbrules.DEFAULT_MAX_CALLBACK_TIME, "Max duration of a single callback of an untrusted script")
+	apiTokens := flag.String("api-tokens", "", "API token file for the cell setting RPC (empty = RPC disabled)")
+	metricsAddr := flag.String("metrics", "", "Listen address of the Prometheus metrics endpoint, e.g. :9101 (empty = disabled)")
+	httpAPIAddr := flag.String("http-api", "", "Listen address of the HTTP rule management API, e.g. :8088 (empty = disabled, requires -api-tokens)")
+	auditLogPath := flag.String("audit-log", "/var/log/wb-rules-audit.log", "Audit log file for changes made via RPC and overridden rule writes")
+	jsonLog := flag.String("json-log", "", "File receiving the messages logged by scripts as JSON objects, 'syslog' to send them to syslog (empty = disabled)")
+	logTopicPrefix := flag.String("log-topic-prefix", "", "Prefix of MQTT topics receiving the log messages (empty = /wbrules/log)")
+	logRate := flag.Float64("log-rate", 0, "Max average number of log messages published to MQTT per second (0 = unlimited)")
+	logBurst := flag.Int("log-burst", 20, "Max number of log messages published to MQTT at once when -log-rate is set")
+	scriptScanInterval := flag.Duration("script-scan-interval", 0, "Interval between periodic rescans of the script directories in addition to inotify watching (0 = disabled)")
+	noScriptWatchEvents := flag.Bool("no-inotify", false, "Don't use inotify to watch the script directories, rely on -script-scan-interval")
+	stateExportInterval := flag.Duration("state-export-interval", 0, "Interval between state snapshot publications for cold standby (0 = disabled)")
+	stateImport := flag.Bool("state-import", false, "Import state snapshot from the broker if persistent storage is empty")
+	configDir := flag.String("config-dir", "", "Directory with JSON config files editable by scripts (empty = editConfig() disabled)")
+	inventory := flag.String("inventory", "", "Inventory file (JSON or CSV) listing virtual devices to define")
+	adaptersDir := flag.String("adapters-dir", "", "Directory with JSON files mapping foreign MQTT devices (zigbee2mqtt, Tasmota, Shelly) to virtual devices")
+	profilePath := flag.String("profile", "", "Controller profile file exposed to scripts as 'profile' object (empty = use environment variables only)")
+	startupDelay := flag.Duration("startup-delay", 0, "Don't run rule actions for the specified time after startup")
+	ingestQuiet := flag.Duration("startup-ingest-quiet", 0, "Don't run rules at startup till no values are received for the specified time (0 = disabled)")
+	ingestMax := flag.Duration("startup-ingest-max", wbrules.DEFAULT_INGEST_MAX_DURATION, "Max duration of startup value ingestion")
+	startupGrace := flag.Duration("startup-grace", 0, "Don't run rules for the specified time after startup value ingestion")
+	startupEdgeTriggers := flag.Bool("startup-edge-triggers", true, "Allow whenChanged and asSoonAs rules to fire during the initial replay of retained values (till the cells used by rules are complete)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "Max time to wait for running timers, rule callbacks and spawned processes to finish on exit")
+	readyTimeout := flag.Duration("ready-timeout", wbrules.DEFAULT_READY_TIMEOUT, "Max time to wait for the cells used by rules to become complete before starting waitReady timers")
+	sharedGlobals := flag.Bool("shared-globals", false, "Share top-level variables and functions between the scripts (compatibility mode)")
+	notifyConfig := flag.String("notify-config", "", "Notification channel config file for Notify.email/telegram/webhook (empty = channels disabled)")
+	cellChangeBatch := flag.Int("cell-change-batch", wbrules.DEFAULT_CELL_CHANGE_BATCH, "Max number of pending cell changes handled by a single rule pass (1 = no batching)")
+	slowRuleThreshold := flag.Duration("slow-rule-threshold", wbrules.DEFAULT_SLOW_RULE_THRESHOLD, "Log a warning when a rule callback runs longer than the specified time (0 = disabled)")
+	cellHistoryRetention := flag.Duration("cell-history-retention", wbrules.DEFAULT_CELL_HISTORY_RETENTION, "Default time the cell values are kept by cellHistory()")
+	ruleHistorySize := flag.Int("rule-history-size", wbrules.DEFAULT_RULE_HISTORY_SIZE, "Number of the most recent rule firings kept for the RuleHistory RPC service")
+	writeConflicts := flag.String("write-conflicts", wbrules.WRITE_CONFLICTS_ALLOW, "Handling of the writes of the same cell by several rules with equal priority during a rule pass (allow, log or reject)")
+	maxCascadeDepth := flag.Int("max-cascade-depth", wbrules.DEFAULT_MAX_CASCADE_DEPTH, "Max length of a chain of rules triggering each other via cell writes (0 = unlimited)")
+	modulePath := flag.String("module-path", wbrules.DEFAULT_MODULE_PATH, "Colon-separated list of directories with modules loaded by require()")
+	libDir := flag.String("lib-dir", "", "Directory to look for the runtime library (lib.js) before the default locations")
+	libChecksum := flag.String("lib-sha256", "", "Expected SHA-256 checksum of the runtime library (empty = don't verify)")
+	diffMode := flag.Bool("diff", false, "Compare the rule sets of two script files/directories specified as arguments and exit")
+	renameRefs := flag.String("rename", "", "Rewrite references to the renamed devices/cells (comma-separated old=new pairs, e.g. wb-mr6c_10=wb-mr6c_20,wb-msw/temp=wb-msw2/temp) in the scripts specified as arguments and exit")
+	renameDryRun := flag.Bool("rename-dry-run", false, "Only print the changes -rename would make")
+	testScenario := flag.String("test", "", "Run the test scenario file against the scripts specified as arguments using a fake clock and exit")
+	benchRules := flag.Int("bench-rules", 0, "Run benchmark with the specified number of synthetic rules")
+	benchCells := flag.Int("bench-cells", 10, "Number of cells for the benchmark")
+	benchChanges := flag.Int("bench-changes", 1000, "Number of cell changes for the benchmark")
+	benchRate := flag.Float64("bench-rate", 0, "Cell changes per second for the benchmark (0 = unlimited)")
+	soakDuration := flag.Duration("soak", 0, "Run soak test for the specified time checking engine invariants (0 = disabled)")
+	soakRules := flag.Int("soak-rules", 50, "Number of synthetic rules for the soak test")
+	soakCells := flag.Int("soak-cells", 20, "Number of cells for the soak test")
+	soakRate := flag.Float64("soak-rate", 1000, "Cell changes per second for the soak test (0 = unlimited)")
+	soakReloadInterval := flag.Duration("soak-reload-interval", time.Second, "Interval between script reloads during the soak test (0 = don't reload)")
+	soakMaxHeapGrowth := flag.String("soak-max-heap-growth", "16MiB", "Max allowed heap growth during the soak test (0 = don't check)")
+	soakSeed := flag.Int64("soak-seed", 0, "Random seed for the soak test (0 = use current time)")
 	flag.Parse()
-	if flag.NArg() < 1 {
+	wbrules.SetLibDir(*libDir)
+	wbrules.SetLibChecksum(*libChecksum)
+	if err := wbrules.CheckLib(); err != nil {
+		wbgo.Error.Fatal(err)
+	}
+	if *diffMode {
+		if flag.NArg() != 2 {
+			wbgo.Error.Fatal("must specify old and new script file/directory names")
+		}
+		diff, err := wbrules.DiffRuleSets(flag.Arg(0), flag.Arg(1))
+		if err != nil {
+			wbgo.Error.Fatalf("error comparing rule sets: %s", err)
+		}
+		fmt.Print(diff)
+		if diff.Empty() {
+			fmt.Println("no changes")
+		}
+		return
+	}
+	if *renameRefs != "" {
+		if flag.NArg() < 1 {
+			wbgo.Error.Fatal("must specify script directory name(s)")
+		}
+		renames, err := wbrules.ParseReferenceRenames(*renameRefs)
+		if err != nil {
+			wbgo.Error.Fatal(err)
+		}
+		for _, root := range flag.Args() {
+			results, err := wbrules.RenameReferencesInDir(root, renames, *renameDryRun)
+			if err != nil {
+				wbgo.Error.Fatalf("error renaming references in %s: %s", root, err)
+			}
+			fmt.Print(wbrules.FormatRefactorResults(results))
+		}
+		return
+	}
+	if *testScenario != "" {
+		if flag.NArg() < 1 {
+			wbgo.Error.Fatal("must specify rule file/directory name(s)")
+		}
+		os.Exit(runTestScenario(*testScenario, flag.Args()))
+	}
+	benchMode := *benchRules > 0
+	soakMode := *soakDuration > 0
+	if flag.NArg() < 1 && !benchMode && !soakMode {
 		wbgo.Error.Fatal("must specify rule file/directory name(s)")
 	}
 	if *useSyslog {
@@ -29,16 +170,132 @@ func main() {
 		wbgo.EnableMQTTDebugLog()
 	}
 	model := wbrules.NewCellModel()
-	mqttClient := wbgo.NewPahoMQTTClient(*brokerAddress, DRIVER_CLIENT_ID, true)
+	mqttClient := wbgo.NewPahoMQTTClient(*brokerAddress, wbrules.InstanceName(DRIVER_CLIENT_ID, *instanceID), true)
 	driver := wbgo.NewDriver(model, mqttClient)
 	driver.SetAutoPoll(false)
 	driver.SetAcceptsExternalDevices(true)
-	engine := wbrules.NewESEngine(model, mqttClient)
+	engine, err := wbrules.NewESEngine(model, mqttClient)
+	if err != nil {
+		wbgo.Error.Fatal(err)
+	}
+	if err := engine.SetInstanceID(*instanceID); err != nil {
+		wbgo.Error.Fatal(err)
+	}
+	engine.SetWriteCoalescing(*coalesceWrites, *logSuppressedWrites)
+	engine.SetDeferredWrites(*deferWrites)
+	engine.SetMaxCascadeDepth(*maxCascadeDepth)
+	if err := engine.SetWriteConflictMode(*writeConflicts); err != nil {
+		wbgo.Error.Fatal(err)
+	}
+	engine.SetRuleHistorySize(*ruleHistorySize)
+	engine.SetSlowRuleThreshold(*slowRuleThreshold)
+	engine.SetCellHistoryRetention(*cellHistoryRetention)
+	engine.SetCellChangeBatching(*cellChangeBatch)
+	engine.SetModulePath(wbrules.ParseModulePath(*modulePath))
+	engine.SetScriptIsolation(!*sharedGlobals)
+	if *notifyConfig != "" {
+		config, err := wbrules.LoadNotificationConfig(*notifyConfig)
+		if err != nil {
+			wbgo.Error.Fatalf("error loading notification config: %s", err)
+		}
+		notifier, err := wbrules.NewNotifier(config)
+		if err != nil {
+			wbgo.Error.Fatalf("invalid notification config %s: %s", *notifyConfig, err)
+		}
+		engine.SetNotifier(notifier)
+	}
+	engine.SetStartupDelay(*startupDelay)
+	engine.SetStartupIngestion(*ingestQuiet, *ingestMax)
+	engine.SetStartupGrace(*startupGrace)
+	engine.SetReadyTimeout(*readyTimeout)
+	engine.SetStartupEdgeTriggers(*startupEdgeTriggers)
+	backend := *persistentBackend
+	if *persistentDB == "" {
+		// in-memory storage
+		backend = wbrules.STORAGE_BACKEND_JSON
+	}
+	storage, err := wbrules.OpenStorage(backend, *persistentDB)
+	if err != nil {
+		wbgo.Error.Fatalf("error opening persistent storage %s: %s", *persistentDB, err)
+	}
+	if *persistentDB != "" && *persistentFlushInterval > 0 {
+		storage = wbrules.NewBufferedStorage(storage, *persistentFlushInterval)
+	}
+	defer func() {
+		// pending persistent values are written here
+		if err := storage.Close(); err != nil {
+			wbgo.Error.Printf("error closing persistent storage: %s", err)
+		}
+	}()
+	engine.SetPersistentStorage(storage)
+	if *stateImport {
+		if err := engine.BootstrapState(wbrules.DEFAULT_STATE_WAIT_TIMEOUT); err != nil {
+			wbgo.Warn.Printf("state snapshot not imported: %s", err)
+		}
+	}
+	if *restrictedDirs != "" {
+		for _, dir := range strings.Split(*restrictedDirs, ",") {
+			profile := wbrules.NewRestrictedProfile(dir)
+			profile.MaxCallbackTime = *restrictedTimeLimit
+			if err := engine.AddRestrictedDir(dir, profile); err != nil {
+				wbgo.Error.Fatalf("invalid restricted dir %s: %s", dir, err)
+			}
+		}
+	}
+	profile, err := wbrules.LoadProfile(*profilePath)
+	if err != nil {
+		wbgo.Error.Fatalf("error loading controller profile %s: %s", *profilePath, err)
+	}
+	engine.SetProfile(profile)
+	engine.SetLogTopicPrefix(*logTopicPrefix)
+	engine.SetLogRateLimit(*logRate, *logBurst)
+	switch *jsonLog {
+	case "":
+	case "syslog":
+		sink, err := wbrules.NewSyslogJSONLogSink("wb-rules")
+		if err != nil {
+			wbgo.Error.Fatalf("error connecting to syslog: %s", err)
+		}
+		engine.AddLogSink(sink)
+	default:
+		sink, err := wbrules.OpenJSONLogFile(*jsonLog)
+		if err != nil {
+			wbgo.Error.Fatalf("error opening JSON log %s: %s", *jsonLog, err)
+		}
+		engine.AddLogSink(sink)
+	}
+	if *inventory != "" {
+		if err := engine.ImportInventory(*inventory); err != nil {
+			wbgo.Error.Fatalf("error importing inventory %s: %s", *inventory, err)
+		}
+	}
+	if *adaptersDir != "" {
+		if err := engine.LoadDeviceAdapters(*adaptersDir); err != nil {
+			wbgo.Error.Fatalf("error loading device adapters: %s", err)
+		}
+	}
+	if *configDir != "" {
+		configClient, err := engine.SetConfigDir(*configDir)
+		if err != nil {
+			wbgo.Error.Fatalf("invalid config dir %s: %s", *configDir, err)
+		}
+		configWatcher := wbgo.NewDirWatcher("\\.json$", configClient)
+		if err := configWatcher.Load(*configDir); err != nil {
+			wbgo.Error.Printf("error watching config dir %s: %s", *configDir, err)
+		}
+	}
 	gotSome := false
-	watcher := wbgo.NewDirWatcher("\\.js$", engine)
+	watcher := wbrules.NewScriptWatcher("\\.js$", engine)
+	watcher.SetScanInterval(*scriptScanInterval)
+	watcher.SetWatchEvents(!*noScriptWatchEvents)
 	if *editDir != "" {
 		engine.SetSourceRoot(*editDir)
+		engine.SetScriptSwitches(*scriptSwitches)
+		engine.SetScriptLogLevelCells(*scriptLogLevels)
 	}
+	// the scripts are loaded after all of them are found,
+	// so they can be ordered by their dependencies
+	engine.BeginScriptBatch()
 	for _, path := range flag.Args() {
 		if err := watcher.Load(path); err != nil {
 			wbgo.Error.Printf("error loading script file/dir %s: %s", path, err)
@@ -46,22 +303,115 @@ func main() {
 			gotSome = true
 		}
 	}
-	if !gotSome {
+	for _, err := range engine.LoadScriptBatch() {
+		wbgo.Error.Printf("error loading script: %s", err)
+	}
+	if !gotSome && !benchMode {
 		wbgo.Error.Fatalf("no valid scripts found")
 	}
 	if err := driver.Start(); err != nil {
 		wbgo.Error.Fatalf("error starting the driver: %s", err)
 	}
 
+	rpc := wbgo.NewMQTTRPCServer(wbrules.InstanceName("wbrules", *instanceID), mqttClient)
 	if *editDir != "" {
-		rpc := wbgo.NewMQTTRPCServer("wbrules", mqttClient)
 		rpc.Register(wbrules.NewEditor(engine))
-		rpc.Start()
 	}
+	rpc.Register(wbrules.NewEvaluator(engine))
+	rpc.Register(wbrules.NewScheduler(engine))
+	rpc.Register(wbrules.NewRuleHistory(engine))
+	rpc.Register(wbrules.NewScenes(engine))
+	rpc.Register(wbrules.NewAccessStats(engine))
+	rpc.Register(wbrules.NewPersistenceStats(engine))
+	rpc.Register(wbrules.NewDebugger(engine))
+	if *httpAPIAddr != "" && *apiTokens == "" {
+		wbgo.Error.Fatal("HTTP API requires API tokens")
+	}
+	if *apiTokens != "" {
+		tokens, err := wbrules.LoadAPITokens(*apiTokens)
+		if err != nil {
+			wbgo.Error.Fatalf("error loading API tokens: %s", err)
+		}
+		auditLog, err := wbrules.OpenAuditLog(*auditLogPath)
+		if err != nil {
+			wbgo.Error.Fatalf("error opening audit log %s: %s", *auditLogPath, err)
+		}
+		engine.SetAuditLog(auditLog)
+		rpc.Register(wbrules.NewCells(engine, tokens, auditLog))
+		if *httpAPIAddr != "" {
+			api := wbrules.NewHTTPAPI(engine, tokens, auditLog)
+			go func() {
+				wbgo.Error.Fatalf("HTTP API server failed: %s", http.ListenAndServe(*httpAPIAddr, api))
+			}()
+		}
+	}
+	if *metricsAddr != "" {
+		go func() {
+			wbgo.Error.Fatalf("metrics server failed: %s",
+				http.ListenAndServe(*metricsAddr, wbrules.NewMetricsHandler(engine)))
+		}()
+	}
+	rpc.Start()
 
 	engine.Start()
+	if *stateExportInterval > 0 {
+		engine.StartStateExport(*stateExportInterval)
+	}
+
+	if benchMode {
+		r, err := wbrules.RunBenchmark(engine, wbrules.BenchmarkOptions{
+			Rules:      *benchRules,
+			Cells:      *benchCells,
+			Changes:    *benchChanges,
+			ChangeRate: *benchRate,
+		})
+		if err != nil {
+			wbgo.Error.Fatalf("benchmark failed: %s", err)
+		}
+		wbgo.Info.Printf("benchmark: %d rules, %d cells: %s", *benchRules, *benchCells, r)
+		return
+	}
+
+	if soakMode {
+		maxHeapGrowth, err := wbrules.ParseByteSize(*soakMaxHeapGrowth)
+		if err != nil {
+			wbgo.Error.Fatalf("bad max heap growth: %s", err)
+		}
+		seed := *soakSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		wbgo.Info.Printf("soak test: seed %d", seed)
+		r, err := wbrules.RunSoakTest(engine, wbrules.SoakOptions{
+			Duration:       *soakDuration,
+			Rules:          *soakRules,
+			Cells:          *soakCells,
+			ChangeRate:     *soakRate,
+			ReloadInterval: *soakReloadInterval,
+			MaxHeapGrowth:  uint64(maxHeapGrowth),
+			Seed:           seed,
+		})
+		if err != nil {
+			wbgo.Error.Fatalf("soak test failed: %s", err)
+		}
+		for _, v := range r.Violations {
+			wbgo.Error.Printf("soak test: %s", v)
+		}
+		if !r.OK() {
+			wbgo.Error.Fatalf("soak test: %s", r)
+		}
+		wbgo.Info.Printf("soak test: %s", r)
+		return
+	}
 
-	for {
-		time.Sleep(1 * time.Second)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigCh
+	wbgo.Info.Printf("got %s, exiting", sig)
+	watcher.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := engine.Stop(ctx); err != nil {
+		wbgo.Warn.Printf("engine shutdown didn't complete: %s", err)
 	}
 }
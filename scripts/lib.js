@@ -3,6 +3,7 @@ var _WbRules = {
   requireCompleteCells: 0,
   timers: {},
   aliases: {},
+  aliasOwners: {},
 
   CronEntry: function (spec) {
     if (typeof spec != "string")
@@ -84,11 +85,22 @@ var _WbRules = {
   defineAlias: function (name, cellRef) {
     if (!name || !cellRef)
       throw new Error("invalid alias definition");
-    var ref = _WbRules.parseCellRef(cellRef);
+    var ref = _WbRules.parseCellRef(cellRef), owner = {},
+        globalObj = (function () { return this; })();
     _WbRules.aliases[name] = cellRef;
+    _WbRules.aliasOwners[name] = owner;
+    // the alias is removed when the script that defined it
+    // is reloaded or removed, unless it was redefined elsewhere
+    _wbAddCleanup(function () {
+      if (_WbRules.aliasOwners[name] !== owner)
+        return;
+      delete _WbRules.aliasOwners[name];
+      delete _WbRules.aliases[name];
+      delete globalObj[name];
+    });
     var d = null;
     Object.defineProperty(
-      (function () { return this; })(),
+      globalObj,
       name,
       {
         configurable: true,
@@ -106,6 +118,11 @@ var _WbRules = {
   },
 
   defineRule: function (name, def) {
+    if (typeof name == "object" && def === undefined) {
+      // anonymous rule, the name is generated by the engine
+      def = name;
+      name = "";
+    }
     debug("defineRule: " + name);
     if (typeof name != "string" || typeof def != "object")
       throw new Error("invalid rule definition");
@@ -143,8 +160,15 @@ var _WbRules = {
       return wrapConditionFunc(item, undefined);
     }
 
-    // when: cron("...") is converted to cron: "..."
-    if (def.hasOwnProperty("when") && def.when instanceof _WbRules.CronEntry) {
+    // when: cron("...") and cron: "..." are converted to _cron: "..."
+    if (def.hasOwnProperty("cron")) {
+      if (def.hasOwnProperty("when"))
+        throw new Error("invalid rule -- cannot combine 'when' with 'cron'");
+      if (typeof def.cron != "string")
+        throw new Error("invalid cron spec");
+      def._cron = def.cron;
+      delete def.cron;
+    } else if (def.hasOwnProperty("when") && def.when instanceof _WbRules.CronEntry) {
       def._cron = def.when.spec;
       delete def.when;
     }
@@ -153,8 +177,21 @@ var _WbRules = {
       var orig = d[k];
       switch(k) {
       case "readonly":
+      case "ignoreStartupDelay":
+      case "waitReady":
+      case "fireOnRepublish":
+      case "immediateWrites":
         d[k] = !!d[k]; // avoid type cast error on the Go side
         break;
+      case "thenTimeoutMs":
+      case "debounceMs":
+      case "throttleMs":
+        d[k] = _WbRules.parseDuration(orig);
+        break;
+      case "priority":
+        if (typeof orig != "number" || orig % 1 != 0)
+          throw new Error("invalid rule priority: " + orig);
+        break;
       case "asSoonAs":
       case "when":
         d[k] = wrapConditionFunc(orig, false);
@@ -165,25 +202,119 @@ var _WbRules = {
         else
           d[k] = transformWhenChangedItem(orig);
         break;
+      case "whenComplete":
+        d[k] = (Array.isArray(orig) ? orig : [orig]).map(function (item) {
+          if (typeof item != "string")
+            throw new Error("invalid whenComplete spec");
+          return transformWhenChangedItem(item);
+        });
+        break;
+      case "whenRate":
+        if (typeof orig != "object" || orig === null || typeof orig.cell != "string")
+          throw new Error("invalid whenRate spec");
+        d[k] = {
+          cell: transformWhenChangedItem(orig.cell),
+          threshold: orig.threshold,
+          windowMs: _WbRules.parseDuration(orig.windowMs)
+        };
+        break;
       case "then":
+        // the value returned by then() is passed to the engine
+        // oldValue is passed as the last argument, so
+        // it doesn't break the callbacks that don't use it
         d[k] = function (options) {
-          if (options) {
-            if (options.hasOwnProperty("device"))
-              // TBD: pass options.oldValue right after newValue here -- for consistency
-              orig.call(d, options.newValue, options.device, options.cell);
-            else
-              orig.call(d, options.newValue);
-          } else
-            orig.call(d);
+          if (options)
+            return orig.call(d, options.newValue, options.device, options.cell, options.oldValue);
+          else
+            return orig.call(d);
         };
       }
     });
-    _wbDefineRule(name, d);
+    return new _WbRules.RuleHandle(_wbDefineRule(name, d));
   },
 
-  startTimer: function startTimer(name, ms, periodic) {
+  // RuleHandle is returned by defineRule() and allows
+  // to control the rule from the scripts
+  RuleHandle: function (name) {
+    function check (what, err) {
+      if (err !== null)
+        throw new Error(what + " " + name + ": " + err);
+    }
+    this.name = name;
+    this.enable = function () {
+      check("enable", _wbSetRuleEnabled(name, true));
+    };
+    this.disable = function () {
+      check("disable", _wbSetRuleEnabled(name, false));
+    };
+    // run() is kept for compatibility
+    this.run = this.runNow = function () {
+      check("run", _wbRunRule(name));
+    };
+    this.check = function () {
+      var r = _wbCheckRule(name);
+      if (typeof r == "string")
+        check("check", r);
+      return r;
+    };
+    this.destroy = function () {
+      check("destroy", _wbDestroyRule(name));
+    };
+  },
+
+  importInventory: function (inv) {
+    var devNames = {};
+    Object.keys(inv.devices).forEach(function (name) {
+      devNames[name] = defineVirtualDevice(name, inv.devices[name]);
+    });
+    Object.keys(inv.aliases).forEach(function (name) {
+      // aliases of the inventory devices must take
+      // the script's device prefix into account
+      var ref = _WbRules.parseCellRef(inv.aliases[name]);
+      if (devNames.hasOwnProperty(ref.device))
+        _WbRules.defineAlias(name, devNames[ref.device] + "/" + ref.control);
+      else
+        _WbRules.defineAlias(name, inv.aliases[name]);
+    });
+  },
+
+  // parseDuration converts duration specs like "2h", "1h30m",
+  // "15s" or "500ms" to milliseconds. Numbers are treated
+  // as milliseconds.
+  parseDuration: function parseDuration (spec) {
+    var ms = null;
+    if (typeof spec == "number")
+      ms = spec >= 0 ? spec : null;
+    else if (typeof spec == "string")
+      ms = _wbParseDuration(spec);
+    if (ms === null)
+      throw new Error("invalid duration: " + spec);
+    return ms;
+  },
+
+  // timerInterval accepts duration specs in place
+  // of timer intervals in milliseconds
+  timerInterval: function timerInterval (ms) {
+    return typeof ms == "string" ? _WbRules.parseDuration(ms) : ms;
+  },
+
+  startTimer: function startTimer(name, ms, periodic, options) {
     debug("starting timer: " + name);
-    _wbStartTimer(name, ms, !!periodic);
+    _wbStartTimer(name, _WbRules.timerInterval(ms), !!periodic, !!(options && options.waitReady));
+  },
+
+  // startCallbackTimer implements setTimeout(), setInterval()
+  // and their WhenReady counterparts. Like in browsers and
+  // Node.js, the extra arguments are passed to the callback.
+  startCallbackTimer: function startCallbackTimer(callback, ms, periodic, extraArgs, waitReady) {
+    var fn = callback;
+    if (typeof callback == "function" && extraArgs.length) {
+      fn = function () {
+        return callback.apply(null, extraArgs);
+      };
+    }
+    return _wbStartTimer(fn, ms === undefined ? 0 : _WbRules.timerInterval(ms), periodic,
+                         !!waitReady);
   }
 };
 
@@ -197,31 +328,86 @@ var timers = _WbRules.autoload(_WbRules.timers, function (name) {
     get firing() {
       return _wbCheckCurrentTimer(name);
     },
+    get running() {
+      return _wbTimerState(name).running;
+    },
+    // remaining time till the timer fires, ms
+    get remaining() {
+      return _wbTimerState(name).remaining;
+    },
     stop: function () {
       _wbStopTimer(name);
+    },
+    restart: function () {
+      return _wbRestartTimer(name);
     }
   };
 });
 
 var defineRule = _WbRules.defineRule;
 
-function startTimer (name, ms) {
-  _WbRules.startTimer(name, ms, false);
+// runRule(name) invokes the then callback of the rule without
+// checking its condition. The rules defined by the same script
+// may be specified by their short names.
+function runRule (name) {
+  var err = _wbRunRule(name);
+  if (err !== null)
+    throw new Error("runRule " + name + ": " + err);
 }
 
-function startTicker (name, ms) {
-  _WbRules.startTimer(name, ms, true);
+// options.waitReady makes the timer start counting
+// only after the engine is ready
+function startTimer (name, ms, options) {
+  _WbRules.startTimer(name, ms, false, options);
+}
+
+function startTicker (name, ms, options) {
+  _WbRules.startTimer(name, ms, true, options);
 }
 
 function setTimeout(callback, ms) {
-  return _wbStartTimer(callback, ms, false);
+  return _WbRules.startCallbackTimer(callback, ms, false,
+                                     Array.prototype.slice.call(arguments, 2));
 }
 
 function setInterval(callback, ms) {
-  return _wbStartTimer(callback, ms, true);
+  return _WbRules.startCallbackTimer(callback, ms, true,
+                                     Array.prototype.slice.call(arguments, 2));
+}
+
+// setTimeoutWhenReady() and setIntervalWhenReady() are like
+// setTimeout() and setInterval(), but the timer starts counting
+// only after the engine is ready
+function setTimeoutWhenReady(callback, ms) {
+  return _WbRules.startCallbackTimer(callback, ms, false,
+                                     Array.prototype.slice.call(arguments, 2), true);
+}
+
+function setIntervalWhenReady(callback, ms) {
+  return _WbRules.startCallbackTimer(callback, ms, true,
+                                     Array.prototype.slice.call(arguments, 2), true);
+}
+
+// duration("1h30m") returns the duration in milliseconds
+function duration (spec) {
+  return _WbRules.parseDuration(spec);
+}
+
+// bytes("2MB") returns the size in bytes. KB, MB, GB, TB
+// are decimal units, KiB, MiB, GiB, TiB are binary ones.
+function bytes (spec) {
+  var n = typeof spec == "number" ? spec : null;
+  if (typeof spec == "string")
+    n = _wbParseByteSize(spec);
+  if (n === null || !(n >= 0))
+    throw new Error("invalid size: " + spec);
+  return n;
 }
 
 function clearTimeout(id) {
+  // like in browsers and Node.js, missing ids are ignored
+  if (id === undefined || id === null)
+    return;
   _wbStopTimer(id);
 }
 
@@ -252,25 +438,119 @@ function spawn(cmd, args, options) {
   if (options.input != null)
     options.input = "" + options.input;
 
-  _wbSpawn([cmd].concat(args || []), options.exitCallback ? function (args) {
+  var id = _wbSpawn([cmd].concat(args || []), options.exitCallback ? function (args) {
     try {
       options.exitCallback(
         args.exitStatus,
         options.captureOutput ? args.capturedOutput : null,
-        args.capturedErrorOutput
+        args.capturedErrorOutput,
+        args.killed
       );
     } catch (e) {
       log("error running command callback for " + cmd + ": " + (e.stack || e));
     }
-  } : null, !!options.captureOutput, !!options.captureErrorOutput, options.input);
+  } : null, !!options.captureOutput, !!options.captureErrorOutput, options.input, {
+    env: options.env || null,
+    cwd: options.cwd != null ? "" + options.cwd : null,
+    timeout: options.timeout || null,
+    streamOutput: typeof options.onOutputLine == "function",
+    streamErrorOutput: typeof options.onErrorLine == "function"
+  }, options.onOutputLine || options.onErrorLine ? function (args) {
+    var handler = args.stream == "stdout" ? options.onOutputLine : options.onErrorLine;
+    try {
+      handler(args.line);
+    } catch (e) {
+      log("error running output callback for " + cmd + ": " + (e.stack || e));
+    }
+  } : null);
+
+  return {
+    // kill() kills the process along with its children.
+    // Returns false if the process has already exited.
+    kill: function kill () {
+      return _wbKillProcess(id);
+    }
+  };
 }
 
 function runShellCommand(cmd, options) {
-  spawn("/bin/sh", ["-c", cmd], options);
+  return spawn("/bin/sh", ["-c", cmd], options);
 }
 
+var http = (function () {
+  // request performs an HTTP request. The callback receives
+  // an error message (null in case of success) and the response
+  // object with 'status', 'headers' and 'body' properties.
+  // Non-string bodies are sent as JSON.
+  function request (options, callback) {
+    if (!options || typeof options != "object")
+      throw new Error("http.request: options object expected");
+    if (typeof callback != "function")
+      throw new Error("http.request: callback expected");
+    var opts = {}, headers = {};
+    for (var k in options)
+      if (options.hasOwnProperty(k))
+        opts[k] = options[k];
+    for (k in options.headers || {})
+      if (options.headers.hasOwnProperty(k))
+        headers[k] = "" + options.headers[k];
+    if (opts.body != null && typeof opts.body != "string") {
+      opts.body = JSON.stringify(opts.body);
+      if (!headers.hasOwnProperty("Content-Type") && !headers.hasOwnProperty("content-type"))
+        headers["Content-Type"] = "application/json";
+    }
+    opts.headers = headers;
+    var err = _wbHttpRequest(opts, function (result) {
+      if (result.error !== null)
+        callback(result.error, null);
+      else
+        callback(null, {
+          status: result.status,
+          headers: result.headers,
+          body: result.body
+        });
+    });
+    if (err !== null)
+      throw new Error("http.request: " + err);
+  }
+
+  function withOptions (options, extra) {
+    var opts = {};
+    for (var k in options || {})
+      if (options.hasOwnProperty(k))
+        opts[k] = options[k];
+    for (k in extra)
+      opts[k] = extra[k];
+    return opts;
+  }
+
+  return {
+    request: request,
+
+    get: function get (url, options, callback) {
+      if (typeof options == "function") {
+        callback = options;
+        options = {};
+      }
+      request(withOptions(options, { method: "GET", url: url }), callback);
+    },
+
+    post: function post (url, body, options, callback) {
+      if (typeof options == "function") {
+        callback = options;
+        options = {};
+      }
+      request(withOptions(options, { method: "POST", url: url, body: body }), callback);
+    }
+  };
+})();
+
 var defineAlias = _WbRules.defineAlias;
 
+function importInventory(path) {
+  _WbRules.importInventory(_wbReadInventory(path));
+}
+
 String.prototype.format = function () {
   var args = [ this ];
   for (var i = 0; i < arguments.length; ++i)
@@ -294,10 +574,39 @@ String.prototype.xformat = function () {
   }).join("{");
 };
 
+// editConfig() atomically updates the config file located in the
+// config directory. edit() receives the current content of the file
+// (an empty object if the file doesn't exist) and may either modify
+// it or return the new content. The rules with onConfigChange option
+// set to the file are fired after the file is written.
+function editConfig (name, edit) {
+  if (typeof edit != "function")
+    throw new Error("editConfig: edit function expected");
+  var conf = _wbLoadConfig(name), r = edit(conf);
+  _wbWriteConfig(name, r === undefined ? conf : r);
+}
+
 function cron(spec) {
   return new _WbRules.CronEntry(spec);
 }
 
+// timeInRange("22:00", "06:00") returns true if the current time
+// of day is within the range, which may wrap around midnight.
+// Rules that use it in their conditions are re-checked
+// when the range starts or ends.
+function timeInRange (from, to) {
+  var r = _wbTimeInRange("" + from, "" + to);
+  if (typeof r == "string")
+    throw new Error("timeInRange: " + r);
+  return r;
+}
+
+// Date.now() returns the time of the engine clock, which
+// is replaced by a fake one when the rules are tested
+Date.now = function () {
+  return _wbNow();
+};
+
 var Notify = (function (){
   var _smsQueue = [],
       _smsBusy = false;
@@ -309,8 +618,48 @@ var Notify = (function (){
     next();
   }
 
+  // _send sends the notification via a channel configured
+  // in the notification config file. options.onSent is called
+  // after successful delivery, options.onError(message) is called
+  // when the notification can't be delivered.
+  function _send (channel, to, subject, text, options) {
+    options = options || {};
+    var err = _wbNotify(channel, "" + to, "" + subject, "" + text, function (result) {
+      if (result.error === null) {
+        if (options.onSent)
+          options.onSent();
+        return;
+      }
+      log.error("error sending {} notification to {}: {}", channel, to, result.error);
+      if (options.onError)
+        options.onError(result.error);
+    });
+    if (err !== null)
+      throw new Error("Notify.{}: {}".format(channel, err));
+  }
+
   return {
+    email: function email (to, subject, text, options) {
+      _send("email", to, subject, text, options);
+    },
+
+    telegram: function telegram (chatId, text, options) {
+      _send("telegram", chatId, "", text, options);
+    },
+
+    webhook: function webhook (text, options) {
+      _send("webhook", "", "", text, options);
+    },
+
+    sendTelegram: function sendTelegram (chatId, text) {
+      Notify.telegram(chatId, text);
+    },
+
     sendEmail: function sendEmail (to, subject, text) {
+      if (_wbHasNotifyChannel("email")) {
+        Notify.email(to, subject, text);
+        return;
+      }
       log("sending email to {}: {}", to, subject);
       runShellCommand("/usr/sbin/sendmail '{}'".format(to), {
         captureErrorOutput: true,
@@ -366,6 +715,20 @@ var Alarms = (function () {
       return function sendSMSWrapper (text) {
         Notify.sendSMS(src.to, text);
       };
+    },
+
+    telegram: function getTelegramSendFunc (src) {
+      if (!src.hasOwnProperty("to"))
+        throw new Error("telegram recipient without 'to'");
+      return function sendTelegramWrapper (text) {
+        Notify.telegram(src.to, text);
+      };
+    },
+
+    webhook: function getWebhookSendFunc (src) {
+      return function sendWebhookWrapper (text) {
+        Notify.webhook(text);
+      };
     }
   };
 
@@ -557,14 +920,24 @@ var Alarms = (function () {
     if (!src.hasOwnProperty("alarms") || !Array.isArray(src.alarms))
       throw new Error("absent/invalid alarms spec");
 
-    var sendFuncs = src.recipients.map(getSendFunc);
+    // the device name may have the script's device prefix
+    var deviceName = _wbDeviceName(src.deviceName),
+        sendFuncs = src.recipients.map(getSendFunc);
     function notify (text) {
-      dev[src.deviceName].log = text;
-      sendFuncs.forEach(function (sendFunc) { sendFunc.call(null, text); });
+      dev[deviceName].log = text;
+      sendFuncs.forEach(function (sendFunc) {
+        // make sure the other recipients are notified
+        // if a notification channel isn't configured
+        try {
+          sendFunc.call(null, text);
+        } catch (e) {
+          log.error("alarm notification failed: {}", e);
+        }
+      });
     }
 
     var loadedAlarms = src.alarms.map(function (alarmSrc) {
-      return loadAlarm(alarmSrc, notify, src.deviceName);
+      return loadAlarm(alarmSrc, notify, deviceName);
     });
 
     var deviceDef = {
@@ -600,3 +973,1114 @@ var Alarms = (function () {
     }
   };
 })();
+
+var createDevice = (function () {
+  var templates = {};
+
+  function relayCells (relayCount, inputCount) {
+    var cells = {}, i;
+    for (i = 1; i <= relayCount; ++i)
+      cells["K" + i] = { type: "switch", value: false };
+    for (i = 0; i <= inputCount; ++i)
+      cells["Input " + i] = { type: "switch", value: false, readonly: true };
+    return cells;
+  }
+
+  function defineTemplate (name, def) {
+    if (typeof name != "string" || !def || typeof def != "object" ||
+        !def.cells || typeof def.cells != "object")
+      throw new Error("invalid device template definition");
+    templates[name] = def;
+  }
+
+  // Device template cell definitions may contain the following
+  // extra properties:
+  // sourceCell - the name of the source device cell to mirror
+  //   (defaults to the name of the cell itself);
+  // fromSource / toSource - value conversion functions used
+  //   when mirroring the source device cell.
+  function fromTemplate (templateName, deviceName, options) {
+    if (!templates.hasOwnProperty(templateName))
+      throw new Error("unknown device template: " + templateName);
+    if (typeof deviceName != "string" || !deviceName)
+      throw new Error("invalid device name for template " + templateName);
+    options = options || {};
+    var template = templates[templateName], cells = {};
+    Object.keys(template.cells).forEach(function (cellName) {
+      var src = template.cells[cellName], cellDef = {};
+      Object.keys(src).forEach(function (k) {
+        if (k != "sourceCell" && k != "fromSource" && k != "toSource")
+          cellDef[k] = src[k];
+      });
+      cells[cellName] = cellDef;
+    });
+    deviceName = defineVirtualDevice(deviceName, {
+      title: options.title || template.title || deviceName,
+      cells: cells
+    });
+    if (options.source)
+      Object.keys(template.cells).forEach(function (cellName) {
+        mirrorCell(deviceName, cellName, options.source, template.cells[cellName]);
+      });
+  }
+
+  function identity (v) {
+    return v;
+  }
+
+  function mirrorCell (deviceName, cellName, sourceName, cellDef) {
+    var sourceCell = cellDef.sourceCell || cellName,
+        fromSource = cellDef.fromSource || identity,
+        toSource = cellDef.toSource || identity,
+        ruleNamePrefix = "__template__{}__{}__".format(deviceName, cellName);
+    // values are only written when they differ from the current
+    // ones so the pair of rules doesn't loop
+    defineRule(ruleNamePrefix + "in", {
+      whenChanged: sourceName + "/" + sourceCell,
+      then: function (newValue) {
+        var v = fromSource(newValue);
+        if (dev[deviceName][cellName] !== v)
+          dev[deviceName][cellName] = v;
+      }
+    });
+    if (cellDef.readonly)
+      return;
+    defineRule(ruleNamePrefix + "out", {
+      whenChanged: deviceName + "/" + cellName,
+      then: function (newValue) {
+        var v = toSource(newValue);
+        if (dev[sourceName][sourceCell] !== v)
+          dev[sourceName][sourceCell] = v;
+      }
+    });
+  }
+
+  defineTemplate("wb-mr3", {
+    title: "WB-MR3",
+    cells: relayCells(3, 3)
+  });
+
+  defineTemplate("wb-mr6c", {
+    title: "WB-MR6C",
+    cells: relayCells(6, 6)
+  });
+
+  defineTemplate("wb-mrgbw", {
+    title: "WB-MRGBW-D",
+    cells: {
+      "RGB Strip": { type: "switch", value: false },
+      "RGB Palette": { type: "rgb", value: "0;0;0" },
+      "Channel 1 (B)": { type: "range", value: 0, max: 255 },
+      "Channel 2 (G)": { type: "range", value: 0, max: 255 },
+      "Channel 3 (R)": { type: "range", value: 0, max: 255 },
+      "Channel 4": { type: "range", value: 0, max: 255 }
+    }
+  });
+
+  defineTemplate("wb-mdm3", {
+    title: "WB-MDM3",
+    cells: {
+      "K1": { type: "switch", value: false },
+      "K2": { type: "switch", value: false },
+      "K3": { type: "switch", value: false },
+      "Channel 1": { type: "range", value: 0, max: 100 },
+      "Channel 2": { type: "range", value: 0, max: 100 },
+      "Channel 3": { type: "range", value: 0, max: 100 }
+    }
+  });
+
+  defineTemplate("wb-msw", {
+    title: "WB-MSW",
+    cells: {
+      "Temperature": { type: "temperature", value: 0, readonly: true },
+      "Humidity": { type: "rel_humidity", value: 0, readonly: true },
+      "CO2": { type: "concentration", value: 0, readonly: true },
+      "Sound Level": { type: "sound_level", value: 0, readonly: true },
+      // illuminance is rounded to whole lux
+      "Illuminance": {
+        type: "lux",
+        value: 0,
+        readonly: true,
+        fromSource: function (v) { return Math.round(v); }
+      }
+    }
+  });
+
+  return {
+    defineTemplate: defineTemplate,
+    fromTemplate: fromTemplate,
+    get templates () {
+      return Object.keys(templates).sort();
+    }
+  };
+})();
+
+var features = (function () {
+  var FEATURES_BUCKET = "features",
+      defined = {};
+
+  return {
+    // define() adds a toggle to the features device. The state
+    // of the toggle is persisted across restarts.
+    define: function (name, options) {
+      if (typeof name != "string" || !name || name.indexOf("/") >= 0)
+        throw new Error("invalid feature name");
+      options = options || {};
+      var saved = _wbPersistentGet(FEATURES_BUCKET, name);
+      // the name of the features device depends on the instance id
+      var devName = _wbDefineFeature(name, saved === undefined ? !!options.enabled : !!saved);
+      defined[name] = devName;
+      defineRule("__feature__" + name, {
+        whenChanged: devName + "/" + name,
+        then: function (newValue) {
+          // feature toggles are rare and must not be lost
+          _wbPersistentSet(FEATURES_BUCKET, name, !!newValue, true);
+        }
+      });
+    },
+
+    isEnabled: function (name) {
+      return defined.hasOwnProperty(name) && !!dev[defined[name]][name];
+    }
+  };
+})();
+
+// storage provides access to the persistent storage. Values are
+// grouped in named buckets, null value removes the key.
+// migrate() reshapes the state saved by older versions of
+// the scripts. The storage version starts at 0 and each migration
+// moves it from fromVersion to fromVersion + 1. Migrations are run
+// when they're defined, so they must be defined before the code
+// that uses the saved state. A migration for a version that's
+// not reached yet waits for the preceding migrations, which
+// may be defined in other scripts.
+var storage = (function () {
+  var STORAGE_BUCKET = "_wbStorage",
+      VERSION_KEY = "version",
+      pending = {};
+
+  function version () {
+    var v = _wbPersistentGet(STORAGE_BUCKET, VERSION_KEY);
+    return typeof v == "number" ? v : 0;
+  }
+
+  function runPending () {
+    for (var v = version(); pending.hasOwnProperty(v); v = version()) {
+      var fn = pending[v];
+      delete pending[v];
+      try {
+        fn();
+      } catch (e) {
+        log.error("storage migration from version {} failed: {}", v, e);
+        return;
+      }
+      // the version is flushed together with the migrated values
+      _wbPersistentSet(STORAGE_BUCKET, VERSION_KEY, v + 1, true);
+      log.info("storage migrated from version {} to {}", v, v + 1);
+    }
+  }
+
+  return {
+    get: function (bucket, key) {
+      return _wbPersistentGet(bucket, key);
+    },
+
+    set: function (bucket, key, value) {
+      _wbPersistentSet(bucket, key, value);
+    },
+
+    keys: function (bucket) {
+      return _wbPersistentKeys(bucket);
+    },
+
+    get version () {
+      return version();
+    },
+
+    migrate: function (fromVersion, fn) {
+      if (typeof fromVersion != "number" || fromVersion < 0 || fromVersion % 1)
+        throw new Error("storage.migrate: invalid version");
+      if (typeof fn != "function")
+        throw new Error("storage.migrate: migration function expected");
+      if (fromVersion < version())
+        return;
+      if (pending.hasOwnProperty(fromVersion))
+        throw new Error("storage.migrate: duplicate migration from version " + fromVersion);
+      pending[fromVersion] = fn;
+      // migrations that didn't run are forgotten when
+      // the script is reloaded or removed
+      _wbAddCleanup(function () {
+        if (pending[fromVersion] === fn)
+          delete pending[fromVersion];
+      });
+      runPending();
+    }
+  };
+})();
+
+// Scenes capture the current values of a set of cells and write
+// them back later. The scenes are kept in the persistent storage.
+// Scenes.capture(name, cells) takes an array of "device/cell"
+// strings or { cell: "device/cell", delayMs: ... } objects;
+// delayMs postpones the write of the cell value when the
+// scene is recalled.
+var Scenes = (function () {
+  function check (what, err) {
+    if (err !== null)
+      throw new Error("Scenes.{}: {}".format(what, err));
+  }
+
+  return {
+    capture: function capture (name, cells) {
+      if (typeof name != "string" || !Array.isArray(cells))
+        throw new Error("Scenes.capture: scene name and cell list expected");
+      check("capture", _wbSceneCapture(name, cells));
+    },
+
+    recall: function recall (name) {
+      check("recall", _wbSceneRecall("" + name));
+    },
+
+    get: function get (name) {
+      return _wbSceneGet("" + name);
+    },
+
+    remove: function remove (name) {
+      check("remove", _wbSceneDelete("" + name));
+    },
+
+    list: function list () {
+      return _wbSceneList();
+    }
+  };
+})();
+
+// profile is the read-only controller profile that makes it
+// possible to run the same scripts on controllers with different
+// wiring. It's fetched upon the first access because the profile
+// is set after the runtime library is loaded.
+(function () {
+  var globalObj = (function () { return this; })(),
+      cached = null;
+
+  function freeze (obj) {
+    if (obj && typeof obj == "object") {
+      Object.keys(obj).forEach(function (key) {
+        freeze(obj[key]);
+      });
+      Object.freeze(obj);
+    }
+    return obj;
+  }
+
+  Object.defineProperty(globalObj, "profile", {
+    get: function () {
+      if (!cached)
+        cached = freeze(_wbProfile());
+      return cached;
+    }
+  });
+})();
+
+// defineParams() creates a settings device with one cell per
+// parameter and returns a live params object. Parameter values
+// edited by the user are persisted across restarts.
+function defineParams (name, defaults, options) {
+  if (typeof name != "string" || !name || name.indexOf("/") >= 0)
+    throw new Error("invalid params name");
+  // the device name may have the script's device prefix
+  var devName = _wbDeviceName(name),
+      PARAMS_BUCKET = "params/" + devName;
+  if (!defaults || typeof defaults != "object")
+    throw new Error("invalid params definition: " + name);
+  options = options || {};
+
+  var cells = {}, params = {};
+  Object.keys(defaults).forEach(function (key) {
+    var defaultValue = defaults[key], type;
+    switch (typeof defaultValue) {
+    case "number":
+      type = "value";
+      break;
+    case "boolean":
+      type = "switch";
+      break;
+    case "string":
+      type = "text";
+      break;
+    default:
+      throw new Error("invalid default value for param {}/{}".format(name, key));
+    }
+    var saved = _wbPersistentGet(PARAMS_BUCKET, key);
+    cells[key] = {
+      type: type,
+      value: saved !== undefined && typeof saved == typeof defaultValue ? saved : defaultValue
+    };
+    // reading params via dev makes rules depend on them
+    Object.defineProperty(params, key, {
+      enumerable: true,
+      get: function () {
+        return dev[devName][key];
+      }
+    });
+  });
+
+  defineVirtualDevice(name, {
+    title: options.title || name,
+    cells: cells
+  });
+
+  Object.keys(defaults).forEach(function (key) {
+    defineRule("__params__{}__{}".format(devName, key), {
+      whenChanged: devName + "/" + key,
+      then: function (newValue) {
+        _wbPersistentSet(PARAMS_BUCKET, key, newValue);
+      }
+    });
+  });
+
+  return params;
+}
+
+// useDevicePrefix() makes the virtual devices defined by the rest
+// of the current script get the prefix, so generically named
+// devices like "settings" of different rule bundles don't collide.
+// Returns a function that resolves device names and "device/cell"
+// references of the script, e.g.:
+//   var ns = useDevicePrefix("hvac");
+//   defineVirtualDevice("settings", { ... }); // hvac-settings
+//   dev[ns("settings/setpoint")] = 22;
+function useDevicePrefix (prefix) {
+  _wbSetDevicePrefix(prefix);
+  return function (name) {
+    return _wbDeviceName(name, prefix);
+  };
+}
+
+// getDevice() returns an object that's used to add and remove
+// cells of a virtual device after it's defined, e.g.:
+//   getDevice("heating").addControl("zone3", { type: "switch", value: false });
+//   getDevice("heating").removeControl("zone3");
+// Cell definitions have the same format as ones passed to
+// defineVirtualDevice(). The added cells are removed when
+// the device is redefined.
+function getDevice (name) {
+  return {
+    getId: function () {
+      return name;
+    },
+    addControl: function (cellName, cellDef) {
+      var err = _wbAddControl(name, cellName, cellDef);
+      if (err !== null)
+        throw new Error("addControl: " + err);
+    },
+    removeControl: function (cellName) {
+      var err = _wbRemoveControl(name, cellName);
+      if (err !== null)
+        throw new Error("removeControl: " + err);
+    },
+    isControlExists: function (cellName) {
+      return _wbControlExists(name, cellName);
+    }
+  };
+}
+
+// require() loads a module from the module path (-module-path
+// option), e.g. var pid = require("pid"). The module code
+// runs in its own scope and exports its API by setting the
+// properties of 'exports' or replacing 'module.exports'.
+// Each module is loaded once, subsequent calls return
+// the same exports object.
+var require = (function () {
+  var modules = {};
+
+  return function require (id) {
+    if (typeof id != "string")
+      throw new Error("require: module id expected");
+    var path = _wbModuleResolve(id);
+    if (path === null)
+      throw new Error("require: module not found: " + id);
+    if (modules.hasOwnProperty(path))
+      return modules[path].exports;
+    var f = _wbModuleCompile(path);
+    if (typeof f != "function")
+      throw new Error("require: " + f);
+    var module = { id: id, filename: path, exports: {} };
+    // registering the module before running it makes
+    // circular dependencies return partial exports
+    modules[path] = module;
+    try {
+      f.call(module.exports, module, module.exports, require);
+    } catch (e) {
+      delete modules[path];
+      throw e;
+    }
+    return module.exports;
+  };
+})();
+
+// glitchFilter() makes the engine ignore pulses of the binary
+// cell that are shorter than the specified duration, e.g.
+// glitchFilter("wb-gpio/A1_IN", "50ms"). Zero duration
+// removes the filter.
+function glitchFilter (cellRef, duration) {
+  var ref = _WbRules.parseCellRef(cellRef);
+  _wbSetGlitchFilter(ref.device, ref.control, _WbRules.parseDuration(duration));
+}
+
+// trackMqtt() invokes the callback for each message received on
+// the MQTT topic, which doesn't need to follow Wiren Board
+// conventions, e.g. trackMqtt("zigbee2mqtt/+/action", function (msg) {
+// log("{}: {}", msg.topic, msg.payload); }). The topic may contain
+// wildcards. msg.retained is true for retained messages.
+function trackMqtt (topic, callback) {
+  if (typeof topic != "string")
+    throw new Error("trackMqtt: invalid topic");
+  if (typeof callback != "function")
+    throw new Error("trackMqtt: invalid callback");
+  _wbTrackMqtt(topic, callback);
+}
+
+// cellHistory() makes the engine keep the recent numeric values
+// of the cell and returns an object that provides access to them,
+// e.g. cellHistory("wb-msw/temp").delta("10m"). The values are
+// kept for the specified retention time (1h by default, see
+// -cell-history-retention option). Switch values are converted
+// to 0 and 1. The functions that take a time window return
+// null if the cell got no values within the window.
+function cellHistory (cellRef, retention) {
+  var ref = _WbRules.parseCellRef(cellRef);
+  _wbCellHistoryEnable(ref.device, ref.control,
+                       retention === undefined ? 0 : _WbRules.parseDuration(retention));
+
+  function stats (window) {
+    return _wbCellHistoryStats(ref.device, ref.control, _WbRules.parseDuration(window));
+  }
+
+  function statsField (name) {
+    return function (window) {
+      var s = stats(window);
+      return s === null ? null : s[name];
+    };
+  }
+
+  return {
+    // values() returns the array of {ts, value} objects,
+    // ts being the time in milliseconds since the epoch
+    values: function values (window) {
+      return _wbCellHistoryValues(ref.device, ref.control, _WbRules.parseDuration(window));
+    },
+    stats: stats,
+    avg: statsField("avg"),
+    min: statsField("min"),
+    max: statsField("max"),
+    delta: statsField("delta")
+  };
+}
+
+// PID() creates a PID controller that keeps the value of the
+// input cell at the value of the setpoint cell by writing to
+// the output cell every periodMs milliseconds, e.g.:
+//   var heating = PID({
+//     kp: 10, ki: 0.1, kd: 0,
+//     setpointCell: "thermostat/setpoint",
+//     inputCell: "wb-msw/temp",
+//     outputCell: "heater/power",
+//     periodMs: "5s"
+//   });
+// The output is limited to outputMin..outputMax range (0..100
+// by default). 'enabled: false' creates a disabled controller.
+// The controller is removed when the script is reloaded.
+function PID (options) {
+  if (typeof options != "object" || options === null)
+    throw new Error("PID: options expected");
+  var params = {};
+  ["kp", "ki", "kd", "outputMin", "outputMax", "setpointCell",
+   "inputCell", "outputCell", "enabled"].forEach(function (k) {
+    if (options[k] !== undefined)
+      params[k] = options[k];
+  });
+  // cell aliases may be used in place of the cell names
+  ["setpointCell", "inputCell", "outputCell"].forEach(function (k) {
+    var ref = params[k];
+    if (typeof ref == "string" && ref.indexOf("/") < 0 &&
+        _WbRules.aliases.hasOwnProperty(ref))
+      params[k] = _WbRules.aliases[ref];
+  });
+  if (options.periodMs !== undefined)
+    params.periodMs = _WbRules.parseDuration(options.periodMs);
+  var id = _wbPIDCreate(params);
+  if (typeof id == "string")
+    throw new Error("PID: " + id);
+
+  return {
+    enable: function () {
+      _wbPIDSetEnabled(id, true);
+    },
+    disable: function () {
+      _wbPIDSetEnabled(id, false);
+    },
+    isEnabled: function () {
+      return _wbPIDIsEnabled(id);
+    },
+    // reset() clears the accumulated integral term
+    reset: function () {
+      _wbPIDReset(id);
+    }
+  };
+}
+
+// combineSensors() defines a virtual device with 'value' cell
+// combining the readings of redundant sensors and 'error' cell
+// that's set when some of the sensors disagree with the others
+// or not enough of them are available, e.g.:
+//   combineSensors("roomTemp", ["wb-msw/temp", "wb-w1/28-0001", "t3"], {
+//     strategy: "median",
+//     maxSpread: 2
+//   });
+// Sensors can be specified as "device/cell" or as cell aliases.
+// The readings that deviate from the median by more than a half
+// of maxSpread are rejected. The remaining readings are combined
+// using the strategy: "median" (default), "mean", "weighted"
+// (weighted mean using 'weights' option), "min" or "max".
+// The value isn't updated when no readings are available.
+// Returns the name of the device.
+var combineSensors = (function () {
+  function median (readings) {
+    var values = readings.map(function (r) { return r.value; }).sort(function (a, b) {
+      return a - b;
+    }), n = values.length;
+    return n % 2 ? values[(n - 1) / 2] : (values[n / 2 - 1] + values[n / 2]) / 2;
+  }
+
+  function weightedMean (readings) {
+    var sum = 0, totalWeight = 0;
+    readings.forEach(function (r) {
+      sum += r.value * r.weight;
+      totalWeight += r.weight;
+    });
+    return sum / totalWeight;
+  }
+
+  var strategies = {
+    median: median,
+    mean: function (readings) {
+      return weightedMean(readings.map(function (r) {
+        return { value: r.value, weight: 1 };
+      }));
+    },
+    weighted: weightedMean,
+    min: function (readings) {
+      return Math.min.apply(null, readings.map(function (r) { return r.value; }));
+    },
+    max: function (readings) {
+      return Math.max.apply(null, readings.map(function (r) { return r.value; }));
+    }
+  };
+
+  function resolveRef (item) {
+    if (typeof item == "string" && item.indexOf("/") >= 0)
+      return item;
+    if (!_WbRules.aliases.hasOwnProperty(item))
+      throw new Error("combineSensors: invalid sensor: " + item);
+    return _WbRules.aliases[item];
+  }
+
+  // readSensor() returns undefined for incomplete cells
+  function readSensor (ref) {
+    _WbRules.requireCompleteCells++;
+    try {
+      return dev[ref];
+    } catch (e) {
+      if (e instanceof _WbRules.IncompleteCellCaught)
+        return undefined;
+      throw e;
+    } finally {
+      _WbRules.requireCompleteCells--;
+    }
+  }
+
+  return function (name, sensors, options) {
+    if (typeof name != "string" || !name || name.indexOf("/") >= 0)
+      throw new Error("combineSensors: invalid device name");
+    if (!Array.isArray(sensors) || !sensors.length)
+      throw new Error("combineSensors: sensor list expected");
+    options = options || {};
+    var strategy = options.strategy || "median",
+        combine = strategies.hasOwnProperty(strategy) ? strategies[strategy] : null,
+        weights = options.weights || [],
+        minSensors = options.hasOwnProperty("minSensors") ? options.minSensors : 1,
+        refs = sensors.map(resolveRef);
+    if (!combine)
+      throw new Error("combineSensors: unknown strategy: " + strategy);
+    if (strategy == "weighted" && weights.length != refs.length)
+      throw new Error("combineSensors: weights must be specified for all of the sensors");
+
+    var devName = defineVirtualDevice(name, {
+      title: options.title || name,
+      cells: {
+        value: { type: options.type || "temperature", value: 0, readonly: true },
+        error: { type: "switch", value: false, readonly: true }
+      }
+    });
+    var valueRef = devName + "/value", errorRef = devName + "/error";
+
+    defineRule("_wbCombineSensors:" + devName, {
+      whenChanged: refs,
+      then: function () {
+        var readings = [];
+        refs.forEach(function (ref, i) {
+          var value = readSensor(ref);
+          if (typeof value == "number" && isFinite(value))
+            readings.push({ value: value, weight: i < weights.length ? weights[i] : 1 });
+        });
+        var nAvailable = readings.length;
+        if (readings.length && options.hasOwnProperty("maxSpread")) {
+          var m = median(readings);
+          readings = readings.filter(function (r) {
+            return Math.abs(r.value - m) <= options.maxSpread / 2;
+          });
+        }
+        var error = readings.length < nAvailable || readings.length < minSensors;
+        if (readings.length) {
+          var value = combine(readings);
+          if (dev[valueRef] !== value)
+            dev[valueRef] = value;
+        }
+        if (dev[errorRef] !== error)
+          dev[errorRef] = error;
+      }
+    });
+    return devName;
+  };
+})();
+
+// defineLoadShifting() computes the daily run schedule of the
+// appliances that minimizes the cost of energy for the specified
+// tariffs and switches the appliances according to it. The plan
+// is exposed as the cells of the virtual device. The plan is
+// recomputed at midnight and when the power of an appliance
+// specified as a cell changes.
+var defineLoadShifting = (function () {
+  function parseHour (spec) {
+    var m = typeof spec == "string" && /^(\d{1,2}):00$/.exec(spec),
+        hour = m ? +m[1] : spec;
+    if (typeof hour != "number" || hour % 1 || hour < 0 || hour > 24)
+      throw new Error("defineLoadShifting: invalid hour: " + spec);
+    return hour % 24;
+  }
+
+  function formatHour (hour) {
+    return (hour < 10 ? "0" : "") + hour + ":00";
+  }
+
+  // formatPlan() returns the run hours as "23:00-02:00, 05:00-06:00"
+  function formatPlan (schedule) {
+    var runs = [], start = null;
+    for (var h = 0; h <= 24; h++) {
+      var on = h < 24 && schedule[h];
+      if (on && start === null)
+        start = h;
+      else if (!on && start !== null) {
+        runs.push({ start: start, end: h });
+        start = null;
+      }
+    }
+    if (runs.length > 1 && runs[0].start == 0 && runs[runs.length - 1].end == 24)
+      runs[0].start = runs.pop().start;
+    return runs.map(function (run) {
+      return formatHour(run.start) + "-" + formatHour(run.end);
+    }).join(", ");
+  }
+
+  function setCell (ref, value) {
+    if (dev[ref] !== value)
+      dev[ref] = value;
+  }
+
+  return function (name, options) {
+    if (typeof name != "string" || !name || name.indexOf("/") >= 0)
+      throw new Error("defineLoadShifting: invalid device name");
+    options = options || {};
+    if (!Array.isArray(options.tariffs) || !options.tariffs.length)
+      throw new Error("defineLoadShifting: tariffs expected");
+    var appliances = options.appliances || {},
+        names = Object.keys(appliances).sort(),
+        powerRefs = [],
+        cells = {
+          cost: { type: "value", value: 0, readonly: true },
+          error: { type: "text", value: "", readonly: true }
+        };
+    if (!names.length)
+      throw new Error("defineLoadShifting: appliances expected");
+    var tariffs = options.tariffs.map(function (tariff) {
+      if (typeof tariff.price != "number")
+        throw new Error("defineLoadShifting: invalid tariff price");
+      return { from: parseHour(tariff.from), to: parseHour(tariff.to), price: tariff.price };
+    });
+    names.forEach(function (app) {
+      var appliance = appliances[app];
+      if (typeof appliance.hours != "number")
+        throw new Error("defineLoadShifting: hours must be specified for " + app);
+      if (typeof appliance.power == "string")
+        powerRefs.push(appliance.power);
+      else if (typeof appliance.power != "number")
+        throw new Error("defineLoadShifting: invalid power for " + app);
+      cells[app] = { type: "switch", value: false, readonly: true };
+      cells[app + "Plan"] = { type: "text", value: "", readonly: true };
+    });
+
+    var devName = defineVirtualDevice(name, {
+      title: options.title || name,
+      cells: cells
+    });
+    var plan = null;
+
+    function apply () {
+      var hour = new Date().getHours();
+      names.forEach(function (app) {
+        var on = !!plan && plan.schedule[app][hour], control = appliances[app].control;
+        setCell(devName + "/" + app, on);
+        // the appliances are left as is if there's no plan
+        if (plan && control)
+          setCell(control, on);
+      });
+    }
+
+    function replan () {
+      var result = _wbPlanLoadSchedule({
+        tariffs: tariffs,
+        maxPower: options.maxPower || 0,
+        appliances: names.map(function (app) {
+          var appliance = appliances[app],
+              power = typeof appliance.power == "string" ? dev[appliance.power] : appliance.power;
+          return {
+            name: app,
+            power: +power || 0,
+            hours: appliance.hours,
+            from: appliance.hasOwnProperty("from") ? parseHour(appliance.from) : 0,
+            to: appliance.hasOwnProperty("to") ? parseHour(appliance.to) : 0,
+            contiguous: !!appliance.contiguous
+          };
+        })
+      });
+      if (result.error) {
+        plan = null;
+        log.error("defineLoadShifting: {}: {}", devName, result.error);
+        setCell(devName + "/error", result.error);
+      } else {
+        plan = result;
+        setCell(devName + "/error", "");
+        setCell(devName + "/cost", Math.round(plan.cost * 100) / 100);
+      }
+      names.forEach(function (app) {
+        setCell(devName + "/" + app + "Plan", plan ? formatPlan(plan.schedule[app]) : "");
+      });
+      apply();
+    }
+
+    defineRule("_wbLoadShifting:" + devName, {
+      asSoonAs: function () {
+        return true;
+      },
+      then: replan
+    });
+
+    defineRule("_wbLoadShifting:" + devName + ":hourly", {
+      when: cron("@hourly"),
+      then: function () {
+        if (new Date().getHours() == 0)
+          replan();
+        else
+          apply();
+      }
+    });
+
+    if (powerRefs.length) {
+      defineRule("_wbLoadShifting:" + devName + ":power", {
+        whenChanged: powerRefs,
+        then: replan
+      });
+    }
+    return devName;
+  };
+})();
+
+// defineHeartbeatGuard() is a dead-man switch that makes sure
+// that critical rules keep firing and cells keep changing, e.g.:
+//   defineHeartbeatGuard({
+//     expect: ["pump controller fired within 10m",
+//              "wb-msw/temp changed within 5m"],
+//     onMiss: function (expectation) {
+//       dev["pump/enabled"] = false;
+//     }
+//   });
+// Expectations are "<rule> fired within <duration>" or
+// "<device/cell or alias> changed within <duration>". Each of
+// them is checked once per its duration, so the expectation is
+// missed if the rule didn't fire or the cell didn't change during
+// the whole period. onMiss is invoked once per miss, optional
+// onRestore is invoked when the activity resumes.
+var defineHeartbeatGuard = (function () {
+  var EXPECTATION_RX = /^(.+) (fired|changed) within (\S+)$/;
+
+  function parseExpectation (text) {
+    var m = typeof text == "string" && EXPECTATION_RX.exec(text);
+    if (!m)
+      throw new Error("defineHeartbeatGuard: invalid expectation: " + text);
+    var target = m[1];
+    if (m[2] == "changed" && target.indexOf("/") < 0) {
+      if (!_WbRules.aliases.hasOwnProperty(target))
+        throw new Error("defineHeartbeatGuard: invalid cell: " + target);
+      target = _WbRules.aliases[target];
+    }
+    var interval = _WbRules.parseDuration(m[3]);
+    if (interval <= 0)
+      throw new Error("defineHeartbeatGuard: invalid duration: " + m[3]);
+    return { text: text, target: target, kind: m[2], interval: interval };
+  }
+
+  function watch (expectation, onMiss, onRestore) {
+    var activity, missed = false;
+    if (expectation.kind == "fired") {
+      activity = function () {
+        // null for rules that aren't defined (yet)
+        return _wbRuleFireCount(expectation.target);
+      };
+    } else {
+      var changes = 0;
+      defineRule("_wbHeartbeatGuard:" + expectation.text, {
+        whenChanged: expectation.target,
+        then: function () {
+          changes++;
+        }
+      });
+      activity = function () {
+        return changes;
+      };
+    }
+
+    var last = activity();
+    setInterval(function () {
+      var current = activity(), alive = current !== null && current !== last;
+      last = current;
+      if (alive != missed)
+        return;
+      missed = !alive;
+      if (missed) {
+        log.warning("heartbeat missed: {}", expectation.text);
+        onMiss(expectation.text);
+      } else {
+        log.info("heartbeat restored: {}", expectation.text);
+        if (onRestore)
+          onRestore(expectation.text);
+      }
+    }, expectation.interval);
+  }
+
+  return function (options) {
+    options = options || {};
+    var expect = typeof options.expect == "string" ? [options.expect] : options.expect;
+    if (!Array.isArray(expect) || !expect.length)
+      throw new Error("defineHeartbeatGuard: expectations expected");
+    if (typeof options.onMiss != "function")
+      throw new Error("defineHeartbeatGuard: onMiss function expected");
+    if (options.onRestore !== undefined && typeof options.onRestore != "function")
+      throw new Error("defineHeartbeatGuard: onRestore must be a function");
+    expect.map(parseExpectation).forEach(function (expectation) {
+      watch(expectation, options.onMiss, options.onRestore);
+    });
+  };
+})();
+
+// override() temporarily sets the cell value, e.g. for
+// a "party mode", and restores the previous value when the
+// override period ends or when the override is cancelled.
+// Overridden cells are marked with 'override' meta so
+// the UI can display them.
+var override = (function () {
+  // active overrides are kept in the persistent storage
+  // so they're included in state snapshots and are restored
+  // when the engine is started, see restore()
+  var OVERRIDES_BUCKET = "overrides", active = {};
+
+  function setOverrideMeta (ref, overridden) {
+    try {
+      publish("/devices/{}/controls/{}/meta/override".format(ref.device, ref.control),
+              overridden ? "1" : "", 1, true);
+    } catch (e) {
+      debug("can't set override meta for {}/{}: {}", ref.device, ref.control, e);
+    }
+  }
+
+  function cancel (cellRef) {
+    if (!active.hasOwnProperty(cellRef))
+      return false;
+    var entry = active[cellRef];
+    delete active[cellRef];
+    if (entry.timerId !== null)
+      clearTimeout(entry.timerId);
+    dev[cellRef] = entry.previous;
+    setOverrideMeta(entry.ref, false);
+    _wbPersistentSet(OVERRIDES_BUCKET, cellRef, null);
+    return true;
+  }
+
+  function startExpiryTimer (cellRef, entry, ms) {
+    entry.timerId = setTimeout(function () {
+      entry.timerId = null;
+      cancel(cellRef);
+    }, ms);
+  }
+
+  // restore() re-applies the overrides saved in the persistent
+  // storage, e.g. before a restart or in a state snapshot imported
+  // by BootstrapState(). The overrides that have expired meanwhile
+  // are cancelled, restoring the previous values.
+  function restore () {
+    _wbPersistentKeys(OVERRIDES_BUCKET).sort().forEach(function (cellRef) {
+      var saved = _wbPersistentGet(OVERRIDES_BUCKET, cellRef);
+      if (!saved || active.hasOwnProperty(cellRef))
+        return;
+      var ms = saved.until ? new Date(saved.until).getTime() - Date.now() : null;
+      try {
+        var ref = _WbRules.parseCellRef(cellRef);
+        if (ms !== null && !(ms > 0)) {
+          dev[cellRef] = saved.previous;
+          setOverrideMeta(ref, false);
+          _wbPersistentSet(OVERRIDES_BUCKET, cellRef, null);
+          return;
+        }
+        var entry = active[cellRef] = { ref: ref, previous: saved.previous, timerId: null };
+        dev[cellRef] = saved.value;
+        setOverrideMeta(ref, true);
+        if (ms !== null)
+          startExpiryTimer(cellRef, entry, ms);
+      } catch (e) {
+        log.error("can't restore override of {}: {}", cellRef, e);
+        _wbPersistentSet(OVERRIDES_BUCKET, cellRef, null);
+      }
+    });
+  }
+
+  _wbAddStartupHook(restore);
+
+  function doOverride (cellRef, value, options) {
+    var ref = _WbRules.parseCellRef(cellRef), entry;
+    options = options || {};
+    var ms = options.hasOwnProperty("for") ? _WbRules.parseDuration(options.for) : null;
+    if (active.hasOwnProperty(cellRef)) {
+      // repeated override extends the period but keeps
+      // the original value to restore
+      entry = active[cellRef];
+      if (entry.timerId !== null)
+        clearTimeout(entry.timerId);
+      entry.timerId = null;
+    } else
+      entry = active[cellRef] = { ref: ref, previous: dev[cellRef], timerId: null };
+    dev[cellRef] = value;
+    setOverrideMeta(ref, true);
+    if (ms !== null)
+      startExpiryTimer(cellRef, entry, ms);
+    _wbPersistentSet(OVERRIDES_BUCKET, cellRef, {
+      value: value,
+      previous: entry.previous,
+      until: ms === null ? null : new Date(Date.now() + ms).toISOString()
+    });
+    return {
+      cancel: function () {
+        return active[cellRef] === entry && cancel(cellRef);
+      }
+    };
+  }
+
+  doOverride.cancel = cancel;
+  doOverride.isActive = function (cellRef) {
+    return active.hasOwnProperty(cellRef);
+  };
+  return doOverride;
+})();
+
+// command() writes the value to the command cell and waits for
+// the status cell to report the expected value, e.g.
+//   command("relays/K1", true, {
+//     timeout: "5s",
+//     onAck: function (value) { ... },
+//     onTimeout: function () { ... }
+//   });
+// The status cell defaults to the command cell itself, so the
+// command is acknowledged when the device publishes the new value.
+var command = (function () {
+  var DEFAULT_TIMEOUT = 10000, pending = {}, watchers = {};
+
+  function finish (cmdRef, entry) {
+    if (pending[cmdRef] !== entry)
+      return false;
+    delete pending[cmdRef];
+    if (entry.timerId !== null)
+      clearTimeout(entry.timerId);
+    return true;
+  }
+
+  function ensureWatcher (statusRef) {
+    if (watchers.hasOwnProperty(statusRef))
+      return;
+    watchers[statusRef] = true;
+    // the watcher rule is removed together with the script
+    // that defined it
+    _wbAddCleanup(function () {
+      delete watchers[statusRef];
+    });
+    defineRule("_wbCommandAck:" + statusRef, {
+      whenChanged: statusRef,
+      then: function (newValue) {
+        Object.keys(pending).forEach(function (cmdRef) {
+          var entry = pending[cmdRef];
+          if (entry.statusRef == statusRef && newValue === entry.expect &&
+              finish(cmdRef, entry) && entry.onAck)
+            entry.onAck(newValue);
+        });
+      }
+    });
+  }
+
+  function doCommand (cmdRef, value, options) {
+    options = options || {};
+    var statusRef = options.status || cmdRef;
+    _WbRules.parseCellRef(cmdRef);
+    _WbRules.parseCellRef(statusRef);
+    var ms = _WbRules.parseDuration(options.hasOwnProperty("timeout") ?
+                                    options.timeout : DEFAULT_TIMEOUT);
+    var entry = {
+      statusRef: statusRef,
+      expect: options.hasOwnProperty("expect") ? options.expect : value,
+      onAck: options.onAck || null,
+      onTimeout: options.onTimeout || null,
+      timerId: null
+    };
+    // a repeated command replaces the pending one
+    if (pending.hasOwnProperty(cmdRef))
+      finish(cmdRef, pending[cmdRef]);
+    ensureWatcher(statusRef);
+    pending[cmdRef] = entry;
+    dev[cmdRef] = value;
+    entry.timerId = setTimeout(function () {
+      entry.timerId = null;
+      if (finish(cmdRef, entry) && entry.onTimeout)
+        entry.onTimeout();
+    }, ms);
+    return {
+      cancel: function () {
+        return finish(cmdRef, entry);
+      },
+      get pending () {
+        return pending[cmdRef] === entry;
+      }
+    };
+  }
+
+  doCommand.isPending = function (cmdRef) {
+    return pending.hasOwnProperty(cmdRef);
+  };
+  return doCommand;
+})();
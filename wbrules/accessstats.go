@@ -0,0 +1,101 @@
+package wbrules
+
+import (
+	"sort"
+)
+
+// CellAccessStats describes how the cell was used by the
+// scripts since the engine was started
+type CellAccessStats struct {
+	Device string `json:"device"`
+	Cell   string `json:"cell"`
+	Reads  uint64 `json:"reads"`
+	Writes uint64 `json:"writes"`
+	// Rules is the number of rules that depend on the cell
+	Rules int `json:"rules"`
+}
+
+func (stats *CellAccessStats) Referenced() bool {
+	return stats.Reads > 0 || stats.Writes > 0 || stats.Rules > 0
+}
+
+// CellAccessReport lists cell access statistics along with
+// devices and cells that weren't referenced by any script.
+// Unreferenced cells are listed as "device/cell".
+type CellAccessReport struct {
+	Cells               []CellAccessStats `json:"cells"`
+	UnreferencedCells   []string          `json:"unreferencedCells"`
+	UnreferencedDevices []string          `json:"unreferencedDevices"`
+}
+
+// CellAccessReport returns the cell access report for all the
+// devices known to the engine except for the engine's own
+// settings device
+func (engine *RuleEngine) CellAccessReport() (report *CellAccessReport) {
+	engine.Call(func() {
+		report = engine.buildCellAccessReport()
+	})
+	return
+}
+
+func (engine *RuleEngine) buildCellAccessReport() *CellAccessReport {
+	devNames := make([]string, 0, len(engine.model.devices))
+	for name := range engine.model.devices {
+		if name != engine.settingsDevName() {
+			devNames = append(devNames, name)
+		}
+	}
+	sort.Strings(devNames)
+
+	report := &CellAccessReport{
+		Cells:               make([]CellAccessStats, 0),
+		UnreferencedCells:   make([]string, 0),
+		UnreferencedDevices: make([]string, 0),
+	}
+	for _, devName := range devNames {
+		devReferenced := false
+		for _, cell := range engine.model.devices[devName].sortedCells() {
+			stats := CellAccessStats{
+				Device: devName,
+				Cell:   cell.Name(),
+				Reads:  cell.reads,
+				Writes: cell.writes,
+				Rules:  len(engine.cellToRuleMap[cell]),
+			}
+			report.Cells = append(report.Cells, stats)
+			if stats.Referenced() {
+				devReferenced = true
+			} else {
+				report.UnreferencedCells = append(report.UnreferencedCells, devName+"/"+cell.Name())
+			}
+		}
+		if !devReferenced {
+			report.UnreferencedDevices = append(report.UnreferencedDevices, devName)
+		}
+	}
+	return report
+}
+
+// CellAccessReporter provides cell access reports
+type CellAccessReporter interface {
+	CellAccessReport() *CellAccessReport
+}
+
+// AccessStats is an RPC service that provides cell access
+// statistics. It helps to find devices and cells that
+// aren't used by any rules, e.g. stale virtual devices
+// and dead hardware mappings.
+type AccessStats struct {
+	reporter CellAccessReporter
+}
+
+func NewAccessStats(reporter CellAccessReporter) *AccessStats {
+	return &AccessStats{reporter}
+}
+
+type AccessStatsReportArgs struct{}
+
+func (accessStats *AccessStats) Report(args *AccessStatsReportArgs, reply *CellAccessReport) error {
+	*reply = *accessStats.reporter.CellAccessReport()
+	return nil
+}
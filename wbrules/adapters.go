@@ -0,0 +1,279 @@
+package wbrules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DisposaBoy/JsonConfigReader"
+	wbgo "github.com/contactless/wbgo"
+	"github.com/stretchr/objx"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ADAPTER_FILE_EXTENSION = ".json"
+)
+
+// AdapterControl maps the values received on an MQTT topic
+// to a cell of the adapter device. If Path is set, the payload
+// is parsed as JSON and the value is taken from the object
+// property specified by the dot-separated path, otherwise the
+// whole payload is used. Values maps the received values to
+// the values of the cell. If Command is set, the cell isn't
+// read-only and its value is published to the Command topic
+// when it's changed by rules or by the user, using the
+// reverse mapping of Values if possible.
+type AdapterControl struct {
+	Type    string                 `json:"type"`
+	Topic   string                 `json:"topic"`
+	Path    string                 `json:"path"`
+	Values  map[string]interface{} `json:"values"`
+	Command string                 `json:"command"`
+	Max     *float64               `json:"max"`
+	// lastValue is the raw value of the cell that was
+	// received from the device or sent to it
+	lastValue string
+}
+
+// DeviceAdapter describes a virtual device whose cells reflect
+// the state of a device that doesn't follow Wiren Board MQTT
+// conventions, e.g. a zigbee2mqtt, Tasmota or Shelly device:
+//
+//	{
+//	  "device": "hall_plug",
+//	  "title": "Hall plug",
+//	  "controls": {
+//	    "power": {
+//	      "type": "switch",
+//	      "topic": "stat/hall_plug/POWER",
+//	      "values": { "ON": true, "OFF": false },
+//	      "command": "cmnd/hall_plug/POWER"
+//	    },
+//	    "voltage": {
+//	      "type": "voltage",
+//	      "topic": "tele/hall_plug/SENSOR",
+//	      "path": "ENERGY.Voltage"
+//	    }
+//	  }
+//	}
+type DeviceAdapter struct {
+	Device   string                     `json:"device"`
+	Title    string                     `json:"title"`
+	Controls map[string]*AdapterControl `json:"controls"`
+}
+
+var noAdapterValue = errors.New("no value")
+
+// ReadDeviceAdapter reads the device adapter definition
+// from the JSON file (comments are allowed)
+func ReadDeviceAdapter(path string) (*DeviceAdapter, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	content, err := ioutil.ReadAll(JsonConfigReader.New(in))
+	if err != nil {
+		return nil, err
+	}
+	var adapter DeviceAdapter
+	if err = json.Unmarshal(content, &adapter); err != nil {
+		return nil, err
+	}
+	if err = adapter.validate(); err != nil {
+		return nil, err
+	}
+	return &adapter, nil
+}
+
+func (adapter *DeviceAdapter) validate() error {
+	if adapter.Device == "" {
+		return errors.New("adapter: no device name")
+	}
+	if len(adapter.Controls) == 0 {
+		return fmt.Errorf("adapter %s: no controls", adapter.Device)
+	}
+	for name, ctl := range adapter.Controls {
+		switch {
+		case ctl == nil || ctl.Type == "":
+			return fmt.Errorf("adapter %s/%s: no control type", adapter.Device, name)
+		case ctl.Topic == "":
+			return fmt.Errorf("adapter %s/%s: no topic", adapter.Device, name)
+		case !isValidTopicFilter(ctl.Topic):
+			return fmt.Errorf("adapter %s/%s: invalid topic: %s", adapter.Device, name, ctl.Topic)
+		case strings.ContainsAny(ctl.Command, "+#"):
+			return fmt.Errorf("adapter %s/%s: invalid command topic: %s", adapter.Device, name, ctl.Command)
+		}
+	}
+	return nil
+}
+
+// adapterZeroValue returns the initial value of the
+// adapter cell of the specified type
+func adapterZeroValue(controlType string) interface{} {
+	switch cellType(controlType) {
+	case CELL_TYPE_BOOLEAN, CELL_TYPE_BUTTON:
+		return false
+	case CELL_TYPE_FLOAT:
+		return float64(0)
+	case CELL_TYPE_RGB:
+		return RGBColor{}.String()
+	default:
+		return ""
+	}
+}
+
+// extractValue returns the control value contained
+// in the message payload
+func (ctl *AdapterControl) extractValue(payload string) (interface{}, error) {
+	var value interface{} = payload
+	if ctl.Path != "" {
+		if err := json.Unmarshal([]byte(payload), &value); err != nil {
+			return nil, err
+		}
+		for _, key := range strings.Split(ctl.Path, ".") {
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, noAdapterValue
+			}
+			if value, ok = m[key]; !ok {
+				return nil, noAdapterValue
+			}
+		}
+	}
+	if value == nil {
+		return nil, noAdapterValue
+	}
+	if mapped, found := ctl.Values[adapterValueKey(value)]; found {
+		return mapped, nil
+	}
+	return value, nil
+}
+
+// commandPayload returns the payload of the command that
+// sets the control to the value of the cell
+func (ctl *AdapterControl) commandPayload(cell *Cell) string {
+	keys := make([]string, 0, len(ctl.Values))
+	for key := range ctl.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if v, err := validateCellValue(cell.Type(), cell.Max(), ctl.Values[key]); err == nil && v == cell.Value() {
+			return key
+		}
+	}
+	return cell.RawValue()
+}
+
+func adapterValueKey(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// DefineDeviceAdapter defines the virtual device for the adapter
+// and subscribes to the topics of its controls
+func (engine *RuleEngine) DefineDeviceAdapter(adapter *DeviceAdapter) error {
+	return engine.CallErr(func() error {
+		return engine.defineDeviceAdapter(adapter)
+	})
+}
+
+func (engine *RuleEngine) defineDeviceAdapter(adapter *DeviceAdapter) error {
+	cells := objx.Map{}
+	for name, ctl := range adapter.Controls {
+		cellDef := objx.Map{
+			"type":     ctl.Type,
+			"value":    adapterZeroValue(ctl.Type),
+			"readonly": ctl.Command == "",
+		}
+		if ctl.Max != nil {
+			cellDef["max"] = *ctl.Max
+		}
+		cells[name] = cellDef
+	}
+	title := adapter.Title
+	if title == "" {
+		title = adapter.Device
+	}
+	if err := engine.DefineVirtualDevice(adapter.Device, objx.Map{"title": title, "cells": cells}); err != nil {
+		return err
+	}
+	dev := engine.model.devices[adapter.Device]
+	for name, ctl := range adapter.Controls {
+		cell, c := dev.MustGetCell(name), ctl
+		if c.Command != "" {
+			engine.adapterCells[cell] = c
+		}
+		err := engine.TrackMQTT(c.Topic, func(msg wbgo.MQTTMessage) {
+			engine.acceptAdapterValue(cell, c, msg.Payload)
+		})
+		if err != nil {
+			return fmt.Errorf("adapter %s/%s: %s", adapter.Device, name, err)
+		}
+	}
+	return nil
+}
+
+// LoadDeviceAdapters defines the adapters described by
+// the JSON files in the specified directory
+func (engine *RuleEngine) LoadDeviceAdapters(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+ADAPTER_FILE_EXTENSION))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		adapter, err := ReadDeviceAdapter(path)
+		if err == nil {
+			err = engine.DefineDeviceAdapter(adapter)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+func (engine *RuleEngine) acceptAdapterValue(cell *Cell, ctl *AdapterControl, payload string) {
+	value, err := ctl.extractValue(payload)
+	if err == noAdapterValue {
+		// e.g. zigbee2mqtt devices don't include
+		// all the properties in each message
+		return
+	}
+	if err == nil {
+		value, err = validateCellValue(cell.Type(), cell.Max(), value)
+	}
+	if err != nil {
+		engine.Logf(ENGINE_LOG_WARNING, "adapter %s/%s: bad value %q: %s",
+			cell.DevName(), cell.Name(), payload, err)
+		return
+	}
+	engine.writeSource = CELL_SOURCE_MQTT
+	engine.setCellValue(cell, value)
+	engine.writeSource = ""
+	ctl.lastValue = cell.RawValue()
+}
+
+// maybeSendAdapterCommand publishes the command for the adapter
+// cell unless the value of the cell came from the device
+func (engine *RuleEngine) maybeSendAdapterCommand(cell *Cell) {
+	ctl, found := engine.adapterCells[cell]
+	if !found || (!cell.IsButton() && cell.RawValue() == ctl.lastValue) {
+		return
+	}
+	ctl.lastValue = cell.RawValue()
+	engine.Publish(ctl.Command, ctl.commandPayload(cell), 1, false)
+}
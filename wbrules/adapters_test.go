@@ -0,0 +1,109 @@
+package wbrules
+
+import (
+	wbgo "github.com/contactless/wbgo"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testAdapter = `{
+  // Tasmota plug
+  "device": "hall_plug",
+  "controls": {
+    "power": {
+      "type": "switch",
+      "topic": "stat/hall_plug/POWER",
+      "values": { "ON": true, "OFF": false },
+      "command": "cmnd/hall_plug/POWER"
+    },
+    "voltage": {
+      "type": "voltage",
+      "topic": "tele/hall_plug/SENSOR",
+      "path": "ENERGY.Voltage"
+    },
+    "state": {
+      "type": "text",
+      "topic": "tele/hall_plug/SENSOR",
+      "path": "ENERGY.State"
+    }
+  }
+}`
+
+type adapterTestClient struct {
+	trackTestClient
+	published []wbgo.MQTTMessage
+}
+
+func (client *adapterTestClient) Publish(message wbgo.MQTTMessage) {
+	client.published = append(client.published, message)
+}
+
+func TestDeviceAdapters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wbrules-adapters")
+	if err != nil {
+		t.Fatalf("TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "plug.json"), []byte(testAdapter), 0644); err != nil {
+		t.Fatalf("WriteFile(): %s", err)
+	}
+
+	client := &adapterTestClient{
+		trackTestClient: trackTestClient{handlers: make(map[string]wbgo.MQTTMessageHandler)},
+	}
+	model, engine := newTestEngine(t, client)
+	if err := engine.LoadDeviceAdapters(dir); err != nil {
+		t.Fatalf("LoadDeviceAdapters(): %s", err)
+	}
+	if len(client.handlers) != 2 {
+		t.Fatalf("bad subscriptions: %v", client.handlers)
+	}
+	power := model.EnsureCell(&CellSpec{"hall_plug", "power"})
+	voltage := model.EnsureCell(&CellSpec{"hall_plug", "voltage"})
+	state := model.EnsureCell(&CellSpec{"hall_plug", "state"})
+	if power.readonly || !voltage.readonly {
+		t.Errorf("bad readonly flags")
+	}
+
+	client.handlers["stat/hall_plug/POWER"](wbgo.MQTTMessage{Topic: "stat/hall_plug/POWER", Payload: "ON"})
+	client.handlers["tele/hall_plug/SENSOR"](wbgo.MQTTMessage{
+		Topic:   "tele/hall_plug/SENSOR",
+		Payload: `{"ENERGY": {"Voltage": 229.5}}`,
+	})
+	if power.Value() != true || voltage.Value() != 229.5 || state.Value() != "" {
+		t.Errorf("bad values: %v, %v, %q", power.Value(), voltage.Value(), state.Value())
+	}
+	if power.Source() != CELL_SOURCE_MQTT {
+		t.Errorf("bad source: %q", power.Source())
+	}
+
+	client.published = nil
+	powerSpec := &CellSpec{"hall_plug", "power"}
+	engine.RunRules(powerSpec, NO_TIMER_NAME)
+	if len(client.published) != 0 {
+		t.Errorf("the value received from the device was sent back: %v", client.published)
+	}
+	engine.setCellValue(power, false)
+	engine.RunRules(powerSpec, NO_TIMER_NAME)
+	expected := []wbgo.MQTTMessage{{Topic: "cmnd/hall_plug/POWER", Payload: "OFF", QoS: 1}}
+	if !reflect.DeepEqual(client.published, expected) {
+		t.Errorf("bad command: %v", client.published)
+	}
+}
+
+func TestDeviceAdapterValidation(t *testing.T) {
+	for _, adapter := range []DeviceAdapter{
+		{Controls: map[string]*AdapterControl{"x": {Type: "text", Topic: "a/b"}}},
+		{Device: "dev"},
+		{Device: "dev", Controls: map[string]*AdapterControl{"x": {Topic: "a/b"}}},
+		{Device: "dev", Controls: map[string]*AdapterControl{"x": {Type: "text", Topic: "a/#/b"}}},
+		{Device: "dev", Controls: map[string]*AdapterControl{"x": {Type: "text", Topic: "a/b", Command: "a/+"}}},
+	} {
+		if adapter.validate() == nil {
+			t.Errorf("no error for %#v", adapter)
+		}
+	}
+}
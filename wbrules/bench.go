@@ -0,0 +1,190 @@
+package wbrules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+const (
+	BENCHMARK_DEV_NAME    = "_wbrulesBench"
+	BENCHMARK_SCRIPT_NAME = "bench.js"
+)
+
+// BenchmarkOptions specify the parameters of a synthetic
+// rule set used for benchmarking.
+type BenchmarkOptions struct {
+	// Rules is the number of rules to define.
+	Rules int
+	// Cells is the number of cells of the benchmark device.
+	Cells int
+	// Changes is the number of cell changes to make.
+	Changes int
+	// ChangeRate is the number of cell changes per second.
+	// Zero means 'as fast as possible'.
+	ChangeRate float64
+}
+
+// BenchmarkResult contains rule evaluation latency statistics
+// and allocation counts gathered during the benchmark run.
+type BenchmarkResult struct {
+	Changes      int
+	Total        time.Duration
+	Min          time.Duration
+	P50          time.Duration
+	P90          time.Duration
+	P99          time.Duration
+	Max          time.Duration
+	AllocsPerRun float64
+	BytesPerRun  float64
+}
+
+func (r *BenchmarkResult) String() string {
+	return fmt.Sprintf(
+		"%d changes in %s: min %s, p50 %s, p90 %s, p99 %s, max %s; "+
+			"%.1f allocs/change, %.1f bytes/change",
+		r.Changes, r.Total, r.Min, r.P50, r.P90, r.P99, r.Max,
+		r.AllocsPerRun, r.BytesPerRun)
+}
+
+func (opts BenchmarkOptions) validate() error {
+	if opts.Rules <= 0 || opts.Cells <= 0 || opts.Changes <= 0 {
+		return errors.New("benchmark: rule, cell and change counts must be positive")
+	}
+	if opts.ChangeRate < 0 {
+		return errors.New("benchmark: negative change rate")
+	}
+	return nil
+}
+
+func benchCellName(n int) string {
+	return fmt.Sprintf("c%d", n)
+}
+
+// GenerateBenchmarkScript returns the source of a synthetic rule set.
+// Even rules are whenChanged rules and odd ones are level-triggered
+// rules, each of them depending on one or two benchmark device cells.
+func GenerateBenchmarkScript(opts BenchmarkOptions) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "defineVirtualDevice(%q, {\n  cells: {\n", BENCHMARK_DEV_NAME)
+	for i := 0; i < opts.Cells; i++ {
+		fmt.Fprintf(&buf, "    %q: { type: \"temperature\", value: 0 },\n", benchCellName(i))
+	}
+	buf.WriteString("  }\n});\n\nvar benchCounter = 0;\n\n")
+	for i := 0; i < opts.Rules; i++ {
+		cellA := BENCHMARK_DEV_NAME + "/" + benchCellName(i%opts.Cells)
+		cellB := BENCHMARK_DEV_NAME + "/" + benchCellName((i+1)%opts.Cells)
+		if i%2 == 0 {
+			fmt.Fprintf(&buf, "defineRule(\"bench%d\", {\n"+
+				"  whenChanged: %q,\n"+
+				"  then: function (newValue) {\n"+
+				"    benchCounter += newValue;\n"+
+				"  }\n"+
+				"});\n\n", i, cellA)
+		} else {
+			fmt.Fprintf(&buf, "defineRule(\"bench%d\", {\n"+
+				"  when: function () {\n"+
+				"    return dev[%q] > dev[%q];\n"+
+				"  },\n"+
+				"  then: function () {\n"+
+				"    benchCounter++;\n"+
+				"  }\n"+
+				"});\n\n", i, cellA, cellB)
+		}
+	}
+	return buf.String()
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	n := int(float64(len(sorted))*p+0.5) - 1
+	switch {
+	case n < 0:
+		n = 0
+	case n >= len(sorted):
+		n = len(sorted) - 1
+	}
+	return sorted[n]
+}
+
+// RunBenchmark loads the synthetic rule set into the running engine,
+// changes benchmark device cells at the specified rate and
+// measures the time spent evaluating rules after each change.
+// Cell values are changed without publishing them so only
+// the rule dispatch path is measured. The rule set is
+// unloaded after the benchmark completes.
+func RunBenchmark(engine *ESEngine, opts BenchmarkOptions) (*BenchmarkResult, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "wbrules-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, BENCHMARK_SCRIPT_NAME)
+	if err = ioutil.WriteFile(path, []byte(GenerateBenchmarkScript(opts)), 0644); err != nil {
+		return nil, err
+	}
+	if err = engine.LiveLoadFile(path); err != nil {
+		return nil, err
+	}
+	defer engine.LiveRemoveFile(path)
+
+	var interval time.Duration
+	if opts.ChangeRate > 0 {
+		interval = time.Duration(float64(time.Second) / opts.ChangeRate)
+	}
+
+	durations := make([]time.Duration, opts.Changes)
+	var memBefore, memAfter runtime.MemStats
+	runtime.ReadMemStats(&memBefore)
+	start := time.Now()
+	for i := 0; i < opts.Changes; i++ {
+		if interval > 0 {
+			if d := start.Add(time.Duration(i) * interval).Sub(time.Now()); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		cellSpec := &CellSpec{BENCHMARK_DEV_NAME, benchCellName(i % opts.Cells)}
+		value := i % 100
+		engine.Call(func() {
+			cell := engine.model.EnsureCell(cellSpec)
+			cell.maybeSetValueQuiet(value, true)
+			cell.gotValue = true
+			runStart := time.Now()
+			engine.runRules(cellSpec, NO_TIMER_NAME)
+			durations[i] = time.Since(runStart)
+		})
+	}
+	total := time.Since(start)
+	runtime.ReadMemStats(&memAfter)
+
+	sort.Sort(durationSlice(durations))
+	return &BenchmarkResult{
+		Changes:      opts.Changes,
+		Total:        total,
+		Min:          durations[0],
+		P50:          percentile(durations, 0.5),
+		P90:          percentile(durations, 0.9),
+		P99:          percentile(durations, 0.99),
+		Max:          durations[len(durations)-1],
+		AllocsPerRun: float64(memAfter.Mallocs-memBefore.Mallocs) / float64(opts.Changes),
+		BytesPerRun:  float64(memAfter.TotalAlloc-memBefore.TotalAlloc) / float64(opts.Changes),
+	}, nil
+}
+
+type durationSlice []time.Duration
+
+func (s durationSlice) Len() int           { return len(s) }
+func (s durationSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s durationSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,76 @@
+package wbrules
+
+import (
+	"strings"
+)
+
+const (
+	// DEFAULT_MAX_CASCADE_DEPTH is the default max number of
+	// rules in a chain where each rule is triggered by a cell
+	// write made by the previous one
+	DEFAULT_MAX_CASCADE_DEPTH = 32
+)
+
+// ruleCascade describes a chain of rules where each rule
+// was triggered by a cell write of the previous one
+type ruleCascade struct {
+	rule   string
+	parent *ruleCascade
+	depth  int
+}
+
+func (cascade *ruleCascade) String() string {
+	names := make([]string, cascade.depth)
+	for c := cascade; c != nil; c = c.parent {
+		names[c.depth-1] = c.rule
+	}
+	return strings.Join(names, " -> ")
+}
+
+// SetMaxCascadeDepth sets the max length of the rule chains
+// triggered by cell writes. The cell writes that would make
+// a chain longer are dropped and reported as rule errors,
+// so a feedback loop between the rules doesn't make the
+// engine spin forever. Zero disables the check.
+func (engine *RuleEngine) SetMaxCascadeDepth(depth int) {
+	engine.maxCascadeDepth = depth
+}
+
+// beginCascade is invoked by the outermost RunRules pass
+// and makes the rule chain that caused the cell change,
+// if any, current. When a pass handles several cell changes,
+// the longest chain is used.
+func (engine *RuleEngine) beginCascade(cell *Cell) {
+	if cell == nil || len(engine.cellCauses) == 0 {
+		return
+	}
+	if cause, found := engine.cellCauses[cell]; found {
+		if engine.currentCascade == nil || engine.currentCascade.depth < cause.depth {
+			engine.currentCascade = cause
+		}
+		delete(engine.cellCauses, cell)
+	}
+}
+
+// checkCascade records the rule chain that caused the cell write
+// made by the current rule. It returns false if the write must
+// be dropped because the chain is too long.
+func (engine *RuleEngine) checkCascade(cell *Cell) bool {
+	if engine.maxCascadeDepth <= 0 || engine.runDepth == 0 || engine.currentRule == "" {
+		return true
+	}
+	depth := 1
+	if engine.currentCascade != nil {
+		depth = engine.currentCascade.depth + 1
+	}
+	cascade := &ruleCascade{engine.currentRule, engine.currentCascade, depth}
+	if depth > engine.maxCascadeDepth {
+		msg := "rule cascade is too long, possible feedback loop: " +
+			cascade.String() + "; write to " + cell.DevName() + "/" + cell.Name() + " dropped"
+		engine.Log(ENGINE_LOG_ERROR, msg)
+		engine.recordRuleError(msg)
+		return false
+	}
+	engine.cellCauses[cell] = cascade
+	return true
+}
@@ -7,7 +7,9 @@ import (
 	"log"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,37 +20,17 @@ const (
 	CELL_TYPE_BOOLEAN
 	CELL_TYPE_FLOAT
 	CELL_TYPE_BUTTON
+	CELL_TYPE_RGB
 )
 
-type CellType int
-
-var cellTypeMap map[string]CellType = map[string]CellType{
-	"text":                 CELL_TYPE_TEXT,
-	"switch":               CELL_TYPE_BOOLEAN,
-	"wo-switch":            CELL_TYPE_BOOLEAN,
-	"alarm":                CELL_TYPE_BOOLEAN,
-	"pushbutton":           CELL_TYPE_BUTTON,
-	"temperature":          CELL_TYPE_FLOAT,
-	"rel_humidity":         CELL_TYPE_FLOAT,
-	"atmospheric_pressure": CELL_TYPE_FLOAT,
-	"rainfall":             CELL_TYPE_FLOAT,
-	"wind_speed":           CELL_TYPE_FLOAT,
-	"power":                CELL_TYPE_FLOAT,
-	"power_consumption":    CELL_TYPE_FLOAT,
-	"voltage":              CELL_TYPE_FLOAT,
-	"water_flow":           CELL_TYPE_FLOAT,
-	"consumption":          CELL_TYPE_FLOAT,
-	"pressure":             CELL_TYPE_FLOAT,
-	"range":                CELL_TYPE_FLOAT,
-}
-
-func cellType(controlType string) CellType {
-	cellType, found := cellTypeMap[controlType]
-	if found {
-		return cellType
-	}
-	return CELL_TYPE_TEXT
-}
+// Pseudo-cells are maintained by the cell model for each device
+// they're referenced for. They're never published. '#' can't be
+// a part of an MQTT topic name, so there can't be real cells
+// with such names.
+const (
+	COMPLETE_PSEUDO_CELL_NAME    = "#complete"
+	LAST_UPDATE_PSEUDO_CELL_NAME = "#lastUpdate"
+)
 
 type CellSpec struct {
 	DevName  string
@@ -60,16 +42,43 @@ type CellModel struct {
 	devices            map[string]CellModelDevice
 	cellChangeChannels []chan *CellSpec
 	started            bool
+	startedMtx         sync.Mutex
 	publishDoneCh      chan struct{}
-}
+	// delayFunc is used to delay cell value updates
+	// by glitch filters, see SetDelayFunc()
+	delayFunc DelayFunc
+	// metaPublishFunc is used to publish extra cell
+	// metadata, see SetMetaPublishFunc()
+	metaPublishFunc MetaPublishFunc
+	// clock provides the time of the value updates
+	// for the cell history and '#lastUpdate' pseudo-cells
+	clock Clock
+	// pendingChanges is the number of cell changes
+	// that are not yet delivered to the channels
+	pendingChanges int32
+}
+
+// DelayFunc invokes the thunk in the model goroutine after
+// the specified duration and returns a function that
+// cancels the invocation
+type DelayFunc func(d time.Duration, thunk func()) (cancel func())
+
+// MetaPublishFunc publishes a retained meta topic
+type MetaPublishFunc func(topic, payload string)
 
 type CellModelDevice interface {
 	wbgo.DeviceModel
 	EnsureCell(name string) (cell *Cell)
 	MustGetCell(name string) (cell *Cell)
+	LookupCell(name string) (cell *Cell, found bool)
+	sortedCells() []*Cell
 	setValue(name, value string, notify bool)
+	updatePseudoCells(gotValue bool)
+	updateSourcePseudoCell(cell *Cell)
 	queryParams()
 	shouldSetValueImmediately() bool
+	// now returns the current time of the model clock
+	now() time.Time
 }
 
 type CellModelDeviceBase struct {
@@ -78,6 +87,9 @@ type CellModelDeviceBase struct {
 	cells     map[string]*Cell
 	self      CellModelDevice
 	onSetCell func(*Cell)
+	// pseudoCells are created when they're referenced,
+	// see EnsureCell()
+	pseudoCells map[string]*Cell
 }
 
 type CellModelLocalDevice struct {
@@ -98,6 +110,36 @@ type Cell struct {
 	gotType     bool
 	gotValue    bool
 	readonly    bool
+	// boxed device and cell names are used as rule
+	// callback arguments without extra allocations
+	devNameArg interface{}
+	nameArg    interface{}
+	// access counters used for cell access statistics
+	reads  uint64
+	writes uint64
+	// glitch filter state, see CellModel.SetGlitchFilter()
+	glitchFilter  time.Duration
+	pendingValue  string
+	cancelPending func()
+	// valueSeq is incremented each time the cell receives
+	// a value, even if the value is the same
+	valueSeq uint64
+	// meta holds extra metadata of local cells such as
+	// units or precision, see SetCellMeta()
+	meta map[string]string
+	// pseudo is true for pseudo-cells such as '#complete'
+	pseudo bool
+	// history holds the recent values of the cell,
+	// see EnableHistory()
+	history *cellHistory
+	// source is the last writer of the cell, see Source().
+	// writeSource is the writer of the value being set and
+	// sentSource is the writer of sentValue that was sent
+	// to an external device but not confirmed yet.
+	source      string
+	writeSource string
+	sentSource  string
+	sentValue   string
 }
 
 func NewCellModel() *CellModel {
@@ -105,6 +147,7 @@ func NewCellModel() *CellModel {
 		devices:            make(map[string]CellModelDevice),
 		cellChangeChannels: make([]chan *CellSpec, 0, CELL_CHANGE_SLICE_CAPACITY),
 		publishDoneCh:      make(chan struct{}, 10),
+		clock:              SystemClock,
 	}
 }
 
@@ -113,7 +156,7 @@ func (model *CellModel) Start() error {
 	if model.started {
 		panic("model already started")
 	}
-	model.started = true
+	model.setStarted(true)
 	names := make([]string, 0, len(model.devices))
 	for name := range model.devices {
 		names = append(names, name)
@@ -136,12 +179,26 @@ func (model *CellModel) Start() error {
 	return nil
 }
 
+func (model *CellModel) setStarted(started bool) {
+	model.startedMtx.Lock()
+	defer model.startedMtx.Unlock()
+	model.started = started
+}
+
+// IsStarted returns true if the model is started. Unlike other
+// model methods, it can be safely called from any goroutine.
+func (model *CellModel) IsStarted() bool {
+	model.startedMtx.Lock()
+	defer model.startedMtx.Unlock()
+	return model.started
+}
+
 func (model *CellModel) Stop() {
 	// should be called by the driver once and only once when it stops
 	if !model.started {
 		panic("model already stopped")
 	}
-	model.started = false
+	model.setStarted(false)
 	chs := model.cellChangeChannels
 	model.cellChangeChannels = make([]chan *CellSpec, 0, CELL_CHANGE_SLICE_CAPACITY)
 
@@ -207,6 +264,17 @@ func (model *CellModel) EnsureDevice(name string) (dev CellModelDevice) {
 	return
 }
 
+// LookupCell returns the specified cell or nil if there's no such
+// cell. Unlike EnsureCell(), it doesn't create any devices or cells.
+func (model *CellModel) LookupCell(cellSpec *CellSpec) *Cell {
+	dev, found := model.devices[cellSpec.DevName]
+	if !found {
+		return nil
+	}
+	cell, _ := dev.LookupCell(cellSpec.CellName)
+	return cell
+}
+
 func (model *CellModel) EnsureCell(cellSpec *CellSpec) *Cell {
 	return model.EnsureDevice(cellSpec.DevName).EnsureCell(cellSpec.CellName)
 }
@@ -277,11 +345,89 @@ func (model *CellModel) closeCellChangeChannel(ch chan *CellSpec) {
 }
 
 func (model *CellModel) notify(cellSpec *CellSpec) {
+	atomic.AddInt32(&model.pendingChanges, 1)
+	defer atomic.AddInt32(&model.pendingChanges, -1)
 	for _, ch := range model.cellChangeChannels {
 		ch <- cellSpec
 	}
 }
 
+// PendingCellChanges returns the number of cell changes
+// that are waiting to be received from the cell change
+// channels
+func (model *CellModel) PendingCellChanges() int {
+	return int(atomic.LoadInt32(&model.pendingChanges))
+}
+
+// SetDelayFunc sets the function that's used by glitch
+// filters to delay cell value updates
+func (model *CellModel) SetDelayFunc(delayFunc DelayFunc) {
+	model.delayFunc = delayFunc
+}
+
+// SetClock sets the clock used by the model, see RuleEngine.SetClock()
+func (model *CellModel) SetClock(clock Clock) {
+	model.clock = clock
+}
+
+// SetGlitchFilter makes the model ignore the pulses of the binary
+// cell that are shorter than the specified duration, so rules aren't
+// triggered by the noise on dry contact inputs. The new value
+// of the cell is accepted only after it stays the same for
+// the specified duration. Zero duration disables the filter,
+// the pending value, if any, is accepted immediately.
+func (model *CellModel) SetGlitchFilter(cellSpec *CellSpec, d time.Duration) {
+	dev, ok := model.EnsureDevice(cellSpec.DevName).(*CellModelExternalDevice)
+	if !ok {
+		wbgo.Warn.Printf("glitch filter can't be used for local cell %s/%s",
+			cellSpec.DevName, cellSpec.CellName)
+		return
+	}
+	cell := dev.EnsureCell(cellSpec.CellName)
+	cell.glitchFilter = d
+	if d > 0 || cell.cancelPending == nil {
+		return
+	}
+	cell.cancelPending()
+	cell.cancelPending = nil
+	dev.acceptCellValue(cell, cell.pendingValue)
+}
+
+// filterGlitch returns true if the value must not be
+// accepted right now because of the glitch filter
+// SetMetaPublishFunc sets the function that's used to publish
+// extra metadata of local cells
+func (model *CellModel) SetMetaPublishFunc(metaPublishFunc MetaPublishFunc) {
+	model.metaPublishFunc = metaPublishFunc
+}
+
+func (model *CellModel) filterGlitch(dev *CellModelDeviceBase, cell *Cell, value string) bool {
+	if !cell.gotValue || cellType(cell.controlType) != CELL_TYPE_BOOLEAN || model.delayFunc == nil {
+		// initial values aren't filtered
+		return false
+	}
+	if cell.cancelPending != nil {
+		if value == cell.pendingValue {
+			return true
+		}
+		cell.cancelPending()
+		cell.cancelPending = nil
+		if value == cell.value {
+			wbgo.Debug.Printf("glitch filter: ignoring pulse of %s/%s",
+				cell.DevName(), cell.name)
+			return true
+		}
+	} else if value == cell.value {
+		return false
+	}
+	cell.pendingValue = value
+	cell.cancelPending = model.delayFunc(cell.glitchFilter, func() {
+		cell.cancelPending = nil
+		dev.acceptCellValue(cell, value)
+	})
+	return true
+}
+
 func (model *CellModel) CallSync(thunk func()) {
 	// FIXME: need to do it all in a more Go-like way
 	model.Observer.CallSync(thunk)
@@ -306,12 +452,20 @@ func (dev *CellModelDeviceBase) setCell(name, controlType string, value interfac
 		gotType:     complete,
 		gotValue:    complete,
 		readonly:    readonly,
+		devNameArg:  dev.DevName,
+		nameArg:     name,
 	}
 	cell.maybeSetValueQuiet(value, true)
+	if oldCell, found := dev.cells[name]; found {
+		// keep access statistics when the cell is redefined
+		cell.reads, cell.writes = oldCell.reads, oldCell.writes
+		cell.history = oldCell.history
+	}
 	dev.cells[name] = cell
 	if dev.onSetCell != nil {
 		dev.onSetCell(cell)
 	}
+	dev.updatePseudoCells(false)
 	return
 }
 
@@ -327,16 +481,155 @@ func (dev *CellModelDeviceBase) SetButtonCell(name string) (cell *Cell) {
 	return dev.setCell(name, "pushbutton", 0, true, -1, false)
 }
 
+// SetCellMeta sets extra metadata of the cell such as units or
+// precision. The metadata of local cells is published as
+// /devices/<dev>/controls/<cell>/meta/<key> topics.
+func (dev *CellModelDeviceBase) SetCellMeta(name string, meta map[string]string) {
+	cell := dev.MustGetCell(name)
+	cell.meta = meta
+	if _, ok := dev.self.(*CellModelLocalDevice); ok && dev.model.started {
+		cell.publishMeta()
+	}
+}
+
 func (dev *CellModelDeviceBase) MustGetCell(name string) (cell *Cell) {
-	cell, found := dev.cells[name]
+	cell, found := dev.LookupCell(name)
 	if !found {
 		log.Panicf("cell not found: %s/%s", dev.DevName, name)
 	}
 	return
 }
 
+// LookupCell returns the cell with the specified name
+// without creating it
+func (dev *CellModelDeviceBase) LookupCell(name string) (cell *Cell, found bool) {
+	if cell, found = dev.cells[name]; !found && isPseudoCellName(name) {
+		cell, found = dev.pseudoCells[name]
+	}
+	return
+}
+
+func isPseudoCellName(name string) bool {
+	return name == COMPLETE_PSEUDO_CELL_NAME || name == LAST_UPDATE_PSEUDO_CELL_NAME ||
+		isSourcePseudoCellName(name)
+}
+
+// ensurePseudoCell returns the pseudo-cell creating it if necessary.
+// '#complete' is true when all of the cells of the device are
+// complete. '#lastUpdate' is the time of the last value received
+// by any cell of the device in milliseconds since the epoch, or
+// zero if no values were received since the pseudo-cell is created.
+// '<cell>#source' is the last writer of the cell, see Cell.Source().
+func (dev *CellModelDeviceBase) ensurePseudoCell(name string) *Cell {
+	if cell, found := dev.pseudoCells[name]; found {
+		return cell
+	}
+	if dev.pseudoCells == nil {
+		dev.pseudoCells = make(map[string]*Cell)
+	}
+	controlType, value := "value", "0"
+	switch {
+	case name == COMPLETE_PSEUDO_CELL_NAME:
+		controlType = "switch"
+		value = boolCellValue(dev.allCellsComplete())
+	case isSourcePseudoCellName(name):
+		controlType, value = "text", ""
+		if cell, found := dev.cells[strings.TrimSuffix(name, SOURCE_PSEUDO_CELL_SUFFIX)]; found {
+			value = cell.source
+		}
+	}
+	cell := &Cell{
+		device:      dev.self,
+		name:        name,
+		title:       name,
+		controlType: controlType,
+		max:         -1,
+		value:       value,
+		gotType:     true,
+		gotValue:    true,
+		readonly:    true,
+		devNameArg:  dev.DevName,
+		nameArg:     name,
+		pseudo:      true,
+	}
+	dev.pseudoCells[name] = cell
+	return cell
+}
+
+func boolCellValue(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
+func (dev *CellModelDeviceBase) allCellsComplete() bool {
+	for _, cell := range dev.cells {
+		if !cell.IsComplete() {
+			return false
+		}
+	}
+	return len(dev.cells) > 0
+}
+
+// updatePseudoCells updates the pseudo-cells of the device
+// after a cell is defined, removed or receives a value
+func (dev *CellModelDeviceBase) updatePseudoCells(gotValue bool) {
+	if len(dev.pseudoCells) == 0 {
+		return
+	}
+	if cell, found := dev.pseudoCells[LAST_UPDATE_PSEUDO_CELL_NAME]; found && gotValue {
+		cell.value = strconv.FormatInt(dev.now().UnixNano()/int64(time.Millisecond), 10)
+		cell.valueSeq++
+		go dev.model.notify(&CellSpec{dev.DevName, cell.name})
+	}
+	if cell, found := dev.pseudoCells[COMPLETE_PSEUDO_CELL_NAME]; found {
+		if value := boolCellValue(dev.allCellsComplete()); value != cell.value {
+			cell.value = value
+			cell.valueSeq++
+			go dev.model.notify(&CellSpec{dev.DevName, cell.name})
+		}
+	}
+}
+
+// RemoveCell removes the cell from the device and returns it,
+// or nil if there's no such cell
+func (dev *CellModelDeviceBase) RemoveCell(name string) *Cell {
+	cell, found := dev.cells[name]
+	if !found {
+		return nil
+	}
+	if cell.cancelPending != nil {
+		cell.cancelPending()
+		cell.cancelPending = nil
+	}
+	delete(dev.cells, name)
+	dev.updatePseudoCells(false)
+	return cell
+}
+
+func (dev *CellModelDeviceBase) now() time.Time {
+	return dev.model.clock.Now()
+}
+
+func (dev *CellModelDeviceBase) sortedCells() []*Cell {
+	names := make([]string, 0, len(dev.cells))
+	for name := range dev.cells {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cells := make([]*Cell, len(names))
+	for n, name := range names {
+		cells[n] = dev.cells[name]
+	}
+	return cells
+}
+
 func (dev *CellModelDeviceBase) EnsureCell(name string) (cell *Cell) {
 	cell, found := dev.cells[name]
+	if !found && isPseudoCellName(name) {
+		return dev.ensurePseudoCell(name)
+	}
 	if !found {
 		wbgo.Debug.Printf("adding cell %s", name)
 		cell = dev.setCell(name, "text", "", false, -1, false)
@@ -350,9 +643,32 @@ func (dev *CellModelDeviceBase) AcceptValue(name, value string) {
 	}
 
 	cell := dev.EnsureCell(name)
+	if _, isLocal := dev.self.(*CellModelLocalDevice); isLocal && cell.IsButton() {
+		// buttons have no state, so a value of a local
+		// button picked up from the broker (e.g. retained
+		// by an older version) must not be treated as a press
+		return
+	}
+	if cell.glitchFilter > 0 && dev.model.filterGlitch(dev, cell, value) {
+		return
+	}
+	dev.acceptCellValue(cell, value)
+}
+
+func (dev *CellModelDeviceBase) acceptCellValue(cell *Cell, value string) {
+	source := CELL_SOURCE_MQTT
+	if cell.sentSource != "" && value == cell.sentValue {
+		// the device confirmed the value written by the engine
+		source = cell.sentSource
+	}
+	cell.sentSource, cell.sentValue = "", ""
+	cell.setSource(source)
 	cell.value = value
 	cell.gotValue = true
-	go dev.model.notify(&CellSpec{dev.DevName, name})
+	cell.valueSeq++
+	cell.recordHistory()
+	go dev.model.notify(&CellSpec{dev.DevName, cell.name})
+	dev.updatePseudoCells(true)
 }
 
 func (dev *CellModelDeviceBase) setValue(name, value string, notify bool) {
@@ -370,28 +686,33 @@ func (dev *CellModelLocalDevice) AcceptOnValue(name, value string) bool {
 		wbgo.Debug.Printf("cell %s <- %v [.../on]", name, value)
 	}
 	cell := dev.EnsureCell(name)
+	if cell.IsButton() {
+		// the press is propagated to the rules, but
+		// the button doesn't keep any value
+		value = "0"
+	}
+	cell.setSource(CELL_SOURCE_MQTT)
 	cell.value = value
 	cell.gotValue = true
+	cell.valueSeq++
+	cell.recordHistory()
 	go dev.model.notify(&CellSpec{dev.DevName, name})
+	dev.updatePseudoCells(true)
 	return true
 }
 
 func (dev *CellModelLocalDevice) queryParams() {
-	names := make([]string, 0, len(dev.cells))
-	for name := range dev.cells {
-		names = append(names, name)
-	}
-	sort.Strings(names)
-	for _, name := range names {
-		cell := dev.cells[name]
+	for _, cell := range dev.sortedCells() {
 		dev.publishCell(cell)
 	}
 }
 
 func (dev *CellModelLocalDevice) publishCell(cell *Cell) string {
-	return dev.Observer.OnNewControl(
+	value := dev.Observer.OnNewControl(
 		dev, cell.name, cell.controlType, cell.value, cell.readonly,
 		cell.max, !cell.IsButton())
+	cell.publishMeta()
+	return value
 }
 
 func (dev *CellModelLocalDevice) IsVirtual() bool {
@@ -412,6 +733,7 @@ func (dev *CellModelExternalDevice) AcceptControlType(name, controlType string)
 	cell.gotType = true
 	cell.controlType = controlType
 	go dev.model.notify(&CellSpec{dev.DevName, name})
+	dev.updatePseudoCells(false)
 }
 
 func (dev *CellModelExternalDevice) AcceptControlRange(name string, max float64) {
@@ -457,33 +779,39 @@ func (cell *Cell) Value() interface{} {
 		} else {
 			return r
 		}
+	case CELL_TYPE_RGB:
+		color, _ := parseRGBColor(cell.value)
+		return color
 	default:
 		panic("invalid cell type")
 	}
 }
 
-func (cell *Cell) maybeSetValueQuiet(value interface{}, actuallySet bool) (bool, string) {
-	if cell.IsButton() {
-		if actuallySet {
-			cell.value = "0"
-		}
-		return true, "1"
-	}
-
-	var newValue string
+// rawCellValue converts the value to the
+// form used to publish it via MQTT
+func rawCellValue(value interface{}) string {
 	switch v := value.(type) {
 	case string:
-		newValue = v
+		return v
 	case bool:
 		if v {
-			newValue = "1"
-		} else {
-			newValue = "0"
+			return "1"
 		}
+		return "0"
 	default:
-		newValue = fmt.Sprintf("%v", value)
+		return fmt.Sprintf("%v", value)
 	}
+}
 
+func (cell *Cell) maybeSetValueQuiet(value interface{}, actuallySet bool) (bool, string) {
+	if cell.IsButton() {
+		if actuallySet {
+			cell.value = "0"
+		}
+		return true, "1"
+	}
+
+	newValue := rawCellValue(value)
 	if cell.value != newValue {
 		if actuallySet {
 			cell.value = newValue
@@ -494,10 +822,45 @@ func (cell *Cell) maybeSetValueQuiet(value interface{}, actuallySet bool) (bool,
 }
 
 func (cell *Cell) SetValue(value interface{}) {
+	cell.publishValue(cell.setValueDeferred(value))
+}
+
+// setValueDeferred updates the value of a local cell without
+// publishing it. The returned raw value must be passed
+// to publishValue() later.
+func (cell *Cell) setValueDeferred(value interface{}) string {
 	cell.gotValue = true
-	setImmediately := cell.device.shouldSetValueImmediately()
-	_, newValue := cell.maybeSetValueQuiet(value, setImmediately)
-	cell.device.setValue(cell.name, newValue, setImmediately)
+	cell.valueSeq++
+	_, newValue := cell.maybeSetValueQuiet(value, cell.device.shouldSetValueImmediately())
+	if cell.device.shouldSetValueImmediately() {
+		cell.recordHistory()
+		cell.setSource(cell.writeSource)
+	} else {
+		cell.sentSource, cell.sentValue = cell.writeSource, newValue
+	}
+	cell.writeSource = ""
+	cell.device.updatePseudoCells(true)
+	return newValue
+}
+
+func (cell *Cell) publishValue(newValue string) {
+	cell.device.setValue(cell.name, newValue, cell.device.shouldSetValueImmediately())
+}
+
+func (cell *Cell) publishMeta() {
+	publish := cell.device.(*CellModelLocalDevice).model.metaPublishFunc
+	if publish == nil || len(cell.meta) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(cell.meta))
+	for key := range cell.meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	prefix := "/devices/" + cell.DevName() + "/controls/" + cell.name + "/meta/"
+	for _, key := range keys {
+		publish(prefix+key, cell.meta[key])
+	}
 }
 
 func (cell *Cell) Type() string {
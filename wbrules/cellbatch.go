@@ -0,0 +1,172 @@
+package wbrules
+
+const (
+	// DEFAULT_CELL_CHANGE_BATCH is the default max number of pending
+	// cell changes handled by a single rule pass
+	DEFAULT_CELL_CHANGE_BATCH = 256
+)
+
+// SetCellChangeBatching sets the max number of pending cell changes
+// that are handled by a single rule pass. When many cell changes
+// arrive at once, e.g. retained values after reconnecting to the
+// broker, the condition callbacks of 'when' and 'asSoonAs' rules
+// are invoked once per batch instead of once per change, and
+// 'whenChanged' rules fire once per changed cell with its latest
+// value. Values less than 2 disable batching.
+func (engine *RuleEngine) SetCellChangeBatching(maxBatch int) {
+	engine.maxCellChangeBatch = maxBatch
+}
+
+// drainCellChanges appends the cell changes that are already
+// pending to the batch without waiting for new ones
+func (engine *RuleEngine) drainCellChanges(batch []*CellSpec) []*CellSpec {
+	for len(batch) < engine.maxCellChangeBatch {
+		select {
+		case cellSpec, ok := <-engine.cellChange:
+			if !ok {
+				// the closed channel is handled
+				// by the engine loop
+				return batch
+			}
+			batch = append(batch, cellSpec)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// runRulesForBatch runs the rules for a batch of cell changes.
+// nil CellSpec means that all the rules must be checked.
+func (engine *RuleEngine) runRulesForBatch(batch []*CellSpec) {
+	if len(batch) == 1 {
+		engine.runRules(batch[0], NO_TIMER_NAME)
+		return
+	}
+	cellSpecs := make([]*CellSpec, 0, len(batch))
+	runAll := false
+	for _, cellSpec := range batch {
+		if cellSpec == nil {
+			runAll = true
+		} else {
+			cellSpecs = append(cellSpecs, cellSpec)
+		}
+	}
+	if runAll {
+		engine.runRules(nil, NO_TIMER_NAME)
+	}
+	engine.runRulesForCells(cellSpecs)
+}
+
+func isCellSpecificCond(cond RuleCondition) bool {
+	switch cond.(type) {
+	case *CellChangedRuleCondition, *OrRuleCondition:
+		return true
+	default:
+		return false
+	}
+}
+
+func (engine *RuleEngine) ruleDependsOnCell(rule *Rule, cell *Cell) bool {
+	if !cell.IsComplete() {
+		return false
+	}
+	for _, r := range engine.cellToRuleMap[cell] {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRuleForCells checks the rule once for the whole batch,
+// except for 'whenChanged' rules that need to be checked for
+// each changed cell they depend on
+func (engine *RuleEngine) checkRuleForCells(rule *Rule, cells []*Cell) {
+	var lastCell *Cell
+	for _, cell := range cells {
+		if !engine.ruleDependsOnCell(rule, cell) {
+			continue
+		}
+		lastCell = cell
+		if isCellSpecificCond(rule.cond) {
+			rule.ShouldCheck()
+			rule.Check(cell)
+		}
+	}
+	switch {
+	case lastCell == nil:
+		// the rule doesn't depend on any of the cells,
+		// e.g. it's a rule without cells
+		rule.Check(cells[len(cells)-1])
+	case !isCellSpecificCond(rule.cond):
+		rule.Check(lastCell)
+	}
+}
+
+// RunRulesForCells handles several cell changes using a single rule
+// pass. The repeated changes of the same cell are coalesced except
+// for buttons, see SetCellChangeBatching(). The rules are run
+// on the event loop.
+func (engine *RuleEngine) RunRulesForCells(cellSpecs []*CellSpec) {
+	engine.Call(func() {
+		engine.runRulesForCells(cellSpecs)
+	})
+}
+
+func (engine *RuleEngine) runRulesForCells(cellSpecs []*CellSpec) {
+	engine.runDepth++
+	defer engine.endRulePass()
+
+	cells := make([]*Cell, 0, len(cellSpecs))
+	seen := make(map[*Cell]bool, len(cellSpecs))
+	for _, cellSpec := range cellSpecs {
+		cell := engine.model.EnsureCell(cellSpec)
+		if cell.IsFreshButton() || (seen[cell] && !cell.IsButton()) {
+			continue
+		}
+		seen[cell] = true
+		cells = append(cells, cell)
+		if engine.runDepth == 1 {
+			engine.beginCascade(cell)
+		}
+		engine.handleCellChange(cell)
+		if cell.IsComplete() {
+			for _, rule := range engine.cellToRuleMap[cell] {
+				rule.ShouldCheck()
+			}
+		}
+	}
+	if len(cells) == 0 {
+		return
+	}
+	for rule, isWithoutCells := range engine.rulesWithoutCells {
+		if isWithoutCells {
+			rule.ShouldCheck()
+		}
+	}
+
+	savedProfile := engine.currentProfile
+	for _, name := range engine.ruleList {
+		rule := engine.ruleMap[name]
+		if !rule.shouldCheck {
+			continue
+		}
+		if rule.profile == nil {
+			engine.currentProfile = nil
+			engine.withCurrentRule(name, func() {
+				engine.checkRuleForCells(rule, cells)
+			})
+		} else {
+			engine.withProfile(rule.profile, "rule "+name, func() {
+				engine.withCurrentRule(name, func() {
+					engine.checkRuleForCells(rule, cells)
+				})
+			})
+		}
+	}
+	engine.currentProfile = savedProfile
+	if engine.runDepth == 1 && engine.startupDone && !engine.readyWaitOver {
+		engine.maybeEndReadyWait()
+	}
+}
@@ -0,0 +1,241 @@
+package wbrules
+
+import (
+	"github.com/ivan4th/go-duktape"
+	"strconv"
+	"time"
+)
+
+const (
+	// DEFAULT_CELL_HISTORY_RETENTION is the default time
+	// the cell values are kept in the cell history
+	DEFAULT_CELL_HISTORY_RETENTION = time.Hour
+	// MAX_CELL_HISTORY_SAMPLES limits the number of
+	// values kept in the history of a single cell
+	MAX_CELL_HISTORY_SAMPLES = 10000
+)
+
+// CellSample is a numeric value received by a cell
+type CellSample struct {
+	Time  time.Time
+	Value float64
+}
+
+// CellHistoryStats describes the values of
+// a cell received during a time window
+type CellHistoryStats struct {
+	Count int
+	Avg   float64
+	Min   float64
+	Max   float64
+	// Delta is the difference between the last
+	// and the first value within the window
+	Delta float64
+}
+
+// cellHistory keeps the recent numeric values of a cell
+type cellHistory struct {
+	retention time.Duration
+	samples   []CellSample
+}
+
+func (h *cellHistory) add(t time.Time, value float64) {
+	h.samples = append(h.samples, CellSample{t, value})
+	start := t.Add(-h.retention)
+	n := 0
+	for n < len(h.samples) && h.samples[n].Time.Before(start) {
+		n++
+	}
+	if len(h.samples)-n > MAX_CELL_HISTORY_SAMPLES {
+		n = len(h.samples) - MAX_CELL_HISTORY_SAMPLES
+	}
+	// the samples are dropped from the beginning of the slice,
+	// append() reallocates the backing array when it's exhausted
+	// so the memory used by the dropped samples is reclaimed
+	h.samples = h.samples[n:]
+}
+
+// window returns the values received during the
+// specified time before t. The returned slice must
+// not be modified.
+func (h *cellHistory) window(t time.Time, d time.Duration) []CellSample {
+	start := t.Add(-d)
+	n := len(h.samples)
+	for n > 0 && !h.samples[n-1].Time.Before(start) {
+		n--
+	}
+	return h.samples[n:]
+}
+
+func (h *cellHistory) stats(t time.Time, d time.Duration) (stats CellHistoryStats) {
+	samples := h.window(t, d)
+	if len(samples) == 0 {
+		return
+	}
+	stats.Count = len(samples)
+	stats.Min, stats.Max = samples[0].Value, samples[0].Value
+	sum := 0.0
+	for _, sample := range samples {
+		sum += sample.Value
+		if sample.Value < stats.Min {
+			stats.Min = sample.Value
+		}
+		if sample.Value > stats.Max {
+			stats.Max = sample.Value
+		}
+	}
+	stats.Avg = sum / float64(len(samples))
+	stats.Delta = samples[len(samples)-1].Value - samples[0].Value
+	return
+}
+
+// numericValue returns the cell value as a number.
+// Switches are converted to 0 or 1. Returns false
+// if the value isn't numeric.
+func (cell *Cell) numericValue() (float64, bool) {
+	switch v := cell.Value().(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		if r, err := strconv.ParseFloat(v, 64); err == nil {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// EnableHistory makes the cell keep its numeric values received
+// during the specified time. The retention is never decreased
+// so that the history requested by several scripts is kept.
+// The current value of the cell becomes the first history entry.
+func (cell *Cell) EnableHistory(retention time.Duration) {
+	if cell.history != nil {
+		if retention > cell.history.retention {
+			cell.history.retention = retention
+		}
+		return
+	}
+	cell.history = &cellHistory{retention: retention}
+	if cell.gotValue {
+		cell.recordHistory()
+	}
+}
+
+// recordHistory adds the current value of
+// the cell to its history if it's enabled
+func (cell *Cell) recordHistory() {
+	if cell.history == nil || cell.IsButton() {
+		return
+	}
+	if v, ok := cell.numericValue(); ok {
+		cell.history.add(cell.device.now(), v)
+	}
+}
+
+// History returns the values of the cell received during
+// the specified time. Returns nil if the history of
+// the cell isn't enabled.
+func (cell *Cell) History(d time.Duration) []CellSample {
+	if cell.history == nil {
+		return nil
+	}
+	return append([]CellSample(nil), cell.history.window(cell.device.now(), d)...)
+}
+
+// HistoryStats returns the statistics of the values of
+// the cell received during the specified time
+func (cell *Cell) HistoryStats(d time.Duration) CellHistoryStats {
+	if cell.history == nil {
+		return CellHistoryStats{}
+	}
+	return cell.history.stats(cell.device.now(), d)
+}
+
+// SetCellHistoryRetention sets the default time the values
+// are kept in the history of the cells, see cellHistory()
+// JS function
+func (engine *RuleEngine) SetCellHistoryRetention(retention time.Duration) {
+	engine.historyRetention = retention
+}
+
+func (engine *ESEngine) historyCell() (*Cell, bool) {
+	if !engine.ctx.IsString(0) || !engine.ctx.IsString(1) || !engine.ctx.IsNumber(2) {
+		return nil, false
+	}
+	cellSpec := &CellSpec{engine.ctx.GetString(0), engine.ctx.GetString(1)}
+	cell := engine.model.EnsureCell(cellSpec)
+	// the rules that use the history in their
+	// conditions depend on the cell
+	engine.trackCell(cell)
+	return cell, true
+}
+
+func (engine *ESEngine) esWbCellHistoryEnable() int {
+	if engine.ctx.GetTop() != 3 {
+		return duktape.DUK_RET_ERROR
+	}
+	cell, ok := engine.historyCell()
+	if !ok {
+		return duktape.DUK_RET_ERROR
+	}
+	retention := time.Duration(engine.ctx.GetNumber(2) * float64(time.Millisecond))
+	if retention <= 0 {
+		retention = engine.historyRetention
+	}
+	cell.EnableHistory(retention)
+	return 0
+}
+
+// esWbCellHistoryValues returns the array of
+// {ts, value} objects, ts being the time in
+// milliseconds since the epoch
+func (engine *ESEngine) esWbCellHistoryValues() int {
+	if engine.ctx.GetTop() != 3 {
+		return duktape.DUK_RET_ERROR
+	}
+	cell, ok := engine.historyCell()
+	if !ok {
+		return duktape.DUK_RET_ERROR
+	}
+	samples := cell.History(time.Duration(engine.ctx.GetNumber(2) * float64(time.Millisecond)))
+	values := make([]interface{}, len(samples))
+	for i, sample := range samples {
+		values[i] = map[string]interface{}{
+			"ts":    float64(sample.Time.UnixNano() / int64(time.Millisecond)),
+			"value": sample.Value,
+		}
+	}
+	engine.ctx.PushJSObject(values)
+	return 1
+}
+
+// esWbCellHistoryStats returns the statistics
+// object or null if there are no values
+// within the window
+func (engine *ESEngine) esWbCellHistoryStats() int {
+	if engine.ctx.GetTop() != 3 {
+		return duktape.DUK_RET_ERROR
+	}
+	cell, ok := engine.historyCell()
+	if !ok {
+		return duktape.DUK_RET_ERROR
+	}
+	stats := cell.HistoryStats(time.Duration(engine.ctx.GetNumber(2) * float64(time.Millisecond)))
+	if stats.Count == 0 {
+		engine.ctx.PushNull()
+		return 1
+	}
+	engine.ctx.PushJSObject(map[string]interface{}{
+		"count": float64(stats.Count),
+		"avg":   stats.Avg,
+		"min":   stats.Min,
+		"max":   stats.Max,
+		"delta": stats.Delta,
+	})
+	return 1
+}
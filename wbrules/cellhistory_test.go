@@ -0,0 +1,61 @@
+package wbrules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCellHistoryWindow(t *testing.T) {
+	h := &cellHistory{retention: time.Minute}
+	start := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, v := range []float64{20, 22, 21, 25, 24} {
+		h.add(start.Add(time.Duration(i)*20*time.Second), v)
+	}
+	// the first value is older than the retention time
+	if len(h.samples) != 4 || h.samples[0].Value != 22 {
+		t.Errorf("bad samples after trimming: %v", h.samples)
+	}
+
+	now := start.Add(80 * time.Second)
+	stats := h.stats(now, 40*time.Second)
+	expected := CellHistoryStats{Count: 3, Avg: 70.0 / 3, Min: 21, Max: 25, Delta: 3}
+	if stats != expected {
+		t.Errorf("bad stats: %#v", stats)
+	}
+	if stats := h.stats(now.Add(time.Hour), time.Minute); stats.Count != 0 {
+		t.Errorf("non-empty stats for an empty window: %#v", stats)
+	}
+}
+
+func TestCellHistoryRecording(t *testing.T) {
+	model := newTestModel(t)
+	dev := model.EnsureLocalDevice("room", "room")
+	temp := dev.SetCell("temp", "temperature", 20.0, false)
+	heater := dev.SetCell("heater", "switch", false, false)
+	if temp.History(time.Hour) != nil {
+		t.Errorf("history is recorded before it's enabled")
+	}
+
+	temp.EnableHistory(time.Hour)
+	heater.EnableHistory(time.Hour)
+	temp.SetValue(21.5)
+	heater.SetValue(true)
+	dev.AcceptOnValue("temp", "23")
+
+	var values []float64
+	for _, sample := range temp.History(time.Hour) {
+		values = append(values, sample.Value)
+	}
+	if len(values) != 3 || values[0] != 20 || values[1] != 21.5 || values[2] != 23 {
+		t.Errorf("bad temperature history: %v", values)
+	}
+	if stats := heater.HistoryStats(time.Hour); stats.Count != 2 || stats.Delta != 1 {
+		t.Errorf("bad switch history stats: %#v", stats)
+	}
+
+	// redefining the cell keeps its history
+	temp = dev.SetCell("temp", "temperature", 24.0, false)
+	if stats := temp.HistoryStats(time.Hour); stats.Count != 3 || stats.Max != 23 {
+		t.Errorf("bad history stats after redefining the cell: %#v", stats)
+	}
+}
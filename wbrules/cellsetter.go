@@ -0,0 +1,182 @@
+package wbrules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DisposaBoy/JsonConfigReader"
+	"github.com/contactless/wbgo"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	unknownCellError  = errors.New("unknown cell")
+	readonlyCellError = errors.New("cell is read-only")
+)
+
+// AuditRecord describes a change made by an external system
+// or a rule write overridden by a higher-priority rule
+type AuditRecord struct {
+	Time     time.Time   `json:"time"`
+	Identity string      `json:"identity"`
+	Action   string      `json:"action"`
+	Target   string      `json:"target"`
+	Value    interface{} `json:"value"`
+	Reason   string      `json:"reason,omitempty"`
+}
+
+// AuditLog writes audit records as JSON lines
+type AuditLog struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// OpenAuditLog opens the audit log file for appending
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditLog(f), nil
+}
+
+func (log *AuditLog) Record(record AuditRecord) error {
+	bs, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	log.Lock()
+	defer log.Unlock()
+	_, err = log.w.Write(append(bs, '\n'))
+	return err
+}
+
+// LoadAPITokens loads the API token file. The file contains
+// a JSON object (comments are allowed) that maps tokens to the
+// identities of the callers, e.g. { "s3cret": "scada" }
+func LoadAPITokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens := make(map[string]string)
+	if err = json.NewDecoder(JsonConfigReader.New(f)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("error parsing API token file %s: %s", path, err)
+	}
+	return tokens, nil
+}
+
+// CellWriter validates and writes cell values
+type CellWriter interface {
+	// WriteCell validates the value and writes it to the cell
+	// as if it was written by a rule. The validated value is
+	// passed to commit (unless it's nil) before the write;
+	// if commit returns an error, the write is cancelled and
+	// the error is returned. Returns the value actually written.
+	WriteCell(cellSpec *CellSpec, value interface{}, commit func(value interface{}) error) (interface{}, error)
+}
+
+// Cells is an RPC service that makes it possible for external
+// systems to set cell values. Unlike raw '/on' publishes, the
+// values are validated, the changes are recorded in the audit
+// log and callers must be authenticated using API tokens.
+// Values are not written if the change can't be recorded
+// in the audit log.
+type Cells struct {
+	writer   CellWriter
+	tokens   map[string]string
+	auditLog *AuditLog
+	now      func() time.Time
+}
+
+type CellsError struct {
+	code    int32
+	message string
+}
+
+func (err *CellsError) Error() string {
+	return err.message
+}
+
+func (err *CellsError) ErrorCode() int32 {
+	return err.code
+}
+
+const (
+	// no iota here because these values may be used
+	// by external software
+	CELLS_ERROR_UNAUTHORIZED  = 1300
+	CELLS_ERROR_UNKNOWN_CELL  = 1301
+	CELLS_ERROR_READONLY      = 1302
+	CELLS_ERROR_INVALID_VALUE = 1303
+	CELLS_ERROR_AUDIT         = 1304
+)
+
+func NewCells(writer CellWriter, tokens map[string]string, auditLog *AuditLog) *Cells {
+	return &Cells{writer, tokens, auditLog, time.Now}
+}
+
+type CellsSetCellArgs struct {
+	Token  string      `json:"token"`
+	Device string      `json:"device"`
+	Cell   string      `json:"cell"`
+	Value  interface{} `json:"value"`
+	Reason string      `json:"reason"`
+}
+
+type CellsSetCellResponse struct {
+	Value interface{} `json:"value"`
+}
+
+func (cells *Cells) SetCell(args *CellsSetCellArgs, reply *CellsSetCellResponse) error {
+	identity, found := cells.tokens[args.Token]
+	if args.Token == "" || !found {
+		return &CellsError{CELLS_ERROR_UNAUTHORIZED, "unauthorized"}
+	}
+	if args.Device == "" || args.Cell == "" {
+		return &CellsError{CELLS_ERROR_UNKNOWN_CELL, "device and cell must be specified"}
+	}
+	var auditErr error
+	value, err := cells.writer.WriteCell(&CellSpec{args.Device, args.Cell}, args.Value, func(value interface{}) error {
+		auditErr = cells.audit(identity, args, value)
+		return auditErr
+	})
+	switch {
+	case auditErr != nil:
+		wbgo.Error.Printf("Cells: error writing audit log: %s", auditErr)
+		return &CellsError{CELLS_ERROR_AUDIT,
+			fmt.Sprintf("can't write audit log, %s/%s not set", args.Device, args.Cell)}
+	case err == unknownCellError:
+		return &CellsError{CELLS_ERROR_UNKNOWN_CELL,
+			fmt.Sprintf("unknown cell: %s/%s", args.Device, args.Cell)}
+	case err == readonlyCellError:
+		return &CellsError{CELLS_ERROR_READONLY,
+			fmt.Sprintf("cell is read-only: %s/%s", args.Device, args.Cell)}
+	case err != nil:
+		return &CellsError{CELLS_ERROR_INVALID_VALUE, err.Error()}
+	}
+	*reply = CellsSetCellResponse{value}
+	return nil
+}
+
+func (cells *Cells) audit(identity string, args *CellsSetCellArgs, value interface{}) error {
+	if cells.auditLog == nil {
+		return nil
+	}
+	return cells.auditLog.Record(AuditRecord{
+		Time:     cells.now(),
+		Identity: identity,
+		Action:   "SetCell",
+		Target:   args.Device + "/" + args.Cell,
+		Value:    value,
+		Reason:   args.Reason,
+	})
+}
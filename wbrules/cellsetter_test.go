@@ -0,0 +1,101 @@
+package wbrules
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type fakeCellWriter struct {
+	types  map[CellSpec]string
+	values map[CellSpec]interface{}
+}
+
+func (writer *fakeCellWriter) WriteCell(cellSpec *CellSpec, value interface{}, commit func(value interface{}) error) (interface{}, error) {
+	controlType, found := writer.types[*cellSpec]
+	switch {
+	case !found:
+		return nil, unknownCellError
+	case controlType == "readonly":
+		return nil, readonlyCellError
+	}
+	result, err := validateCellValue(controlType, -1, value)
+	if err != nil {
+		return nil, err
+	}
+	if commit != nil {
+		if err = commit(result); err != nil {
+			return nil, err
+		}
+	}
+	writer.values[*cellSpec] = result
+	return result, nil
+}
+
+type failingWriter struct{}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestSetCellRPC(t *testing.T) {
+	var buf bytes.Buffer
+	writer := &fakeCellWriter{
+		types: map[CellSpec]string{
+			CellSpec{"heating", "setpoint"}: "temperature",
+			CellSpec{"heating", "current"}:  "readonly",
+		},
+		values: make(map[CellSpec]interface{}),
+	}
+	cells := NewCells(writer, map[string]string{"s3cret": "scada"}, NewAuditLog(&buf))
+	cells.now = func() time.Time {
+		return time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	}
+
+	var reply CellsSetCellResponse
+	assert.NoError(t, cells.SetCell(&CellsSetCellArgs{
+		Token:  "s3cret",
+		Device: "heating",
+		Cell:   "setpoint",
+		Value:  "22.5",
+		Reason: "schedule",
+	}, &reply))
+	assert.Equal(t, float64(22.5), reply.Value)
+	assert.Equal(t,
+		`{"time":"2026-10-16T12:00:00Z","identity":"scada","action":"SetCell",`+
+			`"target":"heating/setpoint","value":22.5,"reason":"schedule"}`+"\n",
+		buf.String())
+
+	for _, tt := range []struct {
+		args CellsSetCellArgs
+		code int32
+	}{
+		{CellsSetCellArgs{Device: "heating", Cell: "setpoint", Value: float64(1)}, CELLS_ERROR_UNAUTHORIZED},
+		{CellsSetCellArgs{Token: "wrong", Device: "heating", Cell: "setpoint", Value: float64(1)}, CELLS_ERROR_UNAUTHORIZED},
+		{CellsSetCellArgs{Token: "s3cret", Device: "heating", Cell: "nosuchcell", Value: float64(1)}, CELLS_ERROR_UNKNOWN_CELL},
+		{CellsSetCellArgs{Token: "s3cret", Device: "heating", Cell: "current", Value: float64(1)}, CELLS_ERROR_READONLY},
+		{CellsSetCellArgs{Token: "s3cret", Device: "heating", Cell: "setpoint", Value: "hot"}, CELLS_ERROR_INVALID_VALUE},
+	} {
+		buf.Reset()
+		err := cells.SetCell(&tt.args, &reply)
+		if assert.Error(t, err, "args: %#v", tt.args) {
+			assert.Equal(t, tt.code, err.(*CellsError).ErrorCode())
+		}
+		assert.Empty(t, buf.String(), "failed writes must not be audited")
+	}
+
+	cells.auditLog = NewAuditLog(failingWriter{})
+	err := cells.SetCell(&CellsSetCellArgs{
+		Token:  "s3cret",
+		Device: "heating",
+		Cell:   "setpoint",
+		Value:  float64(18),
+	}, &reply)
+	if assert.Error(t, err) {
+		assert.Equal(t, int32(CELLS_ERROR_AUDIT), err.(*CellsError).ErrorCode())
+	}
+	assert.Equal(t, float64(22.5), writer.values[CellSpec{"heating", "setpoint"}],
+		"writes that can't be audited must be refused")
+}
@@ -0,0 +1,108 @@
+package wbrules
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	// the sources of cell values, see Cell.Source()
+	CELL_SOURCE_RULE_PREFIX = "rule:"
+	CELL_SOURCE_SCRIPT      = "script"
+	CELL_SOURCE_EXTERNAL    = "external"
+	CELL_SOURCE_MQTT        = "mqtt"
+
+	SOURCE_PSEUDO_CELL_SUFFIX = "#source"
+
+	// the ways to handle the writes of the same cell by several
+	// rules with equal priority, see SetWriteConflictMode()
+	WRITE_CONFLICTS_ALLOW  = "allow"
+	WRITE_CONFLICTS_LOG    = "log"
+	WRITE_CONFLICTS_REJECT = "reject"
+)
+
+// Source returns the last writer of the cell: "rule:<name>"
+// for the writes made by rules, "script" for the writes made
+// by the scripts outside of rules (e.g. by timers), "external"
+// for the writes made via RPC or HTTP API and "mqtt" for the
+// values received from MQTT. The source of a value written
+// to an external device is changed when the device confirms
+// the value. The source is empty if the cell didn't receive
+// any value yet.
+func (cell *Cell) Source() string {
+	return cell.source
+}
+
+func (cell *Cell) setSource(source string) {
+	if source == cell.source {
+		return
+	}
+	cell.source = source
+	cell.device.updateSourcePseudoCell(cell)
+}
+
+// updateSourcePseudoCell updates '<cell>#source' pseudo-cell
+// after the source of the cell changes
+func (dev *CellModelDeviceBase) updateSourcePseudoCell(cell *Cell) {
+	if len(dev.pseudoCells) == 0 {
+		return
+	}
+	if pseudoCell, found := dev.pseudoCells[cell.name+SOURCE_PSEUDO_CELL_SUFFIX]; found {
+		pseudoCell.value = cell.source
+		pseudoCell.valueSeq++
+		go dev.model.notify(&CellSpec{dev.DevName, pseudoCell.name})
+	}
+}
+
+func isSourcePseudoCellName(name string) bool {
+	return len(name) > len(SOURCE_PSEUDO_CELL_SUFFIX) && strings.HasSuffix(name, SOURCE_PSEUDO_CELL_SUFFIX)
+}
+
+// currentWriteSource returns the source of the
+// cell writes made by the engine at the moment
+func (engine *RuleEngine) currentWriteSource() string {
+	if engine.writeSource != "" {
+		return engine.writeSource
+	}
+	if rule, found := engine.ruleMap[engine.currentRule]; found {
+		return rule.source
+	}
+	return CELL_SOURCE_SCRIPT
+}
+
+// SetWriteConflictMode sets the way the writes of the same cell
+// by several rules with equal priority during a single rule pass
+// are handled. WRITE_CONFLICTS_ALLOW (default) makes the last
+// writer win, WRITE_CONFLICTS_LOG makes the last writer win
+// logging the conflict and WRITE_CONFLICTS_REJECT makes the
+// first writer win rejecting the conflicting writes.
+// The writes of the same value don't conflict.
+func (engine *RuleEngine) SetWriteConflictMode(mode string) error {
+	switch mode {
+	case WRITE_CONFLICTS_ALLOW, WRITE_CONFLICTS_LOG, WRITE_CONFLICTS_REJECT:
+		engine.writeConflicts = mode
+		return nil
+	default:
+		return fmt.Errorf("invalid write conflict mode: %s", mode)
+	}
+}
+
+// writeConflict handles the write of the cell by a rule after
+// another rule with equal priority wrote it during the same
+// pass and returns false if the write must be rejected
+func (engine *RuleEngine) writeConflict(cell *Cell, prev, claim writeClaim) bool {
+	switch {
+	case engine.writeConflicts == "" || engine.writeConflicts == WRITE_CONFLICTS_ALLOW:
+		return true
+	case reflect.DeepEqual(prev.value, claim.value):
+		return true
+	case engine.writeConflicts == WRITE_CONFLICTS_REJECT:
+		engine.recordOverriddenWrite(cell, claim, prev)
+		return false
+	default:
+		engine.Logf(ENGINE_LOG_WARNING, "conflicting writes %s/%s = %v by rule %s and %v by rule %s",
+			cell.DevName(), cell.Name(), prev.value, prev.rule, claim.value, claim.rule)
+		return true
+	}
+}
@@ -0,0 +1,264 @@
+package wbrules
+
+import (
+	"fmt"
+	"github.com/ivan4th/go-duktape"
+	"github.com/stretchr/objx"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type CellType int
+
+// cellTypeInfo describes a control type
+type cellTypeInfo struct {
+	kind CellType
+	// hasMax is true for the types with adjustable
+	// max value such as range
+	hasMax bool
+	// check validates the value already
+	// converted to the kind of the type
+	check func(value interface{}, max float64) error
+}
+
+func checkCellRange(value interface{}, max float64) error {
+	f := value.(float64)
+	if f < 0 || max >= 0 && f > max {
+		return fmt.Errorf("value out of range: %v (max %v)", f, max)
+	}
+	return nil
+}
+
+// RGBColor is the value of rgb cells. It's published
+// as "R;G;B" and passed to the scripts as {r, g, b} object.
+type RGBColor struct {
+	R uint8 `json:"r"`
+	G uint8 `json:"g"`
+	B uint8 `json:"b"`
+}
+
+func (color RGBColor) String() string {
+	return fmt.Sprintf("%d;%d;%d", color.R, color.G, color.B)
+}
+
+// Hex returns the color in #rrggbb form
+func (color RGBColor) Hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", color.R, color.G, color.B)
+}
+
+func (color RGBColor) jsObject() map[string]interface{} {
+	return map[string]interface{}{
+		"r": float64(color.R),
+		"g": float64(color.G),
+		"b": float64(color.B),
+	}
+}
+
+// parseRGBColor parses the color specified either
+// as "R;G;B" or as "#rrggbb"
+func parseRGBColor(s string) (RGBColor, error) {
+	if strings.HasPrefix(s, "#") {
+		n, err := strconv.ParseUint(s[1:], 16, 32)
+		if err != nil || len(s) != 7 {
+			return RGBColor{}, fmt.Errorf("invalid rgb value: %q, #rrggbb expected", s)
+		}
+		return RGBColor{uint8(n >> 16), uint8(n >> 8), uint8(n)}, nil
+	}
+	parts := strings.Split(s, ";")
+	if len(parts) != 3 {
+		return RGBColor{}, fmt.Errorf("invalid rgb value: %q, R;G;B expected", s)
+	}
+	var c [3]uint8
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return RGBColor{}, fmt.Errorf("invalid rgb value: %q, R;G;B expected", s)
+		}
+		c[i] = uint8(n)
+	}
+	return RGBColor{c[0], c[1], c[2]}, nil
+}
+
+// rgbColorFromMap converts {r, g, b} object to RGBColor
+func rgbColorFromMap(m map[string]interface{}) (RGBColor, error) {
+	var c [3]uint8
+	for i, key := range []string{"r", "g", "b"} {
+		v, ok := m[key].(float64)
+		if !ok || v < 0 || v > 255 || v != math.Floor(v) {
+			return RGBColor{}, fmt.Errorf("invalid rgb value: %v, {r, g, b} with components 0..255 expected", m)
+		}
+		c[i] = uint8(v)
+	}
+	return RGBColor{c[0], c[1], c[2]}, nil
+}
+
+func toRGBColor(value interface{}) (RGBColor, error) {
+	switch v := value.(type) {
+	case RGBColor:
+		return v, nil
+	case string:
+		return parseRGBColor(v)
+	case objx.Map:
+		return rgbColorFromMap(v)
+	case map[string]interface{}:
+		return rgbColorFromMap(v)
+	}
+	return RGBColor{}, fmt.Errorf("invalid rgb value: %v", value)
+}
+
+var (
+	textCellType    = &cellTypeInfo{kind: CELL_TYPE_TEXT}
+	booleanCellType = &cellTypeInfo{kind: CELL_TYPE_BOOLEAN}
+	floatCellType   = &cellTypeInfo{kind: CELL_TYPE_FLOAT}
+	rangeCellType   = &cellTypeInfo{kind: CELL_TYPE_FLOAT, hasMax: true, check: checkCellRange}
+)
+
+// cellTypes is the registry of control types. Unknown control
+// types are treated as text.
+var cellTypes = map[string]*cellTypeInfo{
+	"text":                 textCellType,
+	"rgb":                  &cellTypeInfo{kind: CELL_TYPE_RGB},
+	"switch":               booleanCellType,
+	"wo-switch":            booleanCellType,
+	"alarm":                booleanCellType,
+	"pushbutton":           &cellTypeInfo{kind: CELL_TYPE_BUTTON},
+	"range":                rangeCellType,
+	"rheostat":             rangeCellType,
+	"temperature":          floatCellType,
+	"rel_humidity":         floatCellType,
+	"atmospheric_pressure": floatCellType,
+	"rainfall":             floatCellType,
+	"wind_speed":           floatCellType,
+	"power":                floatCellType,
+	"power_consumption":    floatCellType,
+	"voltage":              floatCellType,
+	"water_flow":           floatCellType,
+	"consumption":          floatCellType,
+	"pressure":             floatCellType,
+	"concentration":        floatCellType,
+	"sound_level":          floatCellType,
+	"lux":                  floatCellType,
+	// "value" controls used to be textual, see the
+	// compatibility note in README
+	"value": floatCellType,
+}
+
+func lookupCellType(controlType string) *cellTypeInfo {
+	if info, found := cellTypes[controlType]; found {
+		return info
+	}
+	return textCellType
+}
+
+func cellType(controlType string) CellType {
+	return lookupCellType(controlType).kind
+}
+
+// validateCellValue checks that the value can be written to the
+// cell of the specified type and returns the value converted
+// to the type used for cells of that type
+func validateCellValue(controlType string, max float64, value interface{}) (interface{}, error) {
+	info := lookupCellType(controlType)
+	result, ok := coerceCellValue(info.kind, value)
+	if !ok {
+		return nil, fmt.Errorf("invalid %s value: %v", controlType, value)
+	}
+	if info.check != nil {
+		if err := info.check(result, max); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func isFiniteFloat(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// coerceCellValue converts the value to the
+// type used for the cells of the specified kind
+func coerceCellValue(kind CellType, value interface{}) (interface{}, bool) {
+	switch kind {
+	case CELL_TYPE_TEXT:
+		switch v := value.(type) {
+		case string:
+			return value, true
+		case float64, bool:
+			return fmt.Sprint(v), true
+		}
+	case CELL_TYPE_BOOLEAN, CELL_TYPE_BUTTON:
+		// for buttons, true means a press
+		switch v := value.(type) {
+		case nil:
+			if kind == CELL_TYPE_BUTTON {
+				return true, true
+			}
+		case bool:
+			return v, true
+		case float64:
+			if v == 0 || v == 1 {
+				return v == 1, true
+			}
+		case string:
+			if v == "0" || v == "1" {
+				return v == "1", true
+			}
+		}
+	case CELL_TYPE_RGB:
+		if color, err := toRGBColor(value); err == nil {
+			return color, true
+		}
+	case CELL_TYPE_FLOAT:
+		switch v := value.(type) {
+		case float64:
+			if isFiniteFloat(v) {
+				return value, true
+			}
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); err == nil && isFiniteFloat(f) {
+				return f, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// cellMaxFromDef returns the max value specified
+// in the cell definition of a range cell
+func cellMaxFromDef(cellDef map[string]interface{}) (float64, error) {
+	switch max := cellDef["max"].(type) {
+	case nil:
+		return DEFAULT_CELL_MAX, nil
+	case float64:
+		if max > 0 {
+			return max, nil
+		}
+	case string:
+		if f, err := strconv.ParseFloat(max, 64); err == nil && f > 0 {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid value of max property: %v", cellDef["max"])
+}
+
+// esRGBToHex converts the color specified as {r, g, b}
+// object or "R;G;B" string to #rrggbb form
+func (engine *ESEngine) esRGBToHex() int {
+	if engine.ctx.GetTop() != 1 {
+		return duktape.DUK_RET_ERROR
+	}
+	var value interface{}
+	switch {
+	case engine.ctx.IsString(0):
+		value = engine.ctx.GetString(0)
+	case engine.ctx.IsObject(0):
+		value = engine.ctx.GetJSObject(0)
+	}
+	color, err := toRGBColor(value)
+	if err != nil {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+	engine.ctx.PushString(color.Hex())
+	return 1
+}
@@ -0,0 +1,192 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"testing"
+)
+
+func TestCellTypeRegistry(t *testing.T) {
+	for _, tt := range []struct {
+		controlType string
+		max         float64
+		value       interface{}
+		result      interface{}
+		ok          bool
+	}{
+		{"text", -1, "abc", "abc", true},
+		{"text", -1, float64(42), "42", true},
+		{"switch", -1, true, true, true},
+		{"switch", -1, float64(0), false, true},
+		{"switch", -1, "1", true, true},
+		{"switch", -1, float64(2), nil, false},
+		{"switch", -1, "on", nil, false},
+		{"temperature", -1, float64(21.5), float64(21.5), true},
+		{"temperature", -1, "21.5", float64(21.5), true},
+		{"temperature", -1, "warm", nil, false},
+		{"temperature", -1, true, nil, false},
+		{"range", 100, float64(50), float64(50), true},
+		{"range", 100, float64(101), nil, false},
+		{"range", 100, float64(-1), nil, false},
+		{"pushbutton", -1, nil, true, true},
+		{"rheostat", 50, float64(50), float64(50), true},
+		{"rheostat", 50, "51", nil, false},
+		{"rgb", -1, "255;0;127", RGBColor{255, 0, 127}, true},
+		{"rgb", -1, "#ff007F", RGBColor{255, 0, 127}, true},
+		{"rgb", -1, objx.Map{"r": 1.0, "g": 2.0, "b": 3.0}, RGBColor{1, 2, 3}, true},
+		{"rgb", -1, "255;0", nil, false},
+		{"rgb", -1, "256;0;0", nil, false},
+		{"rgb", -1, "#ff00", nil, false},
+		{"rgb", -1, objx.Map{"r": 1.0, "g": 2.5, "b": 3.0}, nil, false},
+		{"rgb", -1, objx.Map{"r": 1.0, "g": 2.0}, nil, false},
+		{"alarm", -1, float64(1), true, true},
+		{"pressure", -1, "1013.2", float64(1013.2), true},
+		{"value", -1, nil, nil, false},
+		{"value", -1, "42.5", float64(42.5), true},
+		{"value", -1, "42 kWh", nil, false},
+		{"unknown_type", -1, float64(5), "5", true},
+	} {
+		result, err := validateCellValue(tt.controlType, tt.max, tt.value)
+		switch {
+		case !tt.ok && err == nil:
+			t.Errorf("%s: no error for %v", tt.controlType, tt.value)
+		case tt.ok && err != nil:
+			t.Errorf("%s: error for %v: %s", tt.controlType, tt.value, err)
+		case tt.ok && result != tt.result:
+			t.Errorf("%s: bad result for %v: %#v", tt.controlType, tt.value, result)
+		}
+	}
+}
+
+func TestDefineCellValidation(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	dev := model.EnsureLocalDevice("dimmer", "dimmer")
+	for name, def := range map[string]map[string]interface{}{
+		"level":  {"type": "range", "value": 10.5, "max": "12.5"},
+		"fader":  {"type": "rheostat", "value": 0.0},
+		"color":  {"type": "rgb", "value": "0;0;0"},
+		"enable": {"type": "switch", "value": 1.0},
+	} {
+		if err := defineCell(dev, name, objx.Map(def)); err != nil {
+			t.Errorf("defineCell(%s): %s", name, err)
+		}
+	}
+	for name, def := range map[string]map[string]interface{}{
+		"badLevel": {"type": "range", "value": 20.0, "max": 12.5},
+		"badMax":   {"type": "range", "value": 0.0, "max": -1.0},
+		"badColor": {"type": "rgb", "value": "red"},
+		"badTemp":  {"type": "temperature", "value": "warm"},
+	} {
+		if err := defineCell(dev, name, objx.Map(def)); err == nil {
+			t.Errorf("no error for %s", name)
+		}
+	}
+
+	level := dev.MustGetCell("level")
+	fader := dev.MustGetCell("fader")
+	enable := dev.MustGetCell("enable")
+	if level.Max() != 12.5 || fader.Max() != DEFAULT_CELL_MAX || fader.Type() != "rheostat" {
+		t.Errorf("bad range cells: max %v, %v, type %s", level.Max(), fader.Max(), fader.Type())
+	}
+	if enable.Value() != true {
+		t.Errorf("bad switch value: %v", enable.Value())
+	}
+
+	if err := engine.setCellValue(level, "12"); err != nil || level.Value() != 12.0 {
+		t.Errorf("bad value after writing a string to a range cell: %v (error %v)", level.Value(), err)
+	}
+	if err := engine.setCellValue(level, 13.0); err == nil || level.Value() != 12.0 {
+		t.Errorf("out of range value was written: %v", level.Value())
+	}
+	if err := engine.setCellValue(enable, 0.0); err != nil || enable.Value() != false {
+		t.Errorf("bad switch value: %v (error %v)", enable.Value(), err)
+	}
+}
+
+func TestRemoveMaxControls(t *testing.T) {
+	var messages []string
+	model, engine := newTestEngine(t, logCapturingClient{messages: &messages})
+	dev := model.EnsureLocalDevice("dimmer", "dimmer")
+	for _, controlType := range []string{"range", "rheostat"} {
+		if err := defineCell(dev, controlType, objx.Map{"type": controlType, "value": 0.0}); err != nil {
+			t.Fatalf("defineCell(%s): %s", controlType, err)
+		}
+		messages = nil
+		if err := engine.RemoveControl("dimmer", controlType); err != nil {
+			t.Fatalf("RemoveControl(%s): %s", controlType, err)
+		}
+		maxCleared := false
+		for _, msg := range messages {
+			if msg == "/devices/dimmer/controls/"+controlType+"/meta/max: " {
+				maxCleared = true
+			}
+		}
+		if !maxCleared {
+			t.Errorf("%s: meta/max not cleared: %v", controlType, messages)
+		}
+	}
+}
+
+func TestButtonCells(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	dev := model.EnsureLocalDevice("buttons", "buttons")
+	button := dev.SetButtonCell("somebutton")
+
+	// a retained value must not be picked up as a press
+	valueSeq := button.valueSeq
+	dev.AcceptValue("somebutton", "1")
+	if button.valueSeq != valueSeq {
+		t.Errorf("the retained value was picked up")
+	}
+	if !dev.AcceptOnValue("somebutton", "1") || button.RawValue() != "0" || button.Value() != false {
+		t.Errorf("the button kept the value: %q", button.RawValue())
+	}
+
+	for _, item := range []struct {
+		value   interface{}
+		pressed bool
+	}{
+		{false, false},
+		{0.0, false},
+		{true, true},
+		{1.0, true},
+	} {
+		writes := button.writes
+		if err := engine.setCellValue(button, item.value); err != nil {
+			t.Errorf("error writing %v: %s", item.value, err)
+		}
+		if pressed := button.writes > writes; pressed != item.pressed {
+			t.Errorf("writing %v: pressed = %v", item.value, pressed)
+		}
+	}
+	if err := engine.setCellValue(button, "press"); err == nil {
+		t.Errorf("no error for an invalid value")
+	}
+}
+
+func TestRGBCells(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	dev := model.EnsureLocalDevice("light", "light")
+	if err := defineCell(dev, "color", objx.Map{"type": "rgb", "value": "10;20;30"}); err != nil {
+		t.Fatalf("defineCell(): %s", err)
+	}
+	color := dev.MustGetCell("color")
+	if color.Value() != (RGBColor{10, 20, 30}) {
+		t.Errorf("bad value: %v", color.Value())
+	}
+	for value, expected := range map[interface{}]string{
+		"#FF8000":  "255;128;0",
+		"1;2;3":    "1;2;3",
+		RGBColor{}: "0;0;0",
+	} {
+		if err := engine.setCellValue(color, value); err != nil || color.RawValue() != expected {
+			t.Errorf("writing %v: raw value %q, error %v", value, color.RawValue(), err)
+		}
+	}
+	if err := engine.setCellValue(color, map[string]interface{}{"r": 4.0, "g": 5.0, "b": 6.0}); err != nil ||
+		color.RawValue() != "4;5;6" {
+		t.Errorf("writing {r, g, b}: raw value %q, error %v", color.RawValue(), err)
+	}
+	if hex := color.Value().(RGBColor).Hex(); hex != "#040506" {
+		t.Errorf("bad hex value: %s", hex)
+	}
+}
@@ -0,0 +1,262 @@
+package wbrules
+
+import (
+	wbgo "github.com/contactless/wbgo"
+	"github.com/robfig/cron"
+	"sync"
+	"time"
+)
+
+// Clock provides the current time, the timers and the cron
+// schedulers to the engine. SystemClock uses the system time,
+// while tests and simulators may use FakeClock to move
+// the time programmatically.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) wbgo.Timer
+	NewTicker(d time.Duration) wbgo.Timer
+	NewCron() Cron
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                       { return time.Now() }
+func (systemClock) NewTimer(d time.Duration) wbgo.Timer  { return wbgo.NewRealTimer(d) }
+func (systemClock) NewTicker(d time.Duration) wbgo.Timer { return wbgo.NewRealTicker(d) }
+func (systemClock) NewCron() Cron                        { return cron.New() }
+
+// SystemClock is the default clock of the engine
+var SystemClock Clock = systemClock{}
+
+// clockTimerFunc returns the timer function
+// that makes the timers using the clock
+func clockTimerFunc(clock Clock) TimerFunc {
+	return func(id uint64, d time.Duration, periodic bool) wbgo.Timer {
+		if periodic {
+			return clock.NewTicker(d)
+		}
+		return clock.NewTimer(d)
+	}
+}
+
+// fakeClockTimer is a timer of the fake clock. Its
+// fields are guarded by the mutex of the clock.
+type fakeClockTimer struct {
+	clock    *FakeClock
+	ch       chan time.Time
+	due      time.Time
+	interval time.Duration
+	periodic bool
+	stopped  bool
+}
+
+func (timer *fakeClockTimer) GetChannel() <-chan time.Time {
+	return timer.ch
+}
+
+func (timer *fakeClockTimer) Stop() {
+	timer.clock.mtx.Lock()
+	defer timer.clock.mtx.Unlock()
+	timer.stopped = true
+}
+
+type fakeClockCronEntry struct {
+	schedule cron.Schedule
+	next     time.Time
+	cmd      func()
+}
+
+// fakeClockCron runs the cron entries using the fake
+// clock. Its fields are guarded by the mutex of the clock.
+type fakeClockCron struct {
+	clock   *FakeClock
+	started bool
+	stopped bool
+	entries []*fakeClockCronEntry
+}
+
+func (c *fakeClockCron) AddFunc(spec string, cmd func()) error {
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return err
+	}
+	c.clock.mtx.Lock()
+	defer c.clock.mtx.Unlock()
+	c.entries = append(c.entries, &fakeClockCronEntry{
+		schedule: schedule,
+		next:     schedule.Next(c.clock.now),
+		cmd:      cmd,
+	})
+	return nil
+}
+
+func (c *fakeClockCron) Start() {
+	c.clock.mtx.Lock()
+	defer c.clock.mtx.Unlock()
+	c.started = true
+	for _, entry := range c.entries {
+		entry.next = entry.schedule.Next(c.clock.now)
+	}
+}
+
+func (c *fakeClockCron) Stop() {
+	c.clock.mtx.Lock()
+	defer c.clock.mtx.Unlock()
+	c.started = false
+	c.stopped = true
+}
+
+// FakeClock is a clock that only moves when it's advanced.
+// The timers and cron entries that become due are fired in
+// their order. The ticks are delivered via the timer channels,
+// so the timers fire asynchronously, as the real ones do, and
+// the function set by SetFireHook() may be used to wait for
+// the engine to handle each of them.
+type FakeClock struct {
+	mtx    sync.Mutex
+	now    time.Time
+	timers []*fakeClockTimer
+	crons  []*fakeClockCron
+	onFire func()
+}
+
+// NewFakeClock creates a fake clock set to the specified time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the time of the clock
+func (clock *FakeClock) Now() time.Time {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	return clock.now
+}
+
+// Set sets the time of the clock without firing any timers
+func (clock *FakeClock) Set(t time.Time) {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	clock.now = t
+}
+
+// SetFireHook sets the function that's invoked after each
+// timer or cron entry is fired by Advance()
+func (clock *FakeClock) SetFireHook(onFire func()) {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	clock.onFire = onFire
+}
+
+func (clock *FakeClock) newTimer(d time.Duration, periodic bool) *fakeClockTimer {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	timer := &fakeClockTimer{
+		clock:    clock,
+		ch:       make(chan time.Time, 1),
+		due:      clock.now.Add(d),
+		interval: d,
+		periodic: periodic,
+	}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+func (clock *FakeClock) NewTimer(d time.Duration) wbgo.Timer {
+	return clock.newTimer(d, false)
+}
+
+func (clock *FakeClock) NewTicker(d time.Duration) wbgo.Timer {
+	return clock.newTimer(d, true)
+}
+
+func (clock *FakeClock) NewCron() Cron {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	c := &fakeClockCron{clock: clock}
+	clock.crons = append(clock.crons, c)
+	return c
+}
+
+// Advance moves the clock forward firing the timers and cron
+// entries that are due in their order. The cron entries are run
+// on the calling goroutine.
+func (clock *FakeClock) Advance(d time.Duration) {
+	target := clock.Now().Add(d)
+	for clock.fireNext(target) {
+		clock.mtx.Lock()
+		onFire := clock.onFire
+		clock.mtx.Unlock()
+		if onFire != nil {
+			onFire()
+		}
+	}
+	clock.Set(target)
+}
+
+// fireNext fires the earliest timer or cron entry that's
+// due by the target time setting the clock to its time.
+// It returns false if there's no such timer or entry.
+func (clock *FakeClock) fireNext(target time.Time) bool {
+	clock.mtx.Lock()
+	var (
+		when  time.Time
+		timer *fakeClockTimer
+		entry *fakeClockCronEntry
+	)
+	pending := clock.timers[:0]
+	for _, t := range clock.timers {
+		if t.stopped {
+			continue
+		}
+		pending = append(pending, t)
+		if !t.due.After(target) && (timer == nil || t.due.Before(when)) {
+			when, timer = t.due, t
+		}
+	}
+	clock.timers = pending
+	crons := clock.crons[:0]
+	for _, c := range clock.crons {
+		if c.stopped {
+			continue
+		}
+		crons = append(crons, c)
+		if !c.started {
+			continue
+		}
+		for _, e := range c.entries {
+			if e.next.IsZero() || e.next.After(target) {
+				continue
+			}
+			if (timer == nil && entry == nil) || e.next.Before(when) {
+				when, timer, entry = e.next, nil, e
+			}
+		}
+	}
+	clock.crons = crons
+
+	switch {
+	case timer != nil:
+		clock.now = when
+		select {
+		case timer.ch <- when:
+		default:
+			// the previous tick of the periodic
+			// timer isn't handled yet
+		}
+		if timer.periodic && timer.interval > 0 {
+			timer.due = timer.due.Add(timer.interval)
+		} else {
+			timer.stopped = true
+		}
+		clock.mtx.Unlock()
+	case entry != nil:
+		clock.now = when
+		entry.next = entry.schedule.Next(when)
+		clock.mtx.Unlock()
+		entry.cmd()
+	default:
+		clock.mtx.Unlock()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	var fired []string
+	// the ticks are delivered via buffered channels,
+	// so they're picked up by the fire hook
+	names := make(map[<-chan time.Time]string)
+	watch := func(name string, ch <-chan time.Time) {
+		names[ch] = name
+	}
+	clock.SetFireHook(func() {
+		for ch, name := range names {
+			select {
+			case ts := <-ch:
+				fired = append(fired, name+" "+ts.Format("15:04"))
+			default:
+			}
+		}
+	})
+
+	watch("timer", clock.NewTimer(5*time.Minute).GetChannel())
+	watch("ticker", clock.NewTicker(2*time.Minute).GetChannel())
+	stopped := clock.NewTimer(time.Minute)
+	watch("stopped", stopped.GetChannel())
+	stopped.Stop()
+	c := clock.NewCron()
+	if err := c.AddFunc("0 */3 * * * *", func() {
+		fired = append(fired, "cron "+clock.Now().Format("15:04"))
+	}); err != nil {
+		t.Fatalf("AddFunc(): %s", err)
+	}
+	if err := c.AddFunc("bad spec", func() {}); err == nil {
+		t.Errorf("no error for an invalid cron spec")
+	}
+	c.Start()
+
+	clock.Advance(6 * time.Minute)
+	expected := []string{
+		"ticker 10:02", "cron 10:03", "ticker 10:04",
+		"timer 10:05", "ticker 10:06", "cron 10:06",
+	}
+	if !reflect.DeepEqual(fired, expected) {
+		t.Errorf("bad firings: %v", fired)
+	}
+	if now := clock.Now(); !now.Equal(start.Add(6 * time.Minute)) {
+		t.Errorf("bad time: %s", now)
+	}
+
+	fired = nil
+	c.Stop()
+	clock.Advance(3 * time.Minute)
+	if !reflect.DeepEqual(fired, []string{"ticker 10:08"}) {
+		t.Errorf("bad firings after cron stop: %v", fired)
+	}
+}
+
+func TestEngineClock(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	clock := NewFakeClock(time.Date(2020, 1, 4, 23, 30, 0, 0, time.Local))
+	engine.SetClock(clock)
+	if !engine.TimeInRange(22*60, 6*60) || !engine.IsWeekend() {
+		t.Errorf("the time predicates don't use the engine clock")
+	}
+
+	err := engine.DefineVirtualDevice("somedev", objx.Map{
+		"cells": objx.Map{"temp": objx.Map{"type": "temperature", "value": 19.0}},
+	})
+	if err != nil {
+		t.Fatalf("DefineVirtualDevice(): %s", err)
+	}
+	cell := model.EnsureCell(&CellSpec{"somedev", "temp"})
+	cell.EnableHistory(time.Hour)
+	clock.Advance(10 * time.Minute)
+	cell.SetValue(20)
+	clock.Advance(10 * time.Minute)
+	cell.SetValue(21)
+	samples := cell.History(5 * time.Minute)
+	if len(samples) != 1 || samples[0].Value != 21 {
+		t.Errorf("the history doesn't use the model clock: %v", samples)
+	}
+}
@@ -0,0 +1,139 @@
+package wbrules
+
+import (
+	"fmt"
+	"github.com/ivan4th/go-duktape"
+	"time"
+)
+
+// parseClockTime parses the time of day in HH:MM format
+// and returns the number of minutes since midnight
+func parseClockTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, HH:MM expected", s)
+	}
+	return minutesSinceMidnight(t), nil
+}
+
+func minutesSinceMidnight(t time.Time) int {
+	return t.Hour()*60 + t.Minute()
+}
+
+// clockTimeInRange returns true if the time of day of t is within
+// [from, to) range specified in minutes since midnight. The range
+// wraps around midnight when from is greater than to.
+func clockTimeInRange(t time.Time, from, to int) bool {
+	m := minutesSinceMidnight(t)
+	if from <= to {
+		return m >= from && m < to
+	}
+	return m >= from || m < to
+}
+
+// nextClockTime returns the nearest moment after t
+// when the time of day is the specified number of
+// minutes since midnight
+func nextClockTime(t time.Time, minutes int) time.Time {
+	next := time.Date(t.Year(), t.Month(), t.Day(), minutes/60, minutes%60, 0, 0, t.Location())
+	if !next.After(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, minutes/60, minutes%60, 0, 0, t.Location())
+	}
+	return next
+}
+
+func isWeekend(t time.Time) bool {
+	weekday := t.Weekday()
+	return weekday == time.Saturday || weekday == time.Sunday
+}
+
+// TimeInRange checks whether the current time of day is within
+// [from, to) range. When invoked from a rule condition, makes the
+// engine re-check the rules when the range starts or ends.
+func (engine *RuleEngine) TimeInRange(from, to int) bool {
+	now := engine.clock.Now()
+	engine.trackClock(now, nextClockTime(now, from), nextClockTime(now, to))
+	return clockTimeInRange(now, from, to)
+}
+
+// DayOfWeek returns the current day of the week. When invoked
+// from a rule condition, makes the engine re-check
+// the rules at midnight.
+func (engine *RuleEngine) DayOfWeek() time.Weekday {
+	now := engine.clock.Now()
+	engine.trackClock(now, nextClockTime(now, 0))
+	return now.Weekday()
+}
+
+// IsWeekend returns true on Saturday and Sunday, see DayOfWeek()
+func (engine *RuleEngine) IsWeekend() bool {
+	now := engine.clock.Now()
+	engine.trackClock(now, nextClockTime(now, 0))
+	return isWeekend(now)
+}
+
+// trackClock notes that the current rule condition depends on
+// the time of day and arranges a rule check at the earliest of
+// the specified moments when the result of the condition may change
+func (engine *RuleEngine) trackClock(now time.Time, boundaries ...time.Time) {
+	if !engine.trackingDeps {
+		return
+	}
+	engine.notedClock = true
+	at := boundaries[0]
+	for _, boundary := range boundaries[1:] {
+		if boundary.Before(at) {
+			at = boundary
+		}
+	}
+	engine.scheduleClockCheck(now, at)
+}
+
+func (engine *RuleEngine) scheduleClockCheck(now, at time.Time) {
+	if _, found := engine.timers[engine.clockTimerId]; found {
+		if !at.Before(engine.clockCheckAt) {
+			return
+		}
+		engine.StopTimerByIndex(engine.clockTimerId)
+	}
+	engine.clockCheckAt = at
+	engine.clockTimerId = engine.StartTimer(NO_TIMER_NAME, func() {
+		engine.clockTimerId = 0
+		engine.runRules(nil, NO_TIMER_NAME)
+	}, at.Sub(now), false)
+}
+
+// esWbTimeInRange returns the result of the check
+// or an error message if the arguments are invalid
+func (engine *ESEngine) esWbTimeInRange() int {
+	if engine.ctx.GetTop() != 2 || !engine.ctx.IsString(0) || !engine.ctx.IsString(1) {
+		return duktape.DUK_RET_ERROR
+	}
+	from, err := parseClockTime(engine.ctx.GetString(0))
+	if err == nil {
+		var to int
+		if to, err = parseClockTime(engine.ctx.GetString(1)); err == nil {
+			engine.ctx.PushBoolean(engine.TimeInRange(from, to))
+			return 1
+		}
+	}
+	engine.ctx.PushString(err.Error())
+	return 1
+}
+
+func (engine *ESEngine) esWbDayOfWeek() int {
+	engine.ctx.PushNumber(float64(engine.DayOfWeek()))
+	return 1
+}
+
+func (engine *ESEngine) esWbIsWeekend() int {
+	engine.ctx.PushBoolean(engine.IsWeekend())
+	return 1
+}
+
+// esWbNow returns the time of the engine clock in
+// milliseconds since the epoch, see Date.now() in lib.js
+func (engine *ESEngine) esWbNow() int {
+	engine.ctx.PushNumber(float64(engine.clock.Now().UnixNano() / int64(time.Millisecond)))
+	return 1
+}
@@ -0,0 +1,109 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"testing"
+	"time"
+)
+
+func clockTime(t *testing.T, s string) int {
+	minutes, err := parseClockTime(s)
+	if err != nil {
+		t.Fatalf("parseClockTime(%q): %s", s, err)
+	}
+	return minutes
+}
+
+func TestParseClockTime(t *testing.T) {
+	if minutes := clockTime(t, "22:30"); minutes != 22*60+30 {
+		t.Errorf("bad minutes for 22:30: %d", minutes)
+	}
+	for _, s := range []string{"", "24:00", "12:60", "12", "12:00:00", "noon"} {
+		if _, err := parseClockTime(s); err == nil {
+			t.Errorf("no error for %q", s)
+		}
+	}
+}
+
+func TestClockTimeInRange(t *testing.T) {
+	for _, item := range []struct {
+		now, from, to string
+		expected      bool
+	}{
+		{"12:00", "08:00", "20:00", true},
+		{"08:00", "08:00", "20:00", true},
+		{"20:00", "08:00", "20:00", false},
+		{"07:59", "08:00", "20:00", false},
+		{"23:00", "22:00", "06:00", true},
+		{"05:59", "22:00", "06:00", true},
+		{"06:00", "22:00", "06:00", false},
+		{"12:00", "22:00", "06:00", false},
+		{"12:00", "12:00", "12:00", false},
+	} {
+		now := time.Date(2016, 3, 1, 0, clockTime(t, item.now), 0, 0, time.UTC)
+		if r := clockTimeInRange(now, clockTime(t, item.from), clockTime(t, item.to)); r != item.expected {
+			t.Errorf("clockTimeInRange(%s, %s, %s) = %v", item.now, item.from, item.to, r)
+		}
+	}
+}
+
+func TestNextClockTime(t *testing.T) {
+	now := time.Date(2016, 3, 1, 21, 30, 15, 0, time.UTC)
+	for _, item := range []struct {
+		at       string
+		expected time.Time
+	}{
+		{"22:00", time.Date(2016, 3, 1, 22, 0, 0, 0, time.UTC)},
+		{"06:00", time.Date(2016, 3, 2, 6, 0, 0, 0, time.UTC)},
+		{"21:30", time.Date(2016, 3, 2, 21, 30, 0, 0, time.UTC)},
+		{"00:00", time.Date(2016, 3, 2, 0, 0, 0, 0, time.UTC)},
+	} {
+		if next := nextClockTime(now, clockTime(t, item.at)); !next.Equal(item.expected) {
+			t.Errorf("nextClockTime(%s) = %s", item.at, next)
+		}
+	}
+	if isWeekend(now) || !isWeekend(time.Date(2016, 3, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("isWeekend() failed")
+	}
+}
+
+func TestClockRuleCheck(t *testing.T) {
+	_, engine := newTimerTestEngine(t, nullMQTTClient{})
+	checks := make(chan struct{}, 10)
+	rule := NewRule(engine, "nightRule", NewLevelTriggeredRuleCondition(func() bool {
+		checks <- struct{}{}
+		return engine.TimeInRange(22*60, 6*60)
+	}), func(args objx.Map) interface{} {
+		return nil
+	})
+	engine.model.CallSync(func() {
+		engine.DefineRule(rule)
+		engine.runRules(nil, NO_TIMER_NAME)
+	})
+	<-checks
+
+	var checkAt time.Time
+	var isWithoutCells bool
+	engine.model.CallSync(func() {
+		checkAt = engine.clockCheckAt
+		isWithoutCells = engine.rulesWithoutCells[rule]
+		if _, found := engine.timers[engine.clockTimerId]; !found {
+			t.Errorf("clock check timer isn't running")
+		}
+	})
+	if isWithoutCells {
+		t.Errorf("the rule that depends on the clock is marked as the one without cells")
+	}
+	if now := time.Now(); !checkAt.After(now) || checkAt.After(now.Add(16*time.Hour)) {
+		t.Errorf("bad clock check time: %s", checkAt)
+	}
+
+	engine.model.CallSync(func() {
+		engine.scheduleClockCheck(time.Now(), time.Now().Add(10*time.Millisecond))
+	})
+	select {
+	case <-checks:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the rule wasn't re-checked by the clock timer")
+	}
+}
@@ -0,0 +1,243 @@
+package wbrules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DisposaBoy/JsonConfigReader"
+	wbgo "github.com/contactless/wbgo"
+	duktape "github.com/ivan4th/go-duktape"
+	"github.com/stretchr/objx"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var noConfigDir = errors.New("config directory not set")
+
+// ConfigChangedRuleCondition fires the rule when the config
+// file changes. The new content of the file is passed to
+// the rule as newValue.
+type ConfigChangedRuleCondition struct {
+	RuleConditionBase
+	path    string
+	changed func() (string, interface{})
+}
+
+func NewConfigChangedRuleCondition(path string, changed func() (string, interface{})) *ConfigChangedRuleCondition {
+	return &ConfigChangedRuleCondition{path: path, changed: changed}
+}
+
+func (ruleCond *ConfigChangedRuleCondition) Check(cell *Cell) (bool, interface{}) {
+	if cell != nil {
+		return false, nil
+	}
+	path, content := ruleCond.changed()
+	if path != ruleCond.path {
+		return false, nil
+	}
+	return true, content
+}
+
+// configWatcher notifies the engine about config
+// files changed by other programs, e.g. by the web UI
+type configWatcher struct {
+	engine *ESEngine
+}
+
+func (watcher *configWatcher) LoadFile(path string) error {
+	// the files are loaded before the engine is started.
+	// The initial content is remembered so the rules
+	// aren't fired for unchanged files.
+	_, err := watcher.engine.configTracker.Track(path, path)
+	return err
+}
+
+func (watcher *configWatcher) LiveLoadFile(path string) error {
+	watcher.engine.ConfigChanged(path)
+	return nil
+}
+
+func (watcher *configWatcher) LiveRemoveFile(path string) error {
+	return nil
+}
+
+// ReadConfigFile reads JSON config file. Comments
+// are allowed in the file.
+func ReadConfigFile(path string) (objx.Map, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	content, err := ioutil.ReadAll(JsonConfigReader.New(in))
+	if err != nil {
+		return nil, err
+	}
+	return objx.FromJSON(string(content))
+}
+
+// WriteConfigFile atomically replaces the content of JSON
+// config file, so the readers never see a partially
+// written file
+func WriteConfigFile(path string, data objx.Map) error {
+	content, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(append(content, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// SetConfigDir sets the directory with config files that can be
+// edited by scripts using editConfig(). Relative config file paths
+// passed to readConfig() and editConfig() and specified in
+// onConfigChange rule option are resolved against this directory.
+// Returns a watcher client for wbgo.DirWatcher that's used to
+// deliver the changes of the config files made by other programs
+// to the rules.
+func (engine *ESEngine) SetConfigDir(dir string) (wbgo.DirWatcherClient, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	engine.configDir = filepath.Clean(dir)
+	return &configWatcher{engine}, nil
+}
+
+func (engine *ESEngine) resolveConfigPath(name string) (string, error) {
+	if engine.configDir != "" && !filepath.IsAbs(name) {
+		name = filepath.Join(engine.configDir, name)
+	}
+	return filepath.Abs(name)
+}
+
+// writableConfigPath resolves the path of the config file
+// making sure it's located under the config directory
+func (engine *ESEngine) writableConfigPath(name string) (string, error) {
+	if engine.configDir == "" {
+		return "", noConfigDir
+	}
+	path, err := engine.resolveConfigPath(name)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(engine.configDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("config file outside config directory: %s", name)
+	}
+	return path, nil
+}
+
+// ConfigChanged fires the rules that have onConfigChange option
+// set to the specified config file, unless the file content
+// is the same as when they were fired last time. Must not be
+// called from the model goroutine.
+func (engine *ESEngine) ConfigChanged(path string) {
+	engine.Call(func() {
+		engine.runConfigRules(path)
+	})
+}
+
+func (engine *ESEngine) runConfigRules(path string) {
+	changed, err := engine.configTracker.Track(path, path)
+	if err != nil || !changed {
+		return
+	}
+	content, err := ReadConfigFile(path)
+	if err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "failed to reload config file %s: %s", path, err)
+		return
+	}
+	engine.changedConfig, engine.changedConfigContent = path, content
+	defer func() {
+		engine.changedConfig, engine.changedConfigContent = "", nil
+	}()
+	engine.runRules(nil, NO_TIMER_NAME)
+}
+
+func (engine *ESEngine) buildConfigChangedRuleCondition(defIndex int) (RuleCondition, error) {
+	engine.ctx.GetPropString(defIndex, "onConfigChange")
+	defer engine.ctx.Pop()
+	if !engine.ctx.IsString(-1) {
+		return nil, errors.New("onConfigChange: config file name expected")
+	}
+	path, err := engine.resolveConfigPath(engine.ctx.GetString(-1))
+	if err != nil {
+		return nil, err
+	}
+	return NewConfigChangedRuleCondition(path, func() (string, interface{}) {
+		return engine.changedConfig, engine.changedConfigContent
+	}), nil
+}
+
+// esWbLoadConfig returns the content of the config
+// file or an empty object if the file doesn't exist
+func (engine *ESEngine) esWbLoadConfig() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	path, err := engine.writableConfigPath(engine.ctx.GetString(0))
+	if err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "editConfig: %s", err)
+		return duktape.DUK_RET_ERROR
+	}
+	content, err := ReadConfigFile(path)
+	switch {
+	case os.IsNotExist(err):
+		content = objx.New(map[string]interface{}{})
+	case err != nil:
+		engine.Logf(ENGINE_LOG_ERROR, "editConfig: failed to read config file %s: %s", path, err)
+		return duktape.DUK_RET_ERROR
+	}
+	engine.ctx.PushJSObject(content)
+	return 1
+}
+
+func (engine *ESEngine) esWbWriteConfig() int {
+	if engine.ctx.GetTop() != 2 || !engine.ctx.IsString(0) || !engine.ctx.IsObject(1) {
+		return duktape.DUK_RET_ERROR
+	}
+	path, err := engine.writableConfigPath(engine.ctx.GetString(0))
+	if err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "editConfig: %s", err)
+		return duktape.DUK_RET_ERROR
+	}
+	err = engine.checkPermission("writing "+path, func(profile *ExecProfile) bool {
+		return profile.AllowFileAccess
+	})
+	if err != nil {
+		return duktape.DUK_RET_ERROR
+	}
+	content, ok := engine.ctx.GetJSObject(1).(objx.Map)
+	if !ok {
+		return duktape.DUK_RET_ERROR
+	}
+	if err = WriteConfigFile(path, content); err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "editConfig: failed to write config file %s: %s", path, err)
+		return duktape.DUK_RET_ERROR
+	}
+	// the rules are fired after the current callback completes
+	engine.Post(func() {
+		engine.runConfigRules(path)
+	})
+	return 0
+}
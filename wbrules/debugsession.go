@@ -0,0 +1,248 @@
+package wbrules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEBUG_SESSION_SUBTOPIC         = "debug"
+	DEFAULT_DEBUG_SESSION_DURATION = 10 * time.Minute
+	MAX_DEBUG_SESSION_DURATION     = time.Hour
+)
+
+// DebugSessionOptions specify the rules and scripts
+// traced by a debug session
+type DebugSessionOptions struct {
+	Rules []string `json:"rules"`
+	// Scripts are matched against script paths, e.g.
+	// "heating.js" matches "/etc/wb-rules/heating.js"
+	Scripts []string `json:"scripts"`
+	// Duration is the duration of the session in seconds.
+	// DEFAULT_DEBUG_SESSION_DURATION is used if it's zero.
+	Duration int `json:"duration"`
+}
+
+// DebugSessionInfo describes an active debug session.
+// The output of the session is published to Topic.
+type DebugSessionInfo struct {
+	ID      string    `json:"id"`
+	Topic   string    `json:"topic"`
+	Rules   []string  `json:"rules"`
+	Scripts []string  `json:"scripts"`
+	Expires time.Time `json:"expires"`
+}
+
+type debugSession struct {
+	info    DebugSessionInfo
+	rules   map[string]bool
+	timerId uint64
+}
+
+type debugSessionSlice []DebugSessionInfo
+
+func (s debugSessionSlice) Len() int           { return len(s) }
+func (s debugSessionSlice) Less(i, j int) bool { return s[i].Expires.Before(s[j].Expires) }
+func (s debugSessionSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (session *debugSession) matches(ruleName, script string) bool {
+	if ruleName != "" && session.rules[ruleName] {
+		return true
+	}
+	if script == "" {
+		return false
+	}
+	for _, s := range session.info.Scripts {
+		if script == s || strings.HasSuffix(script, "/"+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamToDebugSessions publishes the message to the sessions
+// that trace the current rule or the script being loaded.
+// Must be called with debugMtx locked.
+func (engine *RuleEngine) streamToDebugSessions(level, message string) {
+	ruleName, script := engine.logContext()
+	for _, session := range engine.debugSessions {
+		if session.matches(ruleName, script) {
+			engine.Publish(session.info.Topic, "["+level+"] "+message, 1, false)
+		}
+	}
+}
+
+func (engine *RuleEngine) traceRuleFiring(rule *Rule, firing *RuleFiring) {
+	message := "[trace] rule " + rule.name + " fired"
+	if firing.Device != "" {
+		message += " by " + firing.Device + "/" + firing.Cell
+	}
+	engine.debugMtx.Lock()
+	defer engine.debugMtx.Unlock()
+	for _, session := range engine.debugSessions {
+		if session.matches(rule.name, rule.script) {
+			engine.Publish(session.info.Topic, message, 1, false)
+		}
+	}
+}
+
+// StartDebugSession starts a debug session that streams the
+// log messages of the specified rules and scripts, including
+// debug messages, along with the rule firings to the topic
+// of the session regardless of the global debugging switch.
+// The session ends automatically after the specified duration.
+func (engine *RuleEngine) StartDebugSession(opts DebugSessionOptions) (info DebugSessionInfo, err error) {
+	d := time.Duration(opts.Duration) * time.Second
+	switch {
+	case len(opts.Rules) == 0 && len(opts.Scripts) == 0:
+		return info, fmt.Errorf("no rules or scripts specified")
+	case d < 0 || d > MAX_DEBUG_SESSION_DURATION:
+		return info, fmt.Errorf("invalid debug session duration")
+	case d == 0:
+		d = DEFAULT_DEBUG_SESSION_DURATION
+	}
+	engine.Call(func() {
+		session := &debugSession{rules: make(map[string]bool)}
+		for _, name := range opts.Rules {
+			if _, found := engine.ruleMap[name]; !found {
+				err = fmt.Errorf("unknown rule: %s", name)
+				return
+			}
+			session.rules[name] = true
+		}
+		engine.lastDebugSessId++
+		id := strconv.FormatUint(engine.lastDebugSessId, 10)
+		session.info = DebugSessionInfo{
+			ID:      id,
+			Topic:   engine.topic(DEBUG_SESSION_SUBTOPIC + "/" + id),
+			Rules:   append([]string{}, opts.Rules...),
+			Scripts: append([]string{}, opts.Scripts...),
+			Expires: time.Now().Add(d),
+		}
+		session.timerId = engine.StartTimer(NO_TIMER_NAME, func() {
+			session.timerId = 0
+			engine.endDebugSession(id, "expired")
+		}, d, false)
+		engine.debugMtx.Lock()
+		engine.debugSessions[id] = session
+		engine.debugMtx.Unlock()
+		info = session.info
+		engine.Logf(ENGINE_LOG_INFO, "debug session %s started for %s", id, d)
+	})
+	return
+}
+
+func (engine *RuleEngine) endDebugSession(id, reason string) bool {
+	engine.debugMtx.Lock()
+	session, found := engine.debugSessions[id]
+	if found {
+		delete(engine.debugSessions, id)
+		engine.Publish(session.info.Topic, "[end] debug session "+reason, 1, false)
+	}
+	engine.debugMtx.Unlock()
+	if !found {
+		return false
+	}
+	engine.StopTimerByIndex(session.timerId)
+	engine.Logf(ENGINE_LOG_INFO, "debug session %s %s", id, reason)
+	return true
+}
+
+// StopDebugSession ends the debug session before it expires
+func (engine *RuleEngine) StopDebugSession(id string) (err error) {
+	engine.Call(func() {
+		if !engine.endDebugSession(id, "stopped") {
+			err = fmt.Errorf("unknown debug session: %s", id)
+		}
+	})
+	return
+}
+
+// DebugSessions returns the active debug sessions
+// ordered by expiration time
+func (engine *RuleEngine) DebugSessions() []DebugSessionInfo {
+	engine.debugMtx.Lock()
+	sessions := make([]DebugSessionInfo, 0, len(engine.debugSessions))
+	for _, session := range engine.debugSessions {
+		sessions = append(sessions, session.info)
+	}
+	engine.debugMtx.Unlock()
+	sort.Sort(debugSessionSlice(sessions))
+	return sessions
+}
+
+// DebugSessionManager manages debug sessions
+type DebugSessionManager interface {
+	StartDebugSession(opts DebugSessionOptions) (DebugSessionInfo, error)
+	StopDebugSession(id string) error
+	DebugSessions() []DebugSessionInfo
+}
+
+// Debugger is an RPC service that manages debug sessions. Unlike
+// the global 'Rule debugging' switch, a debug session only affects
+// the selected rules and scripts and reverts automatically, so it's
+// safe to use on production controllers. The caller subscribes to
+// the topic of the session to receive its output.
+type Debugger struct {
+	manager DebugSessionManager
+}
+
+type DebuggerError struct {
+	code    int32
+	message string
+}
+
+func (err *DebuggerError) Error() string {
+	return err.message
+}
+
+func (err *DebuggerError) ErrorCode() int32 {
+	return err.code
+}
+
+const (
+	// no iota here because these values may be used
+	// by external software
+	DEBUGGER_ERROR_INVALID_ARGS    = 1400
+	DEBUGGER_ERROR_UNKNOWN_SESSION = 1401
+)
+
+func NewDebugger(manager DebugSessionManager) *Debugger {
+	return &Debugger{manager}
+}
+
+func (debugger *Debugger) Start(args *DebugSessionOptions, reply *DebugSessionInfo) error {
+	info, err := debugger.manager.StartDebugSession(*args)
+	if err != nil {
+		return &DebuggerError{DEBUGGER_ERROR_INVALID_ARGS, err.Error()}
+	}
+	*reply = info
+	return nil
+}
+
+type DebuggerStopArgs struct {
+	ID string `json:"id"`
+}
+
+type DebuggerStopResponse struct{}
+
+func (debugger *Debugger) Stop(args *DebuggerStopArgs, reply *DebuggerStopResponse) error {
+	if err := debugger.manager.StopDebugSession(args.ID); err != nil {
+		return &DebuggerError{DEBUGGER_ERROR_UNKNOWN_SESSION, err.Error()}
+	}
+	return nil
+}
+
+type DebuggerListArgs struct{}
+
+type DebuggerListResponse struct {
+	Sessions []DebugSessionInfo `json:"sessions"`
+}
+
+func (debugger *Debugger) List(args *DebuggerListArgs, reply *DebuggerListResponse) error {
+	reply.Sessions = debugger.manager.DebugSessions()
+	return nil
+}
@@ -0,0 +1,45 @@
+package wbrules
+
+// pendingWrite is a cell write made by a rule that's
+// postponed till the end of the current rule pass
+type pendingWrite struct {
+	cell   *Cell
+	value  interface{}
+	source string
+}
+
+// SetDeferredWrites enables or disables deferred cell writes.
+// When they're enabled, the cell writes made by rules during
+// a rule pass are applied after all the rules are checked, so
+// all the rules within the pass see the same cell values
+// regardless of the evaluation order. The rules that have
+// immediateWrites option set bypass the deferral.
+func (engine *RuleEngine) SetDeferredWrites(enabled bool) {
+	engine.deferWrites = enabled
+}
+
+// shouldDeferWrite returns true if the cell write being made
+// must be postponed till the end of the rule pass
+func (engine *RuleEngine) shouldDeferWrite() bool {
+	if !engine.deferWrites || engine.runDepth == 0 || engine.currentRule == "" {
+		return false
+	}
+	rule, found := engine.ruleMap[engine.currentRule]
+	return found && !rule.immediateWrites
+}
+
+// applyPendingWrites applies the deferred writes in the order
+// they were made. It's invoked when the outermost rule pass
+// completes before the coalesced writes are published.
+func (engine *RuleEngine) applyPendingWrites() {
+	for i, write := range engine.pendingWrites {
+		write.cell.writeSource = write.source
+		if engine.writeBatch != nil {
+			engine.writeBatch.add(write.cell, write.value)
+		} else {
+			write.cell.SetValue(write.value)
+		}
+		engine.pendingWrites[i] = pendingWrite{}
+	}
+	engine.pendingWrites = engine.pendingWrites[:0]
+}
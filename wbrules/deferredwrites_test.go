@@ -0,0 +1,38 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"testing"
+)
+
+func TestDeferredWrites(t *testing.T) {
+	for _, tt := range []struct {
+		deferWrites, immediate bool
+		seen                   interface{}
+	}{
+		{false, false, true},
+		{true, false, false},
+		{true, true, true},
+	} {
+		engine, _ := setupPriorityEngine(t, []priorityTestRule{{"open", 0, true}})
+		engine.SetDeferredWrites(tt.deferWrites)
+		engine.ruleMap["open"].SetImmediateWrites(tt.immediate)
+		valve := engine.model.EnsureCell(&CellSpec{"heater", "valve"})
+		cond, _ := NewCellChangedRuleCondition(CellSpec{"heater", "trigger"})
+		var seen interface{}
+		engine.DefineRule(NewRule(engine, "check", cond, func(args objx.Map) interface{} {
+			seen = valve.Value()
+			return nil
+		}))
+
+		firePriorityRules(engine)
+		if seen != tt.seen {
+			t.Errorf("defer %v, immediate %v: the value seen by the rule is %v",
+				tt.deferWrites, tt.immediate, seen)
+		}
+		if valve.Value() != true || valve.Source() != "rule:open" {
+			t.Errorf("defer %v, immediate %v: bad value after the pass: %v (source %q)",
+				tt.deferWrites, tt.immediate, valve.Value(), valve.Source())
+		}
+	}
+}
@@ -37,6 +37,7 @@ const (
 	EDITOR_ERROR_FILE_NOT_FOUND = 1003
 	EDITOR_ERROR_REMOVE         = 1004
 	EDITOR_ERROR_READ           = 1005
+	EDITOR_ERROR_INVALID_RENAME = 1006
 )
 
 var invalidPathError = &EditorError{EDITOR_ERROR_INVALID_PATH, "Invalid path"}
@@ -45,6 +46,7 @@ var writeError = &EditorError{EDITOR_ERROR_WRITE, "Error writing the file"}
 var fileNotFoundError = &EditorError{EDITOR_ERROR_FILE_NOT_FOUND, "File not found"}
 var rmError = &EditorError{EDITOR_ERROR_REMOVE, "Error removing the file"}
 var readError = &EditorError{EDITOR_ERROR_READ, "Error reading the file"}
+var refactorError = &EditorError{EDITOR_ERROR_WRITE, "Error rewriting the files"}
 
 func NewEditor(locFileManager LocFileManager) *Editor {
 	return &Editor{locFileManager}
@@ -148,3 +150,59 @@ func (editor *Editor) Load(args *EditorPathArgs, reply *EditorContentResponse) e
 	}
 	return nil
 }
+
+type EditorRenameArgs struct {
+	Renames ReferenceRenames `json:"renames"`
+	DryRun  bool             `json:"dryRun"`
+}
+
+type EditorRenameResponse struct {
+	Files []RefactorFileResult `json:"files"`
+}
+
+// Rename rewrites the references to the renamed devices and cells
+// across the editable scripts. The changed scripts are reloaded, so
+// the aliases defined by them are updated, too. When DryRun is set,
+// only the diffs of the would-be changes are returned.
+func (editor *Editor) Rename(args *EditorRenameArgs, reply *EditorRenameResponse) error {
+	if err := args.Renames.Validate(); err != nil {
+		return &EditorError{EDITOR_ERROR_INVALID_RENAME, err.Error()}
+	}
+	files, err := renameSourceReferences(editor.locFileManager, args.Renames, args.DryRun)
+	if err != nil {
+		wbgo.Error.Printf("error renaming references: %s", err)
+		return refactorError
+	}
+	reply.Files = files
+	return nil
+}
+
+type EditorChangeStateArgs struct {
+	Path  string `json:"path"`
+	State bool   `json:"state"`
+}
+
+// ChangeState enables (State = true) or disables the script.
+// Disabled scripts are listed with 'disabled' flag set.
+func (editor *Editor) ChangeState(args *EditorChangeStateArgs, reply *EditorSaveResponse) error {
+	entry, err := editor.locateFile(args.Path)
+	if err != nil {
+		return err
+	}
+	*reply = EditorSaveResponse{nil, entry.VirtualPath, nil}
+	if args.State == !entry.Disabled {
+		// already in the requested state
+		return nil
+	}
+	err = editor.locFileManager.LiveChangeScriptState(entry.VirtualPath, args.State)
+	switch err.(type) {
+	case nil:
+	case ScriptError:
+		reply.Error = err.Error()
+		reply.Traceback = err.(ScriptError).Traceback
+	default:
+		wbgo.Error.Printf("error changing state of %s: %s", entry.VirtualPath, err)
+		return writeError
+	}
+	return nil
+}
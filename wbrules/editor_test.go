@@ -36,7 +36,7 @@ func (s *EditorSuite) SetupTest() {
 	s.RpcFixture = testutils.NewRpcFixture(
 		s.T(), "wbrules", "Editor", "wbrules",
 		NewEditor(s),
-		"List", "Load", "Remove", "Save")
+		"List", "Load", "Remove", "Save", "Rename", "ChangeState")
 }
 
 func (s *EditorSuite) TearDownTest() {
@@ -67,6 +67,14 @@ func (s *EditorSuite) LiveWriteScript(virtualPath, content string) error {
 	return s.liveWriteError
 }
 
+func (s *EditorSuite) LiveChangeScriptState(virtualPath string, enabled bool) error {
+	physicalPath := filepath.Join(s.DataFileTempDir(), virtualPath)
+	if enabled {
+		return os.Rename(physicalPath+DISABLED_SCRIPT_SUFFIX, physicalPath)
+	}
+	return os.Rename(physicalPath, physicalPath+DISABLED_SCRIPT_SUFFIX)
+}
+
 func (s *EditorSuite) expectLiveWrite(path string, err error) {
 	s.liveWritePath = path
 	s.liveWriteError = err
@@ -96,7 +104,10 @@ func (s *EditorSuite) walkSources(walkFn func(virtualPath, physicalPath string))
 func (s *EditorSuite) ListSourceFiles() (entries []LocFileEntry, err error) {
 	entries = make([]LocFileEntry, 0)
 	s.walkSources(func(virtualPath, physicalPath string) {
-		if !strings.HasSuffix(virtualPath, ".js") {
+		disabled := strings.HasSuffix(virtualPath, ".js"+DISABLED_SCRIPT_SUFFIX)
+		if disabled {
+			virtualPath = strings.TrimSuffix(virtualPath, DISABLED_SCRIPT_SUFFIX)
+		} else if !strings.HasSuffix(virtualPath, ".js") {
 			return
 		}
 
@@ -105,6 +116,7 @@ func (s *EditorSuite) ListSourceFiles() (entries []LocFileEntry, err error) {
 			PhysicalPath: physicalPath,
 			Devices:      []LocItem{},
 			Rules:        []LocItem{},
+			Disabled:     disabled,
 		}
 		if virtualPath == "sample1.js" {
 			entry.Devices = []LocItem{{1, "abc"}, {2, "def"}}
@@ -292,6 +304,83 @@ func (s *EditorSuite) TestLoadFile() {
 		EDITOR_ERROR_FILE_NOT_FOUND, "EditorError", "File not found")
 }
 
+func (s *EditorSuite) TestRename() {
+	s.WriteDataFile("sample3.js", "defineAlias(\"relay\", \"wb-mr6c_10/K1\");\n// wb-mr6c_10/K2\n")
+	diff := "--- a/sample3.js\n+++ b/sample3.js\n" +
+		"@@ -1 +1 @@\n" +
+		"-defineAlias(\"relay\", \"wb-mr6c_10/K1\");\n" +
+		"+defineAlias(\"relay\", \"wb-mr6c_20/K1\");\n"
+	params := objx.Map{
+		"renames": objx.Map{"wb-mr6c_10": "wb-mr6c_20"},
+		"dryRun":  true,
+	}
+	expectedResult := objx.Map{
+		"files": []objx.Map{
+			{"path": "sample3.js", "replacements": 1, "diff": diff},
+		},
+	}
+	s.VerifyRpc("Rename", params, expectedResult)
+	s.verifySources(map[string]string{
+		"sample1.js": "// sample1",
+		"sample2.js": "// sample2",
+		"sample3.js": "defineAlias(\"relay\", \"wb-mr6c_10/K1\");\n// wb-mr6c_10/K2\n",
+	})
+
+	params["dryRun"] = false
+	s.expectLiveWrite("sample3.js", nil)
+	s.VerifyRpc("Rename", params, expectedResult)
+	s.verifyLiveWrite()
+	s.verifySources(map[string]string{
+		"sample1.js": "// sample1",
+		"sample2.js": "// sample2",
+		"sample3.js": "defineAlias(\"relay\", \"wb-mr6c_20/K1\");\n// wb-mr6c_10/K2\n",
+	})
+
+	s.VerifyRpcError("Rename", objx.Map{"renames": objx.Map{"wb-mr6c_10": "wb-mr6c_20/K1"}},
+		EDITOR_ERROR_INVALID_RENAME, "EditorError", `invalid rename: "wb-mr6c_10" -> "wb-mr6c_20/K1"`)
+}
+
+func (s *EditorSuite) TestChangeState() {
+	s.VerifyRpc("ChangeState", objx.Map{"path": "sample2.js", "state": false},
+		objx.Map{"path": "sample2.js"})
+	s.verifySources(map[string]string{
+		"sample1.js":          "// sample1",
+		"sample2.js.disabled": "// sample2",
+	})
+	s.VerifyRpc("List", objx.Map{}, []objx.Map{
+		{
+			"virtualPath": "sample1.js",
+			"devices": []objx.Map{
+				{"line": 1, "name": "abc"},
+				{"line": 2, "name": "def"},
+			},
+			"rules": []objx.Map{
+				{"line": 10, "name": "foobar"},
+			},
+		},
+		{
+			"virtualPath": "sample2.js",
+			"devices":     []objx.Map{},
+			"rules":       []objx.Map{},
+			"disabled":    true,
+		},
+	})
+
+	// disabling a disabled script is a no-op
+	s.VerifyRpc("ChangeState", objx.Map{"path": "sample2.js", "state": false},
+		objx.Map{"path": "sample2.js"})
+
+	s.VerifyRpc("ChangeState", objx.Map{"path": "sample2.js", "state": true},
+		objx.Map{"path": "sample2.js"})
+	s.verifySources(map[string]string{
+		"sample1.js": "// sample1",
+		"sample2.js": "// sample2",
+	})
+
+	s.VerifyRpcError("ChangeState", objx.Map{"path": "nosuchfile.js", "state": true},
+		EDITOR_ERROR_FILE_NOT_FOUND, "EditorError", "File not found")
+}
+
 func TestEditorSuite(t *testing.T) {
 	testutils.RunSuites(t, new(EditorSuite))
 }
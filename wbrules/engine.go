@@ -1,12 +1,15 @@
 package wbrules
 
 import (
+	"context"
 	"fmt"
 	wbgo "github.com/contactless/wbgo"
-	"github.com/robfig/cron"
 	"github.com/stretchr/objx"
 	"log"
+	"math"
+	"regexp"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -20,7 +23,13 @@ const (
 	CELL_RULES_CAPACITY           = 8
 	NO_CALLBACK                   = ESCallback(0)
 	RULE_ENGINE_SETTINGS_DEV_NAME = "wbrules"
+	RULE_ENGINE_TOPIC_ROOT        = "wbrules"
 	RULE_DEBUG_CELL_NAME          = "Rule debugging"
+	FEATURES_DEV_NAME             = "features"
+	FEATURES_DEV_TITLE            = "Features"
+	CELL_CHANGE_RESTART_DELAY     = 100 * time.Millisecond
+	CELL_CHANGE_RESTART_MAX_DELAY = 30 * time.Second
+	DEFAULT_INGEST_MAX_DURATION   = 30 * time.Second
 
 	ENGINE_LOG_DEBUG = EngineLogLevel(iota)
 	ENGINE_LOG_INFO
@@ -30,14 +39,6 @@ const (
 
 type TimerFunc func(id uint64, d time.Duration, periodic bool) wbgo.Timer
 
-func newTimer(id uint64, d time.Duration, periodic bool) wbgo.Timer {
-	if periodic {
-		return wbgo.NewRealTicker(d)
-	} else {
-		return wbgo.NewRealTimer(d)
-	}
-}
-
 type TimerEntry struct {
 	sync.Mutex
 	timer         wbgo.Timer
@@ -46,6 +47,14 @@ type TimerEntry struct {
 	name          string
 	thunk         func()
 	active        bool
+	profile       *ExecProfile
+	interval      time.Duration
+	// script is the script that started the timer
+	script string
+	// started is the time when the timer began counting.
+	// It's zero while the timer waits for the engine
+	// to become ready.
+	started time.Time
 }
 
 func (entry *TimerEntry) stop() {
@@ -59,10 +68,21 @@ func (entry *TimerEntry) stop() {
 	entry.active = false
 }
 
+// deactivate marks the timer as inactive without waiting
+// for its goroutine to finish. It's used when the engine
+// stops and the timer goroutines are terminated via
+// the engine's lifetime context.
+func (entry *TimerEntry) deactivate() {
+	entry.Lock()
+	defer entry.Unlock()
+	entry.active = false
+}
+
 type proxyOwner interface {
 	CellModel() *CellModel
 	getRev() uint64
 	trackCell(*Cell)
+	setCellValue(*Cell, interface{}) error
 }
 
 type DeviceProxy struct {
@@ -107,20 +127,27 @@ func (cellProxy *CellProxy) getCell() *Cell {
 	return cellProxy.cell
 }
 
+// readCell returns the cell for reading its value
+func (cellProxy *CellProxy) readCell() *Cell {
+	cell := cellProxy.getCell()
+	cell.reads++
+	return cell
+}
+
 func (cellProxy *CellProxy) RawValue() string {
-	return cellProxy.getCell().RawValue()
+	return cellProxy.readCell().RawValue()
 }
 
 func (cellProxy *CellProxy) Value() interface{} {
-	return cellProxy.getCell().Value()
+	return cellProxy.readCell().Value()
 }
 
-func (cellProxy *CellProxy) SetValue(value interface{}) {
-	cellProxy.getCell().SetValue(value)
+func (cellProxy *CellProxy) SetValue(value interface{}) error {
+	return cellProxy.devProxy.owner.setCellValue(cellProxy.getCell(), value)
 }
 
 func (cellProxy *CellProxy) IsComplete() bool {
-	return cellProxy.getCell().IsComplete()
+	return cellProxy.readCell().IsComplete()
 }
 
 // cronProxy helps to avoid race conditions when
@@ -141,29 +168,144 @@ func (cp cronProxy) AddFunc(spec string, cmd func()) error {
 }
 
 type RuleEngine struct {
-	cleanup           *ScopedCleanup
-	rev               uint64
-	model             *CellModel
-	mqttClient        wbgo.MQTTClient
-	cellChange        chan *CellSpec
-	timerFunc         TimerFunc
-	nextTimerId       uint64
-	timers            map[uint64]*TimerEntry
-	callbackIndex     ESCallback
-	ruleMap           map[string]*Rule
+	cleanup       *ScopedCleanup
+	rev           uint64
+	model         *CellModel
+	mqttClient    wbgo.MQTTClient
+	cellChange    chan *CellSpec
+	clock         Clock
+	timerFunc     TimerFunc
+	nextTimerId   uint64
+	timers        map[uint64]*TimerEntry
+	callbackIndex ESCallback
+	ruleMap       map[string]*Rule
+	// ruleList is sorted by rule priority and definition order
 	ruleList          []string
+	ruleSeq           int
 	notedCells        map[*Cell]bool
 	notedTimers       map[string]bool
+	trackingDeps      bool
 	cellToRuleMap     map[*Cell][]*Rule
+	ruleCells         map[*Rule][]*Cell
+	instanceID        string
 	rulesWithoutCells map[*Rule]bool
 	timerRules        map[string][]*Rule
 	currentTimer      string
 	cronMaker         func() Cron
 	cron              Cron
 	statusMtx         sync.Mutex
+	loop              *eventLoop
 	debugMtx          sync.Mutex
 	debugEnabled      bool
 	readyCh           chan struct{}
+	lifetime          context.Context
+	stopLifetime      context.CancelFunc
+	runDepth          int
+	writeBatch        *writeBatch
+	deferWrites       bool
+	pendingWrites     []pendingWrite
+	topicSubs         map[string]*topicSubscription
+	adapterCells      map[*Cell]*AdapterControl
+	persistentCells   map[*Cell]string
+	startupDelay      time.Duration
+	inStartupWindow   bool
+	ingestQuiet       time.Duration
+	ingestMaxDuration time.Duration
+	startupGrace      time.Duration
+	readyTimeout      time.Duration
+	startupDone       bool
+	readyWaitOver     bool
+	readyWaiters      []func()
+	startupHooks      []func()
+	readyTimerId      uint64
+	storage           Storage
+	stateMtx          sync.Mutex
+	lastState         []byte
+	restrictedDirs    []restrictedDir
+	currentProfile    *ExecProfile
+	profileLimit      profileLimit
+	currentRule       string
+	currentScript     string
+	ruleErrorsMtx     sync.Mutex
+	ruleErrors        map[string]RuleError
+	profile           objx.Map
+	disabledRules     map[string]bool
+	ruleHistory       *firingRing
+	// debug sessions are guarded by debugMtx and
+	// only modified by the model goroutine
+	debugSessions   map[string]*debugSession
+	lastDebugSessId uint64
+	// writeClaims holds the cell writes made by the rules
+	// during the current rule pass, see arbitrateWrite()
+	writeClaims map[*Cell]writeClaim
+	auditLog    *AuditLog
+	// scriptLogLevels holds the minimum levels of the messages
+	// logged by the scripts, see SetScriptLogLevel()
+	scriptLogLevels map[string]EngineLogLevel
+	logLevelCells   map[*Cell]string
+	// logTopicPrefix and logLimiter are guarded
+	// by debugMtx, see SetLogRateLimit()
+	logTopicPrefix string
+	logLimiter     *logRateLimiter
+	// logSinks receive the messages logged by
+	// the scripts, see AddLogSink()
+	logSinks []LogSink
+	// destroyedRules are removed from the rule list
+	// when the current rule pass completes
+	destroyedRules []*Rule
+	// onSettingsChange is invoked by the engine goroutine
+	// when a cell of the engine settings device changes
+	onSettingsChange func(cellName string)
+	// cellCauses holds the rule chains that caused the pending
+	// cell changes, see checkCascade()
+	cellCauses      map[*Cell]*ruleCascade
+	currentCascade  *ruleCascade
+	maxCascadeDepth int
+	// maxCellChangeBatch is the max number of cell changes
+	// handled by a single rule pass, see SetCellChangeBatching()
+	maxCellChangeBatch int
+	// slowRuleThreshold is the execution time of a rule
+	// callback that causes a warning, see SetSlowRuleThreshold()
+	slowRuleThreshold time.Duration
+	// the counters exported as metrics, see EngineMetrics()
+	ruleChecks    uint64
+	ruleFirings   uint64
+	scriptErrors  uint64
+	spawnFailures uint64
+	// cellChangeRestarts is the number of times the
+	// cell change channel was re-acquired after being
+	// closed unexpectedly
+	cellChangeRestarts uint64
+	// sceneTransitions holds the functions that cancel
+	// the pending delayed writes of the recalled scenes
+	sceneTransitions map[string][]func()
+	// notedClock is set when the condition being checked
+	// depends on the time of day, see trackClock()
+	notedClock bool
+	// clockTimerId identifies the timer that re-checks the rules
+	// at clockCheckAt, when a time of day condition may change
+	clockTimerId uint64
+	clockCheckAt time.Time
+	// historyRetention is the default time the values are
+	// kept in the cell history, see SetCellHistoryRetention()
+	historyRetention time.Duration
+	// pids holds the PID controllers created
+	// by the scripts, see CreatePID()
+	pids      map[uint64]*pidInstance
+	lastPIDId uint64
+	// writeConflicts tells how to handle the writes of the
+	// same cell by several rules with equal priority during
+	// a single rule pass, see SetWriteConflictMode()
+	writeConflicts string
+	// writeSource overrides the source recorded for
+	// the cell writes, see currentWriteSource()
+	writeSource string
+	// suppressStartupEdges prevents edge-triggered rules from
+	// firing till the engine is ready, see SetStartupEdgeTriggers()
+	suppressStartupEdges bool
+	// background counts the goroutines started on behalf
+	// of the engine, see goBackground() and Stop()
+	background sync.WaitGroup
 }
 
 func NewRuleEngine(model *CellModel, mqttClient wbgo.MQTTClient) (engine *RuleEngine) {
@@ -172,27 +314,64 @@ func NewRuleEngine(model *CellModel, mqttClient wbgo.MQTTClient) (engine *RuleEn
 		rev:               0,
 		model:             model,
 		mqttClient:        mqttClient,
-		timerFunc:         newTimer,
+		clock:             SystemClock,
+		timerFunc:         clockTimerFunc(SystemClock),
 		nextTimerId:       1,
 		timers:            make(map[uint64]*TimerEntry),
 		callbackIndex:     1,
 		ruleMap:           make(map[string]*Rule),
 		ruleList:          make([]string, 0, RULES_CAPACITY),
-		notedCells:        nil,
-		notedTimers:       nil,
+		cellCauses:        make(map[*Cell]*ruleCascade),
+		maxCascadeDepth:   DEFAULT_MAX_CASCADE_DEPTH,
+		notedCells:        make(map[*Cell]bool),
+		notedTimers:       make(map[string]bool),
+		trackingDeps:      false,
 		cellToRuleMap:     make(map[*Cell][]*Rule),
+		ruleCells:         make(map[*Rule][]*Cell),
 		rulesWithoutCells: make(map[*Rule]bool),
 		timerRules:        make(map[string][]*Rule),
 		currentTimer:      NO_TIMER_NAME,
-		cronMaker:         func() Cron { return cron.New() },
+		cronMaker:         SystemClock.NewCron,
 		cron:              nil,
 		debugEnabled:      wbgo.DebuggingEnabled(),
 		readyCh:           nil,
+		readyTimeout:      DEFAULT_READY_TIMEOUT,
+		ruleErrors:        make(map[string]RuleError),
+		profile:           objx.New(map[string]interface{}{}),
+		disabledRules:     make(map[string]bool),
+		ruleHistory:       newFiringRing(DEFAULT_RULE_HISTORY_SIZE),
+		debugSessions:     make(map[string]*debugSession),
+		writeClaims:       make(map[*Cell]writeClaim),
+		sceneTransitions:  make(map[string][]func()),
+		historyRetention:  DEFAULT_CELL_HISTORY_RETENTION,
+		pids:              make(map[uint64]*pidInstance),
+		topicSubs:         make(map[string]*topicSubscription),
+		adapterCells:      make(map[*Cell]*AdapterControl),
+		persistentCells:   make(map[*Cell]string),
+		scriptLogLevels:   make(map[string]EngineLogLevel),
+		logLevelCells:     make(map[*Cell]string),
 	}
+	engine.lifetime, engine.stopLifetime = context.WithCancel(context.Background())
+	// in-memory storage is used unless SetPersistentStorage() is called
+	engine.storage, _ = NewJSONStorage("")
 	engine.setupRuleEngineSettingsDevice()
+	model.SetDelayFunc(engine.delay)
+	model.SetMetaPublishFunc(func(topic, payload string) {
+		engine.Publish(topic, payload, 1, true)
+	})
 	return
 }
 
+// Lifetime returns a context that is cancelled when the engine
+// stops. Goroutines started on behalf of the engine (timers,
+// spawned processes) must not invoke any callbacks after
+// the context is cancelled.
+func (engine *RuleEngine) Lifetime() context.Context {
+	engine.statusMtx.Lock()
+	defer engine.statusMtx.Unlock()
+	return engine.lifetime
+}
+
 func (engine *RuleEngine) ReadyCh() <-chan struct{} {
 	if engine.readyCh == nil {
 		panic("cannot engine's readyCh before the engine is started")
@@ -200,8 +379,52 @@ func (engine *RuleEngine) ReadyCh() <-chan struct{} {
 	return engine.readyCh
 }
 
+// namespaceRx matches valid instance ids and device prefixes
+var namespaceRx = regexp.MustCompile(`^[\w-]+$`)
+
+// InstanceName returns the name prefixed with
+// the engine instance id, if any
+func InstanceName(name, instanceID string) string {
+	if instanceID == "" {
+		return name
+	}
+	return instanceID + "-" + name
+}
+
+// SetInstanceID sets the id of the engine instance, making it
+// possible to run several engines against the same broker.
+// The id is used as a prefix for the names of the engine's own
+// devices (settings and features) and for its MQTT topic root.
+// Must be called before any scripts are loaded.
+func (engine *RuleEngine) SetInstanceID(id string) error {
+	if id != "" && !namespaceRx.MatchString(id) {
+		return fmt.Errorf("invalid instance id: %q", id)
+	}
+	engine.model.RemoveLocalDevice(engine.settingsDevName())
+	engine.instanceID = id
+	engine.setupRuleEngineSettingsDevice()
+	return nil
+}
+
+func (engine *RuleEngine) InstanceID() string {
+	return engine.instanceID
+}
+
+func (engine *RuleEngine) settingsDevName() string {
+	return InstanceName(RULE_ENGINE_SETTINGS_DEV_NAME, engine.instanceID)
+}
+
+func (engine *RuleEngine) featuresDevName() string {
+	return InstanceName(FEATURES_DEV_NAME, engine.instanceID)
+}
+
+// topic returns the engine's own MQTT topic
+func (engine *RuleEngine) topic(subtopic string) string {
+	return "/" + InstanceName(RULE_ENGINE_TOPIC_ROOT, engine.instanceID) + "/" + subtopic
+}
+
 func (engine *RuleEngine) setupRuleEngineSettingsDevice() {
-	err := engine.DefineVirtualDevice(RULE_ENGINE_SETTINGS_DEV_NAME, objx.Map{
+	err := engine.DefineVirtualDevice(engine.settingsDevName(), objx.Map{
 		"title": "Rule Engine Settings",
 		"cells": objx.Map{
 			RULE_DEBUG_CELL_NAME: objx.Map{
@@ -215,6 +438,17 @@ func (engine *RuleEngine) setupRuleEngineSettingsDevice() {
 	}
 }
 
+// SetClock sets the clock used by the engine and its cell model
+// for the timers, cron rules and the time checks. It must be
+// called before any scripts are loaded.
+func (engine *RuleEngine) SetClock(clock Clock) {
+	engine.clock = clock
+	engine.timerFunc = clockTimerFunc(clock)
+	engine.cronMaker = clock.NewCron
+	engine.model.SetClock(clock)
+}
+
+// SetTimerFunc overrides the timer function of the clock
 func (engine *RuleEngine) SetTimerFunc(timerFunc TimerFunc) {
 	engine.timerFunc = timerFunc
 }
@@ -223,9 +457,18 @@ func (engine *RuleEngine) SetCronMaker(cronMaker func() Cron) {
 	engine.cronMaker = cronMaker
 }
 
+// StartTrackingDeps starts recording cells and timers accessed
+// by rule conditions. The maps used for tracking are reused
+// between calls to avoid allocations in rule dispatch path.
 func (engine *RuleEngine) StartTrackingDeps() {
-	engine.notedCells = make(map[*Cell]bool)
-	engine.notedTimers = make(map[string]bool)
+	for cell := range engine.notedCells {
+		delete(engine.notedCells, cell)
+	}
+	for timerName := range engine.notedTimers {
+		delete(engine.notedTimers, timerName)
+	}
+	engine.notedClock = false
+	engine.trackingDeps = true
 }
 
 func (engine *RuleEngine) StoreRuleCellSpec(rule *Rule, cellSpec *CellSpec) {
@@ -245,13 +488,54 @@ func (engine *RuleEngine) storeRuleCell(rule *Rule, cell *Cell) {
 	}
 	wbgo.Debug.Printf("adding cell %s for rule %s", cell.Name(), rule.name)
 	engine.cellToRuleMap[cell] = append(list, rule)
+	engine.ruleCells[rule] = append(engine.ruleCells[rule], cell)
 	engine.rulesWithoutCells[rule] = false
 }
 
+// removeRuleDeps removes all of the cell and timer associations
+// of the rule, e.g. when the rule is redefined or removed,
+// so that dependencies of the old rule versions don't
+// accumulate when scripts are edited
+func (engine *RuleEngine) removeRuleDeps(rule *Rule) {
+	for _, cell := range engine.ruleCells[rule] {
+		list := removeRuleFromList(engine.cellToRuleMap[cell], rule)
+		if len(list) == 0 {
+			delete(engine.cellToRuleMap, cell)
+		} else {
+			engine.cellToRuleMap[cell] = list
+		}
+	}
+	delete(engine.ruleCells, rule)
+	delete(engine.rulesWithoutCells, rule)
+	for timerName, list := range engine.timerRules {
+		list = removeRuleFromList(list, rule)
+		if len(list) == 0 {
+			delete(engine.timerRules, timerName)
+		} else {
+			engine.timerRules[timerName] = list
+		}
+	}
+}
+
+func removeRuleFromList(list []*Rule, rule *Rule) []*Rule {
+	for i, item := range list {
+		if item == rule {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
 func (engine *RuleEngine) storeRuleTimer(rule *Rule, timerName string) {
 	list, found := engine.timerRules[timerName]
 	if !found {
 		list = make([]*Rule, 0, CELL_RULES_CAPACITY)
+	} else {
+		for _, item := range list {
+			if item == rule {
+				return
+			}
+		}
 	}
 	engine.timerRules[timerName] = append(list, rule)
 }
@@ -265,7 +549,7 @@ func (engine *RuleEngine) StoreRuleDeps(rule *Rule) {
 		for timerName, _ := range engine.notedTimers {
 			engine.storeRuleTimer(rule, timerName)
 		}
-	} else if !rule.IsNonCellRule() {
+	} else if !rule.IsNonCellRule() && !engine.notedClock {
 		if _, found := engine.rulesWithoutCells[rule]; !found {
 			// Rules without cells in their conditions negatively affect
 			// the engine performance because they must be checked
@@ -281,18 +565,17 @@ func (engine *RuleEngine) StoreRuleDeps(rule *Rule) {
 			engine.rulesWithoutCells[rule] = true
 		}
 	}
-	engine.notedCells = nil
-	engine.notedTimers = nil
+	engine.trackingDeps = false
 }
 
 func (engine *RuleEngine) trackCell(cell *Cell) {
-	if engine.notedCells != nil {
+	if engine.trackingDeps {
 		engine.notedCells[cell] = true
 	}
 }
 
 func (engine *RuleEngine) trackTimer(timerName string) {
-	if engine.notedTimers != nil {
+	if engine.trackingDeps {
 		engine.notedTimers[timerName] = true
 	}
 }
@@ -308,11 +591,13 @@ func (engine *RuleEngine) fireTimer(n uint64) {
 		wbgo.Error.Printf("firing unknown timer %d", n)
 		return
 	}
-	if entry.name == NO_TIMER_NAME {
-		entry.thunk()
-	} else {
-		engine.RunRules(nil, entry.name)
-	}
+	engine.withProfile(entry.profile, "timer", func() {
+		if entry.name == NO_TIMER_NAME {
+			engine.withCurrentScript(entry.script, entry.thunk)
+		} else {
+			engine.runRules(nil, entry.name)
+		}
+	})
 
 	if !entry.periodic {
 		engine.removeTimer(n)
@@ -323,14 +608,67 @@ func (engine *RuleEngine) removeTimer(n uint64) {
 	delete(engine.timers, n)
 }
 
-func (engine *RuleEngine) StopTimerByName(name string) {
+func (engine *RuleEngine) findTimerByName(name string) (uint64, *TimerEntry) {
 	for n, entry := range engine.timers {
 		if entry != nil && name == entry.name {
-			engine.removeTimer(n)
-			entry.stop()
-			break
+			return n, entry
 		}
 	}
+	return 0, nil
+}
+
+func (engine *RuleEngine) StopTimerByName(name string) {
+	if n, entry := engine.findTimerByName(name); entry != nil {
+		engine.removeTimer(n)
+		entry.stop()
+	}
+}
+
+// RestartTimer restarts the named timer with its original
+// interval, so it begins counting anew. It returns false
+// if there's no such active timer.
+func (engine *RuleEngine) RestartTimer(name string) bool {
+	n, entry := engine.findTimerByName(name)
+	if entry == nil {
+		return false
+	}
+	engine.removeTimer(n)
+	entry.stop()
+	n = engine.StartTimer(name, nil, entry.interval, entry.periodic)
+	// the timer keeps the profile of the script that started it
+	engine.timers[n].profile = entry.profile
+	return true
+}
+
+// TimerState returns true if the named timer is active along
+// with the time remaining till it fires. For periodic timers
+// the time till the next tick is returned.
+func (engine *RuleEngine) TimerState(name string) (running bool, remaining time.Duration) {
+	_, entry := engine.findTimerByName(name)
+	if entry == nil {
+		return false, 0
+	}
+	entry.Lock()
+	defer entry.Unlock()
+	if entry.started.IsZero() {
+		return true, entry.interval
+	}
+	elapsed := engine.clock.Now().Sub(entry.started)
+	if entry.periodic && entry.interval > 0 {
+		elapsed %= entry.interval
+	}
+	if remaining = entry.interval - elapsed; remaining < 0 {
+		remaining = 0
+	}
+	return true, remaining
+}
+
+// stopTimerIfActive stops the specified timer unless it
+// already fired or was stopped
+func (engine *RuleEngine) stopTimerIfActive(n uint64) {
+	if _, found := engine.timers[n]; found {
+		engine.StopTimerByIndex(n)
+	}
 }
 
 func (engine *RuleEngine) StopTimerByIndex(n uint64) {
@@ -345,10 +683,65 @@ func (engine *RuleEngine) StopTimerByIndex(n uint64) {
 	}
 }
 
+// handleCellChange performs the engine's own actions
+// for the cell change before the rules are checked
+func (engine *RuleEngine) handleCellChange(cell *Cell) {
+	if len(engine.adapterCells) > 0 {
+		engine.maybeSendAdapterCommand(cell)
+	}
+	if len(engine.persistentCells) > 0 {
+		engine.maybePersistCell(cell)
+	}
+	if len(engine.logLevelCells) > 0 {
+		engine.maybeSetScriptLogLevel(cell)
+	}
+}
+
+// endRulePass must be deferred by the functions that start
+// a rule pass incrementing runDepth. When the outermost pass
+// completes, the deferred and coalesced writes are applied.
+func (engine *RuleEngine) endRulePass() {
+	engine.runDepth--
+	if engine.runDepth != 0 {
+		return
+	}
+	if len(engine.pendingWrites) > 0 {
+		engine.applyPendingWrites()
+	}
+	if engine.writeBatch != nil {
+		engine.writeBatch.flush()
+	}
+	if len(engine.writeClaims) > 0 {
+		engine.clearWriteClaims()
+	}
+	engine.currentCascade = nil
+	if len(engine.destroyedRules) > 0 {
+		engine.removeDestroyedRules()
+	}
+}
+
+// RunRules runs the rules on the event loop after the change of the
+// specified cell or the firing of the specified timer. If cellSpec
+// is nil and timerName is empty, all the rules are checked.
 func (engine *RuleEngine) RunRules(cellSpec *CellSpec, timerName string) {
+	engine.Call(func() {
+		engine.runRules(cellSpec, timerName)
+	})
+}
+
+func (engine *RuleEngine) runRules(cellSpec *CellSpec, timerName string) {
+	// runRules may be invoked recursively via runRules() JS function,
+	// the writes are flushed when the outermost pass completes
+	engine.runDepth++
+	defer engine.endRulePass()
+
 	var cell *Cell
 	if cellSpec != nil {
 		cell = engine.model.EnsureCell(cellSpec)
+		if engine.runDepth == 1 {
+			engine.beginCascade(cell)
+		}
+		engine.handleCellChange(cell)
 		if cell.IsFreshButton() {
 			// special case - a button that wasn't pressed yet
 			return
@@ -378,10 +771,30 @@ func (engine *RuleEngine) RunRules(cellSpec *CellSpec, timerName string) {
 		}
 	}
 
+	savedProfile := engine.currentProfile
 	for _, name := range engine.ruleList {
-		engine.ruleMap[name].Check(cell)
+		rule := engine.ruleMap[name]
+		if rule.destroyed {
+			continue
+		}
+		if rule.profile == nil {
+			engine.currentProfile = nil
+			engine.withCurrentRule(name, func() {
+				rule.Check(cell)
+			})
+		} else {
+			engine.withProfile(rule.profile, "rule "+name, func() {
+				engine.withCurrentRule(name, func() {
+					rule.Check(cell)
+				})
+			})
+		}
 	}
+	engine.currentProfile = savedProfile
 	engine.currentTimer = NO_TIMER_NAME
+	if engine.runDepth == 1 && engine.startupDone && !engine.readyWaitOver {
+		engine.maybeEndReadyWait()
+	}
 }
 
 func (engine *RuleEngine) setupCron() {
@@ -389,22 +802,106 @@ func (engine *RuleEngine) setupCron() {
 		engine.cron.Stop()
 	}
 
-	engine.cron = newCronProxy(engine.cronMaker(), engine.model.CallSync)
+	engine.cron = newCronProxy(engine.cronMaker(), engine.Call)
 	// note for rule reloading: will need to restart cron
 	// to reload rules properly
 	for _, name := range engine.ruleList {
-		rule := engine.ruleMap[name]
-		rule.MaybeAddToCron(engine.cron)
+		rule, ruleName := engine.ruleMap[name], name
+		ruleCron := newCronProxy(engine.cron, func(thunk func()) {
+			engine.withCurrentRule(ruleName, thunk)
+		})
+		if rule.profile == nil {
+			rule.MaybeAddToCron(ruleCron)
+			continue
+		}
+		profile, what := rule.profile, "rule "+name
+		rule.MaybeAddToCron(newCronProxy(ruleCron, func(thunk func()) {
+			engine.withProfile(profile, what, thunk)
+		}))
 	}
 	engine.cron.Start()
+	// whenTopic rules are indexed along with cron rules
+	engine.setupTopicRules()
+}
+
+// goBackground runs f in a goroutine that is waited for by Stop().
+// Returns false without running f if the engine is stopped.
+func (engine *RuleEngine) goBackground(f func()) bool {
+	engine.statusMtx.Lock()
+	defer engine.statusMtx.Unlock()
+	if engine.lifetime.Err() != nil {
+		return false
+	}
+	engine.background.Add(1)
+	go func() {
+		defer engine.background.Done()
+		f()
+	}()
+	return true
+}
+
+// Stop stops the engine. It stops cron, cancels the engine's
+// lifetime context terminating the timer goroutines and killing
+// the spawned processes, releases the cell change channel and
+// waits for the goroutines started on behalf of the engine,
+// including the ones that are running the callbacks of timers,
+// spawned processes and HTTP requests, to finish, and then stops
+// the event loop (see eventloop.go). After Stop()
+// returns nil, no callbacks are invoked by the engine anymore,
+// so its script context may be destroyed. If ctx is done before
+// the goroutines finish, ctx.Err() is returned. Stop() must not
+// be called from the model goroutine, because the goroutines
+// may be waiting in Call().
+func (engine *RuleEngine) Stop(ctx context.Context) error {
+	if engine.model.IsStarted() {
+		engine.Call(func() {
+			if engine.cron != nil {
+				engine.cron.Stop()
+				engine.cron = nil
+			}
+		})
+	}
+	engine.statusMtx.Lock()
+	engine.stopLifetime()
+	cellChange := engine.cellChange
+	engine.statusMtx.Unlock()
+	if cellChange != nil {
+		// the main loop notices that the channel is
+		// closed and finishes via handleStop()
+		engine.model.ReleaseCellChangeChannel(cellChange)
+	}
+	done := make(chan struct{})
+	go func() {
+		engine.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		// nothing is waiting for the loop anymore
+		engine.stopLoop()
+		wbgo.Debug.Printf("engine stopped gracefully")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (engine *RuleEngine) handleStop() {
 	wbgo.Debug.Printf("engine stopped")
-	for _, entry := range engine.timers {
-		entry.stop()
-	}
-	engine.timers = make(map[uint64]*TimerEntry)
+	// Cancelling the lifetime context terminates timer goroutines.
+	// Not waiting for them here because they may be blocked
+	// in CallSync() of the model that's already stopped.
+	engine.statusMtx.Lock()
+	engine.stopLifetime()
+	engine.statusMtx.Unlock()
+	// the timers and the rules are only touched by the loop
+	engine.Call(func() {
+		for _, entry := range engine.timers {
+			entry.deactivate()
+		}
+		engine.timers = make(map[uint64]*TimerEntry)
+		engine.resetReadyWait()
+	})
 	engine.model.ReleaseCellChangeChannel(engine.cellChange)
 	engine.statusMtx.Lock()
 	engine.cellChange = nil
@@ -413,15 +910,15 @@ func (engine *RuleEngine) handleStop() {
 }
 
 func (engine *RuleEngine) isDebugCell(cellSpec *CellSpec) bool {
-	return cellSpec.DevName == RULE_ENGINE_SETTINGS_DEV_NAME &&
+	return cellSpec.DevName == engine.settingsDevName() &&
 		cellSpec.CellName == RULE_DEBUG_CELL_NAME
 }
 
 func (engine *RuleEngine) updateDebugEnabled() {
-	engine.model.CallSync(func() {
+	engine.Call(func() {
 		debugCell := engine.model.MustGetCell(
 			&CellSpec{
-				RULE_ENGINE_SETTINGS_DEV_NAME,
+				engine.settingsDevName(),
 				RULE_DEBUG_CELL_NAME,
 			})
 		engine.debugMtx.Lock()
@@ -434,15 +931,20 @@ func (engine *RuleEngine) Start() {
 	if engine.cellChange != nil {
 		return
 	}
+	engine.startLoop()
 	engine.readyCh = make(chan struct{})
 	engine.statusMtx.Lock()
+	if engine.lifetime.Err() != nil {
+		// the engine is being restarted after being stopped
+		engine.lifetime, engine.stopLifetime = context.WithCancel(context.Background())
+	}
 	engine.cellChange = engine.model.AcquireCellChangeChannel()
 	engine.statusMtx.Unlock()
 	ready := make(chan struct{})
 	engine.model.WhenReady(func() {
 		close(ready)
 	})
-	go func() {
+	engine.goBackground(func() {
 		// cell changes are ignored until the engine is ready
 		// FIXME: some very small probability of race condition is
 		// present here
@@ -464,43 +966,103 @@ func (engine *RuleEngine) Start() {
 				}
 			}
 		}
+		if !engine.ingestRetainedValues() {
+			return
+		}
 		wbgo.Debug.Printf("setting up cron")
-		engine.model.CallSync(engine.setupCron)
+		engine.Call(engine.setupCron)
 		wbgo.Debug.Printf("doing the first rule run")
-		engine.model.CallSync(func() {
-			engine.RunRules(nil, NO_TIMER_NAME)
+		engine.Call(func() {
+			engine.runStartupHooks()
+			engine.beginStartupWindow()
+			engine.runRules(nil, NO_TIMER_NAME)
 		})
 		close(engine.readyCh)
 		wbgo.Debug.Printf("the engine is ready")
 		// wbgo.Info.Printf("******** READY ********")
+		restartDelay := CELL_CHANGE_RESTART_DELAY
+		var batch []*CellSpec
 		for {
 			select {
 			case cellSpec, ok := <-engine.cellChange:
 				if ok {
-					if wbgo.DebuggingEnabled() {
-						wbgo.Debug.Printf("cell change: %v", cellSpec)
-						if cellSpec != nil {
-							wbgo.Debug.Printf(
-								"rule engine: running rules after cell change: %s/%s",
-								cellSpec.DevName, cellSpec.CellName)
-						} else {
-							wbgo.Debug.Printf(
-								"rule engine: running rules")
-						}
+					restartDelay = CELL_CHANGE_RESTART_DELAY
+					batch = append(batch[:0], cellSpec)
+					if engine.maxCellChangeBatch > 1 {
+						batch = engine.drainCellChanges(batch)
 					}
-					if cellSpec == nil || engine.isDebugCell(cellSpec) {
-						engine.updateDebugEnabled()
+					for _, cellSpec := range batch {
+						if wbgo.DebuggingEnabled() {
+							wbgo.Debug.Printf("cell change: %v", cellSpec)
+							if cellSpec != nil {
+								wbgo.Debug.Printf(
+									"rule engine: running rules after cell change: %s/%s",
+									cellSpec.DevName, cellSpec.CellName)
+							} else {
+								wbgo.Debug.Printf(
+									"rule engine: running rules")
+							}
+						}
+						if cellSpec == nil || engine.isDebugCell(cellSpec) {
+							engine.updateDebugEnabled()
+						} else if engine.onSettingsChange != nil && cellSpec.DevName == engine.settingsDevName() {
+							engine.onSettingsChange(cellSpec.CellName)
+						}
 					}
-					engine.model.CallSync(func() {
-						engine.RunRules(cellSpec, NO_TIMER_NAME)
+					engine.Call(func() {
+						engine.runRulesForBatch(batch)
 					})
+				} else if engine.model.IsStarted() && engine.Lifetime().Err() == nil &&
+					engine.reacquireCellChangeChannel(restartDelay) {
+					restartDelay *= 2
+					if restartDelay > CELL_CHANGE_RESTART_MAX_DELAY {
+						restartDelay = CELL_CHANGE_RESTART_MAX_DELAY
+					}
 				} else {
 					engine.handleStop()
 					return
 				}
 			}
 		}
-	}()
+	})
+}
+
+// reacquireCellChangeChannel replaces the cell change channel
+// that was closed while the model is still active, so that
+// rule evaluation isn't stopped permanently. Returns false if
+// the engine must stop instead.
+func (engine *RuleEngine) reacquireCellChangeChannel(delay time.Duration) bool {
+	engine.Logf(ENGINE_LOG_WARNING,
+		"cell change channel closed unexpectedly, resuming in %s", delay)
+	timer := time.NewTimer(delay)
+	select {
+	case <-timer.C:
+	case <-engine.Lifetime().Done():
+		timer.Stop()
+		return false
+	}
+	resumed := false
+	// the model's channel list is only touched on the
+	// model goroutine
+	engine.Call(func() {
+		if !engine.model.IsStarted() {
+			return
+		}
+		// the closed channel must be removed from the model
+		// so the model doesn't try to send to it
+		engine.model.ReleaseCellChangeChannel(engine.cellChange)
+		cellChange := engine.model.AcquireCellChangeChannel()
+		engine.statusMtx.Lock()
+		engine.cellChange = cellChange
+		engine.statusMtx.Unlock()
+		engine.cellChangeRestarts++
+		engine.Logf(ENGINE_LOG_INFO, "cell change processing resumed (restart #%d)",
+			engine.cellChangeRestarts)
+		// some cell changes may have been missed
+		engine.runRules(nil, NO_TIMER_NAME)
+		resumed = true
+	})
+	return resumed
 }
 
 func (engine *RuleEngine) IsActive() bool {
@@ -510,44 +1072,70 @@ func (engine *RuleEngine) IsActive() bool {
 }
 
 func (engine *RuleEngine) StartTimer(name string, callback func(), interval time.Duration, periodic bool) uint64 {
+	return engine.startTimer(name, callback, interval, periodic, false)
+}
+
+// StartTimerWhenReady starts a timer that doesn't begin counting
+// until the engine is ready, see WhenReady()
+func (engine *RuleEngine) StartTimerWhenReady(name string, callback func(), interval time.Duration, periodic bool) uint64 {
+	return engine.startTimer(name, callback, interval, periodic, true)
+}
+
+func (engine *RuleEngine) startTimer(name string, callback func(), interval time.Duration, periodic, waitReady bool) uint64 {
 	entry := &TimerEntry{
 		periodic: periodic,
 		quit:     nil,
 		quitted:  nil,
 		name:     name,
 		active:   true,
+		interval: interval,
 	}
 
 	n := engine.nextTimerId
 	engine.nextTimerId += 1
 	engine.timers[n] = entry
 
+	entry.profile = engine.currentProfile
+	_, entry.script = engine.logContext()
 	if name == NO_TIMER_NAME {
 		entry.thunk = callback
 	} else if callback != nil {
 		wbgo.Warn.Printf("warning: ignoring callback func for a named timer")
 	}
 
-	engine.model.WhenReady(func() {
+	// Timers started while a script is being loaded are stopped
+	// when the script is reloaded or removed
+	engine.cleanup.AddCleanup(func() {
+		engine.stopTimerIfActive(n)
+	})
+
+	lifetime := engine.Lifetime()
+	start := func() {
 		entry.Lock()
 		defer entry.Unlock()
-		if !entry.active {
+		if !entry.active || lifetime.Err() != nil {
 			// stopped before the engine is ready
 			return
 		}
 		entry.quit = make(chan struct{}, 2) // FIXME: is 2 necessary here?
 		entry.quitted = make(chan struct{})
+		entry.started = engine.clock.Now()
 		entry.timer = engine.timerFunc(n, interval, periodic)
 		tickCh := entry.timer.GetChannel()
-		go func() {
+		started := engine.goBackground(func() {
+			defer close(entry.quitted)
 			for {
 				select {
 				case <-tickCh:
-					engine.model.CallSync(func() {
+					if lifetime.Err() != nil {
+						entry.timer.Stop()
+						return
+					}
+					engine.Call(func() {
 						entry.Lock()
 						wasActive := entry.active
 						entry.Unlock()
-						if wasActive {
+						if wasActive && lifetime.Err() == nil {
 							engine.fireTimer(n)
 						}
 					})
@@ -556,15 +1144,43 @@ func (engine *RuleEngine) StartTimer(name string, callback func(), interval time
 					}
 				case <-entry.quit:
 					entry.timer.Stop()
-					close(entry.quitted)
+					return
+				case <-lifetime.Done():
+					entry.timer.Stop()
 					return
 				}
 			}
-		}()
-	})
+		})
+		if !started {
+			entry.timer.Stop()
+			close(entry.quitted)
+		}
+	}
+	if waitReady {
+		engine.WhenReady(start)
+	} else {
+		engine.model.WhenReady(start)
+	}
 	return n
 }
 
+func (engine *RuleEngine) delay(d time.Duration, thunk func()) func() {
+	n := engine.StartTimer(NO_TIMER_NAME, thunk, d, false)
+	return func() {
+		engine.StopTimerByIndex(n)
+	}
+}
+
+// SetGlitchFilter sets up the glitch filter for the binary
+// cell, see CellModel.SetGlitchFilter(). The filter is
+// removed when the script that set it is reloaded.
+func (engine *RuleEngine) SetGlitchFilter(cellSpec *CellSpec, d time.Duration) {
+	engine.model.SetGlitchFilter(cellSpec, d)
+	engine.cleanup.AddCleanup(func() {
+		engine.model.SetGlitchFilter(cellSpec, 0)
+	})
+}
+
 func (engine *RuleEngine) Publish(topic, payload string, qos byte, retain bool) {
 	engine.mqttClient.Start()
 	engine.mqttClient.Publish(wbgo.MQTTMessage{
@@ -581,9 +1197,19 @@ func (engine *RuleEngine) DefineVirtualDevice(name string, obj objx.Map) error {
 		title = obj.Get("title").Str(name)
 	}
 
+	if _, found := engine.model.devices[name]; found {
+		err := engine.checkPermission("redefining device "+name, func(profile *ExecProfile) bool {
+			return profile.devices[name]
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	// if the device was for some reason defined in another script,
 	// we must remove it
 	engine.model.RemoveLocalDevice(name)
+	engine.registerProfileDevice(name)
 
 	dev := engine.model.EnsureLocalDevice(name, title)
 	engine.cleanup.AddCleanup(func() {
@@ -594,6 +1220,7 @@ func (engine *RuleEngine) DefineVirtualDevice(name string, obj objx.Map) error {
 	if !obj.Has("cells") {
 		return nil
 	}
+	persistent := obj.Get("persistent").Bool(false)
 
 	v := obj.Get("cells")
 	var m objx.Map
@@ -628,71 +1255,544 @@ func (engine *RuleEngine) DefineVirtualDevice(name string, obj objx.Map) error {
 			}
 			cellDef = objx.Map(cd)
 		}
-		cellType, ok := cellDef["type"]
-		if !ok {
-			return fmt.Errorf("%s/%s: no cell type", name, cellName)
+		if persistent {
+			cellDef = engine.restoredCellDef(name, cellName, cellDef)
 		}
-		// FIXME: too much spaghetti for my taste
-		if cellType == "pushbutton" {
-			dev.SetButtonCell(cellName)
-			continue
+		if err := defineCell(dev, cellName, cellDef); err != nil {
+			return err
 		}
+	}
+	if persistent {
+		engine.persistDeviceCells(dev)
+	}
 
-		cellValue, ok := cellDef["value"]
+	return nil
+}
+
+func defineCell(dev *CellModelLocalDevice, cellName string, cellDef objx.Map) error {
+	name := dev.DevName
+	cellType, ok := cellDef["type"].(string)
+	if !ok {
+		return fmt.Errorf("%s/%s: no cell type", name, cellName)
+	}
+	typeInfo := lookupCellType(cellType)
+	if typeInfo.kind == CELL_TYPE_BUTTON {
+		dev.SetButtonCell(cellName)
+		return nil
+	}
+
+	cellValue, ok := cellDef["value"]
+	if !ok {
+		return fmt.Errorf("%s/%s: cell value required for cell type %s",
+			name, cellName, cellType)
+	}
+
+	cellReadonly := false
+	cellReadonlyRaw, hasReadonly := cellDef["readonly"]
+
+	if hasReadonly {
+		cellReadonly, ok = cellReadonlyRaw.(bool)
 		if !ok {
-			return fmt.Errorf("%s/%s: cell value required for cell type %s",
-				name, cellName, cellType)
+			return fmt.Errorf("%s/%s: non-boolean value of readonly property",
+				name, cellName)
 		}
+	}
 
-		cellReadonly := false
-		cellReadonlyRaw, hasReadonly := cellDef["readonly"]
+	cellMeta, err := cellMetaFromDef(cellDef)
+	if err != nil {
+		return fmt.Errorf("%s/%s: %s", name, cellName, err)
+	}
 
-		if hasReadonly {
-			cellReadonly, ok = cellReadonlyRaw.(bool)
-			if !ok {
-				return fmt.Errorf("%s/%s: non-boolean value of readonly property",
-					name, cellName)
-			}
+	max := -1.0
+	if typeInfo.hasMax {
+		if max, err = cellMaxFromDef(cellDef); err != nil {
+			return fmt.Errorf("%s/%s: %s", name, cellName, err)
 		}
+	}
+	if cellValue, err = validateCellValue(cellType, max, cellValue); err != nil {
+		return fmt.Errorf("%s/%s: %s", name, cellName, err)
+	}
+	dev.setCell(cellName, cellType, cellValue, true, max, cellReadonly)
+	if len(cellMeta) > 0 {
+		dev.SetCellMeta(cellName, cellMeta)
+	}
+	return nil
+}
 
-		if cellType == "range" {
-			fmax := DEFAULT_CELL_MAX
-			max, ok := cellDef["max"]
-			if ok {
-				fmax, ok = max.(float64)
-				if !ok {
-					return fmt.Errorf("%s/%s: non-numeric value of max property",
-						name, cellName)
-				}
-			}
-			// FIXME: can be float
-			dev.SetRangeCell(cellName, cellValue, fmax, cellReadonly)
-		} else {
-			dev.SetCell(cellName, cellType.(string), cellValue, cellReadonly)
-		}
+// localDevice returns the virtual device defined by
+// DefineVirtualDevice() checking the permission to modify it
+func (engine *RuleEngine) localDevice(name string) (*CellModelLocalDevice, error) {
+	dev, ok := engine.model.devices[name].(*CellModelLocalDevice)
+	if !ok {
+		return nil, fmt.Errorf("no such virtual device: %s", name)
+	}
+	err := engine.checkPermission("modifying device "+name, func(profile *ExecProfile) bool {
+		return profile.devices[name]
+	})
+	if err != nil {
+		return nil, err
 	}
+	return dev, nil
+}
 
+// AddControl adds a cell to the virtual device after the device
+// is defined. The cell definition has the same format as ones
+// passed to DefineVirtualDevice(). The cell is removed when
+// the device is redefined.
+func (engine *RuleEngine) AddControl(devName, cellName string, cellDef objx.Map) error {
+	dev, err := engine.localDevice(devName)
+	if err != nil {
+		return err
+	}
+	if _, found := dev.LookupCell(cellName); found {
+		return fmt.Errorf("%s/%s: control already exists", devName, cellName)
+	}
+	return defineCell(dev, cellName, cellDef)
+}
+
+// RemoveControl removes the cell of the virtual device clearing
+// the retained MQTT topics of the cell
+func (engine *RuleEngine) RemoveControl(devName, cellName string) error {
+	dev, err := engine.localDevice(devName)
+	if err != nil {
+		return err
+	}
+	cell := dev.RemoveCell(cellName)
+	if cell == nil {
+		return fmt.Errorf("%s/%s: no such control", devName, cellName)
+	}
+	if !engine.model.IsStarted() {
+		// the cell wasn't published yet
+		return nil
+	}
+	prefix := "/devices/" + devName + "/controls/" + cellName
+	if !cell.readonly {
+		engine.mqttClient.Unsubscribe(prefix + "/on")
+	}
+	engine.Publish(prefix, "", 1, true)
+	metaKeys := []string{"type", "order"}
+	if cell.readonly {
+		metaKeys = append(metaKeys, "readonly")
+	}
+	if lookupCellType(cell.controlType).hasMax {
+		metaKeys = append(metaKeys, "max")
+	}
+	for key := range cell.meta {
+		metaKeys = append(metaKeys, key)
+	}
+	sort.Strings(metaKeys)
+	for n, key := range metaKeys {
+		// extra metadata may duplicate the standard keys
+		if n == 0 || key != metaKeys[n-1] {
+			engine.Publish(prefix+"/meta/"+key, "", 1, true)
+		}
+	}
 	return nil
 }
 
+// cellMetaFromDef returns the extra metadata of a virtual
+// device cell that's published as meta topics
+func cellMetaFromDef(cellDef objx.Map) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, key := range []string{"units", "error"} {
+		if v, found := cellDef[key]; found {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string value of %s property", key)
+			}
+			meta[key] = s
+		}
+	}
+	for _, key := range []string{"order", "min", "precision"} {
+		v, found := cellDef[key]
+		if !found {
+			continue
+		}
+		f, ok := v.(float64)
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("non-numeric value of %s property", key)
+		case key == "order" && (f < 1 || f != math.Trunc(f)):
+			return nil, fmt.Errorf("order must be a positive integer")
+		case key == "precision" && f <= 0:
+			return nil, fmt.Errorf("precision must be positive")
+		}
+		meta[key] = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return meta, nil
+}
+
 func (engine *RuleEngine) DefineRule(rule *Rule) {
 	if oldRule, found := engine.ruleMap[rule.name]; found {
 		oldRule.Destroy()
+		rule.fireCount = oldRule.fireCount
+		rule.timings = oldRule.timings
+		// redefined rule keeps its place in the definition order
+		rule.seq = oldRule.seq
+		// the new rule's initially known deps are
+		// already stored at this point
+		engine.removeRuleDeps(oldRule)
+		if oldRule.priority != rule.priority {
+			engine.removeFromRuleList(rule.name)
+			engine.insertIntoRuleList(rule)
+		}
 	} else {
-		engine.ruleList = append(engine.ruleList, rule.name)
+		engine.ruleSeq++
+		rule.seq = engine.ruleSeq
+		engine.insertIntoRuleList(rule)
 	}
 	engine.ruleMap[rule.name] = rule
+	engine.clearRuleError(rule.name)
+	rule.profile = engine.currentProfile
+	rule.disabled = engine.disabledRules[rule.name]
+	rule.script = engine.cleanup.CurrentScope()
+	rule.onFire = engine.recordRuleFiring
+	rule.onFired = engine.finishRuleFiring
+	rule.onChecked = engine.recordCondTiming
+	if rule.timings == nil {
+		rule.timings = &ruleTimings{}
+	}
+	rule.delay = func(d time.Duration, thunk func()) func() {
+		return engine.delay(d, func() {
+			engine.withCurrentRule(rule.name, thunk)
+		})
+	}
+	rule.setStartupWindow(engine.inStartupWindow)
+	rule.setWaitingReady(!engine.readyWaitOver)
+	rule.setReplay(engine.suppressStartupEdges && !engine.readyWaitOver)
 	engine.cleanup.AddCleanup(func() {
+		rule.cancelPending()
+		engine.removeRuleDeps(rule)
+		if curRule, found := engine.ruleMap[rule.name]; found && curRule != rule {
+			engine.removeRuleDeps(curRule)
+		}
 		delete(engine.ruleMap, rule.name)
-		for i, name := range engine.ruleList {
-			if name == rule.name {
-				engine.ruleList = append(
-					engine.ruleList[0:i],
-					engine.ruleList[i+1:]...)
-				break
+		engine.removeFromRuleList(rule.name)
+		engine.clearRuleError(rule.name)
+	})
+}
+
+// LastRuleResult returns the value returned by the then callback
+// of the specified rule when it fired last time. The second
+// return value is false if there's no such rule.
+func (engine *RuleEngine) LastRuleResult(name string) (CallbackResult, bool) {
+	rule, found := engine.ruleMap[name]
+	if !found {
+		return CallbackResult{}, false
+	}
+	return rule.LastResult(), true
+}
+
+// RuleFireCount returns the number of times the specified
+// rule fired, including the firings of its previous
+// definitions. The second return value is false
+// if there's no such rule.
+func (engine *RuleEngine) RuleFireCount(name string) (uint64, bool) {
+	rule, found := engine.ruleMap[name]
+	if !found {
+		return 0, false
+	}
+	return rule.fireCount, true
+}
+
+// RuleCronSpec returns the cron spec of the specified rule
+// or an empty string if the rule isn't time-based.
+// The second return value is false if there's no such rule.
+func (engine *RuleEngine) RuleCronSpec(name string) (spec string, found bool) {
+	engine.Call(func() {
+		var rule *Rule
+		if rule, found = engine.ruleMap[name]; found {
+			if cond, ok := rule.cond.(*CronRuleCondition); ok {
+				spec = cond.spec
 			}
 		}
 	})
+	return
+}
+
+// SetPersistentStorage sets the storage used to keep
+// the values that must survive engine restarts
+func (engine *RuleEngine) SetPersistentStorage(storage Storage) {
+	engine.storage = storage
+}
+
+func (engine *RuleEngine) PersistentStorage() Storage {
+	return engine.storage
+}
+
+// FlushPersistentStorage writes pending persistent values
+// if the storage is buffered
+func (engine *RuleEngine) FlushPersistentStorage() error {
+	if bs, ok := engine.storage.(*BufferedStorage); ok {
+		return bs.Flush()
+	}
+	return nil
+}
+
+// PersistentStorageStats returns write metrics of the persistent
+// storage. The second return value is false if the storage
+// isn't buffered and thus no metrics are collected.
+func (engine *RuleEngine) PersistentStorageStats() (StorageStats, bool) {
+	if bs, ok := engine.storage.(*BufferedStorage); ok {
+		return bs.Stats(), true
+	}
+	return StorageStats{}, false
+}
+
+// DefineFeature adds a feature flag toggle to the features device.
+// If the feature is already defined, its current state is kept.
+// Returns the name of the features device.
+func (engine *RuleEngine) DefineFeature(name string, enabled bool) string {
+	devName := engine.featuresDevName()
+	dev := engine.model.EnsureLocalDevice(devName, FEATURES_DEV_TITLE)
+	if _, found := dev.cells[name]; !found {
+		dev.SetCell(name, "switch", enabled, false)
+	}
+	return devName
+}
+
+// SetStartupDelay sets the duration of the startup window.
+// During the startup window rule conditions are evaluated
+// but their then callbacks aren't invoked, except for the
+// rules that have ignoreStartupDelay option set. This helps
+// to avoid actuator glitches while retained values
+// are being received after the engine starts.
+// Must be called before the engine is started.
+func (engine *RuleEngine) SetStartupDelay(d time.Duration) {
+	engine.startupDelay = d
+}
+
+func (engine *RuleEngine) setStartupWindow(active bool) {
+	engine.inStartupWindow = active
+	for _, rule := range engine.ruleMap {
+		rule.setStartupWindow(active)
+	}
+}
+
+func (engine *RuleEngine) beginStartupWindow() {
+	if engine.startupDelay <= 0 {
+		engine.completeStartup()
+		return
+	}
+	engine.setStartupWindow(true)
+	engine.StartTimer(NO_TIMER_NAME, engine.endStartupWindow, engine.startupDelay, false)
+}
+
+func (engine *RuleEngine) endStartupWindow() {
+	engine.setStartupWindow(false)
+	wbgo.Debug.Printf("startup window ended")
+	// level-triggered rules and asSoonAs rules that
+	// were triggered during the window may fire now
+	engine.runRules(nil, NO_TIMER_NAME)
+	engine.completeStartup()
+}
+
+// SetStartupIngestion enables startup ingestion mode. In this
+// mode, the engine doesn't run rules for cell changes received
+// after it becomes ready until no changes are received for the
+// quiet period or maxDuration passes. This way the flood of
+// retained values that follows the startup only builds the cell
+// model, and then a single rule run is performed. Zero quiet
+// period disables ingestion mode. Must be called before the
+// engine is started.
+func (engine *RuleEngine) SetStartupIngestion(quiet, maxDuration time.Duration) {
+	engine.ingestQuiet = quiet
+	engine.ingestMaxDuration = maxDuration
+}
+
+// SetStartupGrace sets the grace period that follows startup
+// ingestion (or the engine becoming ready if ingestion mode is
+// disabled). During the grace period, the cell values are still
+// being received, but the rules aren't run, so the devices that
+// publish their state a bit later than the others have a chance
+// to do so before the first rule run. Must be called before the
+// engine is started.
+func (engine *RuleEngine) SetStartupGrace(d time.Duration) {
+	engine.startupGrace = d
+}
+
+// ingestRetainedValues waits till the startup flood of cell
+// changes settles down and the grace period passes. Cell values
+// are updated by the model itself, so the changes are just
+// skipped here. Returns false if the engine was stopped during
+// ingestion.
+func (engine *RuleEngine) ingestRetainedValues() bool {
+	if !engine.waitForQuietPeriod() {
+		return false
+	}
+	if engine.startupGrace <= 0 {
+		return true
+	}
+	wbgo.Debug.Printf("startup grace period: %s", engine.startupGrace)
+	return engine.skipCellChanges(engine.startupGrace)
+}
+
+// skipCellChanges consumes the cell changes received during
+// the specified time without running the rules. Returns false
+// if the engine was stopped meanwhile.
+func (engine *RuleEngine) skipCellChanges(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case cellSpec, ok := <-engine.cellChange:
+			if !ok {
+				wbgo.Debug.Printf("stoping the engine (startup grace period)")
+				engine.handleStop()
+				return false
+			}
+			if cellSpec == nil || engine.isDebugCell(cellSpec) {
+				engine.updateDebugEnabled()
+			}
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// waitForQuietPeriod skips the cell changes till no changes
+// are received for the quiet period of the ingestion mode.
+// Returns false if the engine was stopped meanwhile.
+func (engine *RuleEngine) waitForQuietPeriod() bool {
+	if engine.ingestQuiet <= 0 {
+		return true
+	}
+	maxDuration := engine.ingestMaxDuration
+	if maxDuration <= 0 {
+		maxDuration = DEFAULT_INGEST_MAX_DURATION
+	}
+	deadline := time.NewTimer(maxDuration)
+	defer deadline.Stop()
+	quiet := time.NewTimer(engine.ingestQuiet)
+	defer quiet.Stop()
+	count := 0
+	for {
+		select {
+		case cellSpec, ok := <-engine.cellChange:
+			if !ok {
+				wbgo.Debug.Printf("stoping the engine (ingesting retained values)")
+				engine.handleStop()
+				return false
+			}
+			count++
+			if cellSpec == nil || engine.isDebugCell(cellSpec) {
+				engine.updateDebugEnabled()
+			}
+			if !quiet.Stop() {
+				<-quiet.C
+			}
+			quiet.Reset(engine.ingestQuiet)
+		case <-quiet.C:
+			wbgo.Debug.Printf("startup ingestion complete: %d cell changes", count)
+			return true
+		case <-deadline.C:
+			// the rules will run while the values are still
+			// arriving, -startup-ingest-max may be too small
+			wbgo.Warn.Printf("startup ingestion timed out after %s: %d cell changes, "+
+				"the values are still being received", maxDuration, count)
+			return true
+		}
+	}
+}
+
+// SetWriteCoalescing enables or disables cell write coalescing.
+// When it's enabled, only the final value of a cell that's
+// written several times during a single rule pass is published,
+// so the rules depending on the cell are triggered just once.
+// If logSuppressed is true, suppressed intermediate writes
+// are logged as debug messages.
+func (engine *RuleEngine) SetWriteCoalescing(enabled, logSuppressed bool) {
+	if !enabled {
+		engine.writeBatch = nil
+		return
+	}
+	engine.writeBatch = newWriteBatch()
+	if logSuppressed {
+		engine.writeBatch.onSuppress = func(cell *Cell, value string) {
+			engine.Logf(ENGINE_LOG_DEBUG, "suppressed intermediate write: %s/%s = %s",
+				cell.DevName(), cell.Name(), value)
+		}
+	}
+}
+
+func (engine *RuleEngine) setCellValue(cell *Cell, value interface{}) error {
+	if cell.pseudo {
+		engine.Logf(ENGINE_LOG_ERROR, "can't write pseudo-cell %s/%s", cell.DevName(), cell.Name())
+		return readonlyCellError
+	}
+	if _, isLocal := cell.device.(*CellModelLocalDevice); isLocal || cellType(cell.Type()) == CELL_TYPE_RGB {
+		// the values written to the virtual device cells are
+		// converted to the type of the cell, see cellTypes.
+		// rgb values are converted for any cells because
+		// they're passed by the scripts as {r, g, b} objects.
+		v, err := validateCellValue(cell.Type(), cell.Max(), value)
+		if err != nil {
+			engine.Logf(ENGINE_LOG_ERROR, "can't write %s/%s: %s", cell.DevName(), cell.Name(), err)
+			return err
+		}
+		value = v
+	}
+	if cell.IsButton() {
+		// writing false to a button doesn't press it
+		if pressed, _ := coerceCellValue(CELL_TYPE_BUTTON, value); pressed != true {
+			return nil
+		}
+	}
+	if err := engine.checkCellWritePermission(cell); err != nil {
+		return err
+	}
+	if !engine.arbitrateWrite(cell, value) || !engine.checkCascade(cell) {
+		return nil
+	}
+	cell.writes++
+	if engine.shouldDeferWrite() {
+		engine.pendingWrites = append(engine.pendingWrites,
+			pendingWrite{cell, value, engine.currentWriteSource()})
+		return nil
+	}
+	cell.writeSource = engine.currentWriteSource()
+	if engine.writeBatch != nil && engine.runDepth > 0 {
+		engine.writeBatch.add(cell, value)
+	} else {
+		cell.SetValue(value)
+	}
+	return nil
+}
+
+// WriteCell validates the value and writes it to the cell on
+// behalf of an external system. The change is logged and
+// triggers the rules in the same way as writes made by rules.
+// Unless commit is nil, it's invoked with the validated value
+// before the write, and the cell isn't changed if commit
+// returns an error.
+func (engine *RuleEngine) WriteCell(cellSpec *CellSpec, value interface{}, commit func(value interface{}) error) (result interface{}, err error) {
+	engine.Call(func() {
+		cell := engine.model.LookupCell(cellSpec)
+		switch {
+		case cell == nil || !cell.gotType:
+			err = unknownCellError
+			return
+		case cell.readonly:
+			err = readonlyCellError
+			return
+		}
+		if result, err = validateCellValue(cell.Type(), cell.Max(), value); err != nil {
+			return
+		}
+		if commit != nil {
+			if err = commit(result); err != nil {
+				return
+			}
+		}
+		engine.writeSource = CELL_SOURCE_EXTERNAL
+		err = engine.setCellValue(cell, result)
+		engine.writeSource = ""
+		if err == nil {
+			engine.Logf(ENGINE_LOG_INFO, "external write: %s/%s = %v",
+				cellSpec.DevName, cellSpec.CellName, result)
+		}
+	})
+	return
 }
 
 // Refresh() should be called after engine rules are altered
@@ -701,14 +1801,41 @@ func (engine *RuleEngine) Refresh() {
 	engine.rev++ // invalidate cell proxies
 	engine.setupCron()
 
-	// Some cell pointers are now probably invalid
-	engine.cellToRuleMap = make(map[*Cell][]*Rule)
-	for _, rule := range engine.ruleMap {
-		rule.StoreInitiallyKnownDeps()
+	// The rules and devices of the reloaded or removed script
+	// are already cleaned up. Cell pointers of the devices that
+	// were removed or redefined are now invalid, so the rules
+	// depending on such cells must start tracking their deps
+	// anew, while the deps of other rules are kept.
+	staleRules := make(map[*Rule]bool)
+	for cell, rules := range engine.cellToRuleMap {
+		if engine.model.LookupCell(&CellSpec{cell.DevName(), cell.Name()}) == cell {
+			continue
+		}
+		for _, rule := range rules {
+			staleRules[rule] = true
+		}
+	}
+	for rule := range staleRules {
+		engine.removeRuleDeps(rule)
+		if engine.ruleMap[rule.name] == rule {
+			rule.StoreInitiallyKnownDeps()
+		}
 	}
-	engine.rulesWithoutCells = make(map[*Rule]bool)
-	engine.timerRules = make(map[string][]*Rule)
-	engine.RunRules(nil, NO_TIMER_NAME)
+	engine.runRules(nil, NO_TIMER_NAME)
+}
+
+// GetCellValues returns the values of the specified cells.
+// Unknown and incomplete cells are skipped.
+func (engine *RuleEngine) GetCellValues(cellSpecs []*CellSpec) map[CellSpec]interface{} {
+	values := make(map[CellSpec]interface{}, len(cellSpecs))
+	engine.Call(func() {
+		for _, cellSpec := range cellSpecs {
+			if cell := engine.model.LookupCell(cellSpec); cell != nil && cell.IsComplete() {
+				values[*cellSpec] = cell.Value()
+			}
+		}
+	})
+	return values
 }
 
 func (engine *RuleEngine) CellModel() *CellModel {
@@ -724,27 +1851,39 @@ func (engine *RuleEngine) GetDeviceProxy(name string) *DeviceProxy {
 }
 
 func (engine *RuleEngine) Log(level EngineLogLevel, message string) {
+	engine.log(level, "", message)
+}
+
+// log logs the message prepending the tag to the
+// line written to the system log
+func (engine *RuleEngine) log(level EngineLogLevel, tag, message string) {
 	var topicItem string
 	switch level {
 	case ENGINE_LOG_DEBUG:
-		wbgo.Debug.Printf("[rule debug] %s", message)
-		engine.debugMtx.Lock()
-		defer engine.debugMtx.Unlock()
-		if !engine.debugEnabled {
-			return
-		}
+		wbgo.Debug.Printf("[rule debug] %s%s", tag, message)
 		topicItem = "debug"
 	case ENGINE_LOG_INFO:
-		wbgo.Info.Printf("[rule info] %s", message)
+		wbgo.Info.Printf("[rule info] %s%s", tag, message)
 		topicItem = "info"
 	case ENGINE_LOG_WARNING:
-		wbgo.Warn.Printf("[rule warning] %s", message)
+		wbgo.Warn.Printf("[rule warning] %s%s", tag, message)
 		topicItem = "warning"
 	case ENGINE_LOG_ERROR:
-		wbgo.Error.Printf("[rule error] %s", message)
+		wbgo.Error.Printf("[rule error] %s%s", tag, message)
 		topicItem = "error"
 	}
-	engine.Publish("/wbrules/log/"+topicItem, message, 1, false)
+	var messages []logMessage
+	engine.debugMtx.Lock()
+	if len(engine.debugSessions) > 0 {
+		engine.streamToDebugSessions(topicItem, message)
+	}
+	if level != ENGINE_LOG_DEBUG || engine.debugEnabled {
+		messages = engine.logMessages(topicItem, message)
+	}
+	engine.debugMtx.Unlock()
+	for _, msg := range messages {
+		engine.Publish(msg.topic, msg.payload, 1, false)
+	}
 }
 
 func (engine *RuleEngine) Logf(level EngineLogLevel, format string, v ...interface{}) {
@@ -6,10 +6,12 @@ import (
 	wbgo "github.com/contactless/wbgo"
 	duktape "github.com/ivan4th/go-duktape"
 	"github.com/stretchr/objx"
+	"io/ioutil"
 	"log"
 	"reflect"
 	"regexp"
 	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
 )
@@ -24,6 +26,16 @@ type ESCallback uint64
 type ESCallbackFunc func(args objx.Map) interface{}
 type ESCallbackErrorHandler func(err ESError)
 
+// ESCallGuard is invoked before each call of a Go function
+// from ECMAScript code. If it returns false, the function
+// isn't called and an error is thrown instead.
+type ESCallGuard func() bool
+
+// ESPanicHandler is invoked when a Go function called from
+// ECMAScript code or the conversion of callback arguments or
+// results panics. where identifies the function.
+type ESPanicHandler func(where string, p interface{}, stack []byte)
+
 // ESSyncFunc denotes a function that executes the specified
 // thunk in the context of the goroutine which utilizes the context
 type ESSyncFunc func(thunk func())
@@ -33,6 +45,9 @@ type ESContext struct {
 	callbackIndex        ESCallback
 	syncFunc             ESSyncFunc
 	callbackErrorHandler ESCallbackErrorHandler
+	callGuard            ESCallGuard
+	panicHandler         ESPanicHandler
+	fatalPanics          bool
 }
 
 type ESError struct {
@@ -50,8 +65,12 @@ func newESContext(syncFunc ESSyncFunc) *ESContext {
 		1,
 		syncFunc,
 		nil,
+		nil,
+		nil,
+		false,
 	}
 	ctx.callbackErrorHandler = ctx.DefaultCallbackErrorHandler
+	ctx.panicHandler = ctx.DefaultPanicHandler
 	ctx.initGlobalObject()
 	ctx.initGlobalProperty("_esCallbacks")
 	return ctx
@@ -65,6 +84,35 @@ func (ctx *ESContext) SetCallbackErrorHandler(handler ESCallbackErrorHandler) {
 	ctx.callbackErrorHandler = handler
 }
 
+func (ctx *ESContext) SetCallGuard(guard ESCallGuard) {
+	ctx.callGuard = guard
+}
+
+func (ctx *ESContext) DefaultPanicHandler(where string, p interface{}, stack []byte) {
+	wbgo.Error.Printf("panic in %s: %v\n%s", where, p, stack)
+}
+
+func (ctx *ESContext) SetPanicHandler(handler ESPanicHandler) {
+	ctx.panicHandler = handler
+}
+
+// SetFatalPanics makes the panics in Go functions called from
+// ECMAScript code propagate instead of being turned into
+// ECMAScript errors. This is intended for tests.
+func (ctx *ESContext) SetFatalPanics(fatal bool) {
+	ctx.fatalPanics = fatal
+}
+
+// handlePanic must be called with the value returned by recover().
+// It passes the panic to the panic handler or re-panics if panics
+// are fatal.
+func (ctx *ESContext) handlePanic(where string, p interface{}) {
+	if ctx.fatalPanics {
+		panic(p)
+	}
+	ctx.panicHandler(where, p, debug.Stack())
+}
+
 func (ctx *ESContext) getObject(objIndex int) map[string]interface{} {
 	m := make(map[string]interface{})
 	ctx.Enum(-1, duktape.DUK_ENUM_OWN_PROPERTIES_ONLY)
@@ -136,6 +184,8 @@ func (ctx *ESContext) PushJSObject(obj interface{}) {
 		ctx.PushString(obj.(string))
 	case objx.Map:
 		ctx.PushJSObject(map[string]interface{}(obj.(objx.Map)))
+	case RGBColor:
+		ctx.PushJSObject(obj.(RGBColor).jsObject())
 	case map[string]interface{}:
 		ctx.PushObject()
 		for k, v := range obj.(map[string]interface{}) {
@@ -223,9 +273,24 @@ func (ctx *ESContext) callbackKey(key ESCallback) string {
 }
 
 func (ctx *ESContext) invokeCallback(key ESCallback, args objx.Map) interface{} {
+	return ctx.invokeCallbackByKeyString(ctx.callbackKey(key), args)
+}
+
+func (ctx *ESContext) invokeCallbackByKeyString(keyStr string, args objx.Map) (result interface{}) {
+	top := ctx.GetTop()
+	defer func() {
+		if p := recover(); p != nil {
+			// the value stack may be left in an inconsistent
+			// state by the panic, so it's restored explicitly
+			ctx.SetTop(top)
+			ctx.handlePanic("callback", p)
+			ctx.callbackErrorHandler(ESError{Message: fmt.Sprintf("panic in callback: %v", p)})
+			result = nil
+		}
+	}()
 	ctx.PushGlobalStash()
 	ctx.GetPropString(-1, "_esCallbacks")
-	ctx.PushString(ctx.callbackKey(key))
+	ctx.PushString(keyStr)
 	argCount := 0
 	if args != nil {
 		ctx.PushJSObject(args)
@@ -241,11 +306,60 @@ func (ctx *ESContext) invokeCallback(key ESCallback, args objx.Map) interface{}
 		return ctx.ToString(-1)
 	} else if ctx.IsNumber(-1) {
 		return ctx.ToNumber(-1)
+	} else if ctx.IsObject(-1) && !ctx.IsFunction(-1) {
+		// objects are returned as objx.Map, arrays as []interface{}
+		return ctx.GetJSObject(-1)
 	} else {
 		return nil
 	}
 }
 
+// CallbackResult wraps a value returned by an ES callback
+// providing typed access to it.
+type CallbackResult struct {
+	value interface{}
+}
+
+func NewCallbackResult(value interface{}) CallbackResult {
+	return CallbackResult{value}
+}
+
+// Value returns the raw value as it was converted from JS
+func (r CallbackResult) Value() interface{} {
+	return r.value
+}
+
+// IsNil returns true if the callback returned null or undefined
+// (or didn't return anything)
+func (r CallbackResult) IsNil() bool {
+	return r.value == nil
+}
+
+func (r CallbackResult) Bool() (v bool, ok bool) {
+	v, ok = r.value.(bool)
+	return
+}
+
+func (r CallbackResult) String() (v string, ok bool) {
+	v, ok = r.value.(string)
+	return
+}
+
+func (r CallbackResult) Number() (v float64, ok bool) {
+	v, ok = r.value.(float64)
+	return
+}
+
+func (r CallbackResult) Map() (v objx.Map, ok bool) {
+	v, ok = r.value.(objx.Map)
+	return
+}
+
+func (r CallbackResult) Array() (v []interface{}, ok bool) {
+	v, ok = r.value.([]interface{})
+	return
+}
+
 // storeCallback stores the callback from the specified stack index
 // (which should be >= 0) at 'key' in the callback list specified as propName.
 // If key is specified as nil, a new callback key is generated and returned
@@ -270,6 +384,9 @@ func (ctx *ESContext) storeCallback(callbackStackIndex int) ESCallback {
 type callbackHolder struct {
 	ctx      *ESContext
 	callback ESCallback
+	// keyStr is cached to avoid formatting the key
+	// upon each invocation of the callback
+	keyStr string
 }
 
 func callbackFinalizer(holder *callbackHolder) {
@@ -277,13 +394,15 @@ func callbackFinalizer(holder *callbackHolder) {
 }
 
 func (ctx *ESContext) WrapCallback(callbackStackIndex int) ESCallbackFunc {
+	key := ctx.storeCallback(callbackStackIndex)
 	holder := &callbackHolder{
 		ctx,
-		ctx.storeCallback(callbackStackIndex),
+		key,
+		ctx.callbackKey(key),
 	}
 	runtime.SetFinalizer(holder, callbackFinalizer)
 	return func(args objx.Map) interface{} {
-		return ctx.invokeCallback(holder.callback, args)
+		return ctx.invokeCallbackByKeyString(holder.keyStr, args)
 	}
 }
 
@@ -312,6 +431,25 @@ func (ctx *ESContext) EvalScript(code string) error {
 	return nil
 }
 
+// EVAL_FILENAME is the file name used in the tracebacks
+// of the code evaluated by EvalScriptWithResult()
+const EVAL_FILENAME = "<eval>"
+
+// EvalScriptWithResult evaluates the code and returns its result
+// converted to Go, see GetJSObject(). Objects are returned as
+// map[string]interface{} and arrays as []interface{}.
+func (ctx *ESContext) EvalScriptWithResult(code string) (interface{}, error) {
+	ctx.PushString(EVAL_FILENAME)
+	defer ctx.Pop()
+	if r := ctx.PcompileStringFilename(duktape.DUK_COMPILE_EVAL, code); r != 0 {
+		return nil, ctx.GetESErrorAugmentingSyntaxErrors(EVAL_FILENAME)
+	}
+	if r := ctx.Pcall(0); r != 0 {
+		return nil, ctx.GetESError()
+	}
+	return ctx.getJSObject(-1, false), nil
+}
+
 var syntaxErrorRx = regexp.MustCompile(`^SyntaxError:.*?\(line\s+(\d+)\)\s*(\n|$)`)
 
 func (ctx *ESContext) LoadScript(path string) error {
@@ -322,6 +460,27 @@ func (ctx *ESContext) LoadScript(path string) error {
 	return nil
 }
 
+// LoadScriptIsolated runs the script wrapped in a function,
+// so its top-level variables and functions don't get into
+// the global object. The wrapper is placed on the first line
+// of the script to keep the line numbers intact.
+func (ctx *ESContext) LoadScriptIsolated(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	ctx.PushString(path)
+	defer ctx.Pop()
+	src := "function () {" + string(content) + "\n}"
+	if r := ctx.PcompileStringFilename(duktape.DUK_COMPILE_FUNCTION, src); r != 0 {
+		return ctx.GetESErrorAugmentingSyntaxErrors(path)
+	}
+	if r := ctx.Pcall(0); r != 0 {
+		return ctx.GetESError()
+	}
+	return nil
+}
+
 func (ctx *ESContext) LoadScriptFromString(filename, content string) error {
 	ctx.PushString(filename)
 	// we use PcompileStringFilename here to get readable stacktraces
@@ -336,10 +495,31 @@ func (ctx *ESContext) LoadScriptFromString(filename, content string) error {
 	return nil
 }
 
+// CompileScript compiles the script without running it
+func (ctx *ESContext) CompileScript(path, content string) error {
+	ctx.PushString(path)
+	defer ctx.Pop()
+	if r := ctx.PcompileStringFilename(0, content); r != 0 {
+		return ctx.GetESErrorAugmentingSyntaxErrors(path)
+	}
+	return nil
+}
+
 func (ctx *ESContext) DefineFunctions(fns map[string]func() int) {
 	for name, fn := range fns {
-		f := fn
-		ctx.PushGoFunc(func(*duktape.Context) int {
+		n, f := name, fn
+		ctx.PushGoFunc(func(*duktape.Context) (r int) {
+			// a panic must not unwind through duktape frames,
+			// so it's converted into an ECMAScript error
+			defer func() {
+				if p := recover(); p != nil {
+					ctx.handlePanic(n, p)
+					r = duktape.DUK_RET_ERROR
+				}
+			}()
+			if ctx.callGuard != nil && !ctx.callGuard() {
+				return duktape.DUK_RET_ERROR
+			}
 			return f()
 		})
 		ctx.PutPropString(-2, name)
@@ -1,6 +1,7 @@
 package wbrules
 
 import (
+	"fmt"
 	"github.com/stretchr/objx"
 	"github.com/stretchr/testify/assert"
 	"math"
@@ -133,3 +134,70 @@ func TestCallLocation(t *testing.T) {
 		assert.Equal(t, loc.tracebacks, storedTracebacks)
 	}
 }
+
+func TestCallbackResults(t *testing.T) {
+	ctx := newESContext(nil)
+	for _, tt := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"(function () {})", nil},
+		{"(function () { return null; })", nil},
+		{"(function () { return true; })", true},
+		{"(function () { return 'abc'; })", "abc"},
+		{"(function () { return 42; })", float64(42)},
+		{"(function () { return { x: 1, y: [ 'a', 'b' ] }; })",
+			objx.Map{"x": float64(1), "y": []interface{}{"a", "b"}}},
+		{"(function () { return [ 1, { z: 2 } ]; })",
+			[]interface{}{float64(1), objx.Map{"z": float64(2)}}},
+	} {
+		if r := ctx.PevalString(tt.script); r != 0 {
+			t.Fatal("failed to evaluate the script")
+		}
+		callback := ctx.WrapCallback(-1)
+		ctx.Pop()
+		result := NewCallbackResult(callback(nil))
+		assert.Equal(t, tt.expected, result.Value(), "script: %s", tt.script)
+		assert.Equal(t, tt.expected == nil, result.IsNil())
+	}
+}
+
+func TestEvalScriptWithResult(t *testing.T) {
+	ctx := newESContext(nil)
+	top := ctx.GetTop()
+	value, err := ctx.EvalScriptWithResult("var v = { x: [ 1, 'a' ] }; v")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"x": []interface{}{float64(1), "a"}}, value)
+
+	_, err = ctx.EvalScriptWithResult("\n  nosuchfunc();")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.(ESError).Traceback, ESLocation{EVAL_FILENAME, 2})
+	}
+	_, err = ctx.EvalScriptWithResult("1 +")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.(ESError).Traceback, ESLocation{EVAL_FILENAME, 1})
+	}
+	assert.Equal(t, top, ctx.GetTop(), "value stack not cleaned up")
+}
+
+func TestGoFunctionPanics(t *testing.T) {
+	ctx := newESContext(nil)
+	var panics []string
+	ctx.SetPanicHandler(func(where string, p interface{}, stack []byte) {
+		panics = append(panics, fmt.Sprintf("%s: %v", where, p))
+	})
+	ctx.PushGlobalObject()
+	ctx.DefineFunctions(map[string]func() int{
+		"crash": func() int {
+			panic("boom")
+		},
+	})
+	ctx.Pop()
+	if r := ctx.PevalString("(function () { try { crash(); return 'no error'; } catch (e) { return 'caught'; } })"); r != 0 {
+		t.Fatal("failed to evaluate the script")
+	}
+	callback := ctx.WrapCallback(-1)
+	ctx.Pop()
+	assert.Equal(t, "caught", callback(nil))
+	assert.Equal(t, []string{"crash: boom"}, panics)
+}
@@ -1,6 +1,8 @@
 package wbrules
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/DisposaBoy/JsonConfigReader"
@@ -29,6 +31,10 @@ const (
 	SOURCE_ITEM_RULE
 )
 
+// DISABLED_SCRIPT_SUFFIX is appended to the names
+// of the scripts disabled via the editor
+const DISABLED_SCRIPT_SUFFIX = ".disabled"
+
 var noLibJs = errors.New("unable to locate lib.js")
 var searchDirs = []string{LIB_SYS_PATH}
 
@@ -42,6 +48,47 @@ type ESEngine struct {
 	currentSource *LocFileEntry
 	sourcesMtx    sync.Mutex
 	tracker       *wbgo.ContentTracker
+	loadingScript bool
+	// devicePrefix is prepended to the names of virtual
+	// devices defined by the script being loaded
+	devicePrefix string
+	// thenRule is the name of the rule which then callback
+	// is being run under the timeout set by thenTimeoutMs
+	thenRule        string
+	thenDeadline    time.Time
+	thenInterrupted bool
+	// configDir is the directory with config
+	// files editable via editConfig()
+	configDir     string
+	configTracker *wbgo.ContentTracker
+	// changedConfig is the path of the config file
+	// which onConfigChange rules are being run
+	changedConfig        string
+	changedConfigContent interface{}
+	// scriptSwitches maps the names of the script switches
+	// to the virtual paths of the scripts
+	scriptSwitches map[string]string
+	// modulePath is the list of directories searched
+	// for the modules loaded by require()
+	modulePath []string
+	// isolateScripts makes top-level variables and functions
+	// of each script local to the script
+	isolateScripts bool
+	// notifier sends the notifications for Notify.* functions
+	notifier *Notifier
+	// processes lists the running processes spawned by the scripts
+	processes *processTable
+	// logLevelScripts maps the names of the log level
+	// cells to the paths of the scripts
+	logLevelScripts map[string]string
+	// loadedScripts lists the paths of the loaded scripts
+	loadedScripts map[string]bool
+	// scriptBatch holds the scripts collected
+	// by LoadFile(), see BeginScriptBatch()
+	scriptBatch []string
+	// anonymousRules counts the rules defined without a name
+	// on each line of the script being loaded
+	anonymousRules map[string]int
 }
 
 func init() {
@@ -54,16 +101,31 @@ func init() {
 	}
 }
 
-func NewESEngine(model *CellModel, mqttClient wbgo.MQTTClient) (engine *ESEngine) {
-	engine = &ESEngine{
-		RuleEngine: NewRuleEngine(model, mqttClient),
-		ctx:        newESContext(model.CallSync),
-		sources:    make(sourceMap),
-		tracker:    wbgo.NewContentTracker(),
+// NewESEngine creates an engine that runs ECMAScript rules.
+// An error is returned if the runtime library can't be loaded.
+func NewESEngine(model *CellModel, mqttClient wbgo.MQTTClient) (*ESEngine, error) {
+	engine := &ESEngine{
+		RuleEngine:    NewRuleEngine(model, mqttClient),
+		ctx:           newESContext(model.CallSync),
+		sources:       make(sourceMap),
+		tracker:       wbgo.NewContentTracker(),
+		configTracker: wbgo.NewContentTracker(),
+		modulePath:    ParseModulePath(DEFAULT_MODULE_PATH),
+		processes:     newProcessTable(),
+		loadedScripts: make(map[string]bool),
 	}
 
 	engine.ctx.SetCallbackErrorHandler(func(err ESError) {
+		engine.scriptErrors++
 		engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("ECMAScript error: %s", err))
+		engine.recordRuleError(err.Error())
+	})
+	engine.ctx.SetCallGuard(func() bool {
+		return engine.checkThenDeadline() && engine.checkProfileDeadline()
+	})
+	engine.ctx.SetPanicHandler(func(where string, p interface{}, stack []byte) {
+		engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("panic in %s: %v", where, p))
+		wbgo.Error.Printf("panic in %s: %v\n%s", where, p, stack)
 	})
 
 	engine.ctx.PushGlobalObject()
@@ -78,10 +140,61 @@ func NewESEngine(model *CellModel, mqttClient wbgo.MQTTClient) (engine *ESEngine
 		"_wbStartTimer":        engine.esWbStartTimer,
 		"_wbStopTimer":         engine.esWbStopTimer,
 		"_wbCheckCurrentTimer": engine.esWbCheckCurrentTimer,
+		"_wbRestartTimer":      engine.esWbRestartTimer,
+		"_wbTimerState":        engine.esWbTimerState,
+		"_wbRuleFireCount":     engine.esWbRuleFireCount,
 		"_wbSpawn":             engine.esWbSpawn,
+		"_wbKillProcess":       engine.esWbKillProcess,
+		"getRuleOrder":         engine.esGetRuleOrder,
 		"_wbDefineRule":        engine.esWbDefineRule,
 		"runRules":             engine.esWbRunRules,
 		"readConfig":           engine.esReadConfig,
+		"_wbPersistentGet":     engine.esWbPersistentGet,
+		"_wbPersistentSet":     engine.esWbPersistentSet,
+		"_wbPersistentKeys":    engine.esWbPersistentKeys,
+		"_wbSceneCapture":      engine.esWbSceneCapture,
+		"_wbSceneRecall":       engine.esWbSceneRecall,
+		"_wbSceneGet":          engine.esWbSceneGet,
+		"_wbSceneDelete":       engine.esWbSceneDelete,
+		"_wbSceneList":         engine.esWbSceneList,
+		"_wbDefineFeature":     engine.esWbDefineFeature,
+		"_wbReadInventory":     engine.esWbReadInventory,
+		"_wbSetGlitchFilter":   engine.esWbSetGlitchFilter,
+		"_wbSetDevicePrefix":   engine.esWbSetDevicePrefix,
+		"_wbDeviceName":        engine.esWbDeviceName,
+		"_wbParseDuration":     engine.esWbParseDuration,
+		"_wbParseByteSize":     engine.esWbParseByteSize,
+		"_wbAddCleanup":        engine.esWbAddCleanup,
+		"_wbAddStartupHook":    engine.esWbAddStartupHook,
+		"_wbProfile":           engine.esWbProfile,
+		"_wbLoadConfig":        engine.esWbLoadConfig,
+		"_wbWriteConfig":       engine.esWbWriteConfig,
+		"_wbPlanLoadSchedule":  engine.esWbPlanLoadSchedule,
+		"_wbAddControl":        engine.esWbAddControl,
+		"_wbRemoveControl":     engine.esWbRemoveControl,
+		"_wbControlExists":     engine.esWbControlExists,
+		"_wbModuleResolve":     engine.esWbModuleResolve,
+		"_wbModuleCompile":     engine.esWbModuleCompile,
+		"_wbNotify":            engine.esWbNotify,
+		"_wbHasNotifyChannel":  engine.esWbHasNotifyChannel,
+		"_wbHttpRequest":       engine.esWbHttpRequest,
+		"_wbTimeInRange":       engine.esWbTimeInRange,
+		"dayOfWeek":            engine.esWbDayOfWeek,
+		"isWeekend":            engine.esWbIsWeekend,
+		"_wbCellHistoryEnable": engine.esWbCellHistoryEnable,
+		"_wbCellHistoryValues": engine.esWbCellHistoryValues,
+		"_wbCellHistoryStats":  engine.esWbCellHistoryStats,
+		"_wbPIDCreate":         engine.esWbPIDCreate,
+		"_wbPIDSetEnabled":     engine.esWbPIDSetEnabled,
+		"_wbPIDIsEnabled":      engine.esWbPIDIsEnabled,
+		"_wbPIDReset":          engine.esWbPIDReset,
+		"rgbToHex":             engine.esRGBToHex,
+		"_wbTrackMqtt":         engine.esWbTrackMqtt,
+		"_wbNow":               engine.esWbNow,
+		"_wbSetRuleEnabled":    engine.esWbSetRuleEnabled,
+		"_wbRunRule":           engine.esWbRunRule,
+		"_wbCheckRule":         engine.esWbCheckRule,
+		"_wbDestroyRule":       engine.esWbDestroyRule,
 	})
 	engine.ctx.GetPropString(-1, "log")
 	engine.ctx.DefineFunctions(map[string]func() int{
@@ -92,9 +205,17 @@ func NewESEngine(model *CellModel, mqttClient wbgo.MQTTClient) (engine *ESEngine
 	})
 	engine.ctx.Pop2()
 	if err := engine.loadLib(); err != nil {
-		wbgo.Error.Panicf("failed to load runtime library: %s", err)
+		engine.ctx.DestroyHeap()
+		return nil, err
 	}
-	return
+	return engine, nil
+}
+
+// SetFatalPanics makes panics in Go functions called from
+// scripts crash the process instead of being reported as
+// script errors. Used by tests so that panics aren't masked.
+func (engine *ESEngine) SetFatalPanics(fatal bool) {
+	engine.ctx.SetFatalPanics(fatal)
 }
 
 func (engine *ESEngine) ScriptDir() string {
@@ -111,14 +232,19 @@ func (engine *ESEngine) SetSourceRoot(sourceRoot string) (err error) {
 	return
 }
 
-func (engine *ESEngine) buildSingleWhenChangedRuleCondition(defIndex int) (RuleCondition, error) {
+func (engine *ESEngine) buildSingleWhenChangedRuleCondition(defIndex int, fireOnRepublish bool) (RuleCondition, error) {
 	if engine.ctx.IsString(defIndex) {
 		cellFullName := engine.ctx.SafeToString(defIndex)
 		parts := strings.SplitN(cellFullName, "/", 2)
 		if len(parts) != 2 {
 			return nil, fmt.Errorf("invalid whenChanged spec: '%s'", cellFullName)
 		}
-		return NewCellChangedRuleCondition(CellSpec{parts[0], parts[1]})
+		cond, err := NewCellChangedRuleCondition(CellSpec{parts[0], parts[1]})
+		if err != nil {
+			return nil, err
+		}
+		cond.SetFireOnRepublish(fireOnRepublish)
+		return cond, nil
 	}
 	if engine.ctx.IsFunction(defIndex) {
 		f := engine.ctx.WrapCallback(defIndex)
@@ -129,18 +255,24 @@ func (engine *ESEngine) buildSingleWhenChangedRuleCondition(defIndex int) (RuleC
 
 func (engine *ESEngine) buildWhenChangedRuleCondition(defIndex int) (RuleCondition, error) {
 	ctx := engine.ctx
+	fireOnRepublish := false
+	if ctx.HasPropString(defIndex, "fireOnRepublish") {
+		ctx.GetPropString(defIndex, "fireOnRepublish")
+		fireOnRepublish = ctx.ToBoolean(-1)
+		ctx.Pop()
+	}
 	ctx.GetPropString(defIndex, "whenChanged")
 	defer ctx.Pop()
 
 	if !ctx.IsArray(-1) {
-		return engine.buildSingleWhenChangedRuleCondition(-1)
+		return engine.buildSingleWhenChangedRuleCondition(-1, fireOnRepublish)
 	}
 
 	conds := make([]RuleCondition, ctx.GetLength(-1))
 
 	for i := range conds {
 		ctx.GetPropIndex(-1, uint(i))
-		cond, err := engine.buildSingleWhenChangedRuleCondition(-1)
+		cond, err := engine.buildSingleWhenChangedRuleCondition(-1, fireOnRepublish)
 		ctx.Pop()
 		if err != nil {
 			return nil, err
@@ -158,8 +290,52 @@ func (engine *ESEngine) buildRuleCond(defIndex int) (RuleCondition, error) {
 	hasAsSoonAs := ctx.HasPropString(defIndex, "asSoonAs")
 	hasWhenChanged := ctx.HasPropString(defIndex, "whenChanged")
 	hasCron := ctx.HasPropString(defIndex, "_cron")
+	hasConfig := ctx.HasPropString(defIndex, "onConfigChange")
+	hasWhenRate := ctx.HasPropString(defIndex, "whenRate")
+	hasWhenComplete := ctx.HasPropString(defIndex, "whenComplete")
+	hasWhenTopic := ctx.HasPropString(defIndex, "whenTopic")
 
 	switch {
+	case hasWhenTopic && (hasWhen || hasAsSoonAs || hasWhenChanged || hasCron || hasConfig || hasWhenRate || hasWhenComplete):
+		return nil, errors.New(
+			"invalid rule -- cannot combine 'whenTopic' with other conditions")
+
+	case hasWhenTopic:
+		ctx.GetPropString(defIndex, "whenTopic")
+		defer ctx.Pop()
+		if !ctx.IsString(-1) {
+			return nil, errors.New("whenTopic: MQTT topic expected")
+		}
+		if err := engine.checkSubscribePermission(ctx.GetString(-1)); err != nil {
+			return nil, fmt.Errorf("whenTopic: %s", err)
+		}
+		cond, err := NewTopicRuleCondition(ctx.GetString(-1))
+		if err != nil {
+			return nil, fmt.Errorf("whenTopic: %s", err)
+		}
+		return cond, nil
+
+	case hasWhenComplete && (hasWhen || hasAsSoonAs || hasWhenChanged || hasCron || hasConfig || hasWhenRate):
+		return nil, errors.New(
+			"invalid rule -- cannot combine 'whenComplete' with other conditions")
+
+	case hasWhenComplete:
+		return engine.buildCompleteRuleCondition(defIndex)
+
+	case hasConfig && (hasWhen || hasAsSoonAs || hasWhenChanged || hasCron || hasWhenRate):
+		return nil, errors.New(
+			"invalid rule -- cannot combine 'onConfigChange' with other conditions")
+
+	case hasConfig:
+		return engine.buildConfigChangedRuleCondition(defIndex)
+
+	case hasWhenRate && (hasWhen || hasAsSoonAs || hasWhenChanged || hasCron):
+		return nil, errors.New(
+			"invalid rule -- cannot combine 'whenRate' with other conditions")
+
+	case hasWhenRate:
+		return engine.buildRateRuleCondition(defIndex)
+
 	case hasWhen && (hasAsSoonAs || hasWhenChanged || hasCron):
 		// _cron is added by lib.js. Under normal circumstances
 		// it may not be combined with 'when' here, so no special message
@@ -190,31 +366,74 @@ func (engine *ESEngine) buildRuleCond(defIndex int) (RuleCondition, error) {
 
 	default:
 		return nil, errors.New(
-			"invalid rule -- must provide one of 'when', 'asSoonAs' or 'whenChanged'")
+			"invalid rule -- must provide one of 'when', 'asSoonAs', 'whenChanged', 'whenRate', 'whenComplete', 'whenTopic' or 'onConfigChange'")
 	}
 }
 
+// ruleDuration returns the duration specified in ms
+// by the rule definition property, if any
+func (engine *ESEngine) ruleDuration(defIndex int, prop string) time.Duration {
+	if !engine.ctx.HasPropString(defIndex, prop) {
+		return 0
+	}
+	engine.ctx.GetPropString(defIndex, prop)
+	defer engine.ctx.Pop()
+	return time.Duration(engine.ctx.ToNumber(-1) * float64(time.Millisecond))
+}
+
 func (engine *ESEngine) buildRule(name string, defIndex int) (*Rule, error) {
 	if !engine.ctx.HasPropString(defIndex, "then") {
 		// this should be handled by lib.js
 		return nil, errors.New("invalid rule -- no then")
 	}
 	then := engine.wrapRuleCallback(defIndex, "then")
-	if cond, err := engine.buildRuleCond(defIndex); err != nil {
+	if timeout := engine.ruleDuration(defIndex, "thenTimeoutMs"); timeout > 0 {
+		then = engine.limitThenTime(name, then, timeout)
+	}
+	cond, err := engine.buildRuleCond(defIndex)
+	if err != nil {
 		return nil, err
-	} else {
-		return NewRule(engine, name, cond, then), nil
 	}
+	rule := NewRule(engine, name, cond, then)
+	if engine.ctx.HasPropString(defIndex, "ignoreStartupDelay") {
+		engine.ctx.GetPropString(defIndex, "ignoreStartupDelay")
+		rule.SetIgnoreStartupDelay(engine.ctx.ToBoolean(-1))
+		engine.ctx.Pop()
+	}
+	if engine.ctx.HasPropString(defIndex, "waitReady") {
+		engine.ctx.GetPropString(defIndex, "waitReady")
+		rule.SetWaitReady(engine.ctx.ToBoolean(-1))
+		engine.ctx.Pop()
+	}
+	debounce := engine.ruleDuration(defIndex, "debounceMs")
+	throttle := engine.ruleDuration(defIndex, "throttleMs")
+	if debounce > 0 && throttle > 0 {
+		return nil, errors.New("invalid rule -- cannot combine 'debounceMs' with 'throttleMs'")
+	}
+	rule.SetDebounce(debounce)
+	rule.SetThrottle(throttle)
+	if engine.ctx.HasPropString(defIndex, "priority") {
+		engine.ctx.GetPropString(defIndex, "priority")
+		rule.SetPriority(engine.ctx.ToInt(-1))
+		engine.ctx.Pop()
+	}
+	if engine.ctx.HasPropString(defIndex, "immediateWrites") {
+		engine.ctx.GetPropString(defIndex, "immediateWrites")
+		rule.SetImmediateWrites(engine.ctx.ToBoolean(-1))
+		engine.ctx.Pop()
+	}
+	return rule, nil
 }
 
 func (engine *ESEngine) loadLib() error {
-	for _, dir := range searchDirs {
-		path := filepath.Join(dir, LIB_FILE)
-		if _, err := os.Stat(path); err == nil {
-			return engine.ctx.LoadScript(path)
-		}
+	path, content, err := readLib()
+	if err != nil {
+		return err
+	}
+	if err = engine.ctx.LoadScriptFromString(path, string(content)); err != nil {
+		return &LibError{path, libSearchDirs(), err}
 	}
-	return noLibJs
+	return nil
 }
 
 func (engine *ESEngine) maybeRegisterSourceItem(typ itemType, name string) {
@@ -232,35 +451,79 @@ func (engine *ESEngine) maybeRegisterSourceItem(typ itemType, name string) {
 		log.Panicf("bad source item type %d", typ)
 	}
 
+	line := engine.scriptLine(engine.currentSource.PhysicalPath)
+	if line == -1 {
+		return
+	}
+	*items = append(*items, LocItem{line, name})
+}
+
+// scriptLine returns the line of the script being executed
+// or -1 if the script isn't found in the backtrace
+func (engine *ESEngine) scriptLine(path string) int {
 	line := -1
 	for _, loc := range engine.ctx.GetTraceback() {
 		// Here we depend upon the fact that duktape displays
 		// unmodified source paths in the backtrace
-		if loc.filename == engine.currentSource.PhysicalPath {
+		if loc.filename == path {
 			line = loc.line
 		}
 	}
-	if line == -1 {
-		return
-	}
-	*items = append(*items, LocItem{line, name})
+	return line
 }
 
 func (engine *ESEngine) ListSourceFiles() (entries []LocFileEntry, err error) {
 	engine.sourcesMtx.Lock()
 	defer engine.sourcesMtx.Unlock()
-	pathList := make([]string, 0, len(engine.sources))
-	for virtualPath, _ := range engine.sources {
+	entryMap := make(map[string]*LocFileEntry)
+	for virtualPath, entry := range engine.sources {
+		entryMap[virtualPath] = entry
+	}
+	if engine.sourceRoot != "" {
+		if err = engine.addDisabledSources(entryMap); err != nil {
+			return nil, err
+		}
+	}
+	pathList := make([]string, 0, len(entryMap))
+	for virtualPath, _ := range entryMap {
 		pathList = append(pathList, virtualPath)
 	}
 	sort.Strings(pathList)
 	entries = make([]LocFileEntry, len(pathList))
 	for n, virtualPath := range pathList {
-		entries[n] = *engine.sources[virtualPath]
+		entries[n] = *entryMap[virtualPath]
 	}
 	return
 }
 
+// addDisabledSources adds the entries for the disabled
+// scripts under the source root
+func (engine *ESEngine) addDisabledSources(entryMap map[string]*LocFileEntry) error {
+	err := filepath.Walk(engine.sourceRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".js"+DISABLED_SCRIPT_SUFFIX) {
+			return err
+		}
+		virtualPath, err := filepath.Rel(engine.sourceRoot, strings.TrimSuffix(path, DISABLED_SCRIPT_SUFFIX))
+		if err != nil {
+			return err
+		}
+		if _, found := entryMap[virtualPath]; !found {
+			entryMap[virtualPath] = &LocFileEntry{
+				VirtualPath:  virtualPath,
+				PhysicalPath: path,
+				Devices:      []LocItem{},
+				Rules:        []LocItem{},
+				Disabled:     true,
+			}
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
 func (engine *ESEngine) checkSourcePath(path string) (cleanPath string, virtualPath string, underSourceRoot bool, err error) {
 	path, err = filepath.Abs(path)
 	if err != nil {
@@ -284,9 +547,18 @@ func (engine *ESEngine) checkVirtualPath(path string) (cleanPath string, virtual
 	return
 }
 
-func (engine *ESEngine) LoadFile(path string) (err error) {
-	_, err = engine.loadScript(path, true)
-	return
+// LoadFile loads the script on the event loop, see
+// also BeginScriptBatch()
+func (engine *ESEngine) LoadFile(path string) error {
+	return engine.CallErr(func() error {
+		if engine.scriptBatch != nil {
+			engine.scriptBatch = append(engine.scriptBatch, path)
+			return nil
+		}
+		_, err := engine.loadScript(path, true)
+		engine.syncScriptControls()
+		return err
+	})
 }
 
 func (engine *ESEngine) loadScript(path string, loadIfUnchanged bool) (bool, error) {
@@ -300,6 +572,10 @@ func (engine *ESEngine) loadScript(path string, loadIfUnchanged bool) (bool, err
 		panic("recursive loadScript() calls not supported")
 	}
 
+	if err := engine.checkScriptRequires(path); err != nil {
+		return false, err
+	}
+
 	wasChangedOrFirstSeen, err := engine.tracker.Track(virtualPath, path)
 	if err != nil {
 		return false, err
@@ -315,6 +591,18 @@ func (engine *ESEngine) loadScript(path string, loadIfUnchanged bool) (bool, err
 
 	engine.cleanup.PushCleanupScope(path)
 	defer engine.cleanup.PopCleanupScope(path)
+	engine.loadedScripts[path] = true
+	engine.cleanup.AddCleanup(func() {
+		delete(engine.loadedScripts, path)
+	})
+	engine.currentProfile = engine.profileForPath(path)
+	engine.loadingScript = true
+	engine.anonymousRules = make(map[string]int)
+	defer func() {
+		engine.currentProfile = nil
+		engine.loadingScript = false
+		engine.devicePrefix = ""
+	}()
 	if underSourceRoot {
 		engine.currentSource = &LocFileEntry{
 			VirtualPath:  virtualPath,
@@ -335,7 +623,21 @@ func (engine *ESEngine) loadScript(path string, loadIfUnchanged bool) (bool, err
 		}()
 	}
 
-	return true, engine.trackESError(path, engine.ctx.LoadScript(path))
+	load := engine.ctx.LoadScript
+	if engine.isolateScripts {
+		load = engine.ctx.LoadScriptIsolated
+	}
+	return true, engine.trackESError(path, load(path))
+}
+
+// SetScriptIsolation enables or disables script isolation. When
+// it's enabled, top-level variables and functions of a script are
+// not visible to other scripts, so scripts can't clobber each
+// other's variables. The functions and objects provided by
+// the engine are still shared, as well as the global variables
+// assigned without 'var'. Affects the scripts loaded afterwards.
+func (engine *ESEngine) SetScriptIsolation(enabled bool) {
+	engine.isolateScripts = enabled
 }
 
 func (engine *ESEngine) trackESError(path string, err error) error {
@@ -370,7 +672,7 @@ func (engine *ESEngine) maybePublishUpdate(subtopic, physicalPath string) {
 		wbgo.Error.Printf("checkSourcePath() failed for %s: %s", physicalPath, err)
 	}
 	if underSourceRoot {
-		engine.Publish("/wbrules/updates/"+subtopic, virtualPath, 1, false)
+		engine.Publish(engine.topic("updates/"+subtopic), virtualPath, 1, false)
 	}
 }
 
@@ -380,6 +682,7 @@ func (engine *ESEngine) loadScriptAndRefresh(path string, loadIfUnchanged bool)
 		// must call refresh() even in case of loadScript() error,
 		// because a part of script was still probably loaded
 		engine.Refresh()
+		engine.syncScriptControls()
 		engine.maybePublishUpdate("changed", path)
 	}
 	return
@@ -419,6 +722,84 @@ func (engine *ESEngine) LiveWriteScript(virtualPath, content string) error {
 	return <-r
 }
 
+// ValidateScript compiles the script in a throwaway context
+// without running it, so the syntax errors can be detected before
+// the live script is replaced. The errors refer to the virtual
+// path of the script if it resides under the source root.
+// Currently duktape stops at the first syntax error, so at most
+// one error is returned. Unlike the other engine methods,
+// ValidateScript may be invoked from any goroutine.
+func (engine *ESEngine) ValidateScript(path string) ([]ScriptError, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx := newESContext(nil)
+	defer ctx.DestroyHeap()
+	esError, ok := ctx.CompileScript(path, string(content)).(ESError)
+	if !ok {
+		return nil, nil
+	}
+	return []ScriptError{NewScriptError(esError.Message, engine.scriptTraceback(esError.Traceback))}, nil
+}
+
+// scriptTraceback translates the file names in the traceback to
+// the virtual paths for the scripts under the source root
+func (engine *ESEngine) scriptTraceback(esTraceback ESTraceback) []LocItem {
+	traceback := make([]LocItem, 0, len(esTraceback))
+	for _, esLoc := range esTraceback {
+		name := esLoc.filename
+		if name == EVAL_FILENAME {
+			// not a file
+		} else if _, virtualPath, underSourceRoot, err := engine.checkSourcePath(name); err == nil && underSourceRoot {
+			name = virtualPath
+		}
+		traceback = append(traceback, LocItem{esLoc.line, name})
+	}
+	return traceback
+}
+
+// LiveChangeScriptState enables or disables the script. Disabled
+// scripts are renamed to *.js.disabled, so they're not loaded at
+// startup, and the rules and devices defined by them are removed.
+// Enabled scripts are loaded immediately. The change is published
+// to /wbrules/updates/enabled or /wbrules/updates/disabled topic.
+func (engine *ESEngine) LiveChangeScriptState(virtualPath string, enabled bool) error {
+	r := make(chan error)
+	engine.model.WhenReady(func() {
+		cleanPath, _, err := engine.checkVirtualPath(virtualPath)
+		if err != nil {
+			r <- err
+			return
+		}
+		disabledPath := cleanPath + DISABLED_SCRIPT_SUFFIX
+		if _, err = os.Stat(disabledPath); (err == nil) != enabled {
+			// already in the requested state
+			r <- nil
+			return
+		}
+		if enabled {
+			if err = os.Rename(disabledPath, cleanPath); err != nil {
+				r <- err
+				return
+			}
+			err = engine.loadScriptAndRefresh(cleanPath, true)
+			engine.maybePublishUpdate("enabled", cleanPath)
+		} else {
+			if err = os.Rename(cleanPath, disabledPath); err != nil {
+				r <- err
+				return
+			}
+			engine.cleanup.RunCleanups(cleanPath)
+			engine.Refresh()
+			engine.syncScriptControls()
+			engine.maybePublishUpdate("disabled", cleanPath)
+		}
+		r <- err
+	})
+	return <-r
+}
+
 // LiveLoadFile loads the specified script in the running engine.
 // If the engine isn't ready yet, the function waits for it to become
 // ready. If the script didn't change since the last time it was loaded,
@@ -436,6 +817,7 @@ func (engine *ESEngine) LiveRemoveFile(path string) error {
 	engine.model.WhenReady(func() {
 		engine.cleanup.RunCleanups(path)
 		engine.Refresh()
+		engine.syncScriptControls()
 		engine.maybePublishUpdate("removed", path)
 	})
 	return nil
@@ -447,6 +829,48 @@ func (engine *ESEngine) wrapRuleCallback(defIndex int, propName string) ESCallba
 	return engine.ctx.WrapCallback(-1)
 }
 
+// limitThenTime makes the rule's then callback run under
+// the specified timeout. ECMAScript code can't be preempted,
+// so the callback is interrupted when it calls an engine
+// function (accesses a cell, writes to the log, etc.) after
+// the timeout has passed. Callbacks that don't do so are
+// reported after they finish. A loop that doesn't call any
+// engine functions (e.g. while(true);) is not interrupted
+// and blocks the engine for good.
+func (engine *ESEngine) limitThenTime(name string, then ESCallbackFunc, timeout time.Duration) ESCallbackFunc {
+	return func(args objx.Map) interface{} {
+		savedRule, savedDeadline, savedInterrupted :=
+			engine.thenRule, engine.thenDeadline, engine.thenInterrupted
+		start := time.Now()
+		engine.thenRule, engine.thenDeadline, engine.thenInterrupted =
+			name, start.Add(timeout), false
+		defer func() {
+			engine.thenRule, engine.thenDeadline, engine.thenInterrupted =
+				savedRule, savedDeadline, savedInterrupted
+		}()
+		r := then(args)
+		if elapsed := time.Since(start); elapsed > timeout && !engine.thenInterrupted {
+			engine.Logf(ENGINE_LOG_ERROR, "rule %s: then callback took %s (timeout %s)",
+				name, elapsed, timeout)
+		}
+		return r
+	}
+}
+
+// checkThenDeadline returns false if the then callback
+// being run has exceeded its timeout
+func (engine *ESEngine) checkThenDeadline() bool {
+	if engine.thenDeadline.IsZero() || time.Now().Before(engine.thenDeadline) {
+		return true
+	}
+	if !engine.thenInterrupted {
+		engine.thenInterrupted = true
+		engine.Logf(ENGINE_LOG_ERROR, "rule %s: then callback timeout exceeded, interrupting",
+			engine.thenRule)
+	}
+	return false
+}
+
 func (engine *ESEngine) wrapRuleCondFunc(defIndex int, defProp string) func() bool {
 	f := engine.wrapRuleCallback(defIndex, defProp)
 	return func() bool {
@@ -459,16 +883,95 @@ func (engine *ESEngine) esDefineVirtualDevice() int {
 	if engine.ctx.GetTop() != 2 || !engine.ctx.IsString(-2) || !engine.ctx.IsObject(-1) {
 		return duktape.DUK_RET_ERROR
 	}
-	name := engine.ctx.GetString(-2)
+	name := PrefixedDeviceName(engine.devicePrefix, engine.ctx.GetString(-2))
 	obj := engine.ctx.GetJSObject(-1).(objx.Map)
 	if err := engine.DefineVirtualDevice(name, obj); err != nil {
 		wbgo.Error.Printf("device definition error: %s", err)
 		return duktape.DUK_RET_ERROR
 	}
 	engine.maybeRegisterSourceItem(SOURCE_ITEM_DEVICE, name)
+	engine.ctx.PushString(name)
+	return 1
+}
+
+// esWbAddControl adds a cell to the virtual device.
+// It returns an error message or null on success.
+func (engine *ESEngine) esWbAddControl() int {
+	if engine.ctx.GetTop() != 3 || !engine.ctx.IsString(0) ||
+		!engine.ctx.IsString(1) || !engine.ctx.IsObject(2) {
+		return duktape.DUK_RET_ERROR
+	}
+	cellDef, ok := engine.ctx.GetJSObject(2).(objx.Map)
+	if !ok {
+		return duktape.DUK_RET_TYPE_ERROR
+	}
+	if err := engine.AddControl(engine.ctx.GetString(0), engine.ctx.GetString(1), cellDef); err != nil {
+		engine.ctx.PushString(err.Error())
+	} else {
+		engine.ctx.PushNull()
+	}
+	return 1
+}
+
+// esWbRemoveControl removes a cell of the virtual device.
+// It returns an error message or null on success.
+func (engine *ESEngine) esWbRemoveControl() int {
+	if engine.ctx.GetTop() != 2 || !engine.ctx.IsString(0) || !engine.ctx.IsString(1) {
+		return duktape.DUK_RET_ERROR
+	}
+	if err := engine.RemoveControl(engine.ctx.GetString(0), engine.ctx.GetString(1)); err != nil {
+		engine.ctx.PushString(err.Error())
+	} else {
+		engine.ctx.PushNull()
+	}
+	return 1
+}
+
+func (engine *ESEngine) esWbControlExists() int {
+	if engine.ctx.GetTop() != 2 || !engine.ctx.IsString(0) || !engine.ctx.IsString(1) {
+		return duktape.DUK_RET_ERROR
+	}
+	cell := engine.model.LookupCell(&CellSpec{engine.ctx.GetString(0), engine.ctx.GetString(1)})
+	engine.ctx.PushBoolean(cell != nil && cell.IsComplete())
+	return 1
+}
+
+// PrefixedDeviceName returns the name of the device
+// defined by a script with the device prefix.
+// The name may also be a "device/cell" reference.
+func PrefixedDeviceName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "-" + name
+}
+
+func (engine *ESEngine) esWbSetDevicePrefix() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	prefix := engine.ctx.GetString(0)
+	if !engine.loadingScript || !namespaceRx.MatchString(prefix) {
+		wbgo.Error.Printf("can't set device prefix %q", prefix)
+		return duktape.DUK_RET_ERROR
+	}
+	engine.devicePrefix = prefix
 	return 0
 }
 
+func (engine *ESEngine) esWbDeviceName() int {
+	top := engine.ctx.GetTop()
+	if (top != 1 && top != 2) || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	prefix := engine.devicePrefix
+	if top == 2 {
+		prefix = engine.ctx.SafeToString(1)
+	}
+	engine.ctx.PushString(PrefixedDeviceName(prefix, engine.ctx.GetString(0)))
+	return 1
+}
+
 func (engine *ESEngine) esFormat() int {
 	engine.ctx.PushString(engine.ctx.Format())
 	return 1
@@ -476,7 +979,7 @@ func (engine *ESEngine) esFormat() int {
 
 func (engine *ESEngine) makeLogFunc(level EngineLogLevel) func() int {
 	return func() int {
-		engine.Log(level, engine.ctx.Format())
+		engine.LogFromScript(level, engine.ctx.Format())
 		return 0
 	}
 }
@@ -503,6 +1006,12 @@ func (engine *ESEngine) esPublish() int {
 	}
 	topic := engine.ctx.GetString(-2)
 	payload := engine.ctx.SafeToString(-1)
+	err := engine.checkPermission("publishing to "+topic, func(profile *ExecProfile) bool {
+		return profile.AllowPublish
+	})
+	if err != nil {
+		return duktape.DUK_RET_ERROR
+	}
 	engine.Publish(topic, payload, byte(qos), retain)
 	return 0
 }
@@ -549,7 +1058,9 @@ func (engine *ESEngine) esWbCellObject() int {
 				wbgo.Error.Printf("invalid cell definition")
 				return duktape.DUK_RET_TYPE_ERROR
 			}
-			cellProxy.SetValue(m["v"])
+			if cellProxy.SetValue(m["v"]) != nil {
+				return duktape.DUK_RET_ERROR
+			}
 			return 1
 		},
 		"isComplete": func() int {
@@ -561,7 +1072,8 @@ func (engine *ESEngine) esWbCellObject() int {
 }
 
 func (engine *ESEngine) esWbStartTimer() int {
-	if engine.ctx.GetTop() != 3 || !engine.ctx.IsNumber(1) {
+	top := engine.ctx.GetTop()
+	if (top != 3 && top != 4) || !engine.ctx.IsNumber(1) {
 		// FIXME: need to throw proper exception here
 		wbgo.Error.Println("bad _wbStartTimer call")
 		return duktape.DUK_RET_ERROR
@@ -585,6 +1097,7 @@ func (engine *ESEngine) esWbStartTimer() int {
 		ms = MIN_INTERVAL_MS
 	}
 	periodic := engine.ctx.ToBoolean(2)
+	waitReady := top == 4 && engine.ctx.ToBoolean(3)
 
 	var callback func()
 	if name == NO_TIMER_NAME {
@@ -593,8 +1106,13 @@ func (engine *ESEngine) esWbStartTimer() int {
 	}
 
 	interval := time.Duration(ms * float64(time.Millisecond))
-	engine.ctx.PushNumber(
-		float64(engine.StartTimer(name, callback, interval, periodic)))
+	var n uint64
+	if waitReady {
+		n = engine.StartTimerWhenReady(name, callback, interval, periodic)
+	} else {
+		n = engine.StartTimer(name, callback, interval, periodic)
+	}
+	engine.ctx.PushNumber(float64(n))
 	return 1
 }
 
@@ -626,8 +1144,51 @@ func (engine *ESEngine) esWbCheckCurrentTimer() int {
 	return 1
 }
 
+func (engine *ESEngine) esWbRestartTimer() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.ctx.PushBoolean(engine.RestartTimer(engine.ctx.ToString(0)))
+	return 1
+}
+
+// esWbTimerState returns an object with 'running' and
+// 'remaining' (ms) properties for the named timer
+func (engine *ESEngine) esWbTimerState() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	running, remaining := engine.TimerState(engine.ctx.ToString(0))
+	engine.ctx.PushJSObject(map[string]interface{}{
+		"running":   running,
+		"remaining": float64(remaining / time.Millisecond),
+	})
+	return 1
+}
+
+// esWbRuleFireCount returns the number of times the
+// rule fired or null if there's no such rule
+func (engine *ESEngine) esWbRuleFireCount() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	if count, found := engine.RuleFireCount(engine.ctx.GetString(0)); found {
+		engine.ctx.PushNumber(float64(count))
+	} else {
+		engine.ctx.PushNull()
+	}
+	return 1
+}
+
+// esWbSpawn spawns a process. Arguments: command line array,
+// exit callback, captureOutput, captureErrorOutput, input, an
+// optional object with 'env', 'cwd', 'timeout' (ms), 'streamOutput'
+// and 'streamErrorOutput' properties and an optional line callback
+// that receives objects with 'stream' ("stdout" or "stderr") and
+// 'line' properties for the streams that are requested.
+// Returns the process id that can be passed to _wbKillProcess().
 func (engine *ESEngine) esWbSpawn() int {
-	if engine.ctx.GetTop() != 5 || !engine.ctx.IsArray(0) || !engine.ctx.IsBoolean(2) ||
+	if engine.ctx.GetTop() != 7 || !engine.ctx.IsArray(0) || !engine.ctx.IsBoolean(2) ||
 		!engine.ctx.IsBoolean(3) {
 		return duktape.DUK_RET_ERROR
 	}
@@ -637,6 +1198,14 @@ func (engine *ESEngine) esWbSpawn() int {
 		return duktape.DUK_RET_ERROR
 	}
 
+	err := engine.checkPermission("spawning "+args[0], func(profile *ExecProfile) bool {
+		return profile.AllowSpawn
+	})
+	if err != nil {
+		return duktape.DUK_RET_ERROR
+	}
+	profile := engine.currentProfile
+
 	callbackFn := ESCallbackFunc(nil)
 
 	if engine.ctx.IsFunction(1) {
@@ -645,39 +1214,148 @@ func (engine *ESEngine) esWbSpawn() int {
 		return duktape.DUK_RET_ERROR
 	}
 
-	var input *string
+	options := SpawnOptions{
+		CaptureOutput:      engine.ctx.GetBoolean(2),
+		CaptureErrorOutput: engine.ctx.GetBoolean(3),
+	}
 	if engine.ctx.IsString(4) {
 		instr := engine.ctx.GetString(4)
-		input = &instr
+		options.Input = &instr
 	} else if !engine.ctx.IsNullOrUndefined(4) {
 		return duktape.DUK_RET_ERROR
 	}
 
-	captureOutput := engine.ctx.GetBoolean(2)
-	captureErrorOutput := engine.ctx.GetBoolean(3)
-	go func() {
-		r, err := Spawn(args[0], args[1:], captureOutput, captureErrorOutput, input)
+	streamOutput, streamErrorOutput := false, false
+	if engine.ctx.IsObject(5) {
+		engine.ctx.Dup(5)
+		m, ok := engine.ctx.GetJSObject(-1).(objx.Map)
+		engine.ctx.Pop()
+		if !ok || !parseSpawnOptions(m, &options) {
+			return duktape.DUK_RET_ERROR
+		}
+		streamOutput, _ = m["streamOutput"].(bool)
+		streamErrorOutput, _ = m["streamErrorOutput"].(bool)
+	} else if !engine.ctx.IsNullOrUndefined(5) {
+		return duktape.DUK_RET_ERROR
+	}
+
+	if engine.ctx.IsFunction(6) {
+		lineCallbackFn := engine.ctx.WrapCallback(6)
+		onLine := func(stream string) func(string) {
+			return func(line string) {
+				if engine.Lifetime().Err() != nil {
+					return
+				}
+				engine.Call(func() {
+					args := objx.New(map[string]interface{}{
+						"stream": stream,
+						"line":   line,
+					})
+					engine.withProfile(profile, "spawn output callback", func() {
+						lineCallbackFn(args)
+					})
+				})
+			}
+		}
+		if streamOutput {
+			options.OnOutputLine = onLine("stdout")
+		}
+		if streamErrorOutput {
+			options.OnErrorLine = onLine("stderr")
+		}
+	} else if !engine.ctx.IsNullOrUndefined(6) {
+		return duktape.DUK_RET_ERROR
+	}
+
+	ctx, cancel := context.WithCancel(engine.Lifetime())
+	id := engine.processes.add(cancel)
+	started := engine.goBackground(func() {
+		defer cancel()
+		r, err := SpawnWithOptions(ctx, args[0], args[1:], options)
+		engine.processes.remove(id)
+		if engine.Lifetime().Err() != nil {
+			wbgo.Debug.Printf("engine stopped, dropping the result of '%s'",
+				strings.Join(args, " "))
+			return
+		}
 		if err != nil {
 			wbgo.Error.Printf("external command failed: %s", err)
+			engine.Call(func() {
+				engine.spawnFailures++
+			})
 			return
 		}
+		if r.TimedOut {
+			wbgo.Error.Printf("command '%s' killed after timeout of %s",
+				strings.Join(args, " "), options.Timeout)
+		}
 		if callbackFn != nil {
-			engine.model.CallSync(func() {
+			engine.Call(func() {
 				args := objx.New(map[string]interface{}{
 					"exitStatus": r.ExitStatus,
+					"killed":     r.Killed,
 				})
-				if captureOutput {
+				if options.CaptureOutput {
 					args["capturedOutput"] = r.CapturedOutput
 				}
 				args["capturedErrorOutput"] = r.CapturedErrorOutput
-				callbackFn(args)
+				engine.withProfile(profile, "spawn callback", func() {
+					callbackFn(args)
+				})
 			})
-		} else if r.ExitStatus != 0 {
+		} else if r.ExitStatus != 0 && !r.Killed {
 			wbgo.Error.Printf("command '%s' failed with exit status %d",
 				strings.Join(args, " "), r.ExitStatus)
 		}
-	}()
-	return 0
+	})
+	if !started {
+		// the engine is stopped
+		engine.processes.remove(id)
+		cancel()
+	}
+	engine.ctx.PushNumber(float64(id))
+	return 1
+}
+
+// parseSpawnOptions parses 'env', 'cwd' and 'timeout'
+// options of spawn()
+func parseSpawnOptions(m objx.Map, options *SpawnOptions) bool {
+	if v, found := m["env"]; found && v != nil {
+		env, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for name, value := range env {
+			options.Env = append(options.Env, fmt.Sprintf("%s=%v", name, value))
+		}
+		// make the environment deterministic
+		sort.Strings(options.Env)
+	}
+	if v, found := m["cwd"]; found && v != nil {
+		dir, ok := v.(string)
+		if !ok {
+			return false
+		}
+		options.Dir = dir
+	}
+	if v, found := m["timeout"]; found && v != nil {
+		ms, ok := v.(float64)
+		if !ok || ms < 0 {
+			return false
+		}
+		options.Timeout = time.Duration(ms * float64(time.Millisecond))
+	}
+	return true
+}
+
+// esWbKillProcess kills the process spawned by _wbSpawn().
+// Returns false if the process isn't running.
+func (engine *ESEngine) esWbKillProcess() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsNumber(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.ctx.PushBoolean(engine.processes.kill(int(engine.ctx.GetNumber(0))))
+	return 1
 }
 
 func (engine *ESEngine) esWbDefineRule() int {
@@ -686,10 +1364,21 @@ func (engine *ESEngine) esWbDefineRule() int {
 		return duktape.DUK_RET_ERROR
 	}
 	shortName := engine.ctx.GetString(0)
+	if shortName == "" {
+		var err error
+		if shortName, err = engine.anonymousRuleName(); err != nil {
+			engine.Logf(ENGINE_LOG_ERROR, "bad rule definition: %s", err)
+			return duktape.DUK_RET_ERROR
+		}
+	}
 	name := shortName
 	if engine.currentSource != nil {
 		name = engine.currentSource.VirtualPath + "/" + shortName
 	}
+	if oldRule, found := engine.ruleMap[name]; found && oldRule.profile != engine.currentProfile {
+		engine.Logf(ENGINE_LOG_ERROR, "cannot redefine rule '%s' defined by another script", name)
+		return duktape.DUK_RET_ERROR
+	}
 	if rule, err := engine.buildRule(name, 1); err != nil {
 		// FIXME: proper error handling
 		engine.Log(ENGINE_LOG_ERROR,
@@ -699,17 +1388,131 @@ func (engine *ESEngine) esWbDefineRule() int {
 		engine.DefineRule(rule)
 		engine.maybeRegisterSourceItem(SOURCE_ITEM_RULE, shortName)
 	}
-	return 0
+	engine.ctx.PushString(name)
+	return 1
+}
+
+// anonymousRuleName generates the name of a rule defined without
+// a name. The name is based on the line of the script, so it
+// stays the same when the script is reloaded unless the rule
+// is moved.
+func (engine *ESEngine) anonymousRuleName() (string, error) {
+	path := engine.cleanup.CurrentScope()
+	if !engine.loadingScript || path == "" {
+		return "", errors.New("anonymous rules may only be defined at the script load time")
+	}
+	line := engine.scriptLine(path)
+	if line == -1 {
+		return "", errors.New("unable to determine the line of the anonymous rule")
+	}
+	name := fmt.Sprintf("anonymous:%d", line)
+	engine.anonymousRules[name]++
+	if n := engine.anonymousRules[name]; n > 1 {
+		// several rules defined on the same line,
+		// e.g. by a function called in a loop
+		name = fmt.Sprintf("%s#%d", name, n)
+	}
+	if engine.currentSource == nil {
+		// the names of the rules must be unique,
+		// so the file name is used as a prefix
+		name = filepath.Base(path) + "/" + name
+	}
+	return name, nil
+}
+
+// esWbSetRuleEnabled enables or disables the rule.
+// It returns an error message or null on success.
+func (engine *ESEngine) esWbSetRuleEnabled() int {
+	if engine.ctx.GetTop() != 2 || !engine.ctx.IsString(0) || !engine.ctx.IsBoolean(1) {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.pushRuleError(engine.setRuleEnabled(engine.ctx.GetString(0), engine.ctx.GetBoolean(1)))
+	return 1
+}
+
+// esWbRunRule runs the then callback of the rule.
+// It returns an error message or null on success.
+func (engine *ESEngine) esWbRunRule() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.pushRuleError(engine.RunRule(engine.resolveRuleName(engine.ctx.GetString(0))))
+	return 1
+}
+
+// esWbCheckRule evaluates the condition of the rule. It returns
+// true if the rule fired, false if it didn't or an error message.
+func (engine *ESEngine) esWbCheckRule() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	if fired, err := engine.CheckRule(engine.resolveRuleName(engine.ctx.GetString(0))); err != nil {
+		engine.ctx.PushString(err.Error())
+	} else {
+		engine.ctx.PushBoolean(fired)
+	}
+	return 1
+}
+
+// resolveRuleName returns the full name of the rule. The rules
+// defined by the script being loaded or by the script that
+// defined the current rule may be specified by their short names.
+func (engine *ESEngine) resolveRuleName(name string) string {
+	if _, found := engine.ruleMap[name]; found {
+		return name
+	}
+	virtualPath := ""
+	if engine.currentSource != nil {
+		virtualPath = engine.currentSource.VirtualPath
+	} else if rule, found := engine.ruleMap[engine.currentRule]; found {
+		virtualPath = engine.scriptVirtualPath(rule.script)
+	}
+	if virtualPath == "" {
+		return name
+	}
+	return virtualPath + "/" + name
+}
+
+// scriptVirtualPath returns the virtual path of the
+// script or an empty string if it's not under the
+// source root
+func (engine *ESEngine) scriptVirtualPath(path string) string {
+	engine.sourcesMtx.Lock()
+	defer engine.sourcesMtx.Unlock()
+	for virtualPath, entry := range engine.sources {
+		if entry.PhysicalPath == path {
+			return virtualPath
+		}
+	}
+	return ""
+}
+
+// esWbDestroyRule removes the rule.
+// It returns an error message or null on success.
+func (engine *ESEngine) esWbDestroyRule() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.pushRuleError(engine.DestroyRule(engine.ctx.GetString(0)))
+	return 1
+}
+
+func (engine *ESEngine) pushRuleError(err error) {
+	if err != nil {
+		engine.ctx.PushString(err.Error())
+	} else {
+		engine.ctx.PushNull()
+	}
 }
 
 func (engine *ESEngine) esWbRunRules() int {
 	switch engine.ctx.GetTop() {
 	case 0:
-		engine.RunRules(nil, NO_TIMER_NAME)
+		engine.runRules(nil, NO_TIMER_NAME)
 	case 2:
 		devName := engine.ctx.SafeToString(0)
 		cellName := engine.ctx.SafeToString(1)
-		engine.RunRules(&CellSpec{devName, cellName}, NO_TIMER_NAME)
+		engine.runRules(&CellSpec{devName, cellName}, NO_TIMER_NAME)
 	default:
 		return duktape.DUK_RET_ERROR
 	}
@@ -721,7 +1524,17 @@ func (engine *ESEngine) esReadConfig() int {
 		engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("invalid readConfig call"))
 		return duktape.DUK_RET_ERROR
 	}
-	path := engine.ctx.GetString(0)
+	path, err := engine.resolveConfigPath(engine.ctx.GetString(0))
+	if err != nil {
+		engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("invalid config file path: %s", err))
+		return duktape.DUK_RET_ERROR
+	}
+	err = engine.checkPermission("reading "+path, func(profile *ExecProfile) bool {
+		return profile.AllowFileAccess
+	})
+	if err != nil {
+		return duktape.DUK_RET_ERROR
+	}
 	in, err := os.Open(path)
 	if err != nil {
 		engine.Log(ENGINE_LOG_ERROR, fmt.Sprintf("failed to open config file: %s", path))
@@ -747,14 +1560,214 @@ func (engine *ESEngine) esReadConfig() int {
 	return 1
 }
 
+func (engine *ESEngine) esWbPersistentGet() int {
+	if engine.ctx.GetTop() != 2 || !engine.ctx.IsString(0) || !engine.ctx.IsString(1) {
+		return duktape.DUK_RET_ERROR
+	}
+	value, found := engine.storage.Get(engine.ctx.GetString(0), engine.ctx.GetString(1))
+	if !found {
+		engine.ctx.PushUndefined()
+	} else {
+		engine.ctx.PushJSObject(value)
+	}
+	return 1
+}
+
+func (engine *ESEngine) esWbPersistentSet() int {
+	// the optional 4th argument marks a critical write
+	// that must be flushed immediately
+	top := engine.ctx.GetTop()
+	if top < 3 || top > 4 || !engine.ctx.IsString(0) || !engine.ctx.IsString(1) {
+		return duktape.DUK_RET_ERROR
+	}
+	bucket, key := engine.ctx.GetString(0), engine.ctx.GetString(1)
+	err := engine.storage.Set(bucket, key, engine.ctx.GetJSObject(2))
+	if err == nil && top == 4 && engine.ctx.ToBoolean(3) {
+		err = engine.FlushPersistentStorage()
+	}
+	if err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "failed to store persistent value %s/%s: %s",
+			bucket, key, err)
+		return duktape.DUK_RET_ERROR
+	}
+	return 0
+}
+
+func (engine *ESEngine) esWbPersistentKeys() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	keys, err := StorageKeys(engine.storage, engine.ctx.GetString(0))
+	if err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "failed to list persistent keys: %s", err)
+		return duktape.DUK_RET_ERROR
+	}
+	engine.ctx.PushJSObject(keys)
+	return 1
+}
+
+func (engine *ESEngine) esWbDefineFeature() int {
+	if engine.ctx.GetTop() != 2 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.ctx.PushString(engine.DefineFeature(engine.ctx.GetString(0), engine.ctx.ToBoolean(1)))
+	return 1
+}
+
+func (engine *ESEngine) esWbSetGlitchFilter() int {
+	if engine.ctx.GetTop() != 3 || !engine.ctx.IsString(0) ||
+		!engine.ctx.IsString(1) || !engine.ctx.IsNumber(2) {
+		return duktape.DUK_RET_ERROR
+	}
+	cellSpec := &CellSpec{engine.ctx.GetString(0), engine.ctx.GetString(1)}
+	ms := engine.ctx.GetNumber(2)
+	engine.SetGlitchFilter(cellSpec, time.Duration(ms*float64(time.Millisecond)))
+	return 0
+}
+
+// esWbAddCleanup registers a function to be called when
+// the script being loaded is reloaded or removed. Outside
+// of script loading the function is never called.
+func (engine *ESEngine) esWbAddCleanup() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsFunction(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	if !engine.loadingScript {
+		return 0
+	}
+	f := engine.ctx.WrapCallback(0)
+	engine.cleanup.AddCleanup(func() {
+		f(nil)
+	})
+	return 0
+}
+
+// esWbAddStartupHook registers a function that's invoked each
+// time the engine is started, before the first rule run
+func (engine *ESEngine) esWbAddStartupHook() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsFunction(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	f := engine.ctx.WrapCallback(0)
+	engine.addStartupHook(func() {
+		f(nil)
+	})
+	return 0
+}
+
+// esWbParseDuration returns the duration in milliseconds
+// or null if the spec is invalid
+func (engine *ESEngine) esWbParseDuration() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	d, err := ParseDuration(engine.ctx.GetString(0))
+	if err != nil {
+		engine.ctx.PushNull()
+	} else {
+		engine.ctx.PushNumber(float64(d) / float64(time.Millisecond))
+	}
+	return 1
+}
+
+// esWbParseByteSize returns the number of bytes
+// or null if the spec is invalid
+func (engine *ESEngine) esWbParseByteSize() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	n, err := ParseByteSize(engine.ctx.GetString(0))
+	if err != nil {
+		engine.ctx.PushNull()
+	} else {
+		engine.ctx.PushNumber(float64(n))
+	}
+	return 1
+}
+
+func (engine *ESEngine) esWbProfile() int {
+	engine.ctx.PushJSObject(engine.profile)
+	return 1
+}
+
+func (engine *ESEngine) esWbReadInventory() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	path := engine.ctx.GetString(0)
+	err := engine.checkPermission("reading "+path, func(profile *ExecProfile) bool {
+		return profile.AllowFileAccess
+	})
+	if err != nil {
+		return duktape.DUK_RET_ERROR
+	}
+	inv, err := ReadInventory(path)
+	if err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "failed to read inventory %s: %s", path, err)
+		return duktape.DUK_RET_ERROR
+	}
+	engine.ctx.PushJSObject(inv)
+	return 1
+}
+
+// ImportInventory defines virtual devices and aliases
+// listed in the inventory file (see ReadInventory()).
+// Must be called before the engine is started.
+func (engine *ESEngine) ImportInventory(path string) error {
+	quotedPath, err := json.Marshal(path)
+	if err != nil {
+		return err
+	}
+	return engine.CallErr(func() error {
+		return engine.ctx.EvalScript(fmt.Sprintf("importInventory(%s)", quotedPath))
+	})
+}
+
+// EvalScript evaluates the code in the global context,
+// see EvalScriptWithResult()
 func (engine *ESEngine) EvalScript(code string) error {
-	ch := make(chan error)
-	engine.model.CallSync(func() {
-		err := engine.ctx.EvalScript(code)
-		if err != nil {
+	if _, scriptErr := engine.EvalScriptWithResult(code); scriptErr != nil {
+		return *scriptErr
+	}
+	return nil
+}
+
+// EvalScriptWithResult evaluates the code in the global context
+// and returns its result converted to Go, see
+// ESContext.EvalScriptWithResult(). If the code fails, the error
+// holds the message, the line of the code where the error occurred,
+// if known, and the stack trace, e.g. for an interactive console.
+func (engine *ESEngine) EvalScriptWithResult(code string) (value interface{}, scriptErr *ScriptError) {
+	engine.Call(func() {
+		var err error
+		if value, err = engine.ctx.EvalScriptWithResult(code); err != nil {
 			engine.Logf(ENGINE_LOG_ERROR, "eval error: %s", err)
+			scriptErr = engine.evalError(err)
 		}
-		ch <- err
 	})
-	return <-ch
+	return
+}
+
+func (engine *ESEngine) evalError(err error) *ScriptError {
+	esError, ok := err.(ESError)
+	if !ok {
+		return &ScriptError{Message: err.Error(), Traceback: []LocItem{}}
+	}
+	// the stack trace of the error object, which is
+	// used as the message, starts with the message itself
+	lines := strings.SplitN(esError.Message, "\n", 2)
+	scriptErr := &ScriptError{
+		Message:   lines[0],
+		Traceback: engine.scriptTraceback(esError.Traceback),
+	}
+	if len(lines) > 1 {
+		scriptErr.Stack = esError.Message
+	}
+	for _, loc := range scriptErr.Traceback {
+		if loc.Name == EVAL_FILENAME {
+			scriptErr.Line = loc.Line
+			break
+		}
+	}
+	return scriptErr
 }
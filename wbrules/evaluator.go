@@ -0,0 +1,111 @@
+package wbrules
+
+import (
+	"errors"
+	"fmt"
+	"github.com/contactless/wbgo"
+	"math"
+	"strings"
+)
+
+// CellValueSource provides current cell values
+// for the expression evaluator
+type CellValueSource interface {
+	// GetCellValues returns the values of the specified cells.
+	// Values of unknown or incomplete cells are omitted.
+	GetCellValues(cellSpecs []*CellSpec) map[CellSpec]interface{}
+}
+
+// Evaluator is an RPC service that evaluates read-only
+// expressions over current cell values, e.g. for
+// dashboards that need to display derived values.
+type Evaluator struct {
+	source CellValueSource
+}
+
+type EvaluatorError struct {
+	code    int32
+	message string
+}
+
+func (err *EvaluatorError) Error() string {
+	return err.message
+}
+
+func (err *EvaluatorError) ErrorCode() int32 {
+	return err.code
+}
+
+const (
+	// no iota here because these values may be used
+	// by external software
+	EVALUATOR_ERROR_INVALID_EXPR    = 1100
+	EVALUATOR_ERROR_INVALID_BINDING = 1101
+	EVALUATOR_ERROR_EVAL            = 1102
+)
+
+var invalidCellRefError = errors.New("invalid cell reference")
+
+func parseCellRef(cellRef string) (*CellSpec, error) {
+	parts := strings.SplitN(cellRef, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, invalidCellRefError
+	}
+	return &CellSpec{parts[0], parts[1]}, nil
+}
+
+func NewEvaluator(source CellValueSource) *Evaluator {
+	return &Evaluator{source}
+}
+
+type EvaluatorEvalArgs struct {
+	Expr string `json:"expr"`
+	// Bindings map expression names to cells ("device/cell")
+	Bindings map[string]string `json:"bindings"`
+}
+
+type EvaluatorEvalResponse struct {
+	Value interface{} `json:"value"`
+}
+
+func (evaluator *Evaluator) Eval(args *EvaluatorEvalArgs, reply *EvaluatorEvalResponse) error {
+	expr, err := ParseExpr(args.Expr)
+	if err != nil {
+		return &EvaluatorError{EVALUATOR_ERROR_INVALID_EXPR, err.Error()}
+	}
+
+	cellSpecs := make([]*CellSpec, 0, len(args.Bindings))
+	names := make(map[string]CellSpec, len(args.Bindings))
+	for name, cellRef := range args.Bindings {
+		cellSpec, err := parseCellRef(cellRef)
+		if err != nil {
+			return &EvaluatorError{EVALUATOR_ERROR_INVALID_BINDING,
+				"invalid binding for " + name + ": " + cellRef}
+		}
+		cellSpecs = append(cellSpecs, cellSpec)
+		names[name] = *cellSpec
+	}
+
+	values := evaluator.source.GetCellValues(cellSpecs)
+	value, err := expr.Eval(func(name string) (interface{}, bool) {
+		cellSpec, found := names[name]
+		if !found {
+			return nil, false
+		}
+		v, found := values[cellSpec]
+		return v, found
+	})
+	if err != nil {
+		wbgo.Debug.Printf("error evaluating %q: %s", args.Expr, err)
+		return &EvaluatorError{EVALUATOR_ERROR_EVAL, err.Error()}
+	}
+	// infinities and NaNs (e.g. from division by zero or
+	// sqrt of a negative number) can't be encoded as JSON
+	if f, ok := value.(float64); ok && (math.IsInf(f, 0) || math.IsNaN(f)) {
+		wbgo.Debug.Printf("error evaluating %q: result is %v", args.Expr, f)
+		return &EvaluatorError{EVALUATOR_ERROR_EVAL,
+			fmt.Sprintf("result is not a finite number: %v", f)}
+	}
+	*reply = EvaluatorEvalResponse{value}
+	return nil
+}
@@ -0,0 +1,55 @@
+package wbrules
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type fakeCellValueSource map[CellSpec]interface{}
+
+func (source fakeCellValueSource) GetCellValues(cellSpecs []*CellSpec) map[CellSpec]interface{} {
+	r := make(map[CellSpec]interface{})
+	for _, cellSpec := range cellSpecs {
+		if v, found := source[*cellSpec]; found {
+			r[*cellSpec] = v
+		}
+	}
+	return r
+}
+
+func TestEvaluator(t *testing.T) {
+	evaluator := NewEvaluator(fakeCellValueSource{
+		CellSpec{"meter", "power"}:   float64(1234),
+		CellSpec{"meter", "voltage"}: float64(230),
+		CellSpec{"meter", "current"}: float64(0),
+	})
+
+	var reply EvaluatorEvalResponse
+	assert.NoError(t, evaluator.Eval(&EvaluatorEvalArgs{
+		Expr: "round(p / u, 1)",
+		Bindings: map[string]string{
+			"p": "meter/power",
+			"u": "meter/voltage",
+		},
+	}, &reply))
+	assert.Equal(t, float64(5.4), reply.Value)
+
+	for _, tt := range []struct {
+		args EvaluatorEvalArgs
+		code int32
+	}{
+		{EvaluatorEvalArgs{"round(", nil}, EVALUATOR_ERROR_INVALID_EXPR},
+		{EvaluatorEvalArgs{"p", map[string]string{"p": "meter"}}, EVALUATOR_ERROR_INVALID_BINDING},
+		{EvaluatorEvalArgs{"p", map[string]string{"p": "meter/frequency"}}, EVALUATOR_ERROR_EVAL},
+		{EvaluatorEvalArgs{"q", map[string]string{"p": "meter/power"}}, EVALUATOR_ERROR_EVAL},
+		{EvaluatorEvalArgs{"p / i", map[string]string{"p": "meter/power", "i": "meter/current"}}, EVALUATOR_ERROR_EVAL},
+		{EvaluatorEvalArgs{"-p / i", map[string]string{"p": "meter/power", "i": "meter/current"}}, EVALUATOR_ERROR_EVAL},
+		{EvaluatorEvalArgs{"i / i", map[string]string{"i": "meter/current"}}, EVALUATOR_ERROR_EVAL},
+		{EvaluatorEvalArgs{"sqrt(-p)", map[string]string{"p": "meter/power"}}, EVALUATOR_ERROR_EVAL},
+	} {
+		err := evaluator.Eval(&tt.args, &reply)
+		if assert.Error(t, err, "expr: %s", tt.args.Expr) {
+			assert.Equal(t, tt.code, err.(*EvaluatorError).ErrorCode())
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package wbrules
+
+// The engine state, the cell model and the script context aren't
+// guarded by locks. Instead, all the code that touches them runs
+// one thunk at a time. While the engine is running, the commands
+// are sent to the event loop goroutine of the engine via its
+// command channel. The loop executes them one by one on the model
+// goroutine (that of the model's observer, the driver), where the
+// cell change handlers and the model callbacks are run, too. The
+// code running on other goroutines (the cell change consumer,
+// timers, spawned processes, HTTP requests, the editor, the HTTP
+// API etc.) sends the commands using Call() or Post(), and so do
+// the public entry points of the engine such as LoadFile(),
+// RunRules() and EvalScript().
+//
+// Before the engine is started and after it's stopped, there's
+// no loop, and the commands are executed on the calling goroutine,
+// via the model's CallSync() if the model is started. At that time,
+// the engine must only be used by a single goroutine.
+//
+// Neither function may be invoked from the code that's run by the
+// loop itself, as the loop would wait for itself. The code running
+// on the loop (rule callbacks, script functions, cell change
+// handlers) uses the unexported counterparts of the entry points,
+// such as runRules().
+
+type engineCommand struct {
+	thunk func()
+	done  chan struct{}
+}
+
+// eventLoop holds the command channel of a running loop
+type eventLoop struct {
+	commands chan *engineCommand
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// startLoop starts the event loop goroutine
+// unless it's already running
+func (engine *RuleEngine) startLoop() {
+	engine.statusMtx.Lock()
+	defer engine.statusMtx.Unlock()
+	if engine.loop != nil {
+		return
+	}
+	loop := &eventLoop{
+		commands: make(chan *engineCommand),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	engine.loop = loop
+	go engine.runLoop(loop)
+}
+
+// stopLoop stops the event loop goroutine and waits for it to finish.
+// The commands that are sent afterwards are executed directly.
+func (engine *RuleEngine) stopLoop() {
+	engine.statusMtx.Lock()
+	loop := engine.loop
+	engine.loop = nil
+	engine.statusMtx.Unlock()
+	if loop != nil {
+		close(loop.quit)
+		<-loop.done
+	}
+}
+
+func (engine *RuleEngine) runLoop(loop *eventLoop) {
+	defer close(loop.done)
+	for {
+		select {
+		case cmd := <-loop.commands:
+			engine.execute(cmd.thunk)
+			close(cmd.done)
+		case <-loop.quit:
+			return
+		}
+	}
+}
+
+// execute runs the thunk on the model goroutine
+// or directly if the model isn't started
+func (engine *RuleEngine) execute(thunk func()) {
+	if engine.model.IsStarted() {
+		engine.model.CallSync(thunk)
+	} else {
+		thunk()
+	}
+}
+
+// Call runs the thunk on the event loop and waits for it
+// to finish.
+func (engine *RuleEngine) Call(thunk func()) {
+	engine.statusMtx.Lock()
+	loop := engine.loop
+	engine.statusMtx.Unlock()
+	if loop == nil {
+		engine.execute(thunk)
+		return
+	}
+	cmd := &engineCommand{thunk, make(chan struct{})}
+	select {
+	case loop.commands <- cmd:
+		<-cmd.done
+	case <-loop.done:
+		// the loop was stopped meanwhile
+		engine.execute(thunk)
+	}
+}
+
+// CallErr runs the function on the event loop and returns
+// its result.
+func (engine *RuleEngine) CallErr(f func() error) (err error) {
+	engine.Call(func() {
+		err = f()
+	})
+	return
+}
+
+// Post schedules the thunk to run on the event loop without
+// waiting for it. The thunk is not run and false is returned
+// if the engine is stopped. Stop() waits for the posted
+// thunks to finish.
+func (engine *RuleEngine) Post(thunk func()) bool {
+	return engine.goBackground(func() {
+		engine.Call(thunk)
+	})
+}
@@ -0,0 +1,116 @@
+package wbrules
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/objx"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventLoopCalls(t *testing.T) {
+	_, engine := newTimerTestEngine(t, nullMQTTClient{})
+
+	// the counter isn't guarded by a lock, the event loop
+	// serializes the access (checked with -race)
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			engine.Call(func() { counter++ })
+		}()
+		go func() {
+			defer wg.Done()
+			if !engine.Post(func() { counter++ }) {
+				t.Errorf("Post() failed")
+			}
+		}()
+	}
+	wg.Wait()
+
+	expectedErr := errors.New("fail")
+	if err := engine.CallErr(func() error { return expectedErr }); err != expectedErr {
+		t.Errorf("bad error returned by CallErr(): %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := engine.Stop(ctx); err != nil {
+		t.Fatalf("Stop(): %s", err)
+	}
+	engine.Call(func() {
+		if counter != 20 {
+			t.Errorf("bad counter value: %d", counter)
+		}
+	})
+	if engine.Post(func() { counter++ }) {
+		t.Errorf("Post() succeeded after Stop()")
+	}
+}
+
+func TestEventLoopLifetime(t *testing.T) {
+	_, engine := newTimerTestEngine(t, nullMQTTClient{})
+	currentLoop := func() *eventLoop {
+		engine.statusMtx.Lock()
+		defer engine.statusMtx.Unlock()
+		return engine.loop
+	}
+	if currentLoop() != nil {
+		t.Fatalf("the loop is running before Start()")
+	}
+	fired := 0
+	engine.Call(func() {
+		engine.DefineRule(NewRule(engine, "counter", NewLevelTriggeredRuleCondition(func() bool {
+			return true
+		}), func(args objx.Map) interface{} {
+			fired++
+			return nil
+		}))
+	})
+
+	engine.Start()
+	loop := currentLoop()
+	if loop == nil {
+		t.Fatalf("the loop isn't running after Start()")
+	}
+	<-engine.ReadyCh()
+	// the public entry points are sent to the loop
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			engine.RunRules(nil, NO_TIMER_NAME)
+		}()
+	}
+	wg.Wait()
+	engine.Call(func() {
+		// the first rule pass is made by Start()
+		if fired != 6 {
+			t.Errorf("bad number of rule firings: %d", fired)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := engine.Stop(ctx); err != nil {
+		t.Fatalf("Stop(): %s", err)
+	}
+	select {
+	case <-loop.done:
+	default:
+		t.Errorf("the loop goroutine is still running after Stop()")
+	}
+	if currentLoop() != nil {
+		t.Errorf("the loop is set after Stop()")
+	}
+	// after Stop(), the commands are run directly
+	called := false
+	engine.Call(func() { called = true })
+	if !called {
+		t.Errorf("Call() didn't run the thunk after Stop()")
+	}
+}
@@ -0,0 +1,500 @@
+package wbrules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	EXPR_MAX_LENGTH = 1024
+	EXPR_MAX_DEPTH  = 64
+)
+
+// ExprEnv resolves names used in expressions.
+// The second return value is false if the name is unknown.
+type ExprEnv func(name string) (interface{}, bool)
+
+// Expr is a parsed read-only expression. Expressions can only
+// use literals, names resolved via ExprEnv, arithmetic, comparison
+// and logical operators and a fixed set of math functions,
+// so they can't have any side effects.
+type Expr interface {
+	Eval(env ExprEnv) (interface{}, error)
+}
+
+type exprFunc struct {
+	minArgs, maxArgs int
+	fn               func(args []float64) float64
+}
+
+// maxArgs < 0 means 'any number of args'
+var exprFuncs = map[string]exprFunc{
+	"abs":   {1, 1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"ceil":  {1, 1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"floor": {1, 1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"sqrt":  {1, 1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"pow":   {2, 2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"round": {1, 2, exprRound},
+	"min": {1, -1, func(a []float64) float64 {
+		r := a[0]
+		for _, v := range a[1:] {
+			r = math.Min(r, v)
+		}
+		return r
+	}},
+	"max": {1, -1, func(a []float64) float64 {
+		r := a[0]
+		for _, v := range a[1:] {
+			r = math.Max(r, v)
+		}
+		return r
+	}},
+}
+
+func exprRound(a []float64) float64 {
+	if len(a) == 1 {
+		return math.Floor(a[0] + 0.5)
+	}
+	p := math.Pow(10, math.Floor(a[1]))
+	return math.Floor(a[0]*p+0.5) / p
+}
+
+type exprLiteral struct {
+	value interface{}
+}
+
+func (e *exprLiteral) Eval(env ExprEnv) (interface{}, error) {
+	return e.value, nil
+}
+
+type exprName struct {
+	name string
+}
+
+func (e *exprName) Eval(env ExprEnv) (interface{}, error) {
+	if v, found := env(e.name); found {
+		return v, nil
+	}
+	return nil, fmt.Errorf("unknown name: %s", e.name)
+}
+
+type exprUnary struct {
+	op string
+	x  Expr
+}
+
+func (e *exprUnary) Eval(env ExprEnv) (interface{}, error) {
+	v, err := e.x.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if e.op == "!" {
+		return !exprToBool(v), nil
+	}
+	f, err := exprToNumber(v)
+	if err != nil {
+		return nil, err
+	}
+	return -f, nil
+}
+
+type exprBinary struct {
+	op   string
+	x, y Expr
+}
+
+func (e *exprBinary) Eval(env ExprEnv) (interface{}, error) {
+	a, err := e.x.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// logical operators are short-circuited
+	switch e.op {
+	case "&&":
+		if !exprToBool(a) {
+			return false, nil
+		}
+		b, err := e.y.Eval(env)
+		return exprToBool(b), err
+	case "||":
+		if exprToBool(a) {
+			return true, nil
+		}
+		b, err := e.y.Eval(env)
+		return exprToBool(b), err
+	}
+
+	b, err := e.y.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	sa, aIsStr := a.(string)
+	sb, bIsStr := b.(string)
+	switch {
+	case e.op == "+" && (aIsStr || bIsStr):
+		return exprToString(a) + exprToString(b), nil
+	case aIsStr && bIsStr:
+		switch e.op {
+		case "==":
+			return sa == sb, nil
+		case "!=":
+			return sa != sb, nil
+		case "<":
+			return sa < sb, nil
+		case "<=":
+			return sa <= sb, nil
+		case ">":
+			return sa > sb, nil
+		case ">=":
+			return sa >= sb, nil
+		}
+	}
+
+	fa, err := exprToNumber(a)
+	if err != nil {
+		return nil, err
+	}
+	fb, err := exprToNumber(b)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "+":
+		return fa + fb, nil
+	case "-":
+		return fa - fb, nil
+	case "*":
+		return fa * fb, nil
+	case "/":
+		return fa / fb, nil
+	case "%":
+		return math.Mod(fa, fb), nil
+	case "==":
+		return fa == fb, nil
+	case "!=":
+		return fa != fb, nil
+	case "<":
+		return fa < fb, nil
+	case "<=":
+		return fa <= fb, nil
+	case ">":
+		return fa > fb, nil
+	case ">=":
+		return fa >= fb, nil
+	}
+	return nil, fmt.Errorf("unsupported operator: %s", e.op)
+}
+
+type exprCall struct {
+	name string
+	fn   exprFunc
+	args []Expr
+}
+
+func (e *exprCall) Eval(env ExprEnv) (interface{}, error) {
+	args := make([]float64, len(e.args))
+	for n, arg := range e.args {
+		v, err := arg.Eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if args[n], err = exprToNumber(v); err != nil {
+			return nil, fmt.Errorf("%s(): %s", e.name, err)
+		}
+	}
+	return e.fn.fn(args), nil
+}
+
+func exprToNumber(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("not a number: %q", v)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("not a number: %v", v)
+	}
+}
+
+func exprToBool(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	default:
+		return v != nil
+	}
+}
+
+func exprToString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+type exprToken struct {
+	kind  rune // 'n'umber, 's'tring, 'i'dentifier, 'o'perator, 0 = EOF
+	text  string
+	value interface{}
+	pos   int
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	depth  int
+}
+
+var exprOperators = []string{
+	"&&", "||", "==", "!=", "<=", ">=",
+	"+", "-", "*", "/", "%", "<", ">", "!", "(", ")", ",",
+}
+
+func tokenizeExpr(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	i := 0
+TokenLoop:
+	for i < len(s) {
+		c, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case unicode.IsSpace(c):
+			i += size
+		case c >= '0' && c <= '9' || c == '.':
+			start := i
+			for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.' ||
+				s[i] == 'e' || s[i] == 'E' ||
+				(s[i] == '-' || s[i] == '+') && (s[i-1] == 'e' || s[i-1] == 'E')) {
+				i++
+			}
+			f, err := strconv.ParseFloat(s[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number at %d: %s", start, s[start:i])
+			}
+			tokens = append(tokens, exprToken{'n', s[start:i], f, start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var buf bytes.Buffer
+			for i < len(s) && rune(s[i]) != c {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				buf.WriteByte(s[i])
+				i++
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, exprToken{'s', s[start:i], buf.String(), start})
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(s) {
+				c, size = utf8.DecodeRuneInString(s[i:])
+				if c != '_' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, exprToken{'i', s[start:i], nil, start})
+		default:
+			for _, op := range exprOperators {
+				if strings.HasPrefix(s[i:], op) {
+					tokens = append(tokens, exprToken{'o', op, nil, i})
+					i += len(op)
+					continue TokenLoop
+				}
+			}
+			return nil, fmt.Errorf("unexpected character at %d: %c", i, c)
+		}
+	}
+	return append(tokens, exprToken{0, "", nil, len(s)}), nil
+}
+
+// ParseExpr parses an expression such as "round(a / b, 1)"
+func ParseExpr(s string) (Expr, error) {
+	if len(s) > EXPR_MAX_LENGTH {
+		return nil, errors.New("expression too long")
+	}
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	e, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != 0 {
+		return nil, fmt.Errorf("unexpected token at %d: %s", t.pos, t.text)
+	}
+	return e, nil
+}
+
+// binary operators by precedence, lowest first
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != 'o' {
+		return false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) expectOp(op string) error {
+	if !p.isOp(op) {
+		t := p.peek()
+		return fmt.Errorf("'%s' expected at %d", op, t.pos)
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) enter() error {
+	p.depth++
+	if p.depth > EXPR_MAX_DEPTH {
+		return errors.New("expression too complex")
+	}
+	return nil
+}
+
+func (p *exprParser) parseBinary(level int) (Expr, error) {
+	if level == len(exprPrecedence) {
+		return p.parseUnary()
+	}
+	x, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(exprPrecedence[level]...) {
+		op := p.next().text
+		y, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &exprBinary{op, x, y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseUnary() (Expr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	if p.isOp("-", "!") {
+		op := p.next().text
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{op, x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (Expr, error) {
+	t := p.next()
+	switch {
+	case t.kind == 'n' || t.kind == 's':
+		return &exprLiteral{t.value}, nil
+	case t.kind == 'i' && t.text == "true":
+		return &exprLiteral{true}, nil
+	case t.kind == 'i' && t.text == "false":
+		return &exprLiteral{false}, nil
+	case t.kind == 'i' && p.isOp("("):
+		return p.parseCall(t)
+	case t.kind == 'i':
+		return &exprName{t.text}, nil
+	case t.kind == 'o' && t.text == "(":
+		e, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case t.kind == 0:
+		return nil, errors.New("unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("unexpected token at %d: %s", t.pos, t.text)
+	}
+}
+
+func (p *exprParser) parseCall(name exprToken) (Expr, error) {
+	fn, found := exprFuncs[name.text]
+	if !found {
+		return nil, fmt.Errorf("unknown function: %s", name.text)
+	}
+	p.next() // '('
+	var args []Expr
+	if !p.isOp(")") {
+		for {
+			arg, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+	}
+	if err := p.expectOp(")"); err != nil {
+		return nil, err
+	}
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, fmt.Errorf("%s(): wrong number of arguments", name.text)
+	}
+	return &exprCall{name.text, fn, args}, nil
+}
@@ -0,0 +1,90 @@
+package wbrules
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var exprTests = []struct {
+	expr     string
+	expected interface{}
+}{
+	{"42", float64(42)},
+	{"1.5e2", float64(150)},
+	{"2 + 3 * 4", float64(14)},
+	{"(2 + 3) * 4", float64(20)},
+	{"-a + 1", float64(-9)},
+	{"a / b", float64(2.5)},
+	{"round(a / 3, 1)", float64(3.3)},
+	{"round(2.5)", float64(3)},
+	{"min(a, b, 1) + max(a, b)", float64(11)},
+	{"abs(-2) + floor(1.7) + ceil(1.2) + sqrt(9) + pow(2, 3)", float64(16)},
+	{"7 % 4", float64(3)},
+	{"a > b && b > 3", true},
+	{"a < b || !sw", false},
+	{"a == 10", true},
+	{"name + ': ' + a", "kitchen: 10"},
+	{"name == 'kitchen'", true},
+	{`"a\"b"`, `a"b`},
+	{"sw + 1", float64(2)},
+	{"true && false", false},
+	{"температура\u00a0+ 1", float64(22)},
+	{"'кухня: ' + температура", "кухня: 21"},
+}
+
+var exprErrorTests = []string{
+	"",
+	"1 +",
+	"(1 + 2",
+	"1 2",
+	"nosuchfunc(1)",
+	"round()",
+	"pow(1)",
+	"'abc",
+	"a $ b",
+	"unknown + 1",
+	"name * 2",
+	"a € b",
+}
+
+func exprTestEnv(name string) (interface{}, bool) {
+	v, found := map[string]interface{}{
+		"a":           float64(10),
+		"b":           float64(4),
+		"sw":          true,
+		"name":        "kitchen",
+		"температура": float64(21),
+	}[name]
+	return v, found
+}
+
+func TestExpr(t *testing.T) {
+	for _, tt := range exprTests {
+		expr, err := ParseExpr(tt.expr)
+		if !assert.NoError(t, err, "expr: %s", tt.expr) {
+			continue
+		}
+		v, err := expr.Eval(exprTestEnv)
+		assert.NoError(t, err, "expr: %s", tt.expr)
+		assert.Equal(t, tt.expected, v, "expr: %s", tt.expr)
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, s := range exprErrorTests {
+		expr, err := ParseExpr(s)
+		if err == nil {
+			_, err = expr.Eval(exprTestEnv)
+		}
+		assert.Error(t, err, "expr: %s", s)
+	}
+}
+
+func TestExprDepthLimit(t *testing.T) {
+	s := ""
+	for i := 0; i < EXPR_MAX_DEPTH+1; i++ {
+		s += "-"
+	}
+	_, err := ParseExpr(s + "1")
+	assert.Error(t, err)
+}
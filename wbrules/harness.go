@@ -0,0 +1,453 @@
+package wbrules
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	wbgo "github.com/contactless/wbgo"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_HARNESS_SETTLE_TIME = 20 * time.Millisecond
+	HARNESS_STOP_TIMEOUT        = 5 * time.Second
+)
+
+// RuleTestHarness makes it possible to test the rules without
+// MQTT broker and without waiting for the timers. The scripts
+// are loaded into an engine that uses an in-process cell model
+// and a fake clock. The test sets the cell values as if they
+// were received from the devices, advances the clock firing the
+// timers and cron rules that are due and checks the resulting
+// cell values:
+//
+//	h, err := wbrules.NewRuleTestHarness()
+//	if err != nil {
+//		...
+//	}
+//	defer h.Close()
+//	if err := h.LoadFile("heating.js"); err != nil {
+//		...
+//	}
+//	h.Start()
+//	h.Set("room/temp", 18)
+//	h.Advance(5 * time.Minute)
+//	if err := h.Expect("heating/on", true); err != nil {
+//		...
+//	}
+//
+// The values written by the rules to the cells of external
+// devices are accepted immediately, as if the devices confirmed
+// them. After each action the harness waits till the engine
+// becomes idle, i.e. the rules triggered by the action and
+// by the cell changes made by the rules are done.
+type RuleTestHarness struct {
+	model      *CellModel
+	observer   *harnessObserver
+	engine     *RuleEngine
+	es         *ESEngine
+	clock      *FakeClock
+	settleTime time.Duration
+}
+
+// harnessObserver runs the event loop of the harness engine.
+// Unlike the driver, it runs the thunks on the calling goroutine,
+// one at a time, and keeps track of the engine activity.
+type harnessObserver struct {
+	loopMtx     sync.Mutex
+	statusMtx   sync.Mutex
+	ready       bool
+	readyThunks []func()
+	// activity is incremented each time a thunk
+	// is started or finished
+	activity uint64
+	busy     int
+}
+
+func (obs *harnessObserver) OnNewDevice(dev wbgo.DeviceModel) {
+	dev.Observe(obs)
+}
+
+func (obs *harnessObserver) RemoveDevice(dev wbgo.DeviceModel) {}
+
+func (obs *harnessObserver) CallSync(thunk func()) {
+	obs.loopMtx.Lock()
+	defer obs.loopMtx.Unlock()
+	obs.track(1)
+	defer obs.track(-1)
+	thunk()
+}
+
+func (obs *harnessObserver) WhenReady(thunk func()) {
+	obs.statusMtx.Lock()
+	if !obs.ready {
+		obs.readyThunks = append(obs.readyThunks, thunk)
+		obs.statusMtx.Unlock()
+		return
+	}
+	obs.statusMtx.Unlock()
+	thunk()
+}
+
+func (obs *harnessObserver) OnNewControl(dev wbgo.LocalDeviceModel, name, paramType, value string, readOnly bool, max float64, retain bool) string {
+	return value
+}
+
+func (obs *harnessObserver) OnValue(dev wbgo.DeviceModel, name, value string) {
+	if extDev, ok := dev.(*CellModelExternalDevice); ok {
+		// the device confirms the value written by the engine
+		extDev.AcceptValue(name, value)
+	}
+}
+
+func (obs *harnessObserver) track(delta int) {
+	obs.statusMtx.Lock()
+	defer obs.statusMtx.Unlock()
+	obs.busy += delta
+	obs.activity++
+}
+
+func (obs *harnessObserver) status() (activity uint64, idle bool) {
+	obs.statusMtx.Lock()
+	defer obs.statusMtx.Unlock()
+	return obs.activity, obs.busy == 0
+}
+
+// setReady makes the model ready running the
+// thunks that wait for it on the event loop
+func (obs *harnessObserver) setReady() {
+	obs.CallSync(func() {
+		obs.statusMtx.Lock()
+		obs.ready = true
+		thunks := obs.readyThunks
+		obs.readyThunks = nil
+		obs.statusMtx.Unlock()
+		for _, thunk := range thunks {
+			thunk()
+		}
+	})
+}
+
+// NewRuleTestHarness creates a test harness with its
+// fake clock set to the current time
+func NewRuleTestHarness() (*RuleTestHarness, error) {
+	h := newRuleTestHarness()
+	es, err := NewESEngine(h.model, nullMQTTClient{})
+	if err != nil {
+		return nil, err
+	}
+	h.es = es
+	h.setEngine(h.es.RuleEngine)
+	return h, nil
+}
+
+func newRuleTestHarness() *RuleTestHarness {
+	h := &RuleTestHarness{
+		model:      NewCellModel(),
+		observer:   &harnessObserver{},
+		clock:      NewFakeClock(time.Now()),
+		settleTime: DEFAULT_HARNESS_SETTLE_TIME,
+	}
+	h.clock.SetFireHook(h.settle)
+	h.model.Observe(h.observer)
+	if err := h.model.Start(); err != nil {
+		// CellModel.Start() never fails
+		panic(err)
+	}
+	return h
+}
+
+func (h *RuleTestHarness) setEngine(engine *RuleEngine) {
+	h.engine = engine
+	engine.SetClock(h.clock)
+}
+
+// Engine returns the engine used by the harness
+func (h *RuleTestHarness) Engine() *ESEngine {
+	return h.es
+}
+
+// SetSettleTime sets the time the harness waits for the engine
+// activity after each action. The engine is considered idle if
+// it does nothing during this time.
+func (h *RuleTestHarness) SetSettleTime(d time.Duration) {
+	h.settleTime = d
+}
+
+// SetTime sets the time of the fake clock. It must be
+// called before the harness is started.
+func (h *RuleTestHarness) SetTime(t time.Time) {
+	h.clock.Set(t)
+}
+
+// Now returns the time of the fake clock
+func (h *RuleTestHarness) Now() time.Time {
+	return h.clock.Now()
+}
+
+// LoadFile loads the script. The scripts must
+// be loaded before the harness is started.
+func (h *RuleTestHarness) LoadFile(path string) error {
+	return h.es.LoadFile(path)
+}
+
+// LoadScripts loads the scripts from the
+// specified file or directory
+func (h *RuleTestHarness) LoadScripts(root string) error {
+	paths, err := findScripts(root)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := h.LoadFile(path); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// Start starts the engine and waits till the
+// first rule run is done
+func (h *RuleTestHarness) Start() {
+	h.engine.Start()
+	h.observer.setReady()
+	<-h.engine.ReadyCh()
+	h.settle()
+}
+
+// Close stops the engine
+func (h *RuleTestHarness) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), HARNESS_STOP_TIMEOUT)
+	defer cancel()
+	return h.engine.Stop(ctx)
+}
+
+// settle waits till the engine becomes idle
+func (h *RuleTestHarness) settle() {
+	last, _ := h.observer.status()
+	for {
+		time.Sleep(h.settleTime)
+		activity, idle := h.observer.status()
+		if idle && activity == last {
+			return
+		}
+		last = activity
+	}
+}
+
+func parseHarnessCellPath(cellPath string) (*CellSpec, error) {
+	parts := strings.Split(cellPath, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid cell path: %q", cellPath)
+	}
+	return &CellSpec{parts[0], parts[1]}, nil
+}
+
+// harnessCellType returns the type of the cell
+// of an unknown device set to the value
+func harnessCellType(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return "switch"
+	case float64, float32, int, int64:
+		return "value"
+	default:
+		return "text"
+	}
+}
+
+// Set sets the value of the cell as if it was received from the
+// device, or, for the cells of virtual devices, as if it was
+// changed by the user, and waits for the rules to settle. The
+// cells of unknown devices are created with the type deduced
+// from the value.
+func (h *RuleTestHarness) Set(cellPath string, value interface{}) error {
+	cellSpec, err := parseHarnessCellPath(cellPath)
+	if err != nil {
+		return err
+	}
+	err = h.engine.CallErr(func() error {
+		switch dev := h.model.EnsureDevice(cellSpec.DevName).(type) {
+		case *CellModelLocalDevice:
+			cell, found := dev.LookupCell(cellSpec.CellName)
+			if !found {
+				return fmt.Errorf("%s: no such cell", cellPath)
+			}
+			v, err := validateCellValue(cell.Type(), cell.Max(), value)
+			if err != nil {
+				return fmt.Errorf("%s: %s", cellPath, err)
+			}
+			dev.AcceptOnValue(cellSpec.CellName, rawCellValue(v))
+		case *CellModelExternalDevice:
+			cell := dev.EnsureCell(cellSpec.CellName)
+			if !cell.gotType {
+				dev.AcceptControlType(cellSpec.CellName, harnessCellType(value))
+			}
+			dev.AcceptValue(cellSpec.CellName, rawCellValue(value))
+		}
+		return nil
+	})
+	if err == nil {
+		h.settle()
+	}
+	return err
+}
+
+// Get returns the value of the cell
+func (h *RuleTestHarness) Get(cellPath string) (value interface{}, err error) {
+	cellSpec, err := parseHarnessCellPath(cellPath)
+	if err != nil {
+		return nil, err
+	}
+	err = h.engine.CallErr(func() error {
+		cell := h.model.LookupCell(cellSpec)
+		if cell == nil {
+			return fmt.Errorf("%s: no such cell", cellPath)
+		}
+		value = cell.Value()
+		return nil
+	})
+	return
+}
+
+// Expect returns an error if the value of the cell differs
+// from the expected one. The expected value is converted to
+// the type of the cell before comparison, so e.g. 1 matches
+// the value of a switch that's on.
+func (h *RuleTestHarness) Expect(cellPath string, expected interface{}) error {
+	cellSpec, err := parseHarnessCellPath(cellPath)
+	if err != nil {
+		return err
+	}
+	return h.engine.CallErr(func() error {
+		cell := h.model.LookupCell(cellSpec)
+		if cell == nil {
+			return fmt.Errorf("%s: no such cell", cellPath)
+		}
+		if v, err := validateCellValue(cell.Type(), cell.Max(), expected); err == nil && reflect.DeepEqual(v, cell.Value()) {
+			return nil
+		}
+		if rawCellValue(expected) == cell.RawValue() {
+			return nil
+		}
+		return fmt.Errorf("%s: expected %v, got %v", cellPath, expected, cell.Value())
+	})
+}
+
+// Advance moves the fake clock forward firing the timers and
+// cron rules that are due in their order and letting the
+// rules settle after each of them
+func (h *RuleTestHarness) Advance(d time.Duration) {
+	h.clock.Advance(d)
+}
+
+// HarnessStep is a step of a test scenario
+type HarnessStep struct {
+	// Line is the line number of the step
+	// in the scenario file
+	Line int
+	// Action is "set", "advance" or "expect"
+	Action string
+	Cell   string
+	Value  interface{}
+	// Duration is the time to advance the clock by
+	Duration time.Duration
+}
+
+// ParseTestScenario parses the test scenario. Each line of the
+// scenario is a step, empty lines and lines starting with '#'
+// are ignored:
+//
+//	# the heating is turned on when it's cold
+//	set room/temp 18
+//	advance 5m
+//	expect heating/on true
+//	expect heating/mode "eco"
+//
+// The values are parsed as JSON, the values that aren't valid
+// JSON are treated as strings. The durations are specified in
+// the format accepted by time.ParseDuration().
+func ParseTestScenario(text string) ([]*HarnessStep, error) {
+	var steps []*HarnessStep
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		step := &HarnessStep{Line: lineNo, Action: fields[0]}
+		switch {
+		case step.Action == "advance" && len(fields) == 2:
+			d, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNo, err)
+			}
+			step.Duration = d
+		case (step.Action == "set" || step.Action == "expect") && len(fields) == 3:
+			if _, err := parseHarnessCellPath(fields[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNo, err)
+			}
+			step.Cell = fields[1]
+			valueStr := strings.TrimSpace(fields[2])
+			if err := json.Unmarshal([]byte(valueStr), &step.Value); err != nil {
+				step.Value = valueStr
+			}
+		default:
+			return nil, fmt.Errorf("line %d: invalid step: %s", lineNo, line)
+		}
+		steps = append(steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("empty test scenario")
+	}
+	return steps, nil
+}
+
+// ReadTestScenario reads the test scenario from the file
+func ReadTestScenario(path string) ([]*HarnessStep, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := ParseTestScenario(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return steps, nil
+}
+
+// Run runs the steps of the test scenario and returns the
+// list of failures. Failed expectations don't stop the
+// scenario, while failed steps of other kinds do.
+func (h *RuleTestHarness) Run(steps []*HarnessStep) []string {
+	var failures []string
+	for _, step := range steps {
+		var err error
+		switch step.Action {
+		case "set":
+			err = h.Set(step.Cell, step.Value)
+		case "advance":
+			h.Advance(step.Duration)
+		case "expect":
+			if err := h.Expect(step.Cell, step.Value); err != nil {
+				failures = append(failures, fmt.Sprintf("line %d: %s", step.Line, err))
+			}
+		default:
+			err = fmt.Errorf("unknown action: %s", step.Action)
+		}
+		if err != nil {
+			return append(failures, fmt.Sprintf("line %d: %s", step.Line, err))
+		}
+	}
+	return failures
+}
@@ -0,0 +1,122 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRuleTestHarness(t *testing.T) {
+	h := newRuleTestHarness()
+	h.SetSettleTime(5 * time.Millisecond)
+	engine := NewRuleEngine(h.model, nullMQTTClient{})
+	h.setEngine(engine)
+	defer h.Close()
+
+	err := engine.DefineVirtualDevice("heating", objx.Map{
+		"cells": objx.Map{
+			"on":    objx.Map{"type": "switch", "value": false},
+			"hours": objx.Map{"type": "value", "value": 0.0},
+		},
+	})
+	if err != nil {
+		t.Fatalf("DefineVirtualDevice(): %s", err)
+	}
+	tempCond, err := NewCellChangedRuleCondition(CellSpec{"room", "temp"})
+	if err != nil {
+		t.Fatalf("NewCellChangedRuleCondition(): %s", err)
+	}
+	engine.DefineRule(NewRule(engine, "cold", tempCond, func(args objx.Map) interface{} {
+		if args["newValue"].(float64) < 20 {
+			engine.StartTimer(NO_TIMER_NAME, func() {
+				engine.setCellValue(engine.model.EnsureCell(&CellSpec{"heating", "on"}), true)
+			}, 5*time.Minute, false)
+		}
+		return nil
+	}))
+	onCond, err := NewCellChangedRuleCondition(CellSpec{"heating", "on"})
+	if err != nil {
+		t.Fatalf("NewCellChangedRuleCondition(): %s", err)
+	}
+	engine.DefineRule(NewRule(engine, "relay", onCond, func(args objx.Map) interface{} {
+		engine.setCellValue(engine.model.EnsureCell(&CellSpec{"wb-mr6c", "K1"}), args["newValue"])
+		return nil
+	}))
+	engine.DefineRule(NewRule(engine, "hours", NewCronRuleCondition("@every 1h"), func(objx.Map) interface{} {
+		cell := engine.model.EnsureCell(&CellSpec{"heating", "hours"})
+		engine.setCellValue(cell, cell.Value().(float64)+1)
+		return nil
+	}))
+	h.Start()
+
+	if err := h.Set("room", 18); err == nil {
+		t.Errorf("no error for an invalid cell path")
+	}
+	if err := h.Set("heating/on", "foo"); err == nil {
+		t.Errorf("no error for an invalid value")
+	}
+	if err := h.Set("room/temp", 18); err != nil {
+		t.Fatalf("Set(): %s", err)
+	}
+	if err := h.Expect("heating/on", false); err != nil {
+		t.Error(err)
+	}
+	h.Advance(4 * time.Minute)
+	if err := h.Expect("heating/on", false); err != nil {
+		t.Error(err)
+	}
+	h.Advance(time.Minute)
+	if err := h.Expect("heating/on", true); err != nil {
+		t.Error(err)
+	}
+	// the write to the external cell is confirmed by the fake device
+	if err := h.Expect("wb-mr6c/K1", 1); err != nil {
+		t.Error(err)
+	}
+	if err := h.Expect("heating/on", 0); err == nil {
+		t.Errorf("no error for an unmet expectation")
+	}
+	if err := h.Expect("heating/off", 0); err == nil {
+		t.Errorf("no error for an unknown cell")
+	}
+
+	h.Advance(2 * time.Hour)
+	if v, err := h.Get("heating/hours"); err != nil || v != float64(2) {
+		t.Errorf("bad cron rule result: %v, %v", v, err)
+	}
+}
+
+func TestParseTestScenario(t *testing.T) {
+	steps, err := ParseTestScenario(`
+# the heating is turned on when it's cold
+set room/temp 18
+advance 5m
+
+expect heating/on true
+expect heating/mode eco mode
+`)
+	if err != nil {
+		t.Fatalf("ParseTestScenario(): %s", err)
+	}
+	expected := []*HarnessStep{
+		{Line: 3, Action: "set", Cell: "room/temp", Value: float64(18)},
+		{Line: 4, Action: "advance", Duration: 5 * time.Minute},
+		{Line: 6, Action: "expect", Cell: "heating/on", Value: true},
+		{Line: 7, Action: "expect", Cell: "heating/mode", Value: "eco mode"},
+	}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("bad steps: %v", steps)
+	}
+	for _, text := range []string{
+		"",
+		"set room/temp",
+		"advance five minutes",
+		"expect room 1",
+		"wait 5m",
+	} {
+		if _, err := ParseTestScenario(text); err == nil {
+			t.Errorf("no error for %q", text)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package wbrules
+
+import (
+	"encoding/json"
+	"fmt"
+	wbgo "github.com/contactless/wbgo"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	HTTP_API_MAX_SCRIPT_SIZE = 1 << 20
+	HTTP_API_AUDIT_TARGET    = "rules"
+)
+
+// RuleManager provides the rule engine
+// functions used by the HTTP API
+type RuleManager interface {
+	LocFileManager
+	RuleStatuses() []RuleStatus
+	SetRuleEnabled(name string, enabled bool) error
+	RecentRuleFirings() []RuleFiring
+	RuleMetrics() []RuleMetrics
+}
+
+// HTTPAPI is an HTTP handler providing REST API for managing
+// the rules, so the rules can be managed by the web UI without
+// MQTT RPC. The callers must be authenticated using API tokens
+// passed via 'Authorization: Bearer <token>' header.
+// GET /rules lists the rules, POST /rules/<name>/enable and
+// POST /rules/<name>/disable enable and disable the rule,
+// GET /firings lists recent rule firings, GET /timings lists
+// the execution time metrics of the rules, GET /files lists
+// the script files and POST /files/<path> writes the script
+// file with the request body as its content.
+type HTTPAPI struct {
+	manager  RuleManager
+	editor   *Editor
+	tokens   map[string]string
+	auditLog *AuditLog
+	mux      *http.ServeMux
+	now      func() time.Time
+}
+
+type httpAPIError struct {
+	Error string `json:"error"`
+}
+
+func NewHTTPAPI(manager RuleManager, tokens map[string]string, auditLog *AuditLog) *HTTPAPI {
+	api := &HTTPAPI{
+		manager:  manager,
+		editor:   NewEditor(manager),
+		tokens:   tokens,
+		auditLog: auditLog,
+		mux:      http.NewServeMux(),
+		now:      time.Now,
+	}
+	api.mux.HandleFunc("/rules", api.handleRules)
+	api.mux.HandleFunc("/rules/", api.handleRuleAction)
+	api.mux.HandleFunc("/firings", api.handleFirings)
+	api.mux.HandleFunc("/timings", api.handleTimings)
+	api.mux.HandleFunc("/files", api.handleFiles)
+	api.mux.HandleFunc("/files/", api.handleSave)
+	return api
+}
+
+func (api *HTTPAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := api.authenticate(r); !ok {
+		api.replyError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	api.mux.ServeHTTP(w, r)
+}
+
+func (api *HTTPAPI) authenticate(r *http.Request) (identity string, ok bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	identity, ok = api.tokens[token]
+	return identity, ok && token != ""
+}
+
+func (api *HTTPAPI) reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		wbgo.Error.Printf("HTTP API: error writing reply: %s", err)
+	}
+}
+
+func (api *HTTPAPI) replyError(w http.ResponseWriter, status int, message string) {
+	api.reply(w, status, httpAPIError{message})
+}
+
+func (api *HTTPAPI) checkMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	api.replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func (api *HTTPAPI) audit(r *http.Request, action, target string, value interface{}) {
+	if api.auditLog == nil {
+		return
+	}
+	identity, _ := api.authenticate(r)
+	err := api.auditLog.Record(AuditRecord{
+		Time:     api.now(),
+		Identity: identity,
+		Action:   action,
+		Target:   target,
+		Value:    value,
+	})
+	if err != nil {
+		wbgo.Error.Printf("HTTP API: error writing audit log: %s", err)
+	}
+}
+
+func (api *HTTPAPI) handleRules(w http.ResponseWriter, r *http.Request) {
+	if api.checkMethod(w, r, "GET") {
+		api.reply(w, http.StatusOK, api.manager.RuleStatuses())
+	}
+}
+
+func (api *HTTPAPI) handleRuleAction(w http.ResponseWriter, r *http.Request) {
+	if !api.checkMethod(w, r, "POST") {
+		return
+	}
+	// rule names may contain slashes
+	path := strings.TrimPrefix(r.URL.Path, "/rules/")
+	n := strings.LastIndex(path, "/")
+	if n <= 0 {
+		api.replyError(w, http.StatusNotFound, "not found")
+		return
+	}
+	name, action := path[:n], path[n+1:]
+	var enabled bool
+	switch action {
+	case "enable":
+		enabled = true
+	case "disable":
+		enabled = false
+	default:
+		api.replyError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch err := api.manager.SetRuleEnabled(name, enabled); {
+	case err == unknownRuleError:
+		api.replyError(w, http.StatusNotFound, fmt.Sprintf("unknown rule: %s", name))
+	case err != nil:
+		api.replyError(w, http.StatusInternalServerError, err.Error())
+	default:
+		api.audit(r, "SetRuleEnabled", HTTP_API_AUDIT_TARGET+"/"+name, enabled)
+		api.reply(w, http.StatusOK, RuleStatus{Name: name, Enabled: enabled})
+	}
+}
+
+func (api *HTTPAPI) handleFirings(w http.ResponseWriter, r *http.Request) {
+	if api.checkMethod(w, r, "GET") {
+		api.reply(w, http.StatusOK, api.manager.RecentRuleFirings())
+	}
+}
+
+func (api *HTTPAPI) handleTimings(w http.ResponseWriter, r *http.Request) {
+	if api.checkMethod(w, r, "GET") {
+		api.reply(w, http.StatusOK, api.manager.RuleMetrics())
+	}
+}
+
+func (api *HTTPAPI) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if !api.checkMethod(w, r, "GET") {
+		return
+	}
+	var entries []LocFileEntry
+	if err := api.editor.List(&struct{}{}, &entries); err != nil {
+		api.replyError(w, http.StatusInternalServerError, listDirError.Error())
+		return
+	}
+	api.reply(w, http.StatusOK, entries)
+}
+
+func (api *HTTPAPI) handleSave(w http.ResponseWriter, r *http.Request) {
+	if !api.checkMethod(w, r, "POST") {
+		return
+	}
+	content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, HTTP_API_MAX_SCRIPT_SIZE))
+	if err != nil {
+		api.replyError(w, http.StatusRequestEntityTooLarge, "script too large")
+		return
+	}
+	var reply EditorSaveResponse
+	err = api.editor.Save(&EditorSaveArgs{
+		Path:    strings.TrimPrefix(r.URL.Path, "/files/"),
+		Content: string(content),
+	}, &reply)
+	switch err {
+	case nil:
+		api.audit(r, "SaveScript", reply.Path, len(content))
+		api.reply(w, http.StatusOK, reply)
+	case invalidPathError:
+		api.replyError(w, http.StatusBadRequest, err.Error())
+	default:
+		api.replyError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,135 @@
+package wbrules
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeRuleManager struct {
+	rules   map[string]bool
+	scripts map[string]string
+}
+
+func (manager *fakeRuleManager) ScriptDir() string {
+	return "/nonexistent"
+}
+
+func (manager *fakeRuleManager) ListSourceFiles() ([]LocFileEntry, error) {
+	return []LocFileEntry{
+		{VirtualPath: "a.js", Devices: []LocItem{}, Rules: []LocItem{{3, "ruleA"}}},
+	}, nil
+}
+
+func (manager *fakeRuleManager) LiveWriteScript(virtualPath, content string) error {
+	manager.scripts[virtualPath] = content
+	return nil
+}
+
+func (manager *fakeRuleManager) LiveChangeScriptState(virtualPath string, enabled bool) error {
+	return nil
+}
+
+func (manager *fakeRuleManager) RuleStatuses() []RuleStatus {
+	return []RuleStatus{
+		{Name: "ruleA", Enabled: manager.rules["ruleA"], Trigger: "when"},
+	}
+}
+
+func (manager *fakeRuleManager) SetRuleEnabled(name string, enabled bool) error {
+	if _, found := manager.rules[name]; !found {
+		return unknownRuleError
+	}
+	manager.rules[name] = enabled
+	return nil
+}
+
+func (manager *fakeRuleManager) RecentRuleFirings() []RuleFiring {
+	return []RuleFiring{
+		{Rule: "ruleA", Time: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC), Device: "dev", Cell: "cell"},
+	}
+}
+
+func (manager *fakeRuleManager) RuleMetrics() []RuleMetrics {
+	return []RuleMetrics{
+		{Rule: "ruleA", Then: RuleDurationStats{Count: 1, TotalMs: 2.5, MaxMs: 2.5, P50Ms: 2.5, P90Ms: 2.5, P99Ms: 2.5}},
+	}
+}
+
+func doHTTPAPIRequest(api *HTTPAPI, method, path, token, body string) (int, string) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	return w.Code, strings.TrimSpace(w.Body.String())
+}
+
+func TestHTTPAPI(t *testing.T) {
+	var buf bytes.Buffer
+	manager := &fakeRuleManager{
+		rules:   map[string]bool{"ruleA": true},
+		scripts: make(map[string]string),
+	}
+	api := NewHTTPAPI(manager, map[string]string{"s3cret": "webui"}, NewAuditLog(&buf))
+	api.now = func() time.Time {
+		return time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	}
+
+	code, body := doHTTPAPIRequest(api, "GET", "/rules", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = doHTTPAPIRequest(api, "GET", "/rules", "wrong", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, body = doHTTPAPIRequest(api, "GET", "/rules", "s3cret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `[{"name":"ruleA","enabled":true,"trigger":"when"}]`, body)
+
+	code, body = doHTTPAPIRequest(api, "POST", "/rules/ruleA/disable", "s3cret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"name":"ruleA","enabled":false,"trigger":""}`, body)
+	assert.False(t, manager.rules["ruleA"])
+	assert.Equal(t,
+		`{"time":"2026-10-16T12:00:00Z","identity":"webui","action":"SetRuleEnabled",`+
+			`"target":"rules/ruleA","value":false}`+"\n",
+		buf.String())
+
+	code, _ = doHTTPAPIRequest(api, "POST", "/rules/nosuchrule/enable", "s3cret", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = doHTTPAPIRequest(api, "POST", "/rules/ruleA/frobnicate", "s3cret", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = doHTTPAPIRequest(api, "GET", "/rules/ruleA/enable", "s3cret", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	code, body = doHTTPAPIRequest(api, "GET", "/firings", "s3cret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `[{"rule":"ruleA","time":"2026-10-16T12:00:00Z","device":"dev","cell":"cell","durationMs":0}]`, body)
+
+	code, body = doHTTPAPIRequest(api, "GET", "/timings", "s3cret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `[{"rule":"ruleA",`+
+		`"condition":{"count":0,"totalMs":0,"maxMs":0,"p50Ms":0,"p90Ms":0,"p99Ms":0},`+
+		`"then":{"count":1,"totalMs":2.5,"maxMs":2.5,"p50Ms":2.5,"p90Ms":2.5,"p99Ms":2.5}}]`, body)
+
+	code, body = doHTTPAPIRequest(api, "GET", "/files", "s3cret", "")
+	assert.Equal(t, http.StatusOK, code)
+	var entries []LocFileEntry
+	assert.NoError(t, json.Unmarshal([]byte(body), &entries))
+	assert.Equal(t, "a.js", entries[0].VirtualPath)
+
+	buf.Reset()
+	code, body = doHTTPAPIRequest(api, "POST", "/files/sub/b.js", "s3cret", "// new script")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"path":"sub/b.js"}`, body)
+	assert.Equal(t, "// new script", manager.scripts["sub/b.js"])
+	assert.Contains(t, buf.String(), `"action":"SaveScript","target":"sub/b.js"`)
+
+	code, _ = doHTTPAPIRequest(api, "POST", "/files/b.txt", "s3cret", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,173 @@
+package wbrules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ivan4th/go-duktape"
+	"github.com/stretchr/objx"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_HTTP_TIMEOUT   = 30 * time.Second
+	MAX_HTTP_RESPONSE_SIZE = 1024 * 1024
+)
+
+var httpResponseTooLargeError = errors.New("response too large")
+
+// HTTPRequest describes a request made by a script
+type HTTPRequest struct {
+	Method  string
+	URL     string
+	Headers map[string]string
+	Body    string
+	Timeout time.Duration
+}
+
+// HTTPResponse describes the response received by a script.
+// The header names are lowercase. Multiple values of the
+// same header are joined using ", ".
+type HTTPResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    string
+}
+
+// DoHTTPRequest performs the request. Responses with any HTTP
+// status are returned without an error, so the scripts
+// can handle them.
+func DoHTTPRequest(ctx context.Context, r HTTPRequest) (*HTTPResponse, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_HTTP_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var body io.Reader
+	if r.Body != "" {
+		body = strings.NewReader(r.Body)
+	}
+	req, err := http.NewRequest(strings.ToUpper(r.Method), r.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_HTTP_RESPONSE_SIZE+1))
+	switch {
+	case err != nil:
+		return nil, err
+	case len(bs) > MAX_HTTP_RESPONSE_SIZE:
+		return nil, httpResponseTooLargeError
+	}
+	headers := make(map[string]string)
+	for k, v := range resp.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ", ")
+	}
+	return &HTTPResponse{resp.StatusCode, headers, string(bs)}, nil
+}
+
+func parseHTTPRequest(options objx.Map) (r HTTPRequest, err error) {
+	var ok bool
+	if r.URL, ok = options["url"].(string); !ok || r.URL == "" {
+		return r, errors.New("url not specified")
+	}
+	r.Method = "GET"
+	if v, found := options["method"]; found && v != nil {
+		if r.Method, ok = v.(string); !ok {
+			return r, errors.New("method must be a string")
+		}
+	}
+	if v, found := options["body"]; found && v != nil {
+		if r.Body, ok = v.(string); !ok {
+			return r, errors.New("body must be a string")
+		}
+	}
+	if v, found := options["timeout"]; found && v != nil {
+		ms, ok := v.(float64)
+		if !ok || ms <= 0 {
+			return r, errors.New("timeout must be a positive number")
+		}
+		r.Timeout = time.Duration(ms * float64(time.Millisecond))
+	}
+	if v, found := options["headers"]; found && v != nil {
+		headers, ok := v.(map[string]interface{})
+		if !ok {
+			return r, errors.New("headers must be an object")
+		}
+		r.Headers = make(map[string]string)
+		for k, v := range headers {
+			r.Headers[k] = fmt.Sprint(v)
+		}
+	}
+	return r, nil
+}
+
+// esWbHttpRequest performs an HTTP request in background.
+// Arguments: options object (url, method, headers, body, timeout
+// in milliseconds) and a callback that receives an object with
+// 'error' property (null in case of success), 'status', 'headers'
+// and 'body'. The callback is invoked on the model's CallSync loop.
+// The function returns an error message or null if the request
+// can't be made at all.
+func (engine *ESEngine) esWbHttpRequest() int {
+	if engine.ctx.GetTop() != 2 || !engine.ctx.IsObject(0) || !engine.ctx.IsFunction(1) {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.ctx.Dup(0)
+	options, ok := engine.ctx.GetJSObject(-1).(objx.Map)
+	engine.ctx.Pop()
+	if !ok {
+		return duktape.DUK_RET_ERROR
+	}
+	r, err := parseHTTPRequest(options)
+	if err == nil {
+		err = engine.checkPermission("HTTP request to "+r.URL, func(profile *ExecProfile) bool {
+			return profile.AllowNetwork
+		})
+	}
+	if err != nil {
+		engine.ctx.PushString(err.Error())
+		return 1
+	}
+	callbackFn := engine.ctx.WrapCallback(1)
+	profile := engine.currentProfile
+	lifetime := engine.Lifetime()
+	engine.goBackground(func() {
+		resp, err := DoHTTPRequest(lifetime, r)
+		if lifetime.Err() != nil {
+			return
+		}
+		engine.Call(func() {
+			args := objx.New(map[string]interface{}{"error": nil})
+			if err != nil {
+				args["error"] = err.Error()
+			} else {
+				headers := make(map[string]interface{})
+				for k, v := range resp.Headers {
+					headers[k] = v
+				}
+				args["status"] = resp.Status
+				args["headers"] = headers
+				args["body"] = resp.Body
+			}
+			engine.withProfile(profile, "HTTP callback", func() {
+				callbackFn(args)
+			})
+		})
+	})
+	engine.ctx.PushNull()
+	return 1
+}
@@ -0,0 +1,91 @@
+package wbrules
+
+import (
+	"context"
+	"github.com/stretchr/objx"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDoHTTPRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			bs, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Method", r.Method)
+			w.Header().Set("X-Token", r.Header.Get("X-Token"))
+			w.Write(bs)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/large":
+			w.Write([]byte(strings.Repeat("x", MAX_HTTP_RESPONSE_SIZE+1)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := DoHTTPRequest(context.Background(), HTTPRequest{
+		Method:  "post",
+		URL:     server.URL + "/echo",
+		Headers: map[string]string{"X-Token": "abc"},
+		Body:    "hello",
+	})
+	switch {
+	case err != nil:
+		t.Fatalf("DoHTTPRequest(): %s", err)
+	case resp.Status != 200 || resp.Body != "hello":
+		t.Errorf("bad response: %#v", resp)
+	case resp.Headers["x-method"] != "POST" || resp.Headers["x-token"] != "abc":
+		t.Errorf("bad response headers: %#v", resp.Headers)
+	}
+
+	resp, err = DoHTTPRequest(context.Background(), HTTPRequest{Method: "GET", URL: server.URL + "/nosuchpage"})
+	if err != nil || resp.Status != 404 {
+		t.Errorf("404 expected, got %#v, %v", resp, err)
+	}
+
+	_, err = DoHTTPRequest(context.Background(), HTTPRequest{
+		Method:  "GET",
+		URL:     server.URL + "/slow",
+		Timeout: 20 * time.Millisecond,
+	})
+	if err == nil {
+		t.Errorf("no timeout error")
+	}
+
+	_, err = DoHTTPRequest(context.Background(), HTTPRequest{Method: "GET", URL: server.URL + "/large"})
+	if err != httpResponseTooLargeError {
+		t.Errorf("httpResponseTooLargeError expected, got %v", err)
+	}
+}
+
+func TestParseHTTPRequest(t *testing.T) {
+	r, err := parseHTTPRequest(objx.Map{
+		"url":     "http://localhost/",
+		"timeout": float64(1500),
+		"headers": map[string]interface{}{"X-Num": float64(42)},
+	})
+	switch {
+	case err != nil:
+		t.Fatalf("parseHTTPRequest(): %s", err)
+	case r.Method != "GET" || r.URL != "http://localhost/" || r.Timeout != 1500*time.Millisecond:
+		t.Errorf("bad request: %#v", r)
+	case r.Headers["X-Num"] != "42":
+		t.Errorf("bad headers: %#v", r.Headers)
+	}
+	for _, options := range []objx.Map{
+		{},
+		{"url": "http://localhost/", "method": float64(1)},
+		{"url": "http://localhost/", "timeout": float64(-1)},
+		{"url": "http://localhost/", "headers": "foo"},
+	} {
+		if _, err := parseHTTPRequest(options); err == nil {
+			t.Errorf("no error for %#v", options)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package wbrules
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/DisposaBoy/JsonConfigReader"
+	"github.com/stretchr/objx"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Inventory columns. The 'device', 'cell' and 'type' columns
+// are required, others are optional.
+const (
+	INVENTORY_COL_DEVICE    = "device"
+	INVENTORY_COL_TITLE     = "title"
+	INVENTORY_COL_CELL      = "cell"
+	INVENTORY_COL_TYPE      = "type"
+	INVENTORY_COL_VALUE     = "value"
+	INVENTORY_COL_READONLY  = "readonly"
+	INVENTORY_COL_MAX       = "max"
+	INVENTORY_COL_MIN       = "min"
+	INVENTORY_COL_PRECISION = "precision"
+	INVENTORY_COL_UNITS     = "units"
+	INVENTORY_COL_ALIAS     = "alias"
+)
+
+// ReadInventory reads an inventory file that lists virtual devices
+// and cell aliases. Files with .csv extension are parsed as CSV
+// with a header row, one cell per row. Other files are parsed as
+// JSON (comments are allowed) with "devices" object mapping
+// device names to device definitions and "aliases" object
+// mapping alias names to "device/cell" strings.
+// Device definitions have the same format as ones passed to
+// defineVirtualDevice(). The result is always in the JSON form.
+func ReadInventory(path string) (objx.Map, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		return readCSVInventory(in)
+	}
+	return readJSONInventory(in)
+}
+
+func readJSONInventory(in io.Reader) (objx.Map, error) {
+	content, err := ioutil.ReadAll(JsonConfigReader.New(in))
+	if err != nil {
+		return nil, err
+	}
+	inv, err := objx.FromJSON(string(content))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"devices", "aliases"} {
+		v := inv.Get(key)
+		switch {
+		case v.IsNil():
+			inv[key] = objx.Map{}
+		case !v.IsMSI():
+			return nil, fmt.Errorf("inventory: '%s' must be an object", key)
+		}
+	}
+	return inv, nil
+}
+
+func parseInventoryValue(controlType, s string) (interface{}, error) {
+	switch cellType(controlType) {
+	case CELL_TYPE_BOOLEAN:
+		if s == "" {
+			return false, nil
+		}
+		return strconv.ParseBool(s)
+	case CELL_TYPE_FLOAT:
+		if s == "" {
+			return float64(0), nil
+		}
+		return strconv.ParseFloat(s, 64)
+	default:
+		return s, nil
+	}
+}
+
+func readCSVInventory(in io.Reader) (objx.Map, error) {
+	r := csv.NewReader(in)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("inventory: can't read header: %s", err)
+	}
+	cols := make(map[string]int)
+	for n, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = n
+	}
+	for _, name := range []string{INVENTORY_COL_DEVICE, INVENTORY_COL_CELL, INVENTORY_COL_TYPE} {
+		if _, found := cols[name]; !found {
+			return nil, fmt.Errorf("inventory: no '%s' column", name)
+		}
+	}
+
+	devices := objx.Map{}
+	aliases := objx.Map{}
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if n, found := cols[name]; found && n < len(record) {
+				return strings.TrimSpace(record[n])
+			}
+			return ""
+		}
+
+		devName, cellName, controlType := field(INVENTORY_COL_DEVICE),
+			field(INVENTORY_COL_CELL), field(INVENTORY_COL_TYPE)
+		if devName == "" || cellName == "" || controlType == "" {
+			return nil, fmt.Errorf("inventory: line %d: device, cell and type must be specified", line)
+		}
+		value, err := parseInventoryValue(controlType, field(INVENTORY_COL_VALUE))
+		if err != nil {
+			return nil, fmt.Errorf("inventory: line %d: bad value: %s", line, err)
+		}
+		cellDef := objx.Map{"type": controlType, "value": value}
+		if s := field(INVENTORY_COL_READONLY); s != "" {
+			if cellDef["readonly"], err = strconv.ParseBool(s); err != nil {
+				return nil, fmt.Errorf("inventory: line %d: bad readonly flag: %s", line, err)
+			}
+		}
+		for _, name := range []string{INVENTORY_COL_MAX, INVENTORY_COL_MIN, INVENTORY_COL_PRECISION} {
+			if s := field(name); s != "" {
+				if cellDef[name], err = strconv.ParseFloat(s, 64); err != nil {
+					return nil, fmt.Errorf("inventory: line %d: bad %s value: %s", line, name, err)
+				}
+			}
+		}
+		if s := field(INVENTORY_COL_UNITS); s != "" {
+			cellDef["units"] = s
+		}
+
+		dev, found := devices[devName].(objx.Map)
+		if !found {
+			dev = objx.Map{"title": devName, "cells": objx.Map{}}
+			devices[devName] = dev
+		}
+		if title := field(INVENTORY_COL_TITLE); title != "" {
+			dev["title"] = title
+		}
+		dev["cells"].(objx.Map)[cellName] = cellDef
+
+		if alias := field(INVENTORY_COL_ALIAS); alias != "" {
+			aliases[alias] = devName + "/" + cellName
+		}
+	}
+	return objx.Map{"devices": devices, "aliases": aliases}, nil
+}
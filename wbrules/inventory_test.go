@@ -0,0 +1,85 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestCSVInventory(t *testing.T) {
+	inv, err := readCSVInventory(strings.NewReader(
+		"device,title,cell,type,value,readonly,max,alias,units,precision\n" +
+			"room1,Room 1,temp,temperature,20.5,true,,room1Temp,,0.1\n" +
+			"room1,,light,switch,,,,,,\n" +
+			"room2,Room 2,dimmer,range,10,,100,room2Dimmer,%,\n" +
+			"room2,,label,text,abc,,,,,\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, objx.Map{
+		"devices": objx.Map{
+			"room1": objx.Map{
+				"title": "Room 1",
+				"cells": objx.Map{
+					"temp": objx.Map{
+						"type":      "temperature",
+						"value":     float64(20.5),
+						"readonly":  true,
+						"precision": float64(0.1),
+					},
+					"light": objx.Map{
+						"type":  "switch",
+						"value": false,
+					},
+				},
+			},
+			"room2": objx.Map{
+				"title": "Room 2",
+				"cells": objx.Map{
+					"dimmer": objx.Map{
+						"type":  "range",
+						"value": float64(10),
+						"max":   float64(100),
+						"units": "%",
+					},
+					"label": objx.Map{
+						"type":  "text",
+						"value": "abc",
+					},
+				},
+			},
+		},
+		"aliases": objx.Map{
+			"room1Temp":   "room1/temp",
+			"room2Dimmer": "room2/dimmer",
+		},
+	}, inv)
+}
+
+func TestCSVInventoryErrors(t *testing.T) {
+	for _, content := range []string{
+		"",
+		"device,cell\nroom1,temp\n",
+		"device,cell,type\nroom1,,switch\n",
+		"device,cell,type,value\nroom1,temp,temperature,abc\n",
+		"device,cell,type,readonly\nroom1,light,switch,maybe\n",
+		"device,cell,type,min\nroom1,temp,temperature,low\n",
+	} {
+		_, err := readCSVInventory(strings.NewReader(content))
+		assert.Error(t, err, "content: %s", content)
+	}
+}
+
+func TestJSONInventory(t *testing.T) {
+	inv, err := readJSONInventory(strings.NewReader(`{
+	  // comments are allowed
+	  "devices": {
+	    "room1": { "title": "Room 1", "cells": { "light": { "type": "switch", "value": false } } }
+	  }
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "Room 1", inv.Get("devices.room1.title").Str())
+	assert.Equal(t, objx.Map{}, inv["aliases"])
+
+	_, err = readJSONInventory(strings.NewReader(`{ "devices": [] }`))
+	assert.Error(t, err)
+}
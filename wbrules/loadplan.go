@@ -0,0 +1,244 @@
+package wbrules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	duktape "github.com/ivan4th/go-duktape"
+	"sort"
+)
+
+const HOURS_PER_DAY = 24
+
+// LoadTariff specifies the price of energy from the hour From
+// till the hour To. To may be less than From if the period
+// spans midnight.
+type LoadTariff struct {
+	From  int     `json:"from"`
+	To    int     `json:"to"`
+	Price float64 `json:"price"`
+}
+
+// LoadAppliance describes an appliance which run time
+// can be shifted, e.g. a boiler or an EV charger
+type LoadAppliance struct {
+	Name string `json:"name"`
+	// Power is the power consumed by the appliance, kW
+	Power float64 `json:"power"`
+	// Hours is the number of hours the appliance must run per day
+	Hours int `json:"hours"`
+	// From and To limit the hours when the appliance may run.
+	// From == To means any time of the day.
+	From int `json:"from"`
+	To   int `json:"to"`
+	// Contiguous appliances must run without interruption
+	Contiguous bool `json:"contiguous"`
+}
+
+// LoadPlanRequest describes the load shifting problem
+type LoadPlanRequest struct {
+	Tariffs    []LoadTariff    `json:"tariffs"`
+	Appliances []LoadAppliance `json:"appliances"`
+	// MaxPower limits the total power of the appliances
+	// running at the same time, kW. Zero means no limit.
+	MaxPower float64 `json:"maxPower"`
+}
+
+// LoadPlan is the daily run schedule of the appliances
+type LoadPlan struct {
+	// Schedule maps appliance names to the hours
+	// of the day when the appliance must run
+	Schedule map[string][]bool `json:"schedule"`
+	// Cost is the daily cost of the energy
+	// consumed by the appliances
+	Cost float64 `json:"cost"`
+}
+
+type loadAppliancePtrSlice []*LoadAppliance
+
+func (s loadAppliancePtrSlice) Len() int { return len(s) }
+func (s loadAppliancePtrSlice) Less(i, j int) bool {
+	// more powerful appliances are harder to fit
+	// under the power limit, so they're placed first
+	if s[i].Power != s[j].Power {
+		return s[i].Power > s[j].Power
+	}
+	return s[i].Name < s[j].Name
+}
+func (s loadAppliancePtrSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// hourSlice sorts the hours by price. Hours with the same
+// price are kept in the order of the appliance window.
+type hourSlice struct {
+	hours  []int
+	prices []float64
+}
+
+func (s hourSlice) Len() int           { return len(s.hours) }
+func (s hourSlice) Less(i, j int) bool { return s.prices[s.hours[i]] < s.prices[s.hours[j]] }
+func (s hourSlice) Swap(i, j int)      { s.hours[i], s.hours[j] = s.hours[j], s.hours[i] }
+
+func validHour(hour int) bool {
+	return hour >= 0 && hour < HOURS_PER_DAY
+}
+
+// hourRange returns the hours from 'from' till 'to'
+// wrapping around midnight. from == to means the whole day.
+func hourRange(from, to int) []int {
+	hours := []int{from}
+	for h := (from + 1) % HOURS_PER_DAY; h != to; h = (h + 1) % HOURS_PER_DAY {
+		hours = append(hours, h)
+	}
+	return hours
+}
+
+func hourlyPrices(tariffs []LoadTariff) ([]float64, error) {
+	prices := make([]float64, HOURS_PER_DAY)
+	covered := make([]bool, HOURS_PER_DAY)
+	for _, tariff := range tariffs {
+		if !validHour(tariff.From) || !validHour(tariff.To) {
+			return nil, errors.New("invalid tariff hours")
+		}
+		for _, h := range hourRange(tariff.From, tariff.To) {
+			prices[h] = tariff.Price
+			covered[h] = true
+		}
+	}
+	for h, ok := range covered {
+		if !ok {
+			return nil, fmt.Errorf("no tariff for hour %d", h)
+		}
+	}
+	return prices, nil
+}
+
+type loadPlanner struct {
+	prices   []float64
+	load     []float64
+	maxPower float64
+}
+
+func (planner *loadPlanner) fits(appliance *LoadAppliance, hour int) bool {
+	return planner.maxPower <= 0 || planner.load[hour]+appliance.Power <= planner.maxPower
+}
+
+// cheapestHours picks the cheapest hours of the window
+// where the appliance fits under the power limit
+func (planner *loadPlanner) cheapestHours(appliance *LoadAppliance, window []int) []int {
+	candidates := make([]int, 0, len(window))
+	for _, h := range window {
+		if planner.fits(appliance, h) {
+			candidates = append(candidates, h)
+		}
+	}
+	if len(candidates) < appliance.Hours {
+		return nil
+	}
+	sort.Stable(hourSlice{candidates, planner.prices})
+	return candidates[:appliance.Hours]
+}
+
+// cheapestRun picks the cheapest contiguous run of hours
+// within the window
+func (planner *loadPlanner) cheapestRun(appliance *LoadAppliance, window []int) []int {
+	var best []int
+	bestPrice := 0.0
+	for start := 0; start+appliance.Hours <= len(window); start++ {
+		run, price := window[start:start+appliance.Hours], 0.0
+		fits := true
+		for _, h := range run {
+			if !planner.fits(appliance, h) {
+				fits = false
+				break
+			}
+			price += planner.prices[h]
+		}
+		if fits && (best == nil || price < bestPrice) {
+			best, bestPrice = run, price
+		}
+	}
+	return best
+}
+
+// PlanLoadSchedule computes the daily run schedule of the
+// appliances that minimizes the cost of energy. Without
+// the power limit the schedule is optimal. With the power
+// limit the appliances are placed one by one starting with
+// the most powerful one, so the schedule may be suboptimal,
+// but it never exceeds the limit.
+func PlanLoadSchedule(req *LoadPlanRequest) (*LoadPlan, error) {
+	prices, err := hourlyPrices(req.Tariffs)
+	if err != nil {
+		return nil, err
+	}
+	appliances := make([]*LoadAppliance, len(req.Appliances))
+	seen := make(map[string]bool)
+	for i := range req.Appliances {
+		appliance := &req.Appliances[i]
+		switch {
+		case appliance.Name == "" || seen[appliance.Name]:
+			return nil, fmt.Errorf("invalid or duplicate appliance name: %q", appliance.Name)
+		case appliance.Power < 0 || appliance.Hours < 0 || appliance.Hours > HOURS_PER_DAY:
+			return nil, fmt.Errorf("invalid power or hours for %s", appliance.Name)
+		case !validHour(appliance.From) || !validHour(appliance.To):
+			return nil, fmt.Errorf("invalid hours for %s", appliance.Name)
+		}
+		seen[appliance.Name] = true
+		appliances[i] = appliance
+	}
+	sort.Sort(loadAppliancePtrSlice(appliances))
+
+	planner := &loadPlanner{prices, make([]float64, HOURS_PER_DAY), req.MaxPower}
+	plan := &LoadPlan{Schedule: make(map[string][]bool)}
+	for _, appliance := range appliances {
+		window := hourRange(appliance.From, appliance.To)
+		var hours []int
+		if appliance.Contiguous {
+			hours = planner.cheapestRun(appliance, window)
+		} else {
+			hours = planner.cheapestHours(appliance, window)
+		}
+		if hours == nil {
+			return nil, fmt.Errorf("can't schedule %s for %d hour(s)", appliance.Name, appliance.Hours)
+		}
+		schedule := make([]bool, HOURS_PER_DAY)
+		for _, h := range hours {
+			schedule[h] = true
+			planner.load[h] += appliance.Power
+			plan.Cost += appliance.Power * prices[h]
+		}
+		plan.Schedule[appliance.Name] = schedule
+	}
+	return plan, nil
+}
+
+// esWbPlanLoadSchedule returns the plan for the LoadPlanRequest
+// passed as an object, or an object with 'error' property
+// if the appliances can't be scheduled
+func (engine *ESEngine) esWbPlanLoadSchedule() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsObject(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	var req LoadPlanRequest
+	bs, err := json.Marshal(engine.ctx.GetJSObject(0))
+	if err == nil {
+		err = json.Unmarshal(bs, &req)
+	}
+	var plan *LoadPlan
+	if err == nil {
+		plan, err = PlanLoadSchedule(&req)
+	}
+	if err != nil {
+		engine.ctx.PushJSObject(map[string]interface{}{"error": err.Error()})
+		return 1
+	}
+	schedule := make(map[string]interface{})
+	for name, hours := range plan.Schedule {
+		schedule[name] = hours
+	}
+	engine.ctx.PushJSObject(map[string]interface{}{
+		"schedule": schedule,
+		"cost":     plan.Cost,
+	})
+	return 1
+}
@@ -0,0 +1,83 @@
+package wbrules
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// night tariff from 23:00 till 07:00, day tariff otherwise
+var testTariffs = []LoadTariff{
+	{From: 7, To: 23, Price: 6},
+	{From: 23, To: 7, Price: 2},
+}
+
+func planHours(schedule []bool) (hours []int) {
+	hours = []int{}
+	for h, on := range schedule {
+		if on {
+			hours = append(hours, h)
+		}
+	}
+	return
+}
+
+func TestPlanLoadSchedule(t *testing.T) {
+	plan, err := PlanLoadSchedule(&LoadPlanRequest{
+		Tariffs: testTariffs,
+		Appliances: []LoadAppliance{
+			{Name: "boiler", Power: 2, Hours: 3, From: 20, To: 8},
+			{Name: "washer", Power: 1, Hours: 2, From: 8, To: 20, Contiguous: true},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []int{0, 1, 23}, planHours(plan.Schedule["boiler"]))
+	assert.Equal(t, []int{8, 9}, planHours(plan.Schedule["washer"]))
+	assert.Equal(t, float64(2*3*2+1*2*6), plan.Cost)
+}
+
+func TestPlanLoadScheduleWithPowerLimit(t *testing.T) {
+	plan, err := PlanLoadSchedule(&LoadPlanRequest{
+		Tariffs: testTariffs,
+		Appliances: []LoadAppliance{
+			{Name: "charger", Power: 3.5, Hours: 6},
+			{Name: "boiler", Power: 2, Hours: 4},
+		},
+		MaxPower: 5,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// the charger takes 6 of 8 night hours, so
+	// the boiler gets the rest of them and 2 day hours
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5}, planHours(plan.Schedule["charger"]))
+	assert.Equal(t, []int{6, 7, 8, 23}, planHours(plan.Schedule["boiler"]))
+	assert.Equal(t, 3.5*6*2+2*2*2+2*2*6, plan.Cost)
+}
+
+func TestPlanLoadScheduleErrors(t *testing.T) {
+	for _, req := range []LoadPlanRequest{
+		{Tariffs: []LoadTariff{{From: 0, To: 12, Price: 1}}},
+		{Tariffs: []LoadTariff{{From: 0, To: 25, Price: 1}}},
+		{
+			Tariffs:    testTariffs,
+			Appliances: []LoadAppliance{{Name: "boiler", Power: 2, Hours: 5, From: 0, To: 4}},
+		},
+		{
+			Tariffs:    testTariffs,
+			Appliances: []LoadAppliance{{Name: "boiler", Power: 6, Hours: 1}},
+			MaxPower:   5,
+		},
+		{
+			Tariffs: testTariffs,
+			Appliances: []LoadAppliance{
+				{Name: "boiler", Power: 1, Hours: 1},
+				{Name: "boiler", Power: 1, Hours: 1},
+			},
+		},
+	} {
+		_, err := PlanLoadSchedule(&req)
+		assert.Error(t, err)
+	}
+}
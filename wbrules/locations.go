@@ -13,6 +13,9 @@ type LocFileEntry struct {
 	Rules        []LocItem    `json:"rules"`
 	VirtualPath  string       `json:"virtualPath"`
 	PhysicalPath string       `json:"-"`
+	// Disabled is set for the scripts disabled via
+	// LiveChangeScriptState()
+	Disabled bool `json:"disabled,omitempty"`
 }
 
 // LocFileManager interface provides a way to access a list of source
@@ -21,6 +24,7 @@ type LocFileManager interface {
 	ScriptDir() string
 	ListSourceFiles() ([]LocFileEntry, error)
 	LiveWriteScript(virtualPath, content string) error
+	LiveChangeScriptState(virtualPath string, enabled bool) error
 }
 
 // ScriptError denotes an error that was caused by JavaScript code.
@@ -28,10 +32,16 @@ type LocFileManager interface {
 type ScriptError struct {
 	Message   string    `json:"message"`
 	Traceback []LocItem `json:"traceback"`
+	// Line and Stack are only set for the errors
+	// returned by EvalScriptWithResult(). Line is the
+	// line of the evaluated code where the error occurred,
+	// Stack is the stack trace of the error.
+	Line  int    `json:"line,omitempty"`
+	Stack string `json:"stack,omitempty"`
 }
 
 func NewScriptError(message string, traceback []LocItem) ScriptError {
-	return ScriptError{message, traceback}
+	return ScriptError{Message: message, Traceback: traceback}
 }
 
 func (err ScriptError) Error() string {
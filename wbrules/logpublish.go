@@ -0,0 +1,108 @@
+package wbrules
+
+import (
+	"fmt"
+	"time"
+)
+
+// logRateLimiter is a token bucket that limits the rate
+// of the log messages published to MQTT. Its fields are
+// guarded by debugMtx of the engine.
+type logRateLimiter struct {
+	rate       float64
+	burst      float64
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+// allow returns true if the message may be published along
+// with the number of messages suppressed since the last
+// published one
+func (limiter *logRateLimiter) allow(now time.Time) (bool, int) {
+	if !limiter.last.IsZero() {
+		limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+		if limiter.tokens > limiter.burst {
+			limiter.tokens = limiter.burst
+		}
+	}
+	limiter.last = now
+	if limiter.tokens < 1 {
+		limiter.suppressed++
+		return false, 0
+	}
+	limiter.tokens--
+	suppressed := limiter.suppressed
+	limiter.suppressed = 0
+	return true, suppressed
+}
+
+// SetLogTopicPrefix sets the prefix of the topics the log
+// messages are published to. The messages are published
+// to <prefix>/debug, <prefix>/info, <prefix>/warning and
+// <prefix>/error topics. Empty prefix means the default
+// one, /wbrules/log.
+func (engine *RuleEngine) SetLogTopicPrefix(prefix string) {
+	engine.debugMtx.Lock()
+	defer engine.debugMtx.Unlock()
+	engine.logTopicPrefix = prefix
+}
+
+// SetLogRateLimit limits the number of the log messages
+// published to MQTT to rate messages per second on average
+// allowing bursts of up to burst messages. The messages
+// exceeding the limit are still written to the system log.
+// When the publishing resumes, the number of suppressed
+// messages is published as a warning. Zero rate disables
+// the limit.
+func (engine *RuleEngine) SetLogRateLimit(rate float64, burst int) {
+	engine.debugMtx.Lock()
+	defer engine.debugMtx.Unlock()
+	if rate <= 0 {
+		engine.logLimiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	engine.logLimiter = &logRateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// logTopic returns the topic of the log messages of the level.
+// Must be called with debugMtx locked.
+func (engine *RuleEngine) logTopic(level string) string {
+	if engine.logTopicPrefix == "" {
+		return engine.topic("log/" + level)
+	}
+	return engine.logTopicPrefix + "/" + level
+}
+
+type logMessage struct {
+	topic, payload string
+}
+
+// logMessages returns the MQTT messages to be published for
+// the log message, which are none if the log rate limit is
+// exceeded. The messages must be published after debugMtx
+// is unlocked, so a slow broker or the log calls made during
+// publishing don't block the logging.
+// Must be called with debugMtx locked.
+func (engine *RuleEngine) logMessages(level, message string) (messages []logMessage) {
+	if engine.logLimiter != nil {
+		allowed, suppressed := engine.logLimiter.allow(engine.clock.Now())
+		if !allowed {
+			return nil
+		}
+		if suppressed > 0 {
+			messages = append(messages, logMessage{
+				engine.logTopic("warning"),
+				fmt.Sprintf("%d log messages suppressed due to the rate limit", suppressed),
+			})
+		}
+	}
+	return append(messages, logMessage{engine.logTopic(level), message})
+}
@@ -0,0 +1,92 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogRateLimit(t *testing.T) {
+	var messages []string
+	_, engine := newTestEngine(t, logCapturingClient{messages: &messages})
+	clock := NewFakeClock(time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC))
+	engine.SetClock(clock)
+	engine.SetLogTopicPrefix("/console")
+	engine.SetLogRateLimit(2, 3)
+
+	messages = nil
+	for i := 1; i <= 5; i++ {
+		engine.Logf(ENGINE_LOG_INFO, "message %d", i)
+	}
+	clock.Advance(time.Second)
+	engine.Log(ENGINE_LOG_ERROR, "message 6")
+	engine.Log(ENGINE_LOG_ERROR, "message 7")
+	engine.Log(ENGINE_LOG_ERROR, "message 8")
+	expected := []string{
+		"/console/info: message 1",
+		"/console/info: message 2",
+		"/console/info: message 3",
+		"/console/warning: 2 log messages suppressed due to the rate limit",
+		"/console/error: message 6",
+		"/console/error: message 7",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("bad messages: %v", messages)
+	}
+
+	messages = nil
+	engine.SetLogTopicPrefix("")
+	engine.SetLogRateLimit(0, 0)
+	for i := 0; i < 5; i++ {
+		engine.Log(ENGINE_LOG_WARNING, "unlimited")
+	}
+	if len(messages) != 5 || messages[0] != "/wbrules/log/warning: unlimited" {
+		t.Errorf("bad messages without the rate limit: %v", messages)
+	}
+}
+
+// reentrantLogClient logs a message when publishing
+// the first one, like a broker client logging errors
+type reentrantLogClient struct {
+	nullMQTTClient
+	engine   **RuleEngine
+	messages chan string
+}
+
+func (client reentrantLogClient) Publish(message wbgo.MQTTMessage) {
+	if message.Payload == "first" {
+		(*client.engine).Log(ENGINE_LOG_WARNING, "logged while publishing")
+	}
+	client.messages <- message.Topic + ": " + message.Payload
+}
+
+func TestLogPublishOutsideLock(t *testing.T) {
+	model := newTestModel(t)
+	var engine *RuleEngine
+	messages := make(chan string, 10)
+	engine = NewRuleEngine(model, reentrantLogClient{engine: &engine, messages: messages})
+	engine.SetLogRateLimit(100, 10)
+	done := make(chan struct{})
+	go func() {
+		engine.Log(ENGINE_LOG_INFO, "first")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("log deadlocked while publishing")
+	}
+	close(messages)
+	var got []string
+	for msg := range messages {
+		got = append(got, msg)
+	}
+	expected := []string{
+		"/wbrules/log/warning: logged while publishing",
+		"/wbrules/log/info: first",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("bad messages: %v", got)
+	}
+}
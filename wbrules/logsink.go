@@ -0,0 +1,127 @@
+package wbrules
+
+import (
+	"encoding/json"
+	"github.com/contactless/wbgo"
+	"io"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LogEntry is a message logged by a script
+type LogEntry struct {
+	Time    time.Time `json:"timestamp"`
+	Level   string    `json:"level"`
+	Script  string    `json:"script,omitempty"`
+	Rule    string    `json:"rule,omitempty"`
+	Message string    `json:"message"`
+}
+
+// LogSink receives the messages logged by the scripts
+// in addition to the system log. WriteLogEntry is invoked
+// on the event loop, so it should return quickly.
+type LogSink interface {
+	WriteLogEntry(entry *LogEntry) error
+}
+
+// JSONLogSink writes the log entries as
+// JSON objects, one object per line
+type JSONLogSink struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func NewJSONLogSink(w io.Writer) *JSONLogSink {
+	return &JSONLogSink{w: w}
+}
+
+// OpenJSONLogFile opens the JSON log file for appending
+func OpenJSONLogFile(path string) (*JSONLogSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLogSink(f), nil
+}
+
+func (sink *JSONLogSink) WriteLogEntry(entry *LogEntry) error {
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	_, err = sink.w.Write(append(bs, '\n'))
+	return err
+}
+
+// syslogJSONSink sends the log entries as JSON objects
+// to syslog using the priorities matching their levels
+type syslogJSONSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogJSONLogSink creates a sink that sends the log
+// entries to the system logger as JSON objects
+func NewSyslogJSONLogSink(tag string) (LogSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogJSONSink{w}, nil
+}
+
+func (sink *syslogJSONSink) WriteLogEntry(entry *LogEntry) error {
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case ENGINE_LOG_DEBUG.String():
+		return sink.w.Debug(string(bs))
+	case ENGINE_LOG_WARNING.String():
+		return sink.w.Warning(string(bs))
+	case ENGINE_LOG_ERROR.String():
+		return sink.w.Err(string(bs))
+	default:
+		return sink.w.Info(string(bs))
+	}
+}
+
+// AddLogSink adds the sink that receives the messages logged
+// by the scripts. Debug messages are only passed to the sinks
+// when rule debugging is enabled. Must be called before
+// the engine is started.
+func (engine *RuleEngine) AddLogSink(sink LogSink) {
+	engine.logSinks = append(engine.logSinks, sink)
+}
+
+func (engine *RuleEngine) writeToLogSinks(level EngineLogLevel, ruleName, script, message string) {
+	if level == ENGINE_LOG_DEBUG {
+		engine.debugMtx.Lock()
+		debugEnabled := engine.debugEnabled
+		engine.debugMtx.Unlock()
+		if !debugEnabled {
+			return
+		}
+	}
+	entry := &LogEntry{
+		Time:    engine.clock.Now(),
+		Level:   level.String(),
+		Rule:    ruleName,
+		Message: message,
+	}
+	if script != "" {
+		entry.Script = filepath.Base(script)
+	}
+	for _, sink := range engine.logSinks {
+		if err := sink.WriteLogEntry(entry); err != nil {
+			// not using engine.Log() here to
+			// avoid writing to the sinks
+			wbgo.Error.Printf("error writing log entry: %s", err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package wbrules
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestJSONLogSink(t *testing.T) {
+	_, engine := newTestEngine(t, nullMQTTClient{})
+	engine.SetClock(NewFakeClock(time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)))
+	var buf bytes.Buffer
+	engine.AddLogSink(NewJSONLogSink(&buf))
+
+	engine.debugEnabled = false
+	engine.withCurrentScript("/etc/wb-rules/lights.js", func() {
+		engine.LogFromScript(ENGINE_LOG_INFO, "lights on")
+		engine.LogFromScript(ENGINE_LOG_DEBUG, "not written")
+	})
+	engine.withCurrentRule("alarm", func() {
+		engine.LogFromScript(ENGINE_LOG_ERROR, `"quoted"`)
+	})
+	// the messages of the engine itself aren't written
+	engine.Log(ENGINE_LOG_WARNING, "engine message")
+
+	expected := `{"timestamp":"2020-01-01T10:00:00Z","level":"info","script":"lights.js","message":"lights on"}
+{"timestamp":"2020-01-01T10:00:00Z","level":"error","rule":"alarm","message":"\"quoted\""}
+`
+	if buf.String() != expected {
+		t.Errorf("bad JSON log:\n%s", buf.String())
+	}
+}
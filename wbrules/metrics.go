@@ -0,0 +1,136 @@
+package wbrules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	METRICS_PATH         = "/metrics"
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// EngineMetrics describes the engine health
+type EngineMetrics struct {
+	// RuleChecks is the number of times the rule
+	// conditions were checked
+	RuleChecks uint64
+	// RuleFirings is the number of times
+	// the then callbacks of the rules were invoked
+	RuleFirings uint64
+	// ScriptErrors is the number of
+	// exceptions thrown by the callbacks
+	ScriptErrors uint64
+	// SpawnFailures is the number of external
+	// commands that couldn't be run
+	SpawnFailures uint64
+	// Timers is the number of active timers
+	Timers int
+	// CellChangeQueueLength is the number of cell
+	// changes not yet received by the engine, see
+	// CellModel.PendingCellChanges()
+	CellChangeQueueLength int
+	// CellChangeRestarts is the number of times the cell
+	// change processing was resumed after the model closed
+	// the cell change channel unexpectedly
+	CellChangeRestarts uint64
+	Rules              []RuleMetrics
+}
+
+// EngineMetrics returns the current engine metrics
+func (engine *RuleEngine) EngineMetrics() (metrics *EngineMetrics) {
+	engine.Call(func() {
+		metrics = &EngineMetrics{
+			RuleChecks:            engine.ruleChecks,
+			RuleFirings:           engine.ruleFirings,
+			ScriptErrors:          engine.scriptErrors,
+			SpawnFailures:         engine.spawnFailures,
+			Timers:                len(engine.timers),
+			CellChangeQueueLength: engine.model.PendingCellChanges(),
+			CellChangeRestarts:    engine.cellChangeRestarts,
+			Rules:                 engine.collectRuleMetrics(),
+		}
+	})
+	return
+}
+
+var metricLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetric(w *bufio.Writer, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+func writeRuleDurationSummary(w *bufio.Writer, name, callback string, stats RuleDurationStats) {
+	labels := fmt.Sprintf(`rule="%s",callback="%s"`, metricLabelReplacer.Replace(name), callback)
+	for _, q := range []struct {
+		quantile string
+		ms       float64
+	}{
+		{"0.5", stats.P50Ms},
+		{"0.9", stats.P90Ms},
+		{"0.99", stats.P99Ms},
+	} {
+		fmt.Fprintf(w, "wbrules_rule_duration_seconds{%s,quantile=\"%s\"} %g\n", labels, q.quantile, q.ms/1000)
+	}
+	fmt.Fprintf(w, "wbrules_rule_duration_seconds_sum{%s} %g\n", labels, stats.TotalMs/1000)
+	fmt.Fprintf(w, "wbrules_rule_duration_seconds_count{%s} %d\n", labels, stats.Count)
+}
+
+// WritePrometheus writes the metrics using Prometheus
+// text exposition format
+func (metrics *EngineMetrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	writeMetric(bw, "wbrules_rule_checks_total", "counter",
+		"Number of rule condition checks.", metrics.RuleChecks)
+	writeMetric(bw, "wbrules_rule_firings_total", "counter",
+		"Number of rule then callback invocations.", metrics.RuleFirings)
+	writeMetric(bw, "wbrules_script_errors_total", "counter",
+		"Number of exceptions thrown by script callbacks.", metrics.ScriptErrors)
+	writeMetric(bw, "wbrules_spawn_failures_total", "counter",
+		"Number of external commands that couldn't be run.", metrics.SpawnFailures)
+	writeMetric(bw, "wbrules_timers", "gauge",
+		"Number of active timers.", metrics.Timers)
+	writeMetric(bw, "wbrules_cell_change_queue_length", "gauge",
+		"Number of cell changes waiting to be handled.", metrics.CellChangeQueueLength)
+	writeMetric(bw, "wbrules_cell_change_restarts_total", "counter",
+		"Number of times cell change processing was resumed.", metrics.CellChangeRestarts)
+	bw.WriteString("# HELP wbrules_rule_duration_seconds Execution time of rule callbacks.\n" +
+		"# TYPE wbrules_rule_duration_seconds summary\n")
+	for _, rule := range metrics.Rules {
+		writeRuleDurationSummary(bw, rule.Rule, "condition", rule.Condition)
+		writeRuleDurationSummary(bw, rule.Rule, "then", rule.Then)
+	}
+	return bw.Flush()
+}
+
+// EngineMetricsSource provides the engine metrics
+type EngineMetricsSource interface {
+	EngineMetrics() *EngineMetrics
+}
+
+// MetricsHandler is an HTTP handler that exports the engine
+// metrics for Prometheus at METRICS_PATH, so that the health
+// of the engine can be monitored across a fleet of controllers.
+type MetricsHandler struct {
+	source EngineMetricsSource
+}
+
+func NewMetricsHandler(source EngineMetricsSource) *MetricsHandler {
+	return &MetricsHandler{source}
+}
+
+func (handler *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path != METRICS_PATH:
+		http.NotFound(w, r)
+		return
+	case r.Method != "GET" && r.Method != "HEAD":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	handler.source.EngineMetrics().WritePrometheus(w)
+}
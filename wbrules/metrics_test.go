@@ -0,0 +1,133 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeMetricsSource struct{}
+
+func (source fakeMetricsSource) EngineMetrics() *EngineMetrics {
+	return &EngineMetrics{
+		RuleChecks:            10,
+		RuleFirings:           4,
+		ScriptErrors:          1,
+		SpawnFailures:         2,
+		Timers:                3,
+		CellChangeQueueLength: 5,
+		CellChangeRestarts:    1,
+		Rules: []RuleMetrics{
+			{
+				Rule:      `a "b"`,
+				Condition: RuleDurationStats{Count: 10, TotalMs: 5, MaxMs: 1, P50Ms: 0.5, P90Ms: 0.75, P99Ms: 1},
+				Then:      RuleDurationStats{Count: 4, TotalMs: 40, MaxMs: 25, P50Ms: 5, P90Ms: 25, P99Ms: 25},
+			},
+		},
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	handler := NewMetricsHandler(fakeMetricsSource{})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("bad status: %d", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != METRICS_CONTENT_TYPE {
+		t.Errorf("bad content type: %s", contentType)
+	}
+	expected := `# HELP wbrules_rule_checks_total Number of rule condition checks.
+# TYPE wbrules_rule_checks_total counter
+wbrules_rule_checks_total 10
+# HELP wbrules_rule_firings_total Number of rule then callback invocations.
+# TYPE wbrules_rule_firings_total counter
+wbrules_rule_firings_total 4
+# HELP wbrules_script_errors_total Number of exceptions thrown by script callbacks.
+# TYPE wbrules_script_errors_total counter
+wbrules_script_errors_total 1
+# HELP wbrules_spawn_failures_total Number of external commands that couldn't be run.
+# TYPE wbrules_spawn_failures_total counter
+wbrules_spawn_failures_total 2
+# HELP wbrules_timers Number of active timers.
+# TYPE wbrules_timers gauge
+wbrules_timers 3
+# HELP wbrules_cell_change_queue_length Number of cell changes waiting to be handled.
+# TYPE wbrules_cell_change_queue_length gauge
+wbrules_cell_change_queue_length 5
+# HELP wbrules_cell_change_restarts_total Number of times cell change processing was resumed.
+# TYPE wbrules_cell_change_restarts_total counter
+wbrules_cell_change_restarts_total 1
+# HELP wbrules_rule_duration_seconds Execution time of rule callbacks.
+# TYPE wbrules_rule_duration_seconds summary
+wbrules_rule_duration_seconds{rule="a \"b\"",callback="condition",quantile="0.5"} 0.0005
+wbrules_rule_duration_seconds{rule="a \"b\"",callback="condition",quantile="0.9"} 0.00075
+wbrules_rule_duration_seconds{rule="a \"b\"",callback="condition",quantile="0.99"} 0.001
+wbrules_rule_duration_seconds_sum{rule="a \"b\"",callback="condition"} 0.005
+wbrules_rule_duration_seconds_count{rule="a \"b\"",callback="condition"} 10
+wbrules_rule_duration_seconds{rule="a \"b\"",callback="then",quantile="0.5"} 0.005
+wbrules_rule_duration_seconds{rule="a \"b\"",callback="then",quantile="0.9"} 0.025
+wbrules_rule_duration_seconds{rule="a \"b\"",callback="then",quantile="0.99"} 0.025
+wbrules_rule_duration_seconds_sum{rule="a \"b\"",callback="then"} 0.04
+wbrules_rule_duration_seconds_count{rule="a \"b\"",callback="then"} 4
+`
+	if w.Body.String() != expected {
+		t.Errorf("bad metrics:\n%s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("bad status for unknown path: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/metrics", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("bad status for POST: %d", w.Code)
+	}
+}
+
+func TestEngineMetrics(t *testing.T) {
+	_, engine := newTestEngine(t, nullMQTTClient{})
+	fire := false
+	engine.DefineRule(NewRule(engine, "countedRule", NewLevelTriggeredRuleCondition(func() bool {
+		return fire
+	}), func(args objx.Map) interface{} {
+		return nil
+	}))
+	engine.RunRules(nil, NO_TIMER_NAME)
+	fire = true
+	engine.RunRules(nil, NO_TIMER_NAME)
+	metrics := engine.EngineMetrics()
+	if metrics.RuleChecks != 2 || metrics.RuleFirings != 1 {
+		t.Errorf("bad counters: %d checks, %d firings", metrics.RuleChecks, metrics.RuleFirings)
+	}
+	if len(metrics.Rules) != 1 || metrics.Rules[0].Then.Count != 1 {
+		t.Errorf("bad rule metrics: %#v", metrics.Rules)
+	}
+}
+
+func TestCellChangeQueueLength(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	ch := model.AcquireCellChangeChannel()
+	waitForQueueLength := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for engine.EngineMetrics().CellChangeQueueLength != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for cell change queue length %d (got %d)",
+					n, engine.EngineMetrics().CellChangeQueueLength)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitForQueueLength(0)
+	go model.notify(&CellSpec{"somedev", "a"})
+	go model.notify(&CellSpec{"somedev", "b"})
+	waitForQueueLength(2)
+	<-ch
+	waitForQueueLength(1)
+	<-ch
+	waitForQueueLength(0)
+}
@@ -0,0 +1,104 @@
+package wbrules
+
+import (
+	"fmt"
+	"github.com/ivan4th/go-duktape"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DEFAULT_MODULE_PATH is the default list of directories
+	// searched for the modules loaded by require()
+	DEFAULT_MODULE_PATH = "/etc/wb-rules-modules:/usr/share/wb-rules-modules"
+	MODULE_SUFFIX       = ".js"
+)
+
+// moduleIdRx matches the module ids like "foo", "foo.js" or
+// "lib/foo". Leading '/' and '..' components aren't allowed,
+// so the modules can only be loaded from the module path.
+var moduleIdRx = regexp.MustCompile(`^[\w-]+(?:/[\w-]+)*(?:\.js)?$`)
+
+// SetModulePath sets the list of directories
+// searched for the modules loaded by require()
+func (engine *ESEngine) SetModulePath(dirs []string) {
+	engine.modulePath = make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if dir != "" {
+			engine.modulePath = append(engine.modulePath, filepath.Clean(dir))
+		}
+	}
+}
+
+// ParseModulePath splits the colon-separated module path
+func ParseModulePath(s string) []string {
+	return strings.Split(s, ":")
+}
+
+// resolveModule returns the path of the module file. The first
+// module found in the module path is used.
+func (engine *ESEngine) resolveModule(id string) (string, error) {
+	if !moduleIdRx.MatchString(id) {
+		return "", fmt.Errorf("invalid module id: %s", id)
+	}
+	name := id
+	if !strings.HasSuffix(name, MODULE_SUFFIX) {
+		name += MODULE_SUFFIX
+	}
+	for _, dir := range engine.modulePath {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("module not found: %s", id)
+}
+
+// compileModule pushes the module function onto the stack.
+// The module code is wrapped in a function, so its top-level
+// variables don't get into the global namespace. The wrapper
+// is placed on the first line of the module, so the line
+// numbers in the error messages are kept intact. In case of an
+// error, the error is popped from the stack and returned.
+func (engine *ESEngine) compileModule(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	engine.ctx.PushString(path)
+	src := "function (module, exports, require) {" + string(content) + "\n}"
+	if r := engine.ctx.PcompileStringFilename(duktape.DUK_COMPILE_FUNCTION, src); r != 0 {
+		defer engine.ctx.Pop()
+		return fmt.Errorf("failed to compile %s: %s", path, engine.ctx.SafeToString(-1))
+	}
+	return nil
+}
+
+// esWbModuleResolve returns the path of the module file
+// or null if the module can't be found
+func (engine *ESEngine) esWbModuleResolve() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	if path, err := engine.resolveModule(engine.ctx.GetString(0)); err != nil {
+		engine.ctx.PushNull()
+	} else {
+		engine.ctx.PushString(path)
+	}
+	return 1
+}
+
+// esWbModuleCompile returns the module function
+// or an error message if the module can't be compiled
+func (engine *ESEngine) esWbModuleCompile() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	if err := engine.compileModule(engine.ctx.GetString(0)); err != nil {
+		engine.ctx.PushString(err.Error())
+	}
+	return 1
+}
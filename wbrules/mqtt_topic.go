@@ -0,0 +1,112 @@
+package wbrules
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	SHARED_SUBSCRIPTION_PREFIX = "$share/"
+)
+
+var invalidTopicFilterError = errors.New("invalid MQTT topic filter")
+
+// TopicFilter represents an MQTT subscription topic filter.
+// Besides plain filters such as "zigbee2mqtt/+/action" it supports
+// broker-side shared subscriptions ("$share/group/some/topic/#").
+// Messages that match a shared subscription are distributed by
+// the broker between all the clients that subscribed using the
+// same group name, which makes it possible to load-balance
+// processing of high-volume topics between several engine
+// instances.
+type TopicFilter struct {
+	// Group is the shared subscription group name.
+	// It's empty for ordinary subscriptions.
+	Group string
+	// Filter is the actual topic filter without
+	// the shared subscription prefix.
+	Filter string
+}
+
+// ParseTopicFilter parses and validates MQTT topic filter.
+func ParseTopicFilter(s string) (*TopicFilter, error) {
+	group := ""
+	filter := s
+	if strings.HasPrefix(s, SHARED_SUBSCRIPTION_PREFIX) {
+		parts := strings.SplitN(s[len(SHARED_SUBSCRIPTION_PREFIX):], "/", 2)
+		if len(parts) != 2 || parts[0] == "" ||
+			strings.ContainsAny(parts[0], "+#") {
+			return nil, invalidTopicFilterError
+		}
+		group, filter = parts[0], parts[1]
+	}
+	if !isValidTopicFilter(filter) {
+		return nil, invalidTopicFilterError
+	}
+	return &TopicFilter{group, filter}, nil
+}
+
+func isValidTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for n, level := range levels {
+		switch {
+		case level == "#" && n != len(levels)-1:
+			return false
+		case level == "#" || level == "+":
+			continue
+		case strings.ContainsAny(level, "+#"):
+			return false
+		}
+	}
+	return true
+}
+
+// IsShared returns true if the filter denotes a shared subscription.
+func (tf *TopicFilter) IsShared() bool {
+	return tf.Group != ""
+}
+
+// SubscriptionTopic returns the topic that must be passed to the broker
+// when subscribing.
+func (tf *TopicFilter) SubscriptionTopic() string {
+	if tf.Group == "" {
+		return tf.Filter
+	}
+	return SHARED_SUBSCRIPTION_PREFIX + tf.Group + "/" + tf.Filter
+}
+
+// Match returns true if the specified topic matches the filter.
+// For shared subscriptions, only the filter part is taken
+// into account because the broker delivers messages
+// using their original topics.
+func (tf *TopicFilter) Match(topic string) bool {
+	return TopicMatch(tf.Filter, topic)
+}
+
+// TopicMatch checks whether the topic matches MQTT topic filter
+// which may contain '+' and '#' wildcards.
+func TopicMatch(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	// Topics starting with '$' are not matched by
+	// filters beginning with a wildcard (MQTT 3.1.1, 4.7.2)
+	if strings.HasPrefix(topic, "$") &&
+		(filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+	for n, filterLevel := range filterLevels {
+		if filterLevel == "#" {
+			return true
+		}
+		if n >= len(topicLevels) {
+			return false
+		}
+		if filterLevel != "+" && filterLevel != topicLevels[n] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
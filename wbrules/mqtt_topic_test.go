@@ -0,0 +1,64 @@
+package wbrules
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var topicMatchTests = []struct {
+	filter, topic string
+	match         bool
+}{
+	{"a/b/c", "a/b/c", true},
+	{"a/b/c", "a/b", false},
+	{"a/b", "a/b/c", false},
+	{"a/+/c", "a/b/c", true},
+	{"a/+/c", "a/b/d", false},
+	{"a/#", "a", true},
+	{"a/#", "a/b/c", true},
+	{"#", "a/b/c", true},
+	{"+/+", "a/b", true},
+	{"+/+", "/b", true},
+	{"zigbee2mqtt/+/action", "zigbee2mqtt/switch1/action", true},
+	{"#", "$SYS/broker/uptime", false},
+	{"+/broker/uptime", "$SYS/broker/uptime", false},
+	{"$SYS/#", "$SYS/broker/uptime", true},
+}
+
+func TestTopicMatch(t *testing.T) {
+	for _, tt := range topicMatchTests {
+		assert.Equal(t, tt.match, TopicMatch(tt.filter, tt.topic),
+			"filter %s, topic %s", tt.filter, tt.topic)
+	}
+}
+
+func TestParseTopicFilter(t *testing.T) {
+	tf, err := ParseTopicFilter("zigbee2mqtt/+/action")
+	assert.NoError(t, err)
+	assert.False(t, tf.IsShared())
+	assert.Equal(t, "zigbee2mqtt/+/action", tf.SubscriptionTopic())
+
+	tf, err = ParseTopicFilter("$share/wbrules/some/topic/#")
+	assert.NoError(t, err)
+	assert.True(t, tf.IsShared())
+	assert.Equal(t, "wbrules", tf.Group)
+	assert.Equal(t, "some/topic/#", tf.Filter)
+	assert.Equal(t, "$share/wbrules/some/topic/#", tf.SubscriptionTopic())
+	assert.True(t, tf.Match("some/topic/abc"))
+	assert.False(t, tf.Match("$share/wbrules/some/topic/abc"))
+
+	for _, bad := range []string{
+		"",
+		"a/#/b",
+		"a/b#",
+		"a+/b",
+		"$share/",
+		"$share/group",
+		"$share//a/b",
+		"$share/gr+oup/a/b",
+		"$share/group/a/#/b",
+	} {
+		_, err = ParseTopicFilter(bad)
+		assert.Error(t, err, "filter: %s", bad)
+	}
+}
@@ -0,0 +1,214 @@
+package wbrules
+
+import (
+	wbgo "github.com/contactless/wbgo"
+	duktape "github.com/ivan4th/go-duktape"
+	"github.com/stretchr/objx"
+)
+
+// MQTTTrackHandler receives the messages of a tracked topic
+type MQTTTrackHandler func(msg wbgo.MQTTMessage)
+
+type topicTracker struct {
+	handler MQTTTrackHandler
+	removed bool
+}
+
+// topicSubscription is the broker subscription shared by all
+// the trackers and whenTopic rules that use the same topic filter
+type topicSubscription struct {
+	filter   *TopicFilter
+	trackers []*topicTracker
+	rules    []*Rule
+}
+
+// TopicRuleCondition fires the rule when an MQTT message
+// matching the topic filter is received. The rules are fired
+// by the engine using the topic index, so Check() never fires.
+// The message is passed to the rule as newValue.
+type TopicRuleCondition struct {
+	RuleConditionBase
+	filter *TopicFilter
+}
+
+func NewTopicRuleCondition(filterStr string) (*TopicRuleCondition, error) {
+	filter, err := ParseTopicFilter(filterStr)
+	if err != nil {
+		return nil, err
+	}
+	return &TopicRuleCondition{filter: filter}, nil
+}
+
+// TrackMQTT subscribes to the MQTT topic filter, which may
+// contain wildcards and may denote a shared subscription
+// ("$share/group/topic"), and invokes the handler on the event
+// loop for each message received. Unlike the cells, the topics
+// don't need to follow Wiren Board MQTT conventions. The tracker
+// is removed when the script that added it is reloaded or
+// removed. Must be called on the event loop.
+func (engine *RuleEngine) TrackMQTT(filterStr string, handler MQTTTrackHandler) error {
+	filter, err := ParseTopicFilter(filterStr)
+	if err != nil {
+		return err
+	}
+	topic, sub := engine.ensureTopicSubscription(filter)
+	tracker := &topicTracker{handler: handler}
+	sub.trackers = append(sub.trackers, tracker)
+	engine.cleanup.AddCleanup(func() {
+		engine.untrackMQTT(topic, tracker)
+	})
+	return nil
+}
+
+// ensureTopicSubscription returns the subscription for the
+// topic filter subscribing to the topic if necessary
+func (engine *RuleEngine) ensureTopicSubscription(filter *TopicFilter) (string, *topicSubscription) {
+	topic := filter.SubscriptionTopic()
+	if sub, found := engine.topicSubs[topic]; found {
+		return topic, sub
+	}
+	sub := &topicSubscription{filter: filter}
+	engine.topicSubs[topic] = sub
+	engine.mqttClient.Start()
+	engine.mqttClient.Subscribe(func(msg wbgo.MQTTMessage) {
+		// the messages are handled synchronously
+		// to keep their order
+		if engine.Lifetime().Err() != nil {
+			return
+		}
+		engine.Call(func() {
+			engine.dispatchTopicMessage(topic, msg)
+		})
+	}, topic)
+	return topic, sub
+}
+
+// maybeUnsubscribe removes the subscription that
+// isn't used by any trackers or rules
+func (engine *RuleEngine) maybeUnsubscribe(topic string, sub *topicSubscription) {
+	if len(sub.trackers) > 0 || len(sub.rules) > 0 {
+		return
+	}
+	delete(engine.topicSubs, topic)
+	engine.mqttClient.Unsubscribe(topic)
+}
+
+// setupTopicRules rebuilds the topic index of whenTopic rules
+// after the rules are altered
+func (engine *RuleEngine) setupTopicRules() {
+	for _, sub := range engine.topicSubs {
+		// the list may be in use by dispatchTopicMessage()
+		// if the rules are redefined by a rule, so it's
+		// not modified in place
+		sub.rules = nil
+	}
+	for _, name := range engine.ruleList {
+		rule := engine.ruleMap[name]
+		cond, ok := rule.cond.(*TopicRuleCondition)
+		if !ok {
+			continue
+		}
+		rule.nonCellRule = true
+		_, sub := engine.ensureTopicSubscription(cond.filter)
+		sub.rules = append(sub.rules, rule)
+	}
+	for topic, sub := range engine.topicSubs {
+		engine.maybeUnsubscribe(topic, sub)
+	}
+}
+
+// untrackMQTT removes the tracker unsubscribing from the
+// topic if it was the last tracker using it
+func (engine *RuleEngine) untrackMQTT(topic string, tracker *topicTracker) {
+	sub, found := engine.topicSubs[topic]
+	if !found {
+		return
+	}
+	tracker.removed = true
+	trackers := make([]*topicTracker, 0, len(sub.trackers))
+	for _, t := range sub.trackers {
+		if t != tracker {
+			trackers = append(trackers, t)
+		}
+	}
+	sub.trackers = trackers
+	engine.maybeUnsubscribe(topic, sub)
+}
+
+func (engine *RuleEngine) dispatchTopicMessage(topic string, msg wbgo.MQTTMessage) {
+	sub, found := engine.topicSubs[topic]
+	if !found || !sub.filter.Match(msg.Topic) {
+		return
+	}
+	// the handlers may remove trackers, e.g. by reloading
+	// scripts, and untrackMQTT() doesn't modify the list
+	// in place, so it's safe to iterate over it
+	for _, tracker := range sub.trackers {
+		if !tracker.removed {
+			tracker.handler(msg)
+		}
+	}
+	if len(sub.rules) > 0 {
+		engine.fireTopicRules(sub.rules, msg)
+	}
+}
+
+// fireTopicRules fires the whenTopic rules for the message
+// within a single rule pass
+func (engine *RuleEngine) fireTopicRules(rules []*Rule, msg wbgo.MQTTMessage) {
+	engine.runDepth++
+	defer engine.endRulePass()
+	message := objx.Map{
+		"topic":    msg.Topic,
+		"payload":  msg.Payload,
+		"retained": msg.Retained,
+	}
+	savedProfile := engine.currentProfile
+	for _, rule := range rules {
+		r := rule
+		fire := func() {
+			engine.withCurrentRule(r.name, func() {
+				r.fireMessage(message)
+			})
+		}
+		if r.profile == nil {
+			engine.currentProfile = nil
+			fire()
+		} else {
+			engine.withProfile(r.profile, "rule "+r.name, fire)
+		}
+	}
+	engine.currentProfile = savedProfile
+}
+
+// esWbTrackMqtt subscribes to the MQTT topic. Arguments:
+// topic filter and a callback that receives an object with
+// 'topic', 'payload' and 'retained' properties.
+func (engine *ESEngine) esWbTrackMqtt() int {
+	if engine.ctx.GetTop() != 2 || !engine.ctx.IsString(0) || !engine.ctx.IsFunction(1) {
+		return duktape.DUK_RET_ERROR
+	}
+	filter := engine.ctx.SafeToString(0)
+	if engine.checkSubscribePermission(filter) != nil {
+		return duktape.DUK_RET_ERROR
+	}
+	callbackFn := engine.ctx.WrapCallback(1)
+	profile := engine.currentProfile
+	_, script := engine.logContext()
+	err := engine.TrackMQTT(filter, func(msg wbgo.MQTTMessage) {
+		engine.withProfile(profile, "trackMqtt callback", func() {
+			engine.withCurrentScript(script, func() {
+				callbackFn(objx.Map{
+					"topic":    msg.Topic,
+					"payload":  msg.Payload,
+					"retained": msg.Retained,
+				})
+			})
+		})
+	})
+	if err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "trackMqtt: %s: %s", filter, err)
+		return duktape.DUK_RET_ERROR
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+package wbrules
+
+import (
+	wbgo "github.com/contactless/wbgo"
+	"github.com/stretchr/objx"
+	"reflect"
+	"testing"
+)
+
+type trackTestClient struct {
+	nullMQTTClient
+	handlers     map[string]wbgo.MQTTMessageHandler
+	unsubscribed []string
+}
+
+func (client *trackTestClient) Subscribe(callback wbgo.MQTTMessageHandler, topics ...string) {
+	for _, topic := range topics {
+		client.handlers[topic] = callback
+	}
+}
+
+func (client *trackTestClient) Unsubscribe(topics ...string) {
+	for _, topic := range topics {
+		delete(client.handlers, topic)
+	}
+	client.unsubscribed = append(client.unsubscribed, topics...)
+}
+
+func TestTrackMQTT(t *testing.T) {
+	client := &trackTestClient{handlers: make(map[string]wbgo.MQTTMessageHandler)}
+	_, engine := newTestEngine(t, client)
+
+	var received []string
+	track := func(name, filter string) {
+		if err := engine.TrackMQTT(filter, func(msg wbgo.MQTTMessage) {
+			received = append(received, name+": "+msg.Topic+" "+msg.Payload)
+		}); err != nil {
+			t.Fatalf("TrackMQTT(%s): %s", filter, err)
+		}
+	}
+	engine.cleanup.PushCleanupScope("a.js")
+	track("a", "zigbee2mqtt/+/action")
+	engine.cleanup.PopCleanupScope("a.js")
+	engine.cleanup.PushCleanupScope("b.js")
+	track("b", "zigbee2mqtt/+/action")
+	track("b", "$share/rules/tasmota/#")
+	engine.cleanup.PopCleanupScope("b.js")
+	if err := engine.TrackMQTT("zigbee2mqtt/#/action", func(wbgo.MQTTMessage) {}); err == nil {
+		t.Errorf("no error for an invalid filter")
+	}
+	if len(client.handlers) != 2 {
+		t.Fatalf("bad subscriptions: %v", client.handlers)
+	}
+
+	client.handlers["zigbee2mqtt/+/action"](wbgo.MQTTMessage{Topic: "zigbee2mqtt/button/action", Payload: "single"})
+	client.handlers["$share/rules/tasmota/#"](wbgo.MQTTMessage{Topic: "tasmota/plug/POWER", Payload: "ON"})
+	expected := []string{
+		"a: zigbee2mqtt/button/action single",
+		"b: zigbee2mqtt/button/action single",
+		"b: tasmota/plug/POWER ON",
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("bad messages received: %v", received)
+	}
+
+	received = nil
+	engine.cleanup.RunCleanups("b.js")
+	if !reflect.DeepEqual(client.unsubscribed, []string{"$share/rules/tasmota/#"}) {
+		t.Errorf("bad unsubscriptions: %v", client.unsubscribed)
+	}
+	client.handlers["zigbee2mqtt/+/action"](wbgo.MQTTMessage{Topic: "zigbee2mqtt/button/action", Payload: "double"})
+	if !reflect.DeepEqual(received, []string{"a: zigbee2mqtt/button/action double"}) {
+		t.Errorf("bad messages received after cleanup: %v", received)
+	}
+	engine.cleanup.RunCleanups("a.js")
+	if len(client.handlers) != 0 {
+		t.Errorf("the topics are still subscribed: %v", client.handlers)
+	}
+}
+
+func TestTopicRules(t *testing.T) {
+	client := &trackTestClient{handlers: make(map[string]wbgo.MQTTMessageHandler)}
+	_, engine := newTestEngine(t, client)
+	if _, err := NewTopicRuleCondition("zigbee2mqtt/#/action"); err == nil {
+		t.Errorf("no error for an invalid filter")
+	}
+	cond, err := NewTopicRuleCondition("zigbee2mqtt/+/action")
+	if err != nil {
+		t.Fatalf("NewTopicRuleCondition(): %s", err)
+	}
+	var received []objx.Map
+	engine.DefineRule(NewRule(engine, "action", cond, func(args objx.Map) interface{} {
+		received = append(received, args["newValue"].(objx.Map))
+		return nil
+	}))
+	engine.setupTopicRules()
+	handler, found := client.handlers["zigbee2mqtt/+/action"]
+	if !found {
+		t.Fatalf("the topic isn't subscribed: %v", client.handlers)
+	}
+
+	// the rule isn't fired by ordinary rule passes
+	engine.RunRules(nil, NO_TIMER_NAME)
+	handler(wbgo.MQTTMessage{Topic: "zigbee2mqtt/button/action", Payload: "single", Retained: true})
+	expected := []objx.Map{
+		{"topic": "zigbee2mqtt/button/action", "payload": "single", "retained": true},
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("bad messages received by the rule: %v", received)
+	}
+
+	engine.DefineRule(NewRule(engine, "action", NewLevelTriggeredRuleCondition(func() bool {
+		return false
+	}), nil))
+	engine.setupTopicRules()
+	if len(client.handlers) != 0 || !reflect.DeepEqual(client.unsubscribed, []string{"zigbee2mqtt/+/action"}) {
+		t.Errorf("the topic wasn't unsubscribed: %v", client.unsubscribed)
+	}
+}
@@ -0,0 +1,360 @@
+package wbrules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DisposaBoy/JsonConfigReader"
+	"github.com/ivan4th/go-duktape"
+	"github.com/stretchr/objx"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NOTIFY_CHANNEL_EMAIL     = "email"
+	NOTIFY_CHANNEL_TELEGRAM  = "telegram"
+	NOTIFY_CHANNEL_WEBHOOK   = "webhook"
+	DEFAULT_TELEGRAM_API_URL = "https://api.telegram.org"
+	NOTIFY_SEND_TIMEOUT      = 30 * time.Second
+)
+
+var rateLimitExceededError = errors.New("rate limit exceeded")
+
+// Notification is a message sent via a notification channel.
+// The meaning of To depends on the channel: it's an email
+// address for email and a chat id for Telegram.
+type Notification struct {
+	Channel string `json:"channel"`
+	To      string `json:"to,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Text    string `json:"text"`
+}
+
+// NotificationTransport delivers the notifications
+type NotificationTransport interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+// RateLimitConfig limits the number of notifications sent
+// via a channel to Count per Interval (e.g. "1m")
+type RateLimitConfig struct {
+	Count    int    `json:"count"`
+	Interval string `json:"interval"`
+}
+
+type SMTPConfig struct {
+	// Server is host:port of the SMTP server
+	Server    string           `json:"server"`
+	Username  string           `json:"username"`
+	Password  string           `json:"password"`
+	From      string           `json:"from"`
+	RateLimit *RateLimitConfig `json:"rateLimit"`
+}
+
+type TelegramConfig struct {
+	Token     string           `json:"token"`
+	APIURL    string           `json:"apiUrl"`
+	RateLimit *RateLimitConfig `json:"rateLimit"`
+}
+
+type WebhookConfig struct {
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers"`
+	RateLimit *RateLimitConfig  `json:"rateLimit"`
+}
+
+// NotificationConfig describes the notification channels.
+// The channels that aren't specified are disabled.
+type NotificationConfig struct {
+	Email    *SMTPConfig     `json:"email"`
+	Telegram *TelegramConfig `json:"telegram"`
+	Webhook  *WebhookConfig  `json:"webhook"`
+}
+
+// LoadNotificationConfig loads the notification config file.
+// The file is JSON with comments allowed.
+func LoadNotificationConfig(path string) (*NotificationConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config := &NotificationConfig{}
+	if err = json.NewDecoder(JsonConfigReader.New(f)).Decode(config); err != nil {
+		return nil, fmt.Errorf("error parsing notification config %s: %s", path, err)
+	}
+	return config, nil
+}
+
+type smtpTransport struct {
+	config SMTPConfig
+}
+
+func (transport *smtpTransport) Send(ctx context.Context, n Notification) error {
+	var auth smtp.Auth
+	if transport.config.Username != "" {
+		host := strings.SplitN(transport.config.Server, ":", 2)[0]
+		auth = smtp.PlainAuth("", transport.config.Username, transport.config.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		transport.config.From, n.To, n.Subject, n.Text)
+	return smtp.SendMail(transport.config.Server, auth, transport.config.From, []string{n.To}, []byte(msg))
+}
+
+func postJSON(ctx context.Context, url string, headers map[string]string, body interface{}) ([]byte, error) {
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return respBody, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return respBody, nil
+}
+
+type telegramTransport struct {
+	config TelegramConfig
+}
+
+func (transport *telegramTransport) Send(ctx context.Context, n Notification) error {
+	apiURL := transport.config.APIURL
+	if apiURL == "" {
+		apiURL = DEFAULT_TELEGRAM_API_URL
+	}
+	respBody, err := postJSON(ctx, strings.TrimSuffix(apiURL, "/")+"/bot"+transport.config.Token+"/sendMessage",
+		nil, map[string]string{"chat_id": n.To, "text": n.Text})
+	var resp struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if respBody != nil && json.Unmarshal(respBody, &resp) == nil && !resp.OK && resp.Description != "" {
+		// Telegram API error messages are more useful
+		// than HTTP status codes
+		return errors.New(resp.Description)
+	}
+	return err
+}
+
+type webhookTransport struct {
+	config WebhookConfig
+}
+
+func (transport *webhookTransport) Send(ctx context.Context, n Notification) error {
+	_, err := postJSON(ctx, transport.config.URL, transport.config.Headers, n)
+	return err
+}
+
+// rateLimiter allows at most count events per interval
+type rateLimiter struct {
+	count    int
+	interval time.Duration
+	events   []time.Time
+}
+
+func newRateLimiter(config *RateLimitConfig) (*rateLimiter, error) {
+	if config == nil {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(config.Interval)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("invalid rate limit interval: %s", err)
+	case config.Count <= 0 || interval <= 0:
+		return nil, fmt.Errorf("invalid rate limit: %d per %s", config.Count, config.Interval)
+	}
+	return &rateLimiter{config.Count, interval, make([]time.Time, 0, config.Count)}, nil
+}
+
+func (limiter *rateLimiter) allow(now time.Time) bool {
+	n := 0
+	for n < len(limiter.events) && now.Sub(limiter.events[n]) >= limiter.interval {
+		n++
+	}
+	limiter.events = append(limiter.events[:0], limiter.events[n:]...)
+	if len(limiter.events) >= limiter.count {
+		return false
+	}
+	limiter.events = append(limiter.events, now)
+	return true
+}
+
+type notifyChannel struct {
+	transport NotificationTransport
+	limiter   *rateLimiter
+}
+
+// Notifier sends the notifications via the configured channels
+type Notifier struct {
+	sync.Mutex
+	channels map[string]*notifyChannel
+	now      func() time.Time
+}
+
+func newNotifier() *Notifier {
+	return &Notifier{channels: make(map[string]*notifyChannel), now: time.Now}
+}
+
+// NewNotifier creates a notifier for the channels
+// specified in the config
+func NewNotifier(config *NotificationConfig) (*Notifier, error) {
+	notifier := newNotifier()
+	var err error
+	if config.Email != nil {
+		if config.Email.Server == "" || config.Email.From == "" {
+			return nil, errors.New("email: server and from must be specified")
+		}
+		err = notifier.AddChannel(NOTIFY_CHANNEL_EMAIL, &smtpTransport{*config.Email}, config.Email.RateLimit)
+	}
+	if err == nil && config.Telegram != nil {
+		if config.Telegram.Token == "" {
+			return nil, errors.New("telegram: token must be specified")
+		}
+		err = notifier.AddChannel(NOTIFY_CHANNEL_TELEGRAM, &telegramTransport{*config.Telegram}, config.Telegram.RateLimit)
+	}
+	if err == nil && config.Webhook != nil {
+		if config.Webhook.URL == "" {
+			return nil, errors.New("webhook: url must be specified")
+		}
+		err = notifier.AddChannel(NOTIFY_CHANNEL_WEBHOOK, &webhookTransport{*config.Webhook}, config.Webhook.RateLimit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return notifier, nil
+}
+
+// AddChannel adds a notification channel with an optional rate limit
+func (notifier *Notifier) AddChannel(name string, transport NotificationTransport, rateLimit *RateLimitConfig) error {
+	limiter, err := newRateLimiter(rateLimit)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	notifier.Lock()
+	defer notifier.Unlock()
+	notifier.channels[name] = &notifyChannel{transport, limiter}
+	return nil
+}
+
+// HasChannel returns true if the channel is configured
+func (notifier *Notifier) HasChannel(name string) bool {
+	notifier.Lock()
+	defer notifier.Unlock()
+	_, found := notifier.channels[name]
+	return found
+}
+
+// Send sends the notification via its channel. The notifications
+// exceeding the rate limit of the channel are dropped.
+func (notifier *Notifier) Send(ctx context.Context, n Notification) error {
+	notifier.Lock()
+	channel, found := notifier.channels[n.Channel]
+	allowed := found && (channel.limiter == nil || channel.limiter.allow(notifier.now()))
+	notifier.Unlock()
+	switch {
+	case !found:
+		return fmt.Errorf("notification channel not configured: %s", n.Channel)
+	case !allowed:
+		return rateLimitExceededError
+	}
+	ctx, cancel := context.WithTimeout(ctx, NOTIFY_SEND_TIMEOUT)
+	defer cancel()
+	return channel.transport.Send(ctx, n)
+}
+
+// SetNotifier sets the notifier used by Notify.* functions
+func (engine *ESEngine) SetNotifier(notifier *Notifier) {
+	engine.notifier = notifier
+}
+
+// esWbHasNotifyChannel returns true if the
+// notification channel is configured
+func (engine *ESEngine) esWbHasNotifyChannel() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.ctx.PushBoolean(engine.notifier != nil && engine.notifier.HasChannel(engine.ctx.GetString(0)))
+	return 1
+}
+
+// esWbNotify sends a notification in background. The callback
+// receives an object with 'error' property that's null if
+// the notification was sent successfully. The function returns
+// an error message or null if the notification can't be sent
+// at all.
+func (engine *ESEngine) esWbNotify() int {
+	if engine.ctx.GetTop() != 5 || !engine.ctx.IsString(0) || !engine.ctx.IsString(1) ||
+		!engine.ctx.IsString(2) || !engine.ctx.IsString(3) {
+		return duktape.DUK_RET_ERROR
+	}
+	n := Notification{
+		Channel: engine.ctx.GetString(0),
+		To:      engine.ctx.GetString(1),
+		Subject: engine.ctx.GetString(2),
+		Text:    engine.ctx.GetString(3),
+	}
+	callbackFn := ESCallbackFunc(nil)
+	if engine.ctx.IsFunction(4) {
+		callbackFn = engine.ctx.WrapCallback(4)
+	} else if !engine.ctx.IsNullOrUndefined(4) {
+		return duktape.DUK_RET_ERROR
+	}
+	// all the notification channels send the messages over the network
+	err := engine.checkPermission("sending notifications via "+n.Channel, func(profile *ExecProfile) bool {
+		return profile.AllowNetwork
+	})
+	switch {
+	case err != nil:
+		engine.ctx.PushString(err.Error())
+		return 1
+	case engine.notifier == nil || !engine.notifier.HasChannel(n.Channel):
+		engine.ctx.PushString("notification channel not configured: " + n.Channel)
+		return 1
+	}
+	profile := engine.currentProfile
+	lifetime := engine.Lifetime()
+	notifier := engine.notifier
+	engine.goBackground(func() {
+		err := notifier.Send(lifetime, n)
+		if lifetime.Err() != nil || callbackFn == nil {
+			return
+		}
+		engine.Call(func() {
+			args := objx.New(map[string]interface{}{"error": nil})
+			if err != nil {
+				args["error"] = err.Error()
+			}
+			engine.withProfile(profile, "notification callback", func() {
+				callbackFn(args)
+			})
+		})
+	})
+	engine.ctx.PushNull()
+	return 1
+}
@@ -0,0 +1,152 @@
+package wbrules
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeNotificationTransport struct {
+	sent []Notification
+}
+
+func (transport *fakeNotificationTransport) Send(ctx context.Context, n Notification) error {
+	transport.sent = append(transport.sent, n)
+	return nil
+}
+
+func TestNotifierRateLimit(t *testing.T) {
+	notifier := newNotifier()
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	notifier.now = func() time.Time { return now }
+	transport := &fakeNotificationTransport{}
+	if err := notifier.AddChannel("fake", transport, &RateLimitConfig{2, "1m"}); err != nil {
+		t.Fatalf("AddChannel(): %s", err)
+	}
+	send := func() error {
+		return notifier.Send(context.Background(), Notification{Channel: "fake", Text: "hello"})
+	}
+	for i, expected := range []error{nil, nil, rateLimitExceededError} {
+		if err := send(); err != expected {
+			t.Errorf("send #%d: %v instead of %v", i+1, err, expected)
+		}
+	}
+	now = now.Add(time.Minute)
+	if err := send(); err != nil {
+		t.Errorf("send after the rate limit interval: %s", err)
+	}
+	if len(transport.sent) != 3 {
+		t.Errorf("%d notifications sent instead of 3", len(transport.sent))
+	}
+	if err := notifier.Send(context.Background(), Notification{Channel: "nosuchchannel"}); err == nil {
+		t.Errorf("no error for an unknown channel")
+	}
+	if err := notifier.AddChannel("bad", transport, &RateLimitConfig{1, "blah"}); err == nil {
+		t.Errorf("no error for an invalid rate limit")
+	}
+}
+
+func TestTelegramTransport(t *testing.T) {
+	var request map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/botsecret/sendMessage" {
+			t.Errorf("bad request path: %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("error decoding the request: %s", err)
+		}
+		if request["chat_id"] == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"ok":false,"description":"Bad Request: chat not found"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	transport := &telegramTransport{TelegramConfig{Token: "secret", APIURL: server.URL}}
+	if err := transport.Send(context.Background(), Notification{To: "42", Text: "hello"}); err != nil {
+		t.Fatalf("Send(): %s", err)
+	}
+	if request["chat_id"] != "42" || request["text"] != "hello" {
+		t.Errorf("bad request: %#v", request)
+	}
+	err := transport.Send(context.Background(), Notification{To: "bad", Text: "hello"})
+	if err == nil || err.Error() != "Bad Request: chat not found" {
+		t.Errorf("bad error: %v", err)
+	}
+}
+
+func TestWebhookTransport(t *testing.T) {
+	var received Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "abc" {
+			t.Errorf("bad X-Token header: %q", r.Header.Get("X-Token"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("error decoding the request: %s", err)
+		}
+		if received.Text == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	transport := &webhookTransport{WebhookConfig{URL: server.URL, Headers: map[string]string{"X-Token": "abc"}}}
+	n := Notification{Channel: NOTIFY_CHANNEL_WEBHOOK, Text: "hello"}
+	if err := transport.Send(context.Background(), n); err != nil {
+		t.Fatalf("Send(): %s", err)
+	}
+	if received != n {
+		t.Errorf("bad notification received: %#v", received)
+	}
+	if err := transport.Send(context.Background(), Notification{Text: "fail"}); err == nil {
+		t.Errorf("no error for HTTP 500")
+	}
+}
+
+func TestLoadNotificationConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifytest")
+	if err != nil {
+		t.Fatalf("TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify.conf")
+	err = ioutil.WriteFile(path, []byte(`{
+  // comments are allowed
+  "telegram": {
+    "token": "secret",
+    "rateLimit": { "count": 10, "interval": "1m" }
+  },
+  "webhook": { "url": "http://localhost/hook" }
+}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile(): %s", err)
+	}
+	config, err := LoadNotificationConfig(path)
+	if err != nil {
+		t.Fatalf("LoadNotificationConfig(): %s", err)
+	}
+	notifier, err := NewNotifier(config)
+	if err != nil {
+		t.Fatalf("NewNotifier(): %s", err)
+	}
+	for channel, expected := range map[string]bool{
+		NOTIFY_CHANNEL_EMAIL:    false,
+		NOTIFY_CHANNEL_TELEGRAM: true,
+		NOTIFY_CHANNEL_WEBHOOK:  true,
+	} {
+		if notifier.HasChannel(channel) != expected {
+			t.Errorf("HasChannel(%q) != %v", channel, expected)
+		}
+	}
+	if _, err := NewNotifier(&NotificationConfig{Telegram: &TelegramConfig{}}); err == nil {
+		t.Errorf("no error for telegram config without token")
+	}
+}
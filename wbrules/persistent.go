@@ -0,0 +1,189 @@
+package wbrules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	STORAGE_BACKEND_JSON   = "json"
+	STORAGE_BACKEND_BOLT   = "bolt"
+	STORAGE_BACKEND_SQLITE = "sqlite"
+)
+
+// Storage keeps values that must survive engine restarts.
+// Values are grouped in named buckets. Values must be
+// JSON-serializable. Numbers may be returned as float64
+// regardless of the type of the value passed to Set().
+type Storage interface {
+	// Get returns the value of the specified key in the bucket.
+	// The second return value is false if there's no such key.
+	Get(bucket, key string) (interface{}, bool)
+	// Set stores the value for the specified key in the bucket.
+	// nil value removes the key.
+	Set(bucket, key string, value interface{}) error
+	// Export returns the copy of the storage contents
+	Export() (StorageData, error)
+	// Close releases the resources used by the storage
+	Close() error
+}
+
+// StorageData maps bucket names to bucket contents
+type StorageData map[string]map[string]interface{}
+
+// OpenStorage opens the storage of the specified kind.
+// JSON storage keeps everything in memory and rewrites the
+// whole file on every change, which is simple but wears out
+// flash memory faster than the database backends that only
+// write the changed pages.
+func OpenStorage(backend, path string) (Storage, error) {
+	switch backend {
+	case STORAGE_BACKEND_JSON:
+		return NewJSONStorage(path)
+	case STORAGE_BACKEND_BOLT:
+		return openBoltStorage(path)
+	case STORAGE_BACKEND_SQLITE:
+		return openSQLiteStorage(path)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", backend)
+	}
+}
+
+type persistentBucket map[string]interface{}
+
+// JSONStorage is a storage that keeps the values in a JSON file.
+// If the file path is empty, values are only kept in memory.
+type JSONStorage struct {
+	sync.Mutex
+	path    string
+	buckets map[string]persistentBucket
+}
+
+// NewJSONStorage creates a storage backed by the
+// specified file. A missing file is treated as an empty storage.
+func NewJSONStorage(path string) (*JSONStorage, error) {
+	storage := &JSONStorage{
+		path:    path,
+		buckets: make(map[string]persistentBucket),
+	}
+	if path == "" {
+		return storage, nil
+	}
+	bs, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return storage, nil
+	case err != nil:
+		return nil, err
+	}
+	if err = json.Unmarshal(bs, &storage.buckets); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func (storage *JSONStorage) Get(bucket, key string) (interface{}, bool) {
+	storage.Lock()
+	defer storage.Unlock()
+	b, found := storage.buckets[bucket]
+	if !found {
+		return nil, false
+	}
+	value, found := b[key]
+	return value, found
+}
+
+func (storage *JSONStorage) Set(bucket, key string, value interface{}) error {
+	storage.Lock()
+	defer storage.Unlock()
+	b, found := storage.buckets[bucket]
+	switch {
+	case value == nil && !found:
+		return nil
+	case value == nil:
+		delete(b, key)
+		if len(b) == 0 {
+			delete(storage.buckets, bucket)
+		}
+	case !found:
+		b = make(persistentBucket)
+		storage.buckets[bucket] = b
+		fallthrough
+	default:
+		b[key] = value
+	}
+	return storage.save()
+}
+
+// save writes the storage contents to a temporary file that's
+// then renamed, so the storage file is never left half-written
+func (storage *JSONStorage) save() error {
+	if storage.path == "" {
+		return nil
+	}
+	bs, err := json.Marshal(storage.buckets)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(storage.path), 0755); err != nil {
+		return err
+	}
+	tmpPath := storage.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, storage.path)
+}
+
+func (storage *JSONStorage) Export() (StorageData, error) {
+	storage.Lock()
+	defer storage.Unlock()
+	data := make(StorageData)
+	for name, b := range storage.buckets {
+		items := make(map[string]interface{})
+		for k, v := range b {
+			items[k] = v
+		}
+		data[name] = items
+	}
+	return data, nil
+}
+
+func (storage *JSONStorage) Close() error {
+	// all changes are written immediately
+	return nil
+}
+
+// StorageKeys returns the sorted list of the keys
+// of the specified bucket
+func StorageKeys(storage Storage, bucket string) ([]string, error) {
+	data, err := storage.Export()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(data[bucket]))
+	for key := range data[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// marshalStorageValue and unmarshalStorageValue are used by
+// database backends that keep values as JSON strings
+func marshalStorageValue(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func unmarshalStorageValue(bs []byte) (interface{}, bool) {
+	var value interface{}
+	if err := json.Unmarshal(bs, &value); err != nil {
+		return nil, false
+	}
+	return value, true
+}
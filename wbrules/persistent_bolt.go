@@ -0,0 +1,106 @@
+//go:build bolt
+// +build bolt
+
+package wbrules
+
+import (
+	"github.com/boltdb/bolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const BOLT_OPEN_TIMEOUT = 5 * time.Second
+
+// BoltStorage is a storage that keeps the values in a BoltDB
+// database. Each storage bucket is a BoltDB bucket.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+func openBoltStorage(path string) (Storage, error) {
+	storage, err := NewBoltStorage(path)
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: BOLT_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStorage{db}, nil
+}
+
+func (storage *BoltStorage) Get(bucket, key string) (value interface{}, found bool) {
+	storage.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		if bs := b.Get([]byte(key)); bs != nil {
+			value, found = unmarshalStorageValue(bs)
+		}
+		return nil
+	})
+	return
+}
+
+func (storage *BoltStorage) Set(bucket, key string, value interface{}) error {
+	if value == nil {
+		return storage.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				return nil
+			}
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+			if k, _ := b.Cursor().First(); k == nil {
+				return tx.DeleteBucket([]byte(bucket))
+			}
+			return nil
+		})
+	}
+	bs, err := marshalStorageValue(value)
+	if err != nil {
+		return err
+	}
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), bs)
+	})
+}
+
+func (storage *BoltStorage) Export() (StorageData, error) {
+	data := make(StorageData)
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			items := make(map[string]interface{})
+			b.ForEach(func(k, bs []byte) error {
+				if value, ok := unmarshalStorageValue(bs); ok {
+					items[string(k)] = value
+				}
+				return nil
+			})
+			data[string(name)] = items
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (storage *BoltStorage) Close() error {
+	return storage.db.Close()
+}
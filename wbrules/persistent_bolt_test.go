@@ -0,0 +1,12 @@
+//go:build bolt
+// +build bolt
+
+package wbrules
+
+import "testing"
+
+func TestBoltStorage(t *testing.T) {
+	verifyStorage(t, "persistent.db", func(path string) (Storage, error) {
+		return OpenStorage(STORAGE_BACKEND_BOLT, path)
+	})
+}
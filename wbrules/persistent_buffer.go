@@ -0,0 +1,202 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo"
+	"sync"
+	"time"
+)
+
+// StorageStats contains persistent storage write metrics
+type StorageStats struct {
+	// Sets is the number of values stored by the scripts
+	Sets uint64 `json:"sets"`
+	// Writes is the number of values written to the backend
+	Writes uint64 `json:"writes"`
+	// Flushes is the number of flushes that wrote anything
+	Flushes uint64 `json:"flushes"`
+	// BytesWritten is the total size of the JSON-encoded
+	// values written to the backend
+	BytesWritten uint64 `json:"bytesWritten"`
+}
+
+type storageKey struct {
+	bucket, key string
+}
+
+// BufferedStorage reduces flash memory wear by coalescing the
+// writes to the underlying storage. Values are kept in memory
+// and written to the underlying storage periodically, so only
+// the last value of a frequently changing key is written.
+// Pending values are also written when Flush() or Close()
+// is called, the latter should be done on shutdown.
+type BufferedStorage struct {
+	sync.Mutex
+	storage Storage
+	pending map[storageKey]interface{}
+	stats   StorageStats
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// NewBufferedStorage creates a storage that flushes the pending
+// values to the specified storage at the specified interval.
+// Zero interval means that values are only written
+// upon explicit Flush() or Close() calls.
+func NewBufferedStorage(storage Storage, interval time.Duration) *BufferedStorage {
+	bs := &BufferedStorage{
+		storage: storage,
+		pending: make(map[storageKey]interface{}),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(bs.doneCh)
+		return bs
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer close(bs.doneCh)
+		for {
+			select {
+			case <-ticker.C:
+				if err := bs.Flush(); err != nil {
+					wbgo.Error.Printf("error flushing persistent storage: %s", err)
+				}
+			case <-bs.stopCh:
+				return
+			}
+		}
+	}()
+	return bs
+}
+
+func (bs *BufferedStorage) Get(bucket, key string) (interface{}, bool) {
+	bs.Lock()
+	value, found := bs.pending[storageKey{bucket, key}]
+	bs.Unlock()
+	if found {
+		// nil means a pending removal
+		return value, value != nil
+	}
+	return bs.storage.Get(bucket, key)
+}
+
+func (bs *BufferedStorage) Set(bucket, key string, value interface{}) error {
+	bs.Lock()
+	defer bs.Unlock()
+	bs.pending[storageKey{bucket, key}] = value
+	bs.stats.Sets++
+	return nil
+}
+
+// Export returns the contents of the underlying
+// storage updated with the pending values
+func (bs *BufferedStorage) Export() (StorageData, error) {
+	bs.Lock()
+	defer bs.Unlock()
+	data, err := bs.storage.Export()
+	if err != nil {
+		return nil, err
+	}
+	for k, value := range bs.pending {
+		items := data[k.bucket]
+		switch {
+		case value != nil && items == nil:
+			items = make(map[string]interface{})
+			data[k.bucket] = items
+			fallthrough
+		case value != nil:
+			items[k.key] = value
+		case items != nil:
+			delete(items, k.key)
+			if len(items) == 0 {
+				delete(data, k.bucket)
+			}
+		}
+	}
+	return data, nil
+}
+
+// Flush writes the pending values to the underlying storage.
+// Values that failed to be written are kept pending.
+func (bs *BufferedStorage) Flush() error {
+	bs.Lock()
+	defer bs.Unlock()
+	if len(bs.pending) == 0 {
+		return nil
+	}
+	var firstErr error
+	for k, value := range bs.pending {
+		if err := bs.storage.Set(k.bucket, k.key, value); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		delete(bs.pending, k)
+		bs.stats.Writes++
+		if value != nil {
+			if encoded, err := marshalStorageValue(value); err == nil {
+				bs.stats.BytesWritten += uint64(len(encoded))
+			}
+		}
+	}
+	bs.stats.Flushes++
+	return firstErr
+}
+
+// Stats returns storage write metrics
+func (bs *BufferedStorage) Stats() StorageStats {
+	bs.Lock()
+	defer bs.Unlock()
+	return bs.stats
+}
+
+// Close flushes the pending values and closes
+// the underlying storage
+func (bs *BufferedStorage) Close() error {
+	select {
+	case <-bs.stopCh:
+		// already closed
+		return nil
+	default:
+		close(bs.stopCh)
+	}
+	<-bs.doneCh
+	err := bs.Flush()
+	if closeErr := bs.storage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// StorageStatsSource provides persistent storage metrics
+type StorageStatsSource interface {
+	PersistentStorageStats() (StorageStats, bool)
+}
+
+// PersistenceStats is an RPC service that provides
+// persistent storage write metrics
+type PersistenceStats struct {
+	source StorageStatsSource
+}
+
+func NewPersistenceStats(source StorageStatsSource) *PersistenceStats {
+	return &PersistenceStats{source}
+}
+
+type PersistenceStatsGetArgs struct{}
+
+type PersistenceStatsGetResponse struct {
+	// Buffered is false when write batching is disabled.
+	// Metrics aren't collected in this case.
+	Buffered bool         `json:"buffered"`
+	Stats    StorageStats `json:"stats"`
+}
+
+func (ps *PersistenceStats) Get(args *PersistenceStatsGetArgs, reply *PersistenceStatsGetResponse) error {
+	stats, buffered := ps.source.PersistentStorageStats()
+	*reply = PersistenceStatsGetResponse{buffered, stats}
+	return nil
+}
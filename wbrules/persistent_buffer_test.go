@@ -0,0 +1,75 @@
+package wbrules
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type countingStorage struct {
+	*JSONStorage
+	sets   int
+	closed bool
+	fail   bool
+}
+
+func (storage *countingStorage) Set(bucket, key string, value interface{}) error {
+	if storage.fail {
+		return errors.New("write failed")
+	}
+	storage.sets++
+	return storage.JSONStorage.Set(bucket, key, value)
+}
+
+func (storage *countingStorage) Close() error {
+	storage.closed = true
+	return nil
+}
+
+func TestBufferedStorage(t *testing.T) {
+	mem, _ := NewJSONStorage("")
+	backend := &countingStorage{JSONStorage: mem}
+	assert.NoError(t, backend.JSONStorage.Set("b", "removed", "x"))
+	storage := NewBufferedStorage(backend, 0)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, storage.Set("b", "counter", float64(i)))
+	}
+	assert.NoError(t, storage.Set("b", "removed", nil))
+	assert.Equal(t, 0, backend.sets)
+
+	// pending values are visible before flushing
+	value, found := storage.Get("b", "counter")
+	assert.True(t, found)
+	assert.Equal(t, float64(9), value)
+	_, found = storage.Get("b", "removed")
+	assert.False(t, found)
+	data, err := storage.Export()
+	if assert.NoError(t, err) {
+		assert.Equal(t, StorageData{"b": {"counter": float64(9)}}, data)
+	}
+
+	assert.NoError(t, storage.Flush())
+	assert.Equal(t, 2, backend.sets)
+	value, found = backend.Get("b", "counter")
+	assert.True(t, found)
+	assert.Equal(t, float64(9), value)
+	_, found = backend.Get("b", "removed")
+	assert.False(t, found)
+	assert.Equal(t, StorageStats{Sets: 11, Writes: 2, Flushes: 1, BytesWritten: 1}, storage.Stats())
+
+	// nothing to flush
+	assert.NoError(t, storage.Flush())
+	assert.Equal(t, uint64(1), storage.Stats().Flushes)
+
+	// failed writes are retried
+	backend.fail = true
+	assert.NoError(t, storage.Set("b", "counter", float64(42)))
+	assert.Error(t, storage.Flush())
+	backend.fail = false
+
+	assert.NoError(t, storage.Close())
+	assert.True(t, backend.closed)
+	value, _ = backend.Get("b", "counter")
+	assert.Equal(t, float64(42), value)
+}
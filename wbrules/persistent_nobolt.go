@@ -0,0 +1,12 @@
+//go:build !bolt
+// +build !bolt
+
+package wbrules
+
+import "errors"
+
+// BoltDB backend is only available when wb-rules
+// is built with the 'bolt' tag
+func openBoltStorage(path string) (Storage, error) {
+	return nil, errors.New("bolt storage backend isn't compiled in (build with -tags bolt)")
+}
@@ -0,0 +1,12 @@
+//go:build !sqlite
+// +build !sqlite
+
+package wbrules
+
+import "errors"
+
+// SQLite backend is only available when wb-rules is built
+// with the 'sqlite' tag, as the driver requires cgo
+func openSQLiteStorage(path string) (Storage, error) {
+	return nil, errors.New("sqlite storage backend isn't compiled in (build with -tags sqlite)")
+}
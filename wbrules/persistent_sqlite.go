@@ -0,0 +1,106 @@
+//go:build sqlite
+// +build sqlite
+
+package wbrules
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"path/filepath"
+)
+
+const sqliteStorageSchema = `
+CREATE TABLE IF NOT EXISTS persistent (
+  bucket TEXT NOT NULL,
+  key TEXT NOT NULL,
+  value TEXT NOT NULL,
+  PRIMARY KEY (bucket, key)
+)`
+
+// SQLiteStorage is a storage that keeps the values in an
+// SQLite database
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+func openSQLiteStorage(path string) (Storage, error) {
+	storage, err := NewSQLiteStorage(path)
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func NewSQLiteStorage(path string) (*SQLiteStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite doesn't support concurrent writes
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(sqliteStorageSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStorage{db}, nil
+}
+
+func (storage *SQLiteStorage) Get(bucket, key string) (interface{}, bool) {
+	var s string
+	err := storage.db.QueryRow(
+		"SELECT value FROM persistent WHERE bucket = ? AND key = ?",
+		bucket, key).Scan(&s)
+	if err != nil {
+		return nil, false
+	}
+	return unmarshalStorageValue([]byte(s))
+}
+
+func (storage *SQLiteStorage) Set(bucket, key string, value interface{}) error {
+	if value == nil {
+		_, err := storage.db.Exec(
+			"DELETE FROM persistent WHERE bucket = ? AND key = ?",
+			bucket, key)
+		return err
+	}
+	bs, err := marshalStorageValue(value)
+	if err != nil {
+		return err
+	}
+	_, err = storage.db.Exec(
+		"INSERT OR REPLACE INTO persistent (bucket, key, value) VALUES (?, ?, ?)",
+		bucket, key, string(bs))
+	return err
+}
+
+func (storage *SQLiteStorage) Export() (StorageData, error) {
+	rows, err := storage.db.Query("SELECT bucket, key, value FROM persistent")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	data := make(StorageData)
+	for rows.Next() {
+		var bucket, key, s string
+		if err = rows.Scan(&bucket, &key, &s); err != nil {
+			return nil, err
+		}
+		value, ok := unmarshalStorageValue([]byte(s))
+		if !ok {
+			continue
+		}
+		if data[bucket] == nil {
+			data[bucket] = make(map[string]interface{})
+		}
+		data[bucket][key] = value
+	}
+	return data, rows.Err()
+}
+
+func (storage *SQLiteStorage) Close() error {
+	return storage.db.Close()
+}
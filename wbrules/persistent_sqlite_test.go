@@ -0,0 +1,12 @@
+//go:build sqlite
+// +build sqlite
+
+package wbrules
+
+import "testing"
+
+func TestSQLiteStorage(t *testing.T) {
+	verifyStorage(t, "persistent.sqlite", func(path string) (Storage, error) {
+		return OpenStorage(STORAGE_BACKEND_SQLITE, path)
+	})
+}
@@ -0,0 +1,93 @@
+package wbrules
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func verifyStorage(t *testing.T, fileName string, open func(path string) (Storage, error)) {
+	dir, err := ioutil.TempDir("", "wbrules-persistent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", fileName)
+
+	storage, err := open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, found := storage.Get("b1", "k1")
+	assert.False(t, found)
+
+	assert.NoError(t, storage.Set("b1", "k1", "abc"))
+	assert.NoError(t, storage.Set("b1", "k2", float64(42)))
+	assert.NoError(t, storage.Set("b2", "k1", true))
+	assert.NoError(t, storage.Set("b2", "k1", nil))
+	assert.NoError(t, storage.Set("b3", "k1", nil))
+	assert.NoError(t, storage.Close())
+
+	storage, err = open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer storage.Close()
+	for _, item := range []struct {
+		bucket, key string
+		value       interface{}
+		found       bool
+	}{
+		{"b1", "k1", "abc", true},
+		{"b1", "k2", float64(42), true},
+		{"b2", "k1", nil, false},
+		{"b3", "k1", nil, false},
+	} {
+		value, found := storage.Get(item.bucket, item.key)
+		assert.Equal(t, item.found, found, "%s/%s", item.bucket, item.key)
+		assert.Equal(t, item.value, value, "%s/%s", item.bucket, item.key)
+	}
+
+	data, err := storage.Export()
+	if assert.NoError(t, err) {
+		assert.Equal(t, StorageData{
+			"b1": {"k1": "abc", "k2": float64(42)},
+		}, data)
+	}
+}
+
+func TestPersistentStorage(t *testing.T) {
+	verifyStorage(t, "persistent.json", func(path string) (Storage, error) {
+		return NewJSONStorage(path)
+	})
+}
+
+func TestInMemoryPersistentStorage(t *testing.T) {
+	storage, err := NewJSONStorage("")
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Set("b", "k", "v"))
+	value, found := storage.Get("b", "k")
+	assert.True(t, found)
+	assert.Equal(t, "v", value)
+}
+
+func TestUnknownStorageBackend(t *testing.T) {
+	_, err := OpenStorage("nosuchbackend", "/tmp/whatever")
+	assert.Error(t, err)
+}
+
+func TestStorageKeys(t *testing.T) {
+	storage, err := NewJSONStorage("")
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Set("b", "k2", "v2"))
+	assert.NoError(t, storage.Set("b", "k1", "v1"))
+	assert.NoError(t, storage.Set("other", "k3", "v3"))
+	keys, err := StorageKeys(storage, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"k1", "k2"}, keys)
+	keys, err = StorageKeys(storage, "nosuchbucket")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, keys)
+}
@@ -0,0 +1,76 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+)
+
+// VIRTUAL_DEVICES_BUCKET is the storage bucket that keeps the cell
+// values of the virtual devices defined with 'persistent: true'
+const VIRTUAL_DEVICES_BUCKET = "_wbDevices"
+
+func persistentCellKey(devName, cellName string) string {
+	return devName + "/" + cellName
+}
+
+// restoredCellDef returns the definition of a cell of a persistent
+// device with the value replaced by the stored one, if any. Stored
+// values that don't fit the cell, e.g. because its type was changed,
+// are ignored.
+func (engine *RuleEngine) restoredCellDef(devName, cellName string, cellDef objx.Map) objx.Map {
+	stored, found := engine.storage.Get(VIRTUAL_DEVICES_BUCKET, persistentCellKey(devName, cellName))
+	if !found {
+		return cellDef
+	}
+	controlType, _ := cellDef["type"].(string)
+	max := -1.0
+	if lookupCellType(controlType).hasMax {
+		var err error
+		if max, err = cellMaxFromDef(cellDef); err != nil {
+			return cellDef
+		}
+	}
+	if _, err := validateCellValue(controlType, max, stored); err != nil {
+		engine.Logf(ENGINE_LOG_WARNING, "%s/%s: ignoring stored value %v: %s",
+			devName, cellName, stored, err)
+		return cellDef
+	}
+	r := make(objx.Map, len(cellDef))
+	for k, v := range cellDef {
+		r[k] = v
+	}
+	r["value"] = stored
+	return r
+}
+
+// persistDeviceCells makes the engine store the values of the
+// cells of the device whenever they change. The values are
+// kept till the device is redefined or removed.
+func (engine *RuleEngine) persistDeviceCells(dev *CellModelLocalDevice) {
+	cells := make([]*Cell, 0, len(dev.cells))
+	for name, cell := range dev.cells {
+		if cell.IsButton() {
+			continue
+		}
+		engine.persistentCells[cell] = persistentCellKey(dev.DevName, name)
+		cells = append(cells, cell)
+	}
+	engine.cleanup.AddCleanup(func() {
+		for _, cell := range cells {
+			delete(engine.persistentCells, cell)
+		}
+	})
+}
+
+// maybePersistCell stores the value of the cell
+// if it belongs to a persistent device
+func (engine *RuleEngine) maybePersistCell(cell *Cell) {
+	key, found := engine.persistentCells[cell]
+	if !found {
+		return
+	}
+	// raw values are stored because they
+	// can be converted to any cell type
+	if err := engine.storage.Set(VIRTUAL_DEVICES_BUCKET, key, cell.RawValue()); err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "failed to store the value of %s: %s", key, err)
+	}
+}
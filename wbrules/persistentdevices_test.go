@@ -0,0 +1,58 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"testing"
+)
+
+func TestPersistentVirtualDevices(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	define := func(persistent bool) {
+		err := engine.DefineVirtualDevice("thermostat", objx.Map{
+			"persistent": persistent,
+			"cells": objx.Map{
+				"setpoint": objx.Map{"type": "range", "value": 20.0, "max": 30.0},
+				"enabled":  objx.Map{"type": "switch", "value": false},
+				"reset":    objx.Map{"type": "pushbutton"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("DefineVirtualDevice(): %s", err)
+		}
+	}
+
+	define(true)
+	setpointSpec := &CellSpec{"thermostat", "setpoint"}
+	engine.setCellValue(model.EnsureCell(setpointSpec), 25.0)
+	engine.RunRules(setpointSpec, NO_TIMER_NAME)
+	if v, _ := engine.storage.Get(VIRTUAL_DEVICES_BUCKET, "thermostat/setpoint"); v != "25" {
+		t.Errorf("bad stored value: %v", v)
+	}
+	if _, found := engine.storage.Get(VIRTUAL_DEVICES_BUCKET, "thermostat/reset"); found {
+		t.Errorf("button value was stored")
+	}
+
+	define(true)
+	if v := model.EnsureCell(setpointSpec).Value(); v != float64(25) {
+		t.Errorf("the value wasn't restored: %v", v)
+	}
+
+	// stored values that don't fit the cell are ignored
+	engine.storage.Set(VIRTUAL_DEVICES_BUCKET, "thermostat/setpoint", "45")
+	define(true)
+	if v := model.EnsureCell(setpointSpec).Value(); v != float64(20) {
+		t.Errorf("bad value restored: %v", v)
+	}
+
+	// the values of non-persistent devices aren't restored or stored
+	engine.storage.Set(VIRTUAL_DEVICES_BUCKET, "thermostat/setpoint", "25")
+	define(false)
+	engine.setCellValue(model.EnsureCell(setpointSpec), 22.0)
+	engine.RunRules(setpointSpec, NO_TIMER_NAME)
+	if v := model.EnsureCell(setpointSpec).Value(); v != float64(22) {
+		t.Errorf("bad value: %v", v)
+	}
+	if v, _ := engine.storage.Get(VIRTUAL_DEVICES_BUCKET, "thermostat/setpoint"); v != "25" {
+		t.Errorf("the value of non-persistent device was stored: %v", v)
+	}
+}
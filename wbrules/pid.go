@@ -0,0 +1,292 @@
+package wbrules
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ivan4th/go-duktape"
+	"github.com/stretchr/objx"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_PID_PERIOD     = time.Second
+	DEFAULT_PID_OUTPUT_MIN = 0
+	DEFAULT_PID_OUTPUT_MAX = 100
+)
+
+// PIDConfig describes a PID controller that keeps the value
+// of the input cell at the value of the setpoint cell
+// by writing to the output cell
+type PIDConfig struct {
+	Kp, Ki, Kd        float64
+	Setpoint          CellSpec
+	Input             CellSpec
+	Output            CellSpec
+	Period            time.Duration
+	OutputMin         float64
+	OutputMax         float64
+	DisabledByDefault bool
+}
+
+// pidController calculates the output of a PID controller.
+// The integral term is clamped to the output range and isn't
+// accumulated while the output is saturated, so the controller
+// doesn't wind up when the output can't bring the input
+// to the setpoint.
+type pidController struct {
+	config    PIDConfig
+	integral  float64
+	prevInput float64
+	hasPrev   bool
+}
+
+func (pid *pidController) reset() {
+	pid.integral, pid.prevInput, pid.hasPrev = 0, 0, false
+}
+
+func clampFloat(v, min, max float64) float64 {
+	switch {
+	case v < min:
+		return min
+	case v > max:
+		return max
+	default:
+		return v
+	}
+}
+
+// step returns the new output value. dt is the time
+// since the previous step in seconds.
+func (pid *pidController) step(setpoint, input, dt float64) float64 {
+	c := &pid.config
+	e := setpoint - input
+	derivative := 0.0
+	if pid.hasPrev && dt > 0 {
+		// the derivative of the input is used instead of the
+		// derivative of the error, so the output doesn't jump
+		// when the setpoint changes
+		derivative = -(input - pid.prevInput) / dt
+	}
+	pid.prevInput, pid.hasPrev = input, true
+
+	integral := clampFloat(pid.integral+c.Ki*e*dt, c.OutputMin, c.OutputMax)
+	output := c.Kp*e + integral + c.Kd*derivative
+	if (output > c.OutputMax && e > 0) || (output < c.OutputMin && e < 0) {
+		// the output is saturated, integrating
+		// the error would only wind it up
+		integral = pid.integral
+		output = c.Kp*e + integral + c.Kd*derivative
+	}
+	pid.integral = integral
+	return clampFloat(output, c.OutputMin, c.OutputMax)
+}
+
+// pidInstance is a PID controller created by a script
+type pidInstance struct {
+	pidController
+	enabled   bool
+	lastStep  time.Time
+	stopTimer func()
+}
+
+func (pid *pidInstance) reset() {
+	pid.pidController.reset()
+	pid.lastStep = time.Time{}
+}
+
+func parsePIDCellSpec(m objx.Map, key string) (CellSpec, error) {
+	s, ok := m.Get(key).Data().(string)
+	if !ok {
+		return CellSpec{}, fmt.Errorf("%s expected", key)
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return CellSpec{}, fmt.Errorf("invalid %s: '%s'", key, s)
+	}
+	return CellSpec{parts[0], parts[1]}, nil
+}
+
+func parsePIDNumber(m objx.Map, key string, defaultValue float64) (float64, error) {
+	if !m.Has(key) {
+		return defaultValue, nil
+	}
+	v, ok := m.Get(key).Data().(float64)
+	if !ok {
+		return 0, fmt.Errorf("invalid %s", key)
+	}
+	return v, nil
+}
+
+func parsePIDConfig(m objx.Map) (config PIDConfig, err error) {
+	for _, item := range []struct {
+		key  string
+		spec *CellSpec
+	}{
+		{"setpointCell", &config.Setpoint},
+		{"inputCell", &config.Input},
+		{"outputCell", &config.Output},
+	} {
+		if *item.spec, err = parsePIDCellSpec(m, item.key); err != nil {
+			return
+		}
+	}
+	periodMs := 0.0
+	for _, item := range []struct {
+		key          string
+		v            *float64
+		defaultValue float64
+	}{
+		{"kp", &config.Kp, 0},
+		{"ki", &config.Ki, 0},
+		{"kd", &config.Kd, 0},
+		{"periodMs", &periodMs, float64(DEFAULT_PID_PERIOD / time.Millisecond)},
+		{"outputMin", &config.OutputMin, DEFAULT_PID_OUTPUT_MIN},
+		{"outputMax", &config.OutputMax, DEFAULT_PID_OUTPUT_MAX},
+	} {
+		if *item.v, err = parsePIDNumber(m, item.key, item.defaultValue); err != nil {
+			return
+		}
+	}
+	switch {
+	case periodMs <= 0:
+		err = errors.New("periodMs must be positive")
+	case config.OutputMin >= config.OutputMax:
+		err = errors.New("outputMin must be less than outputMax")
+	}
+	config.Period = time.Duration(periodMs * float64(time.Millisecond))
+	if enabled, ok := m.Get("enabled").Data().(bool); ok {
+		config.DisabledByDefault = !enabled
+	}
+	return
+}
+
+// cellNumber returns the numeric value of the cell
+// or false if the cell has no numeric value
+func (engine *RuleEngine) cellNumber(cellSpec CellSpec) (float64, bool) {
+	cell := engine.model.LookupCell(&cellSpec)
+	if cell == nil || !cell.IsComplete() {
+		return 0, false
+	}
+	return cell.numericValue()
+}
+
+func (engine *RuleEngine) stepPID(pid *pidInstance) {
+	setpoint, ok := engine.cellNumber(pid.config.Setpoint)
+	if !ok {
+		return
+	}
+	input, ok := engine.cellNumber(pid.config.Input)
+	if !ok {
+		return
+	}
+	now := engine.clock.Now()
+	dt := 0.0
+	if !pid.lastStep.IsZero() {
+		dt = now.Sub(pid.lastStep).Seconds()
+	}
+	pid.lastStep = now
+	output := pid.step(setpoint, input, dt)
+	cell := engine.model.LookupCell(&pid.config.Output)
+	if cell == nil {
+		engine.Logf(ENGINE_LOG_WARNING, "PID: unknown output cell %s/%s",
+			pid.config.Output.DevName, pid.config.Output.CellName)
+		return
+	}
+	engine.setCellValue(cell, output)
+}
+
+func (engine *RuleEngine) setPIDEnabled(pid *pidInstance, enabled bool) {
+	switch {
+	case enabled == pid.enabled:
+		return
+	case enabled:
+		// the controller starts from scratch so the integral
+		// accumulated before it was disabled doesn't cause a jump
+		pid.reset()
+		n := engine.StartTimer(NO_TIMER_NAME, func() {
+			engine.stepPID(pid)
+		}, pid.config.Period, true)
+		pid.stopTimer = func() {
+			// the timer is already stopped if the
+			// script that started it was reloaded
+			engine.stopTimerIfActive(n)
+		}
+	default:
+		pid.stopTimer()
+		pid.stopTimer = nil
+	}
+	pid.enabled = enabled
+}
+
+// CreatePID creates a PID controller. The controller
+// is removed when the script that created it is reloaded.
+func (engine *RuleEngine) CreatePID(config PIDConfig) uint64 {
+	engine.lastPIDId++
+	id := engine.lastPIDId
+	pid := &pidInstance{pidController: pidController{config: config}}
+	engine.pids[id] = pid
+	engine.setPIDEnabled(pid, !config.DisabledByDefault)
+	engine.cleanup.AddCleanup(func() {
+		// the controller may be re-enabled by a rule after
+		// the script is loaded, so its timer may not be
+		// stopped by the script cleanup
+		engine.setPIDEnabled(pid, false)
+		delete(engine.pids, id)
+	})
+	return id
+}
+
+func (engine *ESEngine) lookupPID() (*pidInstance, bool) {
+	if engine.ctx.GetTop() < 1 || !engine.ctx.IsNumber(0) {
+		return nil, false
+	}
+	pid, found := engine.pids[uint64(engine.ctx.GetNumber(0))]
+	return pid, found
+}
+
+// esWbPIDCreate returns the id of the new
+// PID controller or an error message
+func (engine *ESEngine) esWbPIDCreate() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsObject(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	m, ok := engine.ctx.GetJSObject(0).(objx.Map)
+	if !ok {
+		return duktape.DUK_RET_ERROR
+	}
+	config, err := parsePIDConfig(m)
+	if err != nil {
+		engine.ctx.PushString(err.Error())
+		return 1
+	}
+	engine.ctx.PushNumber(float64(engine.CreatePID(config)))
+	return 1
+}
+
+func (engine *ESEngine) esWbPIDSetEnabled() int {
+	pid, found := engine.lookupPID()
+	if !found || engine.ctx.GetTop() != 2 || !engine.ctx.IsBoolean(1) {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.setPIDEnabled(pid, engine.ctx.GetBoolean(1))
+	return 0
+}
+
+func (engine *ESEngine) esWbPIDIsEnabled() int {
+	pid, found := engine.lookupPID()
+	if !found {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.ctx.PushBoolean(pid.enabled)
+	return 1
+}
+
+func (engine *ESEngine) esWbPIDReset() int {
+	pid, found := engine.lookupPID()
+	if !found {
+		return duktape.DUK_RET_ERROR
+	}
+	pid.reset()
+	return 0
+}
@@ -0,0 +1,133 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"testing"
+	"time"
+)
+
+func TestPIDStep(t *testing.T) {
+	pid := &pidController{config: PIDConfig{Kp: 2, Ki: 1, OutputMin: 0, OutputMax: 100}}
+	if output := pid.step(20, 18, 0); output != 4 {
+		t.Errorf("bad proportional output: %v", output)
+	}
+	if output := pid.step(20, 18, 1); output != 6 {
+		t.Errorf("bad output with the integral term: %v", output)
+	}
+
+	// the output is saturated for a long time, but the
+	// integral term must not wind up
+	for i := 0; i < 100; i++ {
+		if output := pid.step(100, 10, 1); output != 100 {
+			t.Fatalf("the output isn't saturated: %v", output)
+		}
+	}
+	if pid.integral > 100 {
+		t.Errorf("integral wind-up: %v", pid.integral)
+	}
+	// the output must go down as soon as
+	// the input exceeds the setpoint
+	if output := pid.step(20, 25, 1); output >= 100 {
+		t.Errorf("the output didn't go down: %v", output)
+	}
+
+	pid = &pidController{config: PIDConfig{Kd: 10, OutputMin: -100, OutputMax: 100}}
+	pid.step(20, 18, 1)
+	if output := pid.step(30, 19, 1); output != -10 {
+		t.Errorf("bad derivative output: %v", output)
+	}
+}
+
+func TestParsePIDConfig(t *testing.T) {
+	config, err := parsePIDConfig(objx.New(map[string]interface{}{
+		"kp":           2.0,
+		"ki":           0.5,
+		"setpointCell": "thermostat/setpoint",
+		"inputCell":    "room/temp",
+		"outputCell":   "heater/power",
+		"periodMs":     500.0,
+		"enabled":      false,
+	}))
+	if err != nil {
+		t.Fatalf("parsePIDConfig(): %s", err)
+	}
+	expected := PIDConfig{
+		Kp:                2,
+		Ki:                0.5,
+		Setpoint:          CellSpec{"thermostat", "setpoint"},
+		Input:             CellSpec{"room", "temp"},
+		Output:            CellSpec{"heater", "power"},
+		Period:            500 * time.Millisecond,
+		OutputMin:         DEFAULT_PID_OUTPUT_MIN,
+		OutputMax:         DEFAULT_PID_OUTPUT_MAX,
+		DisabledByDefault: true,
+	}
+	if config != expected {
+		t.Errorf("bad config: %#v", config)
+	}
+
+	for _, m := range []map[string]interface{}{
+		{"inputCell": "room/temp", "outputCell": "heater/power"},
+		{"setpointCell": "t/s", "inputCell": "room", "outputCell": "heater/power"},
+		{"setpointCell": "t/s", "inputCell": "room/temp", "outputCell": "heater/power", "kp": "1"},
+		{"setpointCell": "t/s", "inputCell": "room/temp", "outputCell": "heater/power", "periodMs": 0.0},
+		{"setpointCell": "t/s", "inputCell": "room/temp", "outputCell": "heater/power", "outputMin": 100.0},
+	} {
+		if _, err := parsePIDConfig(objx.New(m)); err == nil {
+			t.Errorf("no error for %v", m)
+		}
+	}
+}
+
+func TestPIDOutput(t *testing.T) {
+	model, engine := newTimerTestEngine(t, nullMQTTClient{})
+	dev := model.EnsureLocalDevice("room", "room")
+	dev.SetCell("setpoint", "value", 22.0, false)
+	dev.SetCell("temp", "temperature", 20.0, false)
+	power := dev.SetCell("power", "range", 0.0, false)
+
+	var id uint64
+	engine.model.CallSync(func() {
+		id = engine.CreatePID(PIDConfig{
+			Kp:        10,
+			Setpoint:  CellSpec{"room", "setpoint"},
+			Input:     CellSpec{"room", "temp"},
+			Output:    CellSpec{"room", "power"},
+			Period:    10 * time.Millisecond,
+			OutputMax: 100,
+		})
+	})
+	var value interface{}
+	for deadline := time.Now().Add(5 * time.Second); value != 20.0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the PID output wasn't written, value %v", value)
+		}
+		time.Sleep(10 * time.Millisecond)
+		engine.model.CallSync(func() {
+			value = power.Value()
+		})
+	}
+
+	engine.model.CallSync(func() {
+		pid := engine.pids[id]
+		if !pid.enabled {
+			t.Errorf("the PID controller isn't enabled")
+		}
+		config := pid.config
+		config.Period = time.Hour
+		config.DisabledByDefault = true
+		other := engine.pids[engine.CreatePID(config)]
+		timerCount := len(engine.timers)
+		if other.enabled {
+			t.Errorf("the PID controller is enabled")
+		}
+		engine.setPIDEnabled(other, true)
+		if !other.enabled || len(engine.timers) != timerCount+1 {
+			t.Errorf("the PID controller wasn't enabled")
+		}
+		engine.setPIDEnabled(other, false)
+		if other.enabled || len(engine.timers) != timerCount {
+			t.Errorf("the PID controller wasn't disabled")
+		}
+	})
+}
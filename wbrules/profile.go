@@ -0,0 +1,77 @@
+package wbrules
+
+import (
+	"github.com/DisposaBoy/JsonConfigReader"
+	"github.com/stretchr/objx"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Environment variables that override the respective
+// keys of the controller profile
+const (
+	PROFILE_ENV_SITE        = "WB_RULES_SITE"
+	PROFILE_ENV_ROOMS       = "WB_RULES_ROOMS"
+	PROFILE_ENV_HW_REVISION = "WB_RULES_HW_REVISION"
+
+	PROFILE_KEY_SITE        = "site"
+	PROFILE_KEY_ROOMS       = "rooms"
+	PROFILE_KEY_HW_REVISION = "hwRevision"
+)
+
+// LoadProfile loads the controller profile, which makes it possible
+// to run the same scripts on controllers with different wiring.
+// The profile is read from the specified JSON file (comments are
+// allowed), unless the path is empty, and then the values of the
+// WB_RULES_SITE, WB_RULES_ROOMS (comma-separated list) and
+// WB_RULES_HW_REVISION environment variables are applied on top of it.
+func LoadProfile(path string) (objx.Map, error) {
+	profile := objx.New(map[string]interface{}{})
+	if path != "" {
+		in, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer in.Close()
+		content, err := ioutil.ReadAll(JsonConfigReader.New(in))
+		if err != nil {
+			return nil, err
+		}
+		if profile, err = objx.FromJSON(string(content)); err != nil {
+			return nil, err
+		}
+	}
+	applyProfileEnv(profile, os.LookupEnv)
+	return profile, nil
+}
+
+func applyProfileEnv(profile objx.Map, lookupEnv func(string) (string, bool)) {
+	if site, found := lookupEnv(PROFILE_ENV_SITE); found {
+		profile[PROFILE_KEY_SITE] = site
+	}
+	if rooms, found := lookupEnv(PROFILE_ENV_ROOMS); found {
+		list := []interface{}{}
+		for _, room := range strings.Split(rooms, ",") {
+			if room = strings.TrimSpace(room); room != "" {
+				list = append(list, room)
+			}
+		}
+		profile[PROFILE_KEY_ROOMS] = list
+	}
+	if rev, found := lookupEnv(PROFILE_ENV_HW_REVISION); found {
+		profile[PROFILE_KEY_HW_REVISION] = rev
+	}
+}
+
+// SetProfile sets the controller profile exposed to scripts
+// as the read-only 'profile' object. Must be called before
+// any scripts are loaded.
+func (engine *RuleEngine) SetProfile(profile objx.Map) {
+	engine.profile = profile
+}
+
+// Profile returns the controller profile
+func (engine *RuleEngine) Profile() objx.Map {
+	return engine.profile
+}
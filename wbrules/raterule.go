@@ -0,0 +1,100 @@
+package wbrules
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RateRuleCondition fires the rule when the rate of change of
+// a numeric cell exceeds the threshold. The rate is calculated in
+// units per second using the values received during the window.
+// Negative threshold makes the condition fire when the value
+// decreases faster than -threshold units per second. The condition
+// fires once when the threshold is exceeded and then waits for
+// the rate to return within the threshold. The rate is passed
+// to the rule as newValue.
+type RateRuleCondition struct {
+	RuleConditionBase
+	cellSpec  CellSpec
+	threshold float64
+	samples   cellHistory
+	exceeded  bool
+	now       func() time.Time
+}
+
+func NewRateRuleCondition(cellSpec CellSpec, threshold float64, window time.Duration) *RateRuleCondition {
+	return &RateRuleCondition{
+		cellSpec:  cellSpec,
+		threshold: threshold,
+		samples:   cellHistory{retention: window},
+		now:       time.Now,
+	}
+}
+
+func (ruleCond *RateRuleCondition) GetCells() []*CellSpec {
+	return []*CellSpec{&ruleCond.cellSpec}
+}
+
+// rate returns the rate of change in units per second or
+// false if there are not enough values within the window
+func (ruleCond *RateRuleCondition) rate() (float64, bool) {
+	samples := ruleCond.samples.samples
+	if len(samples) < 2 {
+		return 0, false
+	}
+	first, last := samples[0], samples[len(samples)-1]
+	elapsed := last.Time.Sub(first.Time).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return (last.Value - first.Value) / elapsed, true
+}
+
+func (ruleCond *RateRuleCondition) Check(cell *Cell) (bool, interface{}) {
+	if cell == nil || cell.DevName() != ruleCond.cellSpec.DevName ||
+		cell.Name() != ruleCond.cellSpec.CellName || !cell.IsComplete() {
+		return false, nil
+	}
+	v, ok := cell.numericValue()
+	if !ok {
+		return false, nil
+	}
+	ruleCond.samples.add(ruleCond.now(), v)
+	rate, ok := ruleCond.rate()
+	exceeded := ok && (ruleCond.threshold >= 0 && rate > ruleCond.threshold ||
+		ruleCond.threshold < 0 && rate < ruleCond.threshold)
+	shouldFire := exceeded && !ruleCond.exceeded
+	ruleCond.exceeded = exceeded
+	if !shouldFire {
+		return false, nil
+	}
+	return true, rate
+}
+
+func (engine *ESEngine) buildRateRuleCondition(defIndex int) (RuleCondition, error) {
+	ctx := engine.ctx
+	ctx.GetPropString(defIndex, "whenRate")
+	defer ctx.Pop()
+	if !ctx.IsObject(-1) {
+		return nil, errors.New("whenRate: object expected")
+	}
+	ctx.GetPropString(-1, "cell")
+	ctx.GetPropString(-2, "threshold")
+	ctx.GetPropString(-3, "windowMs")
+	defer ctx.Pop3()
+	if !ctx.IsString(-3) || !ctx.IsNumber(-2) || !ctx.IsNumber(-1) {
+		return nil, errors.New("whenRate: cell, threshold and windowMs expected")
+	}
+	cellFullName := ctx.GetString(-3)
+	parts := strings.SplitN(cellFullName, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid whenRate cell: '%s'", cellFullName)
+	}
+	window := time.Duration(ctx.GetNumber(-1) * float64(time.Millisecond))
+	if window <= 0 {
+		return nil, errors.New("whenRate: windowMs must be positive")
+	}
+	return NewRateRuleCondition(CellSpec{parts[0], parts[1]}, ctx.GetNumber(-2), window), nil
+}
@@ -0,0 +1,49 @@
+package wbrules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateRuleCondition(t *testing.T) {
+	model := newTestModel(t)
+	dev := model.EnsureLocalDevice("tank", "tank")
+	level := dev.SetCell("level", "value", 100.0, false)
+	other := dev.SetCell("other", "value", 0.0, false)
+
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	cond := NewRateRuleCondition(CellSpec{"tank", "level"}, -0.5, time.Minute)
+	cond.now = func() time.Time { return now }
+	for i, item := range []struct {
+		after    time.Duration
+		value    float64
+		fire     bool
+		expected float64
+	}{
+		{0, 100, false, 0},
+		{20 * time.Second, 95, false, 0},
+		{20 * time.Second, 70, true, -0.75},
+		// still too fast, the rule has fired already
+		{20 * time.Second, 60, false, 0},
+		{60 * time.Second, 59, false, 0},
+		{30 * time.Second, 58, false, 0},
+		{30 * time.Second, 11, true, -0.8},
+	} {
+		now = now.Add(item.after)
+		level.SetValue(item.value)
+		shouldFire, rate := cond.Check(level)
+		switch {
+		case shouldFire != item.fire:
+			t.Errorf("%d: shouldFire = %v", i, shouldFire)
+		case shouldFire && rate.(float64) != item.expected:
+			t.Errorf("%d: bad rate %v", i, rate)
+		}
+	}
+
+	if shouldFire, _ := cond.Check(other); shouldFire {
+		t.Errorf("the condition fired for another cell")
+	}
+	if shouldFire, _ := cond.Check(nil); shouldFire {
+		t.Errorf("the condition fired without a cell")
+	}
+}
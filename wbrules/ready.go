@@ -0,0 +1,192 @@
+package wbrules
+
+import (
+	"errors"
+	"fmt"
+	"github.com/contactless/wbgo"
+	"strings"
+	"time"
+)
+
+const DEFAULT_READY_TIMEOUT = 30 * time.Second
+
+// SetReadyTimeout sets the max time to wait after the startup
+// for the cells used by the rules to become complete before
+// the engine is considered ready. Must be called before
+// the engine is started.
+func (engine *RuleEngine) SetReadyTimeout(d time.Duration) {
+	engine.readyTimeout = d
+}
+
+// WhenReady invokes the thunk when the engine is ready, that is,
+// the startup (including startup ingestion and startup window)
+// is complete and all of the cells used by the rules are complete,
+// or the ready timeout has passed after the startup. If the engine
+// is already ready, the thunk is invoked immediately. Must be
+// called from the model goroutine.
+func (engine *RuleEngine) WhenReady(thunk func()) {
+	if engine.readyWaitOver {
+		thunk()
+		return
+	}
+	engine.readyWaiters = append(engine.readyWaiters, thunk)
+}
+
+// SetStartupEdgeTriggers specifies whether edge-triggered rules
+// (whenChanged, asSoonAs) may fire during the initial replay
+// of the retained values, that is, till the engine is ready.
+// When disabled, the conditions of such rules are still checked,
+// so the values received during the replay become the baseline
+// for detecting changes, but their then callbacks aren't invoked,
+// except for the rules that have ignoreStartupDelay option set.
+// Must be called before the engine is started.
+func (engine *RuleEngine) SetStartupEdgeTriggers(enabled bool) {
+	engine.suppressStartupEdges = !enabled
+}
+
+// addStartupHook adds a function that's invoked on the event
+// loop each time the engine is started, after the retained values
+// are received and before the first rule run. Unlike WhenReady(),
+// the hooks aren't removed when the engine is stopped.
+func (engine *RuleEngine) addStartupHook(thunk func()) {
+	engine.startupHooks = append(engine.startupHooks, thunk)
+}
+
+func (engine *RuleEngine) runStartupHooks() {
+	for _, thunk := range engine.startupHooks {
+		thunk()
+	}
+}
+
+func (engine *RuleEngine) hasReadyWaiters() bool {
+	if len(engine.readyWaiters) > 0 || engine.suppressStartupEdges {
+		return true
+	}
+	for _, rule := range engine.ruleMap {
+		if rule.waitReady {
+			return true
+		}
+	}
+	return false
+}
+
+func (engine *RuleEngine) ruleCellsComplete() bool {
+	for _, cells := range engine.ruleCells {
+		for _, cell := range cells {
+			if !cell.IsComplete() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (engine *RuleEngine) completeStartup() {
+	engine.startupDone = true
+	if !engine.hasReadyWaiters() {
+		// nobody waits, no need to track cell completeness
+		engine.endReadyWait()
+		return
+	}
+	if engine.ruleCellsComplete() {
+		engine.endReadyWait()
+		return
+	}
+	if engine.readyTimeout > 0 {
+		engine.readyTimerId = engine.StartTimer(NO_TIMER_NAME, func() {
+			engine.readyTimerId = 0
+			engine.Logf(ENGINE_LOG_WARNING,
+				"some of the cells used by rules are still incomplete after %s", engine.readyTimeout)
+			engine.endReadyWait()
+		}, engine.readyTimeout, false)
+	}
+}
+
+func (engine *RuleEngine) maybeEndReadyWait() {
+	if engine.ruleCellsComplete() {
+		engine.StopTimerByIndex(engine.readyTimerId)
+		engine.readyTimerId = 0
+		engine.endReadyWait()
+	}
+}
+
+func (engine *RuleEngine) endReadyWait() {
+	wbgo.Debug.Printf("the engine is ready, starting deferred timers")
+	engine.readyWaitOver = true
+	for _, rule := range engine.ruleMap {
+		rule.setWaitingReady(false)
+		rule.setReplay(false)
+	}
+	waiters := engine.readyWaiters
+	engine.readyWaiters = nil
+	for _, thunk := range waiters {
+		thunk()
+	}
+}
+
+func (engine *RuleEngine) resetReadyWait() {
+	engine.startupDone = false
+	engine.readyWaitOver = false
+	engine.readyWaiters = nil
+	engine.readyTimerId = 0
+	for _, rule := range engine.ruleMap {
+		rule.setWaitingReady(true)
+		rule.setReplay(engine.suppressStartupEdges)
+	}
+}
+
+// CompleteRuleCondition fires once when all of the listed
+// cells become complete, i.e. receive their types and values
+type CompleteRuleCondition struct {
+	RuleConditionBase
+	cellSpecs []CellSpec
+	lookup    func(cellSpec *CellSpec) *Cell
+	fired     bool
+}
+
+func NewCompleteRuleCondition(lookup func(cellSpec *CellSpec) *Cell, cellSpecs []CellSpec) *CompleteRuleCondition {
+	return &CompleteRuleCondition{cellSpecs: cellSpecs, lookup: lookup}
+}
+
+func (ruleCond *CompleteRuleCondition) GetCells() []*CellSpec {
+	r := make([]*CellSpec, len(ruleCond.cellSpecs))
+	for i := range ruleCond.cellSpecs {
+		r[i] = &ruleCond.cellSpecs[i]
+	}
+	return r
+}
+
+func (ruleCond *CompleteRuleCondition) Check(cell *Cell) (bool, interface{}) {
+	if ruleCond.fired {
+		return false, nil
+	}
+	for i := range ruleCond.cellSpecs {
+		if cell := ruleCond.lookup(&ruleCond.cellSpecs[i]); cell == nil || !cell.IsComplete() {
+			return false, nil
+		}
+	}
+	ruleCond.fired = true
+	return true, nil
+}
+
+func (engine *ESEngine) buildCompleteRuleCondition(defIndex int) (RuleCondition, error) {
+	ctx := engine.ctx
+	ctx.GetPropString(defIndex, "whenComplete")
+	defer ctx.Pop()
+	if !ctx.IsArray(-1) || ctx.GetLength(-1) == 0 {
+		return nil, errors.New("whenComplete: non-empty array of cell names expected")
+	}
+	cellSpecs := make([]CellSpec, ctx.GetLength(-1))
+	for i := range cellSpecs {
+		ctx.GetPropIndex(-1, uint(i))
+		cellFullName := ctx.SafeToString(-1)
+		isString := ctx.IsString(-1)
+		ctx.Pop()
+		parts := strings.SplitN(cellFullName, "/", 2)
+		if !isString || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid whenComplete cell: '%s'", cellFullName)
+		}
+		cellSpecs[i] = CellSpec{parts[0], parts[1]}
+	}
+	return NewCompleteRuleCondition(engine.model.LookupCell, cellSpecs), nil
+}
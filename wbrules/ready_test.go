@@ -0,0 +1,67 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"testing"
+)
+
+func TestCompleteRuleCondition(t *testing.T) {
+	model := newTestModel(t)
+	dev := model.EnsureLocalDevice("heater", "heater")
+	temp := dev.SetCell("temp", "temperature", 20.0, false)
+	cond := NewCompleteRuleCondition(model.LookupCell, []CellSpec{{"heater", "temp"}, {"relay", "K1"}})
+	if len(cond.GetCells()) != 2 {
+		t.Errorf("bad cells: %v", cond.GetCells())
+	}
+	if shouldFire, _ := cond.Check(temp); shouldFire {
+		t.Errorf("the condition fired before the cells are complete")
+	}
+	relay := model.EnsureDevice("relay").(*CellModelExternalDevice)
+	relay.AcceptControlType("K1", "switch")
+	if shouldFire, _ := cond.Check(nil); shouldFire {
+		t.Errorf("the condition fired for a cell without value")
+	}
+	relay.AcceptValue("K1", "1")
+	if shouldFire, _ := cond.Check(relay.MustGetCell("K1")); !shouldFire {
+		t.Errorf("the condition didn't fire")
+	}
+	if shouldFire, _ := cond.Check(nil); shouldFire {
+		t.Errorf("the condition fired twice")
+	}
+}
+
+func TestStartupEdgeTriggers(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	engine.SetStartupEdgeTriggers(false)
+	dev := model.EnsureLocalDevice("heater", "heater")
+	cellSpec := &CellSpec{"heater", "trigger"}
+	trigger := dev.SetCell("trigger", "switch", true, false)
+	fired := map[string]int{}
+	defineRule := func(name string, cond RuleCondition) {
+		engine.DefineRule(NewRule(engine, name, cond, func(args objx.Map) interface{} {
+			fired[name]++
+			return nil
+		}))
+	}
+	changed, _ := NewCellChangedRuleCondition(*cellSpec)
+	defineRule("changed", changed)
+	defineRule("level", NewLevelTriggeredRuleCondition(func() bool {
+		return trigger.Value() == true
+	}))
+
+	engine.RunRules(nil, NO_TIMER_NAME)
+	engine.RunRules(cellSpec, NO_TIMER_NAME)
+	if fired["changed"] != 0 || fired["level"] == 0 {
+		t.Errorf("bad firings during the replay: %v", fired)
+	}
+
+	engine.completeStartup()
+	if !engine.readyWaitOver {
+		t.Fatalf("the engine isn't ready after startup")
+	}
+	trigger.SetValue(false)
+	engine.RunRules(cellSpec, NO_TIMER_NAME)
+	if fired["changed"] != 1 {
+		t.Errorf("the edge-triggered rule didn't fire after the replay: %v", fired)
+	}
+}
@@ -0,0 +1,373 @@
+package wbrules
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	jsStringLiteral = `"(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*'`
+	jsIdent         = `[A-Za-z_$][\w$]*`
+)
+
+// referenceRx matches the pieces of the script that may refer
+// to devices and cells. Comments are matched too so that the
+// quotes inside them don't confuse the literal matching, but
+// they're left intact.
+var referenceRx = regexp.MustCompile(
+	`//[^\n]*|/\*(?s:.*?)\*/` +
+		`|(defineVirtualDevice\(\s*)(` + jsStringLiteral + `)` +
+		`|\bdev(?:\.(` + jsIdent + `)|\[\s*(` + jsStringLiteral + `)\s*\])` +
+		`(?:\.(` + jsIdent + `)|\[\s*(` + jsStringLiteral + `)\s*\])?` +
+		`|(` + jsStringLiteral + `)`)
+
+var jsIdentRx = regexp.MustCompile(`^` + jsIdent + `$`)
+
+// ReferenceRenames maps old device and cell names to the new ones.
+// "dev" keys rename the device keeping the names of its cells,
+// "dev/cell" keys rename a single cell, possibly moving it
+// to another device. Cell renames take precedence.
+type ReferenceRenames map[string]string
+
+// ParseReferenceRenames parses comma-separated "old=new" pairs
+func ParseReferenceRenames(s string) (ReferenceRenames, error) {
+	renames := make(ReferenceRenames)
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rename: %q", item)
+		}
+		renames[parts[0]] = parts[1]
+	}
+	return renames, renames.Validate()
+}
+
+func validReferenceName(name string, isCell bool) bool {
+	if name == "" || strings.ContainsAny(name, "\"'\\\n") {
+		return false
+	}
+	parts := strings.Split(name, "/")
+	if !isCell {
+		return len(parts) == 1
+	}
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+// Validate checks that both old and new names of each rename
+// are either device names or "dev/cell" specs
+func (renames ReferenceRenames) Validate() error {
+	if len(renames) == 0 {
+		return fmt.Errorf("no renames specified")
+	}
+	for from, to := range renames {
+		isCell := strings.Contains(from, "/")
+		if !validReferenceName(from, isCell) || !validReferenceName(to, isCell) {
+			return fmt.Errorf("invalid rename: %q -> %q", from, to)
+		}
+	}
+	return nil
+}
+
+func (renames ReferenceRenames) renameDevice(devName string) (string, bool) {
+	newDevName, found := renames[devName]
+	return newDevName, found
+}
+
+func (renames ReferenceRenames) renameCell(devName, cellName string) (string, string, bool) {
+	if to, found := renames[devName+"/"+cellName]; found {
+		parts := strings.SplitN(to, "/", 2)
+		return parts[0], parts[1], true
+	}
+	if newDevName, found := renames.renameDevice(devName); found {
+		return newDevName, cellName, true
+	}
+	return devName, cellName, false
+}
+
+// renameSpec renames the device or cell referred to by
+// a string: "dev/cell" spec or an MQTT topic
+func (renames ReferenceRenames) renameSpec(s string) (string, bool) {
+	if strings.HasPrefix(s, "/devices/") {
+		parts := strings.SplitN(s, "/", 6)
+		if len(parts) >= 5 && parts[3] == "controls" {
+			devName, cellName, ok := renames.renameCell(parts[2], parts[4])
+			if !ok {
+				return s, false
+			}
+			parts[2], parts[4] = devName, cellName
+			return strings.Join(parts, "/"), true
+		}
+		if devName, ok := renames.renameDevice(parts[2]); ok {
+			parts[2] = devName
+			return strings.Join(parts, "/"), true
+		}
+		return s, false
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return s, false
+	}
+	devName, cellName, ok := renames.renameCell(parts[0], parts[1])
+	return devName + "/" + cellName, ok
+}
+
+// unquote returns the contents of the literal unless it
+// contains escapes which aren't worth handling here
+func unquote(literal string) (string, bool) {
+	s := literal[1 : len(literal)-1]
+	return s, !strings.Contains(s, "\\")
+}
+
+func requote(literal, s string) string {
+	return literal[:1] + s + literal[:1]
+}
+
+func (renames ReferenceRenames) renameLiteral(literal string) (string, bool) {
+	s, ok := unquote(literal)
+	if !ok {
+		return literal, false
+	}
+	if s, ok = renames.renameSpec(s); !ok {
+		return literal, false
+	}
+	return requote(literal, s), true
+}
+
+// devAccessor renders a property access on a 'dev' object,
+// keeping the original notation where possible
+func devAccessor(name, literal string) string {
+	if literal != "" {
+		return "[" + requote(literal, name) + "]"
+	}
+	if jsIdentRx.MatchString(name) {
+		return "." + name
+	}
+	return fmt.Sprintf("[%q]", name)
+}
+
+func (renames ReferenceRenames) renameAccessor(src string, m []int) (string, bool) {
+	group := func(n int) string {
+		if m[2*n] < 0 {
+			return ""
+		}
+		return src[m[2*n]:m[2*n+1]]
+	}
+	devIdent, devLiteral, cellIdent, cellLiteral := group(3), group(4), group(5), group(6)
+	devName, cellName := devIdent, cellIdent
+	if devLiteral != "" {
+		var ok bool
+		if devName, ok = unquote(devLiteral); !ok {
+			return "", false
+		}
+		if strings.Contains(devName, "/") {
+			// dev["dev/cell"]; whatever follows it
+			// is not a cell name
+			newLiteral, ok := renames.renameLiteral(devLiteral)
+			if !ok {
+				return "", false
+			}
+			return src[m[0]:m[8]] + newLiteral + src[m[9]:m[1]], true
+		}
+	}
+	if cellLiteral != "" {
+		var ok bool
+		if cellName, ok = unquote(cellLiteral); !ok {
+			return "", false
+		}
+	}
+
+	newDevName, newCellName, ok := devName, cellName, false
+	if cellName != "" {
+		newDevName, newCellName, ok = renames.renameCell(devName, cellName)
+	} else {
+		newDevName, ok = renames.renameDevice(devName)
+	}
+	if !ok {
+		return "", false
+	}
+	r := "dev" + devAccessor(newDevName, devLiteral)
+	if cellName != "" {
+		r += devAccessor(newCellName, cellLiteral)
+	}
+	return r, true
+}
+
+// RewriteReferences replaces the references to the renamed
+// devices and cells in the script source. Recognized references
+// are "dev/cell" strings (including alias tables), MQTT topics,
+// 'dev' object accessors and virtual device definitions.
+// The comments are left intact. The number of the replaced
+// references is returned along with the new source.
+func RewriteReferences(src string, renames ReferenceRenames) (string, int) {
+	var buf bytes.Buffer
+	count, last := 0, 0
+	for _, m := range referenceRx.FindAllStringSubmatchIndex(src, -1) {
+		var r string
+		ok := false
+		switch {
+		case m[4] >= 0:
+			// defineVirtualDevice("name", ...)
+			literal := src[m[4]:m[5]]
+			if s, unquoted := unquote(literal); unquoted {
+				var newName string
+				if newName, ok = renames.renameDevice(s); ok {
+					r = src[m[2]:m[3]] + requote(literal, newName)
+				}
+			}
+		case m[6] >= 0 || m[8] >= 0:
+			r, ok = renames.renameAccessor(src, m)
+		case m[14] >= 0:
+			r, ok = renames.renameLiteral(src[m[14]:m[15]])
+		}
+		if !ok || r == src[m[0]:m[1]] {
+			continue
+		}
+		buf.WriteString(src[last:m[0]])
+		buf.WriteString(r)
+		last = m[1]
+		count++
+	}
+	if count == 0 {
+		return src, 0
+	}
+	buf.WriteString(src[last:])
+	return buf.String(), count
+}
+
+// referenceDiff returns the changed lines of the script.
+// Rewriting references never adds or removes lines, so
+// the lines are compared one by one.
+func referenceDiff(path, oldSrc, newSrc string) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- a/%s\n+++ b/%s\n", path, path)
+	oldLines, newLines := strings.Split(oldSrc, "\n"), strings.Split(newSrc, "\n")
+	for i := range oldLines {
+		if i < len(newLines) && oldLines[i] != newLines[i] {
+			fmt.Fprintf(&buf, "@@ -%d +%d @@\n-%s\n+%s\n", i+1, i+1, oldLines[i], newLines[i])
+		}
+	}
+	return buf.String()
+}
+
+// RefactorFileResult describes the changes made to a single script
+type RefactorFileResult struct {
+	Path         string `json:"path"`
+	Replacements int    `json:"replacements"`
+	Diff         string `json:"diff"`
+	// Error is the error of reloading the rewritten script
+	Error string `json:"error,omitempty"`
+}
+
+type refactorFileResultSlice []RefactorFileResult
+
+func (s refactorFileResultSlice) Len() int           { return len(s) }
+func (s refactorFileResultSlice) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s refactorFileResultSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func rewriteFileReferences(path, physicalPath string, renames ReferenceRenames) (*RefactorFileResult, string, error) {
+	bs, err := ioutil.ReadFile(physicalPath)
+	if err != nil {
+		return nil, "", err
+	}
+	newSrc, count := RewriteReferences(string(bs), renames)
+	if count == 0 {
+		return nil, "", nil
+	}
+	return &RefactorFileResult{
+		Path:         path,
+		Replacements: count,
+		Diff:         referenceDiff(path, string(bs), newSrc),
+	}, newSrc, nil
+}
+
+// RenameReferencesInDir rewrites the references to the renamed
+// devices and cells in the scripts under the specified directory.
+// The files are not modified if dryRun is true.
+func RenameReferencesInDir(root string, renames ReferenceRenames, dryRun bool) ([]RefactorFileResult, error) {
+	if err := renames.Validate(); err != nil {
+		return nil, err
+	}
+	results := []RefactorFileResult{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".js") {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		switch {
+		case err != nil:
+			return err
+		case relPath == ".":
+			// the root is a file
+			relPath = filepath.Base(path)
+		}
+		result, newSrc, err := rewriteFileReferences(relPath, path, renames)
+		if err != nil || result == nil {
+			return err
+		}
+		if !dryRun {
+			if err = ioutil.WriteFile(path, []byte(newSrc), info.Mode()); err != nil {
+				return err
+			}
+		}
+		results = append(results, *result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// FormatRefactorResults returns the diffs of the changed scripts
+func FormatRefactorResults(results []RefactorFileResult) string {
+	var buf bytes.Buffer
+	for _, result := range results {
+		buf.WriteString(result.Diff)
+	}
+	return buf.String()
+}
+
+// renameSourceReferences rewrites the references in the editable
+// scripts reloading the changed ones
+func renameSourceReferences(locFileManager LocFileManager, renames ReferenceRenames, dryRun bool) ([]RefactorFileResult, error) {
+	entries, err := locFileManager.ListSourceFiles()
+	if err != nil {
+		return nil, err
+	}
+	results := []RefactorFileResult{}
+	for _, entry := range entries {
+		result, newSrc, err := rewriteFileReferences(entry.VirtualPath, entry.PhysicalPath, renames)
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			continue
+		}
+		switch {
+		case dryRun:
+		case entry.Disabled:
+			// the disabled scripts must stay disabled
+			if err = ioutil.WriteFile(entry.PhysicalPath, []byte(newSrc), 0644); err != nil {
+				return nil, err
+			}
+		default:
+			err = locFileManager.LiveWriteScript(entry.VirtualPath, newSrc)
+			switch err.(type) {
+			case nil:
+			case ScriptError:
+				result.Error = err.Error()
+			default:
+				return nil, err
+			}
+		}
+		results = append(results, *result)
+	}
+	sort.Sort(refactorFileResultSlice(results))
+	return results, nil
+}
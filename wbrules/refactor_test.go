@@ -0,0 +1,105 @@
+package wbrules
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testRenames = ReferenceRenames{
+	"wb-mr6c_10":      "wb-mr6c_20",
+	"wb-msw/temp":     "wb-msw2/temperature",
+	"heating/enabled": "heating/heating enabled",
+}
+
+func TestRewriteReferences(t *testing.T) {
+	for _, item := range []struct {
+		src, expected string
+		count         int
+	}{
+		{`dev["wb-mr6c_10/K1"] = true;`, `dev["wb-mr6c_20/K1"] = true;`, 1},
+		{`dev["wb-mr6c_10"]["K1"] = true;`, `dev["wb-mr6c_20"]["K1"] = true;`, 1},
+		{`dev['wb-msw']['temp'] > 20`, `dev['wb-msw2']['temperature'] > 20`, 1},
+		{`dev["wb-msw/temp"].toFixed(1)`, `dev["wb-msw2/temperature"].toFixed(1)`, 1},
+		{`dev.heating.enabled`, `dev.heating["heating enabled"]`, 1},
+		{`dev.heating.mode`, `dev.heating.mode`, 0},
+		{`whenChanged: ["wb-msw/temp", "wb-msw/humidity"]`, `whenChanged: ["wb-msw2/temperature", "wb-msw/humidity"]`, 1},
+		{`defineAlias("relay1", "wb-mr6c_10/K1");`, `defineAlias("relay1", "wb-mr6c_20/K1");`, 1},
+		{`publish("/devices/wb-mr6c_10/controls/K1/on", "1");`, `publish("/devices/wb-mr6c_20/controls/K1/on", "1");`, 1},
+		{`"/devices/wb-msw/controls/temp"`, `"/devices/wb-msw2/controls/temperature"`, 1},
+		{`"/devices/wb-mr6c_10/meta/name"`, `"/devices/wb-mr6c_20/meta/name"`, 1},
+		{`defineVirtualDevice("wb-mr6c_10", {`, `defineVirtualDevice("wb-mr6c_20", {`, 1},
+		{`log("wb-mr6c_10 is off"); // wb-mr6c_10/K1 isn't used`, `log("wb-mr6c_10 is off"); // wb-mr6c_10/K1 isn't used`, 0},
+		{`/* "wb-msw/temp" */ "wb-msw/temp"`, `/* "wb-msw/temp" */ "wb-msw2/temperature"`, 1},
+		{`"wb-mr6c_10\/K1"`, `"wb-mr6c_10\/K1"`, 0},
+		{`mydev["wb-mr6c_10"]`, `mydev["wb-mr6c_10"]`, 0},
+	} {
+		actual, count := RewriteReferences(item.src, testRenames)
+		assert.Equal(t, item.expected, actual, item.src)
+		assert.Equal(t, item.count, count, item.src)
+	}
+}
+
+func TestValidateReferenceRenames(t *testing.T) {
+	assert.NoError(t, testRenames.Validate())
+	for _, renames := range []ReferenceRenames{
+		{},
+		{"wb-mr6c_10": "wb-mr6c_20/K1"},
+		{"wb-msw/temp": "temperature"},
+		{"wb-msw/temp/x": "wb-msw/y"},
+		{"wb-msw/temp": "wb-msw/\"temp\""},
+		{"": "wb-msw"},
+	} {
+		assert.Error(t, renames.Validate(), "%v", renames)
+	}
+
+	renames, err := ParseReferenceRenames("wb-mr6c_10=wb-mr6c_20, wb-msw/temp=wb-msw2/temperature")
+	assert.NoError(t, err)
+	assert.Equal(t, ReferenceRenames{
+		"wb-mr6c_10":  "wb-mr6c_20",
+		"wb-msw/temp": "wb-msw2/temperature",
+	}, renames)
+	_, err = ParseReferenceRenames("wb-mr6c_10")
+	assert.Error(t, err)
+}
+
+func TestRenameReferencesInDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wbrules-refactor")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	src := "var relay = \"wb-mr6c_10/K1\";\n\ndev[relay] = dev.heating.enabled;\n"
+	path := filepath.Join(dir, "heating.js")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(src), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other.js"), []byte("// nothing here\n"), 0644))
+
+	expected := []RefactorFileResult{
+		{
+			Path:         "heating.js",
+			Replacements: 2,
+			Diff: "--- a/heating.js\n+++ b/heating.js\n" +
+				"@@ -1 +1 @@\n" +
+				"-var relay = \"wb-mr6c_10/K1\";\n" +
+				"+var relay = \"wb-mr6c_20/K1\";\n" +
+				"@@ -3 +3 @@\n" +
+				"-dev[relay] = dev.heating.enabled;\n" +
+				"+dev[relay] = dev.heating[\"heating enabled\"];\n",
+		},
+	}
+	results, err := RenameReferencesInDir(dir, testRenames, true)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, results)
+	bs, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, src, string(bs), "dry run must not change the files")
+
+	results, err = RenameReferencesInDir(dir, testRenames, false)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, results)
+	bs, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "var relay = \"wb-mr6c_20/K1\";\n\ndev[relay] = dev.heating[\"heating enabled\"];\n", string(bs))
+}
@@ -3,6 +3,13 @@ package wbrules
 import (
 	wbgo "github.com/contactless/wbgo"
 	"github.com/stretchr/objx"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	RULE_ARGS_CAPACITY = 4
 )
 
 type DepTracker interface {
@@ -96,10 +103,23 @@ func (ruleCond *EdgeTriggeredRuleCondition) Check(cell *Cell) (bool, interface{}
 	return shouldFire, nil
 }
 
+// rearm makes the condition fire upon the next check
+// if it's true at that moment
+func (ruleCond *EdgeTriggeredRuleCondition) rearm() {
+	ruleCond.prevCondValue = false
+}
+
 type CellChangedRuleCondition struct {
 	RuleConditionBase
 	cellSpec CellSpec
 	oldValue interface{}
+	// fireOnRepublish makes the condition fire when
+	// the same value is received again
+	fireOnRepublish bool
+	oldValueSeq     uint64
+	// prevValue is the value of the cell
+	// before the last firing
+	prevValue interface{}
 }
 
 func NewCellChangedRuleCondition(cellSpec CellSpec) (*CellChangedRuleCondition, error) {
@@ -125,18 +145,33 @@ func (ruleCond *CellChangedRuleCondition) Check(cell *Cell) (bool, interface{})
 		return false, nil
 	}
 
-	v := cell.Value()
-	if ruleCond.oldValue == v && !cell.IsButton() {
+	v, seq := cell.Value(), cell.valueSeq
+	republished := ruleCond.fireOnRepublish && seq != ruleCond.oldValueSeq
+	if ruleCond.oldValue == v && !cell.IsButton() && !republished {
 		return false, nil
 	}
-	ruleCond.oldValue = v
+	ruleCond.prevValue = ruleCond.oldValue
+	ruleCond.oldValue, ruleCond.oldValueSeq = v, seq
 	return true, nil
 }
 
+func (ruleCond *CellChangedRuleCondition) PrevValue() interface{} {
+	return ruleCond.prevValue
+}
+
+// SetFireOnRepublish specifies whether the condition fires
+// when the cell receives the same value again, e.g. when
+// a device republishes its values periodically. Other
+// events such as meta changes don't make it fire.
+func (ruleCond *CellChangedRuleCondition) SetFireOnRepublish(fire bool) {
+	ruleCond.fireOnRepublish = fire
+}
+
 type FuncValueChangedRuleCondition struct {
 	RuleConditionBase
-	thunk    func() interface{}
-	oldValue interface{}
+	thunk     func() interface{}
+	oldValue  interface{}
+	prevValue interface{}
 }
 
 func NewFuncValueChangedRuleCondition(f func() interface{}) *FuncValueChangedRuleCondition {
@@ -148,20 +183,47 @@ func NewFuncValueChangedRuleCondition(f func() interface{}) *FuncValueChangedRul
 
 func (ruleCond *FuncValueChangedRuleCondition) Check(cell *Cell) (bool, interface{}) {
 	v := ruleCond.thunk()
-	if ruleCond.oldValue == v {
+	// the function may return an object or an array
+	// that can't be compared using ==
+	if reflect.DeepEqual(ruleCond.oldValue, v) {
 		return false, nil
 	}
-	ruleCond.oldValue = v
+	ruleCond.prevValue, ruleCond.oldValue = ruleCond.oldValue, v
 	return true, v
 }
 
+func (ruleCond *FuncValueChangedRuleCondition) PrevValue() interface{} {
+	return ruleCond.prevValue
+}
+
+// ValueChangeCondition is implemented by the conditions
+// that fire when the value of a cell or a function changes
+type ValueChangeCondition interface {
+	RuleCondition
+	// PrevValue returns the value before the change
+	// that made the condition fire last time
+	PrevValue() interface{}
+}
+
+// condFiring describes a firing of a whenChanged condition
+type condFiring struct {
+	cond     RuleCondition
+	newValue interface{}
+}
+
 type OrRuleCondition struct {
 	RuleConditionBase
 	conds []RuleCondition
+	// firings lists the conditions that fired
+	// during the last check
+	firings []condFiring
 }
 
 func NewOrRuleCondition(conds []RuleCondition) *OrRuleCondition {
-	return &OrRuleCondition{conds: conds}
+	return &OrRuleCondition{
+		conds:   conds,
+		firings: make([]condFiring, 0, len(conds)),
+	}
 }
 
 func (ruleCond *OrRuleCondition) GetCells() []*CellSpec {
@@ -172,13 +234,43 @@ func (ruleCond *OrRuleCondition) GetCells() []*CellSpec {
 	return r
 }
 
+// Check checks all of the conditions, so the ones that changed
+// simultaneously don't get lost. The first firing is returned,
+// the rest is available via ExtraFirings().
 func (ruleCond *OrRuleCondition) Check(cell *Cell) (bool, interface{}) {
+	ruleCond.firings = ruleCond.firings[:0]
 	for _, cond := range ruleCond.conds {
 		if shouldFire, newValue := cond.Check(cell); shouldFire {
-			return true, newValue
+			ruleCond.firings = append(ruleCond.firings, condFiring{cond, newValue})
 		}
 	}
-	return false, nil
+	if len(ruleCond.firings) == 0 {
+		return false, nil
+	}
+	return true, ruleCond.firings[0].newValue
+}
+
+func (ruleCond *OrRuleCondition) PrevValue() interface{} {
+	if len(ruleCond.firings) == 0 {
+		return nil
+	}
+	return prevCondValue(ruleCond.firings[0].cond)
+}
+
+// ExtraFirings returns the firings found by the last check
+// besides the first one
+func (ruleCond *OrRuleCondition) ExtraFirings() []condFiring {
+	if len(ruleCond.firings) == 0 {
+		return nil
+	}
+	return ruleCond.firings[1:]
+}
+
+func prevCondValue(cond RuleCondition) interface{} {
+	if c, ok := cond.(ValueChangeCondition); ok {
+		return c.PrevValue()
+	}
+	return nil
 }
 
 type CronRuleCondition struct {
@@ -196,6 +288,28 @@ func (ruleCond *CronRuleCondition) MaybeAddToCron(cron Cron, thunk func()) (adde
 	return
 }
 
+// ruleArgsPool holds argument maps for rule callbacks.
+// Rule callbacks don't retain their arguments (they're converted
+// to JS objects when the callback is invoked) so the maps
+// can be reused, reducing GC pressure when many cell
+// changes are being processed.
+var ruleArgsPool = sync.Pool{
+	New: func() interface{} {
+		return make(objx.Map, RULE_ARGS_CAPACITY)
+	},
+}
+
+func getRuleArgs() objx.Map {
+	return ruleArgsPool.Get().(objx.Map)
+}
+
+func putRuleArgs(args objx.Map) {
+	for k := range args {
+		delete(args, k)
+	}
+	ruleArgsPool.Put(args)
+}
+
 type Rule struct {
 	tracker     DepTracker
 	name        string
@@ -203,6 +317,69 @@ type Rule struct {
 	then        ESCallbackFunc
 	shouldCheck bool
 	nonCellRule bool
+	lastResult  CallbackResult
+	// ignoreStartupDelay makes the rule fire during
+	// the startup window
+	ignoreStartupDelay bool
+	suppressed         bool
+	// startupEdge is set for the asSoonAs rules whose
+	// condition became true during the startup window
+	startupEdge bool
+	// replaying is set for the edge-triggered rules during
+	// the initial replay of the retained values if they
+	// must not fire, see SetStartupEdgeTriggers()
+	replaying bool
+	// waitReady makes the rule skip cron firings
+	// till the engine is ready
+	waitReady    bool
+	waitingReady bool
+	// profile is the execution profile of the script
+	// that defined the rule
+	profile *ExecProfile
+	// script is the path of the script that defined the rule
+	script string
+	// disabled rules don't fire, but their
+	// dependencies are still tracked
+	disabled bool
+	// destroyed rules may stay in the rule list
+	// till the end of the current rule pass
+	destroyed bool
+	// onFire is invoked before the then callback and returns
+	// the sequence number of the firing, onFired is invoked
+	// after the then callback returns and onChecked is
+	// invoked after the condition is checked
+	onFire    func(rule *Rule, args objx.Map) uint64
+	onFired   func(rule *Rule, elapsed time.Duration)
+	onChecked func(rule *Rule, elapsed time.Duration)
+	firingSeq uint64
+	// timings holds the execution time statistics.
+	// They're kept when the rule is redefined.
+	timings *ruleTimings
+	// fireCount is the number of times the rule fired.
+	// It's kept when the rule is redefined.
+	fireCount uint64
+	// debounce delays the then callback till the rule stops
+	// firing for the specified time, throttle makes the rule
+	// fire at most once per the specified time. In both cases
+	// then callback receives the arguments of the last firing.
+	debounce, throttle time.Duration
+	// delay is used to schedule the delayed firings
+	delay       func(d time.Duration, thunk func()) func()
+	stopDelay   func()
+	pendingArgs objx.Map
+	hasPending  bool
+	// priority determines the evaluation order of the rules
+	// and decides which rule wins when several rules write
+	// the same cell during a single rule pass
+	priority int
+	// seq is the definition sequence number of the rule
+	seq int
+	// source identifies the rule as the source
+	// of the cell writes, see Cell.Source()
+	source string
+	// immediateWrites makes the cell writes of the rule
+	// bypass the deferral, see SetDeferredWrites()
+	immediateWrites bool
 }
 
 func NewRule(tracker DepTracker, name string, cond RuleCondition, then ESCallbackFunc) *Rule {
@@ -213,6 +390,7 @@ func NewRule(tracker DepTracker, name string, cond RuleCondition, then ESCallbac
 		then:        then,
 		shouldCheck: false,
 		nonCellRule: false,
+		source:      CELL_SOURCE_RULE_PREFIX + name,
 	}
 	rule.StoreInitiallyKnownDeps()
 	return rule
@@ -237,39 +415,236 @@ func (rule *Rule) Check(cell *Cell) {
 		return
 	}
 	rule.tracker.StartTrackingDeps()
+	start := time.Now()
 	shouldFire, newValue := rule.cond.Check(cell)
-	var args objx.Map
+	if rule.onChecked != nil {
+		rule.onChecked(rule, time.Since(start))
+	}
 	rule.tracker.StoreRuleDeps(rule)
 	rule.shouldCheck = false
 
-	switch {
-	case !shouldFire:
+	if shouldFire && rule.suppressed && !rule.replaying {
+		if _, ok := rule.cond.(*EdgeTriggeredRuleCondition); ok {
+			rule.startupEdge = true
+		}
+	}
+	if !shouldFire || rule.suppressed || rule.replaying || rule.disabled {
 		return
+	}
+	rule.fireWith(cell, newValue, prevCondValue(rule.cond))
+	if or, ok := rule.cond.(*OrRuleCondition); ok {
+		// several cells or functions listed in whenChanged
+		// may change at once, each change is handled
+		// by a separate invocation of the then callback
+		for _, firing := range or.ExtraFirings() {
+			if rule.then == nil || rule.disabled {
+				// redefined or disabled by the then callback
+				break
+			}
+			rule.fireWith(cell, firing.newValue, prevCondValue(firing.cond))
+		}
+	}
+}
+
+func (rule *Rule) fireWith(cell *Cell, newValue, oldValue interface{}) {
+	var args objx.Map
+	switch {
 	case newValue != nil:
-		args = objx.New(map[string]interface{}{
-			"newValue": newValue,
-		})
+		args = getRuleArgs()
+		args["newValue"] = newValue
 	case cell != nil:
-		args = objx.New(map[string]interface{}{
-			"device":   cell.DevName(),
-			"cell":     cell.Name(),
-			"newValue": cell.Value(),
-		})
+		args = getRuleArgs()
+		args["device"] = cell.devNameArg
+		args["cell"] = cell.nameArg
+		args["newValue"] = cell.Value()
+	}
+	if args != nil && oldValue != nil {
+		args["oldValue"] = oldValue
+	}
+	rule.fire(args)
+	if args != nil {
+		putRuleArgs(args)
+	}
+}
+
+// fire invokes the then callback right away unless
+// the rule is debounced or throttled
+func (rule *Rule) fire(args objx.Map) {
+	if (rule.debounce <= 0 && rule.throttle <= 0) || rule.delay == nil {
+		rule.invokeThen(args)
+		return
 	}
-	rule.then(args)
+	// the args come from the pool, so they must be copied
+	rule.pendingArgs, rule.hasPending = copyRuleArgs(args), true
+	switch {
+	case rule.debounce > 0:
+		if rule.stopDelay != nil {
+			rule.stopDelay()
+		}
+		rule.stopDelay = rule.delay(rule.debounce, rule.firePending)
+	case rule.stopDelay == nil:
+		// the rule isn't throttled at the moment
+		rule.firePending()
+	}
+}
+
+func (rule *Rule) firePending() {
+	rule.stopDelay = nil
+	if !rule.hasPending || rule.then == nil {
+		return
+	}
+	args := rule.pendingArgs
+	rule.pendingArgs, rule.hasPending = nil, false
+	if rule.suppressed || rule.disabled {
+		return
+	}
+	if rule.throttle > 0 {
+		rule.stopDelay = rule.delay(rule.throttle, rule.firePending)
+	}
+	rule.invokeThen(args)
+}
+
+// cancelPending drops the delayed firing of a debounced
+// or throttled rule, if any
+func (rule *Rule) cancelPending() {
+	if rule.stopDelay != nil {
+		rule.stopDelay()
+		rule.stopDelay = nil
+	}
+	rule.pendingArgs, rule.hasPending = nil, false
+}
+
+func copyRuleArgs(args objx.Map) objx.Map {
+	if args == nil {
+		return nil
+	}
+	r := make(objx.Map, len(args))
+	for k, v := range args {
+		r[k] = v
+	}
+	return r
+}
+
+func (rule *Rule) invokeThen(args objx.Map) {
+	// the rule may fire again while its then
+	// callback is running, e.g. due to cell writes
+	savedSeq := rule.firingSeq
+	if rule.onFire != nil {
+		rule.firingSeq = rule.onFire(rule, args)
+	}
+	start := time.Now()
+	rule.lastResult = NewCallbackResult(rule.then(args))
+	if rule.onFired != nil {
+		rule.onFired(rule, time.Since(start))
+	}
+	rule.firingSeq = savedSeq
+}
+
+// LastResult returns the value returned by the rule's
+// then callback when the rule fired last time
+func (rule *Rule) LastResult() CallbackResult {
+	return rule.lastResult
+}
+
+// SetIgnoreStartupDelay specifies whether the rule's then
+// callback must run during the startup window
+func (rule *Rule) SetIgnoreStartupDelay(ignore bool) {
+	rule.ignoreStartupDelay = ignore
+}
+
+func (rule *Rule) setStartupWindow(active bool) {
+	rule.suppressed = active && !rule.ignoreStartupDelay
+	if active || !rule.startupEdge {
+		return
+	}
+	// the edge that happened during the startup window
+	// isn't lost, the rule fires during the rule run that
+	// follows the window if its condition is still true
+	rule.startupEdge = false
+	if cond, ok := rule.cond.(*EdgeTriggeredRuleCondition); ok {
+		cond.rearm()
+	}
+}
+
+// SetDebounce makes the rule invoke its then callback only
+// after it stops firing for the specified time
+func (rule *Rule) SetDebounce(d time.Duration) {
+	rule.debounce = d
+}
+
+// SetThrottle makes the rule invoke its then callback at most
+// once per the specified time. The firings that happen in between
+// are coalesced into a single one at the end of the period.
+func (rule *Rule) SetThrottle(d time.Duration) {
+	rule.throttle = d
+}
+
+// SetWaitReady specifies whether cron firings of the rule
+// must be skipped till the engine is ready
+func (rule *Rule) SetWaitReady(wait bool) {
+	rule.waitReady = wait
+}
+
+// SetPriority sets the priority of the rule. The rules with
+// higher priority are evaluated first and their cell writes
+// can't be overridden by the rules with lower priority, so
+// safety rules should have higher priority than the rules
+// they guard. Must be called before the rule is defined.
+func (rule *Rule) SetPriority(priority int) {
+	rule.priority = priority
+}
+
+// SetImmediateWrites makes the cell writes of the rule visible
+// to the other rules of the same rule pass when deferred writes
+// are enabled. Must be called before the rule is defined.
+func (rule *Rule) SetImmediateWrites(immediate bool) {
+	rule.immediateWrites = immediate
+}
+
+func (rule *Rule) setReplay(active bool) {
+	rule.replaying = active && !rule.ignoreStartupDelay && isEdgeTriggered(rule.cond)
+}
+
+// isEdgeTriggered returns true for the conditions that fire
+// on value changes, i.e. whenChanged and asSoonAs
+func isEdgeTriggered(cond RuleCondition) bool {
+	switch cond.(type) {
+	case *EdgeTriggeredRuleCondition, *CellChangedRuleCondition,
+		*FuncValueChangedRuleCondition, *OrRuleCondition:
+		return true
+	default:
+		return false
+	}
+}
+
+func (rule *Rule) setWaitingReady(waiting bool) {
+	rule.waitingReady = waiting && rule.waitReady
 }
 
 func (rule *Rule) MaybeAddToCron(cron Cron) {
 	var err error
 	rule.nonCellRule, err = rule.cond.MaybeAddToCron(cron, func() {
-		rule.then(nil)
+		if !rule.suppressed && !rule.waitingReady && !rule.disabled && !rule.destroyed {
+			rule.fire(nil)
+		}
 	})
 	if err != nil {
 		wbgo.Error.Printf("rule %s: invalid cron spec: %s", rule.name, err)
 	}
 }
 
+// fireMessage fires the whenTopic rule passing
+// the MQTT message to it as newValue
+func (rule *Rule) fireMessage(msg objx.Map) {
+	if rule.then == nil || rule.suppressed || rule.disabled {
+		return
+	}
+	rule.fireWith(nil, msg, nil)
+}
+
 func (rule *Rule) Destroy() {
+	rule.cancelPending()
+	rule.destroyed = true
 	rule.then = nil
 	rule.cond = NewDestroyedRuleCondition()
 }
@@ -0,0 +1,50 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleAccessStatsSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleAccessStatsSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_access.js")
+}
+
+func (s *RuleAccessStatsSuite) findStats(report *CellAccessReport, devName, cellName string) *CellAccessStats {
+	for n := range report.Cells {
+		if report.Cells[n].Device == devName && report.Cells[n].Cell == cellName {
+			return &report.Cells[n]
+		}
+	}
+	s.Require().Fail("cell not found in the report", "%s/%s", devName, cellName)
+	return nil
+}
+
+func (s *RuleAccessStatsSuite) TestReport() {
+	s.publish("/devices/somedev/controls/sw", "1", "somedev/sw", "vdev/out")
+	s.Verify(
+		"tst -> /devices/somedev/controls/sw: [1] (QoS 1, retained)",
+		"driver -> /devices/vdev/controls/out: [1] (QoS 1, retained)",
+	)
+
+	report := s.engine.CellAccessReport()
+	s.Equal([]string{"stale/x", "vdev/unused"}, report.UnreferencedCells)
+	s.Equal([]string{"stale"}, report.UnreferencedDevices)
+
+	sw := s.findStats(report, "somedev", "sw")
+	s.Equal(1, sw.Rules)
+	temp := s.findStats(report, "somedev", "temp")
+	s.NotZero(temp.Reads)
+	s.Zero(temp.Writes)
+	out := s.findStats(report, "vdev", "out")
+	s.Equal(uint64(1), out.Writes)
+}
+
+func TestRuleAccessStatsSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleAccessStatsSuite),
+	)
+}
@@ -108,6 +108,8 @@ func (s *AlarmSuite) verifyNotificationMsgs(text string) {
 		fmt.Sprintf("[info] EMAIL TO: someone@example.com SUBJ: alarm! TEXT: %s", text),
 		fmt.Sprintf("[info] EMAIL TO: anotherone@example.com SUBJ: Alarm: %s TEXT: %s", text, text),
 		fmt.Sprintf("[info] SMS TO: +78122128506 TEXT: %s", text),
+		fmt.Sprintf("[info] TELEGRAM TO: 123456789 TEXT: %s", text),
+		fmt.Sprintf("[info] WEBHOOK TEXT: %s", text),
 	)
 }
 
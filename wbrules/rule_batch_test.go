@@ -0,0 +1,55 @@
+package wbrules
+
+import (
+	"fmt"
+	"github.com/stretchr/objx"
+	"reflect"
+	"testing"
+)
+
+func TestRunRulesForCells(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	dev := model.EnsureLocalDevice("meter", "meter")
+	dev.SetCell("a", "value", 0, false)
+	dev.SetCell("b", "value", 0, false)
+	devProxy := engine.GetDeviceProxy("meter")
+
+	condCount := 0
+	engine.DefineRule(NewRule(engine, "sum", NewLevelTriggeredRuleCondition(func() bool {
+		condCount++
+		return devProxy.EnsureCell("a").Value().(float64)+devProxy.EnsureCell("b").Value().(float64) > 100
+	}), func(args objx.Map) interface{} {
+		return nil
+	}))
+	var changes []string
+	for _, name := range []string{"a", "b"} {
+		cond, err := NewCellChangedRuleCondition(CellSpec{"meter", name})
+		if err != nil {
+			t.Fatalf("NewCellChangedRuleCondition(): %s", err)
+		}
+		engine.DefineRule(NewRule(engine, name+"Changed", cond, func(args objx.Map) interface{} {
+			changes = append(changes, fmt.Sprintf("%v=%v", args["cell"], args["newValue"]))
+			return nil
+		}))
+	}
+	engine.RunRules(nil, NO_TIMER_NAME)
+	condCount, changes = 0, nil
+
+	specA, specB := &CellSpec{"meter", "a"}, &CellSpec{"meter", "b"}
+	set := func(cellSpec *CellSpec, value float64) {
+		cell := engine.model.EnsureCell(cellSpec)
+		cell.maybeSetValueQuiet(value, true)
+		cell.gotValue = true
+	}
+	set(specA, 10)
+	set(specB, 20)
+	set(specA, 30)
+	engine.RunRulesForCells([]*CellSpec{specA, specB, specA})
+	if condCount != 1 {
+		t.Errorf("the condition was checked %d times instead of once", condCount)
+	}
+	expected := []string{"a=30", "b=20"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("bad changes: %v instead of %v", changes, expected)
+	}
+}
@@ -0,0 +1,48 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"strings"
+	"testing"
+)
+
+type RuleBenchmarkSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleBenchmarkSuite) SetupTest() {
+	s.SetupSkippingDefs()
+}
+
+func (s *RuleBenchmarkSuite) TestGenerateScript() {
+	script := GenerateBenchmarkScript(BenchmarkOptions{Rules: 3, Cells: 2, Changes: 1})
+	s.Contains(script, `"c0": { type: "temperature", value: 0 }`)
+	s.Contains(script, `"c1": { type: "temperature", value: 0 }`)
+	s.Equal(3, strings.Count(script, "defineRule("))
+	s.Contains(script, `whenChanged: "_wbrulesBench/c0"`)
+	s.Contains(script, `return dev["_wbrulesBench/c1"] > dev["_wbrulesBench/c0"];`)
+}
+
+func (s *RuleBenchmarkSuite) TestBadOptions() {
+	_, err := RunBenchmark(s.engine, BenchmarkOptions{Rules: 0, Cells: 1, Changes: 1})
+	s.Error(err)
+	_, err = RunBenchmark(s.engine, BenchmarkOptions{Rules: 1, Cells: 1, Changes: 1, ChangeRate: -1})
+	s.Error(err)
+}
+
+func (s *RuleBenchmarkSuite) TestBenchmark() {
+	r, err := RunBenchmark(s.engine, BenchmarkOptions{Rules: 20, Cells: 5, Changes: 50})
+	s.Ck("RunBenchmark()", err)
+	s.Equal(50, r.Changes)
+	s.True(r.Min <= r.P50)
+	s.True(r.P50 <= r.P90)
+	s.True(r.P90 <= r.P99)
+	s.True(r.P99 <= r.Max)
+	s.True(r.AllocsPerRun > 0)
+}
+
+func TestRuleBenchmarkSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleBenchmarkSuite),
+	)
+}
@@ -0,0 +1,79 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleCascadeLoop(t *testing.T) {
+	model := newTestModel(t)
+	changes := make(chan *CellSpec, 100)
+	model.cellChangeChannels = append(model.cellChangeChannels, changes)
+	engine := NewRuleEngine(model, nullMQTTClient{})
+	engine.SetMaxCascadeDepth(5)
+	dev := model.EnsureLocalDevice("loop", "loop")
+	ping := dev.SetCell("ping", "switch", false, false)
+	pong := dev.SetCell("pong", "switch", false, false)
+	fireCount := 0
+	defineLoopRule := func(name string, from, to *Cell) {
+		cond, err := NewCellChangedRuleCondition(CellSpec{"loop", from.Name()})
+		if err != nil {
+			t.Fatalf("NewCellChangedRuleCondition(): %s", err)
+		}
+		engine.DefineRule(NewRule(engine, name, cond, func(args objx.Map) interface{} {
+			fireCount++
+			if err := engine.setCellValue(to, !to.Value().(bool)); err != nil {
+				t.Errorf("setCellValue(): %s", err)
+			}
+			return nil
+		}))
+	}
+	defineLoopRule("pingToPong", ping, pong)
+	defineLoopRule("pongToPing", pong, ping)
+
+	// the first rule run makes whenChanged rules
+	// remember the initial values
+	engine.RunRules(nil, NO_TIMER_NAME)
+	ping.SetValue(true)
+	for {
+		var cellSpec *CellSpec
+		select {
+		case cellSpec = <-changes:
+		case <-time.After(100 * time.Millisecond):
+		}
+		if cellSpec == nil {
+			break
+		}
+		engine.RunRules(cellSpec, NO_TIMER_NAME)
+		if fireCount > 100 {
+			t.Fatalf("the feedback loop wasn't stopped")
+		}
+	}
+	if fireCount != 6 {
+		t.Errorf("the rules fired %d times instead of 6", fireCount)
+	}
+	ruleErrors := engine.GetRuleErrors()
+	if len(ruleErrors) != 1 {
+		t.Fatalf("bad rule errors: %#v", ruleErrors)
+	}
+	expected := "rule cascade is too long, possible feedback loop: " +
+		"pingToPong -> pongToPing -> pingToPong -> pongToPing -> pingToPong -> pongToPing"
+	if !strings.HasPrefix(ruleErrors[0].Message, expected) {
+		t.Errorf("bad rule error: %s", ruleErrors[0].Message)
+	}
+	if len(engine.cellCauses) != 0 {
+		t.Errorf("cell causes not cleared: %v", engine.cellCauses)
+	}
+
+	// a new external change starts a new cascade
+	fireCount = 0
+	engine.RunRules(nil, NO_TIMER_NAME)
+	ping.SetValue(!ping.Value().(bool))
+	cellSpec := <-changes
+	engine.RunRules(cellSpec, NO_TIMER_NAME)
+	if fireCount != 1 {
+		t.Errorf("the rule didn't fire after an external change")
+	}
+}
@@ -61,6 +61,63 @@ func (s *RuleCellChangesSuite) TestAssigningSameValueToACellSeveralTimes() {
 	s.EnsureNoErrorsOrWarnings()
 }
 
+func (s *RuleCellChangesSuite) TestFireOnRepublish() {
+	s.publish("/devices/somedev/controls/meter/meta/type", "value", "somedev/meter")
+	s.publish("/devices/somedev/controls/meter", "42", "somedev/meter")
+	s.Verify(
+		"tst -> /devices/somedev/controls/meter/meta/type: [value] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/meter: [42] (QoS 1, retained)",
+		"[info] meterChanged: 42",
+		"[info] meterReported: 42",
+	)
+
+	// the same value is republished
+	s.publish("/devices/somedev/controls/meter", "42", "somedev/meter")
+	s.Verify(
+		"tst -> /devices/somedev/controls/meter: [42] (QoS 1, retained)",
+		"[info] meterReported: 42",
+	)
+
+	// meta changes don't count as republishing
+	s.publish("/devices/somedev/controls/meter/meta/type", "value", "somedev/meter")
+	s.Verify("tst -> /devices/somedev/controls/meter/meta/type: [value] (QoS 1, retained)")
+
+	s.publish("/devices/somedev/controls/meter", "43", "somedev/meter")
+	s.Verify(
+		"tst -> /devices/somedev/controls/meter: [43] (QoS 1, retained)",
+		"[info] meterChanged: 43",
+		"[info] meterReported: 43",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleCellChangesSuite) TestOldValues() {
+	s.publish("/devices/somedev/controls/level/meta/type", "value", "somedev/level")
+	s.publish("/devices/somedev/controls/level", "5", "somedev/level")
+	s.Verify(
+		"tst -> /devices/somedev/controls/level/meta/type: [value] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/level: [5] (QoS 1, retained)",
+		"[info] levelChanged: somedev/level: none -> 5",
+		"[info] levelChanged: high: none -> false",
+	)
+
+	// both the cell and the function change at once,
+	// each change is handled separately
+	s.publish("/devices/somedev/controls/level", "20", "somedev/level")
+	s.Verify(
+		"tst -> /devices/somedev/controls/level: [20] (QoS 1, retained)",
+		"[info] levelChanged: somedev/level: 5 -> 20",
+		"[info] levelChanged: high: false -> true",
+	)
+
+	s.publish("/devices/somedev/controls/level", "30", "somedev/level")
+	s.Verify(
+		"tst -> /devices/somedev/controls/level: [30] (QoS 1, retained)",
+		"[info] levelChanged: somedev/level: 20 -> 30",
+	)
+	s.VerifyEmpty()
+}
+
 func TestRuleCellChangesSuite(t *testing.T) {
 	testutils.RunSuites(t,
 		new(RuleCellChangesSuite),
@@ -0,0 +1,57 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleCoalesceSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleCoalesceSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_coalesce.js")
+}
+
+func (s *RuleCoalesceSuite) enableCoalescing(logSuppressed bool) {
+	s.model.CallSync(func() {
+		s.engine.SetWriteCoalescing(true, logSuppressed)
+	})
+}
+
+func (s *RuleCoalesceSuite) TestFinalValuePublished() {
+	s.enableCoalescing(false)
+	s.publish("/devices/coalesce/controls/trigger/on", "1", "coalesce/trigger")
+	s.Verify(
+		"tst -> /devices/coalesce/controls/trigger/on: [1] (QoS 1)",
+		"driver -> /devices/coalesce/controls/trigger: [1] (QoS 1, retained)",
+		"driver -> /devices/coalesce/controls/counter: [3] (QoS 1, retained)",
+		"[info] counter: 3",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleCoalesceSuite) TestSuppressedWritesLogged() {
+	s.enableCoalescing(true)
+	s.publish("/devices/wbrules/controls/Rule debugging/on", "1", "wbrules/Rule debugging")
+	s.Verify(
+		"tst -> /devices/wbrules/controls/Rule debugging/on: [1] (QoS 1)",
+		"driver -> /devices/wbrules/controls/Rule debugging: [1] (QoS 1, retained)",
+	)
+	s.publish("/devices/coalesce/controls/trigger/on", "1", "coalesce/trigger")
+	s.Verify(
+		"tst -> /devices/coalesce/controls/trigger/on: [1] (QoS 1)",
+		"driver -> /devices/coalesce/controls/trigger: [1] (QoS 1, retained)",
+		"[debug] suppressed intermediate write: coalesce/counter = 1",
+		"[debug] suppressed intermediate write: coalesce/counter = 2",
+		"driver -> /devices/coalesce/controls/counter: [3] (QoS 1, retained)",
+		"[info] counter: 3",
+	)
+	s.VerifyEmpty()
+}
+
+func TestRuleCoalesceSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleCoalesceSuite),
+	)
+}
@@ -0,0 +1,72 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"regexp"
+	"testing"
+)
+
+type RuleCombineSensorsSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleCombineSensorsSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_combine.js")
+}
+
+func (s *RuleCombineSensorsSuite) publishSensor(name, value string) {
+	s.publish("/devices/somedev/controls/"+name+"/meta/type", "temperature", "somedev/"+name)
+	s.publish("/devices/somedev/controls/"+name, value, "somedev/"+name)
+}
+
+func (s *RuleCombineSensorsSuite) TestCombineSensors() {
+	s.publishSensor("t1", "21")
+	s.Verify(
+		"tst -> /devices/somedev/controls/t1/meta/type: [temperature] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/t1: [21] (QoS 1, retained)",
+		"driver -> /devices/roomTemp/controls/value: [21] (QoS 1, retained)",
+		"driver -> /devices/avgTemp/controls/value: [21] (QoS 1, retained)",
+	)
+
+	s.publishSensor("t2", "21.4")
+	s.Verify(
+		"tst -> /devices/somedev/controls/t2/meta/type: [temperature] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/t2: [21.4] (QoS 1, retained)",
+		"driver -> /devices/roomTemp/controls/value: [21.2] (QoS 1, retained)",
+		"driver -> /devices/avgTemp/controls/value: [21.1] (QoS 1, retained)",
+	)
+
+	// the outlier is rejected
+	s.publishSensor("t3", "30")
+	s.Verify(
+		"tst -> /devices/somedev/controls/t3/meta/type: [temperature] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/t3: [30] (QoS 1, retained)",
+		"driver -> /devices/roomTemp/controls/error: [1] (QoS 1, retained)",
+	)
+
+	s.publish("/devices/somedev/controls/t3", "21.8", "somedev/t3")
+	s.Verify(
+		"tst -> /devices/somedev/controls/t3: [21.8] (QoS 1, retained)",
+		"driver -> /devices/roomTemp/controls/value: [21.4] (QoS 1, retained)",
+		"driver -> /devices/roomTemp/controls/error: [0] (QoS 1, retained)",
+	)
+}
+
+func (s *RuleCombineSensorsSuite) TestInvalidDefinitions() {
+	for _, script := range []string{
+		`combineSensors("bad", [])`,
+		`combineSensors("bad", ["nosuchalias"])`,
+		`combineSensors("bad", ["somedev/t1"], { strategy: "mode" })`,
+		`combineSensors("bad", ["somedev/t1", "somedev/t2"], { strategy: "weighted", weights: [1] })`,
+	} {
+		s.Error(s.engine.EvalScript(script), script)
+		s.Verify(regexp.MustCompile(`^driver -> /wbrules/log/error: \[eval error: .*combineSensors: `))
+	}
+	s.EnsureGotErrors()
+}
+
+func TestRuleCombineSensorsSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleCombineSensorsSuite),
+	)
+}
@@ -0,0 +1,98 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+	"time"
+)
+
+type RuleCommandSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleCommandSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_command.js")
+	s.publish("/devices/relays/controls/K1/meta/type", "switch", "relays/K1")
+	s.publish("/devices/relays/controls/K1", "0", "relays/K1")
+	s.Verify(
+		"tst -> /devices/relays/controls/K1/meta/type: [switch] (QoS 1, retained)",
+		"tst -> /devices/relays/controls/K1: [0] (QoS 1, retained)",
+	)
+}
+
+func (s *RuleCommandSuite) startPump() {
+	s.engine.EvalScript("startPump()")
+	s.Verify(
+		"driver -> /devices/relays/controls/K1/on: [1] (QoS 1)",
+		"new fake timer: 1, 5000",
+		"[info] pending: true",
+	)
+}
+
+func (s *RuleCommandSuite) TestAck() {
+	s.startPump()
+	s.publish("/devices/relays/controls/K1", "1", "relays/K1")
+	s.Verify(
+		"tst -> /devices/relays/controls/K1: [1] (QoS 1, retained)",
+		"timer.Stop(): 1",
+		"[info] acked: true",
+	)
+	s.engine.EvalScript(`log("pending: {} {}", pumpCommand.pending, command.isPending("relays/K1"))`)
+	s.Verify("[info] pending: false false")
+}
+
+func (s *RuleCommandSuite) TestTimeout() {
+	s.startPump()
+	s.FireTimer(1, s.AdvanceTime(5*time.Second))
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] timeout",
+	)
+	// late status update is ignored
+	s.publish("/devices/relays/controls/K1", "1", "relays/K1")
+	s.Verify("tst -> /devices/relays/controls/K1: [1] (QoS 1, retained)")
+	s.VerifyEmpty()
+}
+
+func (s *RuleCommandSuite) TestCancel() {
+	s.startPump()
+	s.engine.EvalScript(`log("cancelled: {}", pumpCommand.cancel())`)
+	s.Verify(
+		"timer.Stop(): 1",
+		"[info] cancelled: true",
+	)
+	s.publish("/devices/relays/controls/K1", "1", "relays/K1")
+	s.Verify("tst -> /devices/relays/controls/K1: [1] (QoS 1, retained)")
+	s.VerifyEmpty()
+}
+
+func (s *RuleCommandSuite) TestStatusCell() {
+	s.publish("/devices/valves/controls/V1/meta/type", "switch", "valves/V1")
+	s.publish("/devices/valves/controls/V1_state/meta/type", "text", "valves/V1_state")
+	s.publish("/devices/valves/controls/V1_state", "closed", "valves/V1_state")
+	s.Verify(
+		"tst -> /devices/valves/controls/V1/meta/type: [switch] (QoS 1, retained)",
+		"tst -> /devices/valves/controls/V1_state/meta/type: [text] (QoS 1, retained)",
+		"tst -> /devices/valves/controls/V1_state: [closed] (QoS 1, retained)",
+	)
+	s.engine.EvalScript("openValve()")
+	s.Verify(
+		"driver -> /devices/valves/controls/V1/on: [1] (QoS 1)",
+		"new fake timer: 1, 2000",
+	)
+	s.publish("/devices/valves/controls/V1_state", "opening", "valves/V1_state")
+	s.Verify("tst -> /devices/valves/controls/V1_state: [opening] (QoS 1, retained)")
+	s.publish("/devices/valves/controls/V1_state", "open", "valves/V1_state")
+	s.Verify(
+		"tst -> /devices/valves/controls/V1_state: [open] (QoS 1, retained)",
+		"timer.Stop(): 1",
+		"[info] valve: open",
+	)
+}
+
+func TestRuleCommandSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleCommandSuite),
+	)
+}
@@ -0,0 +1,37 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleConsumerRestartSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleConsumerRestartSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_results.js")
+}
+
+func (s *RuleConsumerRestartSuite) TestResumeAfterUnexpectedClose() {
+	close(s.engine.cellChange)
+	s.Verify(
+		"[warning] cell change channel closed unexpectedly, resuming in 100ms",
+		"[info] cell change processing resumed (restart #1)",
+	)
+	s.EnsureGotWarnings()
+	s.True(s.engine.IsActive())
+	s.Equal(uint64(1), s.engine.EngineMetrics().CellChangeRestarts)
+
+	s.publish("/devices/somedev/controls/temp", "21", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [21] (QoS 1, retained)",
+		"[info] tempStatus fired: 21",
+	)
+}
+
+func TestRuleConsumerRestartSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleConsumerRestartSuite),
+	)
+}
@@ -0,0 +1,79 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleControlSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleControlSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_control.js")
+}
+
+func (s *RuleControlSuite) toggle(value string) {
+	s.publish("/devices/somedev/controls/sw", value, "somedev/sw")
+}
+
+func (s *RuleControlSuite) TestDisableRule() {
+	s.publish("/devices/somedev/controls/sw/meta/type", "switch", "somedev/sw")
+	s.toggle("1")
+	s.Verify(
+		"tst -> /devices/somedev/controls/sw/meta/type: [switch] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/sw: [1] (QoS 1, retained)",
+		"[info] sw: true",
+	)
+
+	s.Ck("SetRuleEnabled()", s.engine.SetRuleEnabled("switchLogger", false))
+	s.Verify("[info] rule switchLogger disabled")
+	s.toggle("0")
+	s.Verify("tst -> /devices/somedev/controls/sw: [0] (QoS 1, retained)")
+
+	// the rule stays disabled after the script is reloaded
+	s.ReplaceScript("testrules_control.js", "testrules_control_changed.js")
+	s.SkipTill("driver -> /wbrules/updates/changed: [testrules_control.js] (QoS 1)")
+	s.toggle("1")
+	s.Verify("tst -> /devices/somedev/controls/sw: [1] (QoS 1, retained)")
+	s.Equal([]RuleStatus{
+		{Name: "switchLogger", Enabled: false, Trigger: "whenChanged: somedev/sw"},
+	}, s.engine.RuleStatuses())
+
+	s.Ck("SetRuleEnabled()", s.engine.SetRuleEnabled("switchLogger", true))
+	s.Verify("[info] rule switchLogger enabled")
+	s.toggle("0")
+	s.Verify(
+		"tst -> /devices/somedev/controls/sw: [0] (QoS 1, retained)",
+		"[info] sw changed: false",
+	)
+
+	s.Equal(unknownRuleError, s.engine.SetRuleEnabled("nosuchrule", false))
+}
+
+func (s *RuleControlSuite) TestRuleFirings() {
+	s.publish("/devices/somedev/controls/sw/meta/type", "switch", "somedev/sw")
+	s.toggle("1")
+	s.toggle("0")
+	s.Verify(
+		"tst -> /devices/somedev/controls/sw/meta/type: [switch] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/sw: [1] (QoS 1, retained)",
+		"[info] sw: true",
+		"tst -> /devices/somedev/controls/sw: [0] (QoS 1, retained)",
+		"[info] sw: false",
+	)
+	firings := s.engine.RecentRuleFirings()
+	s.Len(firings, 2)
+	for _, firing := range firings {
+		s.Equal("switchLogger", firing.Rule)
+		s.Equal("somedev", firing.Device)
+		s.Equal("sw", firing.Cell)
+	}
+	s.False(firings[1].Time.Before(firings[0].Time))
+}
+
+func TestRuleControlSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleControlSuite),
+	)
+}
@@ -0,0 +1,107 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleControlsSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleControlsSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_controls.js")
+}
+
+func (s *RuleControlsSuite) TestAddRemoveControl() {
+	s.Ck("addControl()", s.engine.EvalScript(`
+	  getDevice("dynDev").addControl("zone1", {
+	    type: "range",
+	    value: 10,
+	    max: 100,
+	    units: "%"
+	  });`))
+	s.Verify(
+		"driver -> /devices/dynDev/controls/zone1/meta/type: [range] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/zone1/meta/order: [2] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/zone1/meta/max: [100] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/zone1: [10] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/dynDev/controls/zone1/on",
+		"driver -> /devices/dynDev/controls/zone1/meta/units: [%] (QoS 1, retained)",
+	)
+
+	s.publish("/devices/dynDev/controls/zone1/on", "20", "dynDev/zone1")
+	s.Verify(
+		"tst -> /devices/dynDev/controls/zone1/on: [20] (QoS 1)",
+		"driver -> /devices/dynDev/controls/zone1: [20] (QoS 1, retained)",
+		"[info] zone1: 20",
+	)
+
+	s.Ck("isControlExists()", s.engine.EvalScript(`
+	  log("exists: {}", getDevice("dynDev").isControlExists("zone1"));
+	  tryControlOp(function (d) {
+	    d.addControl("zone1", { type: "switch", value: false });
+	  });`))
+	s.Verify(
+		"[info] exists: true",
+		"[info] error: addControl: dynDev/zone1: control already exists",
+	)
+
+	s.Ck("removeControl()", s.engine.EvalScript(`getDevice("dynDev").removeControl("zone1")`))
+	s.Verify(
+		"Unsubscribe -- driver: /devices/dynDev/controls/zone1/on",
+		"driver -> /devices/dynDev/controls/zone1: [] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/zone1/meta/max: [] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/zone1/meta/order: [] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/zone1/meta/type: [] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/zone1/meta/units: [] (QoS 1, retained)",
+	)
+
+	s.Ck("removeControl() again", s.engine.EvalScript(`
+	  log("exists: {}", getDevice("dynDev").isControlExists("zone1"));
+	  tryControlOp(function (d) {
+	    d.removeControl("zone1");
+	  });`))
+	s.Verify(
+		"[info] exists: false",
+		"[info] error: removeControl: dynDev/zone1: no such control",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleControlsSuite) TestReadonlyControl() {
+	s.Ck("addControl()", s.engine.EvalScript(`
+	  getDevice("dynDev").addControl("status", { type: "text", value: "ok", readonly: true })`))
+	s.Verify(
+		"driver -> /devices/dynDev/controls/status/meta/type: [text] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/status/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/status/meta/order: [2] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/status: [ok] (QoS 1, retained)",
+	)
+	s.Ck("removeControl()", s.engine.EvalScript(`getDevice("dynDev").removeControl("status")`))
+	s.Verify(
+		"driver -> /devices/dynDev/controls/status: [] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/status/meta/order: [] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/status/meta/readonly: [] (QoS 1, retained)",
+		"driver -> /devices/dynDev/controls/status/meta/type: [] (QoS 1, retained)",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleControlsSuite) TestNoSuchDevice() {
+	s.Ck("addControl()", s.engine.EvalScript(`
+	  try {
+	    getDevice("somedev").addControl("foo", { type: "switch", value: false });
+	  } catch (e) {
+	    log("error: {}", e.message);
+	  }`))
+	s.Verify("[info] error: addControl: no such virtual device: somedev")
+	s.VerifyEmpty()
+}
+
+func TestRuleControlsSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleControlsSuite),
+	)
+}
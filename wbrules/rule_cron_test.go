@@ -13,7 +13,7 @@ func (s *RuleCronSuite) SetupTest() {
 	s.SetupSkippingDefs("testrules_cron.js")
 }
 
-func (s *RuleCronSuite) TestCron() {
+func (s *RuleCronSuite) waitForCron() {
 	s.WaitFor(func() bool {
 		c := make(chan bool)
 		s.model.CallSync(func() {
@@ -21,6 +21,10 @@ func (s *RuleCronSuite) TestCron() {
 		})
 		return <-c
 	})
+}
+
+func (s *RuleCronSuite) TestCron() {
+	s.waitForCron()
 
 	s.cron.invokeEntries("@hourly")
 	s.cron.invokeEntries("@hourly")
@@ -54,6 +58,24 @@ func (s *RuleCronSuite) TestCron() {
 	)
 }
 
+func (s *RuleCronSuite) TestCronProperty() {
+	s.waitForCron()
+	s.cron.invokeEntries("0 30 7 * * 1-5")
+	s.Verify("[info] weekday rule fired")
+
+	s.engine.EvalScript(`
+	  try {
+	    defineRule("badCronRule", {
+	      when: function () { return true; },
+	      cron: "@hourly",
+	      then: function () {}
+	    });
+	  } catch (e) {
+	    log("error: {}", e.message);
+	  }`)
+	s.Verify("[info] error: invalid rule -- cannot combine 'when' with 'cron'")
+}
+
 func TestRuleCronSuite(t *testing.T) {
 	testutils.RunSuites(t,
 		new(RuleCronSuite),
@@ -0,0 +1,102 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"regexp"
+	"testing"
+	"time"
+)
+
+type RuleDebounceSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleDebounceSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_debounce.js")
+}
+
+func (s *RuleDebounceSuite) TestDebounce() {
+	s.publish("/devices/somedev/controls/foo/meta/type", "text", "somedev/foo")
+	s.publish("/devices/somedev/controls/foo", "a", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo/meta/type: [text] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/foo: [a] (QoS 1, retained)",
+		"new fake timer: 1, 500",
+	)
+
+	s.publish("/devices/somedev/controls/foo", "b", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [b] (QoS 1, retained)",
+		"timer.Stop(): 1",
+		"new fake timer: 2, 500",
+	)
+
+	ts := s.AdvanceTime(500 * time.Millisecond)
+	s.FireTimer(2, ts)
+	s.Verify(
+		"timer.fire(): 2",
+		"[info] debounced: somedev/foo=b",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleDebounceSuite) TestThrottle() {
+	s.publish("/devices/somedev/controls/bar/meta/type", "text", "somedev/bar")
+	s.publish("/devices/somedev/controls/bar", "1", "somedev/bar")
+	s.Verify(
+		"tst -> /devices/somedev/controls/bar/meta/type: [text] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/bar: [1] (QoS 1, retained)",
+		"new fake timer: 1, 1000",
+		"[info] throttled: 1",
+	)
+
+	// the changes are coalesced till the end of the period
+	s.publish("/devices/somedev/controls/bar", "2", "somedev/bar")
+	s.publish("/devices/somedev/controls/bar", "3", "somedev/bar")
+	s.Verify(
+		"tst -> /devices/somedev/controls/bar: [2] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/bar: [3] (QoS 1, retained)",
+	)
+
+	ts := s.AdvanceTime(1000 * time.Millisecond)
+	s.FireTimer(1, ts)
+	s.Verify(
+		"timer.fire(): 1",
+		"new fake timer: 2, 1000",
+		"[info] throttled: 3",
+	)
+
+	ts = s.AdvanceTime(2000 * time.Millisecond)
+	s.FireTimer(2, ts)
+	s.Verify("timer.fire(): 2")
+
+	s.publish("/devices/somedev/controls/bar", "4", "somedev/bar")
+	s.Verify(
+		"tst -> /devices/somedev/controls/bar: [4] (QoS 1, retained)",
+		"new fake timer: 3, 1000",
+		"[info] throttled: 4",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleDebounceSuite) TestDebounceWithThrottle() {
+	s.Error(s.engine.EvalScript(`
+	  defineRule("badRule", {
+	    whenChanged: "somedev/foo",
+	    debounceMs: 100,
+	    throttleMs: 100,
+	    then: function () {}
+	  });`))
+	s.Verify(
+		"[error] bad definition of rule 'badRule': "+
+			"invalid rule -- cannot combine 'debounceMs' with 'throttleMs'",
+		regexp.MustCompile(`^driver -> /wbrules/log/error: \[eval error: `),
+	)
+	s.EnsureGotErrors()
+}
+
+func TestRuleDebounceSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleDebounceSuite),
+	)
+}
@@ -0,0 +1,110 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+	"time"
+)
+
+type RuleDebugSessionSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleDebugSessionSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_debug.js")
+}
+
+func (s *RuleDebugSessionSuite) setTemp(value string) {
+	s.publish("/devices/somedev/controls/temp", value, "somedev/temp")
+}
+
+func (s *RuleDebugSessionSuite) TestRuleSession() {
+	info, err := s.engine.StartDebugSession(DebugSessionOptions{
+		Rules:    []string{"traced"},
+		Duration: 60,
+	})
+	s.Ck("StartDebugSession()", err)
+	s.Equal("1", info.ID)
+	s.Equal("/wbrules/debug/1", info.Topic)
+	s.Verify(
+		"new fake timer: 1, 60000",
+		"[info] debug session 1 started for 1m0s",
+	)
+	s.Equal([]DebugSessionInfo{info}, s.engine.DebugSessions())
+
+	s.setTemp("21")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [21] (QoS 1, retained)",
+		"driver -> /wbrules/debug/1: [[trace] rule traced fired by somedev/temp] (QoS 1)",
+		"driver -> /wbrules/debug/1: [[debug] traced: 21] (QoS 1)",
+		"driver -> /wbrules/debug/1: [[info] traced fired] (QoS 1)",
+		"[info] traced fired",
+	)
+
+	ts := s.AdvanceTime(60 * time.Second)
+	s.FireTimer(1, ts)
+	s.Verify(
+		"timer.fire(): 1",
+		"driver -> /wbrules/debug/1: [[end] debug session expired] (QoS 1)",
+		"[info] debug session 1 expired",
+	)
+	s.Empty(s.engine.DebugSessions())
+
+	s.setTemp("22")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [22] (QoS 1, retained)",
+		"[info] traced fired",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleDebugSessionSuite) TestScriptSession() {
+	info, err := s.engine.StartDebugSession(DebugSessionOptions{
+		Scripts: []string{"testrules_debug.js"},
+	})
+	s.Ck("StartDebugSession()", err)
+	s.Verify(
+		"new fake timer: 1, 600000",
+		"[info] debug session 1 started for 10m0s",
+	)
+
+	s.setTemp("21")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [21] (QoS 1, retained)",
+		"driver -> /wbrules/debug/1: [[trace] rule traced fired by somedev/temp] (QoS 1)",
+		"driver -> /wbrules/debug/1: [[debug] traced: 21] (QoS 1)",
+		"driver -> /wbrules/debug/1: [[info] traced fired] (QoS 1)",
+		"[info] traced fired",
+		"driver -> /wbrules/debug/1: [[trace] rule untraced fired by somedev/temp] (QoS 1)",
+		"driver -> /wbrules/debug/1: [[debug] untraced: 21] (QoS 1)",
+	)
+
+	s.Ck("StopDebugSession()", s.engine.StopDebugSession(info.ID))
+	s.Verify(
+		"driver -> /wbrules/debug/1: [[end] debug session stopped] (QoS 1)",
+		"timer.Stop(): 1",
+		"[info] debug session 1 stopped",
+	)
+	s.Error(s.engine.StopDebugSession(info.ID))
+	s.VerifyEmpty()
+}
+
+func (s *RuleDebugSessionSuite) TestInvalidSessions() {
+	for _, opts := range []DebugSessionOptions{
+		{},
+		{Rules: []string{"nosuchrule"}},
+		{Rules: []string{"traced"}, Duration: -1},
+		{Rules: []string{"traced"}, Duration: 7200},
+	} {
+		_, err := s.engine.StartDebugSession(opts)
+		s.Error(err)
+	}
+	s.Empty(s.engine.DebugSessions())
+	s.VerifyEmpty()
+}
+
+func TestRuleDebugSessionSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleDebugSessionSuite),
+	)
+}
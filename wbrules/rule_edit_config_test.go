@@ -0,0 +1,94 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"github.com/stretchr/objx"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type RuleEditConfigSuite struct {
+	RuleSuiteBase
+	cleanup func()
+}
+
+func (s *RuleEditConfigSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.configDir, s.cleanup = testutils.SetupTempDir(s.T())
+	s.SetupSkippingDefs("testrules_edit_config.js")
+}
+
+func (s *RuleEditConfigSuite) TearDownTest() {
+	s.RuleSuiteBase.TearDownTest()
+	if s.cleanup != nil {
+		s.cleanup()
+	}
+}
+
+func (s *RuleEditConfigSuite) schedulePath() string {
+	return filepath.Join(s.configDir, "schedule.json")
+}
+
+func (s *RuleEditConfigSuite) TestEditConfig() {
+	s.publish("/devices/somedev/controls/setpoint/meta/type", "temperature", "somedev/setpoint")
+	s.publish("/devices/somedev/controls/setpoint", "22", "somedev/setpoint")
+	s.Verify(
+		"tst -> /devices/somedev/controls/setpoint/meta/type: [temperature] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/setpoint: [22] (QoS 1, retained)",
+		`[info] schedule: {"setpoint":22}`,
+	)
+	conf, err := ReadConfigFile(s.schedulePath())
+	s.Ck("ReadConfigFile()", err)
+	s.Equal(objx.Map{"setpoint": float64(22)}, conf)
+
+	s.Ck("EvalScript", s.engine.EvalScript("replaceSchedule()"))
+	s.Verify(`[info] schedule: {"setpoint":18}`)
+}
+
+func (s *RuleEditConfigSuite) TestExternalChange() {
+	s.Ck("WriteFile()", ioutil.WriteFile(s.schedulePath(), []byte("{ // edited by hand\n\"setpoint\": 20 }"), 0644))
+	s.engine.ConfigChanged(s.schedulePath())
+	s.Verify(`[info] schedule: {"setpoint":20}`)
+
+	// unchanged files don't fire the rules
+	s.engine.ConfigChanged(s.schedulePath())
+	s.VerifyEmpty()
+}
+
+func (s *RuleEditConfigSuite) TestEditOutsideConfigDir() {
+	s.Ck("EvalScript", s.engine.EvalScript("editOutside()"))
+	s.Verify(
+		"[error] editConfig: config file outside config directory: ../outside.json",
+		"[info] outside edit denied",
+	)
+	s.EnsureGotErrors()
+	_, err := os.Stat(filepath.Join(filepath.Dir(s.configDir), "outside.json"))
+	s.True(os.IsNotExist(err))
+}
+
+func TestRuleEditConfigSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleEditConfigSuite),
+	)
+}
+
+func TestWriteConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wbrulestest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conf.json")
+	conf := objx.Map{"a": float64(1), "b": []interface{}{"x", "y"}}
+	assert.NoError(t, WriteConfigFile(path, conf))
+	assert.NoError(t, WriteConfigFile(path, conf.Set("a", float64(2))))
+	readConf, err := ReadConfigFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, objx.Map{"a": float64(2), "b": []interface{}{"x", "y"}}, readConf)
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,86 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"regexp"
+	"testing"
+)
+
+type RuleErrorsSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleErrorsSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_errors.js")
+}
+
+func (s *RuleErrorsSuite) failRule() {
+	s.publish("/devices/somedev/controls/temp/meta/type", "temperature", "somedev/temp")
+	s.publish("/devices/somedev/controls/temp", "42", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp/meta/type: [temperature] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/temp: [42] (QoS 1, retained)",
+		regexp.MustCompile(
+			`(?s:ECMAScript error:.*temperature too high: 42.*testrules_errors\.js:7.*)`),
+		regexp.MustCompile(
+			`^driver -> /wbrules/errors/failingRule: \[\{"rule":"failingRule",.*"count":1\}\] \(QoS 1, retained\)$`),
+		"driver -> /devices/wbrules/controls/Errors/meta/type: [text] (QoS 1, retained)",
+		"driver -> /devices/wbrules/controls/Errors/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/wbrules/controls/Errors/meta/order: [2] (QoS 1, retained)",
+		"driver -> /devices/wbrules/controls/Errors: [failingRule: Error: temperature too high: 42] (QoS 1, retained)",
+		"[info] healthyRule: 42",
+	)
+	s.EnsureGotErrors()
+}
+
+func (s *RuleErrorsSuite) TestRuleError() {
+	s.failRule()
+	ruleErrors := s.engine.GetRuleErrors()
+	s.Len(ruleErrors, 1)
+	s.Equal("failingRule", ruleErrors[0].Rule)
+	s.Equal(1, ruleErrors[0].Count)
+	s.Regexp(`(?s)temperature too high: 42.*testrules_errors\.js:7`, ruleErrors[0].Message)
+
+	s.publish("/devices/somedev/controls/temp", "43", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [43] (QoS 1, retained)",
+		regexp.MustCompile(`(?s:ECMAScript error:.*temperature too high: 43.*)`),
+		regexp.MustCompile(
+			`^driver -> /wbrules/errors/failingRule: \[\{"rule":"failingRule",.*"count":2\}\] \(QoS 1, retained\)$`),
+		"driver -> /devices/wbrules/controls/Errors: [failingRule: Error: temperature too high: 43] (QoS 1, retained)",
+		"[info] healthyRule: 43",
+	)
+	s.EnsureGotErrors()
+
+	s.publish("/devices/somedev/controls/temp", "20", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [20] (QoS 1, retained)",
+		"[info] failingRule: 20",
+		"[info] healthyRule: 20",
+	)
+	s.Equal(2, s.engine.GetRuleErrors()[0].Count)
+}
+
+func (s *RuleErrorsSuite) TestRedefinitionClearsError() {
+	s.failRule()
+	s.Ck("EvalScript", s.engine.EvalScript(
+		`defineRule("failingRule", { whenChanged: "somedev/temp", then: function () {} })`))
+	s.Verify("driver -> /wbrules/errors/failingRule: [] (QoS 1, retained)")
+	s.Empty(s.engine.GetRuleErrors())
+}
+
+func (s *RuleErrorsSuite) TestScriptRemovalClearsError() {
+	s.failRule()
+	s.RemoveScript("testrules_errors.js")
+	s.Verify(
+		"driver -> /wbrules/errors/failingRule: [] (QoS 1, retained)",
+		"driver -> /wbrules/updates/removed: [testrules_errors.js] (QoS 1)",
+	)
+	s.Empty(s.engine.GetRuleErrors())
+}
+
+func TestRuleErrorsSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleErrorsSuite),
+	)
+}
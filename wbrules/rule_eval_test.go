@@ -0,0 +1,81 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type RuleEvalSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleEvalSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_eval.js")
+}
+
+func (s *RuleEvalSuite) TestResults() {
+	for _, tt := range []struct {
+		code     string
+		expected interface{}
+	}{
+		{"1 + 2", float64(3)},
+		{`dev["evaldev/temp"]`, float64(21)},
+		{`"abc".toUpperCase()`, "ABC"},
+		{"({ a: [1, 'x'], b: true })", map[string]interface{}{
+			"a": []interface{}{float64(1), "x"},
+			"b": true,
+		}},
+		{"var evalX = 5", nil},
+		{"evalX * 2", float64(10)},
+	} {
+		value, err := s.engine.EvalScriptWithResult(tt.code)
+		s.Nil(err, "code: %s", tt.code)
+		s.Equal(tt.expected, value, "code: %s", tt.code)
+	}
+}
+
+func (s *RuleEvalSuite) TestErrors() {
+	for _, tt := range []struct {
+		code, message string
+		line          int
+	}{
+		{"1 +", "SyntaxError", 1},
+		{"var a = 1;\n\nnoSuchFunction();", "ReferenceError", 3},
+		{"\nfailDeep()", "Error: deep failure", 2},
+		{"throw 'oops'", "oops", 0},
+	} {
+		value, err := s.engine.EvalScriptWithResult(tt.code)
+		s.Nil(value, "code: %s", tt.code)
+		if !s.NotNil(err, "code: %s", tt.code) {
+			continue
+		}
+		s.True(strings.HasPrefix(err.Message, tt.message), "message: %s", err.Message)
+		s.NotContains(err.Message, "\n")
+		s.Equal(tt.line, err.Line, "code: %s", tt.code)
+		s.Verify(regexp.MustCompile(`^driver -> /wbrules/log/error: \[eval error: `))
+	}
+
+	_, err := s.engine.EvalScriptWithResult("failDeep()")
+	s.Contains(err.Stack, "deep failure")
+	found := false
+	for _, loc := range err.Traceback {
+		if strings.HasSuffix(loc.Name, "testrules_eval.js") && loc.Line == 13 {
+			found = true
+		}
+	}
+	s.True(found, "no script location in the traceback: %v", err.Traceback)
+	s.Verify(regexp.MustCompile(`^driver -> /wbrules/log/error: \[eval error: `))
+
+	s.Error(s.engine.EvalScript("failDeep()"))
+	s.Verify(regexp.MustCompile(`^driver -> /wbrules/log/error: \[eval error: `))
+	s.EnsureGotErrors()
+}
+
+func TestRuleEvalSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleEvalSuite),
+	)
+}
@@ -0,0 +1,38 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleFeaturesSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleFeaturesSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_features.js")
+}
+
+func (s *RuleFeaturesSuite) TestDefaults() {
+	s.engine.EvalScript("checkFeatures()")
+	s.Verify("[info] enabledByDefault: true, undefinedFeature: false")
+}
+
+func (s *RuleFeaturesSuite) TestToggleFeature() {
+	s.publish("/devices/features/controls/newLogic/on", "1", "features/newLogic")
+	s.Verify(
+		"tst -> /devices/features/controls/newLogic/on: [1] (QoS 1)",
+		"driver -> /devices/features/controls/newLogic: [1] (QoS 1, retained)",
+		"[info] new logic enabled",
+	)
+	value, found := s.engine.PersistentStorage().Get("features", "newLogic")
+	s.True(found)
+	s.Equal(true, value)
+}
+
+func TestRuleFeaturesSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleFeaturesSuite),
+	)
+}
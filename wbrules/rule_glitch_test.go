@@ -0,0 +1,79 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+	"time"
+)
+
+type RuleGlitchFilterSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleGlitchFilterSuite) SetupTest() {
+	s.RuleSuiteBase.SetupTest(false, "testrules_glitch.js")
+	s.SkipTill("tst -> /devices/somedev/controls/temp: [19] (QoS 1, retained)")
+	s.publish("/devices/gpio/controls/in1/meta/type", "switch", "gpio/in1")
+	// the initial value isn't filtered
+	s.publish("/devices/gpio/controls/in1", "0", "gpio/in1")
+	s.engine.Start()
+	<-s.engine.ReadyCh()
+	s.Verify(
+		"tst -> /devices/gpio/controls/in1/meta/type: [switch] (QoS 1, retained)",
+		"tst -> /devices/gpio/controls/in1: [0] (QoS 1, retained)",
+	)
+}
+
+func (s *RuleGlitchFilterSuite) TestShortPulse() {
+	s.publish("/devices/gpio/controls/in1", "1")
+	s.Verify(
+		"tst -> /devices/gpio/controls/in1: [1] (QoS 1, retained)",
+		"new fake timer: 1, 50",
+	)
+	s.publish("/devices/gpio/controls/in1", "0")
+	s.Verify(
+		"tst -> /devices/gpio/controls/in1: [0] (QoS 1, retained)",
+		"timer.Stop(): 1",
+	)
+	s.VerifyEmpty()
+	s.engine.EvalScript("log('in1 = {}', dev['gpio/in1'])")
+	s.Verify("[info] in1 = false")
+}
+
+func (s *RuleGlitchFilterSuite) TestStableChange() {
+	s.publish("/devices/gpio/controls/in1", "1")
+	s.Verify(
+		"tst -> /devices/gpio/controls/in1: [1] (QoS 1, retained)",
+		"new fake timer: 1, 50",
+	)
+	// repeated value doesn't restart the filter
+	s.publish("/devices/gpio/controls/in1", "1")
+	s.Verify("tst -> /devices/gpio/controls/in1: [1] (QoS 1, retained)")
+	s.FireTimer(1, s.AdvanceTime(50*time.Millisecond))
+	s.expectCellChange("gpio/in1")
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] in1: true",
+	)
+}
+
+func (s *RuleGlitchFilterSuite) TestFilterRemoval() {
+	s.publish("/devices/gpio/controls/in1", "1")
+	s.Verify(
+		"tst -> /devices/gpio/controls/in1: [1] (QoS 1, retained)",
+		"new fake timer: 1, 50",
+	)
+	// the pending value is accepted when the filter is removed
+	s.engine.EvalScript("glitchFilter('gpio/in1', 0)")
+	s.expectCellChange("gpio/in1")
+	s.Verify(
+		"timer.Stop(): 1",
+		"[info] in1: true",
+	)
+}
+
+func TestRuleGlitchFilterSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleGlitchFilterSuite),
+	)
+}
@@ -0,0 +1,55 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleGlobalsSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleGlobalsSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_globals_1.js", "testrules_globals_2.js")
+}
+
+func (s *RuleGlobalsSuite) TestIsolatedGlobals() {
+	s.publish("/devices/somedev/controls/temp", "42", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [42] (QoS 1, retained)",
+		"[info] globals_1: 1",
+		"[info] globals_2: 2, set by globals_1",
+	)
+	s.Ck("EvalScript()", s.engine.EvalScript(`log("{} {}", typeof counter, typeof describe)`))
+	s.Verify("[info] undefined undefined")
+	s.VerifyEmpty()
+}
+
+type RuleSharedGlobalsSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleSharedGlobalsSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_globals_1.js", "testrules_globals_2.js")
+}
+
+func (s *RuleSharedGlobalsSuite) TestSharedGlobals() {
+	// the second script clobbers the variables of the first one
+	s.publish("/devices/somedev/controls/temp", "42", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [42] (QoS 1, retained)",
+		"[info] globals_2: 2",
+		"[info] globals_2: 2, set by globals_1",
+	)
+	s.Ck("EvalScript()", s.engine.EvalScript(`log("{} {}", typeof counter, typeof describe)`))
+	s.Verify("[info] number function")
+	s.VerifyEmpty()
+}
+
+func TestRuleGlobalsSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleGlobalsSuite),
+		new(RuleSharedGlobalsSuite),
+	)
+}
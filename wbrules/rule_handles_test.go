@@ -0,0 +1,216 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"github.com/stretchr/objx"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+var anonymousRuleRx = regexp.MustCompile(`^testrules_handles\.js/anonymous:\d+$`)
+
+type RuleHandleSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleHandleSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_handles.js")
+}
+
+func (s *RuleHandleSuite) anonymousRules() (names []string) {
+	for _, status := range s.engine.RuleStatuses() {
+		if anonymousRuleRx.MatchString(status.Name) {
+			names = append(names, status.Name)
+		}
+	}
+	return
+}
+
+func (s *RuleHandleSuite) trigger(value string) {
+	s.publish("/devices/handles/controls/trigger/on", value, "handles/trigger")
+}
+
+func (s *RuleHandleSuite) command(cmd string) {
+	s.publish("/devices/handles/controls/cmd/on", cmd, "handles/cmd")
+	s.Verify(
+		"tst -> /devices/handles/controls/cmd/on: ["+cmd+"] (QoS 1)",
+		"driver -> /devices/handles/controls/cmd: ["+cmd+"] (QoS 1, retained)",
+	)
+}
+
+func (s *RuleHandleSuite) TestAnonymousRules() {
+	s.Len(s.anonymousRules(), 2)
+	s.trigger("1")
+	s.Verify(
+		"tst -> /devices/handles/controls/trigger/on: [1] (QoS 1)",
+		"driver -> /devices/handles/controls/trigger: [1] (QoS 1, retained)",
+		"[info] trigger: true",
+		"[info] one shot",
+		regexp.MustCompile(`^driver -> /wbrules/log/info: \[rule testrules_handles\.js/anonymous:\d+ destroyed\]`),
+	)
+	s.Len(s.anonymousRules(), 1)
+	s.trigger("0")
+	s.Verify(
+		"tst -> /devices/handles/controls/trigger/on: [0] (QoS 1)",
+		"driver -> /devices/handles/controls/trigger: [0] (QoS 1, retained)",
+		"[info] trigger: false",
+	)
+	s.command("destroy")
+	s.Verify("[info] destroy failed")
+	s.VerifyEmpty()
+}
+
+func (s *RuleHandleSuite) TestRuleHandles() {
+	s.command("destroy")
+	s.Verify(regexp.MustCompile(`^driver -> /wbrules/log/info: \[rule testrules_handles\.js/anonymous:\d+ destroyed\]`))
+	s.command("disable")
+	s.Verify(regexp.MustCompile(`^driver -> /wbrules/log/info: \[rule testrules_handles\.js/anonymous:\d+ disabled\]`))
+	s.trigger("1")
+	s.Verify(
+		"tst -> /devices/handles/controls/trigger/on: [1] (QoS 1)",
+		"driver -> /devices/handles/controls/trigger: [1] (QoS 1, retained)",
+	)
+	// disabled rules can still be run explicitly,
+	// the cell value is passed to the then callback
+	s.command("run")
+	s.Verify("[info] trigger: true")
+	s.command("check")
+	s.Verify("[info] fired: false")
+	s.command("enable")
+	s.Verify(regexp.MustCompile(`^driver -> /wbrules/log/info: \[rule testrules_handles\.js/anonymous:\d+ enabled\]`))
+	s.trigger("0")
+	s.Verify(
+		"tst -> /devices/handles/controls/trigger/on: [0] (QoS 1)",
+		"driver -> /devices/handles/controls/trigger: [0] (QoS 1, retained)",
+		"[info] trigger: false",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleHandleSuite) TestRunRule() {
+	s.command("runRule")
+	s.Verify("[info] never: undefined")
+	s.Ck("RunRule()", s.engine.CallErr(func() error {
+		return s.engine.RunRule("never")
+	}))
+	s.Verify("[info] never: undefined")
+	s.VerifyEmpty()
+}
+
+func TestRuleHandleSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleHandleSuite),
+	)
+}
+
+func TestDestroyRule(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	err := engine.DefineVirtualDevice("somedev", objx.Map{
+		"cells": objx.Map{"sw": objx.Map{"type": "switch", "value": false}},
+	})
+	if err != nil {
+		t.Fatalf("DefineVirtualDevice(): %s", err)
+	}
+	cond, err := NewCellChangedRuleCondition(CellSpec{"somedev", "sw"})
+	if err != nil {
+		t.Fatalf("NewCellChangedRuleCondition(): %s", err)
+	}
+	var fired []string
+	engine.DefineRule(NewRule(engine, "first", cond, func(objx.Map) interface{} {
+		fired = append(fired, "first")
+		// the rule that is destroyed by another
+		// rule doesn't fire in the same pass
+		if err := engine.DestroyRule("second"); err != nil {
+			t.Errorf("DestroyRule(): %s", err)
+		}
+		return nil
+	}))
+	cond, err = NewCellChangedRuleCondition(CellSpec{"somedev", "sw"})
+	if err != nil {
+		t.Fatalf("NewCellChangedRuleCondition(): %s", err)
+	}
+	engine.DefineRule(NewRule(engine, "second", cond, func(objx.Map) interface{} {
+		fired = append(fired, "second")
+		return nil
+	}))
+	if err := engine.RunRule("second"); err != nil {
+		t.Errorf("RunRule(): %s", err)
+	}
+
+	cell := model.EnsureCell(&CellSpec{"somedev", "sw"})
+	cell.SetValue(true)
+	engine.RunRules(&CellSpec{"somedev", "sw"}, NO_TIMER_NAME)
+	if !reflect.DeepEqual(fired, []string{"second", "first"}) {
+		t.Errorf("bad firings: %v", fired)
+	}
+	if order := engine.ruleList; !reflect.DeepEqual(order, []string{"first"}) {
+		t.Errorf("the destroyed rule isn't removed: %v", order)
+	}
+	for _, err := range []error{
+		engine.RunRule("second"),
+		engine.DestroyRule("second"),
+		engine.setRuleEnabled("second", false),
+	} {
+		if err != unknownRuleError {
+			t.Errorf("bad error for the destroyed rule: %v", err)
+		}
+	}
+}
+
+func TestRunAndCheckRule(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	err := engine.DefineVirtualDevice("somedev", objx.Map{
+		"cells": objx.Map{"sw": objx.Map{"type": "switch", "value": false}},
+	})
+	if err != nil {
+		t.Fatalf("DefineVirtualDevice(): %s", err)
+	}
+	cond, err := NewCellChangedRuleCondition(CellSpec{"somedev", "sw"})
+	if err != nil {
+		t.Fatalf("NewCellChangedRuleCondition(): %s", err)
+	}
+	var fired []objx.Map
+	engine.DefineRule(NewRule(engine, "sw", cond, func(args objx.Map) interface{} {
+		fired = append(fired, copyRuleArgs(args))
+		return nil
+	}))
+	level := false
+	engine.DefineRule(NewRule(engine, "level", NewLevelTriggeredRuleCondition(func() bool {
+		return level
+	}), func(args objx.Map) interface{} {
+		fired = append(fired, args)
+		return nil
+	}))
+	engine.RunRules(nil, NO_TIMER_NAME)
+
+	if err := engine.RunRule("sw"); err != nil {
+		t.Errorf("RunRule(): %s", err)
+	}
+	expected := []objx.Map{{"device": "somedev", "cell": "sw", "newValue": false}}
+	if !reflect.DeepEqual(fired, expected) {
+		t.Errorf("bad firings after RunRule(): %v", fired)
+	}
+
+	fired = nil
+	cell := model.EnsureCell(&CellSpec{"somedev", "sw"})
+	cell.SetValue(true)
+	for i, expectedFired := range []bool{true, false} {
+		if r, err := engine.CheckRule("sw"); err != nil || r != expectedFired {
+			t.Errorf("CheckRule() #%d: %v, %v", i+1, r, err)
+		}
+	}
+	if r, err := engine.CheckRule("level"); err != nil || r {
+		t.Errorf("CheckRule() for the level-triggered rule: %v, %v", r, err)
+	}
+	level = true
+	if r, err := engine.CheckRule("level"); err != nil || !r {
+		t.Errorf("CheckRule() for the level-triggered rule: %v, %v", r, err)
+	}
+	if len(fired) != 2 || fired[1] != nil {
+		t.Errorf("bad firings after CheckRule(): %v", fired)
+	}
+	if _, err := engine.CheckRule("nosuchrule"); err != unknownRuleError {
+		t.Errorf("bad error for an unknown rule: %v", err)
+	}
+}
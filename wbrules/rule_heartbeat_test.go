@@ -0,0 +1,93 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"regexp"
+	"testing"
+	"time"
+)
+
+type RuleHeartbeatSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleHeartbeatSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_heartbeat.js")
+	s.publish("/devices/somedev/controls/pump/meta/type", "switch", "somedev/pump")
+	s.publish("/devices/somedev/controls/pump", "0", "somedev/pump")
+	s.Verify(
+		"tst -> /devices/somedev/controls/pump/meta/type: [switch] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/pump: [0] (QoS 1, retained)",
+		"[info] pump: false",
+	)
+	s.Ck("guardPump()", s.engine.EvalScript("guardPump()"))
+	s.Verify(
+		"new fake ticker: 1, 10000",
+		"new fake ticker: 2, 5000",
+	)
+}
+
+func (s *RuleHeartbeatSuite) TestHeartbeat() {
+	s.publish("/devices/somedev/controls/temp", "20", "somedev/temp")
+	s.Verify("tst -> /devices/somedev/controls/temp: [20] (QoS 1, retained)")
+	ts := s.AdvanceTime(5 * time.Second)
+	s.FireTimer(2, ts)
+	s.Verify("timer.fire(): 2")
+
+	s.publish("/devices/somedev/controls/pump", "1", "somedev/pump")
+	s.Verify(
+		"tst -> /devices/somedev/controls/pump: [1] (QoS 1, retained)",
+		"[info] pump: true",
+	)
+	ts = s.AdvanceTime(10 * time.Second)
+	s.FireTimer(1, ts)
+	s.Verify("timer.fire(): 1")
+
+	// the temperature didn't change during the last period
+	s.FireTimer(2, ts)
+	s.Verify(
+		"timer.fire(): 2",
+		"[warning] heartbeat missed: somedev/temp changed within 5s",
+		"[info] failsafe: somedev/temp changed within 5s",
+	)
+
+	// the miss is reported only once
+	ts = s.AdvanceTime(15 * time.Second)
+	s.FireTimer(2, ts)
+	s.Verify("timer.fire(): 2")
+
+	s.publish("/devices/somedev/controls/temp", "21", "somedev/temp")
+	s.Verify("tst -> /devices/somedev/controls/temp: [21] (QoS 1, retained)")
+	ts = s.AdvanceTime(20 * time.Second)
+	s.FireTimer(1, ts)
+	s.FireTimer(2, ts)
+	s.Verify(
+		"timer.fire(): 1",
+		"[warning] heartbeat missed: pump controller fired within 10s",
+		"[info] failsafe: pump controller fired within 10s",
+		"timer.fire(): 2",
+		"[info] heartbeat restored: somedev/temp changed within 5s",
+		"[info] back to normal: somedev/temp changed within 5s",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleHeartbeatSuite) TestInvalidExpectations() {
+	for _, script := range []string{
+		`defineHeartbeatGuard({ expect: "pump controller fired", onMiss: function () {} })`,
+		`defineHeartbeatGuard({ expect: "noSuchAlias changed within 1m", onMiss: function () {} })`,
+		`defineHeartbeatGuard({ expect: "pump controller fired within 10m" })`,
+		`defineHeartbeatGuard({ expect: [], onMiss: function () {} })`,
+	} {
+		s.Error(s.engine.EvalScript(script), script)
+		s.Verify(regexp.MustCompile(`^driver -> /wbrules/log/error: \[eval error: .*defineHeartbeatGuard: `))
+	}
+	s.EnsureGotErrors()
+}
+
+func TestRuleHeartbeatSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleHeartbeatSuite),
+	)
+}
@@ -0,0 +1,83 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"testing"
+	"time"
+)
+
+func TestRuleHistory(t *testing.T) {
+	model := newTestModel(t)
+	changes := make(chan *CellSpec, 100)
+	model.cellChangeChannels = append(model.cellChangeChannels, changes)
+	engine := NewRuleEngine(model, nullMQTTClient{})
+	engine.SetRuleHistorySize(3)
+	dev := model.EnsureLocalDevice("hist", "hist")
+	sw := dev.SetCell("sw", "switch", false, false)
+	cond, err := NewCellChangedRuleCondition(CellSpec{"hist", "sw"})
+	if err != nil {
+		t.Fatalf("NewCellChangedRuleCondition(): %s", err)
+	}
+	engine.DefineRule(NewRule(engine, "histRule", cond, func(args objx.Map) interface{} {
+		time.Sleep(5 * time.Millisecond)
+		if args["newValue"] == false {
+			engine.recordRuleError("Error: switched off\nstack trace")
+		}
+		return nil
+	}))
+
+	engine.RunRules(nil, NO_TIMER_NAME)
+	start := time.Now()
+	for _, v := range []bool{true, false, true, false} {
+		sw.SetValue(v)
+		engine.RunRules(<-changes, NO_TIMER_NAME)
+	}
+
+	firings := engine.GetRuleHistory(RuleHistoryFilter{})
+	if len(firings) != 3 {
+		t.Fatalf("%d firings instead of 3", len(firings))
+	}
+	for i, firing := range firings {
+		if firing.Rule != "histRule" || firing.Device != "hist" || firing.Cell != "sw" {
+			t.Errorf("bad firing #%d: %#v", i, firing)
+		}
+		if firing.DurationMs < 5 {
+			t.Errorf("bad duration of firing #%d: %v", i, firing.DurationMs)
+		}
+		expectedError := ""
+		if i%2 == 0 {
+			expectedError = "Error: switched off"
+		}
+		if firing.Error != expectedError {
+			t.Errorf("bad error of firing #%d: %q", i, firing.Error)
+		}
+		if firing.Time.Before(start) || (i > 0 && firing.Time.Before(firings[i-1].Time)) {
+			t.Errorf("bad time of firing #%d: %s", i, firing.Time)
+		}
+	}
+
+	history := NewRuleHistory(engine)
+	var reply RuleHistoryGetResponse
+	if err := history.Get(&RuleHistoryGetArgs{Rule: "histRule", Limit: 1}, &reply); err != nil {
+		t.Fatalf("Get(): %s", err)
+	}
+	if len(reply.Firings) != 1 || reply.Firings[0] != firings[2] {
+		t.Errorf("bad firings for limit 1: %#v", reply.Firings)
+	}
+	for _, args := range []RuleHistoryGetArgs{
+		{Rule: "nosuchrule"},
+		{Cell: "nosuchcell"},
+		{Since: time.Now().Add(time.Hour).Format(time.RFC3339)},
+	} {
+		if err := history.Get(&args, &reply); err != nil {
+			t.Fatalf("Get(): %s", err)
+		}
+		if len(reply.Firings) != 0 {
+			t.Errorf("unexpected firings for %#v: %#v", args, reply.Firings)
+		}
+	}
+	err = history.Get(&RuleHistoryGetArgs{Since: "yesterday"}, &reply)
+	if rpcErr, ok := err.(*RuleHistoryError); !ok || rpcErr.ErrorCode() != RULE_HISTORY_ERROR_INVALID_ARGS {
+		t.Errorf("bad error for invalid since time: %v", err)
+	}
+}
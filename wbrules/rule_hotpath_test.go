@@ -0,0 +1,62 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"testing"
+)
+
+func setupHotPathEngine(nRules int) (*RuleEngine, *CellSpec, *int) {
+	model := NewCellModel()
+	engine := NewRuleEngine(model, nil)
+	dev := model.EnsureLocalDevice("hotpath", "hotpath")
+	dev.SetCell("sw", "switch", false, false)
+	dev.SetCell("other", "switch", false, false)
+	cellSpec := &CellSpec{"hotpath", "sw"}
+	count := 0
+	for i := 0; i < nRules; i++ {
+		spec := *cellSpec
+		if i%2 != 0 {
+			spec.CellName = "other"
+		}
+		cond, _ := NewCellChangedRuleCondition(spec)
+		engine.DefineRule(NewRule(engine, "rule"+string(rune('a'+i)), cond,
+			func(args objx.Map) interface{} {
+				count++
+				return nil
+			}))
+	}
+	return engine, cellSpec, &count
+}
+
+func toggleHotPathCell(engine *RuleEngine, cellSpec *CellSpec, n int) {
+	cell := engine.model.EnsureCell(cellSpec)
+	cell.maybeSetValueQuiet(n%2 == 0, true)
+	cell.gotValue = true
+	// the rule pass itself, as it's run on the event loop
+	engine.runRules(cellSpec, NO_TIMER_NAME)
+}
+
+func TestRunRulesHotPathAllocs(t *testing.T) {
+	engine, cellSpec, count := setupHotPathEngine(10)
+	n := 0
+	toggleHotPathCell(engine, cellSpec, n) // warm up
+	allocs := testing.AllocsPerRun(100, func() {
+		n++
+		toggleHotPathCell(engine, cellSpec, n)
+	})
+	if *count == 0 {
+		t.Fatalf("rules didn't fire")
+	}
+	if allocs > 0 {
+		t.Errorf("runRules() allocates %v times per cell change", allocs)
+	}
+}
+
+func BenchmarkRunRules(b *testing.B) {
+	engine, cellSpec, _ := setupHotPathEngine(20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		toggleHotPathCell(engine, cellSpec, n)
+	}
+}
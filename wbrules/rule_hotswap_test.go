@@ -0,0 +1,76 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleHotSwapSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleHotSwapSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_hotswap.js")
+}
+
+// ruleCount returns the number of rules associated
+// with the cell and checks that no destroyed rules
+// are associated with any cells
+func (s *RuleHotSwapSuite) ruleCount(cellName string) (n int) {
+	s.model.CallSync(func() {
+		for _, list := range s.engine.cellToRuleMap {
+			for _, rule := range list {
+				s.NotNil(rule.then, "destroyed rule %s is still associated with a cell", rule.name)
+			}
+		}
+		cell := s.model.LookupCell(&CellSpec{"somedev", cellName})
+		n = len(s.engine.cellToRuleMap[cell])
+	})
+	return
+}
+
+func (s *RuleHotSwapSuite) TestRedefineAtRuntime() {
+	s.Equal(1, s.ruleCount("temp"))
+	for i := 0; i < 3; i++ {
+		// rules redefined outside of script loading
+		// don't cause the engine refresh
+		s.engine.EvalScript(`defineWatcher("sw"); runRules()`)
+		s.Equal(0, s.ruleCount("temp"))
+		s.Equal(1, s.ruleCount("sw"))
+		s.engine.EvalScript(`defineWatcher("temp"); runRules()`)
+		s.Equal(1, s.ruleCount("temp"))
+		s.Equal(0, s.ruleCount("sw"))
+	}
+
+	s.publish("/devices/somedev/controls/temp", "101", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [101] (QoS 1, retained)",
+		"[info] watcher fired: temp",
+	)
+	s.publish("/devices/somedev/controls/sw", "1", "somedev/sw")
+	s.Verify("tst -> /devices/somedev/controls/sw: [1] (QoS 1, retained)")
+	s.VerifyEmpty()
+}
+
+func (s *RuleHotSwapSuite) TestScriptEditCycles() {
+	for i := 0; i < 3; i++ {
+		s.ReplaceScript("testrules_hotswap.js", "testrules_hotswap_changed.js")
+		s.Equal(0, s.ruleCount("temp"))
+		s.Equal(1, s.ruleCount("sw"))
+		s.ReplaceScript("testrules_hotswap.js", "testrules_hotswap.js")
+		s.Equal(1, s.ruleCount("temp"))
+		s.Equal(0, s.ruleCount("sw"))
+	}
+	s.VerifyEmpty()
+
+	s.RemoveScript("testrules_hotswap.js")
+	s.Equal(0, s.ruleCount("temp"))
+	s.Equal(0, s.ruleCount("sw"))
+}
+
+func TestRuleHotSwapSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleHotSwapSuite),
+	)
+}
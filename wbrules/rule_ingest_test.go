@@ -0,0 +1,62 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+	"time"
+)
+
+type RuleIngestSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleIngestSuite) SetupTest() {
+	s.RuleSuiteBase.SetupTest(false, "testrules_ingest.js")
+	s.engine.SetStartupIngestion(200*time.Millisecond, 5*time.Second)
+	s.SkipTill("tst -> /devices/somedev/controls/temp: [19] (QoS 1, retained)")
+}
+
+func (s *RuleIngestSuite) TestIngestion() {
+	s.engine.Start()
+	for _, v := range []string{"21", "22", "23"} {
+		s.publish("/devices/somedev/controls/temp", v, "somedev/temp")
+	}
+	<-s.engine.ReadyCh()
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [21] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/temp: [22] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/temp: [23] (QoS 1, retained)",
+		// single rule run after ingestion
+		"[info] warm: 23",
+	)
+	s.VerifyEmpty()
+
+	s.publish("/devices/somedev/controls/temp", "24", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [24] (QoS 1, retained)",
+		"[info] warm: 24",
+		"[info] temp changed: 24",
+	)
+}
+
+func (s *RuleIngestSuite) TestGracePeriod() {
+	s.engine.SetStartupGrace(500 * time.Millisecond)
+	s.engine.Start()
+	s.publish("/devices/somedev/controls/temp", "21", "somedev/temp")
+	// the quiet period is over, but the grace period isn't
+	time.Sleep(300 * time.Millisecond)
+	s.publish("/devices/somedev/controls/temp", "22", "somedev/temp")
+	<-s.engine.ReadyCh()
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [21] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/temp: [22] (QoS 1, retained)",
+		"[info] warm: 22",
+	)
+	s.VerifyEmpty()
+}
+
+func TestRuleIngestSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleIngestSuite),
+	)
+}
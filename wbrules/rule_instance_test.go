@@ -0,0 +1,46 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type RuleInstanceSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleInstanceSuite) SetupTest() {
+	s.instanceID = "hvac"
+	s.SetupSkippingDefs("testrules_instance.js")
+}
+
+func (s *RuleInstanceSuite) TestPrefixedDevices() {
+	s.publish("/devices/hvac-features/controls/eco/on", "1", "hvac-features/eco")
+	s.Verify(
+		"tst -> /devices/hvac-features/controls/eco/on: [1] (QoS 1)",
+		"driver -> /devices/hvac-features/controls/eco: [1] (QoS 1, retained)",
+		"driver -> /hvac-wbrules/log/info: [eco: true] (QoS 1)",
+	)
+}
+
+func (s *RuleInstanceSuite) TestPrefixedSettingsDevice() {
+	s.publish("/devices/hvac-wbrules/controls/Rule debugging/on", "1", "hvac-wbrules/Rule debugging")
+	s.Verify(
+		"tst -> /devices/hvac-wbrules/controls/Rule debugging/on: [1] (QoS 1)",
+		"driver -> /devices/hvac-wbrules/controls/Rule debugging: [1] (QoS 1, retained)",
+	)
+	s.engine.EvalScript("debug('debug message')")
+	s.Verify("driver -> /hvac-wbrules/log/debug: [debug message] (QoS 1)")
+}
+
+func TestInstanceName(t *testing.T) {
+	assert.Equal(t, "wbrules", InstanceName("wbrules", ""))
+	assert.Equal(t, "hvac-wbrules", InstanceName("wbrules", "hvac"))
+}
+
+func TestRuleInstanceSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleInstanceSuite),
+	)
+}
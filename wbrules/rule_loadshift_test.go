@@ -0,0 +1,58 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"regexp"
+	"testing"
+)
+
+type RuleLoadShiftingSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleLoadShiftingSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_loadshift.js")
+}
+
+func (s *RuleLoadShiftingSuite) verifyInitialPlan() {
+	// the pump runs all day long, so the
+	// plan doesn't depend on the current time
+	s.Verify(
+		"driver -> /devices/energy/controls/cost: [112] (QoS 1, retained)",
+		"driver -> /devices/energy/controls/pumpPlan: [00:00-24:00] (QoS 1, retained)",
+		"driver -> /devices/energy/controls/pump: [1] (QoS 1, retained)",
+		"driver -> /devices/somedev/controls/pump/on: [1] (QoS 1)",
+	)
+}
+
+func (s *RuleLoadShiftingSuite) TestPlan() {
+	s.verifyInitialPlan()
+	s.VerifyEmpty()
+}
+
+func (s *RuleLoadShiftingSuite) TestInvalidDefinitions() {
+	s.verifyInitialPlan()
+	for _, script := range []string{
+		`defineLoadShifting("bad", { appliances: { pump: { power: 1, hours: 1 } } })`,
+		`defineLoadShifting("bad", { tariffs: [{ from: 0, to: 0, price: 1 }] })`,
+		`defineLoadShifting("bad", {
+		   tariffs: [{ from: "7:30", to: 0, price: 1 }],
+		   appliances: { pump: { power: 1, hours: 1 } }
+		 })`,
+		`defineLoadShifting("bad", {
+		   tariffs: [{ from: 0, to: 0, price: 1 }],
+		   appliances: { pump: { power: 1 } }
+		 })`,
+	} {
+		s.Error(s.engine.EvalScript(script), script)
+		s.Verify(regexp.MustCompile(`^driver -> /wbrules/log/error: \[eval error: .*defineLoadShifting: `))
+	}
+	s.EnsureGotErrors()
+	s.VerifyEmpty()
+}
+
+func TestRuleLoadShiftingSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleLoadShiftingSuite),
+	)
+}
@@ -11,6 +11,7 @@ type RuleLocationSuite struct {
 }
 
 func (s *RuleLocationSuite) SetupTest() {
+	s.sharedGlobals = true
 	s.SetupSkippingDefs(
 		"testrules_defhelper.js",
 		"testrules_locations.js",
@@ -206,6 +207,29 @@ func (s *RuleLocationSuite) TestSyntaxError() {
 	}, scriptErr.Traceback)
 }
 
+func (s *RuleLocationSuite) TestValidateScript() {
+	path := s.CopyDataFileToTempDir("testrules_locations_syntax_error.js", "candidate.js")
+	scriptErrs, err := s.engine.ValidateScript(path)
+	s.Ck("ValidateScript()", err)
+	s.Require().Len(scriptErrs, 1)
+	s.Contains(scriptErrs[0].Message, "SyntaxError")
+	s.Equal([]LocItem{{4, "candidate.js"}}, scriptErrs[0].Traceback)
+
+	// the script is compiled but not run, so runtime
+	// errors aren't detected
+	path = s.CopyDataFileToTempDir("testrules_locations_faulty.js", "candidate.js")
+	scriptErrs, err = s.engine.ValidateScript(path)
+	s.Ck("ValidateScript()", err)
+	s.Empty(scriptErrs)
+
+	for _, entry := range s.listSourceFiles() {
+		s.NotEqual("candidate.js", entry.VirtualPath, "the validated script was loaded")
+	}
+
+	_, err = s.engine.ValidateScript(s.DataFilePath("nosuchscript.js"))
+	s.NotNil(err, "error expected for a nonexistent script")
+}
+
 func TestRuleLocationSuite(t *testing.T) {
 	testutils.RunSuites(t,
 		new(RuleLocationSuite),
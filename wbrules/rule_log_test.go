@@ -10,6 +10,7 @@ type LogSuite struct {
 }
 
 func (s *LogSuite) SetupTest() {
+	s.sharedGlobals = true
 	s.SetupSkippingDefs("testrules_log.js")
 }
 
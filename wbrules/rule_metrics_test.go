@@ -0,0 +1,69 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo"
+	"github.com/stretchr/objx"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingMQTTClient struct {
+	nullMQTTClient
+	messages []wbgo.MQTTMessage
+}
+
+func (client *recordingMQTTClient) Publish(message wbgo.MQTTMessage) {
+	client.messages = append(client.messages, message)
+}
+
+func TestRuleMetrics(t *testing.T) {
+	client := &recordingMQTTClient{}
+	_, engine := newTestEngine(t, client)
+	engine.SetSlowRuleThreshold(20 * time.Millisecond)
+	fire := false
+	defineRule := func(thenTime time.Duration) {
+		engine.DefineRule(NewRule(engine, "timedRule", NewLevelTriggeredRuleCondition(func() bool {
+			return fire
+		}), func(args objx.Map) interface{} {
+			time.Sleep(thenTime)
+			return nil
+		}))
+	}
+	defineRule(time.Millisecond)
+	fire = true
+	for i := 0; i < 3; i++ {
+		engine.RunRules(nil, NO_TIMER_NAME)
+	}
+	// the metrics are kept when the rule is redefined
+	defineRule(30 * time.Millisecond)
+	engine.RunRules(nil, NO_TIMER_NAME)
+
+	metrics := engine.RuleMetrics()
+	if len(metrics) != 1 || metrics[0].Rule != "timedRule" {
+		t.Fatalf("bad metrics: %#v", metrics)
+	}
+	cond, then := metrics[0].Condition, metrics[0].Then
+	if cond.Count != 4 || then.Count != 4 {
+		t.Errorf("bad counts: condition %d, then %d", cond.Count, then.Count)
+	}
+	if then.P50Ms < 1 || then.P50Ms >= 30 || then.MaxMs < 30 || then.P99Ms != then.MaxMs || then.TotalMs < 33 {
+		t.Errorf("bad then stats: %#v", then)
+	}
+	if cond.MaxMs >= 20 {
+		t.Errorf("bad condition stats: %#v", cond)
+	}
+
+	warnings := 0
+	for _, msg := range client.messages {
+		if strings.HasSuffix(msg.Topic, "/log/warning") {
+			warnings++
+			if !strings.HasPrefix(msg.Payload, "rule timedRule: then callback took ") {
+				t.Errorf("bad warning: %s", msg.Payload)
+			}
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("%d slow rule warnings instead of 1", warnings)
+	}
+}
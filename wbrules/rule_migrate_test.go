@@ -0,0 +1,59 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleMigrateSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleMigrateSuite) SetupTest() {
+	s.RuleSuiteBase.SetupTest(false)
+	s.SkipTill("tst -> /devices/somedev/controls/temp: [19] (QoS 1, retained)")
+	s.engine.Start()
+	<-s.engine.ReadyCh()
+}
+
+func (s *RuleMigrateSuite) loadMigrations() {
+	s.Ck("LiveLoadScript()", s.LiveLoadScript("testrules_migrate.js"))
+}
+
+func (s *RuleMigrateSuite) TestMigrate() {
+	storage := s.engine.PersistentStorage()
+	s.Ck("Set()", storage.Set("thermostat", "setpoint", "21.5"))
+	s.loadMigrations()
+	s.Verify(
+		"[info] storage migrated from version 0 to 1",
+		"[info] storage migrated from version 1 to 2",
+		"[info] setpoint: 21.5 C, version: 2",
+		"driver -> /wbrules/updates/changed: [testrules_migrate.js] (QoS 1)",
+	)
+	_, found := storage.Get("thermostat", "setpoint")
+	s.False(found)
+
+	// migrations are only run once
+	s.loadMigrations()
+	s.Verify(
+		"[info] setpoint: 21.5 C, version: 2",
+		"driver -> /wbrules/updates/changed: [testrules_migrate.js] (QoS 1)",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleMigrateSuite) TestFailedMigration() {
+	s.Ck("EvalScript()", s.engine.EvalScript(
+		"storage.migrate(0, function () { throw new Error('boom'); })"))
+	s.Verify("[error] storage migration from version 0 failed: Error: boom")
+	s.EnsureGotErrors()
+	s.Ck("EvalScript()", s.engine.EvalScript("log('version: {}', storage.version)"))
+	s.Verify("[info] version: 0")
+	s.VerifyEmpty()
+}
+
+func TestRuleMigrateSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleMigrateSuite),
+	)
+}
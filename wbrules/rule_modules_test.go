@@ -0,0 +1,74 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"regexp"
+	"testing"
+)
+
+type RuleModulesSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleModulesSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_modules.js")
+	for _, path := range []string{
+		"testmodules/counter.js",
+		"testmodules/lib/greet.js",
+		"testmodules/broken.js",
+		"testmodules/throws.js",
+	} {
+		s.CopyDataFileToTempDir(path, path)
+	}
+	s.model.CallSync(func() {
+		s.engine.SetModulePath([]string{s.DataFilePath("testmodules")})
+	})
+}
+
+func (s *RuleModulesSuite) TestRequire() {
+	s.Ck("require()", s.engine.EvalScript(`
+	  var greet = require("lib/greet");
+	  log(greet("world"));
+	  log(greet("again"));`))
+	s.Verify(
+		"[info] hello, world #1",
+		"[info] hello, again #2",
+	)
+
+	// the modules are loaded once and their
+	// variables don't get into the global scope
+	s.Ck("require()", s.engine.EvalScript(`
+	  log("{} {}", require("counter.js").next(), typeof count);`))
+	s.Verify("[info] 3 undefined")
+	s.VerifyEmpty()
+}
+
+func (s *RuleModulesSuite) TestRequireErrors() {
+	s.Ck("require()", s.engine.EvalScript(`
+	  tryRequire("nosuchmodule");
+	  tryRequire("../testrules_modules");
+	  tryRequire("throws");`))
+	s.Verify(
+		"[info] error: require: module not found: nosuchmodule",
+		"[info] error: require: module not found: ../testrules_modules",
+		"[info] error: module failed",
+	)
+
+	// the failed module isn't cached
+	s.Ck("require()", s.engine.EvalScript(`tryRequire("throws")`))
+	s.Verify("[info] error: module failed")
+
+	s.Ck("require()", s.engine.EvalScript(`tryRequire("broken")`))
+	s.Verify(regexp.MustCompile(
+		`^driver -> /wbrules/log/info: \[error: require: failed to compile ` +
+			regexp.QuoteMeta(s.DataFilePath("testmodules/broken.js")) +
+			`: SyntaxError: .*\(line 3\)`))
+	s.VerifyEmpty()
+}
+
+func TestRuleModulesSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleModulesSuite),
+	)
+}
@@ -0,0 +1,119 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+	"time"
+)
+
+type RuleOverrideSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleOverrideSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_override.js")
+}
+
+func (s *RuleOverrideSuite) startParty() {
+	s.engine.EvalScript("startParty()")
+	s.Verify(
+		"driver -> /devices/heating/controls/setpoint: [23] (QoS 1, retained)",
+		"driver -> /devices/heating/controls/setpoint/meta/override: [1] (QoS 1, retained)",
+		"new fake timer: 1, 7200000",
+		"[info] overridden: true",
+	)
+}
+
+func (s *RuleOverrideSuite) TestExpiry() {
+	s.startParty()
+	ts := s.AdvanceTime(2 * time.Hour)
+	s.FireTimer(1, ts)
+	s.Verify(
+		"timer.fire(): 1",
+		"driver -> /devices/heating/controls/setpoint: [20] (QoS 1, retained)",
+		"driver -> /devices/heating/controls/setpoint/meta/override: [] (QoS 1, retained)",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleOverrideSuite) TestCancel() {
+	s.startParty()
+	s.engine.EvalScript("stopParty()")
+	s.Verify(
+		"timer.Stop(): 1",
+		"driver -> /devices/heating/controls/setpoint: [20] (QoS 1, retained)",
+		"driver -> /devices/heating/controls/setpoint/meta/override: [] (QoS 1, retained)",
+		"[info] cancelled: true",
+		"[info] overridden: false",
+	)
+	s.engine.EvalScript("stopParty()")
+	s.Verify(
+		"[info] cancelled: false",
+		"[info] overridden: false",
+	)
+}
+
+func (s *RuleOverrideSuite) TestDurations() {
+	s.engine.EvalScript(`log("{} {} {}", _WbRules.parseDuration("1h30m"), ` +
+		`_WbRules.parseDuration("15s"), _WbRules.parseDuration(250))`)
+	s.Verify("[info] 5400000 15000 250")
+}
+
+type RuleOverrideRestoreSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleOverrideRestoreSuite) SetupTest() {
+	s.RuleSuiteBase.SetupTest(false, "testrules_override_restore.js")
+	s.SkipTill("tst -> /devices/somedev/controls/temp: [19] (QoS 1, retained)")
+}
+
+func (s *RuleOverrideRestoreSuite) TestRestore() {
+	storage := s.engine.PersistentStorage()
+	s.Ck("Set()", storage.Set("overrides", "heating/setpoint", map[string]interface{}{
+		"value":    float64(23),
+		"previous": float64(20),
+		"until":    time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	}))
+	// expired while the engine wasn't running
+	s.Ck("Set()", storage.Set("overrides", "heating/away", map[string]interface{}{
+		"value":    float64(10),
+		"previous": float64(16),
+		"until":    time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+	}))
+	s.engine.Start()
+	<-s.engine.ReadyCh()
+	s.Verify(
+		"driver -> /devices/heating/controls/away: [16] (QoS 1, retained)",
+		"driver -> /devices/heating/controls/away/meta/override: [] (QoS 1, retained)",
+		"driver -> /devices/heating/controls/setpoint: [23] (QoS 1, retained)",
+		"driver -> /devices/heating/controls/setpoint/meta/override: [1] (QoS 1, retained)",
+		testutils.RegexpCaptureMatcher(`^new fake timer: 1, \d+$`, nil),
+	)
+	_, found := storage.Get("overrides", "heating/away")
+	s.False(found)
+	_, found = storage.Get("overrides", "heating/setpoint")
+	s.True(found)
+
+	s.engine.EvalScript(`log("{} {}", override.isActive("heating/setpoint"), override.isActive("heating/away"))`)
+	s.Verify("[info] true false")
+
+	ts := s.AdvanceTime(time.Hour)
+	s.FireTimer(1, ts)
+	s.Verify(
+		"timer.fire(): 1",
+		"driver -> /devices/heating/controls/setpoint: [20] (QoS 1, retained)",
+		"driver -> /devices/heating/controls/setpoint/meta/override: [] (QoS 1, retained)",
+	)
+	_, found = storage.Get("overrides", "heating/setpoint")
+	s.False(found)
+	s.VerifyEmpty()
+}
+
+func TestRuleOverrideSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleOverrideSuite),
+		new(RuleOverrideRestoreSuite),
+	)
+}
@@ -0,0 +1,32 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleParamsSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleParamsSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_params.js")
+}
+
+func (s *RuleParamsSuite) TestChangeParam() {
+	s.publish("/devices/heating/controls/hysteresis/on", "0.8", "heating/hysteresis")
+	s.Verify(
+		"tst -> /devices/heating/controls/hysteresis/on: [0.8] (QoS 1)",
+		"driver -> /devices/heating/controls/hysteresis: [0.8] (QoS 1, retained)",
+		"[info] hysteresis: 0.8, setback: 2, enabled: true",
+	)
+	value, found := s.engine.PersistentStorage().Get("params/heating", "hysteresis")
+	s.True(found)
+	s.Equal(0.8, value)
+}
+
+func TestRuleParamsSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleParamsSuite),
+	)
+}
@@ -0,0 +1,42 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleDevicePrefixSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleDevicePrefixSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_prefix.js", "testrules_prefix_other.js")
+}
+
+func (s *RuleDevicePrefixSuite) TestPrefixedDevices() {
+	s.engine.EvalScript("checkPrefixedNames()")
+	s.Verify("[info] hvac-settings 21 1")
+	s.engine.EvalScript("checkUnprefixedNames()")
+	s.Verify("[info] settings/setpoint: 5")
+}
+
+func (s *RuleDevicePrefixSuite) TestPrefixedRule() {
+	s.publish("/devices/hvac-settings/controls/setpoint/on", "22", "hvac-settings/setpoint")
+	s.Verify(
+		"tst -> /devices/hvac-settings/controls/setpoint/on: [22] (QoS 1)",
+		"driver -> /devices/hvac-settings/controls/setpoint: [22] (QoS 1, retained)",
+		"[info] hvac setpoint: 22",
+	)
+}
+
+func (s *RuleDevicePrefixSuite) TestPrefixOnlyWhileLoading() {
+	s.engine.EvalScript("try { useDevicePrefix('other'); } catch (e) { log('prefix not set'); }")
+	s.Verify("[info] prefix not set")
+}
+
+func TestRuleDevicePrefixSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleDevicePrefixSuite),
+	)
+}
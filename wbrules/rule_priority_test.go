@@ -0,0 +1,221 @@
+package wbrules
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/objx"
+	"reflect"
+	"testing"
+)
+
+type priorityTestRule struct {
+	name     string
+	priority int
+	value    bool
+}
+
+func setupPriorityEngine(t *testing.T, rules []priorityTestRule) (*RuleEngine, *bytes.Buffer) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	var buf bytes.Buffer
+	engine.SetAuditLog(NewAuditLog(&buf))
+	dev := model.EnsureLocalDevice("heater", "heater")
+	dev.SetCell("trigger", "switch", false, false)
+	valve := dev.SetCell("valve", "switch", false, false)
+	for _, r := range rules {
+		cond, err := NewCellChangedRuleCondition(CellSpec{"heater", "trigger"})
+		if err != nil {
+			t.Fatalf("NewCellChangedRuleCondition(): %s", err)
+		}
+		value := r.value
+		rule := NewRule(engine, r.name, cond, func(args objx.Map) interface{} {
+			if err := engine.setCellValue(valve, value); err != nil {
+				t.Errorf("setCellValue(): %s", err)
+			}
+			return nil
+		})
+		rule.SetPriority(r.priority)
+		engine.DefineRule(rule)
+	}
+	return engine, &buf
+}
+
+func firePriorityRules(engine *RuleEngine) {
+	cellSpec := &CellSpec{"heater", "trigger"}
+	cell := engine.model.EnsureCell(cellSpec)
+	cell.maybeSetValueQuiet(true, true)
+	cell.gotValue = true
+	engine.RunRules(cellSpec, NO_TIMER_NAME)
+}
+
+func verifyAuditRecords(t *testing.T, buf *bytes.Buffer, expected []AuditRecord) {
+	actual := []AuditRecord{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var record AuditRecord
+		if err := dec.Decode(&record); err != nil {
+			t.Fatalf("error decoding audit record: %s", err)
+		}
+		record.Time = expected[0].Time
+		actual = append(actual, record)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("bad audit records: %#v", actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("bad audit record %d: %#v instead of %#v", i, actual[i], expected[i])
+		}
+	}
+}
+
+func TestRuleWritePriority(t *testing.T) {
+	for _, rules := range [][]priorityTestRule{
+		{{"safety", 10, false}, {"comfort", 0, true}},
+		{{"comfort", 0, true}, {"safety", 10, false}},
+	} {
+		engine, buf := setupPriorityEngine(t, rules)
+		firePriorityRules(engine)
+		valve := engine.model.EnsureCell(&CellSpec{"heater", "valve"})
+		if valve.Value() != false {
+			t.Errorf("the safety rule lost (rule order %s, %s)", rules[0].name, rules[1].name)
+		}
+		verifyAuditRecords(t, buf, []AuditRecord{
+			{
+				Identity: "rule:comfort",
+				Action:   AUDIT_ACTION_OVERRIDDEN_WRITE,
+				Target:   "heater/valve",
+				Value:    true,
+				Reason:   "overridden by rule safety (priority 10)",
+			},
+		})
+		if len(engine.writeClaims) != 0 {
+			t.Errorf("write claims not cleared after the pass")
+		}
+	}
+}
+
+func TestRuleWriteEqualPriority(t *testing.T) {
+	engine, buf := setupPriorityEngine(t, []priorityTestRule{
+		{"first", 0, false},
+		{"second", 0, true},
+	})
+	firePriorityRules(engine)
+	valve := engine.model.EnsureCell(&CellSpec{"heater", "valve"})
+	if valve.Value() != true {
+		t.Errorf("the last writer must win among the rules with equal priority")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected audit records: %s", buf.String())
+	}
+}
+
+func TestRuleEvaluationOrder(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	dev := model.EnsureLocalDevice("heater", "heater")
+	dev.SetCell("trigger", "switch", false, false)
+	var fired []string
+	defineRule := func(name string, priority int) {
+		cond, err := NewCellChangedRuleCondition(CellSpec{"heater", "trigger"})
+		if err != nil {
+			t.Fatalf("NewCellChangedRuleCondition(): %s", err)
+		}
+		rule := NewRule(engine, name, cond, func(args objx.Map) interface{} {
+			fired = append(fired, name)
+			return nil
+		})
+		rule.SetPriority(priority)
+		engine.DefineRule(rule)
+	}
+	defineRule("a", 0)
+	defineRule("b", 10)
+	defineRule("c", 0)
+	defineRule("d", -5)
+	defineRule("e", 10)
+	expected := []string{"b", "e", "a", "c", "d"}
+	if order := engine.RuleOrder(); !reflect.DeepEqual(order, expected) {
+		t.Errorf("bad rule order: %v instead of %v", order, expected)
+	}
+	firePriorityRules(engine)
+	if !reflect.DeepEqual(fired, expected) {
+		t.Errorf("bad evaluation order: %v instead of %v", fired, expected)
+	}
+
+	// redefined rules keep their place in the definition order
+	defineRule("a", 10)
+	defineRule("e", 0)
+	expected = []string{"a", "b", "c", "e", "d"}
+	if order := engine.RuleOrder(); !reflect.DeepEqual(order, expected) {
+		t.Errorf("bad rule order after redefinition: %v instead of %v", order, expected)
+	}
+}
+
+func TestRuleWriteConflicts(t *testing.T) {
+	for _, mode := range []string{WRITE_CONFLICTS_LOG, WRITE_CONFLICTS_REJECT} {
+		engine, buf := setupPriorityEngine(t, []priorityTestRule{
+			{"first", 0, false},
+			{"second", 0, true},
+		})
+		if err := engine.SetWriteConflictMode(mode); err != nil {
+			t.Fatalf("SetWriteConflictMode(): %s", err)
+		}
+		firePriorityRules(engine)
+		valve := engine.model.EnsureCell(&CellSpec{"heater", "valve"})
+		expected := mode == WRITE_CONFLICTS_LOG
+		if valve.Value() != expected {
+			t.Errorf("%s: bad value %v", mode, valve.Value())
+		}
+		if (buf.Len() != 0) != (mode == WRITE_CONFLICTS_REJECT) {
+			t.Errorf("%s: unexpected audit records: %q", mode, buf.String())
+		}
+		source := "rule:second"
+		if mode == WRITE_CONFLICTS_REJECT {
+			source = "rule:first"
+		}
+		if valve.Source() != source {
+			t.Errorf("%s: bad source %q", mode, valve.Source())
+		}
+	}
+	engine, _ := setupPriorityEngine(t, nil)
+	if engine.SetWriteConflictMode("fight") == nil {
+		t.Errorf("no error for invalid mode")
+	}
+}
+
+func TestCellSource(t *testing.T) {
+	engine, _ := setupPriorityEngine(t, []priorityTestRule{{"open", 0, true}})
+	dev := engine.model.EnsureLocalDevice("heater", "heater")
+	valve := dev.MustGetCell("valve")
+	sourceCell := dev.EnsureCell("valve#source")
+	if !sourceCell.pseudo || sourceCell.Value() != "" {
+		t.Errorf("bad source pseudo-cell: %v", sourceCell.Value())
+	}
+	firePriorityRules(engine)
+	if valve.Source() != "rule:open" || sourceCell.Value() != "rule:open" {
+		t.Errorf("bad source after rule write: %q, %v", valve.Source(), sourceCell.Value())
+	}
+	engine.setCellValue(valve, false)
+	if valve.Source() != CELL_SOURCE_SCRIPT || sourceCell.Value() != CELL_SOURCE_SCRIPT {
+		t.Errorf("bad source after script write: %q", valve.Source())
+	}
+	if _, err := engine.WriteCell(&CellSpec{"heater", "valve"}, true, nil); err != nil || valve.Source() != CELL_SOURCE_EXTERNAL {
+		t.Errorf("bad source after external write: %q (error %v)", valve.Source(), err)
+	}
+	dev.AcceptOnValue("valve", "0")
+	if valve.Source() != CELL_SOURCE_MQTT {
+		t.Errorf("bad source after MQTT write: %q", valve.Source())
+	}
+
+	relay := engine.model.EnsureDevice("relay").EnsureCell("K1")
+	engine.setCellValue(relay, true)
+	if relay.Source() != "" {
+		t.Errorf("the source changed before the value was confirmed: %q", relay.Source())
+	}
+	relay.device.(*CellModelExternalDevice).AcceptValue("K1", "1")
+	if relay.Source() != CELL_SOURCE_SCRIPT {
+		t.Errorf("bad source of the confirmed value: %q", relay.Source())
+	}
+	relay.device.(*CellModelExternalDevice).AcceptValue("K1", "0")
+	if relay.Source() != CELL_SOURCE_MQTT {
+		t.Errorf("bad source of the value received from MQTT: %q", relay.Source())
+	}
+}
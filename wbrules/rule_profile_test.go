@@ -0,0 +1,84 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"github.com/stretchr/objx"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type RuleProfileSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleProfileSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.profile = objx.Map{
+		"site":       "cottage",
+		"rooms":      []interface{}{"hall", "kitchen"},
+		"hwRevision": "5.8",
+		"wiring": map[string]interface{}{
+			"heater": "relay1/K1",
+		},
+	}
+	s.SetupSkippingDefs("testrules_profile.js")
+}
+
+func (s *RuleProfileSuite) TestProfileRules() {
+	s.publish("/devices/kitchen/controls/motion/meta/type", "switch", "kitchen/motion")
+	s.publish("/devices/kitchen/controls/motion", "1", "kitchen/motion")
+	s.Verify(
+		"tst -> /devices/kitchen/controls/motion/meta/type: [switch] (QoS 1, retained)",
+		"tst -> /devices/kitchen/controls/motion: [1] (QoS 1, retained)",
+		"[info] kitchen: motion true at cottage",
+	)
+}
+
+func (s *RuleProfileSuite) TestReadOnlyProfile() {
+	s.Ck("EvalScript", s.engine.EvalScript("tryToModifyProfile()"))
+	s.Verify("[info] site: cottage, rooms: hall,kitchen, heater: relay1/K1, hwRevision: 5.8")
+}
+
+func TestRuleProfileSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleProfileSuite),
+	)
+}
+
+func TestLoadProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wbrulestest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "profile.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{
+  // comments are allowed
+  "site": "cottage",
+  "rooms": ["hall"],
+  "hwRevision": "5.8"
+}`), 0644))
+
+	profile, err := LoadProfile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "cottage", profile.Get("site").Str())
+	assert.Equal(t, []interface{}{"hall"}, profile.Get("rooms").Data())
+
+	env := map[string]string{
+		PROFILE_ENV_SITE:  "office",
+		PROFILE_ENV_ROOMS: " hall, kitchen ,,lab",
+	}
+	applyProfileEnv(profile, func(name string) (string, bool) {
+		v, found := env[name]
+		return v, found
+	})
+	assert.Equal(t, objx.Map{
+		"site":       "office",
+		"rooms":      []interface{}{"hall", "kitchen", "lab"},
+		"hwRevision": "5.8",
+	}, profile)
+
+	_, err = LoadProfile(filepath.Join(dir, "nonexistent.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,61 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"regexp"
+	"testing"
+)
+
+type RulePseudoCellsSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RulePseudoCellsSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_pseudocells.js")
+}
+
+func (s *RulePseudoCellsSuite) TestPseudoCells() {
+	s.publish("/devices/pdev/controls/a/meta/type", "switch", "pdev/a")
+	s.Verify("tst -> /devices/pdev/controls/a/meta/type: [switch] (QoS 1, retained)")
+
+	s.publish("/devices/pdev/controls/a", "1", "pdev/a", "pdev/#complete", "pdev/#lastUpdate")
+	s.VerifyUnordered(
+		"tst -> /devices/pdev/controls/a: [1] (QoS 1, retained)",
+		"[info] pdev complete",
+		"[info] pdev updated: true",
+	)
+
+	// the device becomes incomplete when a new cell appears
+	s.publish("/devices/pdev/controls/b/meta/type", "switch", "pdev/b", "pdev/#complete")
+	s.Verify("tst -> /devices/pdev/controls/b/meta/type: [switch] (QoS 1, retained)")
+
+	s.publish("/devices/pdev/controls/b", "0", "pdev/b", "pdev/#complete", "pdev/#lastUpdate")
+	s.VerifyUnordered(
+		"tst -> /devices/pdev/controls/b: [0] (QoS 1, retained)",
+		"[info] pdev complete",
+		"[info] pdev updated: true",
+	)
+
+	// only #lastUpdate changes when the device is already complete
+	s.publish("/devices/pdev/controls/a", "0", "pdev/a", "pdev/#lastUpdate")
+	s.Verify(
+		"tst -> /devices/pdev/controls/a: [0] (QoS 1, retained)",
+		"[info] pdev updated: true",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RulePseudoCellsSuite) TestReadOnlyPseudoCells() {
+	s.Error(s.engine.EvalScript(`dev["pdev/#complete"] = true`))
+	s.Verify(
+		"[error] can't write pseudo-cell pdev/#complete",
+		regexp.MustCompile(`^driver -> /wbrules/log/error: \[eval error: `),
+	)
+	s.EnsureGotErrors()
+}
+
+func TestRulePseudoCellsSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RulePseudoCellsSuite),
+	)
+}
@@ -2,6 +2,7 @@ package wbrules
 
 import (
 	"github.com/contactless/wbgo/testutils"
+	"regexp"
 	"testing"
 )
 
@@ -37,6 +38,60 @@ func (s *RuleReadOnlyCellSuite) TestReadOnlyCells() {
 	)
 }
 
+func (s *RuleReadOnlyCellSuite) TestCellMetadata() {
+	s.SkipTill("tst -> /devices/somedev/controls/temp: [19] (QoS 1, retained)")
+	s.engine.EvalScript(`
+	  defineVirtualDevice("metaCells", {
+	    title: "Metadata Test",
+	    cells: {
+	      temp: {
+	        type: "value",
+	        value: 21.5,
+	        readonly: true,
+	        units: "deg C",
+	        min: -40,
+	        precision: 0.1,
+	        order: 5,
+	        error: "r"
+	      }
+	    }
+	  });`)
+	s.Verify(
+		"driver -> /devices/metaCells/meta/name: [Metadata Test] (QoS 1, retained)",
+		"driver -> /devices/metaCells/controls/temp/meta/type: [value] (QoS 1, retained)",
+		"driver -> /devices/metaCells/controls/temp/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/metaCells/controls/temp/meta/order: [1] (QoS 1, retained)",
+		"driver -> /devices/metaCells/controls/temp: [21.5] (QoS 1, retained)",
+		// extra metadata is published after the control itself
+		// in the order of meta topic names
+		"driver -> /devices/metaCells/controls/temp/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/metaCells/controls/temp/meta/min: [-40] (QoS 1, retained)",
+		"driver -> /devices/metaCells/controls/temp/meta/order: [5] (QoS 1, retained)",
+		"driver -> /devices/metaCells/controls/temp/meta/precision: [0.1] (QoS 1, retained)",
+		"driver -> /devices/metaCells/controls/temp/meta/units: [deg C] (QoS 1, retained)",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleReadOnlyCellSuite) TestInvalidCellMetadata() {
+	s.SkipTill("tst -> /devices/somedev/controls/temp: [19] (QoS 1, retained)")
+	for _, cellDef := range []string{
+		`{ type: "value", value: 0, units: 42 }`,
+		`{ type: "value", value: 0, order: 0 }`,
+		`{ type: "value", value: 0, order: 1.5 }`,
+		`{ type: "value", value: 0, precision: "0.1" }`,
+		`{ type: "value", value: 0, min: "low" }`,
+	} {
+		script := `defineVirtualDevice("badMeta", { cells: { foo: ` + cellDef + ` } });`
+		s.Error(s.engine.EvalScript(script), script)
+		s.Verify(
+			regexp.MustCompile(`^driver -> /devices/badMeta/meta/name: `),
+			regexp.MustCompile(`^driver -> /wbrules/log/error: \[eval error: `),
+		)
+		s.EnsureGotErrors()
+	}
+}
+
 func TestRuleReadOnlyCellSuite(t *testing.T) {
 	testutils.RunSuites(t,
 		new(RuleReadOnlyCellSuite),
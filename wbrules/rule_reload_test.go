@@ -124,6 +124,40 @@ func (s *RuleReloadSuite) TestRemoveScript() {
 	)
 }
 
+func (s *RuleReloadSuite) TestAliasRemoval() {
+	s.engine.EvalScript(`log("smc defined: {}", _WbRules.aliases.hasOwnProperty("smc"))`)
+	s.Verify("[info] smc defined: true")
+	s.RemoveScript("testrules_reload_2.js")
+	s.Verify(
+		"Unsubscribe -- driver: /devices/vdev/controls/anotherCell/on",
+		"Unsubscribe -- driver: /devices/vdev/controls/someCell/on",
+		"Unsubscribe -- driver: /devices/vdev1/controls/qqq/on",
+		"[info] detRun",
+		"driver -> /wbrules/updates/removed: [testrules_reload_2.js] (QoS 1)",
+	)
+	s.engine.EvalScript(`log("smc defined: {} {}", ` +
+		`_WbRules.aliases.hasOwnProperty("smc"), typeof smc != "undefined")`)
+	s.Verify("[info] smc defined: false false")
+}
+
+func (s *RuleReloadSuite) TestDepsAfterReload() {
+	var vdev0Cell *Cell
+	s.model.CallSync(func() {
+		vdev0Cell = s.model.LookupCell(&CellSpec{"vdev0", "someCell"})
+	})
+	s.ReplaceScript("testrules_reload_2.js", "testrules_reload_2_changed.js")
+	s.SkipTill("driver -> /wbrules/updates/changed: [testrules_reload_2.js] (QoS 1)")
+	s.model.CallSync(func() {
+		// vdev0 isn't touched by the reload
+		s.Equal(vdev0Cell, s.model.LookupCell(&CellSpec{"vdev0", "someCell"}))
+		// no rules depend on the cells of the removed devices
+		for cell := range s.engine.cellToRuleMap {
+			s.Equal(cell, s.model.LookupCell(&CellSpec{cell.DevName(), cell.Name()}),
+				"stale cell %s/%s", cell.DevName(), cell.Name())
+		}
+	})
+}
+
 func (s *RuleReloadSuite) TestNoReloading() {
 	s.engine.EvalScript("testrules_reload_1_loaded = false;")
 	// no actual replacement should happen here
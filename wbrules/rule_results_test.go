@@ -0,0 +1,99 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"github.com/stretchr/objx"
+	"testing"
+)
+
+type RuleResultsSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleResultsSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_results.js")
+}
+
+func (s *RuleResultsSuite) lastResult(name string) (result CallbackResult, found bool) {
+	s.model.CallSync(func() {
+		result, found = s.engine.LastRuleResult(name)
+	})
+	return
+}
+
+func (s *RuleResultsSuite) TestStructuredResult() {
+	result, found := s.lastResult("tempStatus")
+	s.True(found)
+	s.True(result.IsNil())
+
+	s.publish("/devices/somedev/controls/temp", "21", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [21] (QoS 1, retained)",
+		"[info] tempStatus fired: 21",
+	)
+	result, found = s.lastResult("tempStatus")
+	s.True(found)
+	m, ok := result.Map()
+	s.True(ok)
+	s.Equal(objx.Map{
+		"temp":   float64(21),
+		"high":   true,
+		"source": []interface{}{"somedev", "temp"},
+	}, m)
+}
+
+func (s *RuleResultsSuite) TestNoResult() {
+	s.publish("/devices/somedev/controls/sw", "1", "somedev/sw")
+	s.Verify(
+		"tst -> /devices/somedev/controls/sw: [1] (QoS 1, retained)",
+		"[info] noResult fired",
+	)
+	result, found := s.lastResult("noResult")
+	s.True(found)
+	s.True(result.IsNil())
+
+	_, found = s.lastResult("nosuchrule")
+	s.False(found)
+}
+
+func (s *RuleResultsSuite) TestObjectValueChange() {
+	s.publish("/devices/somedev/controls/level", "5", "somedev/level")
+	s.Verify(
+		"tst -> /devices/somedev/controls/level: [5] (QoS 1, retained)",
+		"[info] levelStatus: low",
+	)
+	// an equal object doesn't trigger the rule
+	s.publish("/devices/somedev/controls/level", "6", "somedev/level")
+	s.Verify("tst -> /devices/somedev/controls/level: [6] (QoS 1, retained)")
+	s.publish("/devices/somedev/controls/level", "25", "somedev/level")
+	s.Verify(
+		"tst -> /devices/somedev/controls/level: [25] (QoS 1, retained)",
+		"[info] levelStatus: high",
+	)
+}
+
+func TestFuncValueChangedObjects(t *testing.T) {
+	var v interface{}
+	cond := NewFuncValueChangedRuleCondition(func() interface{} { return v })
+	for _, tt := range []struct {
+		value interface{}
+		fire  bool
+	}{
+		{objx.Map{"a": []interface{}{1.0}}, true},
+		{objx.Map{"a": []interface{}{1.0}}, false},
+		{[]interface{}{"x"}, true},
+		{[]interface{}{"x"}, false},
+		{"x", true},
+	} {
+		v = tt.value
+		if fire, _ := cond.Check(nil); fire != tt.fire {
+			t.Errorf("%v: fire = %v", tt.value, fire)
+		}
+	}
+}
+
+func TestRuleResultsSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleResultsSuite),
+	)
+}
@@ -22,6 +22,13 @@ func (s *RuleRuntimeErrorsSuite) TestRuntimeErrors() {
 		"tst -> /devices/somedev/controls/foobar: [1] (QoS 1, retained)",
 		regexp.MustCompile(
 			`(?s:ECMAScript error:.*ReferenceError.*testrules_runtime_errors\.js:8.*)`),
+		regexp.MustCompile(
+			`^driver -> /wbrules/errors/brokenCellChange: \[\{"rule":"brokenCellChange",.*"count":1\}\] \(QoS 1, retained\)$`),
+		"driver -> /devices/wbrules/controls/Errors/meta/type: [text] (QoS 1, retained)",
+		"driver -> /devices/wbrules/controls/Errors/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/wbrules/controls/Errors/meta/order: [2] (QoS 1, retained)",
+		regexp.MustCompile(
+			`^driver -> /devices/wbrules/controls/Errors: \[brokenCellChange: ReferenceError.*\] \(QoS 1, retained\)$`),
 	)
 	s.EnsureGotErrors()
 }
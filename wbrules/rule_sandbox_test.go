@@ -0,0 +1,47 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleSandboxSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleSandboxSuite) SetupTest() {
+	s.RuleSuiteBase.SetupTest(false)
+	s.Ck("AddRestrictedDir()",
+		s.engine.AddRestrictedDir(s.DataFileTempDir(), NewRestrictedProfile("bundle")))
+	s.SkipTill("tst -> /devices/somedev/controls/temp: [19] (QoS 1, retained)")
+	s.engine.Start()
+	<-s.engine.ReadyCh()
+	s.Ck("LiveLoadScript()", s.LiveLoadScript("testrules_sandbox.js"))
+	s.SkipTill("driver -> /wbrules/updates/changed: [testrules_sandbox.js] (QoS 1)")
+}
+
+func (s *RuleSandboxSuite) TestRestrictions() {
+	s.publish("/devices/somedev/controls/temp", "21", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [21] (QoS 1, retained)",
+		"driver -> /devices/bundleDev/controls/out: [1] (QoS 1, retained)",
+		"[error] restricted profile bundle: writing somedev/sw not permitted",
+		"[info] write denied",
+		"[error] restricted profile bundle: spawning echo not permitted",
+		"[info] spawn denied",
+		"[error] restricted profile bundle: publishing to /somewhere not permitted",
+		"[info] publish denied",
+		"[error] restricted profile bundle: reading /etc/wb-rules.conf not permitted",
+		"[info] readConfig denied",
+		"[error] restricted profile bundle: subscribing to /devices/# not permitted",
+		"[info] trackMqtt denied",
+	)
+	s.EnsureGotErrors()
+	s.VerifyEmpty()
+}
+
+func TestRuleSandboxSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleSandboxSuite),
+	)
+}
@@ -0,0 +1,76 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"os"
+	"testing"
+)
+
+type RuleScriptSwitchesSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleScriptSwitchesSuite) SetupTest() {
+	s.scriptSwitches = true
+	s.SetupSkippingDefs("testrules_switches.js")
+}
+
+func (s *RuleScriptSwitchesSuite) verifyScriptActive(active bool, temp string) {
+	s.publish("/devices/somedev/controls/temp", temp, "somedev/temp")
+	if active {
+		s.Verify(
+			"tst -> /devices/somedev/controls/temp: ["+temp+"] (QoS 1, retained)",
+			"[info] temp: "+temp,
+		)
+	} else {
+		s.Verify("tst -> /devices/somedev/controls/temp: [" + temp + "] (QoS 1, retained)")
+	}
+	s.VerifyEmpty()
+}
+
+func (s *RuleScriptSwitchesSuite) verifyDisabledFile(disabled bool) {
+	_, err := os.Stat(s.DataFilePath("testrules_switches.js" + DISABLED_SCRIPT_SUFFIX))
+	s.Equal(disabled, err == nil, "bad disabled script file state")
+}
+
+func (s *RuleScriptSwitchesSuite) TestSwitchDisablesScript() {
+	s.verifyScriptActive(true, "20")
+
+	s.publish("/devices/wbrules/controls/testrules_switches.js/on", "0",
+		"wbrules/testrules_switches.js")
+	s.Verify(
+		"tst -> /devices/wbrules/controls/testrules_switches.js/on: [0] (QoS 1)",
+		"driver -> /devices/wbrules/controls/testrules_switches.js: [0] (QoS 1, retained)",
+	)
+	s.SkipTill("driver -> /wbrules/updates/disabled: [testrules_switches.js] (QoS 1)")
+	s.verifyDisabledFile(true)
+	s.verifyScriptActive(false, "21")
+
+	s.publish("/devices/wbrules/controls/testrules_switches.js/on", "1",
+		"wbrules/testrules_switches.js")
+	s.Verify(
+		"tst -> /devices/wbrules/controls/testrules_switches.js/on: [1] (QoS 1)",
+		"driver -> /devices/wbrules/controls/testrules_switches.js: [1] (QoS 1, retained)",
+	)
+	s.SkipTill("driver -> /wbrules/updates/enabled: [testrules_switches.js] (QoS 1)")
+	s.verifyDisabledFile(false)
+	s.verifyScriptActive(true, "22")
+}
+
+func (s *RuleScriptSwitchesSuite) TestSwitchFollowsScriptState() {
+	s.Ck("LiveChangeScriptState()", s.engine.LiveChangeScriptState("testrules_switches.js", false))
+	s.SkipTill("driver -> /devices/wbrules/controls/testrules_switches.js: [0] (QoS 1, retained)")
+	s.Verify("driver -> /wbrules/updates/disabled: [testrules_switches.js] (QoS 1)")
+	s.verifyDisabledFile(true)
+	s.verifyScriptActive(false, "20")
+
+	// the state doesn't change if the script is already disabled
+	s.Ck("LiveChangeScriptState()", s.engine.LiveChangeScriptState("testrules_switches.js", false))
+	s.VerifyEmpty()
+}
+
+func TestRuleScriptSwitchesSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleScriptSwitchesSuite),
+	)
+}
@@ -0,0 +1,57 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"strings"
+	"testing"
+	"time"
+)
+
+type RuleSoakSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleSoakSuite) SetupTest() {
+	s.SetupSkippingDefs()
+}
+
+func (s *RuleSoakSuite) TestGenerateScript() {
+	opts := SoakOptions{Duration: time.Second, Rules: 3, Cells: 2}
+	script := GenerateSoakScript(opts, 0)
+	s.Contains(script, `"ticks": { type: "value", value: soakTicks }`)
+	s.Contains(script, `"c1": { type: "temperature", value: 0 }`)
+	s.Equal(3, strings.Count(script, "defineRule("))
+	s.Equal(2, strings.Count(script, "whenChanged:"))
+	s.Contains(script, `dev["_wbrulesSoak/ticks"] = ++soakTicks;`)
+	s.Equal(1, strings.Count(GenerateSoakScript(opts, 1), "whenChanged:"))
+}
+
+func (s *RuleSoakSuite) TestBadOptions() {
+	_, err := RunSoakTest(s.engine, SoakOptions{Rules: 1, Cells: 1})
+	s.Error(err)
+	_, err = RunSoakTest(s.engine, SoakOptions{Duration: time.Second, Rules: 1, Cells: 1, ChangeRate: -1})
+	s.Error(err)
+}
+
+func (s *RuleSoakSuite) TestSoak() {
+	// the test engine uses fake timers, so the run is kept
+	// short enough for the timer check to be skipped
+	r, err := RunSoakTest(s.engine, SoakOptions{
+		Duration:       50 * time.Millisecond,
+		Rules:          10,
+		Cells:          3,
+		ChangeRate:     1000,
+		ReloadInterval: 10 * time.Millisecond,
+		Seed:           42,
+	})
+	s.Ck("RunSoakTest()", err)
+	s.True(r.OK(), "violations: %v", r.Violations)
+	s.True(r.Changes > 0)
+	s.True(r.Reloads > 0)
+}
+
+func TestRuleSoakSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleSoakSuite),
+	)
+}
@@ -0,0 +1,65 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleStandbySuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleStandbySuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_override.js")
+}
+
+func (s *RuleStandbySuite) TestStateSnapshot() {
+	s.engine.EvalScript("startParty()")
+	s.Verify(
+		"driver -> /devices/heating/controls/setpoint: [23] (QoS 1, retained)",
+		"driver -> /devices/heating/controls/setpoint/meta/override: [1] (QoS 1, retained)",
+		"new fake timer: 1, 7200000",
+		"[info] overridden: true",
+	)
+	s.Ck("PublishStateSnapshot()", s.engine.PublishStateSnapshot())
+	s.Verify(testutils.RegexpCaptureMatcher(
+		`^driver -> /wbrules/state: \[\{"version":1,"time":"[^"]+","storage":`+
+			`\{"overrides":\{"heating/setpoint":\{"previous":20,"until":"[^"]+","value":23\}\}\}\}\] `+
+			`\(QoS 1, retained\)$`, nil))
+
+	// unchanged state isn't published again
+	s.Ck("PublishStateSnapshot()", s.engine.PublishStateSnapshot())
+	s.VerifyEmpty()
+
+	s.engine.EvalScript("stopParty()")
+	s.Verify(
+		"timer.Stop(): 1",
+		"driver -> /devices/heating/controls/setpoint: [20] (QoS 1, retained)",
+		"driver -> /devices/heating/controls/setpoint/meta/override: [] (QoS 1, retained)",
+		"[info] cancelled: true",
+		"[info] overridden: false",
+	)
+	s.Ck("PublishStateSnapshot()", s.engine.PublishStateSnapshot())
+	s.Verify(testutils.RegexpCaptureMatcher(
+		`^driver -> /wbrules/state: \[\{"version":1,"time":"[^"]+","storage":\{\}\}\] \(QoS 1, retained\)$`, nil))
+}
+
+func (s *RuleStandbySuite) TestImportStateSnapshot() {
+	s.Error(s.engine.ImportStateSnapshot(&StateSnapshot{Version: 42}))
+	s.Ck("ImportStateSnapshot()", s.engine.ImportStateSnapshot(&StateSnapshot{
+		Version: STATE_SNAPSHOT_VERSION,
+		Time:    "2026-10-16T10:00:00Z",
+		Storage: StorageData{"features": {"newLogic": true}},
+	}))
+	s.Verify("[info] imported state snapshot taken at 2026-10-16T10:00:00Z")
+	value, found := s.engine.PersistentStorage().Get("features", "newLogic")
+	s.True(found)
+	s.Equal(true, value)
+}
+
+func TestRuleStandbySuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleStandbySuite),
+	)
+}
@@ -0,0 +1,82 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"github.com/stretchr/objx"
+	"testing"
+	"time"
+)
+
+type RuleStartupDelaySuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleStartupDelaySuite) SetupTest() {
+	s.RuleSuiteBase.SetupTest(false, "testrules_startup.js")
+	s.engine.SetStartupDelay(5 * time.Second)
+	s.SkipTill("tst -> /devices/somedev/controls/temp: [19] (QoS 1, retained)")
+	s.engine.Start()
+	<-s.engine.ReadyCh()
+}
+
+func (s *RuleStartupDelaySuite) TestStartupDelay() {
+	s.Verify(
+		"new fake timer: 1, 5000",
+		"[info] critical fired",
+	)
+
+	ts := s.AdvanceTime(5000 * time.Millisecond)
+	s.FireTimer(1, ts)
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] heater fired",
+	)
+	s.VerifyEmpty()
+}
+
+func TestRuleStartupDelaySuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleStartupDelaySuite),
+	)
+}
+
+func TestStartupWindowEdges(t *testing.T) {
+	model, engine := newTestEngine(t, nullMQTTClient{})
+	dev := model.EnsureLocalDevice("alarm", "alarm")
+	leak := dev.SetCell("leak", "switch", false, false)
+	smoke := dev.SetCell("smoke", "switch", false, false)
+	fired := map[string]int{}
+	defineRule := func(name string, cell *Cell) {
+		engine.DefineRule(NewRule(engine, name, NewEdgeTriggeredRuleCondition(func() bool {
+			return cell.Value() == true
+		}), func(args objx.Map) interface{} {
+			fired[name]++
+			return nil
+		}))
+	}
+	defineRule("leak", leak)
+	defineRule("smoke", smoke)
+	engine.RunRules(nil, NO_TIMER_NAME)
+
+	engine.setStartupWindow(true)
+	leak.SetValue(true)
+	engine.RunRules(&CellSpec{"alarm", "leak"}, NO_TIMER_NAME)
+	smoke.SetValue(true)
+	engine.RunRules(&CellSpec{"alarm", "smoke"}, NO_TIMER_NAME)
+	smoke.SetValue(false)
+	engine.RunRules(&CellSpec{"alarm", "smoke"}, NO_TIMER_NAME)
+	if len(fired) != 0 {
+		t.Errorf("rules fired during the startup window: %v", fired)
+	}
+
+	engine.endStartupWindow()
+	// the edge isn't lost, but the condition
+	// that's no longer true doesn't fire
+	if fired["leak"] != 1 || fired["smoke"] != 0 {
+		t.Errorf("bad firings after the startup window: %v", fired)
+	}
+	engine.RunRules(nil, NO_TIMER_NAME)
+	if fired["leak"] != 1 {
+		t.Errorf("the rule fired again: %v", fired)
+	}
+}
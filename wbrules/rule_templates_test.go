@@ -0,0 +1,51 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleTemplatesSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleTemplatesSuite) SetupTest() {
+	s.sharedGlobals = true
+	s.SetupSkippingDefs("testrules_templates.js")
+}
+
+func (s *RuleTemplatesSuite) TestTemplates() {
+	s.engine.EvalScript("listTemplates()")
+	s.Verify("[info] templates: testdev, wb-mdm3, wb-mr3, wb-mr6c, wb-mrgbw, wb-msw")
+	s.engine.EvalScript("badTemplate()")
+	s.Verify("[info] error: unknown device template: nosuchtemplate")
+}
+
+func (s *RuleTemplatesSuite) TestMirrorFromSource() {
+	s.publish("/devices/somedev/controls/temp", "21", "somedev/temp")
+	s.Verify(
+		"tst -> /devices/somedev/controls/temp: [21] (QoS 1, retained)",
+		"driver -> /devices/mirror/controls/temp10: [210] (QoS 1, retained)",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleTemplatesSuite) TestMirrorToSource() {
+	s.publish("/devices/mirror/controls/sw/on", "1", "mirror/sw")
+	s.Verify(
+		"tst -> /devices/mirror/controls/sw/on: [1] (QoS 1)",
+		"driver -> /devices/mirror/controls/sw: [1] (QoS 1, retained)",
+		"driver -> /devices/somedev/controls/sw/on: [1] (QoS 1)",
+	)
+	s.publish("/devices/somedev/controls/sw", "1", "somedev/sw")
+	s.Verify(
+		"tst -> /devices/somedev/controls/sw: [1] (QoS 1, retained)",
+	)
+	s.VerifyEmpty()
+}
+
+func TestRuleTemplatesSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleTemplatesSuite),
+	)
+}
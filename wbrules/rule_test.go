@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/contactless/wbgo"
 	"github.com/contactless/wbgo/testutils"
+	"github.com/stretchr/objx"
 	"regexp"
 	"testing"
 	"time"
@@ -55,8 +56,18 @@ type RuleSuiteBase struct {
 	ruleFile string
 	*testutils.DataFileFixture
 	*testutils.FakeTimerFixture
-	engine *ESEngine
-	cron   *fakeCron
+	engine     *ESEngine
+	cron       *fakeCron
+	instanceID string
+	profile    objx.Map
+	configDir  string
+	// scriptSwitches enables the script switches
+	// of the engine settings device
+	scriptSwitches bool
+	// sharedGlobals disables script isolation (-shared-globals)
+	// for the suites that call the top-level functions of the
+	// scripts via EvalScript() or share them between the scripts
+	sharedGlobals bool
 }
 
 var logVerifyRx = regexp.MustCompile(`^\[(info|debug|warning|error)\] (.*)`)
@@ -93,7 +104,20 @@ func (s *RuleSuiteBase) SetupTest(waitForRetained bool, ruleFiles ...string) {
 	s.DataFileFixture = testutils.NewDataFileFixture(s.T())
 	s.FakeTimerFixture = testutils.NewFakeTimerFixture(s.T(), s.Recorder)
 	s.cron = nil
-	s.engine = NewESEngine(s.model, s.driverClient)
+	var err error
+	s.engine, err = NewESEngine(s.model, s.driverClient)
+	s.Ck("NewESEngine()", err)
+	s.engine.SetFatalPanics(true)
+	s.Ck("SetInstanceID()", s.engine.SetInstanceID(s.instanceID))
+	if s.profile != nil {
+		s.engine.SetProfile(s.profile)
+	}
+	if s.configDir != "" {
+		_, err := s.engine.SetConfigDir(s.configDir)
+		s.Ck("SetConfigDir()", err)
+	}
+	s.engine.SetScriptSwitches(s.scriptSwitches)
+	s.engine.SetScriptIsolation(!s.sharedGlobals)
 	s.engine.SetTimerFunc(s.newFakeTimer)
 	s.engine.SetCronMaker(func() Cron {
 		s.cron = newFakeCron(s.T())
@@ -0,0 +1,40 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"regexp"
+	"testing"
+)
+
+type RuleThenTimeoutSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleThenTimeoutSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_then_timeout.js")
+}
+
+func (s *RuleThenTimeoutSuite) TestThenTimeout() {
+	s.publish("/devices/somedev/controls/slow/meta/type", "switch", "somedev/slow")
+	s.publish("/devices/somedev/controls/slow", "1", "somedev/slow")
+	s.Verify(
+		"tst -> /devices/somedev/controls/slow/meta/type: [switch] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/slow: [1] (QoS 1, retained)",
+		"[error] rule interruptedRule: then callback timeout exceeded, interrupting",
+		regexp.MustCompile(`(?s:ECMAScript error:.*testrules_then_timeout\.js:16.*)`),
+		regexp.MustCompile(`^driver -> /wbrules/errors/interruptedRule: .*\(QoS 1, retained\)$`),
+		"driver -> /devices/wbrules/controls/Errors/meta/type: [text] (QoS 1, retained)",
+		"driver -> /devices/wbrules/controls/Errors/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/wbrules/controls/Errors/meta/order: [2] (QoS 1, retained)",
+		regexp.MustCompile(`^driver -> /devices/wbrules/controls/Errors: \[interruptedRule: .*\] \(QoS 1, retained\)$`),
+		regexp.MustCompile(`rule slowRule: then callback took .* \(timeout 10ms\)`),
+		"[info] fastRule fired",
+	)
+	s.EnsureGotErrors()
+}
+
+func TestRuleThenTimeoutSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleThenTimeoutSuite),
+	)
+}
@@ -0,0 +1,146 @@
+package wbrules
+
+import (
+	"context"
+	"github.com/contactless/wbgo"
+	"github.com/contactless/wbgo/testutils"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type RuleTimerCleanupSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleTimerCleanupSuite) SetupTest() {
+	s.RuleSuiteBase.SetupTest(true, "testrules_timer_cleanup.js")
+	s.engine.Start()
+	s.SkipTill("Subscribe -- driver: /devices/+/controls/+/meta/max")
+	s.Broker.SetReady()
+	<-s.engine.ReadyCh()
+	s.VerifyUnordered(
+		"new fake ticker: 1, 1000",
+		"new fake timer: 2, 5000",
+		"driver -> /devices/wbrules/controls/Rule debugging/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/wbrules/controls/Rule debugging/meta/order: [1] (QoS 1, retained)",
+		"driver -> /devices/wbrules/controls/Rule debugging: [0] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/wbrules/controls/Rule debugging/on",
+	)
+}
+
+func (s *RuleTimerCleanupSuite) TestTimersStoppedOnReload() {
+	ts := s.AdvanceTime(1000 * time.Millisecond)
+	s.FireTimer(1, ts)
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] interval fired",
+	)
+
+	s.ReplaceScript("testrules_timer_cleanup.js", "testrules_timer_cleanup_changed.js")
+	s.VerifyUnordered(
+		"timer.Stop(): 1",
+		"timer.Stop(): 2",
+		"[info] reloaded",
+		"driver -> /wbrules/updates/changed: [testrules_timer_cleanup.js] (QoS 1)",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleTimerCleanupSuite) TestTimersStoppedOnRemoval() {
+	s.RemoveScript("testrules_timer_cleanup.js")
+	s.VerifyUnordered(
+		"timer.Stop(): 1",
+		"timer.Stop(): 2",
+		"driver -> /wbrules/updates/removed: [testrules_timer_cleanup.js] (QoS 1)",
+	)
+}
+
+// manualTimer fires only when told to
+type manualTimer struct {
+	ch chan time.Time
+}
+
+func (timer *manualTimer) GetChannel() <-chan time.Time { return timer.ch }
+
+func (timer *manualTimer) Stop() {}
+
+func TestTimerCleanupLeaks(t *testing.T) {
+	obs := &testModelObserver{ready: true}
+	engine := NewRuleEngine(startTestModel(t, obs), nullMQTTClient{})
+	var timersMtx sync.Mutex
+	var timers []*manualTimer
+	engine.SetTimerFunc(func(id uint64, d time.Duration, periodic bool) wbgo.Timer {
+		timersMtx.Lock()
+		defer timersMtx.Unlock()
+		timer := &manualTimer{make(chan time.Time, 1)}
+		timers = append(timers, timer)
+		return timer
+	})
+	engine.Start()
+	<-engine.ReadyCh()
+	baseline := runtime.NumGoroutine()
+
+	var fired int32
+	load := func() {
+		engine.Call(func() {
+			engine.cleanup.PushCleanupScope("leak.js")
+			defer engine.cleanup.PopCleanupScope("leak.js")
+			for _, periodic := range []bool{false, true} {
+				engine.StartTimer(NO_TIMER_NAME, func() {
+					atomic.AddInt32(&fired, 1)
+				}, time.Second, periodic)
+			}
+		})
+	}
+	verifyStopped := func(what string) {
+		calls := obs.callCount()
+		timersMtx.Lock()
+		for _, timer := range timers {
+			select {
+			case timer.ch <- time.Now():
+			default:
+			}
+		}
+		timersMtx.Unlock()
+		time.Sleep(30 * time.Millisecond)
+		if n := atomic.LoadInt32(&fired); n != 0 {
+			t.Errorf("%s: %d timer callbacks invoked", what, n)
+		}
+		if n := obs.callCount() - calls; n != 0 {
+			t.Errorf("%s: %d CallSync() calls", what, n)
+		}
+		var n int
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if n = runtime.NumGoroutine(); n <= baseline {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Errorf("%s: goroutine leak: %d goroutines, %d before", what, n, baseline)
+	}
+
+	for i := 0; i < 20; i++ {
+		load()
+		engine.Call(func() {
+			engine.cleanup.RunCleanups("leak.js")
+		})
+	}
+	verifyStopped("after unload")
+
+	load()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := engine.Stop(ctx); err != nil {
+		t.Fatalf("Stop(): %s", err)
+	}
+	verifyStopped("after Stop()")
+}
+
+func TestRuleTimerCleanupSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleTimerCleanupSuite),
+	)
+}
@@ -114,6 +114,113 @@ func (s *RuleTimersSuite) TestShortTimers() {
 	s.VerifyEmpty()
 }
 
+func (s *RuleTimersSuite) TestTimerRestart() {
+	s.publish("/devices/somedev/controls/foo/meta/type", "text", "somedev/foo")
+	s.publish("/devices/somedev/controls/foo", "t", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo/meta/type: [text] (QoS 1, retained)",
+		"tst -> /devices/somedev/controls/foo: [t] (QoS 1, retained)",
+		"new fake timer: 1, 500",
+		"new fake timer: 2, 500",
+	)
+
+	s.publish("/devices/somedev/controls/foo", "q", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [q] (QoS 1, retained)",
+		"[info] running: true, remaining ok: true",
+	)
+
+	// restarting the timer doesn't leave the old one running
+	s.publish("/devices/somedev/controls/foo", "r", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [r] (QoS 1, retained)",
+		"timer.Stop(): 1",
+		"new fake timer: 3, 500",
+		"[info] restarted: true",
+	)
+
+	ts := s.AdvanceTime(500 * time.Millisecond)
+	s.FireTimer(3, ts)
+	s.Verify(
+		"timer.fire(): 3",
+		"[info] timer fired",
+	)
+
+	s.publish("/devices/somedev/controls/foo", "q", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [q] (QoS 1, retained)",
+		"[info] running: false, remaining ok: true",
+	)
+
+	s.publish("/devices/somedev/controls/foo", "r", "somedev/foo")
+	s.Verify(
+		"tst -> /devices/somedev/controls/foo: [r] (QoS 1, retained)",
+		"[info] restarted: false",
+	)
+	s.VerifyEmpty()
+}
+
+func (s *RuleTimersSuite) TestDurationSpecs() {
+	s.engine.EvalScript(`
+	  setTimeout(function () {}, "1.5s");
+	  setInterval(function () {}, "1m");
+	  startTimer("specTimer", "1h30m");`)
+	s.Verify(
+		"new fake timer: 1, 1500",
+		"new fake ticker: 2, 60000",
+		"new fake timer: 3, 5400000",
+	)
+	s.engine.EvalScript(`log("{} {} {}", duration("2h"), bytes("2MB"), bytes("4KiB"))`)
+	s.Verify("[info] 7200000 2000000 4096")
+	s.engine.EvalScript(`
+	  try {
+	    setTimeout(function () {}, "5 minutes");
+	  } catch (e) {
+	    log("error: {}", e.message);
+	  }`)
+	s.Verify("[info] error: invalid duration: 5 minutes")
+	s.VerifyEmpty()
+}
+
+func (s *RuleTimersSuite) TestTimerCallbackArgs() {
+	s.engine.EvalScript(`
+	  setTimeout(function (a, b) {
+	    log("timeout: {} {}", a, b);
+	  }, 100, "abc", 42);
+	  var n = 0, id = setInterval(function (obj) {
+	    log("interval: {} {}", obj.value, obj.waitReady);
+	    if (++n == 2)
+	      clearInterval(id);
+	  }, 200, { value: "x", waitReady: true });
+	  setTimeout(function () {});
+	  clearTimeout(null);
+	  clearTimeout(undefined);`)
+	s.Verify(
+		"new fake timer: 1, 100",
+		"new fake ticker: 2, 200",
+		"new fake timer: 3, 1",
+	)
+
+	ts := s.AdvanceTime(100 * time.Millisecond)
+	s.FireTimer(1, ts)
+	s.Verify(
+		"timer.fire(): 1",
+		"[info] timeout: abc 42",
+	)
+
+	for i := 1; i <= 2; i++ {
+		ts = s.AdvanceTime(200 * time.Millisecond)
+		s.FireTimer(2, ts)
+		s.Verify(
+			"timer.fire(): 2",
+			// objects with waitReady are passed as is
+			"[info] interval: x true",
+		)
+	}
+	s.Verify("timer.Stop(): 2")
+	s.VerifyEmpty()
+}
+
 func TestRuleTimersSuite(t *testing.T) {
 	testutils.RunSuites(t,
 		new(RuleTimersSuite),
@@ -0,0 +1,57 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+	"time"
+)
+
+type RuleWaitReadySuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleWaitReadySuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_waitready.js")
+	// remote/temp is incomplete, so the engine waits for it
+	s.Verify("new fake timer: 2, 30000")
+}
+
+func (s *RuleWaitReadySuite) TestReadyWhenCellsComplete() {
+	s.cron.invokeEntries("@hourly")
+	s.VerifyEmpty()
+
+	s.publish("/devices/remote/controls/temp/meta/type", "temperature", "remote/temp")
+	s.publish("/devices/remote/controls/temp", "21", "remote/temp")
+	s.Verify(
+		"tst -> /devices/remote/controls/temp/meta/type: [temperature] (QoS 1, retained)",
+		"tst -> /devices/remote/controls/temp: [21] (QoS 1, retained)",
+		"[info] remote temp: 21",
+		"timer.Stop(): 2",
+		"new fake timer: 1, 1000",
+	)
+
+	s.FireTimer(1, s.AdvanceTime(time.Second))
+	s.Verify(
+		"timer.fire(): 1",
+		`[info] deferred timeout: {"waitReady":true}`,
+	)
+	s.cron.invokeEntries("@hourly")
+	s.Verify("[info] hourly")
+}
+
+func (s *RuleWaitReadySuite) TestReadyTimeout() {
+	s.FireTimer(2, s.AdvanceTime(30*time.Second))
+	s.Verify(
+		"timer.fire(): 2",
+		"[warning] some of the cells used by rules are still incomplete after 30s",
+		"new fake timer: 1, 1000",
+	)
+	s.cron.invokeEntries("@hourly")
+	s.Verify("[info] hourly")
+}
+
+func TestRuleWaitReadySuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleWaitReadySuite),
+	)
+}
@@ -0,0 +1,54 @@
+package wbrules
+
+import (
+	"errors"
+	"github.com/contactless/wbgo/testutils"
+	"testing"
+)
+
+type RuleWriteCellSuite struct {
+	RuleSuiteBase
+}
+
+func (s *RuleWriteCellSuite) SetupTest() {
+	s.SetupSkippingDefs("testrules_writecell.js")
+}
+
+func (s *RuleWriteCellSuite) TestWriteCell() {
+	value, err := s.engine.WriteCell(&CellSpec{"heating", "setpoint"}, "22.5", nil)
+	s.NoError(err)
+	s.Equal(float64(22.5), value)
+	s.Verify(
+		"driver -> /devices/heating/controls/setpoint: [22.5] (QoS 1, retained)",
+		"[info] external write: heating/setpoint = 22.5",
+		"[info] setpoint changed: 22.5",
+	)
+}
+
+func (s *RuleWriteCellSuite) TestWriteCellErrors() {
+	_, err := s.engine.WriteCell(&CellSpec{"heating", "current"}, float64(1), nil)
+	s.Equal(readonlyCellError, err)
+	_, err = s.engine.WriteCell(&CellSpec{"heating", "nosuchcell"}, float64(1), nil)
+	s.Equal(unknownCellError, err)
+	_, err = s.engine.WriteCell(&CellSpec{"heating", "setpoint"}, "hot", nil)
+	s.Error(err)
+	s.VerifyEmpty()
+}
+
+func (s *RuleWriteCellSuite) TestWriteCellCommitError() {
+	commitErr := errors.New("commit failed")
+	var committed interface{}
+	_, err := s.engine.WriteCell(&CellSpec{"heating", "setpoint"}, "22.5", func(value interface{}) error {
+		committed = value
+		return commitErr
+	})
+	s.Equal(commitErr, err)
+	s.Equal(float64(22.5), committed)
+	s.VerifyEmpty()
+}
+
+func TestRuleWriteCellSuite(t *testing.T) {
+	testutils.RunSuites(t,
+		new(RuleWriteCellSuite),
+	)
+}
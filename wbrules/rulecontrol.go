@@ -0,0 +1,216 @@
+package wbrules
+
+import (
+	"errors"
+	"github.com/stretchr/objx"
+	"sort"
+	"time"
+)
+
+var unknownRuleError = errors.New("unknown rule")
+
+// RuleStatus describes a rule defined by the scripts
+type RuleStatus struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Trigger describes the rule condition,
+	// see RuleInfo
+	Trigger string `json:"trigger"`
+}
+
+// RuleFiring describes a single invocation
+// of the then callback of a rule
+type RuleFiring struct {
+	Rule string    `json:"rule"`
+	Time time.Time `json:"time"`
+	// Device and Cell specify the cell that
+	// triggered the rule, if any
+	Device string `json:"device,omitempty"`
+	Cell   string `json:"cell,omitempty"`
+	// DurationMs is the time spent in the then
+	// callback in milliseconds
+	DurationMs float64 `json:"durationMs"`
+	// Error is the first line of the error thrown
+	// by the then callback, if any
+	Error string `json:"error,omitempty"`
+	seq   uint64
+}
+
+type ruleStatusSlice []RuleStatus
+
+func (s ruleStatusSlice) Len() int           { return len(s) }
+func (s ruleStatusSlice) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s ruleStatusSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// RuleStatuses returns the statuses of
+// the rules sorted by rule name
+func (engine *RuleEngine) RuleStatuses() (statuses []RuleStatus) {
+	engine.Call(func() {
+		statuses = make([]RuleStatus, 0, len(engine.ruleMap))
+		for name, rule := range engine.ruleMap {
+			statuses = append(statuses, RuleStatus{
+				Name:    name,
+				Enabled: !rule.disabled,
+				Trigger: describeRuleCond(rule.cond),
+			})
+		}
+	})
+	sort.Sort(ruleStatusSlice(statuses))
+	return
+}
+
+// SetRuleEnabled enables or disables the rule. Disabled rules
+// don't fire. The rule stays disabled when it's redefined,
+// e.g. when the script that defines it is reloaded.
+func (engine *RuleEngine) SetRuleEnabled(name string, enabled bool) (err error) {
+	engine.Call(func() {
+		err = engine.setRuleEnabled(name, enabled)
+	})
+	return
+}
+
+// setRuleEnabled is SetRuleEnabled() for the
+// code that runs on the event loop
+func (engine *RuleEngine) setRuleEnabled(name string, enabled bool) error {
+	rule, found := engine.ruleMap[name]
+	if !found || rule.destroyed {
+		return unknownRuleError
+	}
+	rule.disabled = !enabled
+	if enabled {
+		delete(engine.disabledRules, name)
+		engine.Logf(ENGINE_LOG_INFO, "rule %s enabled", name)
+	} else {
+		engine.disabledRules[name] = true
+		engine.Logf(ENGINE_LOG_INFO, "rule %s disabled", name)
+	}
+	return nil
+}
+
+// RunRule invokes the then callback of the rule without
+// checking its condition. The arguments of the callback are
+// synthesized from the current value of the first cell of the
+// condition, see ruleArgs(). Disabled rules are run, too, as
+// disabling only stops the rule from firing by itself.
+// Must be called on the event loop.
+func (engine *RuleEngine) RunRule(name string) error {
+	rule, found := engine.ruleMap[name]
+	if !found || rule.destroyed || rule.then == nil {
+		return unknownRuleError
+	}
+	engine.runDepth++
+	defer engine.endRulePass()
+	engine.withRuleContext(rule, func() {
+		rule.invokeThen(engine.ruleArgs(rule))
+	})
+	return nil
+}
+
+// ruleArgs returns the arguments of the then callback of the
+// rule as if it's triggered by the first complete cell of its
+// condition. nil is returned if there's no such cell.
+func (engine *RuleEngine) ruleArgs(rule *Rule) objx.Map {
+	for _, cellSpec := range rule.cond.GetCells() {
+		cell := engine.model.LookupCell(cellSpec)
+		if cell == nil || !cell.IsComplete() {
+			continue
+		}
+		return objx.Map{
+			"device":   cell.devNameArg,
+			"cell":     cell.nameArg,
+			"newValue": cell.Value(),
+		}
+	}
+	return nil
+}
+
+// CheckRule evaluates the condition of the rule right away,
+// as if the cells of the condition have changed, and fires
+// the rule if the condition is met. It returns true if the
+// then callback was invoked. Must be called on the event loop.
+func (engine *RuleEngine) CheckRule(name string) (bool, error) {
+	rule, found := engine.ruleMap[name]
+	if !found || rule.destroyed {
+		return false, unknownRuleError
+	}
+	engine.runDepth++
+	defer engine.endRulePass()
+	fireCount := rule.fireCount
+	engine.withRuleContext(rule, func() {
+		cellSpecs := rule.cond.GetCells()
+		if len(cellSpecs) == 0 {
+			rule.Check(nil)
+			return
+		}
+		for _, cellSpec := range cellSpecs {
+			if cell := engine.model.LookupCell(cellSpec); cell != nil {
+				rule.ShouldCheck()
+				rule.Check(cell)
+			}
+		}
+	})
+	return rule.fireCount != fireCount, nil
+}
+
+// withRuleContext runs f with the profile of the script
+// that defined the rule, as if it's run by the rule
+func (engine *RuleEngine) withRuleContext(rule *Rule, f func()) {
+	savedProfile := engine.currentProfile
+	defer func() {
+		engine.currentProfile = savedProfile
+	}()
+	run := func() {
+		engine.withCurrentRule(rule.name, f)
+	}
+	if rule.profile == nil {
+		engine.currentProfile = nil
+		run()
+	} else {
+		engine.withProfile(rule.profile, "rule "+rule.name, run)
+	}
+}
+
+// DestroyRule removes the rule. When it's called during a
+// rule pass, e.g. by the then callback of the rule itself,
+// the rule stops firing right away, but it's removed from
+// the rule list when the pass completes. Must be called
+// on the event loop.
+func (engine *RuleEngine) DestroyRule(name string) error {
+	rule, found := engine.ruleMap[name]
+	if !found || rule.destroyed {
+		return unknownRuleError
+	}
+	nonCellRule := rule.nonCellRule
+	rule.Destroy()
+	engine.clearRuleError(name)
+	if engine.runDepth > 0 {
+		engine.destroyedRules = append(engine.destroyedRules, rule)
+	} else {
+		engine.removeDestroyedRule(rule)
+	}
+	if nonCellRule {
+		// drop the cron entries and MQTT subscriptions
+		engine.setupCron()
+	}
+	engine.Logf(ENGINE_LOG_INFO, "rule %s destroyed", name)
+	return nil
+}
+
+func (engine *RuleEngine) removeDestroyedRule(rule *Rule) {
+	engine.removeRuleDeps(rule)
+	if engine.ruleMap[rule.name] != rule {
+		// redefined after being destroyed
+		return
+	}
+	delete(engine.ruleMap, rule.name)
+	engine.removeFromRuleList(rule.name)
+}
+
+// removeDestroyedRules removes the rules destroyed
+// during the rule pass that has just completed
+func (engine *RuleEngine) removeDestroyedRules() {
+	for _, rule := range engine.destroyedRules {
+		engine.removeDestroyedRule(rule)
+	}
+	engine.destroyedRules = nil
+}
@@ -0,0 +1,336 @@
+package wbrules
+
+import (
+	"bytes"
+	"fmt"
+	wbgo "github.com/contactless/wbgo"
+	"os"
+	"sort"
+	"strings"
+)
+
+const RULE_DIFF_PROFILE_NAME = "rule diff"
+
+// RuleInfo describes a rule of a rule set
+type RuleInfo struct {
+	Name string `json:"name"`
+	// Trigger describes the rule condition, e.g.
+	// "whenChanged: dev/cell" or "cron: @hourly"
+	Trigger string `json:"trigger"`
+	// Deps lists the cells and timers the rule
+	// condition depends on
+	Deps []string `json:"deps"`
+}
+
+// DeviceInfo describes a virtual device defined by a rule set
+type DeviceInfo struct {
+	Name string `json:"name"`
+	// Cells lists the cells of the device as "name (type)"
+	Cells []string `json:"cells"`
+}
+
+// RuleSet describes the rules and virtual devices
+// defined by a scripts tree
+type RuleSet struct {
+	Rules   map[string]*RuleInfo   `json:"rules"`
+	Devices map[string]*DeviceInfo `json:"devices"`
+	// Errors lists script loading errors
+	Errors []string `json:"errors"`
+}
+
+// RuleChange describes the changes of a rule
+// present in both rule sets
+type RuleChange struct {
+	Old *RuleInfo `json:"old"`
+	New *RuleInfo `json:"new"`
+}
+
+// RuleSetDiff describes the differences between two rule sets
+type RuleSetDiff struct {
+	AddedRules     []string      `json:"addedRules"`
+	RemovedRules   []string      `json:"removedRules"`
+	ChangedRules   []*RuleChange `json:"changedRules"`
+	AddedDevices   []string      `json:"addedDevices"`
+	RemovedDevices []string      `json:"removedDevices"`
+	ChangedDevices []string      `json:"changedDevices"`
+	// Errors lists script loading errors of both rule sets
+	Errors []string `json:"errors"`
+}
+
+type ruleChangeSlice []*RuleChange
+
+func (s ruleChangeSlice) Len() int           { return len(s) }
+func (s ruleChangeSlice) Less(i, j int) bool { return s[i].Old.Name < s[j].Old.Name }
+func (s ruleChangeSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// sandboxObserver makes it possible to load scripts into
+// an engine that's not connected to MQTT broker. The model
+// never becomes ready, so timers are never started.
+type sandboxObserver struct{}
+
+func (obs *sandboxObserver) OnNewDevice(dev wbgo.DeviceModel) {
+	dev.Observe(obs)
+}
+
+func (obs *sandboxObserver) RemoveDevice(dev wbgo.DeviceModel) {}
+
+func (obs *sandboxObserver) CallSync(thunk func()) {
+	thunk()
+}
+
+func (obs *sandboxObserver) WhenReady(thunk func()) {}
+
+func (obs *sandboxObserver) OnNewControl(dev wbgo.LocalDeviceModel, name, paramType, value string, readOnly bool, max float64, retain bool) string {
+	return value
+}
+
+func (obs *sandboxObserver) OnValue(dev wbgo.DeviceModel, name, value string) {}
+
+// nullMQTTClient discards all of the messages published
+// by the sandbox engine
+type nullMQTTClient struct{}
+
+func (client nullMQTTClient) WaitForReady() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+func (client nullMQTTClient) Start()                                                       {}
+func (client nullMQTTClient) Stop()                                                        {}
+func (client nullMQTTClient) Publish(message wbgo.MQTTMessage)                             {}
+func (client nullMQTTClient) Subscribe(callback wbgo.MQTTMessageHandler, topics ...string) {}
+func (client nullMQTTClient) Unsubscribe(topics ...string)                                 {}
+
+func describeRuleCond(cond RuleCondition) string {
+	switch c := cond.(type) {
+	case *LevelTriggeredRuleCondition:
+		return "when"
+	case *EdgeTriggeredRuleCondition:
+		return "asSoonAs"
+	case *CellChangedRuleCondition:
+		return "whenChanged: " + c.cellSpec.DevName + "/" + c.cellSpec.CellName
+	case *FuncValueChangedRuleCondition:
+		return "whenChanged: <function>"
+	case *CronRuleCondition:
+		return "cron: " + c.spec
+	case *OrRuleCondition:
+		items := make([]string, len(c.conds))
+		for i, item := range c.conds {
+			items[i] = strings.TrimPrefix(describeRuleCond(item), "whenChanged: ")
+		}
+		return "whenChanged: [" + strings.Join(items, ", ") + "]"
+	default:
+		return fmt.Sprintf("%T", cond)
+	}
+}
+
+// LoadRuleSet loads the scripts from the specified file or
+// directory into a sandbox engine that isn't connected to
+// MQTT broker and describes the resulting rule set. The
+// scripts are loaded under restricted profile, so they
+// can't spawn processes. Rule conditions are evaluated
+// once to find out their dependencies, but the rules
+// aren't run.
+func LoadRuleSet(root string) (*RuleSet, error) {
+	paths, err := findScripts(root)
+	if err != nil {
+		return nil, err
+	}
+
+	model := NewCellModel()
+	model.Observe(&sandboxObserver{})
+	if err = model.Start(); err != nil {
+		return nil, err
+	}
+	engine, err := NewESEngine(model, nullMQTTClient{})
+	if err != nil {
+		return nil, err
+	}
+	profile := NewRestrictedProfile(RULE_DIFF_PROFILE_NAME)
+	profile.AllowFileAccess = true
+	profile.AllowPublish = true
+	profile.MaxCallbackTime = 0
+	if err = engine.AddRestrictedDir(root, profile); err != nil {
+		return nil, err
+	}
+
+	ruleSet := &RuleSet{
+		Rules:   make(map[string]*RuleInfo),
+		Devices: make(map[string]*DeviceInfo),
+		Errors:  []string{},
+	}
+	for _, path := range paths {
+		if err := engine.LoadFile(path); err != nil {
+			ruleSet.Errors = append(ruleSet.Errors, fmt.Sprintf("%s: %s", path, err))
+		}
+	}
+
+	for _, rule := range engine.ruleMap {
+		// conditions are evaluated to track the deps,
+		// but the rules must not fire
+		rule.suppressed = true
+	}
+	engine.RunRules(nil, NO_TIMER_NAME)
+
+	for name, rule := range engine.ruleMap {
+		info := &RuleInfo{
+			Name:    name,
+			Trigger: describeRuleCond(rule.cond),
+			Deps:    []string{},
+		}
+		for _, cell := range engine.ruleCells[rule] {
+			info.Deps = append(info.Deps, cell.DevName()+"/"+cell.Name())
+		}
+		for timerName, rules := range engine.timerRules {
+			for _, r := range rules {
+				if r == rule {
+					info.Deps = append(info.Deps, "timers."+timerName)
+				}
+			}
+		}
+		sort.Strings(info.Deps)
+		ruleSet.Rules[name] = info
+	}
+
+	for name, dev := range model.devices {
+		if _, ok := dev.(*CellModelLocalDevice); !ok || name == engine.settingsDevName() {
+			continue
+		}
+		info := &DeviceInfo{Name: name, Cells: []string{}}
+		for _, cell := range dev.sortedCells() {
+			info.Cells = append(info.Cells, fmt.Sprintf("%s (%s)", cell.Name(), cell.Type()))
+		}
+		ruleSet.Devices[name] = info
+	}
+	return ruleSet, nil
+}
+
+// findScripts returns the scripts in the specified file or
+// directory in their load order, see orderScripts(). The files
+// are found the same way as ScriptWatcher does.
+func findScripts(root string) ([]string, error) {
+	var paths []string
+	err := walkScripts(root, scriptFilePattern, func(path string, info os.FileInfo) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orderScripts(paths), nil
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff compares the rule set with the new version of it
+func (ruleSet *RuleSet) Diff(newRuleSet *RuleSet) *RuleSetDiff {
+	diff := &RuleSetDiff{
+		AddedRules:     []string{},
+		RemovedRules:   []string{},
+		ChangedRules:   []*RuleChange{},
+		AddedDevices:   []string{},
+		RemovedDevices: []string{},
+		ChangedDevices: []string{},
+		Errors:         append(append([]string{}, ruleSet.Errors...), newRuleSet.Errors...),
+	}
+	for name, oldRule := range ruleSet.Rules {
+		newRule, found := newRuleSet.Rules[name]
+		switch {
+		case !found:
+			diff.RemovedRules = append(diff.RemovedRules, name)
+		case oldRule.Trigger != newRule.Trigger || !stringSlicesEqual(oldRule.Deps, newRule.Deps):
+			diff.ChangedRules = append(diff.ChangedRules, &RuleChange{oldRule, newRule})
+		}
+	}
+	for name := range newRuleSet.Rules {
+		if _, found := ruleSet.Rules[name]; !found {
+			diff.AddedRules = append(diff.AddedRules, name)
+		}
+	}
+	for name, oldDev := range ruleSet.Devices {
+		newDev, found := newRuleSet.Devices[name]
+		switch {
+		case !found:
+			diff.RemovedDevices = append(diff.RemovedDevices, name)
+		case !stringSlicesEqual(oldDev.Cells, newDev.Cells):
+			diff.ChangedDevices = append(diff.ChangedDevices, name)
+		}
+	}
+	for name := range newRuleSet.Devices {
+		if _, found := ruleSet.Devices[name]; !found {
+			diff.AddedDevices = append(diff.AddedDevices, name)
+		}
+	}
+	sort.Strings(diff.AddedRules)
+	sort.Strings(diff.RemovedRules)
+	sort.Sort(ruleChangeSlice(diff.ChangedRules))
+	sort.Strings(diff.AddedDevices)
+	sort.Strings(diff.RemovedDevices)
+	sort.Strings(diff.ChangedDevices)
+	return diff
+}
+
+// Empty returns true if the rule sets are the same
+func (diff *RuleSetDiff) Empty() bool {
+	return len(diff.AddedRules) == 0 && len(diff.RemovedRules) == 0 &&
+		len(diff.ChangedRules) == 0 && len(diff.AddedDevices) == 0 &&
+		len(diff.RemovedDevices) == 0 && len(diff.ChangedDevices) == 0
+}
+
+func (diff *RuleSetDiff) String() string {
+	var buf bytes.Buffer
+	for _, err := range diff.Errors {
+		fmt.Fprintf(&buf, "! %s\n", err)
+	}
+	for _, name := range diff.AddedRules {
+		fmt.Fprintf(&buf, "+ rule %s\n", name)
+	}
+	for _, name := range diff.RemovedRules {
+		fmt.Fprintf(&buf, "- rule %s\n", name)
+	}
+	for _, change := range diff.ChangedRules {
+		fmt.Fprintf(&buf, "~ rule %s\n", change.Old.Name)
+		if change.Old.Trigger != change.New.Trigger {
+			fmt.Fprintf(&buf, "    trigger: %s -> %s\n", change.Old.Trigger, change.New.Trigger)
+		}
+		if !stringSlicesEqual(change.Old.Deps, change.New.Deps) {
+			fmt.Fprintf(&buf, "    deps: [%s] -> [%s]\n",
+				strings.Join(change.Old.Deps, ", "), strings.Join(change.New.Deps, ", "))
+		}
+	}
+	for _, name := range diff.AddedDevices {
+		fmt.Fprintf(&buf, "+ device %s\n", name)
+	}
+	for _, name := range diff.RemovedDevices {
+		fmt.Fprintf(&buf, "- device %s\n", name)
+	}
+	for _, name := range diff.ChangedDevices {
+		fmt.Fprintf(&buf, "~ device %s\n", name)
+	}
+	return buf.String()
+}
+
+// DiffRuleSets loads two versions of a scripts tree
+// and compares the resulting rule sets
+func DiffRuleSets(oldRoot, newRoot string) (*RuleSetDiff, error) {
+	oldRuleSet, err := LoadRuleSet(oldRoot)
+	if err != nil {
+		return nil, err
+	}
+	newRuleSet, err := LoadRuleSet(newRoot)
+	if err != nil {
+		return nil, err
+	}
+	return oldRuleSet.Diff(newRuleSet), nil
+}
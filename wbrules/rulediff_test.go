@@ -0,0 +1,114 @@
+package wbrules
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	ruleDiffOldScript = `
+defineVirtualDevice("thermo", {
+  cells: {
+    setpoint: { type: "value", value: 20 }
+  }
+});
+
+defineRule("heat", {
+  when: function () {
+    return dev["thermo/setpoint"] > dev["sensor/temp"];
+  },
+  then: function () {}
+});
+
+defineRule("logTemp", {
+  whenChanged: "sensor/temp",
+  then: function () {}
+});
+
+defineRule("hourly", {
+  when: cron("@hourly"),
+  then: function () {}
+});
+`
+	ruleDiffNewScript = `
+defineVirtualDevice("thermo", {
+  cells: {
+    setpoint: { type: "value", value: 20 },
+    hysteresis: { type: "value", value: 1 }
+  }
+});
+
+defineVirtualDevice("extra", {
+  cells: {
+    enabled: { type: "switch", value: false }
+  }
+});
+
+defineRule("heat", {
+  when: function () {
+    return dev["thermo/setpoint"] - dev["thermo/hysteresis"] > dev["sensor/temp"];
+  },
+  then: function () {}
+});
+
+defineRule("logTemp", {
+  whenChanged: "sensor/humidity",
+  then: function () {}
+});
+
+defineRule("extraRule", {
+  whenChanged: "extra/enabled",
+  then: function () {}
+});
+`
+)
+
+func writeRuleDiffScript(t *testing.T, dir, name, content string) string {
+	root := filepath.Join(dir, name)
+	if err := os.MkdirAll(root, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "rules.js"), []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestRuleSetDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wbrules-diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldRoot := writeRuleDiffScript(t, dir, "old", ruleDiffOldScript)
+	newRoot := writeRuleDiffScript(t, dir, "new", ruleDiffNewScript)
+
+	diff, err := DiffRuleSets(oldRoot, newRoot)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, diff.Errors)
+	assert.Equal(t, []string{"extraRule"}, diff.AddedRules)
+	assert.Equal(t, []string{"hourly"}, diff.RemovedRules)
+	assert.Equal(t, []string{"extra"}, diff.AddedDevices)
+	assert.Empty(t, diff.RemovedDevices)
+	assert.Equal(t, []string{"thermo"}, diff.ChangedDevices)
+	if assert.Len(t, diff.ChangedRules, 2) {
+		heat := diff.ChangedRules[0]
+		assert.Equal(t, "heat", heat.Old.Name)
+		assert.Equal(t, "when", heat.New.Trigger)
+		assert.Equal(t, []string{"sensor/temp", "thermo/setpoint"}, heat.Old.Deps)
+		assert.Equal(t, []string{"sensor/temp", "thermo/hysteresis", "thermo/setpoint"}, heat.New.Deps)
+		logTemp := diff.ChangedRules[1]
+		assert.Equal(t, "whenChanged: sensor/temp", logTemp.Old.Trigger)
+		assert.Equal(t, "whenChanged: sensor/humidity", logTemp.New.Trigger)
+	}
+
+	diff, err = DiffRuleSets(oldRoot, oldRoot)
+	if assert.NoError(t, err) {
+		assert.True(t, diff.Empty())
+	}
+}
@@ -0,0 +1,110 @@
+package wbrules
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	RULE_ERRORS_CELL_NAME = "Errors"
+	RULE_ERRORS_SUBTOPIC  = "errors"
+)
+
+// RuleError describes the last error thrown by the condition
+// or then callback of a rule
+type RuleError struct {
+	Rule    string    `json:"rule"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	// Count is the number of errors since
+	// the rule was defined
+	Count int `json:"count"`
+}
+
+type ruleErrorSlice []RuleError
+
+func (s ruleErrorSlice) Len() int           { return len(s) }
+func (s ruleErrorSlice) Less(i, j int) bool { return s[i].Rule < s[j].Rule }
+func (s ruleErrorSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+var ruleTopicReplacer = strings.NewReplacer("+", "_", "#", "_")
+
+// ruleErrorTopic returns the retained topic
+// used to publish the errors of the rule
+func (engine *RuleEngine) ruleErrorTopic(name string) string {
+	return engine.topic(RULE_ERRORS_SUBTOPIC + "/" + ruleTopicReplacer.Replace(name))
+}
+
+// withCurrentRule runs the thunk with the rule marked as
+// the current one, so that errors thrown by its callbacks
+// are attributed to it
+func (engine *RuleEngine) withCurrentRule(name string, thunk func()) {
+	savedRule := engine.currentRule
+	engine.currentRule = name
+	defer func() {
+		engine.currentRule = savedRule
+	}()
+	thunk()
+}
+
+// recordRuleError records the error thrown by a callback of
+// the current rule, publishes it to the rule's error topic
+// and sets the Errors cell of the engine settings device.
+// Errors thrown outside of rules are ignored.
+func (engine *RuleEngine) recordRuleError(message string) {
+	name := engine.currentRule
+	if name == "" {
+		return
+	}
+	engine.recordFiringError(name, message)
+	engine.ruleErrorsMtx.Lock()
+	ruleErr := engine.ruleErrors[name]
+	ruleErr.Rule = name
+	ruleErr.Message = message
+	ruleErr.Time = time.Now()
+	ruleErr.Count++
+	engine.ruleErrors[name] = ruleErr
+	engine.ruleErrorsMtx.Unlock()
+
+	if payload, err := json.Marshal(ruleErr); err == nil {
+		engine.Publish(engine.ruleErrorTopic(name), string(payload), 1, true)
+	}
+	// the cell is created upon the first error
+	// so the settings device isn't cluttered
+	value := name + ": " + strings.SplitN(message, "\n", 2)[0]
+	if dev, ok := engine.model.devices[engine.settingsDevName()].(*CellModelLocalDevice); ok {
+		if cell, found := dev.LookupCell(RULE_ERRORS_CELL_NAME); found {
+			cell.SetValue(value)
+		} else {
+			dev.SetCell(RULE_ERRORS_CELL_NAME, "text", value, true)
+		}
+	}
+}
+
+// clearRuleError removes the error record of the rule,
+// e.g. when the rule is redefined or its script is
+// reloaded or removed
+func (engine *RuleEngine) clearRuleError(name string) {
+	engine.ruleErrorsMtx.Lock()
+	_, found := engine.ruleErrors[name]
+	delete(engine.ruleErrors, name)
+	engine.ruleErrorsMtx.Unlock()
+	if found {
+		engine.Publish(engine.ruleErrorTopic(name), "", 1, true)
+	}
+}
+
+// GetRuleErrors returns the last errors of the rules
+// sorted by rule name
+func (engine *RuleEngine) GetRuleErrors() []RuleError {
+	engine.ruleErrorsMtx.Lock()
+	defer engine.ruleErrorsMtx.Unlock()
+	r := make([]RuleError, 0, len(engine.ruleErrors))
+	for _, ruleErr := range engine.ruleErrors {
+		r = append(r, ruleErr)
+	}
+	sort.Sort(ruleErrorSlice(r))
+	return r
+}
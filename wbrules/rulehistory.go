@@ -0,0 +1,220 @@
+package wbrules
+
+import (
+	"github.com/stretchr/objx"
+	"strings"
+	"time"
+)
+
+const (
+	// DEFAULT_RULE_HISTORY_SIZE is the default number
+	// of the most recent rule firings that are kept
+	DEFAULT_RULE_HISTORY_SIZE = 100
+)
+
+// firingRing is a fixed size ring buffer of rule firings.
+// Firing sequence numbers start from 1, so the slot of
+// a firing can be found by its sequence number.
+type firingRing struct {
+	firings []RuleFiring
+	lastSeq uint64
+}
+
+func newFiringRing(size int) *firingRing {
+	if size < 1 {
+		size = 1
+	}
+	return &firingRing{firings: make([]RuleFiring, size)}
+}
+
+func (ring *firingRing) add(firing RuleFiring) *RuleFiring {
+	ring.lastSeq++
+	firing.seq = ring.lastSeq
+	slot := &ring.firings[(firing.seq-1)%uint64(len(ring.firings))]
+	*slot = firing
+	return slot
+}
+
+// lookup returns the firing with the specified sequence
+// number or nil if it's already overwritten
+func (ring *firingRing) lookup(seq uint64) *RuleFiring {
+	if seq == 0 {
+		return nil
+	}
+	slot := &ring.firings[(seq-1)%uint64(len(ring.firings))]
+	if slot.seq != seq {
+		return nil
+	}
+	return slot
+}
+
+// each invokes the function for the firings, the oldest first
+func (ring *firingRing) each(thunk func(firing *RuleFiring)) {
+	size := uint64(len(ring.firings))
+	first := uint64(1)
+	if ring.lastSeq > size {
+		first = ring.lastSeq - size + 1
+	}
+	for seq := first; seq <= ring.lastSeq; seq++ {
+		thunk(&ring.firings[(seq-1)%size])
+	}
+}
+
+// SetRuleHistorySize sets the number of the most recent
+// rule firings kept by the engine. The firings recorded
+// so far are discarded.
+func (engine *RuleEngine) SetRuleHistorySize(size int) {
+	engine.ruleHistory = newFiringRing(size)
+}
+
+func (engine *RuleEngine) recordRuleFiring(rule *Rule, args objx.Map) uint64 {
+	// this is the hot path, so the firings are
+	// recorded without allocations
+	rule.fireCount++
+	engine.ruleFirings++
+	firing := RuleFiring{Rule: rule.name, Time: time.Now()}
+	if args != nil {
+		firing.Device, _ = args["device"].(string)
+		firing.Cell, _ = args["cell"].(string)
+	}
+	slot := engine.ruleHistory.add(firing)
+	if len(engine.debugSessions) > 0 {
+		engine.traceRuleFiring(rule, slot)
+	}
+	return slot.seq
+}
+
+func (engine *RuleEngine) finishRuleFiring(rule *Rule, elapsed time.Duration) {
+	if firing := engine.ruleHistory.lookup(rule.firingSeq); firing != nil {
+		firing.DurationMs = durationMs(elapsed)
+	}
+	if rule.timings != nil {
+		engine.recordRuleTiming(rule, "then callback", &rule.timings.then, elapsed)
+	}
+}
+
+// recordFiringError attaches the error to the current
+// firing of the rule if its then callback is running
+func (engine *RuleEngine) recordFiringError(name, message string) {
+	rule, found := engine.ruleMap[name]
+	if !found {
+		return
+	}
+	if firing := engine.ruleHistory.lookup(rule.firingSeq); firing != nil && firing.Error == "" {
+		firing.Error = strings.SplitN(message, "\n", 2)[0]
+	}
+}
+
+// RuleHistoryFilter selects the rule firings
+// returned by GetRuleHistory()
+type RuleHistoryFilter struct {
+	// Rule, Device and Cell are matched
+	// exactly unless they're empty
+	Rule   string
+	Device string
+	Cell   string
+	// Since excludes the firings that
+	// happened before the specified time
+	Since time.Time
+	// Limit is the max number of the most recent
+	// firings to return, 0 means no limit
+	Limit int
+}
+
+func (filter *RuleHistoryFilter) matches(firing *RuleFiring) bool {
+	return (filter.Rule == "" || firing.Rule == filter.Rule) &&
+		(filter.Device == "" || firing.Device == filter.Device) &&
+		(filter.Cell == "" || firing.Cell == filter.Cell) &&
+		!firing.Time.Before(filter.Since)
+}
+
+// GetRuleHistory returns the recent rule firings
+// matching the filter, the oldest first
+func (engine *RuleEngine) GetRuleHistory(filter RuleHistoryFilter) (firings []RuleFiring) {
+	engine.Call(func() {
+		firings = make([]RuleFiring, 0)
+		engine.ruleHistory.each(func(firing *RuleFiring) {
+			if filter.matches(firing) {
+				firings = append(firings, *firing)
+			}
+		})
+	})
+	if filter.Limit > 0 && len(firings) > filter.Limit {
+		firings = firings[len(firings)-filter.Limit:]
+	}
+	return
+}
+
+// RecentRuleFirings returns all the rule firings
+// kept by the engine, the oldest first
+func (engine *RuleEngine) RecentRuleFirings() []RuleFiring {
+	return engine.GetRuleHistory(RuleHistoryFilter{})
+}
+
+// RuleHistorySource provides the recent rule firings
+type RuleHistorySource interface {
+	GetRuleHistory(filter RuleHistoryFilter) []RuleFiring
+}
+
+// RuleHistory is an RPC service that provides the recent
+// rule firings, so that it's possible to find out why
+// and when the rules fired without enabling debugging.
+type RuleHistory struct {
+	source RuleHistorySource
+}
+
+type RuleHistoryError struct {
+	code    int32
+	message string
+}
+
+func (err *RuleHistoryError) Error() string {
+	return err.message
+}
+
+func (err *RuleHistoryError) ErrorCode() int32 {
+	return err.code
+}
+
+const (
+	// no iota here because these values may be used
+	// by external software
+	RULE_HISTORY_ERROR_INVALID_ARGS = 1500
+)
+
+func NewRuleHistory(source RuleHistorySource) *RuleHistory {
+	return &RuleHistory{source}
+}
+
+type RuleHistoryGetArgs struct {
+	Rule   string `json:"rule"`
+	Device string `json:"device"`
+	Cell   string `json:"cell"`
+	// Since is RFC 3339 time, e.g. "2016-01-02T15:04:05Z"
+	Since string `json:"since"`
+	Limit int    `json:"limit"`
+}
+
+type RuleHistoryGetResponse struct {
+	Firings []RuleFiring `json:"firings"`
+}
+
+func (history *RuleHistory) Get(args *RuleHistoryGetArgs, reply *RuleHistoryGetResponse) error {
+	filter := RuleHistoryFilter{
+		Rule:   args.Rule,
+		Device: args.Device,
+		Cell:   args.Cell,
+		Limit:  args.Limit,
+	}
+	if args.Limit < 0 {
+		return &RuleHistoryError{RULE_HISTORY_ERROR_INVALID_ARGS, "invalid limit"}
+	}
+	if args.Since != "" {
+		var err error
+		if filter.Since, err = time.Parse(time.RFC3339, args.Since); err != nil {
+			return &RuleHistoryError{RULE_HISTORY_ERROR_INVALID_ARGS, "invalid since time: " + err.Error()}
+		}
+	}
+	reply.Firings = history.source.GetRuleHistory(filter)
+	return nil
+}
@@ -0,0 +1,138 @@
+package wbrules
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// RULE_TIMING_SAMPLES is the number of the most recent
+	// execution times of each rule callback used to
+	// calculate the percentiles
+	RULE_TIMING_SAMPLES = 128
+	// DEFAULT_SLOW_RULE_THRESHOLD is the default execution
+	// time of a rule callback that causes a warning
+	DEFAULT_SLOW_RULE_THRESHOLD = 100 * time.Millisecond
+)
+
+// durationSamples accumulates the execution times
+// of a rule callback without allocations
+type durationSamples struct {
+	count   uint64
+	total   time.Duration
+	max     time.Duration
+	samples [RULE_TIMING_SAMPLES]time.Duration
+}
+
+func (s *durationSamples) add(d time.Duration) {
+	s.samples[s.count%RULE_TIMING_SAMPLES] = d
+	s.count++
+	s.total += d
+	if d > s.max {
+		s.max = d
+	}
+}
+
+func (s *durationSamples) stats() RuleDurationStats {
+	n := s.count
+	if n > RULE_TIMING_SAMPLES {
+		n = RULE_TIMING_SAMPLES
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, s.samples[:n])
+	sort.Sort(durationSlice(sorted))
+	return RuleDurationStats{
+		Count:   s.count,
+		TotalMs: durationMs(s.total),
+		MaxMs:   durationMs(s.max),
+		P50Ms:   durationMs(percentile(sorted, 0.5)),
+		P90Ms:   durationMs(percentile(sorted, 0.9)),
+		P99Ms:   durationMs(percentile(sorted, 0.99)),
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// ruleTimings holds the execution times of
+// the condition and then callback of a rule
+type ruleTimings struct {
+	cond durationSamples
+	then durationSamples
+}
+
+// RuleDurationStats describes the execution times of a rule
+// callback. The percentiles are calculated using the
+// RULE_TIMING_SAMPLES most recent invocations.
+type RuleDurationStats struct {
+	Count   uint64  `json:"count"`
+	TotalMs float64 `json:"totalMs"`
+	MaxMs   float64 `json:"maxMs"`
+	P50Ms   float64 `json:"p50Ms"`
+	P90Ms   float64 `json:"p90Ms"`
+	P99Ms   float64 `json:"p99Ms"`
+}
+
+// RuleMetrics describes the execution times of the condition
+// and then callback of a rule since the rule was first defined.
+// The time spent in the then callback includes the rules
+// run by it using runRules(), if any.
+type RuleMetrics struct {
+	Rule      string            `json:"rule"`
+	Condition RuleDurationStats `json:"condition"`
+	Then      RuleDurationStats `json:"then"`
+}
+
+type ruleMetricsSlice []RuleMetrics
+
+func (s ruleMetricsSlice) Len() int           { return len(s) }
+func (s ruleMetricsSlice) Less(i, j int) bool { return s[i].Rule < s[j].Rule }
+func (s ruleMetricsSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// SetSlowRuleThreshold makes the engine log a warning each time
+// a condition or then callback of a rule runs longer than
+// the specified time. Zero threshold disables the warnings.
+func (engine *RuleEngine) SetSlowRuleThreshold(threshold time.Duration) {
+	engine.slowRuleThreshold = threshold
+}
+
+func (engine *RuleEngine) recordRuleTiming(rule *Rule, what string, samples *durationSamples, elapsed time.Duration) {
+	samples.add(elapsed)
+	if engine.slowRuleThreshold > 0 && elapsed > engine.slowRuleThreshold {
+		engine.Logf(ENGINE_LOG_WARNING, "rule %s: %s took %s (slow rule threshold %s)",
+			rule.name, what, elapsed, engine.slowRuleThreshold)
+	}
+}
+
+func (engine *RuleEngine) recordCondTiming(rule *Rule, elapsed time.Duration) {
+	engine.ruleChecks++
+	if rule.timings != nil {
+		engine.recordRuleTiming(rule, "condition", &rule.timings.cond, elapsed)
+	}
+}
+
+// RuleMetrics returns the execution time metrics
+// of the rules sorted by rule name
+func (engine *RuleEngine) RuleMetrics() (metrics []RuleMetrics) {
+	engine.Call(func() {
+		metrics = engine.collectRuleMetrics()
+	})
+	return
+}
+
+func (engine *RuleEngine) collectRuleMetrics() []RuleMetrics {
+	metrics := make([]RuleMetrics, 0, len(engine.ruleMap))
+	for name, rule := range engine.ruleMap {
+		if rule.timings == nil {
+			continue
+		}
+		metrics = append(metrics, RuleMetrics{
+			Rule:      name,
+			Condition: rule.timings.cond.stats(),
+			Then:      rule.timings.then.stats(),
+		})
+	}
+	sort.Sort(ruleMetricsSlice(metrics))
+	return metrics
+}
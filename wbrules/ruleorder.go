@@ -0,0 +1,54 @@
+package wbrules
+
+import (
+	"github.com/ivan4th/go-duktape"
+	"sort"
+)
+
+// ruleListIndex returns the index at which the rule must be
+// inserted into ruleList. ruleList is kept sorted by rule
+// priority (highest first) and then by definition order,
+// so RunRules evaluates the rules in a deterministic order
+// that doesn't depend on the order of script loading.
+func (engine *RuleEngine) ruleListIndex(rule *Rule) int {
+	return sort.Search(len(engine.ruleList), func(i int) bool {
+		other := engine.ruleMap[engine.ruleList[i]]
+		return other.priority < rule.priority ||
+			other.priority == rule.priority && other.seq > rule.seq
+	})
+}
+
+func (engine *RuleEngine) insertIntoRuleList(rule *Rule) {
+	i := engine.ruleListIndex(rule)
+	engine.ruleList = append(engine.ruleList, "")
+	copy(engine.ruleList[i+1:], engine.ruleList[i:])
+	engine.ruleList[i] = rule.name
+}
+
+func (engine *RuleEngine) removeFromRuleList(name string) {
+	for i, curName := range engine.ruleList {
+		if curName == name {
+			engine.ruleList = append(
+				engine.ruleList[0:i],
+				engine.ruleList[i+1:]...)
+			break
+		}
+	}
+}
+
+// RuleOrder returns the names of the rules in the order
+// they're evaluated by the engine
+func (engine *RuleEngine) RuleOrder() (names []string) {
+	engine.Call(func() {
+		names = append([]string{}, engine.ruleList...)
+	})
+	return
+}
+
+func (engine *ESEngine) esGetRuleOrder() int {
+	if engine.ctx.GetTop() != 0 {
+		return duktape.DUK_RET_ERROR
+	}
+	engine.ctx.PushJSObject(engine.ruleList)
+	return 1
+}
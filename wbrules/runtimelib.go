@@ -0,0 +1,89 @@
+package wbrules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// libDir is the runtime library directory specified by
+	// the user. It's searched before the default locations.
+	libDir string
+	// libChecksum is the expected SHA-256 of lib.js (hex)
+	libChecksum string
+)
+
+// LibError describes a failure to load the runtime library
+type LibError struct {
+	// Path is the path of lib.js that failed to load,
+	// empty if lib.js wasn't found
+	Path string
+	// SearchDirs lists the directories searched for lib.js
+	SearchDirs []string
+	Err        error
+}
+
+func (err *LibError) Error() string {
+	if err.Path == "" {
+		return fmt.Sprintf("runtime library error: %s (searched in: %s)",
+			err.Err, strings.Join(err.SearchDirs, ", "))
+	}
+	return fmt.Sprintf("runtime library error: %s: %s", err.Path, err.Err)
+}
+
+// SetLibDir specifies the directory to look for lib.js
+// before the default locations
+func SetLibDir(dir string) {
+	libDir = dir
+}
+
+// SetLibChecksum specifies the expected SHA-256 checksum
+// of lib.js as a hex string. Empty string disables
+// the verification.
+func SetLibChecksum(sum string) {
+	libChecksum = strings.ToLower(sum)
+}
+
+func libSearchDirs() []string {
+	if libDir == "" {
+		return searchDirs
+	}
+	return append([]string{libDir}, searchDirs...)
+}
+
+// readLib locates the runtime library and verifies its checksum
+func readLib() (string, []byte, error) {
+	dirs := libSearchDirs()
+	for _, dir := range dirs {
+		path := filepath.Join(dir, LIB_FILE)
+		content, err := ioutil.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return "", nil, &LibError{path, dirs, err}
+		}
+		if libChecksum != "" {
+			sum := sha256.Sum256(content)
+			if actual := hex.EncodeToString(sum[:]); actual != libChecksum {
+				return "", nil, &LibError{path, dirs,
+					fmt.Errorf("checksum mismatch: expected %s, got %s", libChecksum, actual)}
+			}
+		}
+		return path, content, nil
+	}
+	return "", nil, &LibError{"", dirs, noLibJs}
+}
+
+// CheckLib verifies that the runtime library can be located
+// and has the expected checksum. It makes it possible to report
+// the problem at startup before any engine is created.
+func CheckLib() error {
+	_, _, err := readLib()
+	return err
+}
@@ -0,0 +1,53 @@
+package wbrules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadLib(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wbrules-lib")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	content := []byte("var x = 42;\n")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, LIB_FILE), content, 0644))
+	sum := sha256.Sum256(content)
+
+	savedSearchDirs := searchDirs
+	defer func() {
+		searchDirs = savedSearchDirs
+		SetLibDir("")
+		SetLibChecksum("")
+	}()
+
+	searchDirs = []string{filepath.Join(dir, "nosuchdir")}
+	err = CheckLib()
+	if assert.IsType(t, &LibError{}, err) {
+		assert.Equal(t, "", err.(*LibError).Path)
+		assert.Equal(t, noLibJs, err.(*LibError).Err)
+	}
+
+	SetLibDir(dir)
+	path, actual, err := readLib()
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, LIB_FILE), path)
+	assert.Equal(t, content, actual)
+
+	SetLibChecksum(hex.EncodeToString(sum[:]))
+	assert.NoError(t, CheckLib())
+
+	SetLibChecksum("0123")
+	err = CheckLib()
+	if assert.IsType(t, &LibError{}, err) {
+		assert.Equal(t, filepath.Join(dir, LIB_FILE), err.(*LibError).Path)
+	}
+
+	engine, err := NewESEngine(newTestModel(t), nullMQTTClient{})
+	assert.Nil(t, engine)
+	assert.IsType(t, &LibError{}, err)
+}
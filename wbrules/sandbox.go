@@ -0,0 +1,195 @@
+package wbrules
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_CALLBACK_TIME = 100 * time.Millisecond
+	DEFAULT_MAX_OVERRUNS      = 3
+)
+
+// ExecProfile describes restrictions applied to the scripts loaded
+// from specific directories, e.g. community rule bundles that
+// aren't fully trusted. Scripts that run under a restricted
+// profile may only write to the virtual devices defined by
+// scripts of the same profile.
+//
+// All scripts share the same ECMAScript heap, so memory usage
+// can't be limited per profile. The execution time of each
+// callback is limited by MaxCallbackTime. As ECMAScript code
+// can't be preempted, a callback that exceeds the limit is
+// interrupted when it calls an engine function, and a loop
+// that doesn't call any engine functions is not interrupted
+// at all. When callbacks exceed the limit for MaxOverruns
+// times, the rules and timers of the profile are disabled.
+type ExecProfile struct {
+	Name            string
+	AllowSpawn      bool
+	AllowFileAccess bool
+	AllowPublish    bool
+	AllowNetwork    bool
+	MaxCallbackTime time.Duration
+	MaxOverruns     int
+	devices         map[string]bool
+	overruns        int
+	disabled        bool
+}
+
+// NewRestrictedProfile returns a profile that disallows
+// spawning processes, file access, network access
+// and raw MQTT publishing
+func NewRestrictedProfile(name string) *ExecProfile {
+	return &ExecProfile{
+		Name:            name,
+		MaxCallbackTime: DEFAULT_MAX_CALLBACK_TIME,
+		MaxOverruns:     DEFAULT_MAX_OVERRUNS,
+		devices:         make(map[string]bool),
+	}
+}
+
+// Disabled returns true if the profile was disabled
+// due to exceeding its time limit too many times
+func (profile *ExecProfile) Disabled() bool {
+	return profile.disabled
+}
+
+// profileLimit holds the time limit of the restricted
+// callback being run
+type profileLimit struct {
+	deadline    time.Time
+	what        string
+	interrupted bool
+}
+
+type restrictedDir struct {
+	dir     string
+	profile *ExecProfile
+}
+
+var operationNotPermittedError = errors.New("operation not permitted")
+
+// AddRestrictedDir makes the scripts loaded from the specified
+// directory and its subdirectories run under the profile
+func (engine *RuleEngine) AddRestrictedDir(dir string, profile *ExecProfile) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	engine.restrictedDirs = append(engine.restrictedDirs, restrictedDir{filepath.Clean(dir), profile})
+	return nil
+}
+
+func (engine *RuleEngine) profileForPath(path string) *ExecProfile {
+	for _, rd := range engine.restrictedDirs {
+		if path == rd.dir || len(path) > len(rd.dir) &&
+			path[:len(rd.dir)] == rd.dir && path[len(rd.dir)] == filepath.Separator {
+			return rd.profile
+		}
+	}
+	return nil
+}
+
+// withProfile runs the thunk under the specified profile.
+// nil profile means no restrictions.
+func (engine *RuleEngine) withProfile(profile *ExecProfile, what string, thunk func()) {
+	if profile != nil && profile.disabled {
+		return
+	}
+	savedProfile, savedLimit := engine.currentProfile, engine.profileLimit
+	engine.currentProfile, engine.profileLimit = profile, profileLimit{}
+	defer func() {
+		engine.currentProfile, engine.profileLimit = savedProfile, savedLimit
+	}()
+	if profile == nil {
+		thunk()
+		return
+	}
+	start := time.Now()
+	if profile.MaxCallbackTime > 0 {
+		engine.profileLimit = profileLimit{deadline: start.Add(profile.MaxCallbackTime), what: what}
+	}
+	thunk()
+	engine.checkBudget(profile, what, time.Since(start))
+}
+
+// checkProfileDeadline returns false if the restricted callback
+// being run has exceeded the time limit of its profile, so that
+// the callback is interrupted when it calls an engine function
+func (engine *RuleEngine) checkProfileDeadline() bool {
+	limit := &engine.profileLimit
+	if limit.deadline.IsZero() || time.Now().Before(limit.deadline) {
+		return true
+	}
+	if !limit.interrupted {
+		limit.interrupted = true
+		engine.Logf(ENGINE_LOG_ERROR, "restricted profile %s: %s exceeded the time limit, interrupting",
+			engine.currentProfile.Name, limit.what)
+	}
+	return false
+}
+
+func (engine *RuleEngine) checkBudget(profile *ExecProfile, what string, elapsed time.Duration) {
+	if profile.MaxCallbackTime <= 0 || elapsed <= profile.MaxCallbackTime || profile.disabled {
+		return
+	}
+	profile.overruns++
+	engine.Logf(ENGINE_LOG_WARNING, "restricted profile %s: %s took %s (limit %s)",
+		profile.Name, what, elapsed, profile.MaxCallbackTime)
+	if profile.MaxOverruns > 0 && profile.overruns >= profile.MaxOverruns {
+		profile.disabled = true
+		engine.Logf(ENGINE_LOG_ERROR,
+			"restricted profile %s: time limit exceeded too many times, rules disabled",
+			profile.Name)
+	}
+}
+
+// checkPermission returns an error if the operation isn't
+// allowed by the current profile
+func (engine *RuleEngine) checkPermission(operation string, allowed func(*ExecProfile) bool) error {
+	profile := engine.currentProfile
+	if profile == nil || allowed(profile) {
+		return nil
+	}
+	engine.Logf(ENGINE_LOG_ERROR, "restricted profile %s: %s not permitted",
+		profile.Name, operation)
+	return operationNotPermittedError
+}
+
+// checkSubscribePermission returns an error if the current profile
+// isn't allowed to receive raw MQTT messages. Subscriptions aren't
+// limited to the devices of the profile, so, like publish(), they
+// require raw MQTT access.
+func (engine *RuleEngine) checkSubscribePermission(filter string) error {
+	return engine.checkPermission("subscribing to "+filter, func(profile *ExecProfile) bool {
+		return profile.AllowPublish
+	})
+}
+
+func (engine *RuleEngine) checkCellWritePermission(cell *Cell) error {
+	if engine.currentProfile == nil {
+		// fast path for unrestricted scripts
+		return nil
+	}
+	return engine.checkPermission(
+		fmt.Sprintf("writing %s/%s", cell.DevName(), cell.Name()),
+		func(profile *ExecProfile) bool {
+			return profile.devices[cell.DevName()]
+		})
+}
+
+// registerProfileDevice records that the device is owned
+// by the scripts of the current profile
+func (engine *RuleEngine) registerProfileDevice(name string) {
+	profile := engine.currentProfile
+	if profile == nil {
+		return
+	}
+	profile.devices[name] = true
+	engine.cleanup.AddCleanup(func() {
+		delete(profile.devices, name)
+	})
+}
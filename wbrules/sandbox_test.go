@@ -0,0 +1,38 @@
+package wbrules
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestProfileForPath(t *testing.T) {
+	engine := NewRuleEngine(NewCellModel(), nil)
+	profile := NewRestrictedProfile("bundle")
+	assert.NoError(t, engine.AddRestrictedDir("/etc/wb-rules/bundle/", profile))
+	assert.Equal(t, profile, engine.profileForPath("/etc/wb-rules/bundle/a.js"))
+	assert.Equal(t, profile, engine.profileForPath("/etc/wb-rules/bundle/sub/a.js"))
+	assert.Nil(t, engine.profileForPath("/etc/wb-rules/bundle2/a.js"))
+	assert.Nil(t, engine.profileForPath("/etc/wb-rules/a.js"))
+}
+
+func TestProfileDeadline(t *testing.T) {
+	var messages []string
+	_, engine := newTestEngine(t, logCapturingClient{messages: &messages})
+	profile := NewRestrictedProfile("bundle")
+	profile.MaxCallbackTime = time.Millisecond
+	assert.True(t, engine.checkProfileDeadline())
+	engine.withProfile(profile, "test callback", func() {
+		assert.True(t, engine.checkProfileDeadline())
+		time.Sleep(5 * time.Millisecond)
+		assert.False(t, engine.checkProfileDeadline())
+		engine.withProfile(nil, "trusted callback", func() {
+			assert.True(t, engine.checkProfileDeadline())
+		})
+		assert.False(t, engine.checkProfileDeadline())
+	})
+	assert.True(t, engine.checkProfileDeadline())
+	if assert.NotEmpty(t, messages) {
+		assert.Equal(t, "/wbrules/log/error: restricted profile bundle: test callback exceeded the time limit, interrupting", messages[0])
+	}
+}
@@ -0,0 +1,418 @@
+package wbrules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ivan4th/go-duktape"
+	"github.com/stretchr/objx"
+	"sort"
+	"time"
+)
+
+const SCENES_BUCKET = "_wbScenes"
+
+var unknownSceneError = errors.New("unknown scene")
+
+// SceneCell describes a cell value stored in a scene.
+// When the scene is recalled, the value is written
+// to the cell after DelayMs milliseconds.
+type SceneCell struct {
+	Device  string      `json:"device"`
+	Cell    string      `json:"cell"`
+	Value   interface{} `json:"value"`
+	DelayMs int         `json:"delayMs,omitempty"`
+}
+
+// Scene is a named snapshot of cell values
+type Scene struct {
+	Name  string      `json:"name"`
+	Time  time.Time   `json:"time"`
+	Cells []SceneCell `json:"cells"`
+}
+
+func (engine *RuleEngine) loadScene(name string) (*Scene, error) {
+	v, found := engine.storage.Get(SCENES_BUCKET, name)
+	if !found {
+		return nil, unknownSceneError
+	}
+	// the scenes are stored as generic JSON values
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	scene := &Scene{}
+	if err = json.Unmarshal(bs, scene); err != nil {
+		return nil, fmt.Errorf("invalid scene %s: %s", name, err)
+	}
+	return scene, nil
+}
+
+func (engine *RuleEngine) storeScene(scene *Scene) error {
+	bs, err := json.Marshal(scene)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err = json.Unmarshal(bs, &v); err != nil {
+		return err
+	}
+	if err = engine.storage.Set(SCENES_BUCKET, scene.Name, v); err != nil {
+		return err
+	}
+	// scenes are saved rarely and must not be lost
+	return engine.FlushPersistentStorage()
+}
+
+// captureScene stores the current values of the cells as the
+// scene. The values of the cells passed to it are ignored.
+func (engine *RuleEngine) captureScene(name string, cells []SceneCell) (*Scene, error) {
+	if name == "" {
+		return nil, errors.New("scene name not specified")
+	}
+	scene := &Scene{Name: name, Time: engine.clock.Now(), Cells: make([]SceneCell, len(cells))}
+	for i, sceneCell := range cells {
+		cell := engine.model.LookupCell(&CellSpec{sceneCell.Device, sceneCell.Cell})
+		if cell == nil || !cell.IsComplete() {
+			return nil, fmt.Errorf("%s: unknown cell %s/%s", name, sceneCell.Device, sceneCell.Cell)
+		}
+		if sceneCell.DelayMs < 0 {
+			return nil, fmt.Errorf("%s: negative delay for %s/%s", name, sceneCell.Device, sceneCell.Cell)
+		}
+		sceneCell.Value = cell.Value()
+		scene.Cells[i] = sceneCell
+	}
+	if err := engine.storeScene(scene); err != nil {
+		return nil, err
+	}
+	return scene, nil
+}
+
+// recallScene writes the values stored in the scene to the cells.
+// The delayed writes of the scene that are still pending since
+// the scene was recalled last time are cancelled.
+func (engine *RuleEngine) recallScene(name string) error {
+	scene, err := engine.loadScene(name)
+	if err != nil {
+		return err
+	}
+	engine.cancelSceneTransitions(name)
+	var stops []func()
+	for _, sceneCell := range scene.Cells {
+		sceneCell := sceneCell
+		write := func() {
+			cell := engine.model.LookupCell(&CellSpec{sceneCell.Device, sceneCell.Cell})
+			if cell == nil {
+				engine.Logf(ENGINE_LOG_WARNING, "scene %s: unknown cell %s/%s",
+					name, sceneCell.Device, sceneCell.Cell)
+				return
+			}
+			engine.setCellValue(cell, sceneCell.Value)
+		}
+		if sceneCell.DelayMs <= 0 {
+			write()
+		} else {
+			stops = append(stops, engine.delay(time.Duration(sceneCell.DelayMs)*time.Millisecond, write))
+		}
+	}
+	if len(stops) > 0 {
+		engine.sceneTransitions[name] = stops
+	}
+	engine.Logf(ENGINE_LOG_INFO, "scene %s recalled", name)
+	return nil
+}
+
+func (engine *RuleEngine) cancelSceneTransitions(name string) {
+	for _, stop := range engine.sceneTransitions[name] {
+		stop()
+	}
+	delete(engine.sceneTransitions, name)
+}
+
+func (engine *RuleEngine) deleteScene(name string) error {
+	if _, found := engine.storage.Get(SCENES_BUCKET, name); !found {
+		return unknownSceneError
+	}
+	engine.cancelSceneTransitions(name)
+	if err := engine.storage.Set(SCENES_BUCKET, name, nil); err != nil {
+		return err
+	}
+	return engine.FlushPersistentStorage()
+}
+
+func (engine *RuleEngine) sceneNames() ([]string, error) {
+	names, err := StorageKeys(engine.storage, SCENES_BUCKET)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CaptureScene stores the current values of the cells as
+// the scene, replacing the scene with the same name, if any
+func (engine *RuleEngine) CaptureScene(name string, cells []SceneCell) (scene *Scene, err error) {
+	engine.Call(func() {
+		scene, err = engine.captureScene(name, cells)
+	})
+	return
+}
+
+// RecallScene writes the values stored in the scene to the cells
+func (engine *RuleEngine) RecallScene(name string) (err error) {
+	engine.Call(func() {
+		err = engine.recallScene(name)
+	})
+	return
+}
+
+// GetScene returns the scene with the specified name
+func (engine *RuleEngine) GetScene(name string) (scene *Scene, err error) {
+	engine.Call(func() {
+		scene, err = engine.loadScene(name)
+	})
+	return
+}
+
+// DeleteScene removes the scene
+func (engine *RuleEngine) DeleteScene(name string) (err error) {
+	engine.Call(func() {
+		err = engine.deleteScene(name)
+	})
+	return
+}
+
+// SceneNames returns the sorted list of scene names
+func (engine *RuleEngine) SceneNames() (names []string, err error) {
+	engine.Call(func() {
+		names, err = engine.sceneNames()
+	})
+	return
+}
+
+// parseSceneCells parses the cell list passed to Scenes.capture().
+// The items are either "device/cell" strings or objects with
+// 'cell' ("device/cell") and optional 'delayMs' properties.
+func parseSceneCells(items []interface{}) ([]SceneCell, error) {
+	cells := make([]SceneCell, len(items))
+	for i, item := range items {
+		var ref string
+		switch v := item.(type) {
+		case string:
+			ref = v
+		case map[string]interface{}:
+			ref, _ = v["cell"].(string)
+			if delay, found := v["delayMs"]; found && delay != nil {
+				ms, ok := delay.(float64)
+				if !ok || ms < 0 {
+					return nil, errors.New("delayMs must be a non-negative number")
+				}
+				cells[i].DelayMs = int(ms)
+			}
+		}
+		spec, err := parseCellRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		cells[i].Device, cells[i].Cell = spec.DevName, spec.CellName
+	}
+	return cells, nil
+}
+
+// esWbSceneCapture captures the scene. Arguments: the scene
+// name and the array of cells, see parseSceneCells(). Returns
+// an error message or null.
+func (engine *ESEngine) esWbSceneCapture() int {
+	if engine.ctx.GetTop() != 2 || !engine.ctx.IsString(0) || !engine.ctx.IsArray(1) {
+		return duktape.DUK_RET_ERROR
+	}
+	name := engine.ctx.GetString(0)
+	items, ok := engine.ctx.GetJSObject(1).([]interface{})
+	if !ok {
+		return duktape.DUK_RET_ERROR
+	}
+	cells, err := parseSceneCells(items)
+	if err == nil {
+		_, err = engine.captureScene(name, cells)
+	}
+	if err != nil {
+		engine.ctx.PushString(err.Error())
+	} else {
+		engine.ctx.PushNull()
+	}
+	return 1
+}
+
+// esWbSceneRecall recalls the scene. Returns
+// an error message or null.
+func (engine *ESEngine) esWbSceneRecall() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	if err := engine.recallScene(engine.ctx.GetString(0)); err != nil {
+		engine.ctx.PushString(err.Error())
+	} else {
+		engine.ctx.PushNull()
+	}
+	return 1
+}
+
+// esWbSceneGet returns the scene object
+// or undefined if there's no such scene
+func (engine *ESEngine) esWbSceneGet() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	scene, err := engine.loadScene(engine.ctx.GetString(0))
+	if err != nil {
+		engine.ctx.PushUndefined()
+		return 1
+	}
+	cells := make([]interface{}, len(scene.Cells))
+	for i, sceneCell := range scene.Cells {
+		cells[i] = map[string]interface{}{
+			"cell":    sceneCell.Device + "/" + sceneCell.Cell,
+			"value":   sceneCell.Value,
+			"delayMs": sceneCell.DelayMs,
+		}
+	}
+	engine.ctx.PushJSObject(objx.New(map[string]interface{}{
+		"name":  scene.Name,
+		"time":  scene.Time.Format(time.RFC3339),
+		"cells": cells,
+	}))
+	return 1
+}
+
+// esWbSceneDelete removes the scene. Returns
+// an error message or null.
+func (engine *ESEngine) esWbSceneDelete() int {
+	if engine.ctx.GetTop() != 1 || !engine.ctx.IsString(0) {
+		return duktape.DUK_RET_ERROR
+	}
+	if err := engine.deleteScene(engine.ctx.GetString(0)); err != nil {
+		engine.ctx.PushString(err.Error())
+	} else {
+		engine.ctx.PushNull()
+	}
+	return 1
+}
+
+// esWbSceneList returns the array of scene names
+func (engine *ESEngine) esWbSceneList() int {
+	if engine.ctx.GetTop() != 0 {
+		return duktape.DUK_RET_ERROR
+	}
+	names, err := engine.sceneNames()
+	if err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "failed to list scenes: %s", err)
+		return duktape.DUK_RET_ERROR
+	}
+	engine.ctx.PushJSObject(names)
+	return 1
+}
+
+// SceneManager provides the scene functions
+// used by the Scenes RPC service
+type SceneManager interface {
+	CaptureScene(name string, cells []SceneCell) (*Scene, error)
+	RecallScene(name string) error
+	GetScene(name string) (*Scene, error)
+	DeleteScene(name string) error
+	SceneNames() ([]string, error)
+}
+
+// Scenes is an RPC service that captures and recalls scenes,
+// so that the scenes can be managed from the UI
+type Scenes struct {
+	manager SceneManager
+}
+
+type ScenesError struct {
+	code    int32
+	message string
+}
+
+func (err *ScenesError) Error() string {
+	return err.message
+}
+
+func (err *ScenesError) ErrorCode() int32 {
+	return err.code
+}
+
+const (
+	// no iota here because these values may be used
+	// by external software
+	SCENES_ERROR_UNKNOWN_SCENE = 1600
+	SCENES_ERROR_INVALID_ARGS  = 1601
+	SCENES_ERROR_STORAGE       = 1602
+)
+
+func NewScenes(manager SceneManager) *Scenes {
+	return &Scenes{manager}
+}
+
+func scenesError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case unknownSceneError:
+		return &ScenesError{SCENES_ERROR_UNKNOWN_SCENE, err.Error()}
+	default:
+		return &ScenesError{SCENES_ERROR_STORAGE, err.Error()}
+	}
+}
+
+type ScenesCaptureArgs struct {
+	Name string `json:"name"`
+	// Cells specify the cells to capture and their delays,
+	// the values are ignored
+	Cells []SceneCell `json:"cells"`
+}
+
+func (scenes *Scenes) Capture(args *ScenesCaptureArgs, reply *Scene) error {
+	if args.Name == "" || len(args.Cells) == 0 {
+		return &ScenesError{SCENES_ERROR_INVALID_ARGS, "scene name and cells must be specified"}
+	}
+	scene, err := scenes.manager.CaptureScene(args.Name, args.Cells)
+	if err != nil {
+		return &ScenesError{SCENES_ERROR_INVALID_ARGS, err.Error()}
+	}
+	*reply = *scene
+	return nil
+}
+
+type ScenesNameArgs struct {
+	Name string `json:"name"`
+}
+
+type ScenesEmptyResponse struct{}
+
+func (scenes *Scenes) Recall(args *ScenesNameArgs, reply *ScenesEmptyResponse) error {
+	return scenesError(scenes.manager.RecallScene(args.Name))
+}
+
+func (scenes *Scenes) Get(args *ScenesNameArgs, reply *Scene) error {
+	scene, err := scenes.manager.GetScene(args.Name)
+	if err != nil {
+		return scenesError(err)
+	}
+	*reply = *scene
+	return nil
+}
+
+func (scenes *Scenes) Delete(args *ScenesNameArgs, reply *ScenesEmptyResponse) error {
+	return scenesError(scenes.manager.DeleteScene(args.Name))
+}
+
+type ScenesListArgs struct{}
+
+func (scenes *Scenes) List(args *ScenesListArgs, reply *[]string) error {
+	names, err := scenes.manager.SceneNames()
+	if err != nil {
+		return scenesError(err)
+	}
+	*reply = names
+	return nil
+}
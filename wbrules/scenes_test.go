@@ -0,0 +1,107 @@
+package wbrules
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScenes(t *testing.T) {
+	model, engine := newTimerTestEngine(t, nullMQTTClient{})
+	dev := model.EnsureLocalDevice("room", "room")
+	light := dev.SetCell("light", "switch", true, false)
+	level := dev.SetCell("level", "range", 70.0, false)
+
+	scenes := NewScenes(engine)
+	var scene Scene
+	err := scenes.Capture(&ScenesCaptureArgs{
+		Name: "evening",
+		Cells: []SceneCell{
+			{Device: "room", Cell: "light"},
+			{Device: "room", Cell: "level", DelayMs: 50},
+		},
+	}, &scene)
+	if err != nil {
+		t.Fatalf("Capture(): %s", err)
+	}
+	expectedCells := []SceneCell{
+		{Device: "room", Cell: "light", Value: true},
+		{Device: "room", Cell: "level", Value: 70.0, DelayMs: 50},
+	}
+	if scene.Name != "evening" || !reflect.DeepEqual(scene.Cells, expectedCells) {
+		t.Errorf("bad scene: %#v", scene)
+	}
+
+	err = scenes.Capture(&ScenesCaptureArgs{
+		Name:  "bad",
+		Cells: []SceneCell{{Device: "room", Cell: "nosuchcell"}},
+	}, &scene)
+	if rpcErr, ok := err.(*ScenesError); !ok || rpcErr.ErrorCode() != SCENES_ERROR_INVALID_ARGS {
+		t.Errorf("bad error for unknown cell: %v", err)
+	}
+
+	engine.model.CallSync(func() {
+		light.SetValue(false)
+		level.SetValue(10.0)
+	})
+	if err := scenes.Recall(&ScenesNameArgs{"evening"}, &ScenesEmptyResponse{}); err != nil {
+		t.Fatalf("Recall(): %s", err)
+	}
+	var lightValue, levelValue interface{}
+	engine.model.CallSync(func() {
+		lightValue, levelValue = light.Value(), level.Value()
+	})
+	if lightValue != true || levelValue != 10.0 {
+		t.Errorf("bad values right after recall: %v, %v", lightValue, levelValue)
+	}
+	for deadline := time.Now().Add(5 * time.Second); levelValue != 70.0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the delayed value wasn't written")
+		}
+		time.Sleep(10 * time.Millisecond)
+		engine.model.CallSync(func() {
+			levelValue = level.Value()
+		})
+	}
+
+	var names []string
+	if err := scenes.List(&ScenesListArgs{}, &names); err != nil || !reflect.DeepEqual(names, []string{"evening"}) {
+		t.Errorf("bad scene list: %v (error %v)", names, err)
+	}
+	if err := scenes.Get(&ScenesNameArgs{"evening"}, &scene); err != nil || !reflect.DeepEqual(scene.Cells, expectedCells) {
+		t.Errorf("bad scene: %#v (error %v)", scene, err)
+	}
+	if err := scenes.Delete(&ScenesNameArgs{"evening"}, &ScenesEmptyResponse{}); err != nil {
+		t.Errorf("Delete(): %s", err)
+	}
+	err = scenes.Recall(&ScenesNameArgs{"evening"}, &ScenesEmptyResponse{})
+	if rpcErr, ok := err.(*ScenesError); !ok || rpcErr.ErrorCode() != SCENES_ERROR_UNKNOWN_SCENE {
+		t.Errorf("bad error for deleted scene: %v", err)
+	}
+}
+
+func TestParseSceneCells(t *testing.T) {
+	cells, err := parseSceneCells([]interface{}{
+		"room/light",
+		map[string]interface{}{"cell": "room/level", "delayMs": 500.0},
+	})
+	if err != nil {
+		t.Fatalf("parseSceneCells(): %s", err)
+	}
+	expected := []SceneCell{
+		{Device: "room", Cell: "light"},
+		{Device: "room", Cell: "level", DelayMs: 500},
+	}
+	if !reflect.DeepEqual(cells, expected) {
+		t.Errorf("bad cells: %#v", cells)
+	}
+	for _, items := range [][]interface{}{
+		{"nodevice"},
+		{42.0},
+		{map[string]interface{}{"cell": "room/level", "delayMs": -1.0}},
+	} {
+		if _, err := parseSceneCells(items); err == nil {
+			t.Errorf("no error for %#v", items)
+		}
+	}
+}
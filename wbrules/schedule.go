@@ -0,0 +1,128 @@
+package wbrules
+
+import (
+	"github.com/robfig/cron"
+	"time"
+)
+
+const (
+	SCHEDULE_PREVIEW_DEFAULT_COUNT = 10
+	SCHEDULE_PREVIEW_MAX_COUNT     = 100
+)
+
+// RuleScheduleSource provides time-based trigger specs of rules
+type RuleScheduleSource interface {
+	// RuleCronSpec returns the cron spec of the specified rule.
+	// The second return value is false if there's no such rule.
+	// The spec is empty for rules without time-based triggers.
+	RuleCronSpec(name string) (string, bool)
+}
+
+// Scheduler is an RPC service that lists the upcoming
+// firing times of time-based rules, so that the schedules
+// can be verified from the UI before the rules actually fire.
+type Scheduler struct {
+	source RuleScheduleSource
+	now    func() time.Time
+	// loc is the time zone used by the cron
+	loc *time.Location
+}
+
+type SchedulerError struct {
+	code    int32
+	message string
+}
+
+func (err *SchedulerError) Error() string {
+	return err.message
+}
+
+func (err *SchedulerError) ErrorCode() int32 {
+	return err.code
+}
+
+const (
+	// no iota here because these values may be used
+	// by external software
+	SCHEDULER_ERROR_UNKNOWN_RULE = 1200
+	SCHEDULER_ERROR_NOT_TIMED    = 1201
+	SCHEDULER_ERROR_INVALID_SPEC = 1202
+	SCHEDULER_ERROR_INVALID_ARGS = 1203
+	SCHEDULER_ERROR_INVALID_ZONE = 1204
+)
+
+func NewScheduler(source RuleScheduleSource) *Scheduler {
+	return &Scheduler{source, time.Now, time.Local}
+}
+
+type SchedulerPreviewArgs struct {
+	// Either Rule or Spec must be specified. Spec makes
+	// it possible to check a schedule before saving the rule.
+	Rule string `json:"rule"`
+	Spec string `json:"spec"`
+	// Count is the number of firing times to return
+	Count int `json:"count"`
+	// Timezone is IANA time zone name used to display the
+	// firing times. Rules are scheduled using the local time
+	// of the controller, so DST transitions of the local time
+	// zone are taken into account regardless of this setting.
+	Timezone string `json:"timezone"`
+}
+
+type SchedulerPreviewResponse struct {
+	Spec  string   `json:"spec"`
+	Times []string `json:"times"`
+}
+
+func (scheduler *Scheduler) Preview(args *SchedulerPreviewArgs, reply *SchedulerPreviewResponse) error {
+	count := args.Count
+	switch {
+	case count == 0:
+		count = SCHEDULE_PREVIEW_DEFAULT_COUNT
+	case count < 0 || count > SCHEDULE_PREVIEW_MAX_COUNT:
+		return &SchedulerError{SCHEDULER_ERROR_INVALID_ARGS, "invalid count"}
+	}
+
+	spec := args.Spec
+	switch {
+	case args.Rule != "" && spec != "":
+		return &SchedulerError{SCHEDULER_ERROR_INVALID_ARGS, "both rule and spec specified"}
+	case args.Rule != "":
+		var found bool
+		spec, found = scheduler.source.RuleCronSpec(args.Rule)
+		if !found {
+			return &SchedulerError{SCHEDULER_ERROR_UNKNOWN_RULE, "unknown rule: " + args.Rule}
+		}
+		if spec == "" {
+			return &SchedulerError{SCHEDULER_ERROR_NOT_TIMED, "rule has no time-based triggers: " + args.Rule}
+		}
+	case spec == "":
+		return &SchedulerError{SCHEDULER_ERROR_INVALID_ARGS, "rule or spec must be specified"}
+	}
+
+	loc := scheduler.loc
+	if args.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(args.Timezone); err != nil {
+			return &SchedulerError{SCHEDULER_ERROR_INVALID_ZONE, err.Error()}
+		}
+	}
+
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return &SchedulerError{SCHEDULER_ERROR_INVALID_SPEC, err.Error()}
+	}
+
+	times := make([]string, 0, count)
+	t := scheduler.now().In(scheduler.loc)
+	for len(times) < count {
+		t = schedule.Next(t)
+		if t.IsZero() {
+			// the schedule never fires again
+			break
+		}
+		times = append(times, t.In(loc).Format(time.RFC3339))
+	}
+	*reply = SchedulerPreviewResponse{spec, times}
+	return nil
+}
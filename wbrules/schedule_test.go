@@ -0,0 +1,74 @@
+package wbrules
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type fakeRuleScheduleSource map[string]string
+
+func (source fakeRuleScheduleSource) RuleCronSpec(name string) (string, bool) {
+	spec, found := source[name]
+	return spec, found
+}
+
+func TestSchedulerPreview(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %s", err)
+	}
+	scheduler := NewScheduler(fakeRuleScheduleSource{
+		"nightly":   "0 30 2 * * *",
+		"noncron":   "",
+		"weekdays9": "0 0 9 * * MON-FRI",
+	})
+	scheduler.loc = loc
+	scheduler.now = func() time.Time {
+		// the day before DST starts in Europe
+		return time.Date(2026, 3, 28, 12, 0, 0, 0, loc)
+	}
+
+	var reply SchedulerPreviewResponse
+	assert.NoError(t, scheduler.Preview(&SchedulerPreviewArgs{Rule: "nightly", Count: 3}, &reply))
+	assert.Equal(t, SchedulerPreviewResponse{
+		Spec: "0 30 2 * * *",
+		Times: []string{
+			// 02:30 doesn't exist on 2026-03-29
+			"2026-03-30T02:30:00+02:00",
+			"2026-03-31T02:30:00+02:00",
+			"2026-04-01T02:30:00+02:00",
+		},
+	}, reply)
+
+	assert.NoError(t, scheduler.Preview(&SchedulerPreviewArgs{
+		Spec:     "0 0 9 * * MON-FRI",
+		Count:    2,
+		Timezone: "UTC",
+	}, &reply))
+	assert.Equal(t, []string{
+		"2026-03-30T07:00:00Z",
+		"2026-03-31T07:00:00Z",
+	}, reply.Times)
+
+	assert.NoError(t, scheduler.Preview(&SchedulerPreviewArgs{Rule: "weekdays9"}, &reply))
+	assert.Len(t, reply.Times, SCHEDULE_PREVIEW_DEFAULT_COUNT)
+
+	for _, tt := range []struct {
+		args SchedulerPreviewArgs
+		code int32
+	}{
+		{SchedulerPreviewArgs{Rule: "nosuchrule"}, SCHEDULER_ERROR_UNKNOWN_RULE},
+		{SchedulerPreviewArgs{Rule: "noncron"}, SCHEDULER_ERROR_NOT_TIMED},
+		{SchedulerPreviewArgs{Spec: "bad spec"}, SCHEDULER_ERROR_INVALID_SPEC},
+		{SchedulerPreviewArgs{}, SCHEDULER_ERROR_INVALID_ARGS},
+		{SchedulerPreviewArgs{Rule: "nightly", Spec: "@daily"}, SCHEDULER_ERROR_INVALID_ARGS},
+		{SchedulerPreviewArgs{Rule: "nightly", Count: SCHEDULE_PREVIEW_MAX_COUNT + 1}, SCHEDULER_ERROR_INVALID_ARGS},
+		{SchedulerPreviewArgs{Rule: "nightly", Timezone: "Nowhere/Nowhere"}, SCHEDULER_ERROR_INVALID_ZONE},
+	} {
+		err := scheduler.Preview(&tt.args, &reply)
+		if assert.Error(t, err, "args: %#v", tt.args) {
+			assert.Equal(t, tt.code, err.(*SchedulerError).ErrorCode())
+		}
+	}
+}
@@ -41,6 +41,15 @@ func (sc *ScopedCleanup) PopCleanupScope(scope string) string {
 	return scope
 }
 
+// CurrentScope returns the innermost scope or an empty
+// string if no scope is active
+func (sc *ScopedCleanup) CurrentScope() string {
+	if len(sc.scopeStack) == 0 {
+		return ""
+	}
+	return sc.scopeStack[len(sc.scopeStack)-1]
+}
+
 func (sc *ScopedCleanup) AddCleanup(cleanupFn CleanupFunc) {
 	if len(sc.scopeStack) == 0 {
 		// global scope, cleanup will not run
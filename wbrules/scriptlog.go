@@ -0,0 +1,185 @@
+package wbrules
+
+import (
+	"fmt"
+	"github.com/contactless/wbgo"
+	"path/filepath"
+)
+
+const (
+	LOG_LEVELS_DEV_NAME  = "wbrules_log_levels"
+	LOG_LEVELS_DEV_TITLE = "Script Log Levels"
+)
+
+// logLevelNames lists the names of the
+// levels starting from ENGINE_LOG_DEBUG
+var logLevelNames = []string{"debug", "info", "warning", "error"}
+
+func (level EngineLogLevel) String() string {
+	n := int(level - ENGINE_LOG_DEBUG)
+	if n < 0 || n >= len(logLevelNames) {
+		return fmt.Sprintf("level%d", int(level))
+	}
+	return logLevelNames[n]
+}
+
+// ParseLogLevel parses the name of the log
+// level such as "debug" or "warning"
+func ParseLogLevel(name string) (EngineLogLevel, error) {
+	for i, levelName := range logLevelNames {
+		if name == levelName {
+			return ENGINE_LOG_DEBUG + EngineLogLevel(i), nil
+		}
+	}
+	return ENGINE_LOG_DEBUG, fmt.Errorf("invalid log level: %q", name)
+}
+
+// logContext returns the rule and the script being run.
+// The rule is empty for the code that doesn't belong to
+// a rule, such as the top level code of the script or
+// the callbacks of the timers.
+func (engine *RuleEngine) logContext() (ruleName, script string) {
+	ruleName, script = engine.currentRule, engine.currentScript
+	if rule, found := engine.ruleMap[ruleName]; found {
+		script = rule.script
+	} else if script == "" {
+		script = engine.cleanup.CurrentScope()
+	}
+	return
+}
+
+// withCurrentScript runs the thunk with the script marked as
+// the current one, so that the messages logged by the thunk
+// are attributed to it
+func (engine *RuleEngine) withCurrentScript(script string, thunk func()) {
+	savedScript := engine.currentScript
+	engine.currentScript = script
+	defer func() {
+		engine.currentScript = savedScript
+	}()
+	thunk()
+}
+
+func logTag(ruleName, script string) string {
+	switch {
+	case script == "" && ruleName == "":
+		return ""
+	case ruleName == "":
+		return "[script=" + filepath.Base(script) + "] "
+	case script == "":
+		return "[rule=" + ruleName + "] "
+	default:
+		return "[script=" + filepath.Base(script) + " rule=" + ruleName + "] "
+	}
+}
+
+// LogFromScript logs the message produced by the code being run.
+// The line written to the system log is tagged with the script
+// and the rule that produced the message. Messages below the log
+// level of the script are dropped. Must be called on the event loop.
+func (engine *RuleEngine) LogFromScript(level EngineLogLevel, message string) {
+	ruleName, script := engine.logContext()
+	if level < engine.scriptLogLevels[script] {
+		return
+	}
+	engine.log(level, logTag(ruleName, script), message)
+	if len(engine.logSinks) > 0 {
+		engine.writeToLogSinks(level, ruleName, script, message)
+	}
+}
+
+// SetScriptLogLevel sets the minimum level of the messages
+// logged by the script. Must be called on the event loop.
+func (engine *RuleEngine) SetScriptLogLevel(script string, level EngineLogLevel) {
+	if level <= ENGINE_LOG_DEBUG {
+		delete(engine.scriptLogLevels, script)
+	} else {
+		engine.scriptLogLevels[script] = level
+	}
+}
+
+// maybeSetScriptLogLevel updates the log level of the
+// script when its log level cell changes
+func (engine *RuleEngine) maybeSetScriptLogLevel(cell *Cell) {
+	script, found := engine.logLevelCells[cell]
+	if !found {
+		return
+	}
+	name, _ := cell.Value().(string)
+	level, err := ParseLogLevel(name)
+	if err != nil {
+		engine.Logf(ENGINE_LOG_WARNING, "%s: %s", filepath.Base(script), err)
+		return
+	}
+	engine.SetScriptLogLevel(script, level)
+}
+
+// SetScriptLogLevelCells enables or disables the log level cells.
+// When they're enabled, the engine adds a text cell for each script
+// under the source root to the log levels device. The cell holds
+// the minimum level of the messages logged by the script: "debug",
+// "info", "warning" or "error". Must be called before loading
+// the scripts.
+func (engine *ESEngine) SetScriptLogLevelCells(enabled bool) {
+	if enabled {
+		engine.logLevelScripts = make(map[string]string)
+	} else {
+		engine.logLevelScripts = nil
+	}
+}
+
+func (engine *ESEngine) logLevelsDevName() string {
+	return InstanceName(LOG_LEVELS_DEV_NAME, engine.instanceID)
+}
+
+// syncScriptLogLevels adds the log level cells for the new
+// scripts and removes the cells of the removed scripts. The
+// levels chosen for the remaining scripts are kept.
+func (engine *ESEngine) syncScriptLogLevels() {
+	if engine.logLevelScripts == nil || engine.sourceRoot == "" {
+		return
+	}
+	entries, err := engine.ListSourceFiles()
+	if err != nil {
+		wbgo.Error.Printf("error listing the scripts: %s", err)
+		return
+	}
+	devName := engine.logLevelsDevName()
+	dev := engine.model.EnsureLocalDevice(devName, LOG_LEVELS_DEV_TITLE)
+	present := make(map[string]bool)
+	for _, entry := range entries {
+		name := scriptSwitchName(entry.VirtualPath)
+		present[name] = true
+		if _, found := engine.logLevelScripts[name]; found {
+			continue
+		}
+		script, _, err := engine.checkVirtualPath(entry.VirtualPath)
+		if err != nil {
+			continue
+		}
+		engine.logLevelScripts[name] = script
+		engine.logLevelCells[dev.SetCell(name, "text", ENGINE_LOG_DEBUG.String(), false)] = script
+	}
+	for name, script := range engine.logLevelScripts {
+		if present[name] {
+			continue
+		}
+		delete(engine.logLevelScripts, name)
+		delete(engine.scriptLogLevels, script)
+		for cell, cellScript := range engine.logLevelCells {
+			if cellScript == script {
+				delete(engine.logLevelCells, cell)
+			}
+		}
+		if err := engine.RemoveControl(devName, name); err != nil {
+			wbgo.Error.Printf("error removing the log level cell %s: %s", name, err)
+		}
+	}
+}
+
+// syncScriptControls updates the cells that
+// control the scripts after the scripts change
+func (engine *ESEngine) syncScriptControls() {
+	engine.syncScriptSwitches()
+	engine.syncScriptLogLevels()
+}
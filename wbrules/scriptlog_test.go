@@ -0,0 +1,94 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo"
+	"github.com/stretchr/objx"
+	"reflect"
+	"testing"
+)
+
+// logCapturingClient records the payloads of the
+// messages published to the log topics
+type logCapturingClient struct {
+	nullMQTTClient
+	messages *[]string
+}
+
+func (client logCapturingClient) Publish(message wbgo.MQTTMessage) {
+	*client.messages = append(*client.messages, message.Topic+": "+message.Payload)
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, level := range []EngineLogLevel{ENGINE_LOG_DEBUG, ENGINE_LOG_INFO, ENGINE_LOG_WARNING, ENGINE_LOG_ERROR} {
+		if parsed, err := ParseLogLevel(level.String()); err != nil || parsed != level {
+			t.Errorf("ParseLogLevel(%q): %v, %v", level.String(), parsed, err)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Errorf("no error for an invalid log level")
+	}
+}
+
+func TestScriptLogLevels(t *testing.T) {
+	var messages []string
+	model, engine := newTestEngine(t, logCapturingClient{messages: &messages})
+	err := engine.DefineVirtualDevice("somedev", objx.Map{
+		"cells": objx.Map{"sw": objx.Map{"type": "switch", "value": false}},
+	})
+	if err != nil {
+		t.Fatalf("DefineVirtualDevice(): %s", err)
+	}
+	cond, err := NewCellChangedRuleCondition(CellSpec{"somedev", "sw"})
+	if err != nil {
+		t.Fatalf("NewCellChangedRuleCondition(): %s", err)
+	}
+	const script = "/etc/wb-rules/lights.js"
+	var contexts []string
+	engine.cleanup.PushCleanupScope(script)
+	engine.DefineRule(NewRule(engine, "lights.js/sw", cond, func(objx.Map) interface{} {
+		ruleName, script := engine.logContext()
+		contexts = append(contexts, logTag(ruleName, script))
+		engine.LogFromScript(ENGINE_LOG_INFO, "sw changed")
+		engine.LogFromScript(ENGINE_LOG_WARNING, "sw warning")
+		engine.StartTimer(NO_TIMER_NAME, func() {}, 0, false)
+		return nil
+	}))
+	engine.cleanup.PopCleanupScope(script)
+
+	engine.SetScriptLogLevel(script, ENGINE_LOG_WARNING)
+	cell := model.EnsureCell(&CellSpec{"somedev", "sw"})
+	cell.SetValue(true)
+	messages = nil
+	engine.RunRules(&CellSpec{"somedev", "sw"}, NO_TIMER_NAME)
+	expected := []string{"/wbrules/log/warning: sw warning"}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("bad messages: %v", messages)
+	}
+
+	// the timer started by the rule keeps the script
+	for _, entry := range engine.timers {
+		if entry.script != script {
+			t.Errorf("bad script of the timer: %q", entry.script)
+		}
+		engine.withCurrentScript(entry.script, func() {
+			ruleName, script := engine.logContext()
+			contexts = append(contexts, logTag(ruleName, script))
+		})
+	}
+	engine.SetScriptLogLevel(script, ENGINE_LOG_DEBUG)
+	messages = nil
+	engine.withCurrentScript(script, func() {
+		engine.LogFromScript(ENGINE_LOG_INFO, "timer fired")
+	})
+	if !reflect.DeepEqual(messages, []string{"/wbrules/log/info: timer fired"}) {
+		t.Errorf("bad messages after resetting the log level: %v", messages)
+	}
+
+	expected = []string{
+		"[script=lights.js rule=lights.js/sw] ",
+		"[script=lights.js] ",
+	}
+	if !reflect.DeepEqual(contexts, expected) {
+		t.Errorf("bad log tags: %v", contexts)
+	}
+}
@@ -0,0 +1,159 @@
+package wbrules
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SCRIPT_REQUIRES_HEADER starts the comment that lists the
+// scripts that must be loaded before the script, e.g.
+// '// wbrules-requires: lib.js, devices/heating.js'.
+// The paths are relative to the directory of the script.
+const SCRIPT_REQUIRES_HEADER = "wbrules-requires:"
+
+// readScriptRequires returns the absolute paths of the scripts
+// listed in the wbrules-requires headers of the script. Only
+// the comments at the beginning of the script are examined.
+func readScriptRequires(path string) ([]string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var requires []string
+	dir := filepath.Dir(path)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			break
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "//"))
+		if !strings.HasPrefix(line, SCRIPT_REQUIRES_HEADER) {
+			continue
+		}
+		names := strings.FieldsFunc(line[len(SCRIPT_REQUIRES_HEADER):], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		for _, name := range names {
+			requires = append(requires, filepath.Join(dir, filepath.FromSlash(name)))
+		}
+	}
+	return requires, scanner.Err()
+}
+
+// orderScripts sorts the scripts so that each script is placed
+// after the scripts it requires. Otherwise the scripts are kept
+// in alphabetical order. The scripts with missing or circular
+// dependencies are placed at the end, loadScript() reports
+// the errors for them.
+func orderScripts(paths []string) []string {
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	// the scripts are looked up by their absolute paths
+	byAbsPath := make(map[string]string, len(sorted))
+	for _, path := range sorted {
+		if absPath, err := filepath.Abs(path); err == nil {
+			byAbsPath[absPath] = path
+		}
+	}
+	requires := make(map[string][]string, len(sorted))
+	for _, path := range sorted {
+		// unreadable scripts fail to load anyway
+		deps, _ := readScriptRequires(path)
+		for _, dep := range deps {
+			if depPath, found := byAbsPath[dep]; found && depPath != path {
+				requires[path] = append(requires[path], depPath)
+			}
+		}
+	}
+
+	r := make([]string, 0, len(sorted))
+	placed := make(map[string]bool, len(sorted))
+	for len(r) < len(sorted) {
+		progress := false
+		for _, path := range sorted {
+			if placed[path] {
+				continue
+			}
+			ready := true
+			for _, dep := range requires[path] {
+				if !placed[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				r = append(r, path)
+				placed[path] = true
+				progress = true
+				// restart from the beginning to keep
+				// the alphabetical order when possible
+				break
+			}
+		}
+		if !progress {
+			// circular dependencies
+			for _, path := range sorted {
+				if !placed[path] {
+					r = append(r, path)
+					placed[path] = true
+				}
+			}
+		}
+	}
+	return r
+}
+
+// checkScriptRequires returns an error if any of the
+// scripts required by the script isn't loaded
+func (engine *ESEngine) checkScriptRequires(path string) error {
+	requires, err := readScriptRequires(path)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, dep := range requires {
+		if !engine.loadedScripts[dep] {
+			missing = append(missing, filepath.Base(dep))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing dependencies: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// BeginScriptBatch makes LoadFile() collect the scripts instead
+// of loading them. The collected scripts are loaded by
+// LoadScriptBatch() in the order of their dependencies.
+func (engine *ESEngine) BeginScriptBatch() {
+	engine.scriptBatch = []string{}
+}
+
+// LoadScriptBatch loads the scripts collected since
+// BeginScriptBatch() was called, so that each script is loaded
+// after the scripts listed in its wbrules-requires header.
+// The scripts that fail to load are reported via the
+// returned errors.
+func (engine *ESEngine) LoadScriptBatch() (errs []error) {
+	paths := engine.scriptBatch
+	engine.scriptBatch = nil
+	for _, path := range orderScripts(paths) {
+		if err := engine.LoadFile(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", path, err))
+		}
+	}
+	return
+}
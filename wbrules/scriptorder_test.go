@@ -0,0 +1,69 @@
+package wbrules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestScriptOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wbrules-order")
+	if err != nil {
+		t.Fatalf("TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+	scripts := map[string]string{
+		"a_heating.js": "// -*- mode: js2-mode -*-\n" +
+			"// wbrules-requires: lib/z_utils.js, b_devices.js\n\n" +
+			"defineRule({ whenChanged: \"heating/on\", then: function () {} });\n" +
+			"// wbrules-requires: ignored.js\n",
+		"b_devices.js":     "// wbrules-requires: lib/z_utils.js\n",
+		"c_lights.js":      "defineVirtualDevice(\"lights\", { cells: {} });\n",
+		"d_cycle.js":       "// wbrules-requires: e_cycle.js\n",
+		"e_cycle.js":       "// wbrules-requires: d_cycle.js\n",
+		"lib/z_utils.js":   "// utils\n",
+		"f_missing.js":     "// wbrules-requires: nosuchscript.js\n",
+		"lib/y_helpers.js": "// wbrules-requires:   ../c_lights.js\n",
+	}
+	var paths []string
+	for name, content := range scripts {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("MkdirAll(): %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile(): %s", err)
+		}
+		paths = append(paths, path)
+	}
+
+	requires, err := readScriptRequires(filepath.Join(dir, "a_heating.js"))
+	if err != nil {
+		t.Fatalf("readScriptRequires(): %s", err)
+	}
+	expected := []string{filepath.Join(dir, "lib", "z_utils.js"), filepath.Join(dir, "b_devices.js")}
+	if !reflect.DeepEqual(requires, expected) {
+		t.Errorf("bad requires: %v", requires)
+	}
+
+	var order []string
+	for _, path := range orderScripts(paths) {
+		rel, _ := filepath.Rel(dir, path)
+		order = append(order, filepath.ToSlash(rel))
+	}
+	expected = []string{
+		"c_lights.js",
+		"f_missing.js",
+		"lib/y_helpers.js",
+		"lib/z_utils.js",
+		"b_devices.js",
+		"a_heating.js",
+		"d_cycle.js",
+		"e_cycle.js",
+	}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("bad script order: %v", order)
+	}
+}
@@ -0,0 +1,100 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo"
+	"github.com/stretchr/objx"
+	"strings"
+)
+
+const (
+	// SCRIPT_SWITCH_PATH_SEPARATOR replaces '/' in the names
+	// of the switches of the scripts located in subdirectories
+	// of the source root as cell names can't contain '/'
+	SCRIPT_SWITCH_PATH_SEPARATOR = ":"
+)
+
+func scriptSwitchName(virtualPath string) string {
+	return strings.Replace(virtualPath, "/", SCRIPT_SWITCH_PATH_SEPARATOR, -1)
+}
+
+// SetScriptSwitches enables or disables the script switches.
+// When they're enabled, the engine settings device gets a switch
+// for each script under the source root that makes it possible
+// to disable and enable the script from MQTT UI, see
+// LiveChangeScriptState(). Must be called before loading the scripts.
+func (engine *ESEngine) SetScriptSwitches(enabled bool) {
+	if !enabled {
+		engine.scriptSwitches = nil
+		engine.onSettingsChange = nil
+		return
+	}
+	engine.scriptSwitches = make(map[string]string)
+	engine.onSettingsChange = engine.handleScriptSwitch
+}
+
+// syncScriptSwitches adds the switches for the new scripts,
+// removes the switches of the removed scripts and updates
+// the state of the remaining ones
+func (engine *ESEngine) syncScriptSwitches() {
+	if engine.scriptSwitches == nil || engine.sourceRoot == "" {
+		return
+	}
+	entries, err := engine.ListSourceFiles()
+	if err != nil {
+		wbgo.Error.Printf("error listing the scripts: %s", err)
+		return
+	}
+	devName := engine.settingsDevName()
+	dev, ok := engine.model.devices[devName].(*CellModelLocalDevice)
+	if !ok {
+		return
+	}
+	present := make(map[string]bool)
+	for _, entry := range entries {
+		name := scriptSwitchName(entry.VirtualPath)
+		present[name] = true
+		enabled := !entry.Disabled
+		if cell, found := dev.LookupCell(name); found {
+			if cell.Value() != enabled && engine.model.IsStarted() {
+				cell.SetValue(enabled)
+			}
+			continue
+		}
+		engine.scriptSwitches[name] = entry.VirtualPath
+		err := engine.AddControl(devName, name, objx.Map{
+			"type":  "switch",
+			"value": enabled,
+		})
+		if err != nil {
+			wbgo.Error.Printf("error adding the switch for %s: %s", entry.VirtualPath, err)
+		}
+	}
+	for name := range engine.scriptSwitches {
+		if present[name] {
+			continue
+		}
+		delete(engine.scriptSwitches, name)
+		if err := engine.RemoveControl(devName, name); err != nil {
+			wbgo.Error.Printf("error removing the switch %s: %s", name, err)
+		}
+	}
+}
+
+// handleScriptSwitch enables or disables the script
+// when its switch is toggled
+func (engine *ESEngine) handleScriptSwitch(cellName string) {
+	var virtualPath string
+	found, enabled := false, false
+	engine.Call(func() {
+		if virtualPath, found = engine.scriptSwitches[cellName]; found {
+			cell := engine.model.MustGetCell(&CellSpec{engine.settingsDevName(), cellName})
+			enabled, _ = cell.Value().(bool)
+		}
+	})
+	if !found {
+		return
+	}
+	if err := engine.LiveChangeScriptState(virtualPath, enabled); err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "error changing the state of %s: %s", virtualPath, err)
+	}
+}
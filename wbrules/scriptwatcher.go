@@ -0,0 +1,442 @@
+package wbrules
+
+import (
+	"bufio"
+	"github.com/contactless/wbgo"
+	"gopkg.in/fsnotify.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SCRIPT_IGNORE_FILE lists the patterns of the files and
+	// directories that are skipped when looking for the scripts
+	SCRIPT_IGNORE_FILE = ".wbrulesignore"
+	// SCRIPT_SETTLE_DELAY is the delay between a filesystem
+	// event and the scan of the watched directories
+	SCRIPT_SETTLE_DELAY = 200 * time.Millisecond
+)
+
+var scriptFilePattern = regexp.MustCompile(`\.js$`)
+
+// isEditorTempFile returns true for the names of the hidden files
+// and the files used by the editors when saving the scripts, such
+// as vim swap files, emacs lock and backup files and the temporary
+// files of the atomic save
+func isEditorTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") ||
+		strings.HasSuffix(name, "~") ||
+		(strings.HasPrefix(name, "#") && strings.HasSuffix(name, "#"))
+}
+
+// scriptIgnoreRules holds the patterns read from the ignore
+// file of the directory. The patterns of the parent directories
+// apply to the subdirectories, too.
+type scriptIgnoreRules struct {
+	parent   *scriptIgnoreRules
+	dir      string
+	patterns []string
+}
+
+// loadScriptIgnoreRules reads the ignore file of the directory, if
+// any. Each non-empty line of the file that doesn't start with '#'
+// is a shell pattern. Patterns containing '/' are matched against
+// the path relative to the directory, other patterns are matched
+// against the file names. Patterns ending with '/' only match
+// the directories.
+func loadScriptIgnoreRules(parent *scriptIgnoreRules, dir string) (*scriptIgnoreRules, error) {
+	f, err := os.Open(filepath.Join(dir, SCRIPT_IGNORE_FILE))
+	if os.IsNotExist(err) {
+		return parent, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules := &scriptIgnoreRules{parent: parent, dir: dir}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			rules.patterns = append(rules.patterns, line)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+func (rules *scriptIgnoreRules) ignores(path string, isDir bool) bool {
+	for ; rules != nil; rules = rules.parent {
+		relPath, err := filepath.Rel(rules.dir, path)
+		if err != nil {
+			continue
+		}
+		relPath = filepath.ToSlash(relPath)
+		for _, pattern := range rules.patterns {
+			if strings.HasSuffix(pattern, "/") {
+				if !isDir {
+					continue
+				}
+				pattern = strings.TrimSuffix(pattern, "/")
+			}
+			subject := filepath.Base(path)
+			if strings.Contains(pattern, "/") {
+				pattern, subject = strings.TrimPrefix(pattern, "/"), relPath
+			}
+			if matched, _ := filepath.Match(pattern, subject); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// walkScripts invokes the function for each file under the root
+// which name matches the pattern, descending into subdirectories.
+// The files matched by the ignore files and the editor temporary
+// files are skipped. Symbolic links to the files are followed,
+// symbolic links to the directories are skipped. If the root is
+// a file, the function is invoked just for it.
+func walkScripts(root string, pattern *regexp.Regexp, walkFn func(path string, info os.FileInfo) error) error {
+	return walkScriptTree(root, pattern, nil, walkFn)
+}
+
+// walkScriptTree is like walkScripts, but it also invokes dirFn,
+// if it's not nil, for each directory that's not ignored,
+// including the root
+func walkScriptTree(root string, pattern *regexp.Regexp, dirFn func(dir string), walkFn func(path string, info os.FileInfo) error) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return walkFn(root, info)
+	}
+	return walkScriptDir(root, nil, pattern, dirFn, walkFn)
+}
+
+func walkScriptDir(dir string, rules *scriptIgnoreRules, pattern *regexp.Regexp, dirFn func(dir string), walkFn func(path string, info os.FileInfo) error) error {
+	rules, err := loadScriptIgnoreRules(rules, dir)
+	if err != nil {
+		return err
+	}
+	if dirFn != nil {
+		dirFn(dir)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(path); err != nil || info.IsDir() {
+				continue
+			}
+		}
+		if isEditorTempFile(info.Name()) || rules.ignores(path, info.IsDir()) {
+			continue
+		}
+		switch {
+		case info.IsDir():
+			err = walkScriptDir(path, rules, pattern, dirFn, walkFn)
+			if os.IsNotExist(err) {
+				// removed while walking
+				err = nil
+			}
+		case pattern.MatchString(info.Name()):
+			err = walkFn(path, info)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type scriptFileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// ScriptWatcher loads the scripts from the files and directories,
+// including their subdirectories, and then watches them for
+// changes, notifying the client about the added, modified and
+// removed scripts. The directories are watched using inotify,
+// the watches being added to the subdirectories as they appear.
+// A filesystem event triggers a scan of the watched directories
+// after a short delay. A change is only reported after it's seen
+// by two subsequent scans, so the scripts that are being written
+// aren't loaded prematurely, and the scripts replaced by the
+// editors via renaming, like vim and the editors doing atomic save
+// do, aren't removed and then loaded again, which would lose
+// the state of their rules. Optionally, the directories may also
+// be rescanned periodically.
+type ScriptWatcher struct {
+	mtx         sync.Mutex
+	client      wbgo.DirWatcherClient
+	pattern     *regexp.Regexp
+	interval    time.Duration
+	settleDelay time.Duration
+	watchEvents bool
+	roots       []string
+	seen        map[string]scriptFileStat
+	loaded      map[string]scriptFileStat
+	fsWatcher   *fsnotify.Watcher
+	watchedDirs map[string]bool
+	quit        chan struct{}
+	done        chan struct{}
+}
+
+// NewScriptWatcher creates a watcher for the
+// scripts which names match the pattern
+func NewScriptWatcher(pattern string, client wbgo.DirWatcherClient) *ScriptWatcher {
+	return &ScriptWatcher{
+		client:      client,
+		pattern:     regexp.MustCompile(pattern),
+		settleDelay: SCRIPT_SETTLE_DELAY,
+		watchEvents: true,
+		seen:        make(map[string]scriptFileStat),
+		loaded:      make(map[string]scriptFileStat),
+		watchedDirs: make(map[string]bool),
+	}
+}
+
+// SetScanInterval sets the interval between the periodic scans
+// of the watched files and directories, which are done in addition
+// to the scans triggered by the filesystem events. Zero interval,
+// which is the default, disables the periodic scans. Must be
+// called before Load().
+func (watcher *ScriptWatcher) SetScanInterval(interval time.Duration) {
+	watcher.interval = interval
+}
+
+// SetWatchEvents enables or disables watching the directories
+// using inotify. When it's disabled, the changes are only picked
+// up by the periodic scans, if any, and by Scan(). Must be called
+// before Load().
+func (watcher *ScriptWatcher) SetWatchEvents(enabled bool) {
+	watcher.watchEvents = enabled
+}
+
+func (watcher *ScriptWatcher) find(root string) (map[string]scriptFileStat, []string, error) {
+	found := make(map[string]scriptFileStat)
+	var dirs []string
+	err := walkScriptTree(root, watcher.pattern, func(dir string) {
+		dirs = append(dirs, dir)
+	}, func(path string, info os.FileInfo) error {
+		found[path] = scriptFileStat{info.ModTime(), info.Size()}
+		return nil
+	})
+	return found, dirs, err
+}
+
+// updateWatches adds the watches for the new directories and
+// forgets the removed ones, which watches are removed by inotify.
+// Must be called with the mutex locked.
+func (watcher *ScriptWatcher) updateWatches(dirs []string) {
+	if watcher.fsWatcher == nil {
+		return
+	}
+	current := make(map[string]bool)
+	for _, dir := range dirs {
+		current[dir] = true
+		if watcher.watchedDirs[dir] {
+			continue
+		}
+		if err := watcher.fsWatcher.Add(dir); err != nil {
+			wbgo.Warn.Printf("can't watch %s: %s", dir, err)
+			continue
+		}
+		watcher.watchedDirs[dir] = true
+	}
+	for dir := range watcher.watchedDirs {
+		if !current[dir] {
+			delete(watcher.watchedDirs, dir)
+		}
+	}
+}
+
+// Load loads the script or the scripts in the directory and its
+// subdirectories using LoadFile() of the client and starts
+// watching them. The errors of the scripts are logged.
+func (watcher *ScriptWatcher) Load(path string) error {
+	found, dirs, err := watcher.find(path)
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		// watch the directory of the script file
+		dirs = []string{filepath.Dir(path)}
+	}
+	paths := make([]string, 0, len(found))
+	watcher.mtx.Lock()
+	watcher.roots = append(watcher.roots, path)
+	for path, stat := range found {
+		watcher.seen[path] = stat
+		watcher.loaded[path] = stat
+		paths = append(paths, path)
+	}
+	quit, done := watcher.quit, watcher.done
+	start := quit == nil && (watcher.interval > 0 || watcher.watchEvents)
+	if start {
+		quit, done = make(chan struct{}), make(chan struct{})
+		watcher.quit, watcher.done = quit, done
+		if watcher.watchEvents {
+			if watcher.fsWatcher, err = fsnotify.NewWatcher(); err != nil {
+				wbgo.Error.Printf("can't watch the scripts: %s", err)
+				watcher.fsWatcher = nil
+			}
+		}
+	}
+	watcher.updateWatches(dirs)
+	fsWatcher := watcher.fsWatcher
+	watcher.mtx.Unlock()
+
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := watcher.client.LoadFile(path); err != nil {
+			wbgo.Error.Printf("error loading %s: %s", path, err)
+		}
+	}
+	if start {
+		go watcher.run(fsWatcher, quit, done)
+	}
+	return nil
+}
+
+func (watcher *ScriptWatcher) run(fsWatcher *fsnotify.Watcher, quit, done chan struct{}) {
+	defer close(done)
+	var tickCh <-chan time.Time
+	if watcher.interval > 0 {
+		ticker := time.NewTicker(watcher.interval)
+		defer ticker.Stop()
+		tickCh = ticker.C
+	}
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	if fsWatcher != nil {
+		defer fsWatcher.Close()
+		events, watchErrors = fsWatcher.Events, fsWatcher.Errors
+	}
+	settleTimer := time.NewTimer(watcher.settleDelay)
+	settleTimer.Stop()
+	defer settleTimer.Stop()
+	for {
+		select {
+		case <-events:
+			settleTimer.Reset(watcher.settleDelay)
+		case err := <-watchErrors:
+			wbgo.Warn.Printf("error watching the scripts: %s", err)
+			settleTimer.Reset(watcher.settleDelay)
+		case <-settleTimer.C:
+			if watcher.scan() {
+				// confirm the changes by the next scan
+				settleTimer.Reset(watcher.settleDelay)
+			}
+		case <-tickCh:
+			watcher.scan()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Scan checks the watched files and directories for changes and
+// notifies the client about the changes that are seen by this scan
+// and the previous one, see ScriptWatcher.
+func (watcher *ScriptWatcher) Scan() {
+	watcher.scan()
+}
+
+// scan does the work of Scan() and returns true if there are
+// changes that need to be confirmed by a subsequent scan
+func (watcher *ScriptWatcher) scan() (unsettled bool) {
+	watcher.mtx.Lock()
+	roots := append([]string(nil), watcher.roots...)
+	watcher.mtx.Unlock()
+	current := make(map[string]scriptFileStat)
+	var allDirs []string
+	for _, root := range roots {
+		found, dirs, err := watcher.find(root)
+		if err != nil && !os.IsNotExist(err) {
+			// don't remove the scripts that
+			// can't be checked at the moment
+			wbgo.Warn.Printf("error scanning %s: %s", root, err)
+			return false
+		}
+		for path, stat := range found {
+			current[path] = stat
+		}
+		if len(dirs) == 0 {
+			dirs = []string{filepath.Dir(root)}
+		}
+		allDirs = append(allDirs, dirs...)
+	}
+
+	var toLoad, toRemove []string
+	watcher.mtx.Lock()
+	watcher.updateWatches(allDirs)
+	paths := make(map[string]bool)
+	for _, m := range []map[string]scriptFileStat{current, watcher.seen, watcher.loaded} {
+		for path := range m {
+			paths[path] = true
+		}
+	}
+	for path := range paths {
+		stat, present := current[path]
+		seenStat, wasSeen := watcher.seen[path]
+		loadedStat, isLoaded := watcher.loaded[path]
+		if present {
+			watcher.seen[path] = stat
+		} else {
+			delete(watcher.seen, path)
+		}
+		if present != wasSeen || stat != seenStat {
+			// wait for the next scan
+			unsettled = true
+			continue
+		}
+		switch {
+		case present && (!isLoaded || stat != loadedStat):
+			watcher.loaded[path] = stat
+			toLoad = append(toLoad, path)
+		case !present && isLoaded:
+			delete(watcher.loaded, path)
+			toRemove = append(toRemove, path)
+		}
+	}
+	watcher.mtx.Unlock()
+
+	sort.Strings(toRemove)
+	for _, path := range toRemove {
+		if err := watcher.client.LiveRemoveFile(path); err != nil {
+			wbgo.Error.Printf("error removing %s: %s", path, err)
+		}
+	}
+	for _, path := range orderScripts(toLoad) {
+		if err := watcher.client.LiveLoadFile(path); err != nil {
+			wbgo.Error.Printf("error loading %s: %s", path, err)
+		}
+	}
+	return
+}
+
+// Stop stops watching the scripts
+func (watcher *ScriptWatcher) Stop() {
+	watcher.mtx.Lock()
+	quit, done := watcher.quit, watcher.done
+	watcher.quit = nil
+	watcher.fsWatcher = nil
+	watcher.watchedDirs = make(map[string]bool)
+	watcher.mtx.Unlock()
+	if quit != nil {
+		close(quit)
+		<-done
+	}
+}
@@ -0,0 +1,199 @@
+package wbrules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeWatcherClient struct {
+	root  string
+	calls []string
+}
+
+func (client *fakeWatcherClient) record(what, path string) error {
+	relPath, _ := filepath.Rel(client.root, path)
+	client.calls = append(client.calls, what+" "+filepath.ToSlash(relPath))
+	return nil
+}
+
+func (client *fakeWatcherClient) LoadFile(path string) error {
+	return client.record("load", path)
+}
+
+func (client *fakeWatcherClient) LiveLoadFile(path string) error {
+	return client.record("live load", path)
+}
+
+func (client *fakeWatcherClient) LiveRemoveFile(path string) error {
+	return client.record("remove", path)
+}
+
+func (client *fakeWatcherClient) verify(t *testing.T, what string, expected ...string) {
+	if !reflect.DeepEqual(client.calls, expected) {
+		t.Errorf("%s: bad calls: %v (expected %v)", what, client.calls, expected)
+	}
+	client.calls = nil
+}
+
+func TestScriptWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wbrules-watch")
+	if err != nil {
+		t.Fatalf("TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile := func(name, content string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("MkdirAll(): %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile(): %s", err)
+		}
+	}
+	writeFile("a.js", "// a\n")
+	writeFile("sub/b.js", "// b\n")
+	writeFile("sub/deep/c.js", "// c\n")
+	writeFile("sub/local.js", "// ignored by sub/.wbrulesignore\n")
+	writeFile("sub/notes.txt", "not a script\n")
+	writeFile("drafts/d.js", "// ignored directory\n")
+	writeFile("tmp_e.js", "// ignored by pattern\n")
+	writeFile(".#a.js", "emacs lock\n")
+	writeFile("a.js~", "backup\n")
+	writeFile(".hidden/f.js", "// hidden directory\n")
+	writeFile(SCRIPT_IGNORE_FILE, "# comment\ndrafts/\ntmp_*.js\n")
+	writeFile("sub/"+SCRIPT_IGNORE_FILE, "local.js\n")
+
+	client := &fakeWatcherClient{root: dir}
+	watcher := NewScriptWatcher("\\.js$", client)
+	watcher.SetWatchEvents(false)
+	if err := watcher.Load(dir); err != nil {
+		t.Fatalf("Load(): %s", err)
+	}
+	defer watcher.Stop()
+	client.verify(t, "initial load", "load a.js", "load sub/b.js", "load sub/deep/c.js")
+
+	watcher.Scan()
+	client.verify(t, "no changes")
+
+	writeFile("a.js", "// a, modified\n")
+	watcher.Scan()
+	client.verify(t, "modified, first scan")
+	watcher.Scan()
+	client.verify(t, "modified, second scan", "live load a.js")
+
+	// vim-like save: the file is renamed to the backup
+	// one and then the new version is written
+	if err := os.Rename(filepath.Join(dir, "sub/b.js"), filepath.Join(dir, "sub/b.js~")); err != nil {
+		t.Fatalf("Rename(): %s", err)
+	}
+	watcher.Scan()
+	writeFile("sub/b.js", "// b, modified\n")
+	watcher.Scan()
+	watcher.Scan()
+	client.verify(t, "replaced", "live load sub/b.js")
+
+	// atomic save: the new version is written to a
+	// temporary file that's renamed over the script
+	writeFile("sub/deep/.c.js.tmp", "// c, modified\n")
+	if err := os.Rename(filepath.Join(dir, "sub/deep/.c.js.tmp"), filepath.Join(dir, "sub/deep/c.js")); err != nil {
+		t.Fatalf("Rename(): %s", err)
+	}
+	watcher.Scan()
+	watcher.Scan()
+	client.verify(t, "atomic save", "live load sub/deep/c.js")
+
+	writeFile("sub/new/g.js", "// g\n")
+	if err := os.RemoveAll(filepath.Join(dir, "sub/deep")); err != nil {
+		t.Fatalf("RemoveAll(): %s", err)
+	}
+	watcher.Scan()
+	watcher.Scan()
+	client.verify(t, "added and removed", "remove sub/deep/c.js", "live load sub/new/g.js")
+
+	// the scripts that become ignored are removed
+	writeFile(SCRIPT_IGNORE_FILE, "drafts/\ntmp_*.js\nsub/new/\n")
+	watcher.Scan()
+	watcher.Scan()
+	client.verify(t, "ignored", "remove sub/new/g.js")
+}
+
+type chanWatcherClient struct {
+	root  string
+	calls chan string
+}
+
+func (client *chanWatcherClient) record(what, path string) error {
+	relPath, _ := filepath.Rel(client.root, path)
+	client.calls <- what + " " + filepath.ToSlash(relPath)
+	return nil
+}
+
+func (client *chanWatcherClient) LoadFile(path string) error {
+	return client.record("load", path)
+}
+
+func (client *chanWatcherClient) LiveLoadFile(path string) error {
+	return client.record("live load", path)
+}
+
+func (client *chanWatcherClient) LiveRemoveFile(path string) error {
+	return client.record("remove", path)
+}
+
+func (client *chanWatcherClient) verify(t *testing.T, what string, expected string) {
+	select {
+	case call := <-client.calls:
+		if call != expected {
+			t.Errorf("%s: bad call: %s (expected %s)", what, call, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: timed out waiting for %s", what, expected)
+	}
+}
+
+func TestScriptWatcherEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wbrules-watch")
+	if err != nil {
+		t.Fatalf("TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile := func(name, content string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("MkdirAll(): %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile(): %s", err)
+		}
+	}
+	writeFile("sub/deep/a.js", "// a\n")
+
+	client := &chanWatcherClient{root: dir, calls: make(chan string, 10)}
+	watcher := NewScriptWatcher("\\.js$", client)
+	watcher.settleDelay = 10 * time.Millisecond
+	if err := watcher.Load(dir); err != nil {
+		t.Fatalf("Load(): %s", err)
+	}
+	defer watcher.Stop()
+	client.verify(t, "initial load", "load sub/deep/a.js")
+
+	// the change is only reported by the watch
+	// on the subdirectory
+	writeFile("sub/deep/a.js", "// a, modified\n")
+	client.verify(t, "modified", "live load sub/deep/a.js")
+
+	// the watches are added to the new subdirectories
+	writeFile("new/b.js", "// b\n")
+	client.verify(t, "added", "live load new/b.js")
+	writeFile("new/b.js", "// b, modified\n")
+	client.verify(t, "modified in new dir", "live load new/b.js")
+
+	if err := os.RemoveAll(filepath.Join(dir, "sub")); err != nil {
+		t.Fatalf("RemoveAll(): %s", err)
+	}
+	client.verify(t, "removed", "remove sub/deep/a.js")
+}
@@ -0,0 +1,287 @@
+package wbrules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	SOAK_DEV_NAME              = "_wbrulesSoak"
+	SOAK_TICKS_CELL_NAME       = "ticks"
+	SOAK_SCRIPT_NAME           = "soak.js"
+	SOAK_TICK_INTERVAL_MS      = 10
+	DEFAULT_SOAK_STALL_TIMEOUT = 5 * time.Second
+)
+
+// SoakOptions specify the parameters of a soak test run.
+type SoakOptions struct {
+	// Duration is the duration of the run.
+	Duration time.Duration
+	// Rules is the number of synthetic rules.
+	Rules int
+	// Cells is the number of cells of the soak device.
+	Cells int
+	// ChangeRate is the number of cell changes per second.
+	// Zero means 'as fast as possible'.
+	ChangeRate float64
+	// ReloadInterval is the interval between reloading or
+	// removing the soak script. Zero disables reloading.
+	ReloadInterval time.Duration
+	// MaxHeapGrowth is the max allowed heap growth in bytes
+	// after the run. Zero disables the check.
+	MaxHeapGrowth uint64
+	// StallTimeout is the max time the engine may spend
+	// handling a single change or reload.
+	// DEFAULT_SOAK_STALL_TIMEOUT is used if it's zero.
+	StallTimeout time.Duration
+	// Seed is the random seed, so failed runs can be repeated.
+	Seed int64
+}
+
+// SoakResult describes a soak test run. Violations
+// list the invariants that didn't hold.
+type SoakResult struct {
+	Changes    int
+	Reloads    int
+	Ticks      int
+	HeapBefore uint64
+	HeapAfter  uint64
+	Violations []string
+}
+
+// OK returns true if no invariant violations were detected
+func (r *SoakResult) OK() bool {
+	return len(r.Violations) == 0
+}
+
+func (r *SoakResult) String() string {
+	status := "OK"
+	if !r.OK() {
+		status = fmt.Sprintf("%d violation(s)", len(r.Violations))
+	}
+	return fmt.Sprintf("%d changes, %d reloads, %d timer ticks, heap %d -> %d bytes: %s",
+		r.Changes, r.Reloads, r.Ticks, r.HeapBefore, r.HeapAfter, status)
+}
+
+func (opts SoakOptions) validate() error {
+	if opts.Duration <= 0 || opts.Rules <= 0 || opts.Cells <= 0 {
+		return errors.New("soak: duration, rule and cell counts must be positive")
+	}
+	if opts.ChangeRate < 0 || opts.ReloadInterval < 0 || opts.StallTimeout < 0 {
+		return errors.New("soak: negative change rate or interval")
+	}
+	return nil
+}
+
+// GenerateSoakScript returns the source of a synthetic rule set.
+// The variants differ in the kinds of rules, so toggling between
+// them replaces all of the rules. The script also starts a timer
+// that counts ticks in the 'ticks' cell of the soak device.
+func GenerateSoakScript(opts SoakOptions, variant int) string {
+	var buf bytes.Buffer
+	buf.WriteString("if (typeof soakTicks == \"undefined\")\n  soakTicks = 0;\n\n")
+	fmt.Fprintf(&buf, "defineVirtualDevice(%q, {\n  cells: {\n", SOAK_DEV_NAME)
+	fmt.Fprintf(&buf, "    %q: { type: \"value\", value: soakTicks },\n", SOAK_TICKS_CELL_NAME)
+	for i := 0; i < opts.Cells; i++ {
+		fmt.Fprintf(&buf, "    %q: { type: \"temperature\", value: 0 },\n", benchCellName(i))
+	}
+	buf.WriteString("  }\n});\n\nvar soakCounter = 0;\n\n")
+	for i := 0; i < opts.Rules; i++ {
+		cellA := SOAK_DEV_NAME + "/" + benchCellName(i%opts.Cells)
+		cellB := SOAK_DEV_NAME + "/" + benchCellName((i+1)%opts.Cells)
+		if (i+variant)%2 == 0 {
+			fmt.Fprintf(&buf, "defineRule(\"soak%d\", {\n"+
+				"  whenChanged: %q,\n"+
+				"  then: function (newValue) {\n"+
+				"    soakCounter += newValue;\n"+
+				"  }\n"+
+				"});\n\n", i, cellA)
+		} else {
+			fmt.Fprintf(&buf, "defineRule(\"soak%d\", {\n"+
+				"  asSoonAs: function () {\n"+
+				"    return dev[%q] > dev[%q];\n"+
+				"  },\n"+
+				"  then: function () {\n"+
+				"    soakCounter++;\n"+
+				"  }\n"+
+				"});\n\n", i, cellA, cellB)
+		}
+	}
+	fmt.Fprintf(&buf, "setInterval(function () {\n"+
+		"  dev[%q] = ++soakTicks;\n"+
+		"}, %d);\n", SOAK_DEV_NAME+"/"+SOAK_TICKS_CELL_NAME, SOAK_TICK_INTERVAL_MS)
+	return buf.String()
+}
+
+type soakRun struct {
+	sync.Mutex
+	engine *ESEngine
+	opts   SoakOptions
+	path   string
+	result *SoakResult
+}
+
+func (run *soakRun) violation(format string, v ...interface{}) {
+	// violations may be recorded by the model goroutine
+	// after a stall was detected
+	run.Lock()
+	defer run.Unlock()
+	run.result.Violations = append(run.result.Violations, fmt.Sprintf(format, v...))
+}
+
+// callSync runs the thunk in the model goroutine recording
+// panics and stalls as violations. It returns false if
+// the run must be aborted.
+func (run *soakRun) callSync(what string, thunk func() error) bool {
+	done := make(chan bool, 1)
+	go func() {
+		run.engine.Call(func() {
+			defer func() {
+				if r := recover(); r != nil {
+					run.violation("%s: panic: %v", what, r)
+					done <- false
+				}
+			}()
+			if err := thunk(); err != nil {
+				run.violation("%s: %s", what, err)
+			}
+			done <- true
+		})
+	}()
+	timer := time.NewTimer(run.opts.StallTimeout)
+	defer timer.Stop()
+	select {
+	case ok := <-done:
+		return ok
+	case <-timer.C:
+		run.violation("%s: engine stalled for %s", what, run.opts.StallTimeout)
+		return false
+	}
+}
+
+func (run *soakRun) writeScript(variant int) error {
+	return ioutil.WriteFile(run.path, []byte(GenerateSoakScript(run.opts, variant)), 0644)
+}
+
+func (run *soakRun) reload(rnd *rand.Rand, variant int) bool {
+	if err := run.writeScript(variant); err != nil {
+		run.violation("writing soak script: %s", err)
+		return false
+	}
+	remove := rnd.Intn(2) == 0
+	ok := run.callSync("reloading soak script", func() error {
+		if remove {
+			run.engine.cleanup.RunCleanups(run.path)
+			run.engine.Refresh()
+		}
+		return run.engine.loadScriptAndRefresh(run.path, true)
+	})
+	run.result.Reloads++
+	return ok
+}
+
+func (run *soakRun) change(rnd *rand.Rand) bool {
+	cellSpec := &CellSpec{SOAK_DEV_NAME, benchCellName(rnd.Intn(run.opts.Cells))}
+	value := rnd.Intn(100)
+	ok := run.callSync("changing "+cellSpec.DevName+"/"+cellSpec.CellName, func() error {
+		cell := run.engine.model.EnsureCell(cellSpec)
+		cell.maybeSetValueQuiet(value, true)
+		cell.gotValue = true
+		run.engine.runRules(cellSpec, NO_TIMER_NAME)
+		return nil
+	})
+	run.result.Changes++
+	return ok
+}
+
+func heapAlloc() uint64 {
+	var mem runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&mem)
+	return mem.HeapAlloc
+}
+
+// RunSoakTest loads the synthetic rule set into the running
+// engine and stresses the engine for the specified time by
+// changing random cells, reloading and removing the script
+// and firing a high rate timer. The following invariants
+// are checked: the engine doesn't panic or stall, the timer
+// keeps firing and the heap doesn't grow more than allowed.
+// The rule set is unloaded after the run completes.
+func RunSoakTest(engine *ESEngine, opts SoakOptions) (*SoakResult, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.StallTimeout == 0 {
+		opts.StallTimeout = DEFAULT_SOAK_STALL_TIMEOUT
+	}
+
+	dir, err := ioutil.TempDir("", "wbrules-soak")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	run := &soakRun{
+		engine: engine,
+		opts:   opts,
+		path:   filepath.Join(dir, SOAK_SCRIPT_NAME),
+		result: &SoakResult{Violations: []string{}},
+	}
+	if err = run.writeScript(0); err != nil {
+		return nil, err
+	}
+	if err = engine.LiveLoadFile(run.path); err != nil {
+		return nil, err
+	}
+	defer engine.LiveRemoveFile(run.path)
+
+	var interval time.Duration
+	if opts.ChangeRate > 0 {
+		interval = time.Duration(float64(time.Second) / opts.ChangeRate)
+	}
+	rnd := rand.New(rand.NewSource(opts.Seed))
+	run.result.HeapBefore = heapAlloc()
+	start := time.Now()
+	nextReload := start.Add(opts.ReloadInterval)
+	variant := 0
+	for i := 0; time.Since(start) < opts.Duration; i++ {
+		if interval > 0 {
+			if d := start.Add(time.Duration(i) * interval).Sub(time.Now()); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		if opts.ReloadInterval > 0 && !time.Now().Before(nextReload) {
+			variant = 1 - variant
+			if !run.reload(rnd, variant) {
+				return run.result, nil
+			}
+			nextReload = time.Now().Add(opts.ReloadInterval)
+		}
+		if !run.change(rnd) {
+			return run.result, nil
+		}
+	}
+
+	ticksSpec := &CellSpec{SOAK_DEV_NAME, SOAK_TICKS_CELL_NAME}
+	if v, ok := engine.GetCellValues([]*CellSpec{ticksSpec})[*ticksSpec].(float64); ok {
+		run.result.Ticks = int(v)
+	}
+	if opts.Duration >= 10*SOAK_TICK_INTERVAL_MS*time.Millisecond && run.result.Ticks == 0 {
+		run.violation("the timer didn't fire")
+	}
+	run.result.HeapAfter = heapAlloc()
+	if opts.MaxHeapGrowth > 0 && run.result.HeapAfter > run.result.HeapBefore &&
+		run.result.HeapAfter-run.result.HeapBefore > opts.MaxHeapGrowth {
+		run.violation("heap grew by %d bytes (limit %d)",
+			run.result.HeapAfter-run.result.HeapBefore, opts.MaxHeapGrowth)
+	}
+	return run.result, nil
+}
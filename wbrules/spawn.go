@@ -1,20 +1,30 @@
 package wbrules
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	wbgo "github.com/contactless/wbgo"
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type CommandResult struct {
 	ExitStatus          int
 	CapturedOutput      string
 	CapturedErrorOutput string
+	// Killed is true if the process was killed because
+	// of the timeout or context cancellation
+	Killed bool
+	// TimedOut is true if the process was killed
+	// because of the timeout
+	TimedOut bool
 }
 
 func captureCommandOutput(pipe io.ReadCloser, wg *sync.WaitGroup, result *string, e *error) {
@@ -30,24 +40,106 @@ func captureCommandOutput(pipe io.ReadCloser, wg *sync.WaitGroup, result *string
 	}()
 }
 
+// readCommandOutput invokes onLine for each line of the output
+// as soon as the line is received. The line terminators are
+// stripped. If result isn't nil, the whole output is stored
+// there after the process closes the pipe.
+func readCommandOutput(pipe io.ReadCloser, wg *sync.WaitGroup, result *string, onLine func(string), e *error) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var buf bytes.Buffer
+		reader := bufio.NewReader(pipe)
+		for {
+			line, err := reader.ReadString('\n')
+			if result != nil {
+				buf.WriteString(line)
+			}
+			if line != "" {
+				onLine(strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"))
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				*e = err
+				return
+			}
+		}
+		if result != nil {
+			*result = buf.String()
+		}
+	}()
+}
+
+// SpawnOptions specifies the optional parameters
+// of the spawned process
+type SpawnOptions struct {
+	CaptureOutput      bool
+	CaptureErrorOutput bool
+	Input              *string
+	// Env lists the environment variables in "NAME=value"
+	// form that are added to the environment of wb-rules
+	Env []string
+	// Dir is the working directory of the process
+	// (empty = the working directory of wb-rules)
+	Dir string
+	// Timeout is the max running time of the process
+	// after which it's killed (0 = unlimited)
+	Timeout time.Duration
+	// OnOutputLine and OnErrorLine, if specified, are invoked
+	// for each line of stdout and stderr of the process
+	// while it's running
+	OnOutputLine func(line string)
+	OnErrorLine  func(line string)
+}
+
 func Spawn(name string, args []string, captureOutput bool, captureErrorOutput bool, input *string) (*CommandResult, error) {
-	r := &CommandResult{0, "", ""}
+	return SpawnContext(context.Background(), name, args, captureOutput, captureErrorOutput, input)
+}
+
+// SpawnContext works like Spawn but kills the process
+// if the context is done before the process exits.
+func SpawnContext(ctx context.Context, name string, args []string, captureOutput bool, captureErrorOutput bool, input *string) (*CommandResult, error) {
+	return SpawnWithOptions(ctx, name, args, SpawnOptions{
+		CaptureOutput:      captureOutput,
+		CaptureErrorOutput: captureErrorOutput,
+		Input:              input,
+	})
+}
+
+// SpawnWithOptions runs the process. The process is placed in its
+// own process group. When the context is done or the timeout expires,
+// the whole group is killed, so the children of the process (e.g.
+// the commands run by /bin/sh) don't keep the output pipes open.
+func SpawnWithOptions(ctx context.Context, name string, args []string, options SpawnOptions) (*CommandResult, error) {
+	r := &CommandResult{0, "", "", false, false}
 	var err error
 	var stdinPipe io.WriteCloser
 	var stdoutPipe io.ReadCloser
 	var stderrPipe io.ReadCloser
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
 	cmd := exec.Command(name, args...)
-	if input != nil {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Dir = options.Dir
+	if len(options.Env) > 0 {
+		cmd.Env = append(os.Environ(), options.Env...)
+	}
+	if options.Input != nil {
 		if stdinPipe, err = cmd.StdinPipe(); err != nil {
 			return nil, fmt.Errorf("cmd.StdinPipe() failed: %s", err)
 		}
 	}
-	if captureOutput {
+	if options.CaptureOutput || options.OnOutputLine != nil {
 		if stdoutPipe, err = cmd.StdoutPipe(); err != nil {
 			return nil, fmt.Errorf("cmd.StdoutPipe() failed: %s", err)
 		}
 	}
-	if captureErrorOutput {
+	if options.CaptureErrorOutput || options.OnErrorLine != nil {
 		if stderrPipe, err = cmd.StderrPipe(); err != nil {
 			return nil, fmt.Errorf("cmd.StderrPipe() failed: %s", err)
 		}
@@ -55,40 +147,112 @@ func Spawn(name string, args []string, captureOutput bool, captureErrorOutput bo
 		cmd.Stderr = os.Stderr
 	}
 
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
 	if err = cmd.Start(); err != nil {
 		return nil, fmt.Errorf("cmd.Start() failed: %s", err)
 	}
 
+	exited := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			r.Killed = true
+			r.TimedOut = ctx.Err() == context.DeadlineExceeded
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+
 	if stdinPipe != nil || stdoutPipe != nil || stderrPipe != nil {
 		var wg sync.WaitGroup
 		if stdinPipe != nil {
 			wg.Add(1)
 			go func() {
-				io.WriteString(stdinPipe, *input)
+				io.WriteString(stdinPipe, *options.Input)
 				stdinPipe.Close()
 				wg.Done()
 			}()
 		}
-		if stderrPipe != nil {
+		switch {
+		case options.OnErrorLine != nil && options.CaptureErrorOutput:
+			readCommandOutput(stderrPipe, &wg, &r.CapturedErrorOutput, options.OnErrorLine, &err)
+		case options.OnErrorLine != nil:
+			readCommandOutput(stderrPipe, &wg, nil, options.OnErrorLine, &err)
+		case stderrPipe != nil:
 			captureCommandOutput(stderrPipe, &wg, &r.CapturedErrorOutput, &err)
 		}
-		if stdoutPipe != nil {
+		switch {
+		case options.OnOutputLine != nil && options.CaptureOutput:
+			readCommandOutput(stdoutPipe, &wg, &r.CapturedOutput, options.OnOutputLine, &err)
+		case options.OnOutputLine != nil:
+			readCommandOutput(stdoutPipe, &wg, nil, options.OnOutputLine, &err)
+		case stdoutPipe != nil:
 			captureCommandOutput(stdoutPipe, &wg, &r.CapturedOutput, &err)
 		}
 		wg.Wait()
-		if err != nil {
-			return nil, fmt.Errorf("error capturing output: %s", err)
-		}
 	}
 
-	if err = cmd.Wait(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
+	waitErr := cmd.Wait()
+	close(exited)
+	<-watcherDone
+	if err != nil {
+		return nil, fmt.Errorf("error capturing output: %s", err)
+	}
+	if waitErr != nil {
+		if exitErr, ok := waitErr.(*exec.ExitError); ok {
 			r.ExitStatus = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
 			wbgo.Debug.Printf("command '%s': error: exit status: %d", cmd, r.ExitStatus)
 		} else {
-			return nil, err
+			return nil, waitErr
 		}
 	}
 
 	return r, nil
 }
+
+// processTable keeps track of the processes spawned by the
+// scripts, so they can be killed using the handles
+// returned by spawn()
+type processTable struct {
+	sync.Mutex
+	nextId    int
+	processes map[int]context.CancelFunc
+}
+
+func newProcessTable() *processTable {
+	return &processTable{nextId: 1, processes: make(map[int]context.CancelFunc)}
+}
+
+// add registers the process and returns its id
+func (table *processTable) add(cancel context.CancelFunc) int {
+	table.Lock()
+	defer table.Unlock()
+	id := table.nextId
+	table.nextId++
+	table.processes[id] = cancel
+	return id
+}
+
+// remove is invoked after the process exits
+func (table *processTable) remove(id int) {
+	table.Lock()
+	defer table.Unlock()
+	delete(table.processes, id)
+}
+
+// kill kills the process. It returns false
+// if the process isn't running.
+func (table *processTable) kill(id int) bool {
+	table.Lock()
+	cancel, found := table.processes[id]
+	delete(table.processes, id)
+	table.Unlock()
+	if found {
+		cancel()
+	}
+	return found
+}
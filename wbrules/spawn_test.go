@@ -0,0 +1,103 @@
+package wbrules
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpawnOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spawntest")
+	if err != nil {
+		t.Fatalf("TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := SpawnWithOptions(context.Background(), "/bin/sh", []string{"-c", "echo $FOO; pwd"}, SpawnOptions{
+		CaptureOutput: true,
+		Env:           []string{"FOO=bar"},
+		Dir:           dir,
+	})
+	if err != nil {
+		t.Fatalf("SpawnWithOptions(): %s", err)
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("EvalSymlinks(): %s", err)
+	}
+	if r.CapturedOutput != "bar\n"+realDir+"\n" {
+		t.Errorf("bad output: %q", r.CapturedOutput)
+	}
+}
+
+func TestSpawnTimeout(t *testing.T) {
+	start := time.Now()
+	// the grandchild 'sleep' keeps stdout open, so the
+	// whole process group must be killed
+	r, err := SpawnWithOptions(context.Background(), "/bin/sh", []string{"-c", "sleep 10 | cat"}, SpawnOptions{
+		CaptureOutput: true,
+		Timeout:       100 * time.Millisecond,
+	})
+	switch {
+	case err != nil:
+		t.Fatalf("SpawnWithOptions(): %s", err)
+	case !r.Killed || !r.TimedOut:
+		t.Errorf("process not killed after timeout: %#v", r)
+	case time.Since(start) > 5*time.Second:
+		t.Errorf("process group not killed")
+	}
+}
+
+func TestProcessTableKill(t *testing.T) {
+	table := newProcessTable()
+	ctx, cancel := context.WithCancel(context.Background())
+	id := table.add(cancel)
+	done := make(chan *CommandResult)
+	go func() {
+		r, err := SpawnWithOptions(ctx, "/bin/sleep", []string{"10"}, SpawnOptions{})
+		if err != nil {
+			t.Errorf("SpawnWithOptions(): %s", err)
+		}
+		table.remove(id)
+		done <- r
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if !table.kill(id) {
+		t.Fatalf("kill() returned false for a running process")
+	}
+	if r := <-done; r == nil || !r.Killed || r.TimedOut {
+		t.Errorf("bad result: %#v", r)
+	}
+	if table.kill(id) {
+		t.Errorf("kill() returned true for an exited process")
+	}
+}
+
+func TestSpawnOutputLines(t *testing.T) {
+	var outLines, errLines []string
+	r, err := SpawnWithOptions(context.Background(), "/bin/sh",
+		[]string{"-c", "echo a; echo err >&2; printf 'b\\r\\n\\nc'"}, SpawnOptions{
+			CaptureOutput: true,
+			OnOutputLine: func(line string) {
+				outLines = append(outLines, line)
+			},
+			OnErrorLine: func(line string) {
+				errLines = append(errLines, line)
+			},
+		})
+	if err != nil {
+		t.Fatalf("SpawnWithOptions(): %s", err)
+	}
+	if !reflect.DeepEqual(outLines, []string{"a", "b", "", "c"}) {
+		t.Errorf("bad output lines: %#v", outLines)
+	}
+	if !reflect.DeepEqual(errLines, []string{"err"}) {
+		t.Errorf("bad error lines: %#v", errLines)
+	}
+	if r.CapturedOutput != "a\nb\r\n\nc" || r.CapturedErrorOutput != "" {
+		t.Errorf("bad captured output: %#v", r)
+	}
+}
@@ -0,0 +1,146 @@
+package wbrules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	wbgo "github.com/contactless/wbgo"
+	"time"
+)
+
+const (
+	STATE_SNAPSHOT_VERSION     = 1
+	STATE_SNAPSHOT_SUBTOPIC    = "state"
+	DEFAULT_STATE_WAIT_TIMEOUT = 5 * time.Second
+)
+
+// StateSnapshot contains the persistent state of the engine.
+// It's published to the broker periodically, so a replacement
+// controller can bootstrap from it after hardware failure.
+type StateSnapshot struct {
+	Version int         `json:"version"`
+	Time    string      `json:"time"`
+	Storage StorageData `json:"storage"`
+}
+
+var noStateSnapshot = errors.New("no state snapshot received")
+
+// StateTopic returns the topic used for state snapshots
+func (engine *RuleEngine) StateTopic() string {
+	return engine.topic(STATE_SNAPSHOT_SUBTOPIC)
+}
+
+// PublishStateSnapshot publishes the snapshot of the
+// persistent storage as a retained message unless
+// the storage didn't change since the last time
+// the snapshot was published.
+func (engine *RuleEngine) PublishStateSnapshot() error {
+	data, err := engine.storage.Export()
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	engine.stateMtx.Lock()
+	defer engine.stateMtx.Unlock()
+	if engine.lastState != nil && bytes.Equal(encoded, engine.lastState) {
+		return nil
+	}
+	payload, err := json.Marshal(StateSnapshot{
+		Version: STATE_SNAPSHOT_VERSION,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Storage: data,
+	})
+	if err != nil {
+		return err
+	}
+	engine.Publish(engine.StateTopic(), string(payload), 1, true)
+	engine.lastState = encoded
+	return nil
+}
+
+// StartStateExport makes the engine publish state snapshots
+// at the specified interval till the engine is stopped
+func (engine *RuleEngine) StartStateExport(interval time.Duration) {
+	lifetime := engine.Lifetime()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := engine.PublishStateSnapshot(); err != nil {
+					wbgo.Error.Printf("error publishing state snapshot: %s", err)
+				}
+			case <-lifetime.Done():
+				return
+			}
+		}
+	}()
+}
+
+// ImportStateSnapshot writes the values from the snapshot
+// to the persistent storage
+func (engine *RuleEngine) ImportStateSnapshot(snapshot *StateSnapshot) error {
+	if snapshot.Version != STATE_SNAPSHOT_VERSION {
+		return fmt.Errorf("unsupported state snapshot version %d", snapshot.Version)
+	}
+	for bucket, items := range snapshot.Storage {
+		for key, value := range items {
+			if err := engine.storage.Set(bucket, key, value); err != nil {
+				return err
+			}
+		}
+	}
+	engine.Logf(ENGINE_LOG_INFO, "imported state snapshot taken at %s", snapshot.Time)
+	return nil
+}
+
+// FetchStateSnapshot waits for the retained state snapshot
+// on the specified topic
+func FetchStateSnapshot(client wbgo.MQTTClient, topic string, timeout time.Duration) (*StateSnapshot, error) {
+	ch := make(chan string, 1)
+	client.Start()
+	client.Subscribe(func(msg wbgo.MQTTMessage) {
+		select {
+		case ch <- msg.Payload:
+		default:
+		}
+	}, topic)
+	defer client.Unsubscribe(topic)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case payload := <-ch:
+		var snapshot StateSnapshot
+		if err := json.Unmarshal([]byte(payload), &snapshot); err != nil {
+			return nil, fmt.Errorf("bad state snapshot: %s", err)
+		}
+		return &snapshot, nil
+	case <-timer.C:
+		return nil, noStateSnapshot
+	}
+}
+
+// BootstrapState imports the state snapshot from the broker
+// if the persistent storage is empty, e.g. after replacing
+// a failed controller. Must be called before loading scripts.
+func (engine *RuleEngine) BootstrapState(timeout time.Duration) error {
+	data, err := engine.storage.Export()
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		wbgo.Debug.Printf("persistent storage isn't empty, not importing state")
+		return nil
+	}
+	snapshot, err := FetchStateSnapshot(engine.mqttClient, engine.StateTopic(), timeout)
+	if err != nil {
+		return err
+	}
+	return engine.ImportStateSnapshot(snapshot)
+}
@@ -0,0 +1,44 @@
+package wbrules
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEngineStop(t *testing.T) {
+	_, engine := newTimerTestEngine(t, nullMQTTClient{})
+	engine.Start()
+	<-engine.ReadyCh()
+
+	var ticks int32
+	engine.model.CallSync(func() {
+		engine.StartTimer(NO_TIMER_NAME, func() {
+			atomic.AddInt32(&ticks, 1)
+		}, 5*time.Millisecond, true)
+	})
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&ticks) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the timer didn't fire")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := engine.Stop(ctx); err != nil {
+		t.Fatalf("Stop(): %s", err)
+	}
+	if engine.IsActive() {
+		t.Errorf("the engine is still active")
+	}
+	n := atomic.LoadInt32(&ticks)
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt32(&ticks) != n {
+		t.Errorf("the timer fired after the engine was stopped")
+	}
+	if engine.goBackground(func() {}) {
+		t.Errorf("a goroutine was started after the engine was stopped")
+	}
+}
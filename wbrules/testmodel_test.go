@@ -0,0 +1,79 @@
+package wbrules
+
+import (
+	"github.com/contactless/wbgo"
+	"sync"
+	"testing"
+)
+
+// testModelObserver makes it possible to run the cell model
+// and the engine in the tests that don't need the fake MQTT
+// broker. The thunks passed to CallSync() are run directly,
+// one at a time. Unless ready is set, the model never becomes
+// ready, so the timers aren't started.
+type testModelObserver struct {
+	sync.Mutex
+	ready bool
+	calls int
+}
+
+func (obs *testModelObserver) OnNewDevice(dev wbgo.DeviceModel) {
+	dev.Observe(obs)
+}
+
+func (obs *testModelObserver) RemoveDevice(dev wbgo.DeviceModel) {}
+
+func (obs *testModelObserver) CallSync(thunk func()) {
+	obs.Lock()
+	defer obs.Unlock()
+	obs.calls++
+	thunk()
+}
+
+// callCount returns the number of CallSync() calls
+func (obs *testModelObserver) callCount() int {
+	obs.Lock()
+	defer obs.Unlock()
+	return obs.calls
+}
+
+func (obs *testModelObserver) WhenReady(thunk func()) {
+	if obs.ready {
+		thunk()
+	}
+}
+
+func (obs *testModelObserver) OnNewControl(dev wbgo.LocalDeviceModel, name, paramType, value string, readOnly bool, max float64, retain bool) string {
+	return value
+}
+
+func (obs *testModelObserver) OnValue(dev wbgo.DeviceModel, name, value string) {}
+
+func startTestModel(t *testing.T, obs *testModelObserver) *CellModel {
+	model := NewCellModel()
+	model.Observe(obs)
+	if err := model.Start(); err != nil {
+		t.Fatalf("model.Start(): %s", err)
+	}
+	return model
+}
+
+// newTestModel creates and starts a cell model that
+// never becomes ready
+func newTestModel(t *testing.T) *CellModel {
+	return startTestModel(t, &testModelObserver{})
+}
+
+// newTestEngine creates a started cell model that never
+// becomes ready and an engine that uses it
+func newTestEngine(t *testing.T, client wbgo.MQTTClient) (*CellModel, *RuleEngine) {
+	model := startTestModel(t, &testModelObserver{})
+	return model, NewRuleEngine(model, client)
+}
+
+// newTimerTestEngine is like newTestEngine but the model
+// becomes ready at once, so the engine can use the timers
+func newTimerTestEngine(t *testing.T, client wbgo.MQTTClient) (*CellModel, *RuleEngine) {
+	model := startTestModel(t, &testModelObserver{ready: true})
+	return model, NewRuleEngine(model, client)
+}
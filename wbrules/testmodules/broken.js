@@ -0,0 +1,3 @@
+// -*- mode: js2-mode -*-
+
+if (); // syntax error
@@ -0,0 +1,8 @@
+// -*- mode: js2-mode -*-
+
+// count is local to the module
+var count = 0;
+
+exports.next = function () {
+  return ++count;
+};
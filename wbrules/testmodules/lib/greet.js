@@ -0,0 +1,7 @@
+// -*- mode: js2-mode -*-
+
+var counter = require("counter");
+
+module.exports = function (name) {
+  return "hello, " + name + " #" + counter.next();
+};
@@ -0,0 +1,4 @@
+// -*- mode: js2-mode -*-
+
+exports.loaded = true;
+throw new Error("module failed");
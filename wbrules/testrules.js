@@ -92,8 +92,8 @@ defineRule("sendmqtt", {
 
 defineRule("cellChange1", {
   whenChanged: "somedev/foobarbaz",
-  then: function (newValue, devName, cellName) {
-    if (arguments.length != 3)
+  then: function (newValue, devName, cellName, oldValue) {
+    if (arguments.length != 4)
       throw new Error("invalid arguments for then");
     var v = dev[devName][cellName];
     if (v !== newValue)
@@ -106,8 +106,8 @@ defineAlias("tempx", "somedev/tempx");
 
 defineRule("cellChange2", {
   whenChanged: ["somedev/foobarbaz", "tempx" /* an alias */, "somedev/abutton"],
-  then: function (newValue, devName, cellName) {
-    if (arguments.length != 3)
+  then: function (newValue, devName, cellName, oldValue) {
+    if (arguments.length != 4)
       throw new Error("invalid arguments for then");
     var v = dev[devName][cellName];
     if (v !== newValue)
@@ -121,8 +121,8 @@ defineRule("funcValueChange", {
   whenChanged: function () {
     return dev.somedev.cellforfunc > 3;
   },
-  then: function (newValue, devName, cellName) {
-    if (arguments.length != 1)
+  then: function (newValue, devName, cellName, oldValue) {
+    if (arguments.length != 4 || devName !== undefined || cellName !== undefined)
       throw new Error("invalid arguments for then");
     log("funcValueChange: {} ({})", newValue, typeof(newValue));
   }
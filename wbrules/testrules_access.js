@@ -0,0 +1,39 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("vdev", {
+  cells: {
+    out: {
+      type: "switch",
+      value: false
+    },
+    unused: {
+      type: "text",
+      value: ""
+    }
+  }
+});
+
+defineVirtualDevice("stale", {
+  cells: {
+    x: {
+      type: "switch",
+      value: false
+    }
+  }
+});
+
+defineRule("copySwitch", {
+  whenChanged: "somedev/sw",
+  then: function (newValue) {
+    dev.vdev.out = newValue;
+  }
+});
+
+defineRule("warm", {
+  when: function () {
+    return dev.somedev.temp > 20;
+  },
+  then: function () {
+    log("warm");
+  }
+});
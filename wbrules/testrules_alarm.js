@@ -6,5 +6,13 @@ var Notify = {
 
   sendSMS: function sendSMS (to, text) {
     log("SMS TO: {} TEXT: {}", to, text);
+  },
+
+  telegram: function telegram (chatId, text) {
+    log("TELEGRAM TO: {} TEXT: {}", chatId, text);
+  },
+
+  webhook: function webhook (text) {
+    log("WEBHOOK TEXT: {}", text);
   }
 };
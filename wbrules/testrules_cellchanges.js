@@ -31,3 +31,31 @@ defineRule("switchChanged", {
     dev.somedev.sw = true;
   }
 });
+
+defineRule("meterChanged", {
+  whenChanged: "somedev/meter",
+  then: function (newValue) {
+    log("meterChanged: {}", newValue);
+  }
+});
+
+defineRule("meterReported", {
+  whenChanged: "somedev/meter",
+  fireOnRepublish: true,
+  then: function (newValue) {
+    log("meterReported: {}", newValue);
+  }
+});
+
+defineRule("levelChanged", {
+  whenChanged: [
+    "somedev/level",
+    function () {
+      return dev.somedev.level > 10;
+    }
+  ],
+  then: function (newValue, devName, cellName, oldValue) {
+    log("levelChanged: {}: {} -> {}", devName ? devName + "/" + cellName : "high",
+        oldValue === undefined ? "none" : oldValue, newValue);
+  }
+});
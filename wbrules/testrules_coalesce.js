@@ -0,0 +1,30 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("coalesce", {
+  title: "Write Coalescing Test",
+  cells: {
+    trigger: {
+      type: "switch",
+      value: false
+    },
+    counter: {
+      type: "value",
+      value: 0
+    }
+  }
+});
+
+defineRule("iterate", {
+  whenChanged: "coalesce/trigger",
+  then: function () {
+    for (var i = 1; i <= 3; ++i)
+      dev["coalesce/counter"] = i;
+  }
+});
+
+defineRule("counterChanged", {
+  whenChanged: "coalesce/counter",
+  then: function (newValue) {
+    log("counter: {}", newValue);
+  }
+});
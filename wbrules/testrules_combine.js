@@ -0,0 +1,13 @@
+// -*- mode: js2-mode -*-
+
+defineAlias("t3", "somedev/t3");
+
+combineSensors("roomTemp", ["somedev/t1", "somedev/t2", "t3"], {
+  strategy: "median",
+  maxSpread: 2
+});
+
+combineSensors("avgTemp", ["somedev/t1", "somedev/t2"], {
+  strategy: "weighted",
+  weights: [3, 1]
+});
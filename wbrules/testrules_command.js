@@ -1,46 +1,27 @@
 // -*- mode: js2-mode -*-
 
-defineRule("runCommand", {
-  whenChanged: "somedev/cmd",
-  then: function (cmd, devName, cellName) {
-    log("cmd: " + cmd);
-    if (dev.somedev.cmdNoCallback) {
-      runShellCommand(cmd);
-      log("(no callback)"); // make sure the rule didn't fail before here
-    } else {
-      runShellCommand(cmd, function (exitCode) {
-        log("exit({}): {}", exitCode, cmd);
-      });
-    }
-  }
-});
+var pumpCommand = null;
 
-function displayOutput(prefix, out) {
-  out.split("\n").forEach(function (line) {
-    if (line)
-      log(prefix + line);
+function startPump () {
+  pumpCommand = command("relays/K1", true, {
+    timeout: "5s",
+    onAck: function (value) {
+      log("acked: {}", value);
+    },
+    onTimeout: function () {
+      log("timeout");
+    }
   });
+  log("pending: {}", command.isPending("relays/K1"));
 }
 
-defineRule("runCommandWithOutput", {
-  whenChanged: "somedev/cmdWithOutput",
-  then: function (cmd, devName, cellName) {
-    var options = {
-      captureOutput: true,
-      captureErrorOutput: true,
-      exitCallback: function (exitCode, capturedOutput, capturedErrorOutput) {
-        log("exit({}): {}", exitCode, cmd);
-        displayOutput("output: ", capturedOutput);
-        if (exitCode != 0)
-          displayOutput("error: ", capturedErrorOutput);
-      }
-    };
-    var p = cmd.indexOf("!");
-    if (p >= 0) {
-      options.input = cmd.substring(0, p);
-      cmd = cmd.substring(p + 1);
+function openValve () {
+  command("valves/V1", true, {
+    status: "valves/V1_state",
+    expect: "open",
+    timeout: 2000,
+    onAck: function (value) {
+      log("valve: {}", value);
     }
-    log("cmdWithOutput: " + cmd);
-    runShellCommand(cmd, options);
-  }
-});
+  });
+}
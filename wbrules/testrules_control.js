@@ -0,0 +1,8 @@
+// -*- mode: js2-mode -*-
+
+defineRule("switchLogger", {
+  whenChanged: "somedev/sw",
+  then: function (newValue) {
+    log("sw: {}", newValue);
+  }
+});
@@ -0,0 +1,26 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("dynDev", {
+  title: "Dynamic Controls",
+  cells: {
+    enabled: {
+      type: "switch",
+      value: false
+    }
+  }
+});
+
+defineRule("zoneChanged", {
+  whenChanged: "dynDev/zone1",
+  then: function (newValue) {
+    log("zone1: {}", newValue);
+  }
+});
+
+function tryControlOp (op) {
+  try {
+    op(getDevice("dynDev"));
+  } catch (e) {
+    log("error: {}", e.message);
+  }
+}
@@ -11,3 +11,10 @@ defineRule("crontest_daily", {
     log("@daily rule fired");
   }
 });
+
+defineRule("crontest_weekdays", {
+  cron: "0 30 7 * * 1-5",
+  then: function () {
+    log("weekday rule fired");
+  }
+});
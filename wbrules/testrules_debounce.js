@@ -0,0 +1,17 @@
+// -*- mode: js2-mode -*-
+
+defineRule("debounced", {
+  whenChanged: "somedev/foo",
+  debounceMs: 500,
+  then: function (newValue, devName, cellName) {
+    log("debounced: {}/{}={}", devName, cellName, newValue);
+  }
+});
+
+defineRule("throttled", {
+  whenChanged: "somedev/bar",
+  throttleMs: "1s",
+  then: function (newValue) {
+    log("throttled: {}", newValue);
+  }
+});
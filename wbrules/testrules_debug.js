@@ -0,0 +1,16 @@
+// -*- mode: js2-mode -*-
+
+defineRule("traced", {
+  whenChanged: "somedev/temp",
+  then: function (newValue) {
+    debug("traced: {}", newValue);
+    log("traced fired");
+  }
+});
+
+defineRule("untraced", {
+  whenChanged: "somedev/temp",
+  then: function (newValue) {
+    debug("untraced: {}", newValue);
+  }
+});
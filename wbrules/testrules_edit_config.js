@@ -0,0 +1,31 @@
+// -*- mode: js2-mode -*-
+
+defineRule("scheduleChanged", {
+  onConfigChange: "schedule.json",
+  then: function (conf) {
+    log("schedule: {}", JSON.stringify(conf));
+  }
+});
+
+defineRule("setSetpoint", {
+  whenChanged: "somedev/setpoint",
+  then: function (newValue) {
+    editConfig("schedule.json", function (conf) {
+      conf.setpoint = newValue;
+    });
+  }
+});
+
+function replaceSchedule () {
+  editConfig("schedule.json", function () {
+    return { setpoint: 18 };
+  });
+}
+
+function editOutside () {
+  try {
+    editConfig("../outside.json", function (conf) {});
+  } catch (e) {
+    log("outside edit denied");
+  }
+}
@@ -0,0 +1,17 @@
+// -*- mode: js2-mode -*-
+
+defineRule("failingRule", {
+  whenChanged: "somedev/temp",
+  then: function (newValue) {
+    if (newValue > 30)
+      throw new Error("temperature too high: " + newValue);
+    log("failingRule: {}", newValue);
+  }
+});
+
+defineRule("healthyRule", {
+  whenChanged: "somedev/temp",
+  then: function (newValue) {
+    log("healthyRule: {}", newValue);
+  }
+});
@@ -0,0 +1,14 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("evaldev", {
+  cells: {
+    temp: {
+      type: "temperature",
+      value: 21
+    }
+  }
+});
+
+function failDeep() {
+  throw new Error("deep failure");
+}
@@ -0,0 +1,19 @@
+// -*- mode: js2-mode -*-
+
+features.define("newLogic");
+features.define("enabledByDefault", { enabled: true });
+
+defineRule("newLogic", {
+  asSoonAs: function () {
+    return features.isEnabled("newLogic");
+  },
+  then: function () {
+    log("new logic enabled");
+  }
+});
+
+function checkFeatures () {
+  log("enabledByDefault: {}, undefinedFeature: {}",
+      features.isEnabled("enabledByDefault"),
+      features.isEnabled("undefinedFeature"));
+}
@@ -0,0 +1,10 @@
+// -*- mode: js2-mode -*-
+
+glitchFilter("gpio/in1", "50ms");
+
+defineRule("in1Changed", {
+  whenChanged: "gpio/in1",
+  then: function (newValue) {
+    log("in1: {}", newValue);
+  }
+});
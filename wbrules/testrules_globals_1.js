@@ -0,0 +1,17 @@
+// -*- mode: js2-mode -*-
+
+var counter = 1;
+
+function describe () {
+  return "globals_1: " + counter;
+}
+
+// assignments without 'var' still create global variables
+sharedValue = "set by globals_1";
+
+defineRule("globals1", {
+  whenChanged: "somedev/temp",
+  then: function () {
+    log(describe());
+  }
+});
@@ -0,0 +1,14 @@
+// -*- mode: js2-mode -*-
+
+var counter = 2;
+
+function describe () {
+  return "globals_2: " + counter;
+}
+
+defineRule("globals2", {
+  whenChanged: "somedev/temp",
+  then: function () {
+    log("{}, {}", describe(), sharedValue);
+  }
+});
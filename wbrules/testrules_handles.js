@@ -0,0 +1,69 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("handles", {
+  title: "Rule Handle Test",
+  cells: {
+    trigger: {
+      type: "switch",
+      value: false
+    },
+    cmd: {
+      type: "text",
+      value: ""
+    }
+  }
+});
+
+var logger = defineRule({
+  whenChanged: "handles/trigger",
+  then: function (newValue) {
+    log("trigger: {}", newValue);
+  }
+});
+
+var oneShot = defineRule({
+  whenChanged: "handles/trigger",
+  then: function () {
+    log("one shot");
+    oneShot.destroy();
+  }
+});
+
+defineRule("never", {
+  when: function () {
+    return false;
+  },
+  then: function (newValue) {
+    log("never: {}", newValue);
+  }
+});
+
+defineRule("control", {
+  whenChanged: "handles/cmd",
+  then: function (newValue) {
+    try {
+      switch (newValue) {
+      case "enable":
+        logger.enable();
+        break;
+      case "disable":
+        logger.disable();
+        break;
+      case "run":
+        logger.run();
+        break;
+      case "destroy":
+        oneShot.destroy();
+        break;
+      case "check":
+        log("fired: {}", logger.check());
+        break;
+      case "runRule":
+        runRule("never");
+        break;
+      }
+    } catch (e) {
+      log("{} failed", newValue);
+    }
+  }
+});
@@ -0,0 +1,20 @@
+// -*- mode: js2-mode -*-
+
+defineRule("pump controller", {
+  whenChanged: "somedev/pump",
+  then: function (newValue) {
+    log("pump: {}", newValue);
+  }
+});
+
+function guardPump () {
+  defineHeartbeatGuard({
+    expect: ["pump controller fired within 10s", "somedev/temp changed within 5s"],
+    onMiss: function (expectation) {
+      log("failsafe: {}", expectation);
+    },
+    onRestore: function (expectation) {
+      log("back to normal: {}", expectation);
+    }
+  });
+}
@@ -0,0 +1,14 @@
+// -*- mode: js2-mode -*-
+
+function defineWatcher (cellName) {
+  defineRule("watcher", {
+    when: function () {
+      return dev.somedev[cellName] > 100;
+    },
+    then: function () {
+      log("watcher fired: {}", cellName);
+    }
+  });
+}
+
+defineWatcher("temp");
@@ -0,0 +1,10 @@
+// -*- mode: js2-mode -*-
+
+defineRule("watcher", {
+  when: function () {
+    return dev.somedev.sw;
+  },
+  then: function () {
+    log("watcher fired: sw");
+  }
+});
@@ -0,0 +1,17 @@
+// -*- mode: js2-mode -*-
+
+defineRule("warm", {
+  when: function () {
+    return dev.somedev.temp > 20;
+  },
+  then: function () {
+    log("warm: {}", dev.somedev.temp);
+  }
+});
+
+defineRule("tempChanged", {
+  whenChanged: "somedev/temp",
+  then: function (newValue) {
+    log("temp changed: {}", newValue);
+  }
+});
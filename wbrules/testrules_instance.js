@@ -0,0 +1,12 @@
+// -*- mode: js2-mode -*-
+
+features.define("eco");
+
+defineRule("eco", {
+  whenChanged: function () {
+    return features.isEnabled("eco");
+  },
+  then: function (newValue) {
+    log("eco: {}", newValue);
+  }
+});
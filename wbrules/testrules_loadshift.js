@@ -0,0 +1,11 @@
+// -*- mode: js2-mode -*-
+
+defineLoadShifting("energy", {
+  tariffs: [
+    { from: "23:00", to: "07:00", price: 2 },
+    { from: 7, to: 23, price: 6 }
+  ],
+  appliances: {
+    pump: { power: 1, hours: 24, control: "somedev/pump" }
+  }
+});
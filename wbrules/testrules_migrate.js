@@ -0,0 +1,20 @@
+// -*- mode: js2-mode -*-
+
+// migrations may be defined out of order
+storage.migrate(1, function () {
+  storage.set("thermostat/v2", "setpoint", {
+    value: storage.get("thermostat", "setpoint"),
+    unit: "C"
+  });
+  storage.set("thermostat", "setpoint", null);
+});
+
+storage.migrate(0, function () {
+  // the values used to be saved as strings
+  storage.keys("thermostat").forEach(function (key) {
+    storage.set("thermostat", key, parseFloat(storage.get("thermostat", key)));
+  });
+});
+
+var setpoint = storage.get("thermostat/v2", "setpoint");
+log("setpoint: {} {}, version: {}", setpoint.value, setpoint.unit, storage.version);
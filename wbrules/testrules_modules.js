@@ -0,0 +1,10 @@
+// -*- mode: js2-mode -*-
+
+function tryRequire (id) {
+  try {
+    return require(id);
+  } catch (e) {
+    log("error: {}", e.message);
+    return null;
+  }
+}
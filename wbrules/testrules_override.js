@@ -0,0 +1,22 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("heating", {
+  cells: {
+    setpoint: {
+      type: "temperature",
+      value: 20
+    }
+  }
+});
+
+var partyMode = null;
+
+function startParty () {
+  partyMode = override("heating/setpoint", 23, { for: "2h" });
+  log("overridden: {}", override.isActive("heating/setpoint"));
+}
+
+function stopParty () {
+  log("cancelled: {}", partyMode.cancel());
+  log("overridden: {}", override.isActive("heating/setpoint"));
+}
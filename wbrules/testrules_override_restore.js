@@ -0,0 +1,14 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("heating", {
+  cells: {
+    setpoint: {
+      type: "temperature",
+      value: 20
+    },
+    away: {
+      type: "temperature",
+      value: 10
+    }
+  }
+});
@@ -0,0 +1,15 @@
+// -*- mode: js2-mode -*-
+
+var heating = defineParams("heating", {
+  hysteresis: 0.5,
+  nightSetback: 2,
+  enabled: true
+}, { title: "Heating settings" });
+
+defineRule("heatingHysteresis", {
+  whenChanged: "heating/hysteresis",
+  then: function () {
+    log("hysteresis: {}, setback: {}, enabled: {}",
+        heating.hysteresis, heating.nightSetback, heating.enabled);
+  }
+});
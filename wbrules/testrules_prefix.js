@@ -0,0 +1,25 @@
+// -*- mode: js2-mode -*-
+
+var hvac = useDevicePrefix("hvac");
+
+defineVirtualDevice("settings", {
+  cells: {
+    setpoint: {
+      type: "value",
+      value: 21
+    }
+  }
+});
+
+var hvacParams = defineParams("params", { hysteresis: 1 });
+
+defineRule("hvacSetpoint", {
+  whenChanged: hvac("settings/setpoint"),
+  then: function (newValue) {
+    log("hvac setpoint: {}", newValue);
+  }
+});
+
+function checkPrefixedNames () {
+  log("{} {} {}", hvac("settings"), dev[hvac("settings/setpoint")], hvacParams.hysteresis);
+}
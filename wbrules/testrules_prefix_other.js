@@ -0,0 +1,15 @@
+// -*- mode: js2-mode -*-
+
+// the prefix of the other script doesn't apply here
+defineVirtualDevice("settings", {
+  cells: {
+    setpoint: {
+      type: "value",
+      value: 5
+    }
+  }
+});
+
+function checkUnprefixedNames () {
+  log("settings/setpoint: {}", dev["settings/setpoint"]);
+}
@@ -0,0 +1,19 @@
+// -*- mode: js2-mode -*-
+
+profile.rooms.forEach(function (room) {
+  defineRule("lights_" + room, {
+    whenChanged: room + "/motion",
+    then: function (newValue) {
+      log("{}: motion {} at {}", room, newValue, profile.site);
+    }
+  });
+});
+
+function tryToModifyProfile () {
+  profile.site = "other";
+  profile.rooms.push("attic");
+  profile.wiring.heater = "relay2/K1";
+  log("site: {}, rooms: {}, heater: {}, hwRevision: {}",
+      profile.site, profile.rooms.join(","), profile.wiring.heater,
+      profile.hwRevision);
+}
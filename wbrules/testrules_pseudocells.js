@@ -0,0 +1,17 @@
+// -*- mode: js2-mode -*-
+
+defineRule("pdevComplete", {
+  asSoonAs: function () {
+    return dev["pdev/#complete"];
+  },
+  then: function () {
+    log("pdev complete");
+  }
+});
+
+defineRule("pdevActivity", {
+  whenChanged: "pdev/#lastUpdate",
+  then: function (newValue) {
+    log("pdev updated: {}", newValue > 0);
+  }
+});
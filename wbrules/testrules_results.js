@@ -0,0 +1,32 @@
+// -*- mode: js2-mode -*-
+
+defineRule("tempStatus", {
+  whenChanged: "somedev/temp",
+  then: function (newValue, devName, cellName) {
+    log("tempStatus fired: {}", newValue);
+    return {
+      temp: newValue,
+      high: newValue > 20,
+      source: [ devName, cellName ]
+    };
+  }
+});
+
+defineRule("noResult", {
+  whenChanged: "somedev/sw",
+  then: function () {
+    log("noResult fired");
+  }
+});
+
+defineRule("levelStatus", {
+  whenChanged: function () {
+    return {
+      status: dev.somedev.level > 20 ? "high" : "low",
+      limits: [ 0, 20 ]
+    };
+  },
+  then: function (newValue) {
+    log("levelStatus: {}", newValue.status);
+  }
+});
@@ -0,0 +1,42 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("bundleDev", {
+  cells: {
+    out: {
+      type: "switch",
+      value: false
+    }
+  }
+});
+
+defineRule("bundleRule", {
+  whenChanged: "somedev/temp",
+  then: function (newValue) {
+    dev["bundleDev/out"] = newValue > 20;
+    try {
+      dev["somedev/sw"] = true;
+    } catch (e) {
+      log("write denied");
+    }
+    try {
+      spawn("echo", ["abc"]);
+    } catch (e) {
+      log("spawn denied");
+    }
+    try {
+      publish("/somewhere", "abc");
+    } catch (e) {
+      log("publish denied");
+    }
+    try {
+      readConfig("/etc/wb-rules.conf");
+    } catch (e) {
+      log("readConfig denied");
+    }
+    try {
+      trackMqtt("/devices/#", function () {});
+    } catch (e) {
+      log("trackMqtt denied");
+    }
+  }
+});
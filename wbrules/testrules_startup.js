@@ -0,0 +1,20 @@
+// -*- mode: js2-mode -*-
+
+defineRule("heater", {
+  when: function () {
+    return dev.somedev.temp < 20;
+  },
+  then: function () {
+    log("heater fired");
+  }
+});
+
+defineRule("critical", {
+  asSoonAs: function () {
+    return dev.somedev.temp < 20;
+  },
+  ignoreStartupDelay: true,
+  then: function () {
+    log("critical fired");
+  }
+});
@@ -0,0 +1,8 @@
+// -*- mode: js2-mode -*-
+
+defineRule("switchesTemp", {
+  whenChanged: "somedev/temp",
+  then: function (newValue) {
+    log("temp: {}", newValue);
+  }
+});
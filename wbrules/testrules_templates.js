@@ -0,0 +1,35 @@
+// -*- mode: js2-mode -*-
+
+createDevice.defineTemplate("testdev", {
+  title: "Test Device",
+  cells: {
+    sw: {
+      type: "switch",
+      value: false
+    },
+    temp10: {
+      type: "temperature",
+      value: 0,
+      readonly: true,
+      sourceCell: "temp",
+      fromSource: function (v) {
+        return v * 10;
+      }
+    }
+  }
+});
+
+createDevice.fromTemplate("testdev", "mirror", { source: "somedev" });
+createDevice.fromTemplate("wb-mr3", "relays", { title: "Relays" });
+
+function listTemplates () {
+  log("templates: {}", createDevice.templates.join(", "));
+}
+
+function badTemplate () {
+  try {
+    createDevice.fromTemplate("nosuchtemplate", "zzz");
+  } catch (e) {
+    log("error: {}", e.message);
+  }
+}
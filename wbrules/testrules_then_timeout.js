@@ -0,0 +1,34 @@
+// -*- mode: js2-mode -*-
+
+// Date.now() is provided by the engine, so each call would
+// check the then timeout. new Date() doesn't call the engine,
+// so the timeout isn't checked inside the loop.
+function busyWait (ms) {
+  var start = new Date().getTime();
+  while (new Date().getTime() - start < ms);
+}
+
+defineRule("interruptedRule", {
+  whenChanged: "somedev/slow",
+  thenTimeoutMs: 10,
+  then: function () {
+    busyWait(50);
+    log("not reached");
+  }
+});
+
+defineRule("slowRule", {
+  whenChanged: "somedev/slow",
+  thenTimeoutMs: 10,
+  then: function () {
+    busyWait(50);
+  }
+});
+
+defineRule("fastRule", {
+  whenChanged: "somedev/slow",
+  thenTimeoutMs: 1000,
+  then: function () {
+    log("fastRule fired");
+  }
+});
@@ -0,0 +1,16 @@
+// -*- mode: js2-mode -*-
+
+setInterval(function () {
+  log("interval fired");
+}, 1000);
+
+startTimer("toplevel", 5000);
+
+defineRule("toplevelTimer", {
+  when: function () {
+    return timers.toplevel.firing;
+  },
+  then: function () {
+    log("toplevel timer fired");
+  }
+});
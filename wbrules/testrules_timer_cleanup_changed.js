@@ -0,0 +1,5 @@
+// -*- mode: js2-mode -*-
+
+// the timers started by the previous version of the
+// script must be stopped when it's reloaded
+log("reloaded");
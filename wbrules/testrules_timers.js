@@ -130,3 +130,23 @@ defineRule("shortTimers", {
     startTicker("someticker1", -1);
   }
 });
+
+defineRule("restartTimer", {
+  asSoonAs: function () {
+    return dev.somedev.foo == "r";
+  },
+  then: function () {
+    log("restarted: {}", timers.sometimer.restart());
+  }
+});
+
+defineRule("timerState", {
+  asSoonAs: function () {
+    return dev.somedev.foo == "q";
+  },
+  then: function () {
+    var remaining = timers.sometimer.remaining;
+    log("running: {}, remaining ok: {}", timers.sometimer.running,
+        timers.sometimer.running ? remaining > 0 && remaining <= 500 : remaining == 0);
+  }
+});
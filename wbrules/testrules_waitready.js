@@ -0,0 +1,20 @@
+// -*- mode: js2-mode -*-
+
+defineRule("remoteTemp", {
+  whenChanged: "remote/temp",
+  then: function (newValue) {
+    log("remote temp: {}", newValue);
+  }
+});
+
+defineRule("hourly", {
+  when: cron("@hourly"),
+  waitReady: true,
+  then: function () {
+    log("hourly");
+  }
+});
+
+setTimeoutWhenReady(function (options) {
+  log("deferred timeout: {}", JSON.stringify(options));
+}, 1000, { waitReady: true });
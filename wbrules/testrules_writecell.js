@@ -0,0 +1,22 @@
+// -*- mode: js2-mode -*-
+
+defineVirtualDevice("heating", {
+  cells: {
+    setpoint: {
+      type: "temperature",
+      value: 20
+    },
+    current: {
+      type: "temperature",
+      value: 18,
+      readonly: true
+    }
+  }
+});
+
+defineRule("setpointChanged", {
+  whenChanged: "heating/setpoint",
+  then: function (newValue) {
+    log("setpoint changed: {}", newValue);
+  }
+});
@@ -0,0 +1,74 @@
+package wbrules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	durationRx    = regexp.MustCompile(`(\d+(?:\.\d+)?)(ms|s|m|h|d)`)
+	byteSizeRx    = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-zA-Z]*)$`)
+	durationUnits = map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+	}
+	// decimal units follow SI, binary ones follow IEC
+	byteSizeUnits = map[string]float64{
+		"":    1,
+		"b":   1,
+		"kb":  1e3,
+		"mb":  1e6,
+		"gb":  1e9,
+		"tb":  1e12,
+		"kib": 1 << 10,
+		"mib": 1 << 20,
+		"gib": 1 << 30,
+		"tib": 1 << 40,
+	}
+)
+
+// ParseDuration parses duration specs like "2h", "1h30m", "15s",
+// "500ms" or "1d". Unlike time.ParseDuration(), it supports days
+// and doesn't accept negative durations.
+func ParseDuration(spec string) (time.Duration, error) {
+	var d time.Duration
+	matched := ""
+	for _, m := range durationRx.FindAllStringSubmatch(spec, -1) {
+		v, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", spec)
+		}
+		d += time.Duration(v * float64(durationUnits[m[2]]))
+		matched += m[0]
+	}
+	if matched == "" || matched != spec {
+		return 0, fmt.Errorf("invalid duration: %s", spec)
+	}
+	return d, nil
+}
+
+// ParseByteSize parses size specs like "512", "100B", "2MB"
+// or "1.5GiB" returning the number of bytes. The units are
+// case-insensitive, KB/MB/GB/TB are decimal, KiB/MiB/GiB/TiB
+// are binary.
+func ParseByteSize(spec string) (int64, error) {
+	m := byteSizeRx.FindStringSubmatch(strings.TrimSpace(spec))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size: %s", spec)
+	}
+	unit, found := byteSizeUnits[strings.ToLower(m[2])]
+	if !found {
+		return 0, fmt.Errorf("invalid size unit: %s", spec)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", spec)
+	}
+	return int64(v * unit), nil
+}
@@ -0,0 +1,46 @@
+package wbrules
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	for spec, expected := range map[string]time.Duration{
+		"500ms":   500 * time.Millisecond,
+		"15s":     15 * time.Second,
+		"1h30m":   90 * time.Minute,
+		"1.5h":    90 * time.Minute,
+		"1d12h":   36 * time.Hour,
+		"2m500ms": 2*time.Minute + 500*time.Millisecond,
+	} {
+		d, err := ParseDuration(spec)
+		assert.NoError(t, err, spec)
+		assert.Equal(t, expected, d, spec)
+	}
+	for _, spec := range []string{"", "15", "-5s", "1h 30m", "10x", "abc"} {
+		_, err := ParseDuration(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for spec, expected := range map[string]int64{
+		"512":    512,
+		"100B":   100,
+		"2MB":    2000000,
+		"2mb":    2000000,
+		"4 KiB":  4096,
+		"1.5GiB": 3 << 29,
+		"1TB":    1000000000000,
+	} {
+		n, err := ParseByteSize(spec)
+		assert.NoError(t, err, spec)
+		assert.Equal(t, expected, n, spec)
+	}
+	for _, spec := range []string{"", "MB", "-1MB", "2XB", "1.2.3KB"} {
+		_, err := ParseByteSize(spec)
+		assert.Error(t, err, spec)
+	}
+}
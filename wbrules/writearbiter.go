@@ -0,0 +1,87 @@
+package wbrules
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	AUDIT_ACTION_OVERRIDDEN_WRITE = "OverriddenWrite"
+)
+
+// writeClaim describes the write made to a cell by a rule
+// during the current rule pass
+type writeClaim struct {
+	rule     string
+	priority int
+	value    interface{}
+}
+
+// SetAuditLog sets the audit log that receives the records
+// of rule writes overridden by higher-priority rules
+func (engine *RuleEngine) SetAuditLog(auditLog *AuditLog) {
+	engine.auditLog = auditLog
+}
+
+func (engine *RuleEngine) currentRulePriority() int {
+	if rule, found := engine.ruleMap[engine.currentRule]; found {
+		return rule.priority
+	}
+	return 0
+}
+
+// arbitrateWrite decides whether the current rule may write
+// the cell. When several rules write the same cell during a single
+// rule pass, the rule with the highest priority wins regardless
+// of the evaluation order. Among rules with equal priority, the last
+// writer wins unless write conflict handling is enabled, see
+// SetWriteConflictMode(). The overridden writes are logged
+// and recorded in the audit log.
+func (engine *RuleEngine) arbitrateWrite(cell *Cell, value interface{}) bool {
+	if engine.runDepth == 0 || engine.currentRule == "" {
+		// not a rule write
+		return true
+	}
+	claim := writeClaim{engine.currentRule, engine.currentRulePriority(), value}
+	if prev, found := engine.writeClaims[cell]; found && prev.rule != claim.rule {
+		switch {
+		case prev.priority > claim.priority:
+			engine.recordOverriddenWrite(cell, claim, prev)
+			return false
+		case prev.priority < claim.priority:
+			engine.recordOverriddenWrite(cell, prev, claim)
+		case !engine.writeConflict(cell, prev, claim):
+			return false
+		}
+	}
+	engine.writeClaims[cell] = claim
+	return true
+}
+
+func (engine *RuleEngine) recordOverriddenWrite(cell *Cell, loser, winner writeClaim) {
+	target := cell.DevName() + "/" + cell.Name()
+	reason := fmt.Sprintf("overridden by rule %s (priority %d)", winner.rule, winner.priority)
+	engine.Logf(ENGINE_LOG_WARNING, "write %s = %v by rule %s (priority %d) %s",
+		target, loser.value, loser.rule, loser.priority, reason)
+	if engine.auditLog == nil {
+		return
+	}
+	err := engine.auditLog.Record(AuditRecord{
+		Time:     time.Now(),
+		Identity: "rule:" + loser.rule,
+		Action:   AUDIT_ACTION_OVERRIDDEN_WRITE,
+		Target:   target,
+		Value:    loser.value,
+		Reason:   reason,
+	})
+	if err != nil {
+		engine.Logf(ENGINE_LOG_ERROR, "error writing audit log: %s", err)
+	}
+}
+
+// clearWriteClaims is invoked after the outermost rule pass
+func (engine *RuleEngine) clearWriteClaims() {
+	for cell := range engine.writeClaims {
+		delete(engine.writeClaims, cell)
+	}
+}
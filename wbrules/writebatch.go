@@ -0,0 +1,45 @@
+package wbrules
+
+const (
+	WRITE_BATCH_CAPACITY = 16
+)
+
+// writeBatch collects cell writes made during a single rule pass
+// so that only the final value of each cell is published
+// after the pass completes. Cells are published in the order
+// of their first write.
+type writeBatch struct {
+	values map[*Cell]string
+	order  []*Cell
+	// onSuppress is invoked for each intermediate
+	// value that's not going to be published
+	onSuppress func(cell *Cell, value string)
+}
+
+func newWriteBatch() *writeBatch {
+	return &writeBatch{
+		values: make(map[*Cell]string),
+		order:  make([]*Cell, 0, WRITE_BATCH_CAPACITY),
+	}
+}
+
+func (batch *writeBatch) add(cell *Cell, value interface{}) {
+	newValue := cell.setValueDeferred(value)
+	if oldValue, found := batch.values[cell]; found {
+		if batch.onSuppress != nil {
+			batch.onSuppress(cell, oldValue)
+		}
+	} else {
+		batch.order = append(batch.order, cell)
+	}
+	batch.values[cell] = newValue
+}
+
+func (batch *writeBatch) flush() {
+	for _, cell := range batch.order {
+		value := batch.values[cell]
+		delete(batch.values, cell)
+		cell.publishValue(value)
+	}
+	batch.order = batch.order[:0]
+}